@@ -0,0 +1,31 @@
+package main
+
+import (
+	"os"
+
+	"github.com/rfjakob/gocryptfs/internal/exitcodes"
+	"github.com/rfjakob/gocryptfs/internal/fusefrontend"
+	"github.com/rfjakob/gocryptfs/internal/tlog"
+)
+
+// checkFile handles "gocryptfs -check_file PATH CIPHERDIR". It decrypts every
+// block of the single file PATH, relative to the root of the mount, without
+// mounting. This is a quick subset of "-fsck".
+//
+// Returns the exit code.
+func checkFile(args *argContainer) int {
+	if args.reverse {
+		tlog.Fatal.Printf("-check_file cannot be used together with -reverse")
+		os.Exit(exitcodes.Usage)
+	}
+	pfs, wipeKeys := initFuseFrontend(args)
+	defer wipeKeys()
+	rn := pfs.(*fusefrontend.RootNode)
+	stats, err := rn.CheckFile(args.check_file)
+	if err != nil {
+		tlog.Warn.Printf("check_file: %s: %v", args.check_file, err)
+		return exitcodes.FsckErrors
+	}
+	tlog.Info.Printf(tlog.ColorGreen+"check_file: %s: %d blocks ok"+tlog.ColorReset, args.check_file, stats.Blocks)
+	return 0
+}
@@ -10,6 +10,8 @@ import (
 	"fmt"
 	"net"
 	"os"
+	"path/filepath"
+	"runtime"
 	"strconv"
 	"strings"
 	"time"
@@ -17,7 +19,10 @@ import (
 	"github.com/hanwen/go-fuse/v2/fuse"
 
 	"github.com/rfjakob/gocryptfs/internal/configfile"
+	"github.com/rfjakob/gocryptfs/internal/cryptocore"
 	"github.com/rfjakob/gocryptfs/internal/exitcodes"
+	"github.com/rfjakob/gocryptfs/internal/fusefrontend"
+	"github.com/rfjakob/gocryptfs/internal/nametransform"
 	"github.com/rfjakob/gocryptfs/internal/stupidgcm"
 	"github.com/rfjakob/gocryptfs/internal/tlog"
 )
@@ -28,11 +33,12 @@ type argContainer struct {
 	plaintextnames, quiet, nosyslog, wpanic,
 	longnames, allow_other, reverse, aessiv, nonempty, raw64,
 	noprealloc, speed, hkdf, serialize_reads, forcedecode, hh, info,
-	sharedstorage, devrandom, fsck bool
+	sharedstorage, devrandom, fsck, quarantine, encryptacl, unlockcheck, journal, timeout_depth, fanout, filetags, trash, warn_clock_skew, wipe, contenthash,
+	filehash, verifyhash, allow_nested, aligned_writes, unmount_stale, writebuffer, rotate_fileids, compact, noprobe, json, sparse, journald, require_encrypted_volume, export_tar, import_hardlinks, noatime, add_key, remove_key, selftest bool
 	// Mount options with opposites
-	dev, nodev, suid, nosuid, exec, noexec, rw, ro, kernel_cache bool
+	dev, nodev, suid, nosuid, exec, noexec, rw, ro, kernel_cache, direct_io bool
 	masterkey, mountpoint, cipherdir, cpuprofile,
-	memprofile, ko, ctlsock, fsname, force_owner, trace, fido2 string
+	memprofile, ko, ctlsock, fsname, force_owner, trace, fido2, optrace, snapshot, importdir, tmpdir, prefix, user_prefix, webdav, webdav_auth, webdav_cert, webdav_key, syslog_tag, unexpected, timestamps, lowerdir, keyagent, keyagent_serve, check_file, metrics string
 	// -extpass, -badname, -passfile can be passed multiple times
 	extpass, badname, passfile multipleStrings
 	// For reverse mode, several ways to specify exclusions. All can be specified multiple times.
@@ -40,8 +46,33 @@ type argContainer struct {
 	// Configuration file name override
 	config             string
 	notifypid, scryptn int
+	// Configuration file name override that only applies with -reverse
+	reverse_config string
+	// -selftest_seed, zero means random
+	selftest_seed int64
+	// Master key length in bytes for -init
+	masterkey_len int
+	// Encoding of the encrypted file names for -init
+	name_encoding string
+	// Bandwidth limit in MB/s, 0 means unlimited
+	bwlimit int
+	// Maximum total plaintext size in MiB, 0 means unlimited
+	quota int
+	// Maximum number of open files, 0 means unlimited
+	max_open int
+	// Maximum number of FUSE requests processed at the same time, 0 means
+	// unlimited
+	concurrency int
 	// Idle time before autounmount
 	idle time.Duration
+	// Interval for checking backing files for external changes
+	watch_backing time.Duration
+	// Window for coalescing fsyncs
+	fsync_batch time.Duration
+	// Kernel cache timeouts
+	entry_timeout, attr_timeout time.Duration
+	// Timeout for backing file I/O
+	io_timeout time.Duration
 	// Helper variables that are NOT cli options all start with an underscore
 	// _configCustom is true when the user sets a custom config file name.
 	_configCustom bool
@@ -49,6 +80,8 @@ type argContainer struct {
 	_ctlsockFd net.Listener
 	// _forceOwner is, if non-nil, a parsed, validated Owner (as opposed to the string above)
 	_forceOwner *fuse.Owner
+	// _userPrefixes is the parsed "-user_prefix" file
+	_userPrefixes map[uint32]string
 	// _explicitScryptn is true then the user passed "-scryptn=xyz"
 	_explicitScryptn bool
 }
@@ -143,6 +176,8 @@ func parseCliOpts() (args argContainer) {
 	// Tri-state true/false/auto
 	flagSet.StringVar(&opensslAuto, "openssl", "auto", "Use OpenSSL instead of built-in Go crypto")
 	flagSet.BoolVar(&args.passwd, "passwd", false, "Change password")
+	flagSet.BoolVar(&args.add_key, "add_key", false, "Add another password that unlocks the filesystem")
+	flagSet.BoolVar(&args.remove_key, "remove_key", false, "Remove one of the passwords that unlock the filesystem")
 	flagSet.BoolVar(&args.fg, "f", false, "")
 	flagSet.BoolVar(&args.fg, "fg", false, "Stay in the foreground")
 	flagSet.BoolVar(&args.version, "version", false, "Print version and exit")
@@ -150,23 +185,57 @@ func parseCliOpts() (args argContainer) {
 	flagSet.BoolVar(&args.quiet, "q", false, "")
 	flagSet.BoolVar(&args.quiet, "quiet", false, "Quiet - silence informational messages")
 	flagSet.BoolVar(&args.nosyslog, "nosyslog", false, "Do not redirect output to syslog when running in the background")
+	flagSet.BoolVar(&args.journald, "journald", false, "Send log messages to journald once mounted, also when running in the foreground")
+	flagSet.StringVar(&args.syslog_tag, "syslog_tag", tlog.ProgramName, "Tag of syslog messages and SYSLOG_IDENTIFIER of journald messages")
 	flagSet.BoolVar(&args.wpanic, "wpanic", false, "When encountering a warning, panic and exit immediately")
 	flagSet.BoolVar(&args.longnames, "longnames", true, "Store names longer than 176 bytes in extra files")
 	flagSet.BoolVar(&args.allow_other, "allow_other", false, "Allow other users to access the filesystem. "+
 		"Only works if user_allow_other is set in /etc/fuse.conf.")
 	flagSet.BoolVar(&args.reverse, "reverse", false, "Reverse mode")
 	flagSet.BoolVar(&args.aessiv, "aessiv", false, "AES-SIV encryption")
+	flagSet.BoolVar(&args.fanout, "fanout", false, "Spread directory entries over bucket directories (with -init)")
+	flagSet.BoolVar(&args.filetags, "filetags", false, "Reserve an encrypted region for file tags in each file header (with -init)")
 	flagSet.BoolVar(&args.nonempty, "nonempty", false, "Allow mounting over non-empty directories")
+	flagSet.BoolVar(&args.unmount_stale, "unmount_stale", false, "Lazily unmount a stale FUSE mount left on the mountpoint by a crashed process")
 	flagSet.BoolVar(&args.raw64, "raw64", true, "Use unpadded base64 for file names")
 	flagSet.BoolVar(&args.noprealloc, "noprealloc", false, "Disable preallocation before writing")
 	flagSet.BoolVar(&args.speed, "speed", false, "Run crypto speed test")
+	flagSet.BoolVar(&args.selftest, "selftest", false, "Round-trip random data through the block encryption and check the result")
+	flagSet.Int64Var(&args.selftest_seed, "selftest_seed", 0, "Seed for -selftest, to repeat a run. Default random")
 	flagSet.BoolVar(&args.hkdf, "hkdf", true, "Use HKDF as an additional key derivation step")
 	flagSet.BoolVar(&args.serialize_reads, "serialize_reads", false, "Try to serialize read operations")
 	flagSet.BoolVar(&args.forcedecode, "forcedecode", false, "Force decode of files even if integrity check fails."+
 		" Requires gocryptfs to be compiled with openssl support and implies -openssl true")
 	flagSet.BoolVar(&args.hh, "hh", false, "Show this long help text")
 	flagSet.BoolVar(&args.info, "info", false, "Display information about CIPHERDIR")
+	flagSet.BoolVar(&args.unlockcheck, "unlockcheck", false, "Check if the password is correct for CIPHERDIR, without mounting")
 	flagSet.BoolVar(&args.sharedstorage, "sharedstorage", false, "Make concurrent access to a shared CIPHERDIR safer")
+	flagSet.BoolVar(&args.quarantine, "quarantine", false, "List undecryptable entries as \".corrupt.CIPHERNAME\" instead of hiding them")
+	flagSet.BoolVar(&args.trash, "trash", false, "Move deleted files into a hidden trash directory instead of deleting them")
+	flagSet.BoolVar(&args.wipe, "wipe", false, "Overwrite the backing file of a deleted file with random data before deleting it")
+	flagSet.BoolVar(&args.contenthash, "contenthash", false, "Provide the SHA256 of the plaintext as the read-only xattr \"user.gocryptfs.contenthash\"")
+	flagSet.BoolVar(&args.warn_clock_skew, "warn_clock_skew", false, "Warn when a file is written with an older mtime than "+
+		"files written before it in the same directory")
+	flagSet.StringVar(&args.unexpected, "unexpected", "show", "What to do with files that have no valid header: show or hide")
+	flagSet.StringVar(&args.timestamps, "timestamps", "normal", "Timestamp privacy: normal, freeze (report the epoch) or nopropagate (keep CIPHERDIR times unchanged)")
+	flagSet.BoolVar(&args.encryptacl, "encryptacl", false, "Encrypt POSIX ACLs instead of passing them through to CIPHERDIR. Turns off ACL enforcement")
+	flagSet.BoolVar(&args.aligned_writes, "aligned_writes", false, "UNSAFE: reject writes not aligned to 4096 bytes to skip read-modify-write")
+	flagSet.BoolVar(&args.json, "json", false, "Print a JSON summary of the new filesystem to stdout (with -init)")
+	flagSet.BoolVar(&args.noprobe, "noprobe", false, "Do not check if the filesystem CIPHERDIR is on supports what gocryptfs needs")
+	flagSet.BoolVar(&args.require_encrypted_volume, "require_encrypted_volume", false, "Refuse to mount unless CIPHERDIR is on an encrypted volume (LUKS, FileVault)")
+	flagSet.BoolVar(&args.writebuffer, "writebuffer", false, "Collect small sequential writes into whole blocks before encrypting")
+	flagSet.BoolVar(&args.sparse, "sparse", false, "Store all-zero blocks as file holes instead of encrypting them")
+	flagSet.BoolVar(&args.allow_nested, "allow_nested", false, "Allow CIPHERDIR inside a gocryptfs mount (double encryption)")
+	flagSet.BoolVar(&args.filehash, "filehash", false, "Store a checksum of each written file for -verifyhash")
+	flagSet.BoolVar(&args.verifyhash, "verifyhash", false, "Check the checksums stored by -filehash")
+	flagSet.BoolVar(&args.export_tar, "export_tar", false, "Write the plaintext contents of CIPHERDIR as a tar stream to stdout, without mounting")
+	flagSet.BoolVar(&args.rotate_fileids, "rotate_fileids", false, "Re-encrypt all files in CIPHERDIR with new random file IDs, without mounting")
+	flagSet.BoolVar(&args.compact, "compact", false, "Rewrite all files in CIPHERDIR so that their blocks are stored contiguously, without mounting")
+	flagSet.StringVar(&args.webdav, "webdav", "", "Serve the plaintext view of CIPHERDIR over WebDAV at the specified address, without mounting")
+	flagSet.StringVar(&args.webdav_auth, "webdav_auth", "", "File with USER:PASSWORD for -webdav clients")
+	flagSet.StringVar(&args.webdav_cert, "webdav_cert", "", "TLS certificate file for -webdav. Serve HTTPS instead of HTTP")
+	flagSet.StringVar(&args.webdav_key, "webdav_key", "", "TLS private key file for -webdav_cert")
+	flagSet.BoolVar(&args.journal, "journal", false, "Keep a journal of written blocks so that interrupted writes can be resumed")
 	flagSet.BoolVar(&args.devrandom, "devrandom", false, "Use /dev/random for generating master key")
 	flagSet.BoolVar(&args.fsck, "fsck", false, "Run a filesystem check on CIPHERDIR")
 
@@ -180,23 +249,41 @@ func parseCliOpts() (args argContainer) {
 	flagSet.BoolVar(&args.rw, "rw", false, "Mount the filesystem read-write")
 	flagSet.BoolVar(&args.ro, "ro", false, "Mount the filesystem read-only")
 	flagSet.BoolVar(&args.kernel_cache, "kernel_cache", false, "Enable the FUSE kernel_cache option")
+	flagSet.BoolVar(&args.direct_io, "direct_io", false, "Bypass the kernel page cache for file content")
+	flagSet.BoolVar(&args.noatime, "noatime", false, "Do not update the atime of files in CIPHERDIR when reading through the mount")
 
 	flagSet.StringVar(&args.masterkey, "masterkey", "", "Mount with explicit master key")
 	flagSet.StringVar(&args.cpuprofile, "cpuprofile", "", "Write cpu profile to specified file")
 	flagSet.StringVar(&args.memprofile, "memprofile", "", "Write memory profile to specified file")
 	flagSet.StringVar(&args.config, "config", "", "Use specified config file instead of CIPHERDIR/gocryptfs.conf")
+	flagSet.StringVar(&args.reverse_config, "reverse_config", "", "Use specified config file instead of CIPHERDIR/.gocryptfs.reverse.conf in reverse mode")
 	flagSet.StringVar(&args.ko, "ko", "", "Pass additional options directly to the kernel, comma-separated list")
 	flagSet.StringVar(&args.ctlsock, "ctlsock", "", "Create control socket at specified path")
 	flagSet.StringVar(&args.fsname, "fsname", "", "Override the filesystem name")
 	flagSet.StringVar(&args.force_owner, "force_owner", "", "uid:gid pair to coerce ownership")
 	flagSet.StringVar(&args.trace, "trace", "", "Write execution trace to file")
+	flagSet.BoolVar(&args.import_hardlinks, "import_hardlinks", false, "Recreate hard links with -import instead of importing each name as a separate file")
+	flagSet.StringVar(&args.importdir, "import", "", "Encrypt the directory tree at the specified path into CIPHERDIR, without mounting")
+	flagSet.StringVar(&args.snapshot, "snapshot", "", "Copy CIPHERDIR to the specified path, using reflinks if possible")
+	flagSet.StringVar(&args.name_encoding, "name_encoding", nametransform.EncodingBase64URL, "Encoding of encrypted file names (with -init): "+
+		nametransform.EncodingBase64URL+", "+nametransform.EncodingBase32+", or a custom alphabet of 32 or 64 characters")
+	flagSet.StringVar(&args.optrace, "optrace", "", "Write a replayable log of FUSE operations (without plaintext) to file")
+	flagSet.StringVar(&args.metrics, "metrics", "", "Serve operation counters in Prometheus format at http://ADDR/metrics")
 	flagSet.StringVar(&args.fido2, "fido2", "", "Protect the masterkey using a FIDO2 token instead of a password")
+	flagSet.StringVar(&args.prefix, "prefix", "", "Mount the specified plaintext subdirectory as the root")
+	flagSet.StringVar(&args.user_prefix, "user_prefix", "", "File mapping uids to the plaintext subdirectory that is their root of the mount")
+	flagSet.StringVar(&args.lowerdir, "lowerdir", "", "Read-only cipherdir with the same key to merge below CIPHERDIR")
+	flagSet.StringVar(&args.keyagent, "keyagent", "", "Get the master key from the -keyagent_serve agent at the specified socket instead of asking for the password")
+	flagSet.StringVar(&args.keyagent_serve, "keyagent_serve", "", "Unlock CIPHERDIR and serve its master key on the specified socket for -keyagent")
+	flagSet.StringVar(&args.check_file, "check_file", "", "Decrypt every block of the specified file to check its integrity")
+	flagSet.StringVar(&args.tmpdir, "tmpdir", "", "Write the temporary file for config file updates to "+
+		"this directory instead of next to the config file")
 
 	// Exclusion options
 	flagSet.Var(&args.exclude, "e", "Alias for -exclude")
-	flagSet.Var(&args.exclude, "exclude", "Exclude relative path from reverse view")
+	flagSet.Var(&args.exclude, "exclude", "Exclude relative path from reverse view, -fsck and -import")
 	flagSet.Var(&args.excludeWildcard, "ew", "Alias for -exclude-wildcard")
-	flagSet.Var(&args.excludeWildcard, "exclude-wildcard", "Exclude path from reverse view, supporting wildcards")
+	flagSet.Var(&args.excludeWildcard, "exclude-wildcard", "Exclude path from reverse view, -fsck and -import, supporting wildcards")
 	flagSet.Var(&args.excludeFrom, "exclude-from", "File from which to read exclusion patterns (with -exclude-wildcard syntax)")
 
 	// multipleStrings options ([]string)
@@ -206,13 +293,33 @@ func parseCliOpts() (args argContainer) {
 
 	flagSet.IntVar(&args.notifypid, "notifypid", 0, "Send USR1 to the specified process after "+
 		"successful mount - used internally for daemonization")
+	flagSet.IntVar(&args.masterkey_len, "masterkey_len", cryptocore.KeyLen, fmt.Sprintf("Master key length in bytes (with -init). Possible values: %d-%d", cryptocore.KeyLen, cryptocore.MaxKeyLen))
 	const scryptn = "scryptn"
 	flagSet.IntVar(&args.scryptn, scryptn, configfile.ScryptDefaultLogN, "scrypt cost parameter logN. Possible values: 10-28. "+
 		"A lower value speeds up mounting and reduces its memory needs, but makes the password susceptible to brute-force attacks")
 
+	flagSet.IntVar(&args.bwlimit, "bwlimit", 0, "Limit the combined read and write bandwidth through the mount "+
+		"to this many MB/s. 0 means unlimited.")
+	flagSet.IntVar(&args.quota, "quota", 0, "Limit the total plaintext size of all files in the mount "+
+		"to this many MiB. 0 means unlimited.")
+	flagSet.IntVar(&args.max_open, "max_open", 0, "Limit the number of files open through the mount at the same time. "+
+		"0 means unlimited.")
+	flagSet.IntVar(&args.concurrency, "concurrency", 0, "Process at most this many FUSE requests at the same time. "+
+		"0 means unlimited.")
+
+	flagSet.DurationVar(&args.entry_timeout, "entry_timeout", time.Second, "How long the kernel may cache name lookups")
+	flagSet.DurationVar(&args.attr_timeout, "attr_timeout", time.Second, "How long the kernel may cache file attributes")
+	flagSet.BoolVar(&args.timeout_depth, "timeout_depth", false, "Divide -entry_timeout and -attr_timeout by the path depth")
+	flagSet.DurationVar(&args.io_timeout, "io_timeout", 0, "Fail reads and writes with ETIMEDOUT if the backing "+
+		"filesystem does not respond within this duration. 0 means wait forever.")
+
 	flagSet.DurationVar(&args.idle, "i", 0, "Alias for -idle")
 	flagSet.DurationVar(&args.idle, "idle", 0, "Auto-unmount after specified idle duration (ignored in reverse mode). "+
 		"Durations are specified like \"500s\" or \"2h45m\". 0 means stay mounted indefinitely.")
+	flagSet.DurationVar(&args.watch_backing, "watch_backing", 0, "Check backing files for external changes at this interval "+
+		"and make the kernel drop cached content of changed files (ignored in reverse mode). 0 disables the check.")
+	flagSet.DurationVar(&args.fsync_batch, "fsync_batch", 0, "Coalesce fsyncs of a file that arrive within this "+
+		"window into one backing fsync. 0 disables batching.")
 
 	var nofail bool
 	flagSet.BoolVar(&nofail, "nofail", false, "Ignored for /etc/fstab compatibility")
@@ -243,6 +350,37 @@ func parseCliOpts() (args argContainer) {
 			os.Exit(exitcodes.Usage)
 		}
 	}
+	if args.unexpected != "show" && args.unexpected != "hide" {
+		tlog.Fatal.Printf("Invalid \"-unexpected\" setting %q, must be \"show\" or \"hide\"", args.unexpected)
+		os.Exit(exitcodes.Usage)
+	}
+	switch args.timestamps {
+	case "normal", "freeze", "nopropagate":
+	default:
+		tlog.Fatal.Printf("Invalid \"-timestamps\" setting %q, must be \"normal\", \"freeze\" or \"nopropagate\"", args.timestamps)
+		os.Exit(exitcodes.Usage)
+	}
+	if args.timestamps != "normal" && args.reverse {
+		tlog.Fatal.Printf("-timestamps=%s cannot be used together with -reverse", args.timestamps)
+		os.Exit(exitcodes.Usage)
+	}
+	if args.noatime {
+		if args.reverse {
+			tlog.Fatal.Printf("-noatime cannot be used together with -reverse")
+			os.Exit(exitcodes.Usage)
+		}
+		if runtime.GOOS == "darwin" {
+			tlog.Warn.Printf("-noatime has no effect on MacOS. Mount the filesystem that CIPHERDIR is on with noatime instead.")
+		}
+	}
+	if args.direct_io && args.kernel_cache {
+		tlog.Fatal.Printf("-direct_io and -kernel_cache cannot be used together")
+		os.Exit(exitcodes.Usage)
+	}
+	if args.json && !args.init {
+		tlog.Fatal.Printf("The -json flag can only be used together with -init")
+		os.Exit(exitcodes.Usage)
+	}
 	// "-forcedecode" only works with openssl. Check compilation and command line parameters
 	if args.forcedecode == true {
 		if stupidgcm.BuiltWithoutOpenssl == true {
@@ -289,6 +427,86 @@ func parseCliOpts() (args argContainer) {
 		tlog.Fatal.Printf("Idle timeout cannot be less than 0")
 		os.Exit(exitcodes.Usage)
 	}
+	if args.concurrency < 0 {
+		tlog.Fatal.Printf("-concurrency cannot be less than 0")
+		os.Exit(exitcodes.Usage)
+	}
+	if args.syslog_tag == "" {
+		tlog.Fatal.Printf("-syslog_tag cannot be empty")
+		os.Exit(exitcodes.Usage)
+	}
+	tlog.SyslogTag = args.syslog_tag
+	if args.watch_backing < 0 {
+		tlog.Fatal.Printf("-watch_backing interval cannot be less than 0")
+		os.Exit(exitcodes.Usage)
+	}
+	if args.fsync_batch < 0 {
+		tlog.Fatal.Printf("-fsync_batch window cannot be less than 0")
+		os.Exit(exitcodes.Usage)
+	}
+	if args.bwlimit < 0 {
+		tlog.Fatal.Printf("Bandwidth limit cannot be less than 0")
+		os.Exit(exitcodes.Usage)
+	}
+	if args.quota < 0 {
+		tlog.Fatal.Printf("Quota cannot be less than 0")
+		os.Exit(exitcodes.Usage)
+	}
+	if args.max_open < 0 {
+		tlog.Fatal.Printf("-max_open cannot be less than 0")
+		os.Exit(exitcodes.Usage)
+	}
+	if args.entry_timeout < 0 || args.attr_timeout < 0 {
+		tlog.Fatal.Printf("-entry_timeout and -attr_timeout cannot be less than 0")
+		os.Exit(exitcodes.Usage)
+	}
+	if args.io_timeout < 0 {
+		tlog.Fatal.Printf("-io_timeout cannot be less than 0")
+		os.Exit(exitcodes.Usage)
+	}
+	if args.prefix != "" {
+		// "/data/2024/" and "data/2024" mean the same
+		args.prefix = strings.Trim(filepath.Clean("/"+args.prefix), "/")
+		if args.reverse {
+			tlog.Fatal.Printf("-prefix cannot be used together with -reverse")
+			os.Exit(exitcodes.Usage)
+		}
+	}
+	if args.user_prefix != "" {
+		if args.reverse {
+			tlog.Fatal.Printf("-user_prefix cannot be used together with -reverse")
+			os.Exit(exitcodes.Usage)
+		}
+		if args.watch_backing > 0 {
+			tlog.Fatal.Printf("-user_prefix cannot be used together with -watch_backing")
+			os.Exit(exitcodes.Usage)
+		}
+		if args.webdav != "" {
+			// WebDAV clients are not uids
+			tlog.Fatal.Printf("-user_prefix cannot be used together with -webdav")
+			os.Exit(exitcodes.Usage)
+		}
+		var err error
+		args._userPrefixes, err = fusefrontend.ReadUserPrefixes(args.user_prefix)
+		if err != nil {
+			tlog.Fatal.Printf("-user_prefix: %v", err)
+			os.Exit(exitcodes.Usage)
+		}
+		// The kernel caches entries and attributes per path, not per user
+		args.sharedstorage = true
+	}
+	if args.lowerdir != "" {
+		if args.reverse || args.prefix != "" || args.user_prefix != "" {
+			tlog.Fatal.Printf("-lowerdir cannot be used together with -reverse, -prefix or -user_prefix")
+			os.Exit(exitcodes.Usage)
+		}
+	}
+	if args.keyagent != "" {
+		if args.masterkey != "" || args.zerokey || args.init || args.keyagent_serve != "" {
+			tlog.Fatal.Printf("-keyagent cannot be used together with -masterkey, -zerokey, -init or -keyagent_serve")
+			os.Exit(exitcodes.Usage)
+		}
+	}
 	return args
 }
 
@@ -309,12 +527,48 @@ func countOpFlags(args *argContainer) int {
 	if args.passwd {
 		count++
 	}
+	if args.add_key {
+		count++
+	}
+	if args.remove_key {
+		count++
+	}
 	if args.init {
 		count++
 	}
 	if args.fsck {
 		count++
 	}
+	if args.snapshot != "" {
+		count++
+	}
+	if args.unlockcheck {
+		count++
+	}
+	if args.verifyhash {
+		count++
+	}
+	if args.importdir != "" {
+		count++
+	}
+	if args.rotate_fileids {
+		count++
+	}
+	if args.compact {
+		count++
+	}
+	if args.webdav != "" {
+		count++
+	}
+	if args.export_tar {
+		count++
+	}
+	if args.keyagent_serve != "" {
+		count++
+	}
+	if args.check_file != "" {
+		count++
+	}
 	return count
 }
 
@@ -0,0 +1,44 @@
+package main
+
+import (
+	"os"
+	"time"
+
+	"github.com/rfjakob/gocryptfs/internal/exitcodes"
+	"github.com/rfjakob/gocryptfs/internal/fusefrontend"
+	"github.com/rfjakob/gocryptfs/internal/tlog"
+)
+
+// compactFiles handles "gocryptfs -compact CIPHERDIR". It rewrites every file
+// in CIPHERDIR into a fresh copy so that its blocks are stored contiguously
+// again.
+//
+// Returns the exit code.
+func compactFiles(args *argContainer) int {
+	if args.reverse {
+		tlog.Fatal.Printf("-compact cannot be used together with -reverse")
+		os.Exit(exitcodes.Usage)
+	}
+	pfs, wipeKeys := initFuseFrontend(args)
+	defer wipeKeys()
+	rn := pfs.(*fusefrontend.RootNode)
+	var last time.Time
+	progress := func(done, total int) {
+		if time.Since(last) < 5*time.Second && done < total {
+			return
+		}
+		last = time.Now()
+		tlog.Info.Printf("compact: %d of %d files", done, total)
+	}
+	stats, err := rn.CompactFiles(args.config+".rotate", progress)
+	if err != nil {
+		tlog.Fatal.Printf("compact: %v", err)
+		return exitcodes.Compact
+	}
+	tlog.Info.Printf("compact: %d files compacted, %d skipped, %d errors",
+		stats.Compacted, stats.Skipped, stats.Failed)
+	if stats.Failed > 0 {
+		return exitcodes.Compact
+	}
+	return 0
+}
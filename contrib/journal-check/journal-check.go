@@ -0,0 +1,38 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+
+	"github.com/rfjakob/gocryptfs/internal/journal"
+)
+
+const (
+	myName = "journal-check"
+)
+
+func main() {
+	flag.Usage = func() {
+		fmt.Fprintf(os.Stderr, "Usage: %s CIPHERFILE [CIPHERFILE ...]\n", myName)
+		fmt.Fprintf(os.Stderr, "Check encrypted files written with \"gocryptfs -journal\" against their\n"+
+			"journal and print how many plaintext bytes at the start are intact.\n"+
+			"An interrupted write can be resumed at this offset.\n")
+		os.Exit(1)
+	}
+	flag.Parse()
+	if flag.NArg() == 0 {
+		flag.Usage()
+	}
+	exitcode := 0
+	for _, path := range flag.Args() {
+		res, err := journal.CheckFile(path)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "%s: %v\n", path, err)
+			exitcode = 2
+			continue
+		}
+		fmt.Printf("%s: %d blocks, %d bytes intact\n", path, res.Blocks, res.PlainSize)
+	}
+	os.Exit(exitcode)
+}
@@ -0,0 +1,42 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+
+	"github.com/rfjakob/gocryptfs/internal/optrace"
+)
+
+const (
+	myName = "optrace-replay"
+)
+
+func main() {
+	flag.Usage = func() {
+		fmt.Fprintf(os.Stderr, "Usage: %s TRACEFILE MOUNTPOINT\n", myName)
+		fmt.Fprintf(os.Stderr, "Replay a trace recorded by \"gocryptfs -optrace\" against MOUNTPOINT,\n"+
+			"usually a freshly created, empty gocryptfs mount.\n")
+		os.Exit(1)
+	}
+	flag.Parse()
+	if flag.NArg() != 2 {
+		flag.Usage()
+	}
+	f, err := os.Open(flag.Arg(0))
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(2)
+	}
+	defer f.Close()
+	mismatches, err := optrace.Replay(f, flag.Arg(1))
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "replay failed: %v\n", err)
+		os.Exit(3)
+	}
+	if mismatches > 0 {
+		fmt.Printf("%d operations returned a different result than recorded\n", mismatches)
+		os.Exit(4)
+	}
+	fmt.Println("replay done, all results match the trace")
+}
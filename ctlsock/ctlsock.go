@@ -32,7 +32,13 @@ func New(socketPath string) (*CtlSock, error) {
 
 // Query sends a request to the control socket returns the response.
 func (c *CtlSock) Query(req *RequestStruct) (*ResponseStruct, error) {
-	c.Conn.SetDeadline(time.Now().Add(time.Second))
+	return c.QueryTimeout(req, time.Second)
+}
+
+// QueryTimeout is like Query, but waits up to "timeout" for the response.
+// Snapshot requests usually take longer than the one second Query allows.
+func (c *CtlSock) QueryTimeout(req *RequestStruct, timeout time.Duration) (*ResponseStruct, error) {
+	c.Conn.SetDeadline(time.Now().Add(timeout))
 	msg, err := json.Marshal(req)
 	if err != nil {
 		return nil, err
@@ -41,12 +47,16 @@ func (c *CtlSock) Query(req *RequestStruct) (*ResponseStruct, error) {
 	if err != nil {
 		return nil, err
 	}
-	buf := make([]byte, 5000)
-	n, err := c.Conn.Read(buf)
-	if err != nil {
-		return nil, err
+	// The response ends with a newline. A ListOpenFiles response can be long.
+	var buf []byte
+	chunk := make([]byte, 5000)
+	for len(buf) == 0 || buf[len(buf)-1] != '\n' {
+		n, err := c.Conn.Read(chunk)
+		if err != nil {
+			return nil, err
+		}
+		buf = append(buf, chunk[:n]...)
 	}
-	buf = buf[:n]
 	var resp ResponseStruct
 	json.Unmarshal(buf, &resp)
 	if resp.ErrNo != 0 {
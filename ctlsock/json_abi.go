@@ -1,18 +1,36 @@
 package ctlsock
 
+import "time"
+
 // RequestStruct is sent by a client (encoded as JSON).
-// You cannot perform both encryption and decryption in the same request.
+// Only one of the fields may be set in a request.
 type RequestStruct struct {
 	// EncryptPath is the path that should be encrypted.
 	EncryptPath string
 	// DecryptPath is the path that should be decrypted.
 	DecryptPath string
+	// Snapshot is an absolute path where a copy of CIPHERDIR should be
+	// created. Writes are blocked while the copy runs.
+	Snapshot string `json:",omitempty"`
+	// ListOpenFiles requests a list of the file handles that are currently
+	// open, see OpenFile.
+	ListOpenFiles bool `json:",omitempty"`
+	// ListTrash requests a list of the files in the "-trash" directory,
+	// see TrashEntry.
+	ListTrash bool `json:",omitempty"`
+	// RestoreTrash is the ID of a trash entry that should be moved back to
+	// its original path.
+	RestoreTrash string `json:",omitempty"`
+	// PurgeTrash is the ID of a trash entry that should be deleted for good,
+	// or "*" for all entries.
+	PurgeTrash string `json:",omitempty"`
 }
 
 // ResponseStruct is sent by the server in response to a request
 // (encoded as JSON).
 type ResponseStruct struct {
-	// Result is the resulting decrypted or encrypted path. Empty on error.
+	// Result is the resulting decrypted or encrypted path, the snapshot
+	// path, or the path a trash entry was restored to. Empty on error.
 	Result string
 	// ErrNo is the error number as defined in errno.h.
 	// 0 means success and -1 means that the error number is not known
@@ -23,4 +41,42 @@ type ResponseStruct struct {
 	// WarnText contains warnings that may have been encountered while
 	// processing the message.
 	WarnText string
+	// OpenFiles is the answer to a ListOpenFiles request
+	OpenFiles []OpenFile `json:",omitempty"`
+	// Trash is the answer to a ListTrash request
+	Trash []TrashEntry `json:",omitempty"`
+}
+
+// OpenFile describes an open file handle in the response to a ListOpenFiles
+// request.
+type OpenFile struct {
+	// Path is the plaintext path, relative to the root of the mount, that
+	// the file had when it was opened. Later renames and deletes do not
+	// change it.
+	Path string
+	// Flags are the open flags the application used, like "O_WRONLY|O_APPEND".
+	Flags string
+	// BackingFlags are the flags the ciphertext file was opened with.
+	// gocryptfs always needs read access, so O_WRONLY becomes O_RDWR, and
+	// O_APPEND is dropped.
+	BackingFlags string
+	// WriteOnlyChmod is true if the ciphertext file was not readable and
+	// had to be chmod'ed to open it O_RDWR.
+	WriteOnlyChmod bool
+	// BufferedBytes is the number of bytes written to the handle that are
+	// not on disk yet, see "-writebuffer".
+	BufferedBytes int
+	// Opened is when the handle was opened.
+	Opened time.Time
+}
+
+// TrashEntry describes a deleted file in the response to a ListTrash request
+type TrashEntry struct {
+	// ID identifies the entry in RestoreTrash and PurgeTrash requests
+	ID string
+	// Path is the plaintext path, relative to the root of the mount, that
+	// the file had when it was deleted. RestoreTrash moves it back there.
+	Path string
+	// Deleted is when the file was deleted.
+	Deleted time.Time
 }
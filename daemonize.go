@@ -71,7 +71,7 @@ func redirectStdFds() {
 		tlog.Warn.Printf("redirectStdFds: could not create pipe: %v\n", err)
 		return
 	}
-	tag := fmt.Sprintf("gocryptfs-%d-logger", os.Getpid())
+	tag := fmt.Sprintf("%s-%d-logger", tlog.SyslogTag, os.Getpid())
 	cmd := exec.Command("logger", "-t", tag)
 	cmd.Stdin = pr
 	err = cmd.Start()
@@ -0,0 +1,28 @@
+package main
+
+import (
+	"os"
+
+	"github.com/sabhiram/go-gitignore"
+
+	"github.com/rfjakob/gocryptfs/internal/exclude"
+	"github.com/rfjakob/gocryptfs/internal/exitcodes"
+	"github.com/rfjakob/gocryptfs/internal/tlog"
+)
+
+// walkExcluder compiles the "-exclude", "-exclude-wildcard" and
+// "-exclude-from" patterns for "-fsck" and "-import", which match them
+// against plaintext paths relative to the root of the tree they walk.
+// Returns nil if no patterns were passed.
+//
+// The patterns are removed from "args" so they do not reach the forward
+// mode frontend, which does not support them.
+func walkExcluder(args *argContainer) ignore.IgnoreParser {
+	excluder, err := exclude.New(args.exclude, args.excludeWildcard, args.excludeFrom)
+	if err != nil {
+		tlog.Fatal.Printf("Error preparing exclusion rules: %v", err)
+		os.Exit(exitcodes.ExcludeError)
+	}
+	args.exclude, args.excludeWildcard, args.excludeFrom = nil, nil, nil
+	return excluder
+}
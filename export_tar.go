@@ -0,0 +1,232 @@
+package main
+
+import (
+	"archive/tar"
+	"bufio"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"sort"
+	"syscall"
+	"time"
+
+	"golang.org/x/crypto/ssh/terminal"
+	"golang.org/x/sys/unix"
+
+	"github.com/hanwen/go-fuse/v2/fs"
+	"github.com/hanwen/go-fuse/v2/fuse"
+
+	"github.com/rfjakob/gocryptfs/internal/exitcodes"
+	"github.com/rfjakob/gocryptfs/internal/fusefrontend"
+	"github.com/rfjakob/gocryptfs/internal/tlog"
+)
+
+type exportObj struct {
+	tw *tar.Writer
+	// links maps the inode numbers of files with more than one hard link to
+	// the name they were first exported under
+	links map[uint64]string
+	// number of exported, skipped and failed entries
+	exported, skipped, failed int
+}
+
+func (ex *exportObj) fail(name string, err error) {
+	tlog.Warn.Printf("export_tar: %s: %v", name, err)
+	ex.failed++
+}
+
+// exportTar handles "gocryptfs -export_tar CIPHERDIR". It writes the
+// plaintext directory tree as a tar stream to stdout without mounting
+// anything. Like "-import", it calls the fusefrontend node methods directly.
+//
+// Returns the exit code.
+func exportTar(args *argContainer) int {
+	if args.reverse {
+		tlog.Fatal.Printf("-export_tar cannot be used together with -reverse")
+		os.Exit(exitcodes.Usage)
+	}
+	if terminal.IsTerminal(int(os.Stdout.Fd())) {
+		tlog.Fatal.Printf("-export_tar: refusing to write a tar stream to a terminal, redirect stdout")
+		os.Exit(exitcodes.Usage)
+	}
+	pfs, wipeKeys := initFuseFrontend(args)
+	defer wipeKeys()
+	rn := pfs.(*fusefrontend.RootNode)
+	// Set up the inode tree. No mount is created.
+	fs.NewNodeFS(rn, &fs.Options{})
+	out := bufio.NewWriterSize(os.Stdout, fuse.MAX_KERNEL_WRITE)
+	ex := exportObj{tw: tar.NewWriter(out), links: make(map[uint64]string)}
+	err := ex.dir("", &rn.Node)
+	if err == nil {
+		err = ex.tw.Close()
+	}
+	if err == nil {
+		err = out.Flush()
+	}
+	if err != nil {
+		tlog.Fatal.Printf("export_tar: writing the tar stream failed: %v", err)
+		return exitcodes.ExportTar
+	}
+	tlog.Info.Printf("export_tar: %d entries exported, %d skipped, %d errors",
+		ex.exported, ex.skipped, ex.failed)
+	if ex.failed > 0 {
+		return exitcodes.ExportTar
+	}
+	return 0
+}
+
+// dir exports the contents of the directory "n", which is at "dirName" in
+// the archive. Entries are sorted by name so that the archive is
+// reproducible. Only errors writing the tar stream are returned, everything
+// else is counted in ex.failed.
+func (ex *exportObj) dir(dirName string, n *fusefrontend.Node) error {
+	names, errno := n.ReaddirNames()
+	if errno != 0 {
+		ex.fail(dirName+"/", errno)
+		return nil
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		entry := path.Join(dirName, name)
+		ch, errno := n.Lookup(nil, name, &fuse.EntryOut{})
+		if errno != 0 {
+			ex.fail(entry, errno)
+			continue
+		}
+		// The node methods find the backing file through the inode tree
+		n.AddChild(name, ch, true)
+		child := ch.Operations().(*fusefrontend.Node)
+		var aOut fuse.AttrOut
+		if errno = child.Getattr(nil, nil, &aOut); errno != 0 {
+			ex.fail(entry, errno)
+			continue
+		}
+		a := &aOut.Attr
+		hdr := &tar.Header{
+			Name: entry,
+			Mode: int64(a.Mode & 07777),
+			Uid:  int(a.Uid),
+			Gid:  int(a.Gid),
+			// PAX keeps the nanoseconds and has no limit on the name length
+			ModTime: time.Unix(int64(a.Mtime), int64(a.Mtimensec)),
+			Format:  tar.FormatPAX,
+		}
+		switch a.Mode & syscall.S_IFMT {
+		case syscall.S_IFDIR:
+			hdr.Typeflag = tar.TypeDir
+			hdr.Name += "/"
+			if err := ex.tw.WriteHeader(hdr); err != nil {
+				return err
+			}
+			ex.exported++
+			if err := ex.dir(entry, child); err != nil {
+				return err
+			}
+			continue
+		case syscall.S_IFREG:
+			if a.Nlink > 1 {
+				if first, ok := ex.links[a.Ino]; ok {
+					hdr.Typeflag = tar.TypeLink
+					hdr.Linkname = first
+					break
+				}
+				ex.links[a.Ino] = entry
+			}
+			if err := ex.file(hdr, child); err != nil {
+				return err
+			}
+			continue
+		case syscall.S_IFLNK:
+			target, errno := child.Readlink(nil)
+			if errno != 0 {
+				ex.fail(entry, errno)
+				continue
+			}
+			hdr.Typeflag = tar.TypeSymlink
+			hdr.Linkname = string(target)
+		case syscall.S_IFIFO:
+			hdr.Typeflag = tar.TypeFifo
+		case syscall.S_IFCHR, syscall.S_IFBLK:
+			hdr.Typeflag = tar.TypeChar
+			if a.Mode&syscall.S_IFMT == syscall.S_IFBLK {
+				hdr.Typeflag = tar.TypeBlock
+			}
+			hdr.Devmajor = int64(unix.Major(uint64(a.Rdev)))
+			hdr.Devminor = int64(unix.Minor(uint64(a.Rdev)))
+		default:
+			tlog.Warn.Printf("export_tar: %s: skipping unsupported file type %#o", entry, a.Mode&syscall.S_IFMT)
+			ex.skipped++
+			continue
+		}
+		if err := ex.tw.WriteHeader(hdr); err != nil {
+			return err
+		}
+		ex.exported++
+	}
+	return nil
+}
+
+// file exports the regular file "n" with the header "hdr". The content is
+// streamed in chunks of fuse.MAX_KERNEL_WRITE. Once the header is written,
+// the archive expects exactly hdr.Size bytes: if the file cannot be read to
+// the end, the rest is filled with zeros and the file counts as failed.
+func (ex *exportObj) file(hdr *tar.Header, n *fusefrontend.Node) error {
+	fh, _, errno := n.Open(nil, syscall.O_RDONLY)
+	if errno != 0 {
+		ex.fail(hdr.Name, errno)
+		return nil
+	}
+	f := fh.(*fusefrontend.File)
+	defer f.Release(nil)
+	// Stat through the open file, the size may have changed since Getattr
+	var aOut fuse.AttrOut
+	if errno = f.Getattr(nil, &aOut); errno != 0 {
+		ex.fail(hdr.Name, errno)
+		return nil
+	}
+	hdr.Typeflag = tar.TypeReg
+	hdr.Size = int64(aOut.Attr.Size)
+	if err := ex.tw.WriteHeader(hdr); err != nil {
+		return err
+	}
+	buf := make([]byte, fuse.MAX_KERNEL_WRITE)
+	var off int64
+	for off < hdr.Size {
+		m := int64(len(buf))
+		if hdr.Size-off < m {
+			m = hdr.Size - off
+		}
+		res, errno := f.Read(nil, buf[:m], off)
+		var data []byte
+		if errno == 0 {
+			var status fuse.Status
+			data, status = res.Bytes(buf[:m])
+			errno = syscall.Errno(status)
+		}
+		if errno == 0 && len(data) == 0 {
+			errno = syscall.ENODATA
+		}
+		if errno != 0 {
+			ex.fail(hdr.Name, fmt.Errorf("read at offset %d: %v, filling the rest with zeros", off, errno))
+			_, err := io.CopyN(ex.tw, zeroReader{}, hdr.Size-off)
+			return err
+		}
+		if _, err := ex.tw.Write(data); err != nil {
+			return err
+		}
+		off += int64(len(data))
+	}
+	ex.exported++
+	return nil
+}
+
+// zeroReader returns an endless stream of zeros
+type zeroReader struct{}
+
+func (zeroReader) Read(p []byte) (int, error) {
+	for i := range p {
+		p[i] = 0
+	}
+	return len(p), nil
+}
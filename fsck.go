@@ -13,6 +13,7 @@ import (
 	"syscall"
 
 	"github.com/hanwen/go-fuse/v2/fuse"
+	"github.com/sabhiram/go-gitignore"
 
 	"github.com/rfjakob/gocryptfs/internal/exitcodes"
 	"github.com/rfjakob/gocryptfs/internal/fusefrontend"
@@ -36,6 +37,10 @@ type fsckObj struct {
 	seenInodes map[uint64]struct{}
 	// abort the running fsck operation? Checked in a few long-running loops.
 	abort bool
+	// excluder matches the "-exclude" patterns. nil if there are none.
+	excluder ignore.IgnoreParser
+	// Number of excluded entries
+	excluded int
 }
 
 func runsAsRoot() bool {
@@ -104,6 +109,11 @@ func (ck *fsckObj) dir(relPath string) {
 			continue
 		}
 		nextPath := filepath.Join(relPath, entry)
+		if ck.excluder != nil && ck.excluder.MatchesPath(nextPath) {
+			tlog.Debug.Printf("fsck: skipping excluded path %q", nextPath)
+			ck.excluded++
+			continue
+		}
 		var st syscall.Stat_t
 		err := syscall.Lstat(ck.abs(nextPath), &st)
 		if err != nil {
@@ -259,6 +269,7 @@ func fsck(args *argContainer) (exitcode int) {
 		os.Exit(exitcodes.Usage)
 	}
 	args.allow_other = false
+	excluder := walkExcluder(args)
 	var err error
 	args.mountpoint, err = ioutil.TempDir("", "gocryptfs.fsck.")
 	if err != nil {
@@ -273,6 +284,7 @@ func fsck(args *argContainer) (exitcode int) {
 		rootNode:   rn,
 		watchDone:  make(chan struct{}),
 		seenInodes: make(map[uint64]struct{}),
+		excluder:   excluder,
 	}
 	// Mount
 	srv := initGoFuse(pfs, args)
@@ -298,6 +310,9 @@ func fsck(args *argContainer) (exitcode int) {
 		tlog.Info.Printf("fsck: aborted")
 		return exitcodes.Other
 	}
+	if ck.excluded > 0 {
+		tlog.Info.Printf("fsck: %d excluded entries were not checked", ck.excluded)
+	}
 	if len(ck.corruptList) == 0 && len(ck.skippedList) == 0 {
 		tlog.Info.Printf("fsck summary: no problems found\n")
 		return 0
@@ -4,6 +4,8 @@ import (
 	"bufio"
 	"fmt"
 	"os"
+	"text/tabwriter"
+	"time"
 
 	"github.com/rfjakob/gocryptfs/ctlsock"
 )
@@ -60,3 +62,64 @@ func transformPaths(socketPath string, req *ctlsock.RequestStruct, in *string, s
 	}
 	os.Exit(1)
 }
+
+// listOpenFiles prints the open file handles of the mount behind the control
+// socket at "socketPath"
+func listOpenFiles(socketPath string) {
+	resp := queryOrExit(socketPath, &ctlsock.RequestStruct{ListOpenFiles: true})
+	w := tabwriter.NewWriter(os.Stdout, 0, 8, 2, ' ', 0)
+	fmt.Fprintln(w, "PATH\tFLAGS\tBACKING FLAGS\tBUFFERED\tOPENED")
+	for _, f := range resp.OpenFiles {
+		backing := f.BackingFlags
+		if f.WriteOnlyChmod {
+			backing += " (chmod)"
+		}
+		fmt.Fprintf(w, "%s\t%s\t%s\t%d\t%s\n", f.Path, f.Flags, backing, f.BufferedBytes,
+			f.Opened.Format("2006-01-02 15:04:05"))
+	}
+	w.Flush()
+	os.Exit(0)
+}
+
+// listTrash prints the deleted files in the "-trash" directory of the mount
+// behind the control socket at "socketPath"
+func listTrash(socketPath string) {
+	resp := queryOrExit(socketPath, &ctlsock.RequestStruct{ListTrash: true})
+	w := tabwriter.NewWriter(os.Stdout, 0, 8, 2, ' ', 0)
+	fmt.Fprintln(w, "DELETED\tID\tPATH")
+	for _, e := range resp.Trash {
+		fmt.Fprintf(w, "%s\t%s\t%s\n", e.Deleted.Format("2006-01-02 15:04:05"), e.ID, e.Path)
+	}
+	w.Flush()
+	os.Exit(0)
+}
+
+// restoreTrash moves the trash entry "id" back to its original path
+func restoreTrash(socketPath string, id string) {
+	resp := queryOrExit(socketPath, &ctlsock.RequestStruct{RestoreTrash: id})
+	fmt.Println(resp.Result)
+	os.Exit(0)
+}
+
+// purgeTrash deletes the trash entry "id", or all entries for "*"
+func purgeTrash(socketPath string, id string) {
+	queryOrExit(socketPath, &ctlsock.RequestStruct{PurgeTrash: id})
+	os.Exit(0)
+}
+
+// queryOrExit sends "req" to the control socket at "socketPath" and returns
+// the response. Exits on errors. Purging a big trash can take a while, so
+// this waits longer than Query does.
+func queryOrExit(socketPath string, req *ctlsock.RequestStruct) *ctlsock.ResponseStruct {
+	c, err := ctlsock.New(socketPath)
+	if err != nil {
+		fmt.Printf("fatal: %v\n", err)
+		os.Exit(1)
+	}
+	resp, err := c.QueryTimeout(req, time.Minute)
+	if err != nil {
+		fmt.Printf("fatal: %v\n", err)
+		os.Exit(1)
+	}
+	return resp
+}
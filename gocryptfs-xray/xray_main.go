@@ -20,7 +20,9 @@ const (
 	ivLen      = contentenc.DefaultIVBits / 8
 	authTagLen = cryptocore.AuthTagLen
 	blockSize  = contentenc.DefaultBS + ivLen + cryptocore.AuthTagLen
-	myName     = "gocryptfs-xray"
+	// tagsLen is the length of the "-filetags" region after the header
+	tagsLen = ivLen + 2 + contentenc.TagsMaxLen + cryptocore.AuthTagLen
+	myName  = "gocryptfs-xray"
 )
 
 func errExit(err error) {
@@ -48,7 +50,9 @@ func usage() {
 		"Examples:\n"+
 		"  gocryptfs-xray myfs/mCXnISiv7nEmyc0glGuhTQ\n"+
 		"  gocryptfs-xray -dumpmasterkey myfs/gocryptfs.conf\n"+
-		"  gocryptfs-xray -encrypt-paths myfs.sock\n")
+		"  gocryptfs-xray -encrypt-paths myfs.sock\n"+
+		"  gocryptfs-xray -list-open myfs.sock\n"+
+		"  gocryptfs-xray -trash-restore ID myfs.sock\n")
 }
 
 // sum counts the number of true values
@@ -66,19 +70,32 @@ func main() {
 		dumpmasterkey *bool
 		decryptPaths  *bool
 		encryptPaths  *bool
+		listOpen      *bool
+		trashList     *bool
+		trashRestore  *string
+		trashPurge    *string
 		aessiv        *bool
+		filetags      *bool
 		sep0          *bool
 		fido2         *string
 	}
 	args.dumpmasterkey = flag.Bool("dumpmasterkey", false, "Decrypt and dump the master key")
 	args.decryptPaths = flag.Bool("decrypt-paths", false, "Decrypt file paths using gocryptfs control socket")
 	args.encryptPaths = flag.Bool("encrypt-paths", false, "Encrypt file paths using gocryptfs control socket")
+	args.listOpen = flag.Bool("list-open", false, "List open files using gocryptfs control socket")
+	args.trashList = flag.Bool("trash-list", false, "List deleted files of a -trash mount using gocryptfs control socket")
+	args.trashRestore = flag.String("trash-restore", "", "Restore the deleted file with this ID to its original path")
+	args.trashPurge = flag.String("trash-purge", "", "Delete the deleted file with this ID for good, or \"*\" for all")
+	args.filetags = flag.Bool("filetags", false, "Assume a file tags region after the header (\"-filetags\")")
 	args.sep0 = flag.Bool("0", false, "Use \\0 instead of \\n as separator")
 	args.aessiv = flag.Bool("aessiv", false, "Assume AES-SIV mode instead of AES-GCM")
 	args.fido2 = flag.String("fido2", "", "Protect the masterkey using a FIDO2 token instead of a password")
 	flag.Usage = usage
 	flag.Parse()
-	s := sum(args.dumpmasterkey, args.decryptPaths, args.encryptPaths)
+	trashRestore := *args.trashRestore != ""
+	trashPurge := *args.trashPurge != ""
+	s := sum(args.dumpmasterkey, args.decryptPaths, args.encryptPaths, args.listOpen, args.trashList,
+		&trashRestore, &trashPurge)
 	if s > 1 {
 		fmt.Printf("fatal: %d operations were requested\n", s)
 		os.Exit(1)
@@ -94,6 +111,18 @@ func main() {
 	if *args.encryptPaths {
 		encryptPaths(fn, *args.sep0)
 	}
+	if *args.listOpen {
+		listOpenFiles(fn)
+	}
+	if *args.trashList {
+		listTrash(fn)
+	}
+	if trashRestore {
+		restoreTrash(fn, *args.trashRestore)
+	}
+	if trashPurge {
+		purgeTrash(fn, *args.trashPurge)
+	}
 	fd, err := os.Open(fn)
 	if err != nil {
 		errExit(err)
@@ -102,7 +131,7 @@ func main() {
 	if *args.dumpmasterkey {
 		dumpMasterKey(fn, *args.fido2)
 	} else {
-		inspectCiphertext(fd, *args.aessiv)
+		inspectCiphertext(fd, *args.aessiv, *args.filetags)
 	}
 }
 
@@ -130,7 +159,7 @@ func dumpMasterKey(fn string, fido2Path string) {
 	}
 }
 
-func inspectCiphertext(fd *os.File, aessiv bool) {
+func inspectCiphertext(fd *os.File, aessiv bool, filetags bool) {
 	headerBytes := make([]byte, contentenc.HeaderLen)
 	n, err := fd.ReadAt(headerBytes, 0)
 	if err == io.EOF && n == 0 {
@@ -147,10 +176,27 @@ func inspectCiphertext(fd *os.File, aessiv bool) {
 		errExit(err)
 	}
 	prettyPrintHeader(header, aessiv)
+	var dataOff int64 = contentenc.HeaderLen
+	if filetags {
+		tags := make([]byte, tagsLen)
+		n, err := fd.ReadAt(tags, dataOff)
+		if err == io.EOF {
+			errExit(fmt.Errorf("corrupt tags region: truncated data, len=%d", n))
+		} else if err != nil {
+			errExit(err)
+		}
+		tag := tags[tagsLen-authTagLen:]
+		if aessiv {
+			tag = tags[ivLen : ivLen+authTagLen]
+		}
+		fmt.Printf("Tags:     IV: %s, Tag: %s, Offset: %5d Len: %d\n",
+			hex.EncodeToString(tags[:ivLen]), hex.EncodeToString(tag), dataOff, tagsLen)
+		dataOff += tagsLen
+	}
 	var i int64
 	buf := make([]byte, blockSize)
 	for i = 0; ; i++ {
-		off := contentenc.HeaderLen + i*blockSize
+		off := dataOff + i*blockSize
 		n, err := fd.ReadAt(buf, off)
 		if err != nil && err != io.EOF {
 			errExit(err)
@@ -7,7 +7,12 @@ import (
 )
 
 const tUsage = "" +
-	"Usage: " + tlog.ProgramName + " -init|-passwd|-info [OPTIONS] CIPHERDIR\n" +
+	"Usage: " + tlog.ProgramName + " -init|-passwd|-add_key|-remove_key|-info|-unlockcheck|-verifyhash|-rotate_fileids|-compact [OPTIONS] CIPHERDIR\n" +
+	"  or   " + tlog.ProgramName + " -snapshot DEST [-ctlsock SOCKET] CIPHERDIR\n" +
+	"  or   " + tlog.ProgramName + " -import SRCDIR [OPTIONS] CIPHERDIR\n" +
+	"  or   " + tlog.ProgramName + " -check_file PATH [OPTIONS] CIPHERDIR\n" +
+	"  or   " + tlog.ProgramName + " -keyagent_serve SOCKET [OPTIONS] CIPHERDIR\n" +
+	"  or   " + tlog.ProgramName + " -webdav ADDR -webdav_auth FILE [OPTIONS] CIPHERDIR\n" +
 	"  or   " + tlog.ProgramName + " [OPTIONS] CIPHERDIR MOUNTPOINT\n"
 
 // helpShort is what gets displayed when passed "-h" or on syntax error.
@@ -17,19 +22,25 @@ func helpShort() {
 	fmt.Printf(tUsage)
 	fmt.Printf(`
 Common Options (use -hh to show all):
+  -add_key           Add another password that unlocks the filesystem
   -aessiv            Use AES-SIV encryption (with -init)
   -allow_other       Allow other users to access the mount
+  -check_file        Check the integrity of a single file
   -i, -idle          Unmount automatically after specified idle duration
+  -compact           Rewrite all files so that their blocks are contiguous
   -config            Custom path to config file
   -ctlsock           Create control socket at location
+  -export_tar        Write the plaintext of CIPHERDIR as a tar stream to stdout
   -extpass           Call external program to prompt for the password
   -fg                Stay in the foreground
   -fsck              Check filesystem integrity
   -fusedebug         Debug FUSE calls
   -h, -help          This short help text
   -hh                Long help text with all options
+  -import            Encrypt a directory tree into CIPHERDIR
   -init              Initialize encrypted directory
   -info              Display information about encrypted directory
+  -keyagent          Get the master key from a -keyagent_serve agent
   -masterkey         Mount with explicit master key instead of password
   -nonempty          Allow mounting over non-empty directory
   -nosyslog          Do not redirect log messages to syslog
@@ -37,10 +48,17 @@ Common Options (use -hh to show all):
   -passwd            Change password
   -plaintextnames    Do not encrypt file names (with -init)
   -q, -quiet         Silence informational messages
+  -remove_key        Remove one of the passwords that unlock the filesystem
   -reverse           Enable reverse mode
   -ro                Mount read-only
+  -rotate_fileids    Re-encrypt all files with new file IDs
+  -selftest          Check the block encryption with random data
+  -snapshot          Copy CIPHERDIR using reflinks
   -speed             Run crypto speed test
+  -unlockcheck       Check the password without mounting
+  -verifyhash        Check the file checksums stored by -filehash
   -version           Print version information
+  -webdav            Serve CIPHERDIR over WebDAV instead of mounting
   --                 Stop option parsing
 `)
 }
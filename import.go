@@ -0,0 +1,267 @@
+package main
+
+import (
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"syscall"
+
+	"golang.org/x/sys/unix"
+
+	"github.com/hanwen/go-fuse/v2/fs"
+	"github.com/hanwen/go-fuse/v2/fuse"
+	"github.com/sabhiram/go-gitignore"
+
+	"github.com/rfjakob/gocryptfs/internal/exitcodes"
+	"github.com/rfjakob/gocryptfs/internal/fusefrontend"
+	"github.com/rfjakob/gocryptfs/internal/syscallcompat"
+	"github.com/rfjakob/gocryptfs/internal/tlog"
+)
+
+type importObj struct {
+	// preserve file owners (only possible as root)
+	asRoot bool
+	// src is SRCDIR, the excluder's patterns are relative to it
+	src string
+	// excluder matches the "-exclude" patterns. nil if there are none.
+	excluder ignore.IgnoreParser
+	// links maps the device and inode numbers of source files with more
+	// than one hard link to the node they were first imported as. nil
+	// unless "-import_hardlinks" was passed.
+	links map[[2]uint64]*fusefrontend.Node
+	// number of imported, excluded, skipped and failed entries
+	imported, excluded, skipped, failed int
+}
+
+func (im *importObj) fail(path string, err error) {
+	tlog.Warn.Printf("import: %s: %v", path, err)
+	im.failed++
+}
+
+// importTree handles "gocryptfs -import SRCDIR CIPHERDIR". It encrypts the
+// plaintext directory tree at SRCDIR into CIPHERDIR without mounting anything.
+// The fusefrontend node methods are called directly, so the result is
+// exactly what copying the tree into a mount would produce.
+//
+// Returns the exit code.
+func importTree(args *argContainer) int {
+	if args.reverse {
+		tlog.Fatal.Printf("-import cannot be used together with -reverse")
+		os.Exit(exitcodes.Usage)
+	}
+	src, err := filepath.Abs(args.importdir)
+	if err != nil {
+		tlog.Fatal.Printf("import: %v", err)
+		os.Exit(exitcodes.Usage)
+	}
+	if fi, err := os.Stat(src); err != nil || !fi.IsDir() {
+		tlog.Fatal.Printf("import: %q is not a directory", src)
+		os.Exit(exitcodes.Usage)
+	}
+	// Importing CIPHERDIR into itself (or the other way round) would never end
+	if src == args.cipherdir || strings.HasPrefix(src, args.cipherdir+"/") ||
+		strings.HasPrefix(args.cipherdir, src+"/") {
+		tlog.Fatal.Printf("import: %q and CIPHERDIR %q must not contain each other", src, args.cipherdir)
+		os.Exit(exitcodes.Usage)
+	}
+	im := importObj{asRoot: runsAsRoot(), src: src, excluder: walkExcluder(args)}
+	if args.import_hardlinks {
+		im.links = make(map[[2]uint64]*fusefrontend.Node)
+	}
+	pfs, wipeKeys := initFuseFrontend(args)
+	defer wipeKeys()
+	rn := pfs.(*fusefrontend.RootNode)
+	// Set up the inode tree. No mount is created.
+	fs.NewNodeFS(rn, &fs.Options{})
+	im.dir(src, &rn.Node)
+	tlog.Info.Printf("import: %d entries imported, %d excluded, %d skipped, %d errors",
+		im.imported, im.excluded, im.skipped, im.failed)
+	if im.failed > 0 {
+		return exitcodes.Import
+	}
+	return 0
+}
+
+// dir imports the contents of the plaintext directory "srcDir" into "n".
+func (im *importObj) dir(srcDir string, n *fusefrontend.Node) {
+	fis, err := ioutil.ReadDir(srcDir)
+	if err != nil {
+		im.fail(srcDir, err)
+		return
+	}
+	for _, fi := range fis {
+		srcPath := filepath.Join(srcDir, fi.Name())
+		if im.isExcluded(srcPath) {
+			tlog.Debug.Printf("import: skipping excluded path %q", srcPath)
+			im.excluded++
+			continue
+		}
+		var ch *fs.Inode
+		var errno syscall.Errno
+		switch fi.Mode() & os.ModeType {
+		case os.ModeDir:
+			// Create as 0700 so we can write into it even if the source
+			// directory is read-only. setattr fixes the mode afterwards.
+			ch, errno = n.Mkdir(nil, fi.Name(), 0700, &fuse.EntryOut{})
+			if errno == 0 {
+				n.AddChild(fi.Name(), ch, true)
+				im.dir(srcPath, ch.Operations().(*fusefrontend.Node))
+			}
+		case 0:
+			if target := im.linkTarget(fi); target != nil {
+				ch, errno = n.Link(nil, target, fi.Name(), &fuse.EntryOut{})
+				if errno == 0 {
+					n.AddChild(fi.Name(), ch, true)
+					im.imported++
+				} else {
+					im.fail(srcPath, errno)
+				}
+				// The attributes are shared with the first name
+				continue
+			}
+			ch, errno = im.file(srcPath, n, fi.Name())
+			if errno == 0 {
+				im.addLink(fi, ch.Operations().(*fusefrontend.Node))
+			}
+		case os.ModeSymlink:
+			var target string
+			target, err = os.Readlink(srcPath)
+			if err != nil {
+				im.fail(srcPath, err)
+				continue
+			}
+			ch, errno = n.Symlink(nil, target, fi.Name(), &fuse.EntryOut{})
+		default:
+			tlog.Warn.Printf("import: %s: skipping unsupported file type %v", srcPath, fi.Mode()&os.ModeType)
+			im.skipped++
+			continue
+		}
+		if errno != 0 {
+			im.fail(srcPath, errno)
+			continue
+		}
+		// The node methods find the backing file through the inode tree
+		n.AddChild(fi.Name(), ch, true)
+		im.setattr(srcPath, ch.Operations().(*fusefrontend.Node))
+		im.imported++
+	}
+}
+
+// linkKey returns the device and inode number of "fi" if it should be
+// imported as a hard link
+func (im *importObj) linkKey(fi os.FileInfo) (key [2]uint64, ok bool) {
+	if im.links == nil {
+		return key, false
+	}
+	st, ok := fi.Sys().(*syscall.Stat_t)
+	if !ok || st.Nlink < 2 {
+		return key, false
+	}
+	return [2]uint64{uint64(st.Dev), uint64(st.Ino)}, true
+}
+
+// linkTarget returns the node that another name of the source file "fi" has
+// been imported as, or nil
+func (im *importObj) linkTarget(fi os.FileInfo) *fusefrontend.Node {
+	if key, ok := im.linkKey(fi); ok {
+		return im.links[key]
+	}
+	return nil
+}
+
+// addLink records that the source file "fi" has been imported as "n"
+func (im *importObj) addLink(fi os.FileInfo, n *fusefrontend.Node) {
+	if key, ok := im.linkKey(fi); ok {
+		im.links[key] = n
+	}
+}
+
+// isExcluded checks "srcPath" against the "-exclude" patterns
+func (im *importObj) isExcluded(srcPath string) bool {
+	if im.excluder == nil {
+		return false
+	}
+	rel, err := filepath.Rel(im.src, srcPath)
+	if err != nil {
+		return false
+	}
+	return im.excluder.MatchesPath(rel)
+}
+
+// file imports the plaintext file "srcPath" as "name" into "n".
+// A partially written file is deleted again.
+func (im *importObj) file(srcPath string, n *fusefrontend.Node, name string) (*fs.Inode, syscall.Errno) {
+	in, err := os.Open(srcPath)
+	if err != nil {
+		return nil, fs.ToErrno(err)
+	}
+	defer in.Close()
+	ch, fh, _, errno := n.Create(nil, name, syscall.O_WRONLY, 0600, &fuse.EntryOut{})
+	if errno != 0 {
+		return nil, errno
+	}
+	f := fh.(*fusefrontend.File)
+	errno = copyToFile(in, f)
+	f.Release(nil)
+	if errno != 0 {
+		n.Unlink(nil, name)
+		return nil, errno
+	}
+	return ch, 0
+}
+
+// copyToFile copies all of "in" to the beginning of "f".
+func copyToFile(in io.Reader, f *fusefrontend.File) syscall.Errno {
+	buf := make([]byte, 128*1024)
+	var off int64
+	for {
+		m, err := in.Read(buf)
+		if m > 0 {
+			if _, errno := f.Write(nil, buf[:m], off); errno != 0 {
+				return errno
+			}
+			off += int64(m)
+		}
+		if err == io.EOF {
+			return 0
+		}
+		if err != nil {
+			return fs.ToErrno(err)
+		}
+	}
+}
+
+// setattr copies owner (if running as root), mode and timestamps from the
+// plaintext file "srcPath" to "n".
+func (im *importObj) setattr(srcPath string, n *fusefrontend.Node) {
+	var st unix.Stat_t
+	if err := unix.Lstat(srcPath, &st); err != nil {
+		im.fail(srcPath, err)
+		return
+	}
+	// chown clears the setuid bits, so it has to happen before chmod
+	if im.asRoot {
+		in := fuse.SetAttrIn{}
+		in.Valid = fuse.FATTR_UID | fuse.FATTR_GID
+		in.Owner = fuse.Owner{Uid: st.Uid, Gid: st.Gid}
+		if errno := n.Setattr(nil, nil, &in, &fuse.AttrOut{}); errno != 0 {
+			im.fail(srcPath, errno)
+		}
+	}
+	in := fuse.SetAttrIn{}
+	in.Valid = fuse.FATTR_ATIME | fuse.FATTR_MTIME
+	in.Atime, in.Atimensec = uint64(st.Atim.Sec), uint32(st.Atim.Nsec)
+	in.Mtime, in.Mtimensec = uint64(st.Mtim.Sec), uint32(st.Mtim.Nsec)
+	// Symlinks have no mode of their own
+	if st.Mode&syscall.S_IFMT != syscall.S_IFLNK {
+		in.Valid |= fuse.FATTR_MODE
+		in.Mode = uint32(st.Mode) & 07777
+	}
+	// Only does something on MacOS, Linux cannot set the birth time
+	syscallcompat.SetBtime(&in, &st)
+	if errno := n.Setattr(nil, nil, &in, &fuse.AttrOut{}); errno != 0 {
+		im.fail(srcPath, errno)
+	}
+}
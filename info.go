@@ -8,7 +8,6 @@ import (
 	"strings"
 
 	"github.com/rfjakob/gocryptfs/internal/configfile"
-	"github.com/rfjakob/gocryptfs/internal/contentenc"
 	"github.com/rfjakob/gocryptfs/internal/exitcodes"
 	"github.com/rfjakob/gocryptfs/internal/tlog"
 )
@@ -30,14 +29,27 @@ func info(filename string) {
 		tlog.Fatal.Printf("Failed to unmarshal config file")
 		os.Exit(exitcodes.LoadConf)
 	}
-	if cf.Version != contentenc.CurrentVersion {
-		tlog.Fatal.Printf("Unsupported on-disk format %d", cf.Version)
+	readOnly, err := cf.CheckVersion()
+	if err != nil {
+		tlog.Fatal.Println(err)
 		os.Exit(exitcodes.LoadConf)
 	}
 	// Pretty-print
 	fmt.Printf("Creator:      %s\n", cf.Creator)
+	if readOnly {
+		fmt.Printf("Version:      %d, readable by on-disk format %d, read-only for this binary\n", cf.Version, cf.ReadCompatVersion)
+	}
 	fmt.Printf("FeatureFlags: %s\n", strings.Join(cf.FeatureFlags, " "))
 	fmt.Printf("EncryptedKey: %dB\n", len(cf.EncryptedKey))
+	if len(cf.KeySlots) > 0 {
+		fmt.Printf("KeySlots:     %d\n", cf.NumKeySlots())
+	}
+	if cf.MasterKeyLen != 0 {
+		fmt.Printf("MasterKeyLen: %dB\n", cf.MasterKeyLen)
+	}
+	if cf.NameEncoding != "" {
+		fmt.Printf("NameEncoding: %s\n", cf.NameEncoding)
+	}
 	s := cf.ScryptObject
 	fmt.Printf("ScryptObject: Salt=%dB N=%d R=%d P=%d KeyLen=%d\n",
 		len(s.Salt), s.N, s.R, s.P, s.KeyLen)
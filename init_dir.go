@@ -13,7 +13,6 @@ import (
 	"github.com/rfjakob/gocryptfs/internal/exitcodes"
 	"github.com/rfjakob/gocryptfs/internal/fido2"
 	"github.com/rfjakob/gocryptfs/internal/nametransform"
-	"github.com/rfjakob/gocryptfs/internal/readpassword"
 	"github.com/rfjakob/gocryptfs/internal/syscallcompat"
 	"github.com/rfjakob/gocryptfs/internal/tlog"
 )
@@ -55,47 +54,86 @@ func isDir(dir string) error {
 // not need to be empty.
 func initDir(args *argContainer) {
 	var err error
+	// An -init that was killed while writing the config file leaves the
+	// temporary file behind. Without a config file there is nothing it could
+	// belong to, and it would make the directory look non-empty.
+	if _, err = os.Stat(args.config); os.IsNotExist(err) {
+		tmp, err := configfile.RemoveStaleTmp(args.config)
+		if err != nil {
+			tlog.Fatal.Printf("Cannot remove the temporary config file of an interrupted -init: %v", err)
+			os.Exit(exitcodes.Init)
+		}
+		if tmp != "" {
+			tlog.Warn.Printf("Removed %q, which an interrupted -init left behind", tmp)
+		}
+	}
 	if args.reverse {
 		_, err = os.Stat(args.config)
 		if err == nil {
 			tlog.Fatal.Printf("Config file %q already exists", args.config)
 			os.Exit(exitcodes.Init)
 		}
+		// A forward-mode cipherdir holds data that is already encrypted
+		if _, err = os.Stat(filepath.Join(args.cipherdir, configfile.ConfDefaultName)); err == nil {
+			if !args.allow_nested {
+				tlog.Fatal.Printf("%q is a gocryptfs cipherdir, reverse mode would encrypt it twice. Pass -allow_nested if this is intended.",
+					args.cipherdir)
+				os.Exit(exitcodes.CipherDir)
+			}
+			tlog.Warn.Printf("Warning: %q is a gocryptfs cipherdir, files will be encrypted twice", args.cipherdir)
+		}
 	} else {
 		err = isEmptyDir(args.cipherdir)
 		if err != nil {
-			tlog.Fatal.Printf("Invalid cipherdir: %v", err)
+			if hasConfig(args.cipherdir) {
+				tlog.Fatal.Printf("Invalid cipherdir: %q already contains a gocryptfs filesystem", args.cipherdir)
+			} else {
+				tlog.Fatal.Printf("Invalid cipherdir: %v", err)
+			}
 			os.Exit(exitcodes.CipherDir)
 		}
+		checkNested(args, args.cipherdir)
+	}
+	// Check the key length before asking for the password. New filesystems
+	// always use HKDF.
+	if err = cryptocore.ValidKeyLen(args.masterkey_len, true); err != nil {
+		tlog.Fatal.Printf("-masterkey_len: %v", err)
+		os.Exit(exitcodes.Usage)
 	}
-	// Choose password for config file
-	if args.extpass.Empty() && args.fido2 == "" {
-		tlog.Info.Printf("Choose a password for protecting your files.")
+	if _, err = nametransform.NewNameEncoding(args.name_encoding, true); err != nil {
+		tlog.Fatal.Printf("-name_encoding: %v", err)
+		os.Exit(exitcodes.Usage)
+	}
+	if args.plaintextnames && args.name_encoding != nametransform.EncodingBase64URL {
+		tlog.Fatal.Printf("-name_encoding cannot be used together with -plaintextnames")
+		os.Exit(exitcodes.Usage)
+	}
+	if args.fanout && (args.plaintextnames || args.reverse) {
+		tlog.Fatal.Printf("-fanout cannot be used together with -plaintextnames or -reverse")
+		os.Exit(exitcodes.Usage)
+	}
+	if args.filetags && args.reverse {
+		tlog.Fatal.Printf("-filetags cannot be used together with -reverse")
+		os.Exit(exitcodes.Usage)
 	}
 	{
-		var password []byte
 		var fido2CredentialID, fido2HmacSalt []byte
 		if args.fido2 != "" {
 			fido2CredentialID = fido2.Register(args.fido2, filepath.Base(args.cipherdir))
 			fido2HmacSalt = cryptocore.RandBytes(32)
-			password = fido2.Secret(args.fido2, fido2CredentialID, fido2HmacSalt)
-		} else {
-			// normal password entry
-			password = readpassword.Twice([]string(args.extpass), []string(args.passfile))
-			fido2CredentialID = nil
-			fido2HmacSalt = nil
 		}
 		creator := tlog.ProgramName + " " + GitVersion
-		err = configfile.Create(args.config, password, args.plaintextnames,
-			args.scryptn, creator, args.aessiv, args.devrandom, fido2CredentialID, fido2HmacSalt)
+		// The key provider asks for the password, see newKeyProvider
+		newProvider := func(cf *configfile.ConfFile) configfile.KeyProvider {
+			return newKeyProvider(args, cf)
+		}
+		err = configfile.CreateWithProvider(args.config, newProvider, args.plaintextnames,
+			creator, args.aessiv, args.devrandom, fido2CredentialID, fido2HmacSalt, args.masterkey_len, args.name_encoding,
+			args.fanout, args.filetags)
 		if err != nil {
 			tlog.Fatal.Println(err)
 			os.Exit(exitcodes.WriteConf)
 		}
-		for i := range password {
-			password[i] = 0
-		}
-		// password runs out of scope here
 	}
 	// Forward mode with filename encryption enabled needs a gocryptfs.diriv file
 	// in the root dir
@@ -111,6 +149,10 @@ func initDir(args *argContainer) {
 			os.Exit(exitcodes.Init)
 		}
 	}
+	if args.json {
+		printInitSummary(args)
+		return
+	}
 	mountArgs := ""
 	fsName := "gocryptfs"
 	if args.reverse {
@@ -0,0 +1,42 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/rfjakob/gocryptfs/internal/configfile"
+)
+
+// TestInitAfterInterrupt simulates an -init that was killed before it could
+// rename the temporary config file into place, and checks that the next
+// -init removes the leftover and succeeds.
+func TestInitAfterInterrupt(t *testing.T) {
+	dir, err := ioutil.TempDir("", "TestInitAfterInterrupt.")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	conf := filepath.Join(dir, configfile.ConfDefaultName)
+	// What WriteFile had written when the crash happened
+	partial := []byte("{\n\t\"Creator\": \"gocryptfs\",\n\t\"EncryptedKey\": \"3q2+7w")
+	if err = ioutil.WriteFile(conf+".tmp", partial, 0400); err != nil {
+		t.Fatal(err)
+	}
+
+	oldArgs := os.Args
+	os.Args = []string{"gocryptfs", "-init", "-q", "-scryptn=10", "-extpass", "echo test", dir}
+	args := parseCliOpts()
+	os.Args = oldArgs
+	args.cipherdir = dir
+	args.config = conf
+	initDir(&args)
+
+	if _, err = os.Stat(conf + ".tmp"); !os.IsNotExist(err) {
+		t.Errorf("the temporary config file is still there: %v", err)
+	}
+	if _, _, err = configfile.LoadAndDecrypt(conf, []byte("test")); err != nil {
+		t.Errorf("the new config does not load: %v", err)
+	}
+}
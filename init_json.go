@@ -0,0 +1,109 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+
+	"github.com/rfjakob/gocryptfs/internal/configfile"
+	"github.com/rfjakob/gocryptfs/internal/contentenc"
+	"github.com/rfjakob/gocryptfs/internal/cryptocore"
+	"github.com/rfjakob/gocryptfs/internal/exitcodes"
+	"github.com/rfjakob/gocryptfs/internal/nametransform"
+	"github.com/rfjakob/gocryptfs/internal/tlog"
+)
+
+// initSummary describes a newly created filesystem. It is printed by
+// "-init -json" for scripts and must never contain the master key, the
+// password or the scrypt salt.
+type initSummary struct {
+	CipherDir string
+	Config    string
+	Reverse   bool
+	// Version is the on-disk format version
+	Version uint16
+	// Cipher is "AES-GCM" or "AES-SIV"
+	Cipher       string
+	BlockSize    int
+	MasterKeyLen int
+	// FilenameMode is "encrypted" or "plaintext"
+	FilenameMode string
+	// NameEncoding is only set when file names are encrypted
+	NameEncoding string `json:",omitempty"`
+	// Raw64 means that base64 names are unpadded
+	Raw64        bool
+	LongNames    bool
+	HKDF         bool
+	FIDO2        bool
+	FeatureFlags []string
+	KDF          kdfSummary
+}
+
+// kdfSummary are the scrypt parameters without the salt
+type kdfSummary struct {
+	Algorithm string
+	N         int
+	R         int
+	P         int
+	KeyLen    int
+	SaltLen   int
+}
+
+// newInitSummary builds the summary from the config file "cf" that was just
+// written to "args.config".
+func newInitSummary(args *argContainer, cf *configfile.ConfFile) initSummary {
+	s := initSummary{
+		CipherDir:    args.cipherdir,
+		Config:       args.config,
+		Reverse:      args.reverse,
+		Version:      cf.Version,
+		Cipher:       "AES-GCM",
+		BlockSize:    contentenc.DefaultBS,
+		MasterKeyLen: cryptocore.KeyLen,
+		FilenameMode: "encrypted",
+		Raw64:        cf.IsFeatureFlagSet(configfile.FlagRaw64),
+		LongNames:    cf.IsFeatureFlagSet(configfile.FlagLongNames),
+		HKDF:         cf.IsFeatureFlagSet(configfile.FlagHKDF),
+		FIDO2:        cf.IsFeatureFlagSet(configfile.FlagFIDO2),
+		FeatureFlags: cf.FeatureFlags,
+		KDF: kdfSummary{
+			Algorithm: "scrypt",
+			N:         cf.ScryptObject.N,
+			R:         cf.ScryptObject.R,
+			P:         cf.ScryptObject.P,
+			KeyLen:    cf.ScryptObject.KeyLen,
+			SaltLen:   len(cf.ScryptObject.Salt),
+		},
+	}
+	if cf.IsFeatureFlagSet(configfile.FlagAESSIV) {
+		s.Cipher = "AES-SIV"
+	}
+	if cf.IsFeatureFlagSet(configfile.FlagMasterKeyLen) {
+		s.MasterKeyLen = cf.MasterKeyLen
+	}
+	if cf.IsFeatureFlagSet(configfile.FlagPlaintextNames) {
+		s.FilenameMode = "plaintext"
+	} else {
+		s.NameEncoding = nametransform.EncodingBase64URL
+		if cf.IsFeatureFlagSet(configfile.FlagNameEncoding) {
+			s.NameEncoding = cf.NameEncoding
+		}
+	}
+	return s
+}
+
+// printInitSummary prints the JSON summary of the filesystem just created by
+// initDir to stdout. This is called when you pass "-init -json".
+func printInitSummary(args *argContainer) {
+	cf, err := configfile.Load(args.config)
+	if err != nil {
+		tlog.Fatal.Printf("Reading back the new config file failed: %v", err)
+		os.Exit(exitcodes.LoadConf)
+	}
+	js, err := json.MarshalIndent(newInitSummary(args, cf), "", "\t")
+	if err != nil {
+		tlog.Fatal.Println(err)
+		os.Exit(exitcodes.Init)
+	}
+	fmt.Println(string(js))
+}
@@ -0,0 +1,95 @@
+// Package atrest checks, on a best-effort basis, if a directory is stored on
+// a volume that is encrypted at rest, like a LUKS volume on Linux or a
+// FileVault volume on MacOS. It is used by "-require_encrypted_volume" as a
+// policy guardrail and does not affect what gocryptfs encrypts.
+package atrest
+
+import (
+	"strings"
+)
+
+// cowFilesystems do not overwrite file content in place
+var cowFilesystems = map[string]bool{
+	"apfs":     true,
+	"bcachefs": true,
+	"btrfs":    true,
+	"zfs":      true,
+}
+
+// mount is one line of /proc/self/mountinfo
+type mount struct {
+	// Device number as "MAJOR:MINOR"
+	devnum     string
+	mountpoint string
+	fstype     string
+	source     string
+}
+
+// findMount returns the mount that the absolute, symlink-free path "dir" is
+// on, according to the mountinfo file content "mountinfo".
+func findMount(mountinfo string, dir string) (m mount, found bool) {
+	for _, line := range strings.Split(mountinfo, "\n") {
+		// Format: ID PARENT MAJ:MIN ROOT MOUNTPOINT OPTIONS [OPTIONAL...] - TYPE SOURCE SUPER_OPTIONS
+		fields := strings.Fields(line)
+		sep := -1
+		for i, f := range fields {
+			if f == "-" {
+				sep = i
+				break
+			}
+		}
+		if len(fields) < 5 || sep < 0 || sep+2 >= len(fields) {
+			continue
+		}
+		mnt := unescapeMountinfo(fields[4])
+		if mnt != "/" && dir != mnt && !strings.HasPrefix(dir, mnt+"/") {
+			continue
+		}
+		// The longest mountpoint wins. On equal length, the later line is
+		// mounted on top of the earlier one.
+		if !found || len(mnt) >= len(m.mountpoint) {
+			m = mount{
+				devnum:     fields[2],
+				mountpoint: mnt,
+				fstype:     fields[sep+1],
+				source:     unescapeMountinfo(fields[sep+2]),
+			}
+			found = true
+		}
+	}
+	return m, found
+}
+
+// unescapeMountinfo undoes the octal escaping of spaces, tabs, newlines and
+// backslashes in /proc/self/mountinfo.
+func unescapeMountinfo(s string) string {
+	return strings.NewReplacer(`\040`, " ", `\011`, "\t", `\012`, "\n", `\134`, `\`).Replace(s)
+}
+
+// parseDiskutil decides from the output of "diskutil info" on MacOS if the
+// volume is encrypted. APFS volumes report "FileVault: Yes" and also
+// "Encrypted: Yes" when encrypted without FileVault.
+func parseDiskutil(out string) (encrypted bool, why string) {
+	values := make(map[string]string)
+	for _, line := range strings.Split(out, "\n") {
+		i := strings.Index(line, ":")
+		if i < 0 {
+			continue
+		}
+		values[strings.TrimSpace(line[:i])] = strings.TrimSpace(line[i+1:])
+	}
+	name := values["Volume Name"]
+	if name == "" {
+		name = values["Device Node"]
+	}
+	if strings.HasPrefix(values["FileVault"], "Yes") {
+		return true, "volume " + name + " is protected by FileVault"
+	}
+	if strings.HasPrefix(values["Encrypted"], "Yes") {
+		return true, "volume " + name + " is encrypted"
+	}
+	if values["FileVault"] == "" && values["Encrypted"] == "" {
+		return false, "diskutil does not report the encryption status of volume " + name
+	}
+	return false, "volume " + name + " is neither encrypted nor protected by FileVault"
+}
@@ -0,0 +1,53 @@
+package atrest
+
+import (
+	"fmt"
+	"os/exec"
+
+	"golang.org/x/sys/unix"
+)
+
+// Check reports if the volume "dir" is on is encrypted, according to
+// "diskutil info". "why" explains the decision.
+func Check(dir string) (encrypted bool, why []string) {
+	var st unix.Statfs_t
+	if err := unix.Statfs(dir, &st); err != nil {
+		return false, []string{err.Error()}
+	}
+	var b []byte
+	for _, c := range st.Mntonname {
+		if c == 0 {
+			break
+		}
+		b = append(b, byte(c))
+	}
+	mnt := string(b)
+	why = []string{fmt.Sprintf("%q is on the volume mounted on %q", dir, mnt)}
+	out, err := exec.Command("diskutil", "info", mnt).Output()
+	if err != nil {
+		return false, append(why, fmt.Sprintf("diskutil info %s: %v", mnt, err))
+	}
+	encrypted, reason := parseDiskutil(string(out))
+	return encrypted, append(why, reason)
+}
+
+// WipeUnreliable lists the reasons why overwriting a file in "dir" may leave
+// its old content on the disk. APFS, the default on MacOS, is copy-on-write.
+// An empty list is no guarantee that overwriting erases the data.
+func WipeUnreliable(dir string) []string {
+	var st unix.Statfs_t
+	if err := unix.Statfs(dir, &st); err != nil {
+		return nil
+	}
+	var b []byte
+	for _, c := range st.Fstypename {
+		if c == 0 {
+			break
+		}
+		b = append(b, byte(c))
+	}
+	if fstype := string(b); cowFilesystems[fstype] {
+		return []string{fmt.Sprintf("%q is on %s, a copy-on-write filesystem", dir, fstype)}
+	}
+	return nil
+}
@@ -0,0 +1,166 @@
+package atrest
+
+import (
+	"fmt"
+	"io/ioutil"
+	"path/filepath"
+	"strings"
+
+	"golang.org/x/sys/unix"
+)
+
+// Check reports if "dir" is on a dm-crypt (LUKS or plain) device, also when
+// LVM, RAID or partitions sit in between, or inside a gocryptfs mount. "why"
+// explains the decision step by step.
+func Check(dir string) (encrypted bool, why []string) {
+	dir, err := filepath.Abs(dir)
+	if err == nil {
+		dir, err = filepath.EvalSymlinks(dir)
+	}
+	if err != nil {
+		return false, []string{err.Error()}
+	}
+	content, err := ioutil.ReadFile("/proc/self/mountinfo")
+	if err != nil {
+		return false, []string{err.Error()}
+	}
+	return check(string(content), "/sys", dir)
+}
+
+// sourceDevnum returns the device number of the block device "source" as
+// "MAJOR:MINOR"
+var sourceDevnum = func(source string) (string, error) {
+	var st unix.Stat_t
+	if err := unix.Stat(source, &st); err != nil {
+		return "", err
+	}
+	if st.Mode&unix.S_IFMT != unix.S_IFBLK {
+		return "", fmt.Errorf("%s is not a block device", source)
+	}
+	return fmt.Sprintf("%d:%d", unix.Major(uint64(st.Rdev)), unix.Minor(uint64(st.Rdev))), nil
+}
+
+// check is Check with the content of the mountinfo file and the sysfs
+// directory passed in
+func check(mountinfo string, sys string, dir string) (encrypted bool, why []string) {
+	m, found := findMount(mountinfo, dir)
+	if !found {
+		return false, []string{fmt.Sprintf("found no mount for %q", dir)}
+	}
+	why = []string{fmt.Sprintf("%q is on %s (%s) mounted on %q", dir, m.source, m.fstype, m.mountpoint)}
+	if m.fstype == "fuse.gocryptfs" {
+		return true, append(why, m.mountpoint+" is a gocryptfs mount")
+	}
+	dev, err := sysDevice(m, sys)
+	if err == errNoBlockDevice {
+		return false, append(why, m.fstype+" is not on a block device, cannot tell if it is encrypted")
+	} else if err != nil {
+		return false, append(why, err.Error())
+	}
+	encrypted, why2 := blockEncrypted(dev, 0)
+	return encrypted, append(why, why2...)
+}
+
+var errNoBlockDevice = fmt.Errorf("not on a block device")
+
+// sysDevice returns the sysfs directory of the block device "m" is on
+func sysDevice(m mount, sys string) (string, error) {
+	devnum := m.devnum
+	// Filesystems without a block device, and btrfs, report anonymous
+	// device numbers with major 0
+	if strings.HasPrefix(devnum, "0:") {
+		if !strings.HasPrefix(m.source, "/dev/") {
+			return "", errNoBlockDevice
+		}
+		var err error
+		devnum, err = sourceDevnum(m.source)
+		if err != nil {
+			return "", err
+		}
+	}
+	dev, err := filepath.EvalSymlinks(filepath.Join(sys, "dev/block", devnum))
+	if err != nil {
+		return "", fmt.Errorf("device %s not found in %s", devnum, sys)
+	}
+	return dev, nil
+}
+
+// WipeUnreliable lists the reasons why overwriting a file in "dir" may leave
+// its old content on the disk: copy-on-write filesystems write the new data
+// to other blocks, and SSDs remap writes internally. An empty list is no
+// guarantee that overwriting erases the data.
+func WipeUnreliable(dir string) []string {
+	dir, err := filepath.Abs(dir)
+	if err == nil {
+		dir, err = filepath.EvalSymlinks(dir)
+	}
+	if err != nil {
+		return nil
+	}
+	content, err := ioutil.ReadFile("/proc/self/mountinfo")
+	if err != nil {
+		return nil
+	}
+	return wipeUnreliable(string(content), "/sys", dir)
+}
+
+// wipeUnreliable is WipeUnreliable with the content of the mountinfo file and
+// the sysfs directory passed in
+func wipeUnreliable(mountinfo string, sys string, dir string) (why []string) {
+	m, found := findMount(mountinfo, dir)
+	if !found {
+		return nil
+	}
+	if cowFilesystems[m.fstype] {
+		why = append(why, m.mountpoint+" is on "+m.fstype+", a copy-on-write filesystem")
+	}
+	dev, err := sysDevice(m, sys)
+	if err != nil {
+		return why
+	}
+	// Partitions have no queue directory, their disk has
+	for _, q := range []string{filepath.Join(dev, "queue/rotational"), filepath.Join(filepath.Dir(dev), "queue/rotational")} {
+		rot, err := ioutil.ReadFile(q)
+		if err != nil {
+			continue
+		}
+		if strings.TrimSpace(string(rot)) == "0" {
+			why = append(why, m.source+" is an SSD (non-rotational device)")
+		}
+		break
+	}
+	return why
+}
+
+// blockEncrypted reports if the block device with the sysfs directory "dev"
+// is a dm-crypt device, or is only stacked on dm-crypt devices.
+func blockEncrypted(dev string, depth int) (bool, []string) {
+	name := filepath.Base(dev)
+	if dmName, err := ioutil.ReadFile(filepath.Join(dev, "dm/name")); err == nil {
+		name = fmt.Sprintf("%s (%s)", name, strings.TrimSpace(string(dmName)))
+	}
+	// LUKS devices have a uuid like "CRYPT-LUKS2-...", plain dm-crypt
+	// devices "CRYPT-PLAIN-..."
+	uuid, _ := ioutil.ReadFile(filepath.Join(dev, "dm/uuid"))
+	if strings.HasPrefix(string(uuid), "CRYPT-") {
+		return true, []string{name + " is a dm-crypt device"}
+	}
+	// Device mapper and RAID devices list the devices below them in
+	// "slaves". Guard against loops in broken sysfs trees.
+	slaves, _ := ioutil.ReadDir(filepath.Join(dev, "slaves"))
+	if len(slaves) == 0 || depth > 8 {
+		return false, []string{name + " is not a dm-crypt device and not stacked on one"}
+	}
+	why := []string{fmt.Sprintf("%s is stacked on %d device(s)", name, len(slaves))}
+	encrypted := true
+	for _, s := range slaves {
+		slave, err := filepath.EvalSymlinks(filepath.Join(dev, "slaves", s.Name()))
+		if err != nil {
+			return false, append(why, err.Error())
+		}
+		enc, why2 := blockEncrypted(slave, depth+1)
+		encrypted = encrypted && enc
+		why = append(why, why2...)
+	}
+	return encrypted, why
+}
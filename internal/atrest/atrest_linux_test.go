@@ -0,0 +1,145 @@
+package atrest
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+const testMountinfo = `22 1 8:1 / / rw,relatime shared:1 - ext4 /dev/sda1 rw
+30 22 253:1 / /home rw,relatime shared:2 - ext4 /dev/mapper/vg-home rw
+31 22 253:0 / /secret\040dir rw - xfs /dev/mapper/luks-1234 rw
+32 22 9:0 / /raid rw - ext4 /dev/md0 rw
+33 22 0:45 / /tmp rw,nosuid - tmpfs tmpfs rw
+34 22 0:50 / /data rw - btrfs /dev/mapper/luks-1234 rw
+35 30 0:60 / /home/u/plain rw - fuse.gocryptfs /home/u/cipher rw
+36 22 8:17 / /usb rw - vfat /dev/sdb1 rw
+`
+
+// fakeSys builds a sysfs tree with a plain partition sda1, a LUKS device
+// dm-0 on sda2, an LVM volume dm-1 on top of dm-0, and a RAID md0 that
+// mirrors sda1 and dm-0.
+func fakeSys(t *testing.T) string {
+	sys, err := ioutil.TempDir("", "atrest")
+	if err != nil {
+		t.Fatal(err)
+	}
+	mkdir := func(dir string) {
+		if err := os.MkdirAll(filepath.Join(sys, dir), 0700); err != nil {
+			t.Fatal(err)
+		}
+	}
+	write := func(path string, content string) {
+		mkdir(filepath.Dir(path))
+		if err := ioutil.WriteFile(filepath.Join(sys, path), []byte(content), 0600); err != nil {
+			t.Fatal(err)
+		}
+	}
+	symlink := func(target string, link string) {
+		mkdir(filepath.Dir(link))
+		if err := os.Symlink(target, filepath.Join(sys, link)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	mkdir("devices/sda/sda1")
+	mkdir("devices/sda/sda2")
+	write("devices/dm-0/dm/uuid", "CRYPT-LUKS2-1234abcd-luks-1234\n")
+	write("devices/dm-0/dm/name", "luks-1234\n")
+	symlink("../../sda/sda2", "devices/dm-0/slaves/sda2")
+	write("devices/dm-1/dm/uuid", "LVM-abcdef\n")
+	write("devices/dm-1/dm/name", "vg-home\n")
+	symlink("../../dm-0", "devices/dm-1/slaves/dm-0")
+	symlink("../../sda/sda1", "devices/md0/slaves/sda1")
+	symlink("../../dm-0", "devices/md0/slaves/dm-0")
+	symlink("../../devices/sda/sda1", "dev/block/8:1")
+	symlink("../../devices/sda/sda2", "dev/block/8:2")
+	symlink("../../devices/dm-0", "dev/block/253:0")
+	symlink("../../devices/dm-1", "dev/block/253:1")
+	symlink("../../devices/md0", "dev/block/9:0")
+	return sys
+}
+
+func TestCheck(t *testing.T) {
+	sys := fakeSys(t)
+	defer os.RemoveAll(sys)
+	oldSourceDevnum := sourceDevnum
+	defer func() { sourceDevnum = oldSourceDevnum }()
+	sourceDevnum = func(source string) (string, error) {
+		if source != "/dev/mapper/luks-1234" {
+			t.Errorf("unexpected source %q", source)
+		}
+		return "253:0", nil
+	}
+
+	testCases := []struct {
+		dir       string
+		encrypted bool
+		// Must appear in the explanation
+		why string
+	}{
+		{"/etc", false, "sda1 is not a dm-crypt device"},
+		{"/", false, "sda1 is not a dm-crypt device"},
+		{"/home/u/docs", true, "dm-0 (luks-1234) is a dm-crypt device"},
+		{"/secret dir/x", true, "dm-0 (luks-1234) is a dm-crypt device"},
+		{"/secret", false, "sda1"},
+		{"/raid/x", false, "sda1 is not a dm-crypt device"},
+		{"/tmp/x", false, "tmpfs is not on a block device"},
+		{"/data", true, "dm-crypt"},
+		{"/home/u/plain/x", true, "gocryptfs mount"},
+		{"/usb", false, "device 8:17 not found"},
+	}
+	for _, tc := range testCases {
+		encrypted, why := check(testMountinfo, sys, tc.dir)
+		if encrypted != tc.encrypted {
+			t.Errorf("%q: want encrypted=%v, have %v, because: %v", tc.dir, tc.encrypted, encrypted, why)
+		}
+		if !strings.Contains(strings.Join(why, "\n"), tc.why) {
+			t.Errorf("%q: explanation does not contain %q: %v", tc.dir, tc.why, why)
+		}
+	}
+}
+
+func TestWipeUnreliable(t *testing.T) {
+	sys := fakeSys(t)
+	defer os.RemoveAll(sys)
+	for path, rot := range map[string]string{"devices/sda/queue/rotational": "1\n", "devices/dm-1/queue/rotational": "0\n",
+		"devices/dm-0/queue/rotational": "0\n"} {
+		if err := os.MkdirAll(filepath.Join(sys, filepath.Dir(path)), 0700); err != nil {
+			t.Fatal(err)
+		}
+		if err := ioutil.WriteFile(filepath.Join(sys, path), []byte(rot), 0600); err != nil {
+			t.Fatal(err)
+		}
+	}
+	oldSourceDevnum := sourceDevnum
+	defer func() { sourceDevnum = oldSourceDevnum }()
+	sourceDevnum = func(source string) (string, error) {
+		return "253:0", nil
+	}
+
+	testCases := []struct {
+		dir string
+		// Must appear in the reasons, in this order. Nil for none.
+		why []string
+	}{
+		{"/etc", nil},
+		{"/home/u/docs", []string{"SSD"}},
+		{"/data", []string{"copy-on-write", "SSD"}},
+		{"/tmp/x", nil},
+		{"/usb", nil},
+	}
+	for _, tc := range testCases {
+		why := wipeUnreliable(testMountinfo, sys, tc.dir)
+		if len(why) != len(tc.why) {
+			t.Errorf("%q: want %d reasons, have %v", tc.dir, len(tc.why), why)
+			continue
+		}
+		for i := range why {
+			if !strings.Contains(why[i], tc.why[i]) {
+				t.Errorf("%q: reason %q does not contain %q", tc.dir, why[i], tc.why[i])
+			}
+		}
+	}
+}
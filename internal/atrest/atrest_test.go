@@ -0,0 +1,24 @@
+package atrest
+
+import (
+	"testing"
+)
+
+func TestParseDiskutil(t *testing.T) {
+	testCases := []struct {
+		out       string
+		encrypted bool
+	}{
+		{"   Volume Name:              Macintosh HD - Data\n   FileVault:                 Yes (Unlocked)\n", true},
+		{"   Volume Name:              Backup\n   Encrypted:                 Yes (Unlocked)\n   FileVault:                 No\n", true},
+		{"   Volume Name:              USB\n   Encrypted:                 No\n   FileVault:                 No\n", false},
+		// HFS+ and FAT volumes do not report the encryption status
+		{"   Volume Name:              STICK\n   File System Personality:   MS-DOS FAT32\n", false},
+	}
+	for _, tc := range testCases {
+		encrypted, why := parseDiskutil(tc.out)
+		if encrypted != tc.encrypted {
+			t.Errorf("want encrypted=%v, have %v (%s) for %q", tc.encrypted, encrypted, why, tc.out)
+		}
+	}
+}
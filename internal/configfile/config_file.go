@@ -8,6 +8,7 @@ import (
 	"io"
 	"io/ioutil"
 	"log"
+	"path/filepath"
 	"syscall"
 
 	"os"
@@ -15,6 +16,7 @@ import (
 	"github.com/rfjakob/gocryptfs/internal/contentenc"
 	"github.com/rfjakob/gocryptfs/internal/cryptocore"
 	"github.com/rfjakob/gocryptfs/internal/exitcodes"
+	"github.com/rfjakob/gocryptfs/internal/nametransform"
 	"github.com/rfjakob/gocryptfs/internal/tlog"
 )
 
@@ -50,6 +52,12 @@ type ConfFile struct {
 	ScryptObject ScryptKDF
 	// Version is the On-Disk-Format version this filesystem uses
 	Version uint16
+	// ReadCompatVersion is set by on-disk format versions newer than
+	// contentenc.CurrentVersion to the oldest version that can still read
+	// the filesystem, see checkVersion. Zero means that only binaries that
+	// support Version can use it, which holds for all format versions up to
+	// now.
+	ReadCompatVersion uint16 `json:",omitempty"`
 	// FeatureFlags is a list of feature flags this filesystem has enabled.
 	// If gocryptfs encounters a feature flag it does not support, it will refuse
 	// mounting. This mechanism is analogous to the ext4 feature flags that are
@@ -57,8 +65,29 @@ type ConfFile struct {
 	FeatureFlags []string
 	// FIDO2 parameters
 	FIDO2 FIDO2Params
+	// MasterKeyLen is the length of the master key in bytes. Only set
+	// together with the "MasterKeyLen" feature flag, otherwise the length is
+	// cryptocore.KeyLen.
+	MasterKeyLen int `json:",omitempty"`
+	// NameEncoding is the encoding of the encrypted file names, see
+	// nametransform.NewNameEncoding. Only set together with the
+	// "NameEncoding" feature flag, otherwise names use base64.
+	NameEncoding string `json:",omitempty"`
+	// KeySlots holds more copies of the master key, each encrypted with its
+	// own password, see AddKeySlot. EncryptedKey and ScryptObject are slot 0,
+	// KeySlots[0] is slot 1 and so on.
+	// Only set together with the "KeySlots" feature flag, so older versions
+	// of gocryptfs, which would drop the other slots on "-passwd", refuse
+	// to load the config.
+	KeySlots []KeySlot `json:",omitempty"`
 	// Filename is the name of the config file. Not exported to JSON.
 	filename string
+	// unlockedSlot is the key slot the last DecryptMasterKey call unlocked.
+	// Not exported to JSON.
+	unlockedSlot int
+	// readOnlyCompat is set when the filesystem has a newer on-disk format
+	// that we can only read, see ReadOnlyCompat. Not exported to JSON.
+	readOnlyCompat bool
 }
 
 // randBytesDevRandom gets "n" random bytes from /dev/random or panics
@@ -79,8 +108,48 @@ func randBytesDevRandom(n int) []byte {
 // Create - create a new config with a random key encrypted with
 // "password" and write it to "filename".
 // Uses scrypt with cost parameter logN.
+// The master key is "masterkeyLen" bytes long, pass zero for the default.
 func Create(filename string, password []byte, plaintextNames bool,
-	logN int, creator string, aessiv bool, devrandom bool, fido2CredentialID []byte, fido2HmacSalt []byte) error {
+	logN int, creator string, aessiv bool, devrandom bool, fido2CredentialID []byte, fido2HmacSalt []byte,
+	masterkeyLen int, nameEncoding string) error {
+	newProvider := func(cf *ConfFile) KeyProvider {
+		return &PasswordProvider{
+			Conf:     cf,
+			Password: func() []byte { return append([]byte(nil), password...) },
+			LogN:     logN,
+		}
+	}
+	return CreateWithProvider(filename, newProvider, plaintextNames, creator, aessiv, devrandom,
+		fido2CredentialID, fido2HmacSalt, masterkeyLen, nameEncoding, false, false)
+}
+
+// CreateWithProvider is Create with the master key stored by the KeyProvider
+// that "newProvider" returns for the new config. "fanout" enables
+// FlagFanout, "fileTags" enables FlagFileTags.
+func CreateWithProvider(filename string, newProvider func(*ConfFile) KeyProvider, plaintextNames bool,
+	creator string, aessiv bool, devrandom bool, fido2CredentialID []byte, fido2HmacSalt []byte,
+	masterkeyLen int, nameEncoding string, fanout bool, fileTags bool) error {
+	if masterkeyLen == 0 {
+		masterkeyLen = cryptocore.KeyLen
+	}
+	// New filesystems always use HKDF
+	if err := cryptocore.ValidKeyLen(masterkeyLen, true); err != nil {
+		return err
+	}
+	if nameEncoding == nametransform.EncodingBase64URL {
+		nameEncoding = ""
+	}
+	if nameEncoding != "" {
+		if plaintextNames {
+			return fmt.Errorf("a name encoding cannot be used with plaintext names")
+		}
+		if _, err := nametransform.NewNameEncoding(nameEncoding, true); err != nil {
+			return err
+		}
+	}
+	if fanout && plaintextNames {
+		return fmt.Errorf("fanout cannot be used with plaintext names")
+	}
 	var cf ConfFile
 	cf.filename = filename
 	cf.Creator = creator
@@ -100,27 +169,44 @@ func Create(filename string, password []byte, plaintextNames bool,
 	if aessiv {
 		cf.FeatureFlags = append(cf.FeatureFlags, knownFlags[FlagAESSIV])
 	}
+	if fanout {
+		cf.FeatureFlags = append(cf.FeatureFlags, knownFlags[FlagFanout])
+	}
+	if fileTags {
+		cf.FeatureFlags = append(cf.FeatureFlags, knownFlags[FlagFileTags])
+	}
 	if len(fido2CredentialID) > 0 {
 		cf.FeatureFlags = append(cf.FeatureFlags, knownFlags[FlagFIDO2])
 		cf.FIDO2.CredentialID = fido2CredentialID
 		cf.FIDO2.HMACSalt = fido2HmacSalt
 	}
+	if masterkeyLen != cryptocore.KeyLen {
+		cf.FeatureFlags = append(cf.FeatureFlags, knownFlags[FlagMasterKeyLen])
+		cf.MasterKeyLen = masterkeyLen
+	}
+	if nameEncoding != "" {
+		cf.FeatureFlags = append(cf.FeatureFlags, knownFlags[FlagNameEncoding])
+		cf.NameEncoding = nameEncoding
+	}
 	{
 		// Generate new random master key
 		var key []byte
 		if devrandom {
-			key = randBytesDevRandom(cryptocore.KeyLen)
+			key = randBytesDevRandom(masterkeyLen)
 		} else {
-			key = cryptocore.RandBytes(cryptocore.KeyLen)
+			key = cryptocore.RandBytes(masterkeyLen)
 		}
 		tlog.PrintMasterkeyReminder(key)
-		// Encrypt it using the password
-		// This sets ScryptObject and EncryptedKey
+		// With the password provider, this sets ScryptObject and
+		// EncryptedKey.
 		// Note: this looks at the FeatureFlags, so call it AFTER setting them.
-		cf.EncryptKey(key, password, logN)
+		err := newProvider(&cf).Wrap(key)
 		for i := range key {
 			key[i] = 0
 		}
+		if err != nil {
+			return err
+		}
 		// key runs out of scope here
 	}
 	// Write file to disk
@@ -176,13 +262,20 @@ func Load(filename string) (*ConfFile, error) {
 		return nil, err
 	}
 
-	if cf.Version != contentenc.CurrentVersion {
-		return nil, fmt.Errorf("Unsupported on-disk format %d", cf.Version)
+	cf.readOnlyCompat, err = cf.CheckVersion()
+	if err != nil {
+		return nil, err
 	}
 
-	// Check that all set feature flags are known
+	// Check that all set feature flags are known. A newer on-disk format
+	// that declares itself read-compatible promises that we can ignore the
+	// flags it added.
 	for _, flag := range cf.FeatureFlags {
 		if !cf.isFeatureFlagKnown(flag) {
+			if cf.readOnlyCompat {
+				tlog.Info.Printf("Ignoring feature flag %q of the newer on-disk format", flag)
+				continue
+			}
 			return nil, fmt.Errorf("Unsupported feature flag %q", flag)
 		}
 	}
@@ -216,22 +309,95 @@ func Load(filename string) (*ConfFile, error) {
 		return nil, exitcodes.NewErr("Deprecated filesystem", exitcodes.DeprecatedFS)
 	}
 
+	if cf.IsFeatureFlagSet(FlagMasterKeyLen) {
+		if err := cryptocore.ValidKeyLen(cf.MasterKeyLen, cf.IsFeatureFlagSet(FlagHKDF)); err != nil {
+			return nil, fmt.Errorf("MasterKeyLen: %v", err)
+		}
+	} else if cf.MasterKeyLen != 0 {
+		return nil, fmt.Errorf("MasterKeyLen is set, but the %q feature flag is missing", knownFlags[FlagMasterKeyLen])
+	}
+	if cf.IsFeatureFlagSet(FlagNameEncoding) {
+		if _, err := nametransform.NewNameEncoding(cf.NameEncoding, cf.IsFeatureFlagSet(FlagRaw64)); err != nil {
+			return nil, fmt.Errorf("NameEncoding: %v", err)
+		}
+	} else if cf.NameEncoding != "" {
+		return nil, fmt.Errorf("NameEncoding is set, but the %q feature flag is missing", knownFlags[FlagNameEncoding])
+	}
+	if len(cf.KeySlots) > 0 && !cf.IsFeatureFlagSet(FlagKeySlots) {
+		return nil, fmt.Errorf("KeySlots is set, but the %q feature flag is missing", knownFlags[FlagKeySlots])
+	}
+
 	// All good
 	return &cf, nil
 }
 
-// DecryptMasterKey decrypts the masterkey stored in cf.EncryptedKey using
-// password.
+// CheckVersion checks that we can use the on-disk format cf.Version.
+//
+// A filesystem created by a newer gocryptfs with a newer on-disk format is
+// read-compatible if it sets ReadCompatVersion to our version or an older
+// one. A format version may only do that if it leaves the content and file
+// name encryption, and the file headers, as the older version has them, and
+// only adds things that an older version can ignore when reading: config
+// fields, feature flags, and side files. The older version would not keep
+// these up to date when writing, so it must only mount read-only, which is
+// what "readOnly" says. Newer format versions without ReadCompatVersion, and
+// older ones, are refused.
+func (cf *ConfFile) CheckVersion() (readOnly bool, err error) {
+	if cf.Version == contentenc.CurrentVersion {
+		return false, nil
+	}
+	if cf.Version < contentenc.CurrentVersion {
+		return false, fmt.Errorf("Unsupported on-disk format %d", cf.Version)
+	}
+	if cf.ReadCompatVersion != 0 && cf.ReadCompatVersion <= contentenc.CurrentVersion {
+		return true, nil
+	}
+	return false, exitcodes.NewErr(fmt.Sprintf("Filesystem was created by a newer gocryptfs (%q, on-disk format %d), "+
+		"this binary supports on-disk format %d. Please upgrade gocryptfs.",
+		cf.Creator, cf.Version, contentenc.CurrentVersion), exitcodes.NewerFS)
+}
+
+// ReadOnlyCompat returns true if the filesystem has a newer on-disk format
+// that we can read, but must not write, see CheckVersion. WriteFile refuses
+// to write such a config file.
+func (cf *ConfFile) ReadOnlyCompat() bool {
+	return cf.readOnlyCompat
+}
+
+// DecryptMasterKey decrypts the masterkey stored in cf.EncryptedKey, or in
+// one of cf.KeySlots, using password.
 func (cf *ConfFile) DecryptMasterKey(password []byte) (masterkey []byte, err error) {
+	for i := 0; i < cf.NumKeySlots(); i++ {
+		encryptedKey, scryptObject := cf.slot(i)
+		masterkey, err = cf.decryptKey(*encryptedKey, scryptObject, password)
+		if err == nil {
+			cf.unlockedSlot = i
+			break
+		}
+	}
+	if err != nil {
+		tlog.Warn.Printf("failed to unlock master key: %s", err.Error())
+		return nil, exitcodes.NewErr("Password incorrect.", exitcodes.PasswordIncorrect)
+	}
+	if len(masterkey) != cf.masterKeyLen() {
+		return nil, exitcodes.NewErr(fmt.Sprintf("master key has length %d, want %d", len(masterkey), cf.masterKeyLen()),
+			exitcodes.LoadConf)
+	}
+	return masterkey, nil
+}
+
+// decryptKey decrypts "encryptedKey" with a key derived from "password"
+// through "scryptObject"
+func (cf *ConfFile) decryptKey(encryptedKey []byte, scryptObject *ScryptKDF, password []byte) (masterkey []byte, err error) {
 	// Generate derived key from password
-	scryptHash := cf.ScryptObject.DeriveKey(password)
+	scryptHash := scryptObject.DeriveKey(password)
 
 	// Unlock master key using password-based key
 	useHKDF := cf.IsFeatureFlagSet(FlagHKDF)
 	ce := getKeyEncrypter(scryptHash, useHKDF)
 
 	tlog.Warn.Enabled = false // Silence DecryptBlock() error messages on incorrect password
-	masterkey, err = ce.DecryptBlock(cf.EncryptedKey, 0, nil)
+	masterkey, err = ce.DecryptBlock(encryptedKey, 0, nil)
 	tlog.Warn.Enabled = true
 
 	// Purge scrypt-derived key
@@ -242,26 +408,40 @@ func (cf *ConfFile) DecryptMasterKey(password []byte) (masterkey []byte, err err
 	ce.Wipe()
 	ce = nil
 
-	if err != nil {
-		tlog.Warn.Printf("failed to unlock master key: %s", err.Error())
-		return nil, exitcodes.NewErr("Password incorrect.", exitcodes.PasswordIncorrect)
+	return masterkey, err
+}
+
+// masterKeyLen returns the length of the master key in bytes
+func (cf *ConfFile) masterKeyLen() int {
+	if cf.IsFeatureFlagSet(FlagMasterKeyLen) {
+		return cf.MasterKeyLen
 	}
-	return masterkey, nil
+	return cryptocore.KeyLen
 }
 
 // EncryptKey - encrypt "key" using an scrypt hash generated from "password"
 // and store it in cf.EncryptedKey.
 // Uses scrypt with cost parameter logN and stores the scrypt parameters in
 // cf.ScryptObject.
+//
+// If the last DecryptMasterKey call unlocked one of cf.KeySlots, that slot is
+// replaced instead, so that "-passwd" changes the password that was entered.
 func (cf *ConfFile) EncryptKey(key []byte, password []byte, logN int) {
+	encryptedKey, scryptObject := cf.slot(cf.unlockedSlot)
+	*encryptedKey, *scryptObject = cf.encryptKey(key, password, logN)
+}
+
+// encryptKey encrypts "key" with a key derived from "password" through a new
+// ScryptKDF with cost parameter logN
+func (cf *ConfFile) encryptKey(key []byte, password []byte, logN int) (encryptedKey []byte, scryptObject ScryptKDF) {
 	// Generate scrypt-derived key from password
-	cf.ScryptObject = NewScryptKDF(logN)
-	scryptHash := cf.ScryptObject.DeriveKey(password)
+	scryptObject = NewScryptKDF(logN)
+	scryptHash := scryptObject.DeriveKey(password)
 
 	// Lock master key using password-based key
 	useHKDF := cf.IsFeatureFlagSet(FlagHKDF)
 	ce := getKeyEncrypter(scryptHash, useHKDF)
-	cf.EncryptedKey = ce.EncryptBlock(key, 0, nil)
+	encryptedKey = ce.EncryptBlock(key, 0, nil)
 
 	// Purge scrypt-derived key
 	for i := range scryptHash {
@@ -270,26 +450,63 @@ func (cf *ConfFile) EncryptKey(key []byte, password []byte, logN int) {
 	scryptHash = nil
 	ce.Wipe()
 	ce = nil
+	return encryptedKey, scryptObject
+}
+
+// TmpDir is the directory WriteFile creates its temporary file in. Empty means
+// next to the config file, which guarantees that the final rename does not
+// cross a filesystem boundary. $TMPDIR is deliberately not used.
+// Set via "-tmpdir".
+var TmpDir string
+
+// tmpFile is the temporary file WriteFile writes the new config to
+type tmpFile interface {
+	io.Writer
+	Sync() error
+	Close() error
+}
+
+// newTmpFile creates the temporary file. Tests replace it to simulate a full
+// disk.
+var newTmpFile = func(name string) (tmpFile, error) {
+	// 0400 permissions: gocryptfs.conf should be kept secret and never be written to.
+	fd, err := os.OpenFile(name, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0400)
+	if err != nil {
+		return nil, err
+	}
+	return fd, nil
 }
 
 // WriteFile - write out config in JSON format to file "filename.tmp"
 // then rename over "filename".
 // This way a password change atomically replaces the file.
+//
+// If writing the temporary file fails, for example with ENOSPC on a full
+// disk, it is deleted and "filename" is not touched.
 func (cf *ConfFile) WriteFile() error {
-	tmp := cf.filename + ".tmp"
-	// 0400 permissions: gocryptfs.conf should be kept secret and never be written to.
-	fd, err := os.OpenFile(tmp, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0400)
-	if err != nil {
-		return err
+	// We would drop whatever the newer version stored in the config file
+	if cf.readOnlyCompat {
+		return fmt.Errorf("refusing to overwrite the config file of a newer on-disk format (%d)", cf.Version)
 	}
+	tmp := tmpName(cf.filename)
 	js, err := json.MarshalIndent(cf, "", "\t")
 	if err != nil {
 		return err
 	}
 	// For convenience for the user, add a newline at the end.
 	js = append(js, '\n')
-	_, err = fd.Write(js)
+	fd, err := newTmpFile(tmp)
+	if err != nil {
+		return err
+	}
+	n, err := fd.Write(js)
+	if err == nil && n < len(js) {
+		err = io.ErrShortWrite
+	}
 	if err != nil {
+		fd.Close()
+		// Don't leave a truncated copy of the encrypted master key behind
+		os.Remove(tmp)
 		return err
 	}
 	err = fd.Sync()
@@ -302,10 +519,53 @@ func (cf *ConfFile) WriteFile() error {
 	}
 	err = fd.Close()
 	if err != nil {
+		// On NFS, a full disk may only be reported here
+		os.Remove(tmp)
 		return err
 	}
 	err = os.Rename(tmp, cf.filename)
-	return err
+	if err != nil {
+		// Don't leave a copy of the encrypted master key behind
+		os.Remove(tmp)
+		if le, ok := err.(*os.LinkError); ok && le.Err == syscall.EXDEV {
+			return fmt.Errorf("temporary directory %q is on a different filesystem than %q", filepath.Dir(tmp), cf.filename)
+		}
+		return err
+	}
+	// Make the rename itself durable. Not all filesystems support fsync on
+	// directories, so errors are ignored.
+	if dir, err := os.Open(filepath.Dir(cf.filename)); err == nil {
+		dir.Sync()
+		dir.Close()
+	}
+	return nil
+}
+
+// tmpName returns the name of the temporary file WriteFile uses for the
+// config file "filename"
+func tmpName(filename string) string {
+	if TmpDir != "" {
+		return filepath.Join(TmpDir, filepath.Base(filename)+".tmp")
+	}
+	return filename + ".tmp"
+}
+
+// RemoveStaleTmp deletes the temporary file that a WriteFile of the config
+// file "filename" leaves behind if the process is killed before the final
+// rename. Returns the name of the deleted file, or "" if there was none.
+//
+// Only call this when no other process can be writing the config file at the
+// same time, like in "-init".
+func RemoveStaleTmp(filename string) (string, error) {
+	tmp := tmpName(filename)
+	err := os.Remove(tmp)
+	if os.IsNotExist(err) {
+		return "", nil
+	}
+	if err != nil {
+		return "", err
+	}
+	return tmp, nil
 }
 
 // getKeyEncrypter is a helper function that returns the right ContentEnc
@@ -318,6 +578,6 @@ func getKeyEncrypter(scryptHash []byte, useHKDF bool) *contentenc.ContentEnc {
 		IVLen = contentenc.DefaultIVBits
 	}
 	cc := cryptocore.New(scryptHash, cryptocore.BackendGoGCM, IVLen, useHKDF, false)
-	ce := contentenc.New(cc, 4096, false)
+	ce := contentenc.New(cc, 4096, false, false)
 	return ce
 }
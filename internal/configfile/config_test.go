@@ -1,10 +1,20 @@
 package configfile
 
 import (
+	"encoding/json"
 	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"syscall"
 	"testing"
 	"time"
 
+	"golang.org/x/sys/unix"
+
+	"github.com/rfjakob/gocryptfs/internal/contentenc"
 	"github.com/rfjakob/gocryptfs/internal/tlog"
 )
 
@@ -62,7 +72,7 @@ func TestLoadV2StrangeFeature(t *testing.T) {
 }
 
 func TestCreateConfDefault(t *testing.T) {
-	err := Create("config_test/tmp.conf", testPw, false, 10, "test", false, false, nil, nil)
+	err := Create("config_test/tmp.conf", testPw, false, 10, "test", false, false, nil, nil, 0, "")
 	if err != nil {
 		t.Fatal(err)
 	}
@@ -83,14 +93,14 @@ func TestCreateConfDefault(t *testing.T) {
 }
 
 func TestCreateConfDevRandom(t *testing.T) {
-	err := Create("config_test/tmp.conf", testPw, false, 10, "test", false, true, nil, nil)
+	err := Create("config_test/tmp.conf", testPw, false, 10, "test", false, true, nil, nil, 0, "")
 	if err != nil {
 		t.Fatal(err)
 	}
 }
 
 func TestCreateConfPlaintextnames(t *testing.T) {
-	err := Create("config_test/tmp.conf", testPw, true, 10, "test", false, false, nil, nil)
+	err := Create("config_test/tmp.conf", testPw, true, 10, "test", false, false, nil, nil, 0, "")
 	if err != nil {
 		t.Fatal(err)
 	}
@@ -111,7 +121,7 @@ func TestCreateConfPlaintextnames(t *testing.T) {
 
 // Reverse mode uses AESSIV
 func TestCreateConfFileAESSIV(t *testing.T) {
-	err := Create("config_test/tmp.conf", testPw, false, 10, "test", true, false, nil, nil)
+	err := Create("config_test/tmp.conf", testPw, false, 10, "test", true, false, nil, nil, 0, "")
 	if err != nil {
 		t.Fatal(err)
 	}
@@ -124,6 +134,57 @@ func TestCreateConfFileAESSIV(t *testing.T) {
 	}
 }
 
+func TestCreateConfMasterKeyLen(t *testing.T) {
+	err := Create("config_test/tmp.conf", testPw, false, 10, "test", false, false, nil, nil, 64, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	key, c, err := LoadAndDecrypt("config_test/tmp.conf", testPw)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(key) != 64 {
+		t.Errorf("master key has length %d, want 64", len(key))
+	}
+	if !c.IsFeatureFlagSet(FlagMasterKeyLen) || c.MasterKeyLen != 64 {
+		t.Errorf("MasterKeyLen not recorded: flag=%v len=%d", c.IsFeatureFlagSet(FlagMasterKeyLen), c.MasterKeyLen)
+	}
+	for _, l := range []int{16, 31, 65} {
+		err = Create("config_test/tmp.conf", testPw, false, 10, "test", false, false, nil, nil, l, "")
+		if err == nil {
+			t.Errorf("length %d should have been rejected", l)
+		}
+	}
+}
+
+func TestCreateConfNameEncoding(t *testing.T) {
+	err := Create("config_test/tmp.conf", testPw, false, 10, "test", false, false, nil, nil, 0, "base32")
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, c, err := LoadAndDecrypt("config_test/tmp.conf", testPw)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !c.IsFeatureFlagSet(FlagNameEncoding) || c.NameEncoding != "base32" {
+		t.Errorf("NameEncoding not recorded: flag=%v encoding=%q", c.IsFeatureFlagSet(FlagNameEncoding), c.NameEncoding)
+	}
+	// The default is not recorded, so older versions can mount the filesystem
+	err = Create("config_test/tmp.conf", testPw, false, 10, "test", false, false, nil, nil, 0, "base64url")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, c, err = LoadAndDecrypt("config_test/tmp.conf", testPw); err != nil || c.IsFeatureFlagSet(FlagNameEncoding) {
+		t.Errorf("default encoding should not set the feature flag: %v", err)
+	}
+	if err = Create("config_test/tmp.conf", testPw, false, 10, "test", false, false, nil, nil, 0, "base16"); err == nil {
+		t.Error("invalid encoding should have been rejected")
+	}
+	if err = Create("config_test/tmp.conf", testPw, true, 10, "test", false, false, nil, nil, 0, "base32"); err == nil {
+		t.Error("encoding together with plaintext names should have been rejected")
+	}
+}
+
 func TestIsFeatureFlagKnown(t *testing.T) {
 	// Test a few hardcoded values
 	testKnownFlags := []string{"DirIV", "PlaintextNames", "EMENames", "GCMIV128", "LongNames", "AESSIV"}
@@ -145,3 +206,189 @@ func TestIsFeatureFlagKnown(t *testing.T) {
 		t.Errorf("flag %q should be NOT known", f)
 	}
 }
+
+// otherFS returns a directory that is on a different filesystem than the
+// current directory, or skips the test.
+func otherFS(t *testing.T) string {
+	var st1, st2 syscall.Stat_t
+	if err := syscall.Stat(".", &st1); err != nil {
+		t.Fatal(err)
+	}
+	for _, dir := range []string{"/dev/shm", "/run/user/" + strconv.Itoa(os.Getuid()), "/tmp"} {
+		if err := syscall.Stat(dir, &st2); err == nil && st1.Dev != st2.Dev && unix.Access(dir, unix.W_OK) == nil {
+			return dir
+		}
+	}
+	t.Skip("no writable directory on a different filesystem found")
+	return ""
+}
+
+// TestWriteFileTmpDir rewrites a config file while $TMPDIR is on another
+// filesystem, which must not matter, and with "-tmpdir".
+func TestWriteFileTmpDir(t *testing.T) {
+	other := otherFS(t)
+	oldTmp := os.Getenv("TMPDIR")
+	os.Setenv("TMPDIR", other)
+	defer os.Setenv("TMPDIR", oldTmp)
+	const conf = "config_test/tmpdir.conf"
+	defer os.Remove(conf)
+	if err := Create(conf, testPw, false, 10, "test", false, false, nil, nil, 0, ""); err != nil {
+		t.Fatal(err)
+	}
+	_, cf, err := LoadAndDecrypt(conf, testPw)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = cf.WriteFile(); err != nil {
+		t.Fatal(err)
+	}
+	// An explicit -tmpdir on the same filesystem works
+	tmpdir, err := ioutil.TempDir("config_test", "tmpdir")
+	if err != nil {
+		t.Fatal(err)
+	}
+	TmpDir = tmpdir
+	defer func() {
+		os.RemoveAll(tmpdir)
+		TmpDir = ""
+	}()
+	if err = cf.WriteFile(); err != nil {
+		t.Fatal(err)
+	}
+	// On another filesystem, the rename fails cleanly
+	TmpDir = other
+	if err = cf.WriteFile(); err == nil {
+		t.Fatal("rename across filesystems should have failed")
+	} else if !strings.Contains(err.Error(), "different filesystem") {
+		t.Errorf("unexpected error: %v", err)
+	}
+	if _, err = os.Stat(filepath.Join(other, "tmpdir.conf.tmp")); !os.IsNotExist(err) {
+		t.Errorf("temporary file was not removed: %v", err)
+	}
+	if _, _, err = LoadAndDecrypt(conf, testPw); err != nil {
+		t.Errorf("config file damaged: %v", err)
+	}
+}
+
+// fullDisk is a temporary file on a disk that fills up after "space" bytes
+type fullDisk struct {
+	*os.File
+	space int
+}
+
+func (f *fullDisk) Write(p []byte) (int, error) {
+	if len(p) <= f.space {
+		f.space -= len(p)
+		return f.File.Write(p)
+	}
+	n, _ := f.File.Write(p[:f.space])
+	f.space = 0
+	return n, syscall.ENOSPC
+}
+
+// TestWriteFileENOSPC runs out of space while writing the temporary file and
+// checks that the config file is unchanged and the temporary file is gone.
+func TestWriteFileENOSPC(t *testing.T) {
+	const conf = "config_test/enospc.conf"
+	defer os.Remove(conf)
+	if err := Create(conf, testPw, false, 10, "test", false, false, nil, nil, 0, ""); err != nil {
+		t.Fatal(err)
+	}
+	before, err := ioutil.ReadFile(conf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, cf, err := LoadAndDecrypt(conf, testPw)
+	if err != nil {
+		t.Fatal(err)
+	}
+	oldNewTmpFile := newTmpFile
+	defer func() { newTmpFile = oldNewTmpFile }()
+	newTmpFile = func(name string) (tmpFile, error) {
+		f, err := oldNewTmpFile(name)
+		if err != nil {
+			return nil, err
+		}
+		return &fullDisk{File: f.(*os.File), space: 100}, nil
+	}
+	cf.Creator = "changed"
+	if err = cf.WriteFile(); err != syscall.ENOSPC {
+		t.Errorf("want ENOSPC, have %v", err)
+	}
+	after, err := ioutil.ReadFile(conf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(after) != string(before) {
+		t.Error("config file was changed")
+	}
+	if _, err = os.Stat(conf + ".tmp"); !os.IsNotExist(err) {
+		t.Errorf("temporary file was not removed: %v", err)
+	}
+}
+
+// setVersion rewrites the on-disk format version fields of the config file
+// "conf", like a newer gocryptfs would write them, and adds a feature flag we
+// do not know
+func setVersion(t *testing.T, conf string, version, readCompat uint16) {
+	js, err := ioutil.ReadFile(conf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var cf ConfFile
+	if err = json.Unmarshal(js, &cf); err != nil {
+		t.Fatal(err)
+	}
+	cf.Version = version
+	cf.ReadCompatVersion = readCompat
+	if !cf.isFeatureFlagKnown(cf.FeatureFlags[len(cf.FeatureFlags)-1]) {
+		cf.FeatureFlags = append(cf.FeatureFlags, "FutureFeature")
+	}
+	js, err = json.MarshalIndent(cf, "", "\t")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = ioutil.WriteFile(conf, js, 0600); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// TestNewerVersion loads config files of a newer on-disk format. One that
+// declares itself readable by our version loads read-only, one that does not
+// is refused with a message that names both versions.
+func TestNewerVersion(t *testing.T) {
+	const conf = "config_test/newer.conf"
+	defer os.Remove(conf)
+	next := uint16(contentenc.CurrentVersion + 1)
+
+	if err := Create(conf, testPw, false, 10, "test", false, false, nil, nil, 0, ""); err != nil {
+		t.Fatal(err)
+	}
+	setVersion(t, conf, next, contentenc.CurrentVersion)
+	key, cf, err := LoadAndDecrypt(conf, testPw)
+	if err != nil {
+		t.Fatalf("read-compatible newer version: %v", err)
+	}
+	if len(key) == 0 || !cf.ReadOnlyCompat() {
+		t.Errorf("want a key and read-only, have len(key)=%d, ReadOnlyCompat=%v", len(key), cf.ReadOnlyCompat())
+	}
+	if err = cf.WriteFile(); err == nil {
+		t.Error("WriteFile must refuse to overwrite a newer config file")
+	}
+
+	setVersion(t, conf, next, 0)
+	_, _, err = LoadAndDecrypt(conf, testPw)
+	if err == nil {
+		t.Fatal("incompatible newer version must be refused")
+	}
+	for _, want := range []string{fmt.Sprintf("on-disk format %d", next), fmt.Sprintf("supports on-disk format %d", contentenc.CurrentVersion)} {
+		if !strings.Contains(err.Error(), want) {
+			t.Errorf("error message %q does not contain %q", err, want)
+		}
+	}
+	// Not read-compatible with us, but with a newer version than ours
+	setVersion(t, conf, next+1, next)
+	if _, _, err = LoadAndDecrypt(conf, testPw); err == nil {
+		t.Error("a filesystem that is only readable by a newer version must be refused")
+	}
+}
@@ -28,6 +28,25 @@ const (
 	// FlagFIDO2 means that "-fido2" was used when creating the filesystem.
 	// The masterkey is protected using a FIDO2 token instead of a password.
 	FlagFIDO2
+	// FlagMasterKeyLen means that the master key does not have the default
+	// length, see ConfFile.MasterKeyLen. Older versions of gocryptfs do not
+	// know the flag and refuse to mount.
+	FlagMasterKeyLen
+	// FlagNameEncoding means that file names are not encoded with base64,
+	// see ConfFile.NameEncoding.
+	FlagNameEncoding
+	// FlagFanout means that directory entries are spread over bucket
+	// directories, see "-fanout". Older versions of gocryptfs do not know the
+	// flag and refuse to mount.
+	FlagFanout
+	// FlagKeySlots means that ConfFile.KeySlots holds more passwords. Older
+	// versions of gocryptfs do not know the flag and refuse to load the
+	// config, so they cannot drop the extra slots when they rewrite it.
+	FlagKeySlots
+	// FlagFileTags means that every file header is followed by an encrypted
+	// region for file tags, see "-filetags". This moves all data blocks, so
+	// older versions of gocryptfs must refuse to mount.
+	FlagFileTags
 )
 
 // knownFlags stores the known feature flags and their string representation
@@ -41,6 +60,11 @@ var knownFlags = map[flagIota]string{
 	FlagRaw64:          "Raw64",
 	FlagHKDF:           "HKDF",
 	FlagFIDO2:          "FIDO2",
+	FlagMasterKeyLen:   "MasterKeyLen",
+	FlagNameEncoding:   "NameEncoding",
+	FlagFanout:         "Fanout",
+	FlagKeySlots:       "KeySlots",
+	FlagFileTags:       "FileTags",
 }
 
 // Filesystems that do not have these feature flags set are deprecated.
@@ -0,0 +1,70 @@
+package configfile
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/rfjakob/gocryptfs/internal/exitcodes"
+)
+
+// KeyProvider obtains and stores the master key of a filesystem. The default
+// is PasswordProvider, which keeps the master key in the config file,
+// encrypted with a password. Other implementations can have the master key
+// wrapped by a KMS, a TPM or an HSM.
+type KeyProvider interface {
+	// Unwrap returns the master key. The caller zeroes it after use.
+	Unwrap(ctx context.Context) ([]byte, error)
+	// Wrap stores "key" so that Unwrap returns it later. "key" is zeroed
+	// after Wrap returns, so it must be copied if it is kept.
+	Wrap(key []byte) error
+}
+
+// PasswordProvider is the default KeyProvider. The master key is encrypted
+// with a key derived from a password through scrypt, and stored in
+// Conf.EncryptedKey. Wrap only changes Conf; the caller writes it to disk.
+type PasswordProvider struct {
+	Conf *ConfFile
+	// Password returns the password. It is called once in every Unwrap and
+	// Wrap, and the result is zeroed after use.
+	Password func() []byte
+	// LogN is the scrypt cost parameter that Wrap uses
+	LogN int
+}
+
+var _ KeyProvider = &PasswordProvider{} // Verify that interface is implemented.
+
+// Unwrap decrypts the master key with the password
+func (p *PasswordProvider) Unwrap(ctx context.Context) ([]byte, error) {
+	pw := p.Password()
+	defer zero(pw)
+	return p.Conf.DecryptMasterKey(pw)
+}
+
+// Wrap encrypts "key" with the password
+func (p *PasswordProvider) Wrap(key []byte) error {
+	pw := p.Password()
+	defer zero(pw)
+	p.Conf.EncryptKey(key, pw, p.LogN)
+	return nil
+}
+
+// UnwrapKey gets the master key from "kp" and checks that it has the length
+// the config file asks for.
+func (cf *ConfFile) UnwrapKey(ctx context.Context, kp KeyProvider) ([]byte, error) {
+	key, err := kp.Unwrap(ctx)
+	if err != nil {
+		return nil, err
+	}
+	if len(key) != cf.masterKeyLen() {
+		zero(key)
+		return nil, exitcodes.NewErr(fmt.Sprintf("key provider returned a %d byte master key, want %d", len(key), cf.masterKeyLen()),
+			exitcodes.LoadConf)
+	}
+	return key, nil
+}
+
+func zero(b []byte) {
+	for i := range b {
+		b[i] = 0
+	}
+}
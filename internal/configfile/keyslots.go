@@ -0,0 +1,94 @@
+package configfile
+
+import (
+	"fmt"
+	"log"
+)
+
+// KeySlot is an additional copy of the master key, encrypted with a key
+// derived from its own password. It allows several passwords to unlock one
+// filesystem, like the key slots of LUKS.
+type KeySlot struct {
+	// EncryptedKey is the master key, encrypted like ConfFile.EncryptedKey
+	EncryptedKey []byte
+	// ScryptObject stores the scrypt parameters for this slot's password
+	ScryptObject ScryptKDF
+}
+
+// NumKeySlots returns the number of key slots, including slot 0 in
+// cf.EncryptedKey
+func (cf *ConfFile) NumKeySlots() int {
+	return 1 + len(cf.KeySlots)
+}
+
+// UnlockedSlot returns the number of the key slot that the last
+// DecryptMasterKey call unlocked
+func (cf *ConfFile) UnlockedSlot() int {
+	return cf.unlockedSlot
+}
+
+// slot returns pointers to the encrypted key and the scrypt parameters of key
+// slot "i"
+func (cf *ConfFile) slot(i int) (*[]byte, *ScryptKDF) {
+	if i == 0 {
+		return &cf.EncryptedKey, &cf.ScryptObject
+	}
+	s := &cf.KeySlots[i-1]
+	return &s.EncryptedKey, &s.ScryptObject
+}
+
+// AddKeySlot encrypts "key" using an scrypt hash generated from "password"
+// and stores it in a new key slot.
+// Uses scrypt with cost parameter logN. Returns the number of the new slot.
+func (cf *ConfFile) AddKeySlot(key []byte, password []byte, logN int) int {
+	var s KeySlot
+	s.EncryptedKey, s.ScryptObject = cf.encryptKey(key, password, logN)
+	cf.KeySlots = append(cf.KeySlots, s)
+	cf.setKeySlotsFlag()
+	return cf.NumKeySlots() - 1
+}
+
+// RemoveKeySlot deletes key slot "i". If it is slot 0, slot 1 takes its
+// place. Removing the last slot is refused, as it would make the filesystem
+// impossible to unlock.
+func (cf *ConfFile) RemoveKeySlot(i int) error {
+	if i < 0 || i >= cf.NumKeySlots() {
+		log.Panicf("BUG: key slot %d does not exist", i)
+	}
+	if cf.NumKeySlots() == 1 {
+		return fmt.Errorf("cannot remove the last key slot")
+	}
+	if i == 0 {
+		cf.EncryptedKey = cf.KeySlots[0].EncryptedKey
+		cf.ScryptObject = cf.KeySlots[0].ScryptObject
+		i = 1
+	}
+	cf.KeySlots = append(cf.KeySlots[:i-1], cf.KeySlots[i:]...)
+	if len(cf.KeySlots) == 0 {
+		cf.KeySlots = nil
+	}
+	cf.setKeySlotsFlag()
+	cf.unlockedSlot = 0
+	return nil
+}
+
+// setKeySlotsFlag sets the "KeySlots" feature flag if there are cf.KeySlots,
+// and removes it otherwise, so that a config file with a single password
+// still works with older versions of gocryptfs.
+func (cf *ConfFile) setKeySlotsFlag() {
+	want := len(cf.KeySlots) > 0
+	if cf.IsFeatureFlagSet(FlagKeySlots) == want {
+		return
+	}
+	if want {
+		cf.FeatureFlags = append(cf.FeatureFlags, knownFlags[FlagKeySlots])
+		return
+	}
+	var flags []string
+	for _, f := range cf.FeatureFlags {
+		if f != knownFlags[FlagKeySlots] {
+			flags = append(flags, f)
+		}
+	}
+	cf.FeatureFlags = flags
+}
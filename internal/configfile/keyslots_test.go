@@ -0,0 +1,176 @@
+package configfile
+
+import (
+	"bytes"
+	"testing"
+
+	"github.com/rfjakob/gocryptfs/internal/tlog"
+)
+
+// TestKeySlots adds a second password, checks that both unlock the same
+// master key, and that removing either one leaves the other working
+func TestKeySlots(t *testing.T) {
+	if !testing.Verbose() {
+		tlog.Warn.Enabled = false
+		defer func() { tlog.Warn.Enabled = true }()
+	}
+	const fn = "config_test/tmp.conf"
+	for _, remove := range []string{"test", "second"} {
+		if err := Create(fn, testPw, false, 10, "test", false, false, nil, nil, 0, ""); err != nil {
+			t.Fatal(err)
+		}
+		key, cf, err := LoadAndDecrypt(fn, testPw)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if slot := cf.AddKeySlot(key, []byte("second"), 10); slot != 1 {
+			t.Errorf("want new slot 1, have %d", slot)
+		}
+		if err = cf.WriteFile(); err != nil {
+			t.Fatal(err)
+		}
+		for i, pw := range []string{"test", "second"} {
+			key2, cf2, err := LoadAndDecrypt(fn, []byte(pw))
+			if err != nil {
+				t.Fatalf("password %q: %v", pw, err)
+			}
+			if !bytes.Equal(key, key2) {
+				t.Errorf("password %q unlocks a different master key", pw)
+			}
+			if cf2.UnlockedSlot() != i {
+				t.Errorf("password %q: want slot %d, have %d", pw, i, cf2.UnlockedSlot())
+			}
+		}
+		if _, _, err = LoadAndDecrypt(fn, []byte("wrong")); err == nil {
+			t.Errorf("wrong password unlocked the config")
+		}
+
+		_, cf, err = LoadAndDecrypt(fn, []byte(remove))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err = cf.RemoveKeySlot(cf.UnlockedSlot()); err != nil {
+			t.Fatal(err)
+		}
+		if err = cf.WriteFile(); err != nil {
+			t.Fatal(err)
+		}
+		remaining := "second"
+		if remove == "second" {
+			remaining = "test"
+		}
+		if _, _, err = LoadAndDecrypt(fn, []byte(remove)); err == nil {
+			t.Errorf("removed password %q still unlocks the config", remove)
+		}
+		key2, cf, err := LoadAndDecrypt(fn, []byte(remaining))
+		if err != nil {
+			t.Fatalf("remaining password %q: %v", remaining, err)
+		}
+		if !bytes.Equal(key, key2) {
+			t.Errorf("remaining password %q unlocks a different master key", remaining)
+		}
+		if cf.NumKeySlots() != 1 || cf.KeySlots != nil {
+			t.Errorf("want 1 slot, have %d", cf.NumKeySlots())
+		}
+		if err = cf.RemoveKeySlot(0); err == nil {
+			t.Errorf("removing the last key slot must fail")
+		}
+	}
+}
+
+// TestKeySlotsPasswd checks that EncryptKey replaces the slot that was
+// unlocked, and leaves the others alone
+func TestKeySlotsPasswd(t *testing.T) {
+	if !testing.Verbose() {
+		tlog.Warn.Enabled = false
+		defer func() { tlog.Warn.Enabled = true }()
+	}
+	const fn = "config_test/tmp.conf"
+	if err := Create(fn, testPw, false, 10, "test", false, false, nil, nil, 0, ""); err != nil {
+		t.Fatal(err)
+	}
+	key, cf, err := LoadAndDecrypt(fn, testPw)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cf.AddKeySlot(key, []byte("second"), 10)
+	cf.WriteFile()
+	_, cf, err = LoadAndDecrypt(fn, []byte("second"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	cf.EncryptKey(key, []byte("third"), 10)
+	cf.WriteFile()
+	for _, pw := range []string{"test", "third"} {
+		if _, _, err = LoadAndDecrypt(fn, []byte(pw)); err != nil {
+			t.Errorf("password %q: %v", pw, err)
+		}
+	}
+	if _, _, err = LoadAndDecrypt(fn, []byte("second")); err == nil {
+		t.Errorf("old password of slot 1 still works")
+	}
+}
+
+// TestKeySlotsFeatureFlag checks that the "KeySlots" feature flag is set
+// exactly while there are extra key slots, and that KeySlots without the
+// flag are rejected.
+func TestKeySlotsFeatureFlag(t *testing.T) {
+	if !testing.Verbose() {
+		tlog.Warn.Enabled = false
+		defer func() { tlog.Warn.Enabled = true }()
+	}
+	const fn = "config_test/tmp.conf"
+	if err := Create(fn, testPw, false, 10, "test", false, false, nil, nil, 0, ""); err != nil {
+		t.Fatal(err)
+	}
+	key, cf, err := LoadAndDecrypt(fn, testPw)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if cf.IsFeatureFlagSet(FlagKeySlots) {
+		t.Error("flag set without extra key slots")
+	}
+	cf.AddKeySlot(key, []byte("second"), 10)
+	cf.AddKeySlot(key, []byte("third"), 10)
+	if err = cf.WriteFile(); err != nil {
+		t.Fatal(err)
+	}
+	_, cf, err = LoadAndDecrypt(fn, testPw)
+	if err != nil {
+		t.Fatal(err)
+	}
+	n := 0
+	for _, f := range cf.FeatureFlags {
+		if f == knownFlags[FlagKeySlots] {
+			n++
+		}
+	}
+	if n != 1 {
+		t.Errorf("want the flag once, have it %d times: %v", n, cf.FeatureFlags)
+	}
+
+	// KeySlots without the flag, like a version without the flag would write
+	flags := cf.FeatureFlags
+	cf.FeatureFlags = nil
+	for _, f := range flags {
+		if f != knownFlags[FlagKeySlots] {
+			cf.FeatureFlags = append(cf.FeatureFlags, f)
+		}
+	}
+	if err = cf.WriteFile(); err != nil {
+		t.Fatal(err)
+	}
+	if _, _, err = LoadAndDecrypt(fn, testPw); err == nil {
+		t.Error("KeySlots without the feature flag must be rejected")
+	}
+	cf.FeatureFlags = flags
+
+	for _, slot := range []int{2, 1} {
+		if err = cf.RemoveKeySlot(slot); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if cf.IsFeatureFlagSet(FlagKeySlots) {
+		t.Errorf("flag still set with one key slot: %v", cf.FeatureFlags)
+	}
+}
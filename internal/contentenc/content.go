@@ -53,6 +53,15 @@ type ContentEnc struct {
 	allZeroNonce []byte
 	// Force decode even if integrity check fails (openSSL only)
 	forceDecode bool
+	// fileTags means that a tags region follows the file header, see
+	// file_tags.go
+	fileTags bool
+	// headerLen is the length of the file header on disk, including the
+	// tags region
+	headerLen uint64
+	// Limits the warnings about bad blocks. DecryptBlock does not know which
+	// file a block belongs to, so this is shared by all files.
+	badBlockLog tlog.RateLimiter
 
 	// Ciphertext block "sync.Pool" pool. Always returns cipherBS-sized byte
 	// slices (usually 4128 bytes).
@@ -69,10 +78,12 @@ type ContentEnc struct {
 	PReqPool bPool
 }
 
-// New returns an initialized ContentEnc instance.
-func New(cc *cryptocore.CryptoCore, plainBS uint64, forceDecode bool) *ContentEnc {
-	if fuse.MAX_KERNEL_WRITE%plainBS != 0 {
-		log.Panicf("unaligned MAX_KERNEL_WRITE=%d", fuse.MAX_KERNEL_WRITE)
+// New returns an initialized ContentEnc instance. "plainBS" must divide
+// fuse.MAX_KERNEL_WRITE, so that a maximum-size request consists of whole
+// blocks. "fileTags" reserves the tags region after each file header.
+func New(cc *cryptocore.CryptoCore, plainBS uint64, forceDecode bool, fileTags bool) *ContentEnc {
+	if plainBS == 0 || plainBS > fuse.MAX_KERNEL_WRITE || fuse.MAX_KERNEL_WRITE%plainBS != 0 {
+		log.Panicf("BUG: plaintext block size %d does not divide MAX_KERNEL_WRITE=%d", plainBS, fuse.MAX_KERNEL_WRITE)
 	}
 	cipherBS := plainBS + uint64(cc.IVLen) + cryptocore.AuthTagLen
 	// Take IV and GHASH overhead into account.
@@ -89,11 +100,16 @@ func New(cc *cryptocore.CryptoCore, plainBS uint64, forceDecode bool) *ContentEn
 		allZeroBlock: make([]byte, cipherBS),
 		allZeroNonce: make([]byte, cc.IVLen),
 		forceDecode:  forceDecode,
+		fileTags:     fileTags,
+		headerLen:    HeaderLen,
 		cBlockPool:   newBPool(int(cipherBS)),
 		CReqPool:     newBPool(cReqSize),
 		pBlockPool:   newBPool(int(plainBS)),
 		PReqPool:     newBPool(pReqSize),
 	}
+	if fileTags {
+		c.headerLen += c.tagsRegionLen()
+	}
 	return c
 }
 
@@ -119,7 +135,7 @@ func (be *ContentEnc) DecryptBlocks(ciphertext []byte, firstBlockNo uint64, file
 		pBlock, err = be.DecryptBlock(cBlock, blockNo, fileID)
 		if err != nil {
 			if be.forceDecode && err == stupidgcm.ErrAuth {
-				tlog.Warn.Printf("DecryptBlocks: authentication failure in block #%d, overridden by forcedecode", firstBlockNo)
+				tlog.Warn.PrintfLimited(&be.badBlockLog, "DecryptBlocks: authentication failure in block #%d, overridden by forcedecode", firstBlockNo)
 			} else {
 				break
 			}
@@ -166,7 +182,7 @@ func (be *ContentEnc) DecryptBlock(ciphertext []byte, blockNo uint64, fileID []b
 	}
 
 	if len(ciphertext) < be.cryptoCore.IVLen {
-		tlog.Warn.Printf("DecryptBlock: Block is too short: %d bytes", len(ciphertext))
+		tlog.Warn.PrintfLimited(&be.badBlockLog, "DecryptBlock: Block is too short: %d bytes", len(ciphertext))
 		return nil, errors.New("Block is too short")
 	}
 
@@ -312,7 +328,13 @@ func (be *ContentEnc) doEncryptBlock(plaintext []byte, blockNo uint64, fileID []
 
 // MergeBlocks - Merge newData into oldData at offset
 // New block may be bigger than both newData and oldData
+// Bytes of oldData outside of offset..offset+len(newData) are kept as they
+// are. The result must fit into one block.
 func (be *ContentEnc) MergeBlocks(oldData []byte, newData []byte, offset int) []byte {
+	if offset < 0 || len(oldData) > int(be.plainBS) || offset+len(newData) > int(be.plainBS) {
+		log.Panicf("MergeBlocks: out of bounds: len(oldData)=%d, offset=%d, len(newData)=%d",
+			len(oldData), offset, len(newData))
+	}
 	// Fastpath for small-file creation
 	if len(oldData) == 0 && offset == 0 {
 		return newData
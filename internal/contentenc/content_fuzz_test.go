@@ -0,0 +1,84 @@
+//go:build go1.18
+// +build go1.18
+
+package contentenc
+
+import (
+	"bytes"
+	"testing"
+
+	"github.com/rfjakob/gocryptfs/internal/cryptocore"
+	"github.com/rfjakob/gocryptfs/internal/tlog"
+)
+
+// FuzzDecryptBlock feeds arbitrary ciphertext blocks to DecryptBlock with
+// the Go GCM and the AES-SIV backends. It must never panic, and it may only
+// succeed for the special cases (empty block, file hole) or when the input
+// is a valid block, which re-encrypts to the same bytes.
+//
+//	go test ./internal/contentenc -run NONE -fuzz FuzzDecryptBlock
+func FuzzDecryptBlock(f *testing.F) {
+	// Short blocks are logged as warnings, which slows down fuzzing a lot
+	defer func(e bool) { tlog.Warn.Enabled = e }(tlog.Warn.Enabled)
+	tlog.Warn.Enabled = false
+	key := make([]byte, cryptocore.KeyLen)
+	fileID := bytes.Repeat([]byte{1}, headerIDLen)
+	// IVLen is the same for both backends
+	encs := []*ContentEnc{
+		New(cryptocore.New(key, cryptocore.BackendGoGCM, DefaultIVBits, true, false), DefaultBS, false, false),
+		New(cryptocore.New(key, cryptocore.BackendAESSIV, DefaultIVBits, true, false), DefaultBS, false, false),
+	}
+	nonce := bytes.Repeat([]byte{2}, encs[0].cryptoCore.IVLen)
+	// seal is what doEncryptBlock does, without the special case for empty
+	// blocks and the length check
+	seal := func(be *ContentEnc, plaintext []byte, blockNo uint64, nonce []byte) []byte {
+		return be.cryptoCore.AEADCipher.Seal(append([]byte(nil), nonce...), nonce, plaintext, concatAD(blockNo, fileID))
+	}
+	valid := seal(encs[0], []byte("hello world"), 0, nonce)
+
+	f.Add([]byte{}, uint64(0))
+	f.Add([]byte{0}, uint64(0))
+	f.Add(valid[:len(nonce)], uint64(0))
+	// Truncated tag
+	f.Add(valid[:len(valid)-1], uint64(0))
+	// Valid block with the wrong block number
+	f.Add(valid, uint64(1))
+	f.Add(valid, uint64(0))
+	f.Add(make([]byte, len(valid)), uint64(0))
+	f.Add(make([]byte, encs[0].CipherBS()), uint64(0))
+
+	f.Fuzz(func(t *testing.T, ciphertext []byte, blockNo uint64) {
+		for i, be := range encs {
+			// DecryptBlock may return a pooled buffer, work on a copy
+			in := append([]byte(nil), ciphertext...)
+			plaintext, err := be.DecryptBlock(in, blockNo, fileID)
+			if i == 0 && blockNo == 0 && bytes.Equal(ciphertext, valid) {
+				if err != nil || string(plaintext) != "hello world" {
+					t.Fatalf("valid block: have %q, %v", plaintext, err)
+				}
+			}
+			if err != nil {
+				if plaintext != nil {
+					t.Fatalf("backend %d: error %v, but non-nil plaintext", i, err)
+				}
+				continue
+			}
+			if len(ciphertext) == 0 {
+				if len(plaintext) != 0 {
+					t.Fatalf("backend %d: %d bytes from an empty block", i, len(plaintext))
+				}
+				continue
+			}
+			if bytes.Equal(ciphertext, be.allZeroBlock) {
+				if !bytes.Equal(plaintext, make([]byte, be.plainBS)) {
+					t.Fatalf("backend %d: file hole does not decrypt to zeros", i)
+				}
+				continue
+			}
+			n := ciphertext[:be.cryptoCore.IVLen]
+			if again := seal(be, plaintext, blockNo, n); !bytes.Equal(again, ciphertext) {
+				t.Fatalf("backend %d: accepted invalid block %x", i, ciphertext)
+			}
+		}
+	})
+}
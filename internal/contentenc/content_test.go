@@ -1,6 +1,8 @@
 package contentenc
 
 import (
+	"bytes"
+	"math"
 	"testing"
 
 	"github.com/rfjakob/gocryptfs/internal/cryptocore"
@@ -24,7 +26,7 @@ func TestSplitRange(t *testing.T) {
 
 	key := make([]byte, cryptocore.KeyLen)
 	cc := cryptocore.New(key, cryptocore.BackendGoGCM, DefaultIVBits, true, false)
-	f := New(cc, DefaultBS, false)
+	f := New(cc, DefaultBS, false, false)
 
 	for _, r := range ranges {
 		parts := f.ExplodePlainRange(r.offset, r.length)
@@ -41,6 +43,23 @@ func TestSplitRange(t *testing.T) {
 	}
 }
 
+// TestInvalidBlockSize checks that New refuses block sizes that
+// ExplodePlainRange and the request pools cannot work with
+func TestInvalidBlockSize(t *testing.T) {
+	key := make([]byte, cryptocore.KeyLen)
+	cc := cryptocore.New(key, cryptocore.BackendGoGCM, DefaultIVBits, true, false)
+	for _, bs := range []uint64{0, 1000, 3 * DefaultBS, 2 * 1024 * 1024} {
+		func() {
+			defer func() {
+				if recover() == nil {
+					t.Errorf("bs=%d: New did not panic", bs)
+				}
+			}()
+			New(cc, bs, false, false)
+		}()
+	}
+}
+
 func TestCiphertextRange(t *testing.T) {
 	var ranges []testRange
 
@@ -52,7 +71,7 @@ func TestCiphertextRange(t *testing.T) {
 
 	key := make([]byte, cryptocore.KeyLen)
 	cc := cryptocore.New(key, cryptocore.BackendGoGCM, DefaultIVBits, true, false)
-	f := New(cc, DefaultBS, false)
+	f := New(cc, DefaultBS, false, false)
 
 	for _, r := range ranges {
 
@@ -75,7 +94,7 @@ func TestCiphertextRange(t *testing.T) {
 func TestBlockNo(t *testing.T) {
 	key := make([]byte, cryptocore.KeyLen)
 	cc := cryptocore.New(key, cryptocore.BackendGoGCM, DefaultIVBits, true, false)
-	f := New(cc, DefaultBS, false)
+	f := New(cc, DefaultBS, false, false)
 
 	b := f.CipherOffToBlockNo(788)
 	if b != 0 {
@@ -94,3 +113,176 @@ func TestBlockNo(t *testing.T) {
 		t.Errorf("actual: %d", b)
 	}
 }
+
+// TestMaxPlainSize checks that plaintext ranges up to MaxPlainSize, and
+// ranges around the 32-bit boundaries, map to ciphertext ranges that fit
+// into an int64, and that one more block does not fit anymore.
+func TestMaxPlainSize(t *testing.T) {
+	key := make([]byte, cryptocore.KeyLen)
+	cc := cryptocore.New(key, cryptocore.BackendGoGCM, DefaultIVBits, true, false)
+	for _, bs := range []uint64{512, DefaultBS, 64 * 1024} {
+		f := New(cc, bs, false, false)
+		max := f.MaxPlainSize()
+		if max%bs != 0 {
+			t.Errorf("bs=%d: max=%d is not block-aligned", bs, max)
+		}
+		if c := f.PlainSizeToCipherSize(max); c > math.MaxInt64 {
+			t.Errorf("bs=%d: cipher size %d of max=%d overflows int64", bs, c, max)
+		}
+		if c := f.PlainSizeToCipherSize(max + bs); c <= math.MaxInt64 {
+			t.Errorf("bs=%d: max=%d is too small, another block still fits (cipher size %d)", bs, max, c)
+		}
+		ranges := []testRange{
+			{1<<31 - 1, 2},
+			{1<<32 - 1, 2},
+			{1<<32 - 10, 70000},
+			{max - 1, 1},
+			{max - 70000, 70000},
+		}
+		for _, r := range ranges {
+			blocks := f.ExplodePlainRange(r.offset, r.length)
+			off, length := blocks[0].JointCiphertextRange(blocks)
+			if off > math.MaxInt64 || length > math.MaxInt64-off {
+				t.Errorf("bs=%d off=%d len=%d: ciphertext range off=%d len=%d overflows int64",
+					bs, r.offset, r.length, off, length)
+				continue
+			}
+			if f.CipherOffToBlockNo(off) != blocks[0].BlockNo {
+				t.Errorf("bs=%d off=%d: ciphertext offset %d maps back to the wrong block", bs, r.offset, off)
+			}
+			var sum uint64
+			for _, b := range blocks {
+				sum += b.Length
+			}
+			if sum != r.length {
+				t.Errorf("bs=%d off=%d len=%d: blocks add up to %d bytes", bs, r.offset, r.length, sum)
+			}
+		}
+	}
+}
+
+// TestMergeBlocks checks the "modify" step of read-modify-write: only the
+// bytes at offset..offset+len(newData) may change, and the block only grows
+// if the new data reaches past the old end.
+func TestMergeBlocks(t *testing.T) {
+	key := make([]byte, cryptocore.KeyLen)
+	cc := cryptocore.New(key, cryptocore.BackendGoGCM, DefaultIVBits, true, false)
+	f := New(cc, DefaultBS, false, false)
+	full := bytes.Repeat([]byte("o"), DefaultBS)
+	testCases := []struct {
+		oldLen, offset, newLen int
+	}{
+		{DefaultBS, 0, 1},
+		{DefaultBS, 1, 1},
+		{DefaultBS, 100, 17},
+		{DefaultBS, DefaultBS - 1, 1},
+		{DefaultBS, 1, DefaultBS - 1},
+		{500, 10, 10},
+		{500, 499, 1},
+		// Extends the block
+		{500, 490, 20},
+		// Leaves a hole after the old data
+		{500, 1000, 10},
+		{0, 100, 10},
+	}
+	for _, tc := range testCases {
+		oldData := full[:tc.oldLen]
+		newData := bytes.Repeat([]byte("n"), tc.newLen)
+		out := f.MergeBlocks(oldData, newData, tc.offset)
+		wantLen := tc.oldLen
+		if tc.offset+tc.newLen > wantLen {
+			wantLen = tc.offset + tc.newLen
+		}
+		want := make([]byte, wantLen)
+		copy(want, oldData)
+		copy(want[tc.offset:], newData)
+		if !bytes.Equal(out, want) {
+			t.Errorf("oldLen=%d offset=%d newLen=%d: wrong result", tc.oldLen, tc.offset, tc.newLen)
+		}
+		if !bytes.Equal(full, bytes.Repeat([]byte("o"), DefaultBS)) {
+			t.Fatalf("oldLen=%d offset=%d newLen=%d: oldData was modified", tc.oldLen, tc.offset, tc.newLen)
+		}
+	}
+}
+
+// TestCropBlock decrypts a short final block and crops ranges that reach
+// past its end, or start after it
+func TestCropBlock(t *testing.T) {
+	key := make([]byte, cryptocore.KeyLen)
+	cc := cryptocore.New(key, cryptocore.BackendGoGCM, DefaultIVBits, true, false)
+	f := New(cc, DefaultBS, false, false)
+	fileID := make([]byte, headerIDLen)
+	data := make([]byte, 500)
+	for i := range data {
+		data[i] = byte(i)
+	}
+	plain, err := f.DecryptBlock(f.EncryptBlock(data, 3, fileID), 3, fileID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	testCases := []struct {
+		skip, length uint64
+		want         []byte
+	}{
+		{0, 100, data[:100]},
+		{100, 400, data[100:]},
+		{100, DefaultBS - 100, data[100:]},
+		{499, 10, data[499:]},
+		{500, 10, nil},
+		{1000, 100, nil},
+	}
+	for _, tc := range testCases {
+		ib := IntraBlock{BlockNo: 3, Skip: tc.skip, Length: tc.length, fs: f}
+		if have := ib.CropBlock(plain); !bytes.Equal(have, tc.want) {
+			t.Errorf("skip=%d length=%d: want %d bytes, have %d", tc.skip, tc.length, len(tc.want), len(have))
+		}
+	}
+}
+
+// TestSelfTest runs SelfTest with a fixed seed for all backends, and with a
+// small block size so that the random sizes cross many block boundaries
+func TestSelfTest(t *testing.T) {
+	key := make([]byte, cryptocore.KeyLen)
+	for _, backend := range []cryptocore.AEADTypeEnum{cryptocore.BackendGoGCM, cryptocore.BackendAESSIV} {
+		for _, bs := range []uint64{512, DefaultBS} {
+			cc := cryptocore.New(key, backend, DefaultIVBits, true, false)
+			f := New(cc, bs, false, false)
+			if err := f.SelfTest(1, 200); err != nil {
+				t.Errorf("backend=%d bs=%d: %v", backend, bs, err)
+			}
+		}
+	}
+}
+
+// TestFileTags checks that the tags region round-trips, is bound to the file
+// ID, and moves the data blocks.
+func TestFileTags(t *testing.T) {
+	key := make([]byte, cryptocore.KeyLen)
+	cc := cryptocore.New(key, cryptocore.BackendGoGCM, DefaultIVBits, true, false)
+	f := New(cc, DefaultBS, false, true)
+	if f.HeaderLen() != HeaderLen+f.tagsRegionLen() {
+		t.Fatalf("HeaderLen=%d", f.HeaderLen())
+	}
+	if f.BlockNoToCipherOff(0) != f.HeaderLen() || f.CipherSizeToPlainSize(f.HeaderLen()) != 0 {
+		t.Error("data blocks do not follow the tags region")
+	}
+	h := RandomHeader()
+	buf := f.PackHeader(h, []byte("tag"))
+	if uint64(len(buf)) != f.HeaderLen() {
+		t.Fatalf("len=%d", len(buf))
+	}
+	tags, err := f.DecryptTags(buf[HeaderLen:], h.ID)
+	if err != nil || string(tags) != "tag" {
+		t.Errorf("tags=%q err=%v", tags, err)
+	}
+	if _, err = f.DecryptTags(buf[HeaderLen:], RandomHeader().ID); err == nil {
+		t.Error("tags region decrypted with the wrong file ID")
+	}
+	tags, err = f.DecryptTags(make([]byte, f.tagsRegionLen()), h.ID)
+	if err != nil || tags != nil {
+		t.Errorf("zero region: tags=%q err=%v", tags, err)
+	}
+	if _, err = New(cc, DefaultBS, false, false).DecryptTags(buf[HeaderLen:], h.ID); err != ErrNoTags {
+		t.Errorf("without tags: err=%v", err)
+	}
+}
@@ -0,0 +1,96 @@
+package contentenc
+
+// File tags region ("-filetags")
+//
+// Format: [ nonce ] [ encrypted: "Len" uint16 big endian, tags, zero padding
+// to TagsMaxLen ] [ auth tag ]
+//
+// The region directly follows the file header and has a fixed size, so that
+// the data blocks stay at fixed offsets.
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"log"
+	"math"
+
+	"github.com/rfjakob/gocryptfs/internal/cryptocore"
+)
+
+// TagsMaxLen is the maximum length of the file tags
+const TagsMaxLen = 256
+
+// tagsLenLen is the length of the "Len" field
+const tagsLenLen = 2
+
+// tagsBlockNo is the block number the tags region is authenticated with, in
+// place of a real one. Data blocks never get this far, see MaxPlainSize.
+const tagsBlockNo = math.MaxUint64
+
+// ErrNoTags is returned by the tags methods if the filesystem has no tags
+// region
+var ErrNoTags = errors.New("filesystem has no file tags region")
+
+// FileTags returns true if a tags region follows the file header
+func (be *ContentEnc) FileTags() bool {
+	return be.fileTags
+}
+
+// HeaderLen returns the length of the file header on disk. With file tags,
+// this includes the tags region.
+func (be *ContentEnc) HeaderLen() uint64 {
+	return be.headerLen
+}
+
+// tagsRegionLen is the length of the tags region on disk
+func (be *ContentEnc) tagsRegionLen() uint64 {
+	return uint64(be.cryptoCore.IVLen) + tagsLenLen + TagsMaxLen + cryptocore.AuthTagLen
+}
+
+// PackHeader serializes "h" like FileHeader.Pack. With file tags, it appends
+// the tags region with "tags" encrypted for the file ID of "h".
+func (be *ContentEnc) PackHeader(h *FileHeader, tags []byte) []byte {
+	buf := h.Pack()
+	if !be.fileTags {
+		return buf
+	}
+	return append(buf, be.encryptTags(tags, h.ID)...)
+}
+
+// encryptTags returns the tags region for "tags"
+func (be *ContentEnc) encryptTags(tags []byte, fileID []byte) []byte {
+	if len(tags) > TagsMaxLen {
+		log.Panicf("BUG: tags are %d bytes long, the maximum is %d", len(tags), TagsMaxLen)
+	}
+	plain := make([]byte, tagsLenLen+TagsMaxLen)
+	binary.BigEndian.PutUint16(plain, uint16(len(tags)))
+	copy(plain[tagsLenLen:], tags)
+	nonce := be.cryptoCore.IVGenerator.Get()
+	return be.cryptoCore.AEADCipher.Seal(nonce, nonce, plain, concatAD(tagsBlockNo, fileID))
+}
+
+// DecryptTags decrypts the tags region "buf", which is what follows the
+// file header, for the file ID "fileID". An all-zero region has no tags.
+func (be *ContentEnc) DecryptTags(buf []byte, fileID []byte) ([]byte, error) {
+	if !be.fileTags {
+		return nil, ErrNoTags
+	}
+	if uint64(len(buf)) != be.tagsRegionLen() {
+		return nil, fmt.Errorf("DecryptTags: invalid length, want=%d have=%d", be.tagsRegionLen(), len(buf))
+	}
+	if bytes.Equal(buf, make([]byte, len(buf))) {
+		return nil, nil
+	}
+	ivLen := be.cryptoCore.IVLen
+	plain, err := be.cryptoCore.AEADCipher.Open(nil, buf[:ivLen], buf[ivLen:], concatAD(tagsBlockNo, fileID))
+	if err != nil {
+		return nil, err
+	}
+	n := int(binary.BigEndian.Uint16(plain))
+	if n > TagsMaxLen {
+		return nil, fmt.Errorf("DecryptTags: invalid length field %d", n)
+	}
+	return plain[tagsLenLen : tagsLenLen+n], nil
+}
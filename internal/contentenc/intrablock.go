@@ -36,9 +36,16 @@ func (ib *IntraBlock) BlockPlainOff() (offset uint64) {
 }
 
 // CropBlock - crop a potentially larger plaintext block down to the relevant part
+//
+// "d" may also be shorter than Skip + Length, when the file ends inside the
+// block. Then only what is there is returned, which is nothing if the file
+// ends before Skip.
 func (ib *IntraBlock) CropBlock(d []byte) []byte {
-	lenHave := len(d)
-	lenWant := int(ib.Skip + ib.Length)
+	lenHave := uint64(len(d))
+	if lenHave <= ib.Skip {
+		return d[:0]
+	}
+	lenWant := ib.Skip + ib.Length
 	if lenHave < lenWant {
 		return d[ib.Skip:lenHave]
 	}
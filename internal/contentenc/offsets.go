@@ -2,6 +2,7 @@ package contentenc
 
 import (
 	"log"
+	"math"
 
 	"github.com/rfjakob/gocryptfs/internal/tlog"
 )
@@ -15,15 +16,15 @@ func (be *ContentEnc) PlainOffToBlockNo(plainOffset uint64) uint64 {
 
 // CipherOffToBlockNo converts the ciphertext offset to the plaintext block number.
 func (be *ContentEnc) CipherOffToBlockNo(cipherOffset uint64) uint64 {
-	if cipherOffset < HeaderLen {
+	if cipherOffset < be.headerLen {
 		log.Panicf("BUG: offset %d is inside the file header", cipherOffset)
 	}
-	return (cipherOffset - HeaderLen) / be.cipherBS
+	return (cipherOffset - be.headerLen) / be.cipherBS
 }
 
 // BlockNoToCipherOff gets the ciphertext offset of block "blockNo"
 func (be *ContentEnc) BlockNoToCipherOff(blockNo uint64) uint64 {
-	return HeaderLen + blockNo*be.cipherBS
+	return be.headerLen + blockNo*be.cipherBS
 }
 
 // BlockNoToPlainOff gets the plaintext offset of block "blockNo"
@@ -38,14 +39,14 @@ func (be *ContentEnc) CipherSizeToPlainSize(cipherSize uint64) uint64 {
 		return 0
 	}
 
-	if cipherSize == HeaderLen {
+	if cipherSize == be.headerLen {
 		// This can happen between createHeader() and Write() and is harmless.
 		tlog.Debug.Printf("cipherSize %d == header size: interrupted write?\n", cipherSize)
 		return 0
 	}
 
-	if cipherSize < HeaderLen {
-		tlog.Warn.Printf("cipherSize %d < header size %d: corrupt file\n", cipherSize, HeaderLen)
+	if cipherSize < be.headerLen {
+		tlog.Warn.Printf("cipherSize %d < header size %d: corrupt file\n", cipherSize, be.headerLen)
 		return 0
 	}
 
@@ -53,7 +54,7 @@ func (be *ContentEnc) CipherSizeToPlainSize(cipherSize uint64) uint64 {
 	blockNo := be.CipherOffToBlockNo(cipherSize - 1)
 	blockCount := blockNo + 1
 
-	overhead := be.BlockOverhead()*blockCount + HeaderLen
+	overhead := be.BlockOverhead()*blockCount + be.headerLen
 
 	if overhead > cipherSize {
 		tlog.Warn.Printf("cipherSize %d < overhead %d: corrupt file\n", cipherSize, overhead)
@@ -63,6 +64,13 @@ func (be *ContentEnc) CipherSizeToPlainSize(cipherSize uint64) uint64 {
 	return cipherSize - overhead
 }
 
+// MaxPlainSize returns the largest block-aligned plaintext file size whose
+// ciphertext size still fits into an int64, the type of file offsets in the kernel. Plaintext
+// offsets beyond it would wrap around when converted to ciphertext offsets.
+func (be *ContentEnc) MaxPlainSize() uint64 {
+	return (math.MaxInt64 - be.headerLen) / be.cipherBS * be.plainBS
+}
+
 // PlainSizeToCipherSize calculates the ciphertext size from a plaintext size
 func (be *ContentEnc) PlainSizeToCipherSize(plainSize uint64) uint64 {
 	// Zero-sized files stay zero-sized
@@ -74,7 +82,7 @@ func (be *ContentEnc) PlainSizeToCipherSize(plainSize uint64) uint64 {
 	blockNo := be.PlainOffToBlockNo(plainSize - 1)
 	blockCount := blockNo + 1
 
-	overhead := be.BlockOverhead()*blockCount + HeaderLen
+	overhead := be.BlockOverhead()*blockCount + be.headerLen
 
 	return plainSize + overhead
 }
@@ -92,6 +100,9 @@ func (be *ContentEnc) ExplodePlainRange(offset uint64, length uint64) []IntraBlo
 
 		// Minimum of remaining plaintext data and remaining space in the block
 		nextBlock.Length = MinUint64(length, be.plainBS-nextBlock.Skip)
+		if nextBlock.Skip >= be.plainBS || nextBlock.Length == 0 {
+			log.Panicf("BUG: block %d: skip=%d length=%d with plainBS=%d", nextBlock.BlockNo, nextBlock.Skip, nextBlock.Length, be.plainBS)
+		}
 
 		blocks = append(blocks, nextBlock)
 		offset += nextBlock.Length
@@ -118,6 +129,9 @@ func (be *ContentEnc) ExplodeCipherRange(offset uint64, length uint64) []IntraBl
 		if length < maxLen {
 			nextBlock.Length = length
 		}
+		if nextBlock.Skip >= be.cipherBS || nextBlock.Length == 0 {
+			log.Panicf("BUG: block %d: skip=%d length=%d with cipherBS=%d", nextBlock.BlockNo, nextBlock.Skip, nextBlock.Length, be.cipherBS)
+		}
 
 		blocks = append(blocks, nextBlock)
 		offset += nextBlock.Length
@@ -0,0 +1,167 @@
+package contentenc
+
+import (
+	"bytes"
+	"fmt"
+	"math/rand"
+)
+
+// SelfTest checks the block framing. It writes random data at random offsets
+// into a ciphertext file held in memory, block by block through
+// ExplodePlainRange, MergeBlocks and EncryptBlock, the way fusefrontend does,
+// and reads random ranges back through DecryptBlock and CropBlock. Every read
+// is compared against a plaintext copy of the file.
+//
+// It starts with every combination of offset and size that is at most one
+// byte away from one of the first 8 block boundaries, and continues with
+// "iterations" random ones, most of them around block boundaries as well.
+// The same "seed" always gives the same run. Returns an error describing the
+// first mismatch.
+func (be *ContentEnc) SelfTest(seed int64, iterations int) error {
+	rng := rand.New(rand.NewSource(seed))
+	st := selfTest{be: be, rng: rng, fileID: make([]byte, headerIDLen)}
+	rng.Read(st.fileID)
+	st.cipher = (&FileHeader{Version: CurrentVersion, ID: st.fileID}).Pack()
+	boundaries := st.boundaries()
+	i := 0
+	for _, off := range boundaries {
+		for _, size := range boundaries {
+			if err := st.check(off, size); err != nil {
+				return fmt.Errorf("seed %d, boundary step %d: %v", seed, i, err)
+			}
+			i++
+		}
+	}
+	for i = 0; i < iterations; i++ {
+		if err := st.check(st.randSize(), st.randSize()); err != nil {
+			return fmt.Errorf("seed %d, iteration %d: %v", seed, i, err)
+		}
+	}
+	return nil
+}
+
+// selfTest is the state of a SelfTest run
+type selfTest struct {
+	be     *ContentEnc
+	rng    *rand.Rand
+	fileID []byte
+	// cipher is the ciphertext file, starting with the header
+	cipher []byte
+	// plain is what the file should decrypt to
+	plain []byte
+}
+
+// check writes "size" random bytes at "off" and reads them back, followed by
+// a read of a random range
+func (st *selfTest) check(off uint64, size uint64) error {
+	data := make([]byte, size)
+	st.rng.Read(data)
+	if err := st.write(off, data); err != nil {
+		return fmt.Errorf("write off=%d len=%d: %v", off, size, err)
+	}
+	if err := st.verify(off, size); err != nil {
+		return fmt.Errorf("read back off=%d len=%d: %v", off, size, err)
+	}
+	off, length := st.randSize(), st.randSize()
+	if err := st.verify(off, length); err != nil {
+		return fmt.Errorf("read off=%d len=%d: %v", off, length, err)
+	}
+	return nil
+}
+
+// boundaries returns the offsets that are at most one byte away from the
+// first 8 block boundaries
+func (st *selfTest) boundaries() []uint64 {
+	bs := st.be.plainBS
+	out := []uint64{0, 1}
+	for n := bs; n <= 8*bs; n += bs {
+		out = append(out, n-1, n, n+1)
+	}
+	return out
+}
+
+// randSize returns a size or an offset of up to 8 blocks. Three out of four
+// are at most one byte away from a block boundary.
+func (st *selfTest) randSize() uint64 {
+	bs := st.be.plainBS
+	if st.rng.Intn(4) == 0 {
+		return uint64(st.rng.Int63n(int64(8 * bs)))
+	}
+	n := uint64(st.rng.Intn(9)) * bs
+	switch st.rng.Intn(3) {
+	case 0:
+		if n > 0 {
+			n--
+		}
+	case 1:
+		n++
+	}
+	return n
+}
+
+// block returns the ciphertext of block "blockNo", which is empty past the
+// end of the file
+func (st *selfTest) block(blockNo uint64) []byte {
+	off := st.be.BlockNoToCipherOff(blockNo)
+	if off >= uint64(len(st.cipher)) {
+		return nil
+	}
+	end := off + st.be.cipherBS
+	if end > uint64(len(st.cipher)) {
+		end = uint64(len(st.cipher))
+	}
+	return st.cipher[off:end]
+}
+
+// write stores "data" at plaintext offset "off". A write past the end of the
+// file first fills the gap with zeros.
+func (st *selfTest) write(off uint64, data []byte) error {
+	if size := uint64(len(st.plain)); off > size && len(data) > 0 {
+		if err := st.write(size, make([]byte, off-size)); err != nil {
+			return err
+		}
+	}
+	for _, b := range st.be.ExplodePlainRange(off, uint64(len(data))) {
+		oldData, err := st.be.DecryptBlock(st.block(b.BlockNo), b.BlockNo, st.fileID)
+		if err != nil {
+			return err
+		}
+		part := data[b.BlockPlainOff()+b.Skip-off:][:b.Length]
+		blockData := st.be.MergeBlocks(oldData, part, int(b.Skip))
+		cBlock := st.be.EncryptBlock(blockData, b.BlockNo, st.fileID)
+		cOff := b.BlockCipherOff()
+		if end := cOff + uint64(len(cBlock)); end > uint64(len(st.cipher)) {
+			st.cipher = append(st.cipher, make([]byte, end-uint64(len(st.cipher)))...)
+		}
+		copy(st.cipher[cOff:], cBlock)
+	}
+	if end := off + uint64(len(data)); end > uint64(len(st.plain)) {
+		st.plain = append(st.plain, make([]byte, end-uint64(len(st.plain)))...)
+	}
+	copy(st.plain[off:], data)
+	if have, want := st.be.CipherSizeToPlainSize(uint64(len(st.cipher))), uint64(len(st.plain)); have != want {
+		return fmt.Errorf("ciphertext size %d gives plaintext size %d, want %d", len(st.cipher), have, want)
+	}
+	return nil
+}
+
+// verify reads "length" bytes at plaintext offset "off" and compares them
+// against the plaintext copy. The read may extend past the end of the file.
+func (st *selfTest) verify(off uint64, length uint64) error {
+	var have []byte
+	for _, b := range st.be.ExplodePlainRange(off, length) {
+		blockData, err := st.be.DecryptBlock(st.block(b.BlockNo), b.BlockNo, st.fileID)
+		if err != nil {
+			return fmt.Errorf("block %d: %v", b.BlockNo, err)
+		}
+		have = append(have, b.CropBlock(blockData)...)
+	}
+	var want []byte
+	if off < uint64(len(st.plain)) {
+		want = st.plain[off:MinUint64(off+length, uint64(len(st.plain)))]
+	}
+	if !bytes.Equal(have, want) {
+		return fmt.Errorf("content differs (have %d bytes, want %d)", len(have), len(want))
+	}
+	return nil
+}
@@ -19,7 +19,10 @@ import (
 
 const (
 	// KeyLen is the cipher key length in bytes.  32 for AES-256.
+	// This is also the default master key length.
 	KeyLen = 32
+	// MaxKeyLen is the longest master key supported, see ValidKeyLen.
+	MaxKeyLen = 64
 	// AuthTagLen is the length of a GCM auth tag in bytes.
 	AuthTagLen = 16
 )
@@ -44,11 +47,29 @@ type CryptoCore struct {
 	AEADCipher cipher.AEAD
 	// Which backend is behind AEADCipher?
 	AEADBackend AEADTypeEnum
-	// GCM needs unique IVs (nonces)
-	IVGenerator *nonceGenerator
+	// Source of nonces for content encryption. GCM needs unique IVs.
+	IVGenerator IVGenerator
 	IVLen       int
 }
 
+// ValidKeyLen checks if a master key of "keyLen" bytes can be used. Without
+// HKDF, the master key is used as the AES-256 key directly and must be KeyLen
+// bytes long. With HKDF, the cipher keys are derived from the master key, and
+// any length from KeyLen up to MaxKeyLen works. Shorter keys would weaken all
+// ciphers, so they are never allowed.
+func ValidKeyLen(keyLen int, useHKDF bool) error {
+	if !useHKDF {
+		if keyLen != KeyLen {
+			return fmt.Errorf("key length %d is not supported without HKDF, must be %d", keyLen, KeyLen)
+		}
+		return nil
+	}
+	if keyLen < KeyLen || keyLen > MaxKeyLen {
+		return fmt.Errorf("key length %d is not supported, must be between %d and %d", keyLen, KeyLen, MaxKeyLen)
+	}
+	return nil
+}
+
 // New returns a new CryptoCore object or panics.
 //
 // Even though the "GCMIV128" feature flag is now mandatory, we must still
@@ -58,8 +79,8 @@ type CryptoCore struct {
 // Note: "key" is either the scrypt hash of the password (when decrypting
 // a config file) or the masterkey (when finally mounting the filesystem).
 func New(key []byte, aeadType AEADTypeEnum, IVBitLen int, useHKDF bool, forceDecode bool) *CryptoCore {
-	if len(key) != KeyLen {
-		log.Panic(fmt.Sprintf("Unsupported key length %d", len(key)))
+	if err := ValidKeyLen(len(key), useHKDF); err != nil {
+		log.Panic(err)
 	}
 	// We want the IV size in bytes
 	IVLen := IVBitLen / 8
@@ -119,7 +140,7 @@ func New(key []byte, aeadType AEADTypeEnum, IVBitLen int, useHKDF bool, forceDec
 		}
 		// AES-SIV uses 1/2 of the key for authentication, 1/2 for
 		// encryption, so we need a 64-bytes key for AES-256. Derive it from
-		// the 32-byte master key using HKDF, or, for older filesystems, with
+		// the master key using HKDF, or, for older filesystems, with
 		// SHA256.
 		var key64 []byte
 		if useHKDF {
@@ -140,7 +161,7 @@ func New(key []byte, aeadType AEADTypeEnum, IVBitLen int, useHKDF bool, forceDec
 		EMECipher:   emeCipher,
 		AEADCipher:  aeadCipher,
 		AEADBackend: aeadType,
-		IVGenerator: &nonceGenerator{nonceLen: IVLen},
+		IVGenerator: NewRandomIVGenerator(IVLen),
 		IVLen:       IVLen,
 	}
 }
@@ -4,6 +4,7 @@ import (
 	"crypto/rand"
 	"encoding/binary"
 	"log"
+	"sync"
 )
 
 // RandBytes gets "n" random bytes from /dev/urandom or panics
@@ -22,11 +23,109 @@ func RandUint64() uint64 {
 	return binary.BigEndian.Uint64(b)
 }
 
-type nonceGenerator struct {
+// IVGenerator is a source of nonces (IVs) for content encryption.
+//
+// Which implementation is used depends on the mode: Forward mode uses
+// NewRandomIVGenerator (the default, set up by New()), reverse mode uses one
+// NewDeterministicIVGenerator per file, seeded from the path.
+// NewCounterIVGenerator is not used by any mode and exists for experimentation.
+type IVGenerator interface {
+	// Get returns a nonce. Every call returns a new slice that the caller
+	// may keep.
+	Get() []byte
+}
+
+var _ IVGenerator = &randomNonceGenerator{}
+var _ IVGenerator = &counterNonceGenerator{}
+var _ IVGenerator = &deterministicNonceGenerator{}
+
+// randomNonceGenerator returns random nonces. This is what forward mode uses,
+// and this is what the on-disk format was designed for.
+type randomNonceGenerator struct {
 	nonceLen int // bytes
 }
 
+// NewRandomIVGenerator returns an IVGenerator that returns random
+// "nonceLen"-byte nonces.
+func NewRandomIVGenerator(nonceLen int) IVGenerator {
+	return &randomNonceGenerator{nonceLen: nonceLen}
+}
+
 // Get a random "nonceLen"-byte nonce
-func (n *nonceGenerator) Get() []byte {
+func (n *randomNonceGenerator) Get() []byte {
 	return randPrefetcher.read(n.nonceLen)
 }
+
+// counterNonceGenerator returns nonces that consist of a random prefix that is
+// chosen once, followed by a big-endian 64-bit counter. Nonces are guaranteed to
+// be unique for the lifetime of the generator.
+type counterNonceGenerator struct {
+	sync.Mutex
+	prefix  []byte
+	counter uint64
+}
+
+// NewCounterIVGenerator returns an IVGenerator that returns "nonceLen"-byte
+// nonces made of a random prefix and an incrementing counter.
+// "nonceLen" must be at least 12 so that the random prefix is at least 32 bits.
+func NewCounterIVGenerator(nonceLen int) IVGenerator {
+	if nonceLen < 12 {
+		log.Panicf("NewCounterIVGenerator: nonceLen %d is too short", nonceLen)
+	}
+	return &counterNonceGenerator{
+		prefix: RandBytes(nonceLen - 8),
+	}
+}
+
+// Get returns the next nonce
+func (n *counterNonceGenerator) Get() []byte {
+	n.Lock()
+	c := n.counter
+	n.counter++
+	n.Unlock()
+	if c == ^uint64(0) {
+		log.Panic("counterNonceGenerator: counter exhausted")
+	}
+	nonce := make([]byte, len(n.prefix)+8)
+	copy(nonce, n.prefix)
+	binary.BigEndian.PutUint64(nonce[len(n.prefix):], c)
+	return nonce
+}
+
+// deterministicNonceGenerator returns a predictable sequence of nonces derived
+// from a seed. The nth nonce is the seed with "first+n" added to the lower
+// 64 bits. This is what reverse mode uses for the blocks of a file, and it
+// is only secure with AES-SIV.
+type deterministicNonceGenerator struct {
+	sync.Mutex
+	seed []byte
+	next uint64
+}
+
+// NewDeterministicIVGenerator returns an IVGenerator that returns nonces derived
+// from "seed". The first nonce returned corresponds to block number "first".
+// "seed" must be 16 bytes long.
+func NewDeterministicIVGenerator(seed []byte, first uint64) IVGenerator {
+	if len(seed) != 16 {
+		log.Panicf("NewDeterministicIVGenerator: seed has length %d, want 16", len(seed))
+	}
+	return &deterministicNonceGenerator{
+		seed: append([]byte{}, seed...),
+		next: first,
+	}
+}
+
+// Get returns the next nonce
+func (n *deterministicNonceGenerator) Get() []byte {
+	n.Lock()
+	blockNo := n.next
+	n.next++
+	n.Unlock()
+	iv := make([]byte, len(n.seed))
+	copy(iv, n.seed)
+	// Add blockNo to the lower half of the iv
+	lowBytes := iv[8:]
+	lowInt := binary.BigEndian.Uint64(lowBytes)
+	binary.BigEndian.PutUint64(lowBytes, lowInt+blockNo)
+	return iv
+}
@@ -0,0 +1,71 @@
+package cryptocore
+
+import (
+	"bytes"
+	"encoding/hex"
+	"testing"
+)
+
+// Random nonces must have the right length and must not repeat
+func TestRandomIVGenerator(t *testing.T) {
+	g := NewRandomIVGenerator(16)
+	seen := make(map[string]bool)
+	for i := 0; i < 1000; i++ {
+		n := g.Get()
+		if len(n) != 16 {
+			t.Fatalf("wrong length %d", len(n))
+		}
+		h := hex.EncodeToString(n)
+		if seen[h] {
+			t.Fatalf("duplicate nonce %s", h)
+		}
+		seen[h] = true
+	}
+}
+
+// Counter nonces share the prefix, count up, and never repeat
+func TestCounterIVGenerator(t *testing.T) {
+	for _, l := range []int{12, 16} {
+		g := NewCounterIVGenerator(l)
+		n0 := g.Get()
+		n1 := g.Get()
+		if len(n0) != l || len(n1) != l {
+			t.Fatalf("wrong length: %d, %d", len(n0), len(n1))
+		}
+		if !bytes.Equal(n0[:l-8], n1[:l-8]) {
+			t.Errorf("prefix changed: %x -> %x", n0, n1)
+		}
+		if bytes.Equal(n0, n1) {
+			t.Errorf("duplicate nonce %x", n0)
+		}
+		if n1[l-1] != n0[l-1]+1 {
+			t.Errorf("counter did not increment: %x -> %x", n0, n1)
+		}
+	}
+}
+
+// Deterministic nonces must be reproducible and must match the reverse mode
+// block IV derivation
+func TestDeterministicIVGenerator(t *testing.T) {
+	seed := bytes.Repeat([]byte{0xff}, 16)
+	g1 := NewDeterministicIVGenerator(seed, 0x27)
+	g2 := NewDeterministicIVGenerator(seed, 0x27)
+	n1 := g1.Get()
+	n2 := g2.Get()
+	if !bytes.Equal(n1, n2) {
+		t.Errorf("not deterministic: %x != %x", n1, n2)
+	}
+	expected, _ := hex.DecodeString("ffffffffffffffff0000000000000026")
+	if !bytes.Equal(n1, expected) {
+		t.Errorf("\nhave=%x\nwant=%x", n1, expected)
+	}
+	// The next nonce is the one for the next block
+	expected, _ = hex.DecodeString("ffffffffffffffff0000000000000027")
+	if n := g1.Get(); !bytes.Equal(n, expected) {
+		t.Errorf("\nhave=%x\nwant=%x", n, expected)
+	}
+	// The seed must not be modified
+	if !bytes.Equal(seed, bytes.Repeat([]byte{0xff}, 16)) {
+		t.Errorf("seed was modified")
+	}
+}
@@ -9,6 +9,7 @@ import (
 	"io"
 	"net"
 	"os"
+	"path/filepath"
 	"syscall"
 
 	"github.com/rfjakob/gocryptfs/ctlsock"
@@ -21,6 +22,29 @@ type Interface interface {
 	DecryptPath(string) (string, error)
 }
 
+// Snapshotter is implemented by fusefrontend (not by fusefrontend_reverse)
+// to handle "Snapshot" requests.
+type Snapshotter interface {
+	// Snapshot copies CIPHERDIR to the given path. "reflinked" is false if
+	// the data had to be copied because reflinks are not supported.
+	Snapshot(dst string) (reflinked bool, err error)
+}
+
+// OpenFileLister is implemented by fusefrontend (not by fusefrontend_reverse)
+// to handle "ListOpenFiles" requests.
+type OpenFileLister interface {
+	ListOpenFiles() []ctlsock.OpenFile
+}
+
+// Trasher is implemented by fusefrontend (not by fusefrontend_reverse)
+// to handle "ListTrash", "RestoreTrash" and "PurgeTrash" requests.
+type Trasher interface {
+	ListTrash() ([]ctlsock.TrashEntry, error)
+	// RestoreTrash returns the path the entry has been restored to
+	RestoreTrash(id string) (string, error)
+	PurgeTrash(id string) error
+}
+
 type ctlSockHandler struct {
 	fs     Interface
 	socket *net.UnixListener
@@ -93,6 +117,34 @@ func (ch *ctlSockHandler) handleConnection(conn *net.UnixConn) {
 func (ch *ctlSockHandler) handleRequest(in *ctlsock.RequestStruct, conn *net.UnixConn) {
 	var err error
 	var inPath, outPath, clean, warnText string
+	if in.Snapshot != "" {
+		if in.DecryptPath != "" || in.EncryptPath != "" {
+			err = errors.New("Ambiguous")
+			sendResponse(conn, err, "", "")
+			return
+		}
+		ch.handleSnapshot(in.Snapshot, conn)
+		return
+	}
+	if in.ListOpenFiles {
+		if in.DecryptPath != "" || in.EncryptPath != "" {
+			err = errors.New("Ambiguous")
+			sendResponse(conn, err, "", "")
+			return
+		}
+		ch.handleListOpenFiles(conn)
+		return
+	}
+	if in.ListTrash || in.RestoreTrash != "" || in.PurgeTrash != "" {
+		if in.DecryptPath != "" || in.EncryptPath != "" ||
+			countTrue(in.ListTrash, in.RestoreTrash != "", in.PurgeTrash != "") > 1 {
+			err = errors.New("Ambiguous")
+			sendResponse(conn, err, "", "")
+			return
+		}
+		ch.handleTrash(in, conn)
+		return
+	}
 	// You cannot perform both decryption and encryption in one request
 	if in.DecryptPath != "" && in.EncryptPath != "" {
 		err = errors.New("Ambiguous")
@@ -131,6 +183,68 @@ func (ch *ctlSockHandler) handleRequest(in *ctlsock.RequestStruct, conn *net.Uni
 	sendResponse(conn, err, outPath, warnText)
 }
 
+// handleSnapshot handles a "Snapshot" request
+func (ch *ctlSockHandler) handleSnapshot(dst string, conn *net.UnixConn) {
+	s, ok := ch.fs.(Snapshotter)
+	if !ok {
+		sendResponse(conn, syscall.EOPNOTSUPP, "", "")
+		return
+	}
+	if !filepath.IsAbs(dst) {
+		sendResponse(conn, errors.New("Snapshot path must be absolute"), "", "")
+		return
+	}
+	var warnText string
+	reflinked, err := s.Snapshot(dst)
+	if err == nil && !reflinked {
+		warnText = "Reflinks are not supported, data has been copied."
+	}
+	sendResponse(conn, err, dst, warnText)
+}
+
+// handleListOpenFiles handles a "ListOpenFiles" request
+func (ch *ctlSockHandler) handleListOpenFiles(conn *net.UnixConn) {
+	l, ok := ch.fs.(OpenFileLister)
+	if !ok {
+		sendResponse(conn, syscall.EOPNOTSUPP, "", "")
+		return
+	}
+	sendMsg(conn, &ctlsock.ResponseStruct{OpenFiles: l.ListOpenFiles()})
+}
+
+// handleTrash handles "ListTrash", "RestoreTrash" and "PurgeTrash" requests
+func (ch *ctlSockHandler) handleTrash(in *ctlsock.RequestStruct, conn *net.UnixConn) {
+	t, ok := ch.fs.(Trasher)
+	if !ok {
+		sendResponse(conn, syscall.EOPNOTSUPP, "", "")
+		return
+	}
+	switch {
+	case in.ListTrash:
+		l, err := t.ListTrash()
+		if err != nil {
+			sendResponse(conn, err, "", "")
+			return
+		}
+		sendMsg(conn, &ctlsock.ResponseStruct{Trash: l})
+	case in.RestoreTrash != "":
+		path, err := t.RestoreTrash(in.RestoreTrash)
+		sendResponse(conn, err, path, "")
+	default:
+		sendResponse(conn, t.PurgeTrash(in.PurgeTrash), "", "")
+	}
+}
+
+// countTrue counts the number of true values
+func countTrue(x ...bool) (n int) {
+	for _, v := range x {
+		if v {
+			n++
+		}
+	}
+	return n
+}
+
 // sendResponse sends a JSON response message
 func sendResponse(conn *net.UnixConn, err error, result string, warnText string) {
 	msg := ctlsock.ResponseStruct{
@@ -145,10 +259,15 @@ func sendResponse(conn *net.UnixConn, err error, result string, warnText string)
 			if se, ok := pe.Err.(syscall.Errno); ok {
 				msg.ErrNo = int32(se)
 			}
-		} else if err == syscall.ENOENT {
-			msg.ErrNo = int32(syscall.ENOENT)
+		} else if err == syscall.ENOENT || err == syscall.EOPNOTSUPP {
+			msg.ErrNo = int32(err.(syscall.Errno))
 		}
 	}
+	sendMsg(conn, &msg)
+}
+
+// sendMsg sends "msg" as a JSON response message
+func sendMsg(conn *net.UnixConn, msg *ctlsock.ResponseStruct) {
 	jsonMsg, err := json.Marshal(msg)
 	if err != nil {
 		tlog.Warn.Printf("ctlsock: Marshal failed: %v", err)
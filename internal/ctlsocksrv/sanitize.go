@@ -1,6 +1,7 @@
 package ctlsocksrv
 
 import (
+	"fmt"
 	"path/filepath"
 	"strings"
 )
@@ -30,3 +31,23 @@ func SanitizePath(path string) string {
 	}
 	return clean
 }
+
+// CleanPath is like SanitizePath, but for callers of EncryptPath and
+// DecryptPath that do not come through the control socket:
+// 1) Absolute paths are relative to the root, "/" is the root itself
+// 2) The root is returned as ""
+// 3) Relative paths that point above the root are an error instead of
+//    silently becoming the root
+func CleanPath(path string) (string, error) {
+	if filepath.IsAbs(path) {
+		// (1) Clean() drops ".." at the root
+		return SanitizePath(filepath.Clean(path)), nil
+	}
+	clean := filepath.Clean(path)
+	// (3)
+	if clean == ".." || strings.HasPrefix(clean, "../") {
+		return "", fmt.Errorf("path %q points above the root", path)
+	}
+	// (2)
+	return SanitizePath(clean), nil
+}
@@ -28,3 +28,28 @@ func TestSanitizePath(t *testing.T) {
 		}
 	}
 }
+
+func TestCleanPath(t *testing.T) {
+	testCases := [][]string{
+		{"", ""},
+		{".", ""},
+		{"/", ""},
+		{"docs/report.txt", "docs/report.txt"},
+		{"/docs/report.txt", "docs/report.txt"},
+		{"docs//report.txt/", "docs/report.txt"},
+		{"docs/../docs/./report.txt", "docs/report.txt"},
+		// Cannot go above the root of an absolute path
+		{"/../docs", "docs"},
+	}
+	for _, tc := range testCases {
+		res, err := CleanPath(tc[0])
+		if err != nil || res != tc[1] {
+			t.Errorf("%q: got %q %v, want %q", tc[0], res, err, tc[1])
+		}
+	}
+	for _, p := range []string{"..", "../docs", "docs/../.."} {
+		if res, err := CleanPath(p); err == nil {
+			t.Errorf("%q: want an error, got %q", p, res)
+		}
+	}
+}
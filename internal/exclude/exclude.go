@@ -0,0 +1,62 @@
+// Package exclude matches plaintext paths against the patterns passed in
+// "-exclude", "-exclude-wildcard" and "-exclude-from". They are used by
+// reverse mode to hide files from the encrypted view, and by "-fsck" and
+// "-import" to skip files and whole directory trees.
+package exclude
+
+import (
+	"io/ioutil"
+	"strings"
+
+	"github.com/sabhiram/go-gitignore"
+)
+
+// New compiles the exclusion patterns into an object that checks if a
+// relative plaintext path is excluded. Returns nil if there are no patterns.
+func New(exclude, excludeWildcard, excludeFrom []string) (ignore.IgnoreParser, error) {
+	if len(exclude) == 0 && len(excludeWildcard) == 0 && len(excludeFrom) == 0 {
+		return nil, nil
+	}
+	patterns, err := Patterns(exclude, excludeWildcard, excludeFrom)
+	if err != nil {
+		return nil, err
+	}
+	excluder, err := ignore.CompileIgnoreLines(patterns...)
+	if err != nil {
+		return nil, err
+	}
+	return excluder, nil
+}
+
+// Patterns prepares a list of patterns to be excluded.
+// Patterns passed in the -exclude command line option are prefixed
+// with a leading '/' to preserve backwards compatibility (before
+// wildcard matching was implemented, exclusions always were matched
+// against the full path).
+func Patterns(exclude, excludeWildcard, excludeFrom []string) ([]string, error) {
+	patterns := make([]string, len(exclude)+len(excludeWildcard))
+	// add -exclude
+	for i, p := range exclude {
+		patterns[i] = "/" + p
+	}
+	// add -exclude-wildcard
+	copy(patterns[len(exclude):], excludeWildcard)
+	// add -exclude-from
+	for _, file := range excludeFrom {
+		lines, err := getLines(file)
+		if err != nil {
+			return nil, err
+		}
+		patterns = append(patterns, lines...)
+	}
+	return patterns, nil
+}
+
+// getLines reads a file and splits it into lines
+func getLines(file string) ([]string, error) {
+	buffer, err := ioutil.ReadFile(file)
+	if err != nil {
+		return nil, err
+	}
+	return strings.Split(string(buffer), "\n"), nil
+}
@@ -72,6 +72,40 @@ const (
 	DevNull = 30
 	// FIDO2Error - an error was encountered while interacting with a FIDO2 token
 	FIDO2Error = 31
+	// Snapshot - "-snapshot" failed
+	Snapshot = 32
+	// FileHash - "-verifyhash" found files whose checksum does not match
+	FileHash = 33
+	// Import - "-import" could not import some files
+	Import = 34
+	// ServeLoop - the FUSE serve loop exited although the filesystem was not
+	// unmounted
+	ServeLoop = 35
+	// RotateFileIDs - "-rotate_fileids" could not re-encrypt some files
+	RotateFileIDs = 36
+	// WebDAV - "-webdav" could not listen on the address, or the server failed
+	WebDAV = 37
+	// BackingFS - the filesystem CIPHERDIR is on lacks a capability whose
+	// absence could corrupt files
+	BackingFS = 38
+	// UnencryptedVolume - "-require_encrypted_volume" was passed, but
+	// CIPHERDIR is not on an encrypted volume
+	UnencryptedVolume = 39
+	// ExportTar - "-export_tar" could not export some files, or writing the
+	// tar stream failed
+	ExportTar = 40
+	// Compact - "-compact" could not rewrite some files
+	Compact = 41
+	// KeyAgent - "-keyagent" could not get the master key from the agent, or
+	// "-keyagent_serve" could not create the socket
+	KeyAgent = 42
+	// SelfTest - "-selftest" found a mismatch
+	SelfTest = 43
+	// Metrics - "-metrics" could not listen on the address
+	Metrics = 44
+	// NewerFS - the filesystem was created by a newer gocryptfs with an
+	// on-disk format we cannot read
+	NewerFS = 45
 )
 
 // Err wraps an error with an associated numeric exit code
@@ -0,0 +1,201 @@
+// Package filehash maintains a whole-file checksum of the ciphertext
+// ("-filehash") and verifies it ("-verifyhash").
+//
+// The checksum is a SHA256 over the complete ciphertext file, including the
+// header. It is stored in the xattr XattrName of the ciphertext file, together
+// with the file size and mtime at the time the hash was taken. As only the
+// ciphertext is hashed, verification needs no password and does not decrypt
+// anything.
+//
+// The checksum is meant to detect bit rot. It is not authenticated: the file
+// contents are already protected by the per-block AEAD, which this does not
+// replace.
+package filehash
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/binary"
+	"fmt"
+	"hash"
+
+	"golang.org/x/sys/unix"
+
+	"github.com/rfjakob/gocryptfs/internal/syscallcompat"
+)
+
+// XattrName is the xattr on the ciphertext file that stores the checksum.
+// Encrypted xattr names are much longer, so this cannot collide with them.
+const XattrName = "user.gocryptfs.filehash"
+
+const (
+	valueVersion = 1
+	// version byte + sha256 + size + mtime
+	valueLen = 1 + sha256.Size + 8 + 8
+)
+
+// Running is a checksum that is updated while a file is written
+// sequentially. Once the file is written out of order, the checksum is marked
+// invalid, and Store recomputes it from disk.
+//
+// The zero value is an invalid checksum. The caller must serialize access, in
+// fusefrontend this is done by holding the ContentLock.
+type Running struct {
+	h hash.Hash
+	// next is the ciphertext offset the next sequential write starts at
+	next  int64
+	valid bool
+}
+
+// Reset starts a new checksum for a file that is empty.
+func (r *Running) Reset() {
+	r.h = sha256.New()
+	r.next = 0
+	r.valid = true
+}
+
+// Invalidate marks the checksum as invalid. Call it for all modifications
+// that do not go through Write.
+func (r *Running) Invalidate() {
+	r.valid = false
+	r.h = nil
+}
+
+// Write updates the checksum with "ciphertext" written at offset "off".
+func (r *Running) Write(off int64, ciphertext []byte) {
+	if !r.valid {
+		return
+	}
+	if off != r.next {
+		r.Invalidate()
+		return
+	}
+	r.h.Write(ciphertext)
+	r.next += int64(len(ciphertext))
+}
+
+// Store writes the checksum to the XattrName xattr of the open file "fd". If
+// the running checksum is invalid or does not cover the whole file, the file is
+// read back and the checksum is recomputed.
+func (r *Running) Store(fd int) error {
+	var st unix.Stat_t
+	if err := unix.Fstat(fd, &st); err != nil {
+		return err
+	}
+	var sum []byte
+	if r.valid && r.next == st.Size {
+		sum = r.h.Sum(nil)
+	} else {
+		var err error
+		sum, err = hashFd(fd)
+		if err != nil {
+			return err
+		}
+	}
+	return unix.Fsetxattr(fd, XattrName, packValue(sum, &st), 0)
+}
+
+// hashFd computes the checksum of the file "fd" from disk. It uses pread so
+// the file offset is not touched.
+func hashFd(fd int) ([]byte, error) {
+	h := sha256.New()
+	buf := make([]byte, 128*1024)
+	var off int64
+	for {
+		n, err := unix.Pread(fd, buf, off)
+		if err == unix.EINTR {
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		if n == 0 {
+			return h.Sum(nil), nil
+		}
+		h.Write(buf[:n])
+		off += int64(n)
+	}
+}
+
+func packValue(sum []byte, st *unix.Stat_t) []byte {
+	buf := make([]byte, 0, valueLen)
+	buf = append(buf, valueVersion)
+	buf = append(buf, sum...)
+	var b [8]byte
+	binary.BigEndian.PutUint64(b[:], uint64(st.Size))
+	buf = append(buf, b[:]...)
+	binary.BigEndian.PutUint64(b[:], uint64(unix.TimespecToNsec(st.Mtim)))
+	return append(buf, b[:]...)
+}
+
+// Status is the result of Verify
+type Status int
+
+const (
+	// OK means the checksum matches
+	OK Status = iota
+	// Missing means the file has no checksum
+	Missing
+	// Stale means the file has been modified (size or mtime changed) after the
+	// checksum was stored, so it cannot be checked
+	Stale
+	// Mismatch means the file has the size and mtime the checksum was taken
+	// at, but different content. This is what bit rot looks like.
+	Mismatch
+)
+
+func (s Status) String() string {
+	switch s {
+	case OK:
+		return "ok"
+	case Missing:
+		return "no checksum"
+	case Stale:
+		return "stale checksum"
+	case Mismatch:
+		return "CHECKSUM MISMATCH"
+	}
+	return fmt.Sprintf("Status(%d)", int(s))
+}
+
+// Verify recomputes the checksum of the ciphertext file at "path" and
+// compares it to the stored one.
+func Verify(path string) (Status, error) {
+	return VerifyAt(unix.AT_FDCWD, path)
+}
+
+// VerifyAt is Verify for the file "name" in the directory "dirfd". Symlinks
+// are not followed.
+func VerifyAt(dirfd int, name string) (Status, error) {
+	fd, err := syscallcompat.Openat(dirfd, name, unix.O_RDONLY|unix.O_NOFOLLOW, 0)
+	if err != nil {
+		return 0, err
+	}
+	defer unix.Close(fd)
+	val := make([]byte, valueLen)
+	n, err := unix.Fgetxattr(fd, XattrName, val)
+	if err == unix.ENODATA || err == unix.ENOTSUP {
+		return Missing, nil
+	} else if err != nil {
+		return 0, err
+	}
+	if n != valueLen || val[0] != valueVersion {
+		return 0, fmt.Errorf("invalid %s value", XattrName)
+	}
+	var st unix.Stat_t
+	if err = unix.Fstat(fd, &st); err != nil {
+		return 0, err
+	}
+	stored := val[1 : 1+sha256.Size]
+	if !bytes.Equal(packValue(stored, &st), val) {
+		return Stale, nil
+	}
+	sum, err := hashFd(fd)
+	if err != nil {
+		return 0, err
+	}
+	if !bytes.Equal(sum, stored) {
+		return Mismatch, nil
+	}
+	return OK, nil
+}
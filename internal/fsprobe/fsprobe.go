@@ -0,0 +1,251 @@
+// Package fsprobe checks if the filesystem that holds CIPHERDIR supports the
+// operations gocryptfs relies on. Some network and FUSE filesystems silently
+// lack some of them, which can corrupt files instead of just causing errors.
+//
+// The probe creates a few small files in the directory it checks and deletes
+// them again.
+package fsprobe
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"syscall"
+
+	"golang.org/x/sys/unix"
+
+	"github.com/rfjakob/gocryptfs/internal/cryptocore"
+)
+
+// Severity says how bad a missing capability is
+type Severity int
+
+const (
+	// OK means the capability works
+	OK Severity = iota
+	// Warn means things will fail with errors, or data written right before
+	// a crash may be lost
+	Warn
+	// Fatal means gocryptfs could corrupt files
+	Fatal
+)
+
+func (s Severity) String() string {
+	switch s {
+	case OK:
+		return "ok"
+	case Warn:
+		return "warning"
+	case Fatal:
+		return "FATAL"
+	}
+	return fmt.Sprintf("Severity(%d)", int(s))
+}
+
+// Check is the result of probing one capability
+type Check struct {
+	// Name of the capability, like "rename"
+	Name     string
+	Severity Severity
+	// Err is what went wrong. Nil if Severity is OK.
+	Err error
+	// Consequence says what happens without the capability
+	Consequence string
+}
+
+func (c Check) String() string {
+	if c.Severity == OK {
+		return fmt.Sprintf("%s: ok", c.Name)
+	}
+	return fmt.Sprintf("%s: %v. %s", c.Name, c.Err, c.Consequence)
+}
+
+// Worst returns the highest severity in "checks"
+func Worst(checks []Check) Severity {
+	worst := OK
+	for _, c := range checks {
+		if c.Severity > worst {
+			worst = c.Severity
+		}
+	}
+	return worst
+}
+
+// tmpPrefix starts the names of the files the probe creates. Left-over files
+// from an interrupted probe are deleted by the next one.
+const tmpPrefix = ".gocryptfs.probe."
+
+// backend are the filesystem operations the probe uses. Tests replace it to
+// simulate a filesystem that lacks something.
+type backend interface {
+	// WriteFile creates "path", which must not exist, with content "data"
+	WriteFile(path string, data []byte) error
+	ReadFile(path string) ([]byte, error)
+	Fsync(path string) error
+	Rename(oldpath string, newpath string) error
+	Setxattr(path string, attr string, val []byte) error
+	Getxattr(path string, attr string) ([]byte, error)
+	Lstat(path string) (*syscall.Stat_t, error)
+	Remove(path string) error
+}
+
+type osBackend struct{}
+
+func (osBackend) WriteFile(path string, data []byte) error {
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0600)
+	if err != nil {
+		return err
+	}
+	_, err = f.Write(data)
+	if err2 := f.Close(); err == nil {
+		err = err2
+	}
+	return err
+}
+
+func (osBackend) ReadFile(path string) ([]byte, error) {
+	return ioutil.ReadFile(path)
+}
+
+func (osBackend) Fsync(path string) error {
+	f, err := os.OpenFile(path, os.O_WRONLY, 0)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	return f.Sync()
+}
+
+func (osBackend) Rename(oldpath string, newpath string) error {
+	return os.Rename(oldpath, newpath)
+}
+
+func (osBackend) Setxattr(path string, attr string, val []byte) error {
+	return unix.Lsetxattr(path, attr, val, 0)
+}
+
+func (osBackend) Getxattr(path string, attr string) ([]byte, error) {
+	buf := make([]byte, 256)
+	n, err := unix.Lgetxattr(path, attr, buf)
+	if err != nil {
+		return nil, err
+	}
+	return buf[:n], nil
+}
+
+func (osBackend) Lstat(path string) (*syscall.Stat_t, error) {
+	var st syscall.Stat_t
+	err := syscall.Lstat(path, &st)
+	return &st, err
+}
+
+func (osBackend) Remove(path string) error {
+	return os.Remove(path)
+}
+
+// Run probes the filesystem that holds the directory "dir", which must be
+// writable. Returns one Check per capability, in the order they were probed.
+func Run(dir string) []Check {
+	return run(osBackend{}, dir)
+}
+
+func run(b backend, dir string) (checks []Check) {
+	// Clean up after an interrupted probe
+	if names, err := filepath.Glob(filepath.Join(dir, tmpPrefix+"*")); err == nil {
+		for _, n := range names {
+			b.Remove(n)
+		}
+	}
+	add := func(name string, sev Severity, err error, consequence string) {
+		if err == nil {
+			sev = OK
+			consequence = ""
+		}
+		checks = append(checks, Check{Name: name, Severity: sev, Err: err, Consequence: consequence})
+	}
+	id := fmt.Sprintf("%x", cryptocore.RandBytes(8))
+	a := filepath.Join(dir, tmpPrefix+id+".a")
+	bPath := filepath.Join(dir, tmpPrefix+id+".b")
+	defer b.Remove(a)
+	defer b.Remove(bPath)
+	dataA := bytes.Repeat([]byte("a"), 4096)
+	dataB := bytes.Repeat([]byte("b"), 4096)
+
+	// Without this, nothing else can be checked
+	err := b.WriteFile(a, dataA)
+	if err == nil {
+		err = b.WriteFile(bPath, dataB)
+	}
+	if err == nil {
+		err = readBack(b, a, dataA)
+	}
+	add("create and write", Fatal, err, "Files cannot be written.")
+	if err != nil {
+		return checks
+	}
+
+	add("fsync", Warn, b.Fsync(a),
+		"Data written shortly before a crash or power loss may be lost, and files may be left corrupt.")
+
+	stA, errA := b.Lstat(a)
+	stB, errB := b.Lstat(bPath)
+	err = errA
+	if err == nil {
+		err = errB
+	}
+	if err == nil && (stA.Ino == 0 || stA.Ino == stB.Ino) {
+		err = fmt.Errorf("two files have inode numbers %d and %d", stA.Ino, stB.Ino)
+	}
+	add("inode numbers", Fatal, err,
+		"gocryptfs tracks open files by inode number. Files sharing one could get content encrypted for the other one.")
+
+	// gocryptfs renames over existing files to update them atomically
+	err = b.Rename(bPath, a)
+	if err == nil {
+		err = readBack(b, a, dataB)
+	}
+	if err == nil {
+		if _, err2 := b.Lstat(bPath); err2 == nil {
+			err = fmt.Errorf("the old name still exists after rename")
+		}
+	}
+	add("rename", Fatal, err,
+		"The config file cannot be updated without risking its loss, and renaming in the mount fails.")
+	if err == nil && errB == nil {
+		stA2, err := b.Lstat(a)
+		if err == nil && stA2.Ino != stB.Ino {
+			err = fmt.Errorf("inode number changed from %d to %d", stB.Ino, stA2.Ino)
+		}
+		add("inode numbers after rename", Warn, err,
+			"A file that is renamed while open may be written without locking against other writers.")
+	}
+
+	const attr = "user.gocryptfs.probe"
+	err = b.Setxattr(a, attr, []byte(id))
+	if err == nil {
+		var val []byte
+		val, err = b.Getxattr(a, attr)
+		if err == nil && string(val) != id {
+			err = fmt.Errorf("read back %q instead of %q", val, id)
+		}
+	}
+	add("extended attributes", Warn, err,
+		"Extended attributes, -encryptacl and -filehash will not work.")
+	return checks
+}
+
+// readBack checks that "path" has the content "want"
+func readBack(b backend, path string, want []byte) error {
+	have, err := b.ReadFile(path)
+	if err != nil {
+		return err
+	}
+	if !bytes.Equal(have, want) {
+		return fmt.Errorf("%s: read back %d bytes that differ from the %d bytes written",
+			strings.TrimPrefix(filepath.Base(path), tmpPrefix), len(have), len(want))
+	}
+	return nil
+}
@@ -0,0 +1,95 @@
+package fsprobe
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"syscall"
+	"testing"
+)
+
+// noRename simulates a filesystem that does not support rename
+type noRename struct {
+	osBackend
+}
+
+func (noRename) Rename(oldpath string, newpath string) error {
+	return &os.LinkError{Op: "rename", Old: oldpath, New: newpath, Err: syscall.ENOSYS}
+}
+
+// sameIno simulates a filesystem that reports the same inode number for all
+// files
+type sameIno struct {
+	osBackend
+}
+
+func (b sameIno) Lstat(path string) (*syscall.Stat_t, error) {
+	st, err := b.osBackend.Lstat(path)
+	st.Ino = 1
+	return st, err
+}
+
+func findCheck(t *testing.T, checks []Check, name string) Check {
+	for _, c := range checks {
+		if c.Name == name {
+			return c
+		}
+	}
+	t.Fatalf("no check %q in %v", name, checks)
+	return Check{}
+}
+
+func TestRun(t *testing.T) {
+	dir, err := ioutil.TempDir("", "fsprobe")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	// Left over by an interrupted probe
+	ioutil.WriteFile(filepath.Join(dir, tmpPrefix+"old.a"), nil, 0600)
+	checks := Run(dir)
+	// Extended attributes depend on the filesystem /tmp is on
+	for _, c := range checks {
+		if c.Severity != OK && c.Name != "extended attributes" {
+			t.Errorf("%v", c)
+		}
+	}
+	if names, _ := ioutil.ReadDir(dir); len(names) != 0 {
+		t.Errorf("probe files left behind: %v", names)
+	}
+}
+
+// TestNoRename checks that a filesystem without rename is refused, with a
+// message that says what rename is needed for.
+func TestNoRename(t *testing.T) {
+	dir, err := ioutil.TempDir("", "fsprobe")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	checks := run(noRename{}, dir)
+	c := findCheck(t, checks, "rename")
+	if c.Severity != Fatal || Worst(checks) != Fatal {
+		t.Errorf("want a fatal rename check, have %v", checks)
+	}
+	if s := c.String(); !strings.Contains(s, "function not implemented") || !strings.Contains(s, "config file") {
+		t.Errorf("uninformative message %q", s)
+	}
+	// The other checks still ran
+	if c := findCheck(t, checks, "fsync"); c.Severity != OK {
+		t.Errorf("fsync: %v", c)
+	}
+}
+
+func TestSameIno(t *testing.T) {
+	dir, err := ioutil.TempDir("", "fsprobe")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	checks := run(sameIno{}, dir)
+	if c := findCheck(t, checks, "inode numbers"); c.Severity != Fatal {
+		t.Errorf("want a fatal inode number check, have %v", c)
+	}
+}
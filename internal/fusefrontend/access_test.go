@@ -0,0 +1,74 @@
+package fusefrontend
+
+import (
+	"context"
+	"os"
+	"syscall"
+	"testing"
+
+	"golang.org/x/sys/unix"
+
+	"github.com/hanwen/go-fuse/v2/fuse"
+
+	"github.com/rfjakob/gocryptfs/tests/test_helpers"
+)
+
+// TestAccess checks that Access(W_OK) succeeds on a writable mount and fails
+// with EROFS on a read-only mount of the same CIPHERDIR.
+func TestAccess(t *testing.T) {
+	cipherdir := test_helpers.InitFS(t)
+	rw := newTestFS(Args{Cipherdir: cipherdir})
+	_, fh, _, errno := rw.Create(nil, "foo", syscall.O_RDWR, 0600, &fuse.EntryOut{})
+	if errno != 0 {
+		t.Fatal(errno)
+	}
+	fh.(*File).Release(nil)
+
+	access := func(rn *RootNode, mask uint32) syscall.Errno {
+		ch, errno := rn.Lookup(nil, "foo", &fuse.EntryOut{})
+		if errno != 0 {
+			t.Fatal(errno)
+		}
+		// The FUSE bridge normally does this after Lookup
+		rn.AddChild("foo", ch, true)
+		return ch.Operations().(*Node).Access(nil, mask)
+	}
+
+	if errno := access(rw, unix.W_OK); errno != 0 {
+		t.Errorf("rw mount: W_OK: %v", errno)
+	}
+	if errno := access(rw, unix.X_OK); errno != syscall.EACCES {
+		t.Errorf("rw mount: X_OK on mode 0600: want EACCES, got %v", errno)
+	}
+
+	ro := newTestFS(Args{Cipherdir: cipherdir, ReadOnly: true})
+	if errno := access(ro, unix.W_OK); errno != syscall.EROFS {
+		t.Errorf("ro mount: W_OK: want EROFS, got %v", errno)
+	}
+	if errno := access(ro, unix.R_OK); errno != 0 {
+		t.Errorf("ro mount: R_OK: %v", errno)
+	}
+}
+
+// TestAccessCaller checks that, when running as root, Access answers for the
+// caller and not for the daemon.
+func TestAccessCaller(t *testing.T) {
+	if os.Getuid() != 0 {
+		t.Skip("must run as root")
+	}
+	cipherdir := test_helpers.InitFS(t)
+	rn := newTestFS(Args{Cipherdir: cipherdir, PreserveOwner: true})
+	createFile(t, &rn.Node, "foo", []byte("x"))
+	n, errno := lookup(t, &rn.Node, "foo")
+	if errno != 0 {
+		t.Fatal(errno)
+	}
+	ctx := fuse.NewContext(context.Background(), &fuse.Caller{Owner: fuse.Owner{Uid: 1000, Gid: 1000}})
+	if errno = n.Access(ctx, unix.R_OK); errno != syscall.EACCES {
+		t.Errorf("other user on a mode 0600 file: want EACCES, got %v", errno)
+	}
+	// The ids are switched back
+	if errno = n.Access(nil, unix.R_OK); errno != 0 {
+		t.Errorf("root: %v", errno)
+	}
+}
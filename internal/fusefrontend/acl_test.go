@@ -0,0 +1,92 @@
+package fusefrontend
+
+import (
+	"bytes"
+	"encoding/binary"
+	"path/filepath"
+	"syscall"
+	"testing"
+
+	"github.com/hanwen/go-fuse/v2/fuse"
+
+	"github.com/rfjakob/gocryptfs/internal/syscallcompat"
+	"github.com/rfjakob/gocryptfs/tests/test_helpers"
+)
+
+// aclBlob returns a system.posix_acl_access value for mode 0640.
+func aclBlob() []byte {
+	var buf bytes.Buffer
+	// POSIX_ACL_XATTR_VERSION
+	binary.Write(&buf, binary.LittleEndian, uint32(2))
+	for _, e := range []struct {
+		tag, perm uint16
+		id        uint32
+	}{
+		{0x01, 6, ^uint32(0)}, // ACL_USER_OBJ rw-
+		{0x04, 4, ^uint32(0)}, // ACL_GROUP_OBJ r--
+		{0x20, 0, ^uint32(0)}, // ACL_OTHER ---
+	} {
+		binary.Write(&buf, binary.LittleEndian, e)
+	}
+	return buf.Bytes()
+}
+
+// TestEncryptACL sets an ACL with -encryptacl, reads it back, and checks that
+// the backing file only has an encrypted copy.
+func TestEncryptACL(t *testing.T) {
+	cipherdir := test_helpers.InitFS(t)
+	rn := newTestFS(Args{Cipherdir: cipherdir, EncryptACL: true})
+	ch, fh, _, errno := rn.Create(nil, "foo", syscall.O_RDWR, 0640, &fuse.EntryOut{})
+	if errno != 0 {
+		t.Fatal(errno)
+	}
+	fh.(*File).Release(nil)
+	rn.AddChild("foo", ch, true)
+	n := ch.Operations().(*Node)
+
+	const attr = "system.posix_acl_access"
+	acl := aclBlob()
+	if errno := n.Setxattr(nil, attr, acl, 0); errno != 0 {
+		if errno == syscall.EOPNOTSUPP {
+			t.Skip("backing filesystem does not support user xattrs")
+		}
+		t.Fatal(errno)
+	}
+	buf := make([]byte, 1000)
+	sz, errno := n.Getxattr(nil, attr, buf)
+	if errno != 0 {
+		t.Fatal(errno)
+	}
+	if !bytes.Equal(buf[:sz], acl) {
+		t.Errorf("read back wrong ACL: %x", buf[:sz])
+	}
+
+	// Check the backing file
+	dirfd, cName, err := rn.openBackingDir("foo")
+	if err != nil {
+		t.Fatal(err)
+	}
+	syscall.Close(dirfd)
+	cPath := filepath.Join(cipherdir, cName)
+	if _, err := syscallcompat.Lgetxattr(cPath, attr); err == nil {
+		t.Error("ACL was passed through in plaintext")
+	}
+	cData, err := syscallcompat.Lgetxattr(cPath, rn.encryptXattrName(attr))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if bytes.Contains(cData, acl) {
+		t.Errorf("backing xattr is not encrypted: %x", cData)
+	}
+
+	// Without -encryptacl, the encrypted ACL is ignored
+	rn2 := newTestFS(Args{Cipherdir: cipherdir})
+	rn2.AddChild("foo", rn2.NewInode(nil, &Node{}, ch.StableAttr()), true)
+	sz, errno = rn2.GetChild("foo").Operations().(*Node).Listxattr(nil, buf)
+	if errno != 0 {
+		t.Fatal(errno)
+	}
+	if sz != 0 {
+		t.Errorf("expected no xattrs, got %q", buf[:sz])
+	}
+}
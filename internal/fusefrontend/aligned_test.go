@@ -0,0 +1,110 @@
+package fusefrontend
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"syscall"
+	"testing"
+
+	"github.com/hanwen/go-fuse/v2/fuse"
+
+	"github.com/rfjakob/gocryptfs/internal/contentenc"
+	"github.com/rfjakob/gocryptfs/tests/test_helpers"
+)
+
+// TestAlignedWrites checks that with -aligned_writes, overwriting the last
+// block of a file does not read it, and that unaligned writes are rejected.
+func TestAlignedWrites(t *testing.T) {
+	cipherdir := test_helpers.InitFS(t)
+	rn := newTestFS(Args{Cipherdir: cipherdir})
+	bs := int(rn.contentEnc.PlainBS())
+	ch, fh, _, errno := rn.Create(nil, "foo", syscall.O_RDWR, 0600, &fuse.EntryOut{})
+	if errno != 0 {
+		t.Fatal(errno)
+	}
+	rn.AddChild("foo", ch, true)
+	// One and a half blocks
+	if _, errno = fh.(*File).Write(nil, bytes.Repeat([]byte{1}, bs+bs/2), 0); errno != 0 {
+		t.Fatal(errno)
+	}
+	fh.(*File).Release(nil)
+
+	// Corrupt the last block on disk. A read of that block now fails, so a
+	// write that succeeds cannot have read it.
+	dirfd, cName, err := rn.openBackingDir("foo")
+	if err != nil {
+		t.Fatal(err)
+	}
+	syscall.Close(dirfd)
+	cf, err := os.OpenFile(filepath.Join(cipherdir, cName), os.O_RDWR, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err = cf.WriteAt([]byte{0xff, 0xff, 0xff, 0xff}, int64(contentenc.HeaderLen+rn.contentEnc.CipherBS()+100)); err != nil {
+		t.Fatal(err)
+	}
+	cf.Close()
+
+	tail := bytes.Repeat([]byte{2}, bs/2+10)
+	write := func(rn *RootNode, data []byte, off int) syscall.Errno {
+		fh, _, errno := lookupNode(t, rn, "foo").Open(nil, syscall.O_RDWR)
+		if errno != 0 {
+			t.Fatal(errno)
+		}
+		defer fh.(*File).Release(nil)
+		_, errno = fh.(*File).Write(nil, data, int64(off))
+		return errno
+	}
+	// Without -aligned_writes, the partial write reads the corrupt block
+	if errno := write(rn, tail, bs); errno != syscall.EIO {
+		t.Fatalf("want EIO from the read-modify-write, got %v", errno)
+	}
+	rn2 := newTestFS(Args{Cipherdir: cipherdir, AlignedWrites: true})
+	// Overwriting the tail from the block boundary does not read it
+	if errno := write(rn2, tail, bs); errno != 0 {
+		t.Fatalf("aligned tail write failed: %v", errno)
+	}
+	for _, tc := range []struct {
+		off, length int
+	}{
+		// Does not start at a block boundary
+		{100, bs},
+		// Ends in the middle of a block before EOF
+		{0, bs / 2},
+	} {
+		if errno := write(rn2, make([]byte, tc.length), tc.off); errno != syscall.EINVAL {
+			t.Errorf("off=%d len=%d: want EINVAL, got %v", tc.off, tc.length, errno)
+		}
+	}
+	// Whole blocks work everywhere
+	if errno := write(rn2, bytes.Repeat([]byte{3}, bs), 0); errno != 0 {
+		t.Fatal(errno)
+	}
+	fh, _, errno = lookupNode(t, rn2, "foo").Open(nil, syscall.O_RDONLY)
+	if errno != 0 {
+		t.Fatal(errno)
+	}
+	defer fh.(*File).Release(nil)
+	buf := make([]byte, 3*bs)
+	res, errno := fh.(*File).Read(nil, buf, 0)
+	if errno != 0 {
+		t.Fatal(errno)
+	}
+	have, _ := res.Bytes(buf)
+	want := append(bytes.Repeat([]byte{3}, bs), tail...)
+	if !bytes.Equal(have, want) {
+		t.Errorf("wrong content: have %d bytes, want %d", len(have), len(want))
+	}
+}
+
+// lookupNode looks up "name" in the root directory of "rn" and attaches it to
+// the inode tree.
+func lookupNode(t *testing.T, rn *RootNode, name string) *Node {
+	ch, errno := rn.Lookup(nil, name, &fuse.EntryOut{})
+	if errno != 0 {
+		t.Fatal(errno)
+	}
+	rn.AddChild(name, ch, true)
+	return ch.Operations().(*Node)
+}
@@ -1,6 +1,8 @@
 package fusefrontend
 
 import (
+	"time"
+
 	"github.com/hanwen/go-fuse/v2/fuse"
 )
 
@@ -46,7 +48,123 @@ type Args struct {
 	Suid bool
 	// Enable the FUSE kernel_cache option
 	KernelCache bool
+	// DirectIO opens all files with FOPEN_DIRECT_IO, so reads and writes
+	// bypass the kernel page cache. Set via "-direct_io".
+	DirectIO bool
 	// SharedStorage disables caching & hard link tracking,
 	// enabled via cli flag "-sharedstorage"
 	SharedStorage bool
+	// ReadOnly is true if the filesystem has been mounted with "-ro".
+	// The kernel enforces this for writes, we only need it for Access().
+	ReadOnly bool
+	// Quarantine makes Readdir list entries whose name cannot be decrypted
+	// as ".corrupt.CIPHERNAME" instead of hiding them, and also lists the
+	// raw entries of directories whose gocryptfs.diriv is unreadable.
+	// Set via "-quarantine".
+	Quarantine bool
+	// HideBadHeaders makes Readdir and Lookup hide regular files that are
+	// not empty but do not start with a valid file header. Without it, they
+	// are listed like other files, and reading them fails with EIO. Costs one
+	// read per file in Readdir. Set via "-unexpected=hide".
+	HideBadHeaders bool
+	// EncryptACL stores POSIX ACLs encrypted like user xattrs instead of
+	// passing them through to the backing filesystem. Set via "-encryptacl".
+	EncryptACL bool
+	// BandwidthLimit caps the combined read and write throughput in bytes
+	// per second. Zero means unlimited. Set via "-bwlimit".
+	BandwidthLimit int64
+	// Prefix is a plaintext directory, relative to the root of the
+	// filesystem, that is presented as the root of the mount. Everything
+	// outside of it is invisible. Set via "-prefix".
+	Prefix string
+	// UserPrefixes maps uids to a plaintext directory, relative to Prefix,
+	// that is the root of the mount for that user. Users without an entry
+	// get EACCES. Needs SharedStorage, so that the kernel does not serve
+	// one user entries it cached for another. Set via "-user_prefix".
+	UserPrefixes map[uint32]string
+	// Quota caps the total plaintext size of all files in bytes. Writes,
+	// truncates and fallocates that would exceed it fail with EDQUOT. Zero
+	// means unlimited. Set via "-quota".
+	Quota int64
+	// MaxOpen caps the number of files that are open through the mount at
+	// the same time. Opens and creates beyond it fail with ENFILE. Zero
+	// means unlimited. Set via "-max_open".
+	MaxOpen int
+	// Journal keeps a journal of the blocks written to each file in a
+	// CIPHERNAME.journal side file. Set via "-journal".
+	Journal bool
+	// EntryTimeout and AttrTimeout are how long the kernel may cache
+	// name lookups and attributes. Zero leaves them to the fs.Options
+	// defaults. Set via "-entry_timeout" and "-attr_timeout".
+	EntryTimeout time.Duration
+	AttrTimeout  time.Duration
+	// TimeoutDepth divides EntryTimeout and AttrTimeout by the depth of the
+	// path, so that entries near the root are cached longer than deep ones.
+	// Set via "-timeout_depth".
+	TimeoutDepth bool
+	// FileHash maintains a checksum of the whole ciphertext file in an xattr,
+	// see package filehash. Set via "-filehash".
+	FileHash bool
+	// AlignedWrites rejects writes that are not aligned to the plaintext
+	// block size, and in exchange skips the read-modify-write read for the
+	// last block of the file. Set via "-aligned_writes".
+	AlignedWrites bool
+	// IOTimeout makes reads and writes of file content on the backing
+	// filesystem fail with ETIMEDOUT if they take longer. Zero disables
+	// the timeout. Set via "-io_timeout".
+	IOTimeout time.Duration
+	// WriteBuffer collects small sequential writes in a per-handle buffer
+	// and writes complete blocks only, saving the read-modify-write of the
+	// partial block on each write. Set via "-writebuffer".
+	WriteBuffer bool
+	// Sparse leaves file holes in the ciphertext for all-zero plaintext
+	// blocks instead of encrypting them. Set via "-sparse".
+	Sparse bool
+	// WatchBacking is the interval at which the backing files are checked
+	// for changes made behind our back, see scanBacking. Zero disables the
+	// check. Set via "-watch_backing".
+	WatchBacking time.Duration
+	// FsyncBatch coalesces the fsyncs of a file that arrive within this
+	// window into one backing fsync. Zero runs one backing fsync per
+	// fsync. Set via "-fsync_batch".
+	FsyncBatch time.Duration
+	// WarnClockSkew logs a warning when a file is written with an older
+	// mtime than a file written before it in the same directory, which
+	// hints at a clock that moved backward. Set via "-warn_clock_skew".
+	WarnClockSkew bool
+	// ContentHash provides the SHA256 of the plaintext content as the
+	// read-only xattr "user.gocryptfs.contenthash", see content_hash.go.
+	// Set via "-contenthash".
+	ContentHash bool
+	// FreezeTimestamps reports all timestamps as the Unix epoch. The
+	// backing files are not affected. Set via "-timestamps=freeze".
+	FreezeTimestamps bool
+	// NoPropagateTimes keeps accesses through the mount from changing the
+	// timestamps of the backing files: they are opened with O_NOATIME,
+	// utimens is ignored, and the mtime of written files is put back when
+	// they are closed. Set via "-timestamps=nopropagate".
+	NoPropagateTimes bool
+	// NoAtime opens the backing files and directories with O_NOATIME, so
+	// that reading through the mount does not update their atime. Implied
+	// by NoPropagateTimes. Set via "-noatime".
+	NoAtime bool
+	// LowerCipherdir is a second cipherdir with the same master key that is
+	// merged below Cipherdir, see union.go. It is never modified. Set via
+	// "-lowerdir".
+	LowerCipherdir string
+	// Fanout stores the entries of each directory in bucket directories
+	// named after the hash of the encrypted name, see fanout.go. Set via
+	// the "Fanout" feature flag.
+	Fanout bool
+	// FileTags reserves an encrypted region for file tags after each file
+	// header, see file_tags.go. Set via the "FileTags" feature flag.
+	FileTags bool
+	// Trash makes Unlink move files into a hidden trash directory, from
+	// where they can be restored or purged over the control socket, see
+	// trash.go. Set via "-trash".
+	Trash bool
+	// Wipe makes Unlink overwrite the backing file with random data once it
+	// has been deleted, see wipe.go. With Trash, this happens when the file is
+	// purged. Set via "-wipe".
+	Wipe bool
 }
@@ -0,0 +1,140 @@
+package fusefrontend
+
+import (
+	"syscall"
+	"time"
+
+	"golang.org/x/sys/unix"
+
+	"github.com/hanwen/go-fuse/v2/fs"
+	"github.com/hanwen/go-fuse/v2/fuse"
+
+	"github.com/rfjakob/gocryptfs/internal/inomap"
+	"github.com/rfjakob/gocryptfs/internal/openfiletable"
+	"github.com/rfjakob/gocryptfs/internal/syscallcompat"
+	"github.com/rfjakob/gocryptfs/internal/tlog"
+)
+
+// kernelNotifier tells the kernel to drop what it has cached. Tests replace
+// it, the real one needs a mounted filesystem.
+type kernelNotifier interface {
+	// NotifyContent drops the cached content and attributes of "n"
+	NotifyContent(n *fs.Inode) syscall.Errno
+	// NotifyEntry drops the cached lookup of "name" in "parent"
+	NotifyEntry(parent *fs.Inode, name string) syscall.Errno
+}
+
+type inodeNotifier struct{}
+
+func (inodeNotifier) NotifyContent(n *fs.Inode) syscall.Errno {
+	// Offset 0, length 0 means the whole file
+	return n.NotifyContent(0, 0)
+}
+
+func (inodeNotifier) NotifyEntry(parent *fs.Inode, name string) syscall.Errno {
+	return parent.NotifyEntry(name)
+}
+
+// backingStamp is what a scan remembers about a backing file to notice
+// when it is changed behind our back
+type backingStamp struct {
+	ino          uint64
+	size         uint64
+	mtime, ctime uint64
+	mtimensec    uint32
+	ctimensec    uint32
+}
+
+func newBackingStamp(st *syscall.Stat_t) backingStamp {
+	var a fuse.Attr
+	a.FromStat(st)
+	return backingStamp{
+		ino:       st.Ino,
+		size:      a.Size,
+		mtime:     a.Mtime,
+		mtimensec: a.Mtimensec,
+		ctime:     a.Ctime,
+		ctimensec: a.Ctimensec,
+	}
+}
+
+// backingWatch is the state of "-watch_backing"
+type backingWatch struct {
+	notifier kernelNotifier
+	// stamps of the regular files the kernel knows about, from the last
+	// scan. Only accessed by scanBacking.
+	stamps map[*fs.Inode]backingStamp
+}
+
+// WatchBacking calls scanBacking every "interval" and never returns. Run it
+// in a goroutine after mounting.
+func (rn *RootNode) WatchBacking(interval time.Duration) {
+	for {
+		rn.scanBacking()
+		time.Sleep(interval)
+	}
+}
+
+// scanBacking stats the backing files of all regular files the kernel knows
+// about. If one has changed since the last scan, for example because a sync
+// tool wrote a new version, the kernel is told to drop its cached content
+// and the file ID cached for open files is read again.
+//
+// Writes through the mount change the backing files as well and cause
+// unneeded, but harmless, invalidations.
+func (rn *RootNode) scanBacking() {
+	w := rn.backingWatch
+	stamps := make(map[*fs.Inode]backingStamp, len(w.stamps))
+	rn.scanBackingDir(rn.EmbeddedInode(), stamps)
+	w.stamps = stamps
+}
+
+func (rn *RootNode) scanBackingDir(dir *fs.Inode, stamps map[*fs.Inode]backingStamp) {
+	w := rn.backingWatch
+	for name, ch := range dir.Children() {
+		if ch.IsDir() {
+			rn.scanBackingDir(ch, stamps)
+			continue
+		}
+		if ch.StableAttr().Mode&syscall.S_IFMT != syscall.S_IFREG {
+			continue
+		}
+		old, known := w.stamps[ch]
+		dirfd, cName, errno := toNode(dir.Operations()).prepareAtSyscall(nil, name)
+		if errno != 0 {
+			continue
+		}
+		st, err := syscallcompat.Fstatat2(dirfd, cName, unix.AT_SYMLINK_NOFOLLOW)
+		syscall.Close(dirfd)
+		if err == syscall.ENOENT {
+			if known {
+				tlog.Debug.Printf("scanBacking: %q was deleted on disk", name)
+				w.notifier.NotifyEntry(dir, name)
+			}
+			continue
+		} else if err != nil {
+			if known {
+				stamps[ch] = old
+			}
+			continue
+		}
+		stamp := newBackingStamp(st)
+		stamps[ch] = stamp
+		if !known || stamp == old {
+			continue
+		}
+		tlog.Debug.Printf("scanBacking: %q changed on disk, invalidating", name)
+		if stamp.ino != old.ino {
+			// Replaced by a different file, typically by a rename
+			w.notifier.NotifyEntry(dir, name)
+		}
+		w.notifier.NotifyContent(ch)
+		// Open files cache the file ID from the header
+		if e := openfiletable.Lookup(inomap.QInoFromStat(st)); e != nil {
+			e.ContentLock.Lock()
+			e.ID = nil
+			e.FileHash.Invalidate()
+			e.ContentLock.Unlock()
+		}
+	}
+}
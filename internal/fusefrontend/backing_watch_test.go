@@ -0,0 +1,113 @@
+package fusefrontend
+
+import (
+	"bytes"
+	"io/ioutil"
+	"path/filepath"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/hanwen/go-fuse/v2/fs"
+	"github.com/hanwen/go-fuse/v2/fuse"
+
+	"github.com/rfjakob/gocryptfs/tests/test_helpers"
+)
+
+// recordNotifier records invalidations instead of sending them to a kernel
+type recordNotifier struct {
+	content []*fs.Inode
+	entries []string
+}
+
+func (r *recordNotifier) NotifyContent(n *fs.Inode) syscall.Errno {
+	r.content = append(r.content, n)
+	return 0
+}
+
+func (r *recordNotifier) NotifyEntry(parent *fs.Inode, name string) syscall.Errno {
+	r.entries = append(r.entries, name)
+	return 0
+}
+
+// TestWatchBacking replaces the backing file of an open file, like a sync
+// tool would, and checks that the kernel is notified and that the open file
+// reads the new content after the next scan.
+func TestWatchBacking(t *testing.T) {
+	cipherdir := test_helpers.InitFS(t)
+	rn := newTestFS(Args{Cipherdir: cipherdir, WatchBacking: time.Second})
+	rec := &recordNotifier{}
+	rn.backingWatch.notifier = rec
+	oldContent := bytes.Repeat([]byte("o"), 5000)
+	newContent := bytes.Repeat([]byte("n"), 7000)
+	for name, content := range map[string][]byte{"file": oldContent, "new": newContent, "other": oldContent} {
+		ch, fh, _, errno := rn.Create(nil, name, syscall.O_RDWR, 0600, &fuse.EntryOut{})
+		if errno != 0 {
+			t.Fatal(errno)
+		}
+		rn.AddChild(name, ch, true)
+		if _, errno = fh.(*File).Write(nil, content, 0); errno != 0 {
+			t.Fatal(errno)
+		}
+		fh.(*File).Release(nil)
+	}
+	cPath := func(name string) string {
+		dirfd, cName, err := rn.openBackingDir(name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		syscall.Close(dirfd)
+		return filepath.Join(cipherdir, cName)
+	}
+	fh, _, errno := lookupChild(t, &rn.Node, "file").Open(nil, syscall.O_RDONLY)
+	if errno != 0 {
+		t.Fatal(errno)
+	}
+	f := fh.(*File)
+	defer f.Release(nil)
+	read := func() []byte {
+		buf := make([]byte, 10000)
+		res, errno := f.Read(nil, buf, 0)
+		if errno != 0 {
+			t.Fatalf("Read: %v", errno)
+		}
+		data, _ := res.Bytes(buf)
+		return data
+	}
+	if !bytes.Equal(read(), oldContent) {
+		t.Fatal("wrong content before the change")
+	}
+	// The first scan only records the state
+	rn.scanBacking()
+	if len(rec.content) != 0 || len(rec.entries) != 0 {
+		t.Fatalf("first scan notified %v %v", rec.content, rec.entries)
+	}
+
+	// Rewrite "file" in place with the ciphertext of "new". The header and
+	// with it the file ID changes, the inode number stays the same.
+	ciphertext, err := ioutil.ReadFile(cPath("new"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = ioutil.WriteFile(cPath("file"), ciphertext, 0600); err != nil {
+		t.Fatal(err)
+	}
+	syscall.Unlink(cPath("other"))
+	rn.scanBacking()
+	if len(rec.content) != 1 || rec.content[0] != rn.GetChild("file") {
+		t.Errorf("want a content notification for \"file\", have %v", rec.content)
+	}
+	if len(rec.entries) != 1 || rec.entries[0] != "other" {
+		t.Errorf("want an entry notification for \"other\", have %v", rec.entries)
+	}
+	if have := read(); !bytes.Equal(have, newContent) {
+		t.Errorf("open file reads %d bytes of stale content", len(have))
+	}
+
+	// Nothing changed since
+	rec.content, rec.entries = nil, nil
+	rn.scanBacking()
+	if len(rec.content) != 0 || len(rec.entries) != 0 {
+		t.Errorf("unchanged files notified: %v %v", rec.content, rec.entries)
+	}
+}
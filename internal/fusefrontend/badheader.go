@@ -0,0 +1,54 @@
+package fusefrontend
+
+import (
+	"syscall"
+
+	"golang.org/x/sys/unix"
+
+	"github.com/rfjakob/gocryptfs/internal/contentenc"
+	"github.com/rfjakob/gocryptfs/internal/syscallcompat"
+	"github.com/rfjakob/gocryptfs/internal/tlog"
+)
+
+// hasBadHeader returns true if the backing file "cName" in "dirfd", with the
+// attributes "st", is a regular file that gocryptfs cannot have written: it
+// is not empty, but does not start with a valid file header. This is what a
+// plaintext file that was copied into CIPHERDIR looks like.
+//
+// Empty files have no header by design. Files that cannot be opened or read
+// are not checked and return false.
+func hasBadHeader(dirfd int, cName string, st *syscall.Stat_t) bool {
+	if st.Mode&syscall.S_IFMT != syscall.S_IFREG || st.Size == 0 {
+		return false
+	}
+	if st.Size < contentenc.HeaderLen {
+		return true
+	}
+	// O_NONBLOCK in case someone replaced the file with a FIFO since the stat
+	fd, err := syscallcompat.Openat(dirfd, cName, syscall.O_RDONLY|syscall.O_NOFOLLOW|syscall.O_NONBLOCK, 0)
+	if err != nil {
+		return false
+	}
+	defer syscall.Close(fd)
+	buf := make([]byte, contentenc.HeaderLen)
+	if n, err := syscall.Pread(fd, buf, 0); err != nil || n != len(buf) {
+		return false
+	}
+	_, err = contentenc.ParseHeader(buf)
+	return err != nil
+}
+
+// hideBadHeader returns true if "-unexpected=hide" is active and the backing
+// entry "cName" in "dirfd" is a file with a bad header. Readdir skips such
+// entries and Lookup reports ENOENT for them.
+func (rn *RootNode) hideBadHeader(dirfd int, cName string) bool {
+	if !rn.args.HideBadHeaders {
+		return false
+	}
+	st, err := syscallcompat.Fstatat2(dirfd, cName, unix.AT_SYMLINK_NOFOLLOW)
+	if err != nil || !hasBadHeader(dirfd, cName, st) {
+		return false
+	}
+	tlog.Debug.Printf("hiding %q: not a gocryptfs file", cName)
+	return true
+}
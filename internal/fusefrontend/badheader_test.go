@@ -0,0 +1,94 @@
+package fusefrontend
+
+import (
+	"io/ioutil"
+	"path/filepath"
+	"syscall"
+	"testing"
+
+	"github.com/hanwen/go-fuse/v2/fuse"
+
+	"github.com/rfjakob/gocryptfs/tests/test_helpers"
+)
+
+// TestUnexpectedEntries puts things into CIPHERDIR that gocryptfs did not
+// write: FIFOs, an empty file and a file without a header, with encrypted and
+// with undecryptable names. Checks the listing and Lookup with
+// "-unexpected=show" and "-unexpected=hide".
+func TestUnexpectedEntries(t *testing.T) {
+	cipherdir := test_helpers.InitFS(t)
+	rn := newTestFS(Args{Cipherdir: cipherdir})
+	for _, name := range []string{"fifo", "empty", "junk", "good"} {
+		writeTestFile(t, &rn.Node, name, 100)
+	}
+	cPath := func(name string) string {
+		dirfd, cName, err := rn.openBackingDir(name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		syscall.Close(dirfd)
+		return filepath.Join(cipherdir, cName)
+	}
+	// Replace the backing files behind gocryptfs' back
+	if err := syscall.Unlink(cPath("fifo")); err != nil {
+		t.Fatal(err)
+	}
+	if err := syscall.Mkfifo(cPath("fifo"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(cPath("empty"), nil, 0600); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(cPath("junk"), []byte("plaintext that was copied in, longer than a header"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	// Names that do not decrypt
+	if err := syscall.Mkfifo(filepath.Join(cipherdir, "rawfifo"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(filepath.Join(cipherdir, "rawfile"), nil, 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	testCases := []struct {
+		args Args
+		want []string
+	}{
+		{Args{}, []string{"empty", "fifo", "good", "junk"}},
+		{Args{HideBadHeaders: true}, []string{"empty", "fifo", "good"}},
+		{Args{HideBadHeaders: true, Quarantine: true},
+			[]string{quarantinePrefix + "rawfifo", quarantinePrefix + "rawfile", "empty", "fifo", "good"}},
+	}
+	for _, tc := range testCases {
+		tc.args.Cipherdir = cipherdir
+		r := newTestFS(tc.args)
+		names := readdirNames(t, r)
+		if len(names) != len(tc.want) {
+			t.Errorf("%+v: want %v, have %v", tc.args, tc.want, names)
+			continue
+		}
+		for i := range names {
+			if names[i] != tc.want[i] {
+				t.Errorf("%+v: want %v, have %v", tc.args, tc.want, names)
+				break
+			}
+		}
+		// Everything listed can be looked up, with the right type. None of
+		// this may open the FIFOs, which would block.
+		for _, name := range names {
+			var out fuse.EntryOut
+			if _, errno := r.Lookup(nil, name, &out); errno != 0 {
+				t.Errorf("%+v: Lookup %q: %v", tc.args, name, errno)
+				continue
+			}
+			isFifo := out.Attr.Mode&syscall.S_IFMT == syscall.S_IFIFO
+			if isFifo != (name == "fifo" || name == quarantinePrefix+"rawfifo") {
+				t.Errorf("%+v: %q has mode %o", tc.args, name, out.Attr.Mode)
+			}
+		}
+		_, errno := r.Lookup(nil, "junk", &fuse.EntryOut{})
+		if tc.args.HideBadHeaders && errno != syscall.ENOENT {
+			t.Errorf("%+v: hidden file can be looked up: %v", tc.args, errno)
+		}
+	}
+}
@@ -0,0 +1,68 @@
+package fusefrontend
+
+import (
+	"bytes"
+	"syscall"
+	"testing"
+
+	"github.com/hanwen/go-fuse/v2/fuse"
+
+	"github.com/rfjakob/gocryptfs/tests/test_helpers"
+)
+
+// TestBlocks checks that st_blocks reports the allocation of the ciphertext
+// file: a sparse file uses fewer blocks than its size, a fully written one at
+// least as many.
+func TestBlocks(t *testing.T) {
+	cipherdir := test_helpers.InitFS(t)
+	rn := newTestFS(Args{Cipherdir: cipherdir})
+	for _, tc := range []struct {
+		name   string
+		sparse bool
+	}{
+		{"sparse", true},
+		{"dense", false},
+	} {
+		ch, fh, _, errno := rn.Create(nil, tc.name, syscall.O_RDWR, 0600, &fuse.EntryOut{})
+		if errno != 0 {
+			t.Fatal(errno)
+		}
+		rn.AddChild(tc.name, ch, true)
+		f := fh.(*File)
+		const size = 10 * 1024 * 1024
+		if tc.sparse {
+			// A single byte at the end leaves a 10 MiB hole
+			_, errno = f.Write(nil, []byte{1}, size-1)
+		} else {
+			buf := bytes.Repeat([]byte{1}, fuse.MAX_KERNEL_WRITE)
+			for off := 0; off < size && errno == 0; off += len(buf) {
+				_, errno = f.Write(nil, buf, int64(off))
+			}
+		}
+		if errno != 0 {
+			t.Fatal(errno)
+		}
+		// Both the fd-based and the path-based Getattr
+		var a1, a2 fuse.AttrOut
+		if errno = f.Getattr(nil, &a1); errno != 0 {
+			t.Fatal(errno)
+		}
+		f.Release(nil)
+		if errno = ch.Operations().(*Node).Getattr(nil, nil, &a2); errno != 0 {
+			t.Fatal(errno)
+		}
+		for _, a := range []fuse.Attr{a1.Attr, a2.Attr} {
+			if a.Size != size {
+				t.Fatalf("%s: wrong size %d", tc.name, a.Size)
+			}
+			// st_blocks is in units of 512 bytes
+			sizeBlocks := uint64(size / 512)
+			if tc.sparse && a.Blocks >= sizeBlocks {
+				t.Errorf("%s: %d blocks, should be less than %d", tc.name, a.Blocks, sizeBlocks)
+			}
+			if !tc.sparse && a.Blocks < sizeBlocks {
+				t.Errorf("%s: %d blocks, should be at least %d", tc.name, a.Blocks, sizeBlocks)
+			}
+		}
+	}
+}
@@ -0,0 +1,196 @@
+package fusefrontend
+
+import (
+	"bytes"
+	"fmt"
+	"math/rand"
+	"strings"
+	"sync/atomic"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/hanwen/go-fuse/v2/fs"
+	"github.com/hanwen/go-fuse/v2/fuse"
+
+	"github.com/rfjakob/gocryptfs/internal/contentenc"
+	"github.com/rfjakob/gocryptfs/internal/cryptocore"
+	"github.com/rfjakob/gocryptfs/internal/nametransform"
+	"github.com/rfjakob/gocryptfs/tests/test_helpers"
+)
+
+// benchBlockSizes are the plaintext block sizes the workload runs with. They
+// must divide fuse.MAX_KERNEL_WRITE.
+var benchBlockSizes = []uint64{1024, 4096, 16384, 65536}
+
+// newTestFSBlockSize is newTestFS with plaintext block size "bs"
+func newTestFSBlockSize(args Args, bs uint64) *RootNode {
+	key := make([]byte, cryptocore.KeyLen)
+	cCore := cryptocore.New(key, cryptocore.BackendGoGCM, contentenc.DefaultIVBits, true, false)
+	cEnc := contentenc.New(cCore, bs, false, false)
+	n := nametransform.New(cCore.EMECipher, true, true)
+	rn := NewRootNode(args, cEnc, n)
+	oneSec := time.Second
+	fs.NewNodeFS(rn, &fs.Options{EntryTimeout: &oneSec, AttrTimeout: &oneSec})
+	return rn
+}
+
+// countingIO counts the reads from the backing file
+type countingIO struct {
+	backingIO
+	reads uint64
+}
+
+func (c *countingIO) ReadAt(p []byte, off int64) (int, error) {
+	atomic.AddUint64(&c.reads, 1)
+	return c.backingIO.ReadAt(p, off)
+}
+
+// workloadResult is what one run of the block size workload measured
+type workloadResult struct {
+	blockSize uint64
+	// Throughput in MB/s of each phase
+	seqWrite, randWrite, randRead float64
+	// rmwReads counts the backing file reads done by the small writes, which
+	// are the read part of read-modify-write cycles
+	rmwReads uint64
+}
+
+// Size of the file the workload works on, and of the writes and reads
+const (
+	workloadFileSize  = 4 * 1024 * 1024
+	workloadSmallSize = 100
+	workloadReadSize  = 4096
+)
+
+// runWorkload writes a file in the new filesystem "cipherdir" sequentially in
+// large chunks, then does "ops" small writes and "ops" reads at random
+// offsets. The offsets come from a fixed seed, so every block size sees the
+// same workload. Checks the file content at the end.
+func runWorkload(tb testing.TB, cipherdir string, bs uint64, ops int) workloadResult {
+	rn := newTestFSBlockSize(Args{Cipherdir: cipherdir}, bs)
+	_, fh, _, errno := rn.Create(nil, "bench", syscall.O_RDWR, 0600, &fuse.EntryOut{})
+	if errno != 0 {
+		tb.Fatal(errno)
+	}
+	f := fh.(*File)
+	defer f.Release(nil)
+	cio := &countingIO{backingIO: f.bio}
+	f.bio = cio
+	mbps := func(bytes int, d time.Duration) float64 {
+		return float64(bytes) / 1e6 / d.Seconds()
+	}
+	res := workloadResult{blockSize: bs}
+
+	// What the file should contain
+	want := bytes.Repeat([]byte{'s'}, workloadFileSize)
+	buf := want[:fuse.MAX_KERNEL_WRITE]
+	t0 := time.Now()
+	for off := 0; off < workloadFileSize; off += len(buf) {
+		if _, errno = f.Write(nil, buf, int64(off)); errno != 0 {
+			tb.Fatal(errno)
+		}
+	}
+	res.seqWrite = mbps(workloadFileSize, time.Since(t0))
+
+	rng := rand.New(rand.NewSource(1))
+	small := bytes.Repeat([]byte{'r'}, workloadSmallSize)
+	readsBefore := atomic.LoadUint64(&cio.reads)
+	t0 = time.Now()
+	for i := 0; i < ops; i++ {
+		off := rng.Int63n(workloadFileSize - workloadSmallSize)
+		if _, errno = f.Write(nil, small, off); errno != 0 {
+			tb.Fatal(errno)
+		}
+		copy(want[off:], small)
+	}
+	res.randWrite = mbps(ops*workloadSmallSize, time.Since(t0))
+	res.rmwReads = atomic.LoadUint64(&cio.reads) - readsBefore
+
+	rbuf := make([]byte, workloadReadSize)
+	t0 = time.Now()
+	for i := 0; i < ops; i++ {
+		off := rng.Int63n(workloadFileSize - workloadReadSize)
+		if _, errno = f.Read(nil, rbuf, off); errno != 0 {
+			tb.Fatal(errno)
+		}
+	}
+	res.randRead = mbps(ops*workloadReadSize, time.Since(t0))
+
+	rbuf = make([]byte, fuse.MAX_KERNEL_WRITE)
+	for off := 0; off < workloadFileSize; off += len(rbuf) {
+		rr, errno := f.Read(nil, rbuf, int64(off))
+		if errno != 0 {
+			tb.Fatal(errno)
+		}
+		if have, _ := rr.Bytes(rbuf); !bytes.Equal(have, want[off:off+len(rbuf)]) {
+			tb.Fatalf("bs=%d: wrong content at offset %d", bs, off)
+		}
+	}
+	return res
+}
+
+// formatResults prints one table row per block size
+func formatResults(results []workloadResult) string {
+	var sb strings.Builder
+	fmt.Fprintf(&sb, "%10s %14s %15s %14s %10s\n", "blocksize", "seqwrite MB/s", "randwrite MB/s", "randread MB/s", "rmw reads")
+	for _, r := range results {
+		fmt.Fprintf(&sb, "%10d %14.1f %15.2f %14.1f %10d\n", r.blockSize, r.seqWrite, r.randWrite, r.randRead, r.rmwReads)
+	}
+	return sb.String()
+}
+
+// BenchmarkBlockSize runs the workload with each block size in
+// benchBlockSizes and prints a table at the end, to help choosing a block
+// size:
+//
+//	go test ./internal/fusefrontend -run NONE -bench BlockSize -v
+func BenchmarkBlockSize(b *testing.B) {
+	var results []workloadResult
+	for _, bs := range benchBlockSizes {
+		b.Run(fmt.Sprintf("bs%d", bs), func(b *testing.B) {
+			var sum workloadResult
+			for i := 0; i < b.N; i++ {
+				r := runWorkload(b, test_helpers.InitFS(nil), bs, 1000)
+				sum.seqWrite += r.seqWrite
+				sum.randWrite += r.randWrite
+				sum.randRead += r.randRead
+				sum.rmwReads += r.rmwReads
+			}
+			n := float64(b.N)
+			r := workloadResult{blockSize: bs, seqWrite: sum.seqWrite / n, randWrite: sum.randWrite / n,
+				randRead: sum.randRead / n, rmwReads: sum.rmwReads / uint64(b.N)}
+			b.ReportMetric(float64(r.rmwReads), "rmw/op")
+			// b.Run calls this function several times, keep the last result
+			if len(results) > 0 && results[len(results)-1].blockSize == bs {
+				results = results[:len(results)-1]
+			}
+			results = append(results, r)
+		})
+	}
+	b.Logf("\n%s", formatResults(results))
+}
+
+// TestBlockSizeWorkload runs a short version of BenchmarkBlockSize, checks
+// that the file content survives the workload with each block size, and
+// that the table has a row for each of them.
+func TestBlockSizeWorkload(t *testing.T) {
+	var results []workloadResult
+	for _, bs := range benchBlockSizes {
+		r := runWorkload(t, test_helpers.InitFS(t), bs, 50)
+		if r.seqWrite <= 0 || r.randWrite <= 0 || r.randRead <= 0 {
+			t.Errorf("bs=%d: no throughput measured: %+v", bs, r)
+		}
+		// A 100-byte write touches one or two blocks. Only writes that cover
+		// a complete block can skip the read.
+		if r.rmwReads == 0 || r.rmwReads > 2*50 {
+			t.Errorf("bs=%d: implausible %d rmw reads for 50 small writes", bs, r.rmwReads)
+		}
+		results = append(results, r)
+	}
+	table := formatResults(results)
+	t.Logf("\n%s", table)
+	if rows := strings.Count(table, "\n") - 1; rows < 3 || rows != len(benchBlockSizes) {
+		t.Errorf("want one row per block size, have %d rows", rows)
+	}
+}
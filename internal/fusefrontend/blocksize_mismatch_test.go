@@ -0,0 +1,66 @@
+package fusefrontend
+
+import (
+	"bytes"
+	"syscall"
+	"testing"
+
+	"github.com/hanwen/go-fuse/v2/fuse"
+
+	"github.com/rfjakob/gocryptfs/internal/contentenc"
+	"github.com/rfjakob/gocryptfs/internal/tlog"
+	"github.com/rfjakob/gocryptfs/tests/test_helpers"
+)
+
+// TestBlockSizeMismatch writes a file with the default block size and reads
+// it back with other block sizes, as a mismatched version would. Every read
+// must fail with EIO instead of returning corrupt data.
+func TestBlockSizeMismatch(t *testing.T) {
+	cipherdir := test_helpers.InitFS(t)
+	rn := newTestFS(Args{Cipherdir: cipherdir})
+	content := bytes.Repeat([]byte("0123456789"), (3*contentenc.DefaultBS+100)/10)
+	ch, fh, _, errno := rn.Create(nil, "file", syscall.O_RDWR, 0600, &fuse.EntryOut{})
+	if errno != 0 {
+		t.Fatal(errno)
+	}
+	rn.AddChild("file", ch, true)
+	if _, errno = fh.(*File).Write(nil, content, 0); errno != 0 {
+		t.Fatal(errno)
+	}
+	fh.(*File).Release(nil)
+
+	// The decryption failures are expected
+	tlog.Warn.Enabled = false
+	defer func() { tlog.Warn.Enabled = true }()
+
+	for _, bs := range []uint64{contentenc.DefaultBS, 1024, 16384} {
+		rn := newTestFSBlockSize(Args{Cipherdir: cipherdir}, bs)
+		ch, errno := rn.Lookup(nil, "file", &fuse.EntryOut{})
+		if errno != 0 {
+			t.Fatal(errno)
+		}
+		rn.AddChild("file", ch, true)
+		fh, _, errno := toNode(ch.Operations()).Open(nil, syscall.O_RDONLY)
+		if errno != 0 {
+			t.Fatal(errno)
+		}
+		f := fh.(*File)
+		buf := make([]byte, len(content))
+		for _, off := range []int{0, 100, 5000, 9000} {
+			res, errno := f.Read(nil, buf[:len(content)-off], int64(off))
+			if bs != contentenc.DefaultBS {
+				if errno != syscall.EIO {
+					t.Errorf("bs=%d off=%d: want EIO, have %v", bs, off, errno)
+				}
+				continue
+			}
+			if errno != 0 {
+				t.Fatalf("bs=%d off=%d: %v", bs, off, errno)
+			}
+			if have, _ := res.Bytes(buf); !bytes.Equal(have, content[off:]) {
+				t.Errorf("bs=%d off=%d: wrong content", bs, off)
+			}
+		}
+		f.Release(nil)
+	}
+}
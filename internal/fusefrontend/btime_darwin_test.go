@@ -0,0 +1,61 @@
+package fusefrontend
+
+import (
+	"path/filepath"
+	"syscall"
+	"testing"
+
+	"github.com/hanwen/go-fuse/v2/fuse"
+
+	"github.com/rfjakob/gocryptfs/tests/test_helpers"
+)
+
+// TestBtime checks that Getattr reports the birth time of the backing file,
+// and that Setattr can change it. Linux has no birth time in FUSE, so this
+// test only exists on MacOS.
+func TestBtime(t *testing.T) {
+	cipherdir := test_helpers.InitFS(t)
+	rn := newTestFS(Args{Cipherdir: cipherdir})
+	ch, fh, _, errno := rn.Create(nil, "foo", syscall.O_RDWR, 0600, &fuse.EntryOut{})
+	if errno != 0 {
+		t.Fatal(errno)
+	}
+	rn.AddChild("foo", ch, true)
+	fh.(*File).Release(nil)
+	n := ch.Operations().(*Node)
+
+	backing := func() syscall.Timespec {
+		dirfd, cName, err := rn.openBackingDir("foo")
+		if err != nil {
+			t.Fatal(err)
+		}
+		syscall.Close(dirfd)
+		var st syscall.Stat_t
+		if err = syscall.Lstat(filepath.Join(cipherdir, cName), &st); err != nil {
+			t.Fatal(err)
+		}
+		return st.Birthtimespec
+	}
+	check := func() {
+		var out fuse.AttrOut
+		if errno := n.Getattr(nil, nil, &out); errno != 0 {
+			t.Fatal(errno)
+		}
+		want := backing()
+		if out.Crtime_ != uint64(want.Sec) || out.Crtimensec_ != uint32(want.Nsec) {
+			t.Errorf("btime: have %d.%09d, want %d.%09d", out.Crtime_, out.Crtimensec_, want.Sec, want.Nsec)
+		}
+	}
+	check()
+	// Set it to 2001-09-09
+	in := fuse.SetAttrIn{}
+	in.Valid = fuse.FATTR_CRTIME
+	in.Crtime = 1000000000
+	if errno := n.Setattr(nil, nil, &in, &fuse.AttrOut{}); errno != 0 {
+		t.Fatal(errno)
+	}
+	if have := backing(); have.Sec != 1000000000 {
+		t.Errorf("Setattr did not change the btime: %d", have.Sec)
+	}
+	check()
+}
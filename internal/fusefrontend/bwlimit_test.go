@@ -0,0 +1,60 @@
+package fusefrontend
+
+import (
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/hanwen/go-fuse/v2/fuse"
+
+	"github.com/rfjakob/gocryptfs/tests/test_helpers"
+)
+
+// TestBandwidthLimit checks that reading through a RootNode with
+// BandwidthLimit set takes as long as the rate dictates.
+func TestBandwidthLimit(t *testing.T) {
+	const rate = 4 * 1024 * 1024
+	cipherdir := test_helpers.InitFS(t)
+	args := Args{
+		Cipherdir:      cipherdir,
+		BandwidthLimit: rate,
+	}
+	fs := newTestFS(args)
+
+	_, fh, _, errno := fs.Create(nil, "foo", syscall.O_RDWR, 0600, &fuse.EntryOut{})
+	if errno != 0 {
+		t.Fatal(errno)
+	}
+	f := fh.(*File)
+	defer f.Release(nil)
+
+	buf := make([]byte, fuse.MAX_KERNEL_WRITE)
+	// Writing one second's worth uses up the initial burst
+	for off := 0; off < rate; off += len(buf) {
+		if _, errno := f.Write(nil, buf, int64(off)); errno != 0 {
+			t.Fatal(errno)
+		}
+	}
+	// Reading two seconds' worth should now take about two seconds
+	t0 := time.Now()
+	for i := 0; i < 2*rate/len(buf); i++ {
+		off := int64(i*len(buf)) % rate
+		if _, errno := f.Read(nil, buf, off); errno != 0 {
+			t.Fatal(errno)
+		}
+	}
+	d := time.Since(t0)
+	if d < 1800*time.Millisecond || d > 4*time.Second {
+		t.Errorf("expected about 2s, took %v", d)
+	}
+	// Reads at EOF return no data and must not be charged
+	t0 = time.Now()
+	for i := 0; i < 2*rate/len(buf); i++ {
+		if _, errno := f.Read(nil, buf, rate); errno != 0 {
+			t.Fatal(errno)
+		}
+	}
+	if d = time.Since(t0); d > 500*time.Millisecond {
+		t.Errorf("reads at EOF were throttled, took %v", d)
+	}
+}
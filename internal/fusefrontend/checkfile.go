@@ -0,0 +1,90 @@
+package fusefrontend
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"os"
+	"syscall"
+
+	"github.com/rfjakob/gocryptfs/internal/contentenc"
+	"github.com/rfjakob/gocryptfs/internal/syscallcompat"
+)
+
+// CheckFileStats are the results of CheckFile
+type CheckFileStats struct {
+	// Blocks is the number of blocks that were read and decrypted fine.
+	// Holes count as well.
+	Blocks uint64
+	// BadBlock is the number of the first block that did not decrypt, or -1
+	// if there was none
+	BadBlock int64
+}
+
+// CheckFile decrypts every block of the file at "plainPath", which is
+// relative to the root of the mount, and stops at the first block that fails
+// authentication. Nothing is written. Blocks are read one at a time, so the
+// memory use does not depend on the file size.
+//
+// Returns an error if the file cannot be opened or read, has a corrupt
+// header, or has a corrupt block, which is stored in stats.BadBlock.
+//
+// Symlink-safe through openBackingDir().
+func (rn *RootNode) CheckFile(plainPath string) (stats CheckFileStats, err error) {
+	stats.BadBlock = -1
+	dirfd, cName, err := rn.openBackingDir(plainPath)
+	if err != nil {
+		return stats, err
+	}
+	fd, err := syscallcompat.Openat(dirfd, cName, syscall.O_RDONLY|syscall.O_NOFOLLOW, 0)
+	syscall.Close(dirfd)
+	if err != nil {
+		return stats, err
+	}
+	f := os.NewFile(uintptr(fd), cName)
+	defer f.Close()
+	fi, err := f.Stat()
+	if err != nil {
+		return stats, err
+	}
+	if !fi.Mode().IsRegular() {
+		return stats, fmt.Errorf("not a regular file")
+	}
+	if fi.Size() == 0 {
+		// Empty files have no header
+		return stats, nil
+	}
+	buf := make([]byte, rn.contentEnc.HeaderLen())
+	if _, err = io.ReadFull(f, buf); err != nil {
+		return stats, fmt.Errorf("reading header: %v", err)
+	}
+	header, err := contentenc.ParseHeader(buf[:contentenc.HeaderLen])
+	if err != nil {
+		return stats, err
+	}
+	if rn.args.FileTags {
+		if _, err = rn.contentEnc.DecryptTags(buf[contentenc.HeaderLen:], header.ID); err != nil {
+			return stats, fmt.Errorf("tags region: %v", err)
+		}
+	}
+	cipherBS := int(rn.contentEnc.CipherBS())
+	block := make([]byte, cipherBS)
+	zero := make([]byte, cipherBS)
+	for blockNo := uint64(0); ; blockNo++ {
+		off := int64(rn.contentEnc.BlockNoToCipherOff(blockNo))
+		n, err := f.ReadAt(block, off)
+		if n == 0 && err == io.EOF {
+			return stats, nil
+		} else if err != nil && err != io.EOF {
+			return stats, err
+		}
+		// Holes, see rewriteFile
+		if !bytes.Equal(block[:n], zero[:n]) {
+			if _, err = rn.contentEnc.DecryptBlock(block[:n], blockNo, header.ID); err != nil {
+				stats.BadBlock = int64(blockNo)
+				return stats, fmt.Errorf("block %d: %v", blockNo, err)
+			}
+		}
+		stats.Blocks++
+	}
+}
@@ -0,0 +1,65 @@
+package fusefrontend
+
+import (
+	"os"
+	"path/filepath"
+	"syscall"
+	"testing"
+
+	"github.com/rfjakob/gocryptfs/internal/contentenc"
+	"github.com/rfjakob/gocryptfs/tests/test_helpers"
+)
+
+// TestCheckFile checks a good file, then flips a byte in one block and checks
+// that CheckFile reports exactly that block
+func TestCheckFile(t *testing.T) {
+	cipherdir := test_helpers.InitFS(t)
+	rn := newTestFS(Args{Cipherdir: cipherdir})
+	const blocks = 10
+	bs := int(rn.contentEnc.PlainBS())
+	writeTestFile(t, &rn.Node, "f", blocks*bs-100)
+	writeTestFile(t, &rn.Node, "empty", 0)
+
+	stats, err := rn.CheckFile("f")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if stats.Blocks != blocks || stats.BadBlock != -1 {
+		t.Errorf("good file: want %d blocks and no bad block, have %+v", blocks, stats)
+	}
+	if stats, err = rn.CheckFile("empty"); err != nil || stats.Blocks != 0 {
+		t.Errorf("empty file: %+v, %v", stats, err)
+	}
+	if _, err = rn.CheckFile("missing"); err == nil {
+		t.Errorf("missing file: want an error")
+	}
+
+	dirfd, cName, err := rn.openBackingDir("f")
+	if err != nil {
+		t.Fatal(err)
+	}
+	syscall.Close(dirfd)
+	cf, err := os.OpenFile(filepath.Join(cipherdir, cName), os.O_RDWR, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	const bad = 6
+	off := contentenc.HeaderLen + bad*int64(rn.contentEnc.CipherBS()) + 100
+	b := make([]byte, 1)
+	if _, err = cf.ReadAt(b, off); err != nil {
+		t.Fatal(err)
+	}
+	b[0] ^= 0xff
+	if _, err = cf.WriteAt(b, off); err != nil {
+		t.Fatal(err)
+	}
+	cf.Close()
+
+	stats, err = rn.CheckFile("f")
+	if err == nil {
+		t.Fatal("tampered file: want an error")
+	}
+	if stats.BadBlock != bad || stats.Blocks != bad {
+		t.Errorf("tampered file: want bad block %d after %d good ones, have %+v", bad, bad, stats)
+	}
+}
@@ -0,0 +1,71 @@
+package fusefrontend
+
+import (
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/rfjakob/gocryptfs/internal/tlog"
+)
+
+// clockSkew is the state of "-warn_clock_skew". It remembers, per directory,
+// the newest mtime a file written through the mount has been closed with.
+//
+// A file that is opened after that cannot legitimately end up with an older
+// mtime: all its writes happen later. If it does, the clock has moved
+// backward in between, which confuses sync tools like rsync that compare
+// mtimes. Comparing against the newest mtime at open time, not at close time,
+// keeps files that are written concurrently from triggering the warning.
+type clockSkew struct {
+	sync.Mutex
+	// newest mtime by plaintext directory path
+	newest map[string]time.Time
+}
+
+// opened returns the newest mtime seen in "dir", for the File that is about
+// to be opened there. Zero if nothing has been written there yet.
+func (c *clockSkew) opened(dir string) time.Time {
+	c.Lock()
+	defer c.Unlock()
+	return c.newest[dir]
+}
+
+// closed records that "path" has been written and closed with "mtime", and
+// warns if "mtime" is older than "floor", the value opened() returned. After
+// a warning, the new mtime becomes the newest, so that a clock that jumped
+// back is reported once and not for every following file.
+func (c *clockSkew) closed(path string, floor time.Time, mtime time.Time) {
+	dir := filepath.Dir(path)
+	if mtime.Before(floor) {
+		tlog.Warn.Printf("Clock skew? %q was written with mtime %s, which is %s earlier than the newest mtime in its directory",
+			path, mtime.Format(time.RFC3339Nano), floor.Sub(mtime))
+	}
+	c.Lock()
+	defer c.Unlock()
+	if mtime.Before(floor) || mtime.After(c.newest[dir]) {
+		c.newest[dir] = mtime
+	}
+}
+
+// openClockSkew sets up "-warn_clock_skew" for "f", opened at "path"
+func (f *File) openClockSkew(path string) {
+	c := f.rootNode.clockSkew
+	if c == nil {
+		return
+	}
+	f.skewPath = path
+	f.skewFloor = c.opened(filepath.Dir(path))
+}
+
+// checkClockSkew runs the "-warn_clock_skew" check if the file has been
+// written through "f". Called on Release.
+func (f *File) checkClockSkew() {
+	if f.rootNode.clockSkew == nil || !f.skewWritten {
+		return
+	}
+	ts := backingTimes(f.intFd())
+	if ts == nil {
+		return
+	}
+	f.rootNode.clockSkew.closed(f.skewPath, f.skewFloor, time.Unix(ts[1].Unix()))
+}
@@ -0,0 +1,81 @@
+package fusefrontend
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"strings"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/rfjakob/gocryptfs/internal/tlog"
+	"github.com/rfjakob/gocryptfs/tests/test_helpers"
+)
+
+// writeAndClose writes to "name" in "d" and closes it. Before closing, the
+// mtime of the backing file is moved by "shift", which looks the same to us
+// as a clock that was off by "shift" during the write.
+func writeAndClose(t *testing.T, rn *RootNode, d *Node, name string, shift time.Duration) {
+	createFile(t, d, name, nil)
+	n := lookupChild(t, d, name)
+	fh, _, errno := n.Open(nil, syscall.O_WRONLY)
+	if errno != 0 {
+		t.Fatal(errno)
+	}
+	f := fh.(*File)
+	if _, errno = f.Write(nil, []byte("x"), 0); errno != 0 {
+		t.Fatal(errno)
+	}
+	if shift != 0 {
+		mtime := time.Now().Add(shift)
+		cPath, err := rn.EncryptPath(filepath.Join(d.Path(), name))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err = os.Chtimes(filepath.Join(rn.args.Cipherdir, cPath), mtime, mtime); err != nil {
+			t.Fatal(err)
+		}
+	}
+	f.Release(nil)
+}
+
+// TestWarnClockSkew writes a file while the clock is an hour ahead, then one
+// after the clock has been set back, and checks that the second write is
+// reported, once, and only in the directory where it happened.
+func TestWarnClockSkew(t *testing.T) {
+	var logBuf bytes.Buffer
+	tlog.Warn.Logger.SetOutput(&logBuf)
+	defer tlog.Warn.Logger.SetOutput(os.Stderr)
+
+	for _, enabled := range []bool{false, true} {
+		logBuf.Reset()
+		rn := newTestFS(Args{Cipherdir: test_helpers.InitFS(t), WarnClockSkew: enabled})
+		d := mkdirTestDir(t, &rn.Node, "d")
+		other := mkdirTestDir(t, &rn.Node, "other")
+
+		writeAndClose(t, rn, d, "ahead", time.Hour)
+		if logBuf.Len() != 0 {
+			t.Fatalf("unexpected warning: %s", logBuf.String())
+		}
+		// Other directories are not affected
+		writeAndClose(t, rn, other, "a", 0)
+		if logBuf.Len() != 0 {
+			t.Errorf("warning for another directory: %s", logBuf.String())
+		}
+		writeAndClose(t, rn, d, "behind", 0)
+		warned := strings.Contains(logBuf.String(), "Clock skew")
+		if warned != enabled {
+			t.Errorf("enabled=%v: warned=%v, log: %q", enabled, warned, logBuf.String())
+		}
+		if enabled && !strings.Contains(logBuf.String(), `"d/behind"`) {
+			t.Errorf("warning does not name the file: %q", logBuf.String())
+		}
+		// The jump is reported once, not for every following file
+		logBuf.Reset()
+		writeAndClose(t, rn, d, "next", 0)
+		if logBuf.Len() != 0 {
+			t.Errorf("second warning for the same jump: %s", logBuf.String())
+		}
+	}
+}
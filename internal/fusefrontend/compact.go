@@ -0,0 +1,54 @@
+package fusefrontend
+
+import (
+	"github.com/rfjakob/gocryptfs/internal/tlog"
+)
+
+// compactTmpSuffix is appended to the ciphertext file name to get the name of
+// the compacted copy. Encrypted names never contain a dot.
+const compactTmpSuffix = ".compact.tmp"
+
+// CompactStats are the counts returned by CompactFiles
+type CompactStats struct {
+	// Compacted files were rewritten
+	Compacted int
+	// Skipped files were left alone: empty files and files with several
+	// hard links
+	Skipped int
+	// Failed files could not be read or did not decrypt and were left alone
+	Failed int
+}
+
+// CompactFiles rewrites every file in CIPHERDIR into a fresh copy, so that
+// the backing filesystem can store its blocks contiguously again after many
+// overwrites and hole punches. The ciphertext, the file holes and the
+// plaintext size stay the same. The filesystem must not be mounted.
+//
+// Like RotateFileIDs, each file is copied to a temporary file that is renamed
+// over the original, so an interruption leaves every file either completely
+// old or completely new. There is nothing to resume, running it again simply
+// compacts everything again.
+//
+// "skip" is left alone, it is meant for the state file of an interrupted
+// RotateFileIDs run. "progress" is called after each file, it may be nil.
+func (rn *RootNode) CompactFiles(skip string, progress func(done, total int)) (stats CompactStats, err error) {
+	var paths []string
+	paths, stats.Failed, err = rn.contentFiles("compact", skip)
+	if err != nil {
+		return stats, err
+	}
+	for i, rel := range paths {
+		if done, err := rn.rewriteFile(rel, compactTmpSuffix, false); err != nil {
+			tlog.Warn.Printf("compact: %s: %v", rel, err)
+			stats.Failed++
+		} else if !done {
+			stats.Skipped++
+		} else {
+			stats.Compacted++
+		}
+		if progress != nil {
+			progress(i+1, len(paths))
+		}
+	}
+	return stats, nil
+}
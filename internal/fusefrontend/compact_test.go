@@ -0,0 +1,123 @@
+package fusefrontend
+
+import (
+	"bytes"
+	"io/ioutil"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"syscall"
+	"testing"
+
+	"github.com/rfjakob/gocryptfs/internal/contentenc"
+	"github.com/rfjakob/gocryptfs/tests/test_helpers"
+)
+
+// TestCompactFiles punches holes into a file by overwriting some of its blocks
+// with zeros, compacts the filesystem, and checks that every file was
+// rewritten with the same ciphertext and content, and that the holes are
+// still holes. A corrupt file must be left alone.
+func TestCompactFiles(t *testing.T) {
+	cipherdir := test_helpers.InitFS(t)
+	rn := newTestFS(Args{Cipherdir: cipherdir, Sparse: true})
+	bs := contentenc.DefaultBS
+	holes := make([]byte, 10*bs+123)
+	rand.Read(holes)
+	content := map[string][]byte{
+		"holes": holes,
+		"small": []byte("hello world"),
+		"bad":   []byte("corrupt me"),
+		"empty": nil,
+	}
+	for name, data := range content {
+		writeRotateFile(t, rn, name, data, 0)
+	}
+	// With "-sparse", all-zero blocks become file holes
+	f, _, errno := lookupNode(t, rn, "holes").Open(nil, syscall.O_RDWR)
+	if errno != 0 {
+		t.Fatal(errno)
+	}
+	for _, blockNo := range []int{2, 3, 7} {
+		zero := make([]byte, bs)
+		if _, errno = f.(*File).Write(nil, zero, int64(blockNo*bs)); errno != 0 {
+			t.Fatal(errno)
+		}
+		copy(holes[blockNo*bs:], zero)
+	}
+	f.(*File).Release(nil)
+
+	cPath := func(name string) string {
+		dirfd, cName, err := rn.openBackingDir(name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		syscall.Close(dirfd)
+		return filepath.Join(cipherdir, cName)
+	}
+	stat := func(name string) *syscall.Stat_t {
+		var st syscall.Stat_t
+		if err := syscall.Stat(cPath(name), &st); err != nil {
+			t.Fatal(err)
+		}
+		return &st
+	}
+	ciphertext := make(map[string][]byte)
+	inodes := make(map[string]uint64)
+	for name := range content {
+		ciphertext[name], _ = ioutil.ReadFile(cPath(name))
+		inodes[name] = stat(name).Ino
+	}
+	holesBlocks := stat("holes").Blocks
+	bad := cPath("bad")
+	badContent := ciphertext["bad"]
+	badContent[len(badContent)-1] ^= 1
+	ioutil.WriteFile(bad, badContent, 0600)
+	// Left over by an interrupted run
+	leftover := cPath("small") + compactTmpSuffix
+	ioutil.WriteFile(leftover, []byte("garbage"), 0600)
+
+	var calls int
+	stats, err := rn.CompactFiles("", func(done, total int) { calls++ })
+	if err != nil {
+		t.Fatal(err)
+	}
+	if stats != (CompactStats{Compacted: 2, Skipped: 1, Failed: 1}) || calls != 4 {
+		t.Fatalf("wrong stats %+v, %d progress calls", stats, calls)
+	}
+	for _, name := range []string{"holes", "small"} {
+		if stat(name).Ino == inodes[name] {
+			t.Errorf("%s: was not rewritten", name)
+		}
+		if have, _ := ioutil.ReadFile(cPath(name)); !bytes.Equal(have, ciphertext[name]) {
+			t.Errorf("%s: ciphertext changed", name)
+		}
+	}
+	if stat("bad").Ino != inodes["bad"] {
+		t.Error("corrupt file was rewritten")
+	}
+	if blocks := stat("holes").Blocks; blocks > holesBlocks {
+		t.Errorf("holes were filled: %d blocks before, %d after", holesBlocks, blocks)
+	}
+	if _, err := os.Stat(leftover); !os.IsNotExist(err) {
+		t.Errorf("temporary file was not removed: %v", err)
+	}
+
+	// A fresh RootNode, nothing is cached
+	rn2 := newTestFS(Args{Cipherdir: cipherdir})
+	for _, name := range []string{"holes", "small", "empty"} {
+		want := content[name]
+		fh, _, errno := lookupNode(t, rn2, name).Open(nil, syscall.O_RDONLY)
+		if errno != 0 {
+			t.Fatal(errno)
+		}
+		buf := make([]byte, len(want)+100)
+		res, errno := fh.(*File).Read(nil, buf, 0)
+		if errno != 0 {
+			t.Fatalf("%s: %v", name, errno)
+		}
+		if have, _ := res.Bytes(buf); !bytes.Equal(have, want) {
+			t.Errorf("%s: content differs after compacting", name)
+		}
+		fh.(*File).Release(nil)
+	}
+}
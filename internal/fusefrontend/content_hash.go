@@ -0,0 +1,159 @@
+package fusefrontend
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"io"
+	"os"
+	"sync"
+	"syscall"
+
+	"github.com/hanwen/go-fuse/v2/fs"
+
+	"github.com/rfjakob/gocryptfs/internal/contentenc"
+	"github.com/rfjakob/gocryptfs/internal/inomap"
+	"github.com/rfjakob/gocryptfs/internal/openfiletable"
+	"github.com/rfjakob/gocryptfs/internal/syscallcompat"
+	"github.com/rfjakob/gocryptfs/internal/tlog"
+)
+
+// contentHashXattr is the read-only virtual xattr that "-contenthash"
+// provides. Its value is the hex SHA256 of the plaintext content.
+const contentHashXattr = "user.gocryptfs.contenthash"
+
+// contentHashCacheSize limits the number of cached hashes
+const contentHashCacheSize = 10000
+
+// contentHashEntry is a cached hash and the backing file stamp it is valid
+// for
+type contentHashEntry struct {
+	stamp backingStamp
+	sum   string
+}
+
+// contentHashCache is the state of "-contenthash". Hashes only live in
+// memory: an xattr on the backing file would be out of date as soon as the
+// ciphertext was changed behind our back with the mtime restored.
+type contentHashCache struct {
+	sync.Mutex
+	entries map[inomap.QIno]contentHashEntry
+}
+
+func (c *contentHashCache) get(qi inomap.QIno, stamp backingStamp) (string, bool) {
+	c.Lock()
+	defer c.Unlock()
+	e, ok := c.entries[qi]
+	if !ok || e.stamp != stamp {
+		return "", false
+	}
+	return e.sum, true
+}
+
+func (c *contentHashCache) put(qi inomap.QIno, stamp backingStamp, sum string) {
+	c.Lock()
+	defer c.Unlock()
+	if _, ok := c.entries[qi]; !ok && len(c.entries) >= contentHashCacheSize {
+		// Drop an arbitrary entry
+		for k := range c.entries {
+			delete(c.entries, k)
+			break
+		}
+	}
+	c.entries[qi] = contentHashEntry{stamp: stamp, sum: sum}
+}
+
+// contentHash returns the hex SHA256 of the plaintext content of "n". The
+// result is cached until the size, mtime or ctime of the backing file
+// changes. Writes that are still held back by "-writebuffer" are flushed
+// first, so the hash always matches what a read would return.
+//
+// Symlink-safe through Openat() with O_NOFOLLOW.
+func (n *Node) contentHash(ctx context.Context) (string, syscall.Errno) {
+	rn := n.rootNode()
+	dirfd, cName, errno := n.prepareAtSyscall(ctx, "")
+	if errno != 0 {
+		return "", errno
+	}
+	fd, err := syscallcompat.Openat(dirfd, cName, syscall.O_RDONLY|syscall.O_NOFOLLOW, 0)
+	syscall.Close(dirfd)
+	if err == syscall.ELOOP {
+		// A symlink has no content
+		return "", syscall.ENODATA
+	} else if err != nil {
+		return "", fs.ToErrno(err)
+	}
+	f := os.NewFile(uintptr(fd), cName)
+	defer f.Close()
+	var st syscall.Stat_t
+	if err = syscall.Fstat(fd, &st); err != nil {
+		return "", fs.ToErrno(err)
+	}
+	if st.Mode&syscall.S_IFMT != syscall.S_IFREG {
+		return "", syscall.ENODATA
+	}
+	qi := inomap.QInoFromStat(&st)
+	if e := openfiletable.Lookup(qi); e != nil {
+		e.ContentLock.Lock()
+		errno = e.FlushPendingWrite()
+		e.ContentLock.Unlock()
+		if errno != 0 {
+			return "", errno
+		}
+		// Keep writers out while we read
+		e.ContentLock.RLock()
+		defer e.ContentLock.RUnlock()
+		if err = syscall.Fstat(fd, &st); err != nil {
+			return "", fs.ToErrno(err)
+		}
+	}
+	stamp := newBackingStamp(&st)
+	if sum, ok := rn.contentHashCache.get(qi, stamp); ok {
+		return sum, 0
+	}
+	sum, err := rn.hashPlaintext(f, st.Size)
+	if err != nil {
+		tlog.Warn.Printf("contentHash %q: %v", cName, err)
+		return "", syscall.EIO
+	}
+	// Only cache the result if nobody changed the file while we read it
+	var st2 syscall.Stat_t
+	if err = syscall.Fstat(fd, &st2); err == nil && newBackingStamp(&st2) == stamp {
+		rn.contentHashCache.put(qi, stamp, sum)
+	}
+	return sum, 0
+}
+
+// hashPlaintext decrypts the backing file "f" of size "size" block by block
+// and returns the hex SHA256 of the plaintext.
+func (rn *RootNode) hashPlaintext(f *os.File, size int64) (string, error) {
+	h := sha256.New()
+	if size == 0 {
+		// Empty files have no header
+		return hex.EncodeToString(h.Sum(nil)), nil
+	}
+	buf := make([]byte, contentenc.HeaderLen)
+	if _, err := f.ReadAt(buf, 0); err != nil {
+		return "", err
+	}
+	header, err := contentenc.ParseHeader(buf)
+	if err != nil {
+		return "", err
+	}
+	block := make([]byte, rn.contentEnc.CipherBS())
+	for blockNo := uint64(0); ; blockNo++ {
+		off := int64(rn.contentEnc.BlockNoToCipherOff(blockNo))
+		n, err := f.ReadAt(block, off)
+		if n == 0 && err == io.EOF {
+			return hex.EncodeToString(h.Sum(nil)), nil
+		} else if err != nil && err != io.EOF {
+			return "", err
+		}
+		// DecryptBlock turns holes into zeros
+		plain, err := rn.contentEnc.DecryptBlock(block[:n], blockNo, header.ID)
+		if err != nil {
+			return "", err
+		}
+		h.Write(plain)
+	}
+}
@@ -0,0 +1,94 @@
+package fusefrontend
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"syscall"
+	"testing"
+
+	"github.com/rfjakob/gocryptfs/tests/test_helpers"
+)
+
+// getContentHash reads the "-contenthash" xattr of "n"
+func getContentHash(t *testing.T, n *Node) string {
+	buf := make([]byte, 100)
+	sz, errno := n.Getxattr(nil, contentHashXattr, buf)
+	if errno != 0 {
+		t.Fatal(errno)
+	}
+	return string(buf[:sz])
+}
+
+func sha256hex(data []byte) string {
+	sum := sha256.Sum256(data)
+	return hex.EncodeToString(sum[:])
+}
+
+// TestContentHash checks that the virtual xattr matches the SHA256 of the
+// plaintext, also after writes that are still sitting in the write buffer,
+// and that it cannot be changed.
+func TestContentHash(t *testing.T) {
+	for _, writeBuffer := range []bool{false, true} {
+		rn := newTestFS(Args{Cipherdir: test_helpers.InitFS(t), ContentHash: true, WriteBuffer: writeBuffer})
+		content := bytes.Repeat([]byte("0123456789"), 1000)
+		createFile(t, &rn.Node, "f", content)
+		n, f := openTestFile(t, rn, "f", syscall.O_RDWR)
+		if h := getContentHash(t, n); h != sha256hex(content) {
+			t.Fatalf("writebuffer=%v: have %s, want %s", writeBuffer, h, sha256hex(content))
+		}
+		// Overwrite the middle and append, leaving a hole
+		patch := bytes.Repeat([]byte{0xaa}, 100)
+		if _, errno := f.Write(nil, patch, 5000); errno != 0 {
+			t.Fatal(errno)
+		}
+		if _, errno := f.Write(nil, patch, 20000); errno != 0 {
+			t.Fatal(errno)
+		}
+		// Sequential, so "-writebuffer" holds it back
+		if _, errno := f.Write(nil, patch, 20100); errno != 0 {
+			t.Fatal(errno)
+		}
+		copy(content[5000:], patch)
+		content = append(content, make([]byte, 20000-len(content))...)
+		content = append(content, patch...)
+		content = append(content, patch...)
+		if h := getContentHash(t, n); h != sha256hex(content) {
+			t.Errorf("writebuffer=%v: stale hash after write: have %s, want %s", writeBuffer, h, sha256hex(content))
+		}
+		f.Release(nil)
+
+		// Read-only
+		if errno := n.Setxattr(nil, contentHashXattr, []byte("x"), 0); errno != syscall.EPERM {
+			t.Errorf("Setxattr: want EPERM, got %v", errno)
+		}
+		if errno := n.Removexattr(nil, contentHashXattr); errno != syscall.EPERM {
+			t.Errorf("Removexattr: want EPERM, got %v", errno)
+		}
+		if h := getContentHash(t, n); h != sha256hex(content) {
+			t.Errorf("hash changed by Setxattr: %s", h)
+		}
+	}
+
+	// Empty files and directories
+	rn := newTestFS(Args{Cipherdir: test_helpers.InitFS(t), ContentHash: true})
+	createFile(t, &rn.Node, "empty", nil)
+	if h := getContentHash(t, lookupChild(t, &rn.Node, "empty")); h != sha256hex(nil) {
+		t.Errorf("empty file: %s", h)
+	}
+	d := mkdirTestDir(t, &rn.Node, "d")
+	if _, errno := d.Getxattr(nil, contentHashXattr, make([]byte, 100)); errno != syscall.ENODATA {
+		t.Errorf("directory: want ENODATA, got %v", errno)
+	}
+
+	// Without the option, it is just another xattr
+	rn = newTestFS(Args{Cipherdir: test_helpers.InitFS(t)})
+	writeTestFile(t, &rn.Node, "f", 100)
+	n := lookupChild(t, &rn.Node, "f")
+	if errno := n.Setxattr(nil, contentHashXattr, []byte("x"), 0); errno != 0 {
+		t.Fatal(errno)
+	}
+	if h := getContentHash(t, n); h != "x" {
+		t.Errorf("have %q, want %q", h, "x")
+	}
+}
@@ -6,22 +6,38 @@ import (
 	"path/filepath"
 	"strings"
 	"syscall"
+	"time"
+
+	"golang.org/x/sys/unix"
 
 	"github.com/rfjakob/gocryptfs/internal/ctlsocksrv"
 	"github.com/rfjakob/gocryptfs/internal/nametransform"
+	"github.com/rfjakob/gocryptfs/internal/openfiletable"
+	"github.com/rfjakob/gocryptfs/internal/snapshot"
 	"github.com/rfjakob/gocryptfs/internal/syscallcompat"
 	"github.com/rfjakob/gocryptfs/internal/tlog"
 )
 
-var _ ctlsocksrv.Interface = &RootNode{} // Verify that interface is implemented.
+var _ ctlsocksrv.Interface = &RootNode{}   // Verify that interface is implemented.
+var _ ctlsocksrv.Snapshotter = &RootNode{} // Verify that interface is implemented.
 
 // EncryptPath implements ctlsock.Backend
 //
+// "plainPath" is relative to the root of the mount, the returned ciphertext
+// path is relative to CIPHERDIR. With "-prefix", it starts with the
+// encrypted prefix. Absolute paths are taken relative to the root of the
+// mount as well, see ctlsocksrv.CleanPath.
+//
 // Symlink-safe through openBackingDir().
 func (rn *RootNode) EncryptPath(plainPath string) (string, error) {
-	if plainPath == "" {
+	plainPath, err := ctlsocksrv.CleanPath(plainPath)
+	if err != nil {
+		return "", err
+	}
+	plainPath = filepath.Join(rn.args.Prefix, plainPath)
+	if plainPath == "" || plainPath == "." {
 		// Empty string gets encrypted as empty string
-		return plainPath, nil
+		return "", nil
 	}
 	if rn.args.PlaintextNames {
 		return plainPath, nil
@@ -33,11 +49,14 @@ func (rn *RootNode) EncryptPath(plainPath string) (string, error) {
 	cPath := ""
 	for _, part := range parts {
 		wd = filepath.Join(wd, part)
-		dirfd, cName, err := rn.openBackingDir(wd)
+		dirfd, cName, err := rn.openBackingDirUnprefixed(wd)
 		if err != nil {
 			return "", err
 		}
 		syscall.Close(dirfd)
+		if rn.args.Fanout {
+			cPath = filepath.Join(cPath, fanoutBucketPath(cName))
+		}
 		cPath = filepath.Join(cPath, cName)
 	}
 	tlog.Debug.Printf("encryptPath '%s' -> '%s'", plainPath, cPath)
@@ -46,18 +65,60 @@ func (rn *RootNode) EncryptPath(plainPath string) (string, error) {
 
 // DecryptPath implements ctlsock.Backend
 //
+// "cipherPath" is relative to CIPHERDIR, the returned plaintext path is
+// relative to the root of the mount. With "-prefix", paths outside of the
+// prefix cannot be decrypted. Absolute paths are taken relative to
+// CIPHERDIR, see ctlsocksrv.CleanPath.
+//
 // DecryptPath is symlink-safe because openBackingDir() and decryptPathAt()
 // are symlink-safe.
 func (rn *RootNode) DecryptPath(cipherPath string) (plainPath string, err error) {
-	dirfd, _, err := rn.openBackingDir("")
+	if cipherPath, err = ctlsocksrv.CleanPath(cipherPath); err != nil {
+		return "", err
+	}
+	dirfd, _, err := rn.openBackingDirUnprefixed("")
 	if err != nil {
 		return "", err
 	}
 	defer syscall.Close(dirfd)
-	return rn.decryptPathAt(dirfd, cipherPath)
+	plainPath, err = rn.decryptPathAt(dirfd, cipherPath)
+	if err != nil || rn.args.Prefix == "" {
+		return plainPath, err
+	}
+	if plainPath == rn.args.Prefix {
+		return "", nil
+	}
+	if !strings.HasPrefix(plainPath, rn.args.Prefix+"/") {
+		return "", fmt.Errorf("%q is outside of -prefix %q", cipherPath, rn.args.Prefix)
+	}
+	return plainPath[len(rn.args.Prefix)+1:], nil
+}
+
+// CheckPrefix checks that the "-prefix" directory exists.
+func (rn *RootNode) CheckPrefix() error {
+	return rn.checkDir(rn.args.Prefix)
 }
 
-// decryptPathAt decrypts a ciphertext path relative to dirfd.
+// checkDir checks that "relPath", relative to the root of the filesystem, is
+// a directory.
+func (rn *RootNode) checkDir(relPath string) error {
+	dirfd, cName, err := rn.openBackingDirUnprefixed(relPath)
+	if err != nil {
+		return err
+	}
+	defer syscall.Close(dirfd)
+	var st unix.Stat_t
+	if err = syscallcompat.Fstatat(dirfd, cName, &st, unix.AT_SYMLINK_NOFOLLOW); err != nil {
+		return err
+	}
+	if st.Mode&syscall.S_IFMT != syscall.S_IFDIR {
+		return fmt.Errorf("%q is not a directory", relPath)
+	}
+	return nil
+}
+
+// decryptPathAt decrypts a ciphertext path relative to dirfd. With
+// "-fanout", every name is preceded by the bucket directories it is in.
 //
 // Symlink-safe through ReadDirIVAt() and ReadLongNameAt().
 func (rn *RootNode) decryptPathAt(dirfd int, cipherPath string) (plainPath string, err error) {
@@ -66,12 +127,27 @@ func (rn *RootNode) decryptPathAt(dirfd int, cipherPath string) (plainPath strin
 	}
 	parts := strings.Split(cipherPath, "/")
 	wd := dirfd
-	for i, part := range parts {
+	for i := 0; i < len(parts); i++ {
 		dirIV, err := nametransform.ReadDirIVAt(wd)
 		if err != nil {
 			fmt.Printf("ReadDirIV: %v\n", err)
 			return "", err
 		}
+		// The DirIV is in the directory, the name is in the bucket
+		if rn.args.Fanout {
+			for j := 0; j < fanoutLevels; j++ {
+				if i == len(parts)-1 || !isFanoutBucket(parts[i]) {
+					return "", fmt.Errorf("%q: expected a bucket directory, have %q", cipherPath, parts[i])
+				}
+				wd, err = syscallcompat.Openat(wd, parts[i], syscall.O_NOFOLLOW|syscall.O_DIRECTORY|syscallcompat.O_PATH, 0)
+				if err != nil {
+					return "", err
+				}
+				defer syscall.Close(wd)
+				i++
+			}
+		}
+		part := parts[i]
 		longPart := part
 		if nametransform.IsLongContent(part) {
 			longPart, err = nametransform.ReadLongNameAt(wd, part)
@@ -103,3 +179,27 @@ func (rn *RootNode) decryptPathAt(dirfd int, cipherPath string) (plainPath strin
 
 	return plainPath, nil
 }
+
+// snapshotMaxBlock is how long Snapshot may block writers. A copy without
+// reflinks that takes longer is aborted.
+var snapshotMaxBlock = 5 * time.Minute
+
+// Snapshot implements ctlsocksrv.Snapshotter. It copies CIPHERDIR to "dst"
+// using reflinks where possible. Writes to file contents and changes to the
+// directory tree are blocked while the copy runs, so no half-written blocks
+// or half-done renames end up in the snapshot. After snapshotMaxBlock, the
+// copy is aborted and removed, and snapshot.ErrDeadline is returned.
+func (rn *RootNode) Snapshot(dst string) (reflinked bool, err error) {
+	rn.snapshotLock.Lock()
+	defer rn.snapshotLock.Unlock()
+	// The snapshot should contain everything that has been written
+	if errno := openfiletable.FlushAllPendingWrites(); errno != 0 {
+		return false, errno
+	}
+	tlog.Info.Printf("Snapshot: copying %s to %s", rn.args.Cipherdir, dst)
+	reflinked, err = snapshot.CopyDeadline(rn.args.Cipherdir, dst, time.Now().Add(snapshotMaxBlock))
+	if err == snapshot.ErrDeadline {
+		tlog.Warn.Printf("Snapshot: aborted after %v to unblock writers", snapshotMaxBlock)
+	}
+	return reflinked, err
+}
@@ -0,0 +1,68 @@
+package fusefrontend
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"syscall"
+	"testing"
+
+	"github.com/hanwen/go-fuse/v2/fuse"
+
+	"github.com/rfjakob/gocryptfs/tests/test_helpers"
+)
+
+// TestEncryptDecryptPath encrypts a path three levels deep, checks that it
+// exists in CIPHERDIR, and decrypts it back.
+func TestEncryptDecryptPath(t *testing.T) {
+	cipherdir := test_helpers.InitFS(t)
+	rn := newTestFS(Args{Cipherdir: cipherdir})
+	n := &rn.Node
+	for _, name := range []string{"docs", "2024"} {
+		ch, errno := n.Mkdir(nil, name, 0700, &fuse.EntryOut{})
+		if errno != 0 {
+			t.Fatal(errno)
+		}
+		n.AddChild(name, ch, true)
+		n = toNode(ch.Operations())
+	}
+	writeTestFile(t, n, "report.txt", 10)
+
+	const plainPath = "docs/2024/report.txt"
+	cPath, err := rn.EncryptPath(plainPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if strings.Count(cPath, "/") != 2 || strings.Contains(cPath, "report") {
+		t.Errorf("path not encrypted: %q", cPath)
+	}
+	if _, err = os.Stat(filepath.Join(cipherdir, cPath)); err != nil {
+		t.Errorf("ciphertext path does not exist: %v", err)
+	}
+	// Absolute and unclean paths encrypt the same
+	for _, p := range []string{"/" + plainPath, "docs//2024/./report.txt/"} {
+		if have, err := rn.EncryptPath(p); err != nil || have != cPath {
+			t.Errorf("EncryptPath(%q): have %q %v, want %q", p, have, err, cPath)
+		}
+	}
+	for _, p := range []string{cPath, "/" + cPath} {
+		if have, err := rn.DecryptPath(p); err != nil || have != plainPath {
+			t.Errorf("DecryptPath(%q): have %q %v, want %q", p, have, err, plainPath)
+		}
+	}
+	// The root
+	for _, p := range []string{"", ".", "/"} {
+		if have, err := rn.EncryptPath(p); err != nil || have != "" {
+			t.Errorf("EncryptPath(%q): have %q %v", p, have, err)
+		}
+		if have, err := rn.DecryptPath(p); err != nil || have != "" {
+			t.Errorf("DecryptPath(%q): have %q %v", p, have, err)
+		}
+	}
+	if _, err = rn.EncryptPath("../docs"); err == nil {
+		t.Error("EncryptPath accepted a path above the root")
+	}
+	if _, err = rn.EncryptPath("docs/missing/file"); err != syscall.ENOENT {
+		t.Errorf("EncryptPath of a missing directory: want ENOENT, have %v", err)
+	}
+}
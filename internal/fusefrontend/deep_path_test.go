@@ -0,0 +1,140 @@
+package fusefrontend
+
+import (
+	"fmt"
+	"io/ioutil"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"syscall"
+	"testing"
+
+	"github.com/hanwen/go-fuse/v2/fuse"
+
+	"github.com/rfjakob/gocryptfs/internal/headerscan"
+	"github.com/rfjakob/gocryptfs/internal/snapshot"
+	"github.com/rfjakob/gocryptfs/tests/test_helpers"
+)
+
+// TestDeepPath creates a directory tree whose ciphertext paths are longer
+// than PATH_MAX, and checks that all operations still work. They must use
+// dirfd-relative syscalls, as the absolute paths would fail with
+// ENAMETOOLONG.
+func TestDeepPath(t *testing.T) {
+	cipherdir := test_helpers.InitFS(t)
+	rn := newTestFS(Args{Cipherdir: cipherdir, LongNames: true})
+	const depth = 40
+	var names []string
+	n := &rn.Node
+	for i := 0; i < depth; i++ {
+		name := fmt.Sprintf("%03d%s", i, strings.Repeat("d", 100))
+		names = append(names, name)
+		n = mkdirTestDir(t, n, name)
+	}
+	createFile(t, n, "file", []byte("content"))
+
+	plainPath := filepath.Join(append(names, "file")...)
+	cPath, err := rn.EncryptPath(plainPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// PATH_MAX is 4096 on Linux and 1024 on MacOS
+	if len(filepath.Join(cipherdir, cPath)) <= 4096 {
+		t.Fatalf("ciphertext path is only %d bytes long", len(filepath.Join(cipherdir, cPath)))
+	}
+	if _, err = syscall.Open(filepath.Join(cipherdir, cPath), syscall.O_RDONLY, 0); err != syscall.ENAMETOOLONG {
+		t.Fatalf("opening the absolute path: want ENAMETOOLONG, have %v", err)
+	}
+	if have, err := rn.DecryptPath(cPath); err != nil || have != plainPath {
+		t.Errorf("DecryptPath: want %q, have %q, %v", plainPath, have, err)
+	}
+
+	// The offline tools find the file as well
+	res, err := headerscan.Scan(cipherdir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(res.Entries) != 1 || res.Entries[0].Path != cPath || res.Entries[0].Status != headerscan.OK {
+		t.Errorf("headerscan: wrong result %v", res.Entries)
+	}
+	if stats, err := rn.RotateFileIDs(filepath.Join(cipherdir, "rotate.state"), nil); err != nil || stats.Rotated != 1 || stats.Failed != 0 {
+		t.Errorf("rotate: %+v %v", stats, err)
+	}
+	if stats, err := rn.CompactFiles("", nil); err != nil || stats.Compacted != 1 || stats.Failed != 0 {
+		t.Errorf("compact: %+v %v", stats, err)
+	}
+	snapDir, err := ioutil.TempDir(test_helpers.TmpDir, t.Name()+".")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err = snapshot.Copy(cipherdir, filepath.Join(snapDir, "snap")); err != nil {
+		t.Fatalf("snapshot: %v", err)
+	}
+	snap := newTestFS(Args{Cipherdir: filepath.Join(snapDir, "snap"), LongNames: true})
+	n3 := &snap.Node
+	for _, name := range names {
+		var errno syscall.Errno
+		if n3, errno = lookup(t, n3, name); errno != 0 {
+			t.Fatalf("snapshot: Lookup %q: %v", name, errno)
+		}
+	}
+	if have := readChildFile(t, n3, "file"); have != "content" {
+		t.Errorf("snapshot: want %q, have %q", "content", have)
+	}
+
+	// The "-quota" scan at mount time finds the file
+	if rn2 := newTestFS(Args{Cipherdir: cipherdir, LongNames: true, Quota: 1000}); rn2.quota.used != int64(len("content")) {
+		t.Errorf("quota scan: want %d bytes used, have %d", len("content"), rn2.quota.used)
+	}
+
+	// Lookups from a fresh inode tree walk down from the root
+	rn2 := newTestFS(Args{Cipherdir: cipherdir, LongNames: true})
+	n2 := &rn2.Node
+	for _, name := range names {
+		var errno syscall.Errno
+		if n2, errno = lookup(t, n2, name); errno != 0 {
+			t.Fatalf("Lookup %q: %v", name, errno)
+		}
+	}
+	if have := readChildFile(t, n2, "file"); have != "content" {
+		t.Errorf("want %q, have %q", "content", have)
+	}
+	f, errno := lookup(t, n2, "file")
+	if errno != 0 {
+		t.Fatal(errno)
+	}
+	in := &fuse.SetAttrIn{SetAttrInCommon: fuse.SetAttrInCommon{Valid: fuse.FATTR_MODE, Mode: 0640}}
+	var out fuse.AttrOut
+	if errno = f.Setattr(nil, nil, in, &out); errno != 0 {
+		t.Fatalf("Setattr: %v", errno)
+	}
+	if errno = f.Getattr(nil, nil, &out); errno != 0 || out.Mode&0777 != 0640 {
+		t.Errorf("Getattr: want mode 0640, have %o, %v", out.Mode&0777, errno)
+	}
+	if errno = n2.Rename(nil, "file", n2, "renamed", 0); errno != 0 {
+		t.Fatal(errno)
+	}
+	if have := listDir(t, n2); !reflect.DeepEqual(have, []string{"renamed"}) {
+		t.Errorf("want [renamed], have %v", have)
+	}
+	if _, errno := n2.Symlink(nil, "target", "link", &fuse.EntryOut{}); errno != 0 {
+		t.Errorf("Symlink: %v", errno)
+	}
+	for _, name := range []string{"renamed", "link"} {
+		if errno := n2.Unlink(nil, name); errno != 0 {
+			t.Errorf("Unlink %q: %v", name, errno)
+		}
+	}
+
+	// Remove the tree from the bottom up
+	for i := depth - 1; i >= 0; i-- {
+		_, parent := n2.Parent()
+		if errno := toNode(parent.Operations()).Rmdir(nil, names[i]); errno != 0 {
+			t.Fatalf("Rmdir %q: %v", names[i], errno)
+		}
+		n2 = toNode(parent.Operations())
+	}
+	if have := listDir(t, &rn2.Node); len(have) != 0 {
+		t.Errorf("root dir is not empty: %v", have)
+	}
+}
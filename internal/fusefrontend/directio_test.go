@@ -0,0 +1,78 @@
+package fusefrontend
+
+import (
+	"bytes"
+	"math/rand"
+	"syscall"
+	"testing"
+
+	"github.com/hanwen/go-fuse/v2/fuse"
+
+	"github.com/rfjakob/gocryptfs/tests/test_helpers"
+)
+
+// TestDirectIO checks that Open and Create return FOPEN_DIRECT_IO with
+// "-direct_io", and that File.Read and File.Write work with the request
+// patterns direct_io produces: the sizes and offsets of the application, not
+// whole pages.
+func TestDirectIO(t *testing.T) {
+	rn := newTestFS(Args{Cipherdir: test_helpers.InitFS(t), DirectIO: true})
+	ch, fh, fuseFlags, errno := rn.Create(nil, "foo", syscall.O_RDWR, 0600, &fuse.EntryOut{})
+	if errno != 0 {
+		t.Fatal(errno)
+	}
+	if fuseFlags&fuse.FOPEN_DIRECT_IO == 0 {
+		t.Errorf("Create: FOPEN_DIRECT_IO is not set: %#x", fuseFlags)
+	}
+	fh.(*File).Release(nil)
+	rn.AddChild("foo", ch, true)
+	fh, fuseFlags, errno = toNode(ch.Operations()).Open(nil, syscall.O_RDWR)
+	if errno != 0 {
+		t.Fatal(errno)
+	}
+	if fuseFlags&fuse.FOPEN_DIRECT_IO == 0 {
+		t.Errorf("Open: FOPEN_DIRECT_IO is not set: %#x", fuseFlags)
+	}
+	f := fh.(*File)
+	defer f.Release(nil)
+
+	rnd := rand.New(rand.NewSource(1))
+	var want []byte
+	sizes := []int{1, 7, 511, 4095, 4096, 4097, 10000, 65536 + 3, fuse.MAX_KERNEL_WRITE}
+	// Writes and reads of odd sizes at odd offsets, inside the file, at the
+	// end, and past the end
+	for i := 0; i < 200; i++ {
+		size := sizes[rnd.Intn(len(sizes))]
+		off := rnd.Intn(len(want) + 5000)
+		data := make([]byte, size)
+		rnd.Read(data)
+		n, errno := f.Write(nil, data, int64(off))
+		if errno != 0 || int(n) != size {
+			t.Fatalf("write off=%d size=%d: n=%d errno=%v", off, size, n, errno)
+		}
+		if end := off + size; end > len(want) {
+			want = append(want, make([]byte, end-len(want))...)
+		}
+		copy(want[off:], data)
+
+		size = sizes[rnd.Intn(len(sizes))]
+		off = rnd.Intn(len(want) + 100)
+		buf := make([]byte, size)
+		res, errno := f.Read(nil, buf, int64(off))
+		if errno != 0 {
+			t.Fatalf("read off=%d size=%d: %v", off, size, errno)
+		}
+		have, _ := res.Bytes(buf)
+		var expect []byte
+		if off < len(want) {
+			end := off + size
+			if end > len(want) {
+				end = len(want)
+			}
+			expect = want[off:end]
+		}
+		if !bytes.Equal(have, expect) {
+			t.Fatalf("read off=%d size=%d: content mismatch, have %d bytes, want %d", off, size, len(have), len(expect))
+		}
+	}
+}
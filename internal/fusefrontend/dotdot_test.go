@@ -0,0 +1,91 @@
+package fusefrontend
+
+import (
+	"syscall"
+	"testing"
+
+	"github.com/hanwen/go-fuse/v2/fuse"
+
+	"github.com/rfjakob/gocryptfs/tests/test_helpers"
+)
+
+// readdirEntries returns all entries from n.Readdir.
+func readdirEntries(t *testing.T, n *Node) []fuse.DirEntry {
+	ds, errno := n.Readdir(nil)
+	if errno != 0 {
+		t.Fatal(errno)
+	}
+	var entries []fuse.DirEntry
+	for ds.HasNext() {
+		e, errno := ds.Next()
+		if errno != 0 {
+			t.Fatal(errno)
+		}
+		entries = append(entries, e)
+	}
+	return entries
+}
+
+// TestDotEntries checks that Readdir lists "." and ".." with the inode numbers
+// of the directory and its parent, and that Lookup rejects them.
+func TestDotEntries(t *testing.T) {
+	cipherdir := test_helpers.InitFS(t)
+	rn := newTestFS(Args{Cipherdir: cipherdir})
+	var mkdirOut fuse.EntryOut
+	ch, errno := rn.Mkdir(nil, "dir", 0700, &mkdirOut)
+	if errno != 0 {
+		t.Fatal(errno)
+	}
+	rn.AddChild("dir", ch, true)
+	dir := ch.Operations().(*Node)
+	_, fh, _, errno := dir.Create(nil, "file", syscall.O_RDWR, 0600, &fuse.EntryOut{})
+	if errno != 0 {
+		t.Fatal(errno)
+	}
+	fh.(*File).Release(nil)
+
+	var rootAttr fuse.AttrOut
+	if errno := rn.Getattr(nil, nil, &rootAttr); errno != 0 {
+		t.Fatal(errno)
+	}
+	rootIno := rootAttr.Ino
+	dirIno := mkdirOut.Ino
+	if rootIno == 0 || dirIno == 0 || rootIno == dirIno {
+		t.Fatalf("bad inode numbers: root=%d dir=%d", rootIno, dirIno)
+	}
+
+	for _, tc := range []struct {
+		n             *Node
+		self, parent  uint64
+		expectedNames int
+	}{
+		{&rn.Node, rootIno, rootIno, 3},
+		{dir, dirIno, rootIno, 3},
+	} {
+		entries := readdirEntries(t, tc.n)
+		if len(entries) != tc.expectedNames {
+			t.Errorf("%q: wrong number of entries: %v", tc.n.Path(), entries)
+			continue
+		}
+		// "." and ".." come first and are exactly as expected
+		if entries[0].Name != "." || entries[0].Ino != tc.self || entries[0].Mode != syscall.S_IFDIR {
+			t.Errorf("%q: bad \".\" entry %+v, want ino %d", tc.n.Path(), entries[0], tc.self)
+		}
+		if entries[1].Name != ".." || entries[1].Ino != tc.parent || entries[1].Mode != syscall.S_IFDIR {
+			t.Errorf("%q: bad \"..\" entry %+v, want ino %d", tc.n.Path(), entries[1], tc.parent)
+		}
+		// The remaining entry is decrypted normally
+		if name := entries[2].Name; name != "dir" && name != "file" {
+			t.Errorf("%q: unexpected entry %q", tc.n.Path(), name)
+		}
+	}
+
+	// Lookup of "." and ".." fails, go-fuse cannot add them to the tree
+	for _, n := range []*Node{&rn.Node, dir} {
+		for _, name := range []string{".", ".."} {
+			if _, errno := n.Lookup(nil, name, &fuse.EntryOut{}); errno != syscall.ENOENT {
+				t.Errorf("Lookup %q in %q: want ENOENT, got %v", name, n.Path(), errno)
+			}
+		}
+	}
+}
@@ -0,0 +1,205 @@
+package fusefrontend
+
+// "-fanout": the entries of a directory are spread over two levels of bucket
+// directories below it, like "ab/cd/ENCRYPTED_NAME", so that no backing directory
+// grows very large. gocryptfs.diriv stays in the directory itself.
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"path/filepath"
+	"strings"
+	"syscall"
+
+	"golang.org/x/sys/unix"
+
+	"github.com/hanwen/go-fuse/v2/fs"
+	"github.com/hanwen/go-fuse/v2/fuse"
+
+	"github.com/rfjakob/gocryptfs/internal/nametransform"
+	"github.com/rfjakob/gocryptfs/internal/syscallcompat"
+	"github.com/rfjakob/gocryptfs/internal/tlog"
+)
+
+// fanoutLevels is the number of bucket directories between a directory and
+// its entries. Each level has up to 256 buckets.
+const fanoutLevels = 2
+
+// fanoutBuckets returns the bucket names, one per level, that the encrypted
+// name "cName" is stored in. They are taken from the SHA256 of the name, as
+// long names all start with "gocryptfs.longname.".
+func fanoutBuckets(cName string) []string {
+	h := sha256.Sum256([]byte(cName))
+	buckets := make([]string, fanoutLevels)
+	for i := range buckets {
+		buckets[i] = hex.EncodeToString(h[i : i+1])
+	}
+	return buckets
+}
+
+// fanoutBucketPath returns the path of the bucket of "cName", relative to the
+// directory, like "ab/cd"
+func fanoutBucketPath(cName string) string {
+	return filepath.Join(fanoutBuckets(cName)...)
+}
+
+// isFanoutBucket returns true if "name" looks like a bucket. Encrypted names
+// are always longer, and "-fanout" cannot be used with plaintext names.
+func isFanoutBucket(name string) bool {
+	if len(name) != 2 {
+		return false
+	}
+	_, err := hex.DecodeString(name)
+	return err == nil
+}
+
+// fanoutOpenBucket opens the bucket that holds "cName" below the directory
+// "dirfd" with O_PATH. "dirfd" is closed, also on error. Fails with ENOENT
+// if the bucket does not exist yet.
+func fanoutOpenBucket(dirfd int, cName string) (int, error) {
+	for _, b := range fanoutBuckets(cName) {
+		fd, err := syscallcompat.Openat(dirfd, b, syscall.O_NOFOLLOW|syscall.O_DIRECTORY|syscallcompat.O_PATH, 0)
+		syscall.Close(dirfd)
+		if err != nil {
+			return -1, err
+		}
+		dirfd = fd
+	}
+	return dirfd, nil
+}
+
+// writeLongNameAt is nametransform.WriteLongNameAt, except that with
+// "-fanout", "dirfd" is a bucket and the DirIV is read from the directory
+// fanoutLevels up.
+func (rn *RootNode) writeLongNameAt(dirfd int, hashName string, plainName string) error {
+	if !rn.args.Fanout {
+		return rn.nameTransform.WriteLongNameAt(dirfd, hashName, plainName)
+	}
+	up := strings.TrimSuffix(strings.Repeat("../", fanoutLevels), "/")
+	fd, err := syscallcompat.Openat(dirfd, up, syscall.O_NOFOLLOW|syscall.O_DIRECTORY|syscallcompat.O_PATH, 0)
+	if err != nil {
+		return err
+	}
+	defer syscall.Close(fd)
+	iv, err := nametransform.ReadDirIVAt(fd)
+	if err != nil {
+		return err
+	}
+	return rn.nameTransform.WriteLongNameAtIV(dirfd, hashName, plainName, iv)
+}
+
+// fanoutMkdirBucket creates the bucket for the child "name" of n, unless it
+// already exists. Buckets get the permissions and, with PreserveOwner, the
+// owner of the directory, plus full access for the owner.
+func (n *Node) fanoutMkdirBucket(ctx context.Context, name string) syscall.Errno {
+	rn := n.rootNode()
+	if !rn.args.Fanout {
+		return 0
+	}
+	dirfd, cName, errno := n.prepareAtSyscall(ctx, "")
+	if errno != 0 {
+		return errno
+	}
+	fd, err := syscallcompat.Openat(dirfd, cName, syscall.O_NOFOLLOW|syscall.O_DIRECTORY|syscallcompat.O_PATH, 0)
+	syscall.Close(dirfd)
+	if err != nil {
+		return fs.ToErrno(err)
+	}
+	defer func() { syscall.Close(fd) }()
+	iv, err := nametransform.ReadDirIVAt(fd)
+	if err != nil {
+		return fs.ToErrno(err)
+	}
+	cChild, err := rn.nameTransform.EncryptAndHashName(name, iv)
+	if err != nil {
+		return fs.ToErrno(err)
+	}
+	var st unix.Stat_t
+	if err = unix.Fstat(fd, &st); err != nil {
+		return fs.ToErrno(err)
+	}
+	mode := uint32(st.Mode&0777) | 0700
+	for _, b := range fanoutBuckets(cChild) {
+		err = unix.Mkdirat(fd, b, mode)
+		if err == nil && rn.args.PreserveOwner {
+			if err = unix.Fchownat(fd, b, int(st.Uid), int(st.Gid), unix.AT_SYMLINK_NOFOLLOW); err != nil {
+				tlog.Warn.Printf("fanoutMkdirBucket: Fchownat %q: %v", b, err)
+			}
+		} else if err != nil && err != syscall.EEXIST {
+			return fs.ToErrno(err)
+		}
+		fd2, err := syscallcompat.Openat(fd, b, syscall.O_NOFOLLOW|syscall.O_DIRECTORY|syscallcompat.O_PATH, 0)
+		if err != nil {
+			return fs.ToErrno(err)
+		}
+		syscall.Close(fd)
+		fd = fd2
+	}
+	return 0
+}
+
+// fanoutWalk opens the buckets among "entries", which were read from the
+// directory "fd", and calls "fn" with the entries of each bucket of the last
+// level. The buckets are opened one after the other, so only fanoutLevels
+// file descriptors are open at a time.
+func fanoutWalk(fd int, entries []fuse.DirEntry, levels int, fn func(bucketFd int, entries []fuse.DirEntry)) error {
+	for _, e := range entries {
+		if e.Mode&syscall.S_IFMT != syscall.S_IFDIR || !isFanoutBucket(e.Name) {
+			continue
+		}
+		bfd, err := syscallcompat.Openat(fd, e.Name, syscall.O_RDONLY|syscall.O_DIRECTORY|syscall.O_NOFOLLOW, 0)
+		if err != nil {
+			return err
+		}
+		bEntries, err := syscallcompat.Getdents(bfd)
+		if err == nil {
+			if levels == 1 {
+				fn(bfd, bEntries)
+			} else {
+				err = fanoutWalk(bfd, bEntries, levels-1, fn)
+			}
+		}
+		syscall.Close(bfd)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// fanoutPrune deletes the empty buckets below the directory "fd", which Unlink
+// and Rename leave behind. Fails with ENOTEMPTY if a bucket has entries.
+func fanoutPrune(fd int) error {
+	entries, err := syscallcompat.Getdents(fd)
+	if err != nil {
+		return err
+	}
+	return fanoutPruneEntries(fd, entries, fanoutLevels)
+}
+
+func fanoutPruneEntries(fd int, entries []fuse.DirEntry, levels int) error {
+	for _, e := range entries {
+		if e.Mode&syscall.S_IFMT != syscall.S_IFDIR || !isFanoutBucket(e.Name) {
+			continue
+		}
+		if levels > 1 {
+			bfd, err := syscallcompat.Openat(fd, e.Name, syscall.O_RDONLY|syscall.O_DIRECTORY|syscall.O_NOFOLLOW, 0)
+			if err != nil {
+				return err
+			}
+			bEntries, err := syscallcompat.Getdents(bfd)
+			if err == nil {
+				err = fanoutPruneEntries(bfd, bEntries, levels-1)
+			}
+			syscall.Close(bfd)
+			if err != nil {
+				return err
+			}
+		}
+		if err := syscallcompat.Unlinkat(fd, e.Name, unix.AT_REMOVEDIR); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,120 @@
+package fusefrontend
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"strings"
+	"syscall"
+	"testing"
+
+	"github.com/rfjakob/gocryptfs/internal/configfile"
+	"github.com/rfjakob/gocryptfs/internal/nametransform"
+	"github.com/rfjakob/gocryptfs/tests/test_helpers"
+)
+
+// TestFanout creates many entries with "-fanout" and checks that they end up
+// in bucket directories, and that the listing, Lookup, Rename, Unlink and
+// Rmdir all see through the buckets.
+func TestFanout(t *testing.T) {
+	cipherdir := test_helpers.InitFS(t)
+	rn := newTestFS(Args{Cipherdir: cipherdir, LongNames: true, Fanout: true})
+	var want []string
+	for i := 0; i < 300; i++ {
+		name := fmt.Sprintf("file%03d", i)
+		writeTestFile(t, &rn.Node, name, i)
+		want = append(want, name)
+	}
+	long := strings.Repeat("l", 200)
+	writeTestFile(t, &rn.Node, long, 10)
+	d := mkdirTestDir(t, &rn.Node, "dir")
+	writeTestFile(t, d, "x", 1)
+	want = append(want, long, "dir")
+	sort.Strings(want)
+
+	if have := listDir(t, &rn.Node); !reflect.DeepEqual(have, want) {
+		t.Errorf("listing: want %d entries, have %d: %v", len(want), len(have), have)
+	}
+	// The backing directory only holds the buckets
+	entries, err := ioutil.ReadDir(cipherdir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, e := range entries {
+		if e.Name() == configfile.ConfDefaultName || e.Name() == nametransform.DirIVFilename {
+			continue
+		}
+		if !e.IsDir() || !isFanoutBucket(e.Name()) {
+			t.Errorf("unexpected entry %q in the backing directory", e.Name())
+		}
+	}
+
+	// Lookups from a fresh inode tree go to disk
+	rn2 := newTestFS(Args{Cipherdir: cipherdir, LongNames: true, Fanout: true})
+	for _, name := range []string{"file000", "file299", long} {
+		if _, errno := lookup(t, &rn2.Node, name); errno != 0 {
+			t.Errorf("Lookup %q: %v", name, errno)
+		}
+	}
+	if _, errno := lookup(t, &rn2.Node, "nonexisting"); errno != syscall.ENOENT {
+		t.Errorf("Lookup of a nonexisting name: want ENOENT, have %v", errno)
+	}
+	d2, errno := lookup(t, &rn2.Node, "dir")
+	if errno != 0 {
+		t.Fatal(errno)
+	}
+	if have := listDir(t, d2); !reflect.DeepEqual(have, []string{"x"}) {
+		t.Errorf("dir: want [x], have %v", have)
+	}
+
+	// Rename moves the entry to a different bucket
+	if errno = rn.Rename(nil, "file000", &rn.Node, "renamed", 0); errno != 0 {
+		t.Fatal(errno)
+	}
+	if _, errno = lookup(t, &rn2.Node, "renamed"); errno != 0 {
+		t.Errorf("Lookup after Rename: %v", errno)
+	}
+	if errno = rn.Unlink(nil, "file001"); errno != 0 {
+		t.Fatal(errno)
+	}
+	if _, errno = lookup(t, &rn2.Node, "file001"); errno != syscall.ENOENT {
+		t.Errorf("Lookup after Unlink: want ENOENT, have %v", errno)
+	}
+
+	// The ctlsock paths include the buckets
+	cPath, err := rn.EncryptPath("dir/x")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(strings.Split(cPath, "/")) != 2*(fanoutLevels+1) {
+		t.Errorf("EncryptPath: %q does not contain the buckets", cPath)
+	}
+	if _, err = os.Stat(filepath.Join(cipherdir, cPath)); err != nil {
+		t.Error(err)
+	}
+	if plain, err := rn.DecryptPath(cPath); err != nil || plain != "dir/x" {
+		t.Errorf("DecryptPath(%q): want %q, have %q, %v", cPath, "dir/x", plain, err)
+	}
+
+	// Rmdir deletes the empty buckets, but not the ones that are in use
+	if errno = d.Unlink(nil, "x"); errno != 0 {
+		t.Fatal(errno)
+	}
+	if errno = rn.Rmdir(nil, "dir"); errno != 0 {
+		t.Fatalf("Rmdir: %v", errno)
+	}
+	if _, errno = lookup(t, &rn2.Node, "dir"); errno != syscall.ENOENT {
+		t.Errorf("Lookup after Rmdir: want ENOENT, have %v", errno)
+	}
+	d = mkdirTestDir(t, &rn.Node, "dir")
+	writeTestFile(t, d, "y", 1)
+	if errno = rn.Rmdir(nil, "dir"); errno != syscall.ENOTEMPTY {
+		t.Errorf("Rmdir of a non-empty dir: want ENOTEMPTY, have %v", errno)
+	}
+	if have := listDir(t, d); !reflect.DeepEqual(have, []string{"y"}) {
+		t.Errorf("dir after failed Rmdir: want [y], have %v", have)
+	}
+}
@@ -12,13 +12,18 @@ import (
 	"os"
 	"sync"
 	"syscall"
+	"time"
+
+	"golang.org/x/sys/unix"
 
 	"github.com/hanwen/go-fuse/v2/fs"
 	"github.com/hanwen/go-fuse/v2/fuse"
 
 	"github.com/rfjakob/gocryptfs/internal/contentenc"
 	"github.com/rfjakob/gocryptfs/internal/inomap"
+	"github.com/rfjakob/gocryptfs/internal/journal"
 	"github.com/rfjakob/gocryptfs/internal/openfiletable"
+	"github.com/rfjakob/gocryptfs/internal/optrace"
 	"github.com/rfjakob/gocryptfs/internal/serialize_reads"
 	"github.com/rfjakob/gocryptfs/internal/stupidgcm"
 	"github.com/rfjakob/gocryptfs/internal/syscallcompat"
@@ -28,6 +33,9 @@ import (
 // File implements the go-fuse v2 API (github.com/hanwen/go-fuse/v2/fs)
 type File struct {
 	fd *os.File
+	// bio is where file content is read from and written to, normally "fd".
+	// Goes through readAt and writeAt for "-io_timeout".
+	bio backingIO
 	// Has Release() already been called on this file? This also means that the
 	// wlock entry has been freed, so let's not crash trying to access it.
 	// Due to concurrency, Release can overtake other operations. These will
@@ -51,6 +59,37 @@ type File struct {
 	lastOpCount uint64
 	// Parent filesystem
 	rootNode *RootNode
+	// traceFh identifies this file in the "-optrace" log
+	traceFh uint64
+	// journal records the blocks written in "-journal" mode. Nil otherwise.
+	journal *journal.Writer
+	// hashPending is set when the file has been modified through this handle
+	// and the "-filehash" checksum has to be stored on Release.
+	hashPending bool
+	// wbuf holds small writes until they fill a block, see
+	// file_writebuf.go. Protected by ContentLock.
+	wbuf writeBuf
+	// openTimes are the atime and mtime of the backing file at open time,
+	// put back on Release in "-timestamps=nopropagate" mode. Nil otherwise.
+	openTimes *[2]unix.Timespec
+	// isDir is set if the backing file is a directory. Directories have no
+	// encrypted content, so Read rejects them.
+	isDir bool
+	// writeOnly is set if the handle was opened O_WRONLY. The backing fd is
+	// O_RDWR anyway for read-modify-write cycles, so Read has to reject
+	// the handle itself.
+	writeOnly bool
+	// skewPath, skewFloor and skewWritten are the state of the
+	// "-warn_clock_skew" check, see clock_skew.go. skewWritten is
+	// protected by ContentLock.
+	skewPath    string
+	skewFloor   time.Time
+	skewWritten bool
+	// staleChecked is the time, in Unix seconds, when Read or Write last
+	// checked if the backing file has been deleted, and staleErrno is the
+	// result. Both are accessed atomically, see file_stale.go.
+	staleChecked uint32
+	staleErrno   uint32
 }
 
 // NewFile returns a new go-fuse File instance based on an already-open file
@@ -59,6 +98,11 @@ type File struct {
 //
 // `cName` is only used for error logging and may be left blank.
 func NewFile(fd int, cName string, rn *RootNode) (f *File, st *syscall.Stat_t, errno syscall.Errno) {
+	// A delete through the mount that finishes before Register cannot mark
+	// the new entry as deleted, see checkStale. We find out by the link
+	// count, and treat a file that is gone right after we opened it as
+	// deleted by us.
+	deletes := openfiletable.DeleteCount()
 	// Need device number and inode number for openfiletable locking
 	st = &syscall.Stat_t{}
 	if err := syscall.Fstat(fd, st); err != nil {
@@ -67,15 +111,29 @@ func NewFile(fd int, cName string, rn *RootNode) (f *File, st *syscall.Stat_t, e
 	}
 	qi := inomap.QInoFromStat(st)
 	e := openfiletable.Register(qi)
+	if st.Nlink == 0 {
+		openfiletable.MarkDeleted(qi)
+	} else if openfiletable.DeleteCount() != deletes {
+		var st2 syscall.Stat_t
+		if syscall.Fstat(fd, &st2) == nil && st2.Nlink == 0 {
+			openfiletable.MarkDeleted(qi)
+		}
+	}
 
 	osFile := os.NewFile(uintptr(fd), cName)
 
 	f = &File{
 		fd:             osFile,
+		bio:            osFile,
 		contentEnc:     rn.contentEnc,
 		qIno:           qi,
 		fileTableEntry: e,
 		rootNode:       rn,
+		traceFh:        rn.OpTrace.NextFh(),
+		isDir:          st.Mode&syscall.S_IFMT == syscall.S_IFDIR,
+	}
+	if rn.args.NoPropagateTimes {
+		f.openTimes = backingTimes(fd)
 	}
 	return f, st, 0
 }
@@ -91,9 +149,9 @@ func (f *File) readFileID() ([]byte, error) {
 	// We read +1 byte to determine if the file has actual content
 	// and not only the header. A header-only file will be considered empty.
 	// This makes File ID poisoning more difficult.
-	readLen := contentenc.HeaderLen + 1
+	readLen := f.contentEnc.HeaderLen() + 1
 	buf := make([]byte, readLen)
-	n, err := f.fd.ReadAt(buf, 0)
+	n, err := f.readAt(buf, 0)
 	if err != nil {
 		if err == io.EOF && n != 0 {
 			tlog.Warn.Printf("readFileID %d: incomplete file, got %d instead of %d bytes",
@@ -114,11 +172,33 @@ func (f *File) readFileID() ([]byte, error) {
 // Returns the new file ID.
 // The caller must hold fileIDLock.Lock().
 func (f *File) createHeader() (fileID []byte, err error) {
+	return f.writeHeader(f.keepTags())
+}
+
+// keepTags returns the file tags a new header must carry over. A file that
+// holds nothing but the header counts as empty, but it keeps its tags.
+// An unreadable tags region is reported and dropped.
+func (f *File) keepTags() []byte {
+	if !f.rootNode.args.FileTags {
+		return nil
+	}
+	tags, _, err := f.rootNode.readTags(f.readAt)
+	if err != nil {
+		tlog.Warn.Printf("ino%d: dropping unreadable file tags: %v", f.qIno.Ino, err)
+		f.rootNode.reportMitigatedCorruption(fmt.Sprint(f.qIno.Ino))
+		return nil
+	}
+	return tags
+}
+
+// writeHeader writes a new random header with the file tags "tags" to disk.
+// Returns the new file ID.
+func (f *File) writeHeader(tags []byte) (fileID []byte, err error) {
 	h := contentenc.RandomHeader()
-	buf := h.Pack()
+	buf := f.contentEnc.PackHeader(h, tags)
 	// Prevent partially written (=corrupt) header by preallocating the space beforehand
 	if !f.rootNode.args.NoPrealloc {
-		err = syscallcompat.EnospcPrealloc(f.intFd(), 0, contentenc.HeaderLen)
+		err = syscallcompat.EnospcPrealloc(f.intFd(), 0, int64(len(buf)))
 		if err != nil {
 			if !syscallcompat.IsENOSPC(err) {
 				tlog.Warn.Printf("ino%d: createHeader: prealloc failed: %s\n", f.qIno.Ino, err.Error())
@@ -127,10 +207,15 @@ func (f *File) createHeader() (fileID []byte, err error) {
 		}
 	}
 	// Actually write header
-	_, err = f.fd.WriteAt(buf, 0)
+	_, err = f.writeAt(buf, 0)
 	if err != nil {
 		return nil, err
 	}
+	if f.rootNode.args.FileHash {
+		f.fileTableEntry.FileHash.Reset()
+		f.fileTableEntry.FileHash.Write(0, buf)
+		f.hashPending = true
+	}
 	return h.ID, err
 }
 
@@ -161,10 +246,10 @@ func (f *File) doRead(dst []byte, off uint64, length uint64) ([]byte, syscall.Er
 				return nil, 0
 			}
 			buf := make([]byte, 100)
-			n, _ := f.fd.ReadAt(buf, 0)
+			n, _ := f.readAt(buf, 0)
 			buf = buf[:n]
 			hexdump := hex.EncodeToString(buf)
-			tlog.Warn.Printf("doRead %d: corrupt header: %v\nFile hexdump (%d bytes): %s",
+			tlog.Warn.PrintfLimited(&f.fileTableEntry.DecryptErrLog, "doRead %d: corrupt header: %v\nFile hexdump (%d bytes): %s",
 				f.qIno.Ino, err, n, hexdump)
 			return nil, syscall.EIO
 		}
@@ -184,7 +269,7 @@ func (f *File) doRead(dst []byte, off uint64, length uint64) ([]byte, syscall.Er
 
 	ciphertext := f.rootNode.contentEnc.CReqPool.Get()
 	ciphertext = ciphertext[:int(alignedLength)]
-	n, err := f.fd.ReadAt(ciphertext, int64(alignedOffset))
+	n, err := f.readAt(ciphertext, int64(alignedOffset))
 	if err != nil && err != io.EOF {
 		tlog.Warn.Printf("read: ReadAt: %s", err.Error())
 		return nil, fs.ToErrno(err)
@@ -207,27 +292,19 @@ func (f *File) doRead(dst []byte, off uint64, length uint64) ([]byte, syscall.Er
 		if f.rootNode.args.ForceDecode && err == stupidgcm.ErrAuth {
 			// We do not have the information which block was corrupt here anymore,
 			// but DecryptBlocks() has already logged it anyway.
-			tlog.Warn.Printf("doRead %d: off=%d len=%d: returning corrupt data due to forcedecode",
+			tlog.Warn.PrintfLimited(&f.fileTableEntry.DecryptErrLog, "doRead %d: off=%d len=%d: returning corrupt data due to forcedecode",
 				f.qIno.Ino, off, length)
 		} else {
 			curruptBlockNo := firstBlockNo + f.contentEnc.PlainOffToBlockNo(uint64(len(plaintext)))
-			tlog.Warn.Printf("doRead %d: corrupt block #%d: %v", f.qIno.Ino, curruptBlockNo, err)
+			tlog.Warn.PrintfLimited(&f.fileTableEntry.DecryptErrLog, "doRead %d: corrupt block #%d: %v", f.qIno.Ino, curruptBlockNo, err)
 			return nil, syscall.EIO
 		}
 	}
 
-	// Crop down to the relevant part
-	var out []byte
-	lenHave := len(plaintext)
-	lenWant := int(skip + length)
-	if lenHave > lenWant {
-		out = plaintext[skip:lenWant]
-	} else if lenHave > int(skip) {
-		out = plaintext[skip:lenHave]
-	}
-	// else: out stays empty, file was smaller than the requested offset
-
-	out = append(dst, out...)
+	// Crop down to the relevant part. The plaintext is shorter than
+	// requested if the file ends inside the range, or is truncated.
+	crop := contentenc.IntraBlock{Skip: skip, Length: length}
+	out := append(dst, crop.CropBlock(plaintext)...)
 	f.rootNode.contentEnc.PReqPool.Put(plaintext)
 
 	return out, 0
@@ -235,14 +312,51 @@ func (f *File) doRead(dst []byte, off uint64, length uint64) ([]byte, syscall.Er
 
 // Read - FUSE call
 func (f *File) Read(ctx context.Context, buf []byte, off int64) (resultData fuse.ReadResult, errno syscall.Errno) {
+	defer f.rootNode.Metrics.Observe(optrace.OpRead, time.Now(), &errno)
+	// The kernel does not send reads on directories, but do not try to
+	// decrypt directory data if one arrives anyway
+	if f.isDir {
+		return nil, syscall.EISDIR
+	}
+	if f.writeOnly {
+		return nil, syscall.EBADF
+	}
 	if len(buf) > fuse.MAX_KERNEL_WRITE {
 		// This would crash us due to our fixed-size buffer pool
 		tlog.Warn.Printf("Read: rejecting oversized request with EMSGSIZE, len=%d", len(buf))
 		return nil, syscall.EMSGSIZE
 	}
+	if off < 0 {
+		return nil, syscall.EINVAL
+	}
+	// No file can have data beyond MaxPlainSize. Reading there returns EOF
+	// like reading past the end of the file.
+	length := uint64(len(buf))
+	if max := f.contentEnc.MaxPlainSize(); uint64(off) >= max {
+		length = 0
+	} else if length > max-uint64(off) {
+		length = max - uint64(off)
+	}
+	// Nothing to do. Return before ExplodePlainRange sees a zero length.
+	if length == 0 {
+		return fuse.ReadResultData(nil), 0
+	}
+	// Charge the bytes actually read, not the requested length, so that
+	// short reads and EOF do not use up the budget. Deferred first so that
+	// it runs after the locks are released, and waiting readers do not block
+	// other operations on the file.
+	var nRead int
+	defer func() { f.rootNode.bwLimiter.Wait(nRead) }()
 	f.fdLock.RLock()
 	defer f.fdLock.RUnlock()
+	if errno := f.fstatStale(); errno != 0 {
+		return nil, errno
+	}
 
+	// Reads must see buffered writes
+	if errno := f.flushPending(); errno != 0 {
+		return nil, errno
+	}
 	f.fileTableEntry.ContentLock.RLock()
 	defer f.fileTableEntry.ContentLock.RUnlock()
 
@@ -250,14 +364,16 @@ func (f *File) Read(ctx context.Context, buf []byte, off int64) (resultData fuse
 	if f.rootNode.args.SerializeReads {
 		serialize_reads.Wait(off, len(buf))
 	}
-	out, errno := f.doRead(buf[:0], uint64(off), uint64(len(buf)))
+	out, errno := f.doRead(buf[:0], uint64(off), length)
 	if f.rootNode.args.SerializeReads {
 		serialize_reads.Done()
 	}
+	f.rootNode.OpTrace.Record(optrace.Op{Op: optrace.OpRead, Fh: f.traceFh, Off: off, Size: int64(len(buf))}, nil, errno)
 	if errno != 0 {
 		return nil, errno
 	}
 	tlog.Debug.Printf("ino%d: Read: errno=%d, returning %d bytes", f.qIno.Ino, errno, len(out))
+	nRead = len(out)
 	return fuse.ReadResultData(out), errno
 }
 
@@ -292,15 +408,34 @@ func (f *File) doWrite(data []byte, off int64) (uint32, syscall.Errno) {
 		}
 		f.fileTableEntry.ID = fileID
 	}
+	if f.journal != nil {
+		var err error
+		if fileWasEmpty {
+			err = f.journal.Reset(fileID)
+		} else {
+			err = f.journal.Start(fileID)
+		}
+		if err != nil {
+			tlog.Warn.Printf("ino%d fh%d: doWrite: journal: %v", f.qIno.Ino, f.intFd(), err)
+			return 0, syscall.EIO
+		}
+	}
 	// Handle payload data
 	dataBuf := bytes.NewBuffer(data)
 	blocks := f.contentEnc.ExplodePlainRange(uint64(off), uint64(len(data)))
 	toEncrypt := make([][]byte, len(blocks))
+	// zero marks the blocks that "-sparse" leaves as file holes
+	var zero []bool
 	for i, b := range blocks {
 		blockData := dataBuf.Next(int(b.Length))
 		// Incomplete block -> Read-Modify-Write
-		if b.IsPartial() {
-			// Read
+		if b.IsPartial() && !f.overwritesTail(b) {
+			// Read. If the write extends the file, the block may be shorter
+			// than b.Skip, or not exist at all. The read then returns less
+			// data or none at all, and MergeBlocks zero-fills up to b.Skip.
+			// In a new file, there is no old data, and the block is just
+			// the written bytes. The blocks before this one are complete,
+			// see writePadHole.
 			oldData, errno := f.doRead(nil, b.BlockPlainOff(), f.contentEnc.PlainBS())
 			if errno != 0 {
 				tlog.Warn.Printf("ino%d fh%d: RMW read failed: errno=%d", f.qIno.Ino, f.intFd(), errno)
@@ -314,6 +449,12 @@ func (f *File) doWrite(data []byte, off int64) (uint32, syscall.Errno) {
 			f.qIno.Ino, len(blockData), b.BlockNo)
 		// Write into the to-encrypt list
 		toEncrypt[i] = blockData
+		if f.rootNode.args.Sparse && uint64(len(blockData)) == f.contentEnc.PlainBS() && isAllZero(blockData) {
+			if zero == nil {
+				zero = make([]bool, len(blocks))
+			}
+			zero[i] = true
+		}
 	}
 	// Encrypt all blocks
 	ciphertext := f.contentEnc.EncryptBlocks(toEncrypt, blocks[0].BlockNo, f.fileTableEntry.ID)
@@ -321,7 +462,8 @@ func (f *File) doWrite(data []byte, off int64) (uint32, syscall.Errno) {
 	// This prevents partially written (=corrupt) blocks.
 	var err error
 	cOff := int64(blocks[0].BlockCipherOff())
-	if !f.rootNode.args.NoPrealloc {
+	// writeSparse preallocates the data blocks itself
+	if !f.rootNode.args.NoPrealloc && zero == nil {
 		err = syscallcompat.EnospcPrealloc(f.intFd(), cOff, int64(len(ciphertext)))
 		if err != nil {
 			if !syscallcompat.IsENOSPC(err) {
@@ -339,9 +481,29 @@ func (f *File) doWrite(data []byte, off int64) (uint32, syscall.Errno) {
 		}
 	}
 	// Write
-	_, err = f.fd.WriteAt(ciphertext, cOff)
-	// Return memory to CReqPool
-	f.rootNode.contentEnc.CReqPool.Put(ciphertext)
+	if zero != nil {
+		err = f.writeSparse(ciphertext, cOff, zero)
+	} else {
+		_, err = f.writeAt(ciphertext, cOff)
+	}
+	if err == nil && f.rootNode.args.FileHash {
+		f.fileTableEntry.FileHash.Write(cOff, ciphertext)
+		f.hashPending = true
+	}
+	if err == nil {
+		// The journal record must only be appended after the data has been
+		// written.
+		if err2 := f.journal.Append(blocks[0].BlockNo, ciphertext); err2 != nil {
+			tlog.Warn.Printf("ino%d fh%d: doWrite: journal: %v", f.qIno.Ino, f.intFd(), err2)
+			f.rootNode.contentEnc.CReqPool.Put(ciphertext)
+			return 0, syscall.EIO
+		}
+	}
+	// Return memory to CReqPool. After a timeout, the write may still be
+	// reading from it.
+	if err != syscall.ETIMEDOUT {
+		f.rootNode.contentEnc.CReqPool.Put(ciphertext)
+	}
 	if err != nil {
 		tlog.Warn.Printf("ino%d fh%d: doWrite: WriteAt off=%d len=%d failed: %v",
 			f.qIno.Ino, f.intFd(), cOff, len(ciphertext), err)
@@ -350,6 +512,58 @@ func (f *File) doWrite(data []byte, off int64) (uint32, syscall.Errno) {
 	return uint32(len(data)), 0
 }
 
+// checkRange returns EFBIG if the plaintext range of "length" bytes at "off"
+// ends beyond contentenc.MaxPlainSize, where the ciphertext offsets would
+// overflow int64.
+func (f *File) checkRange(off uint64, length uint64) syscall.Errno {
+	max := f.contentEnc.MaxPlainSize()
+	if off > max || length > max-off {
+		tlog.Warn.Printf("ino%d fh%d: rejecting range beyond the maximum file size with EFBIG, off=%d len=%d",
+			f.qIno.Ino, f.intFd(), off, length)
+		return syscall.EFBIG
+	}
+	return 0
+}
+
+// checkAligned implements "-aligned_writes": it returns EINVAL for a write of
+// "length" bytes at "off" unless it starts at a block boundary, and ends at a
+// block boundary or at or beyond the end of the file.
+func (f *File) checkAligned(off int64, length int) syscall.Errno {
+	bs := int64(f.contentEnc.PlainBS())
+	end := off + int64(length)
+	if off%bs == 0 && end%bs == 0 {
+		return 0
+	}
+	if off%bs == 0 {
+		plainSize, err := f.statPlainSize()
+		if err != nil {
+			return fs.ToErrno(err)
+		}
+		if uint64(end) >= plainSize {
+			return 0
+		}
+	}
+	tlog.Warn.Printf("ino%d fh%d: -aligned_writes: rejecting unaligned write with EINVAL, off=%d len=%d",
+		f.qIno.Ino, f.intFd(), off, length)
+	return syscall.EINVAL
+}
+
+// overwritesTail returns true if "-aligned_writes" is active and the partial
+// block "b" replaces all data that block has on disk, so the read in
+// read-modify-write can be skipped. This is the case when "b" starts at the
+// block boundary and reaches the end of the file.
+func (f *File) overwritesTail(b contentenc.IntraBlock) bool {
+	if !f.rootNode.args.AlignedWrites || b.Skip != 0 {
+		return false
+	}
+	plainSize, err := f.statPlainSize()
+	if err != nil {
+		// Let the read-modify-write path deal with it
+		return false
+	}
+	return b.BlockPlainOff()+b.Length >= plainSize
+}
+
 // isConsecutiveWrite returns true if the current write
 // directly (in time and space) follows the last write.
 // This is an optimisation for streaming writes on NFS where a
@@ -363,12 +577,25 @@ func (f *File) isConsecutiveWrite(off int64) bool {
 // Write - FUSE call
 //
 // If the write creates a hole, pads the file to the next block boundary.
-func (f *File) Write(ctx context.Context, data []byte, off int64) (uint32, syscall.Errno) {
+func (f *File) Write(ctx context.Context, data []byte, off int64) (written uint32, errno syscall.Errno) {
+	defer f.rootNode.Metrics.Observe(optrace.OpWrite, time.Now(), &errno)
 	if len(data) > fuse.MAX_KERNEL_WRITE {
 		// This would crash us due to our fixed-size buffer pool
 		tlog.Warn.Printf("Write: rejecting oversized request with EMSGSIZE, len=%d", len(data))
 		return 0, syscall.EMSGSIZE
 	}
+	// POSIX: a zero-length write returns zero and has no other effect. In
+	// particular, it must not create a file header or pad a hole.
+	if len(data) == 0 {
+		return 0, 0
+	}
+	if off < 0 {
+		return 0, syscall.EINVAL
+	}
+	if errno := f.checkRange(uint64(off), uint64(len(data))); errno != 0 {
+		return 0, errno
+	}
+	f.rootNode.bwLimiter.Wait(len(data))
 	f.fdLock.RLock()
 	defer f.fdLock.RUnlock()
 	if f.released {
@@ -376,19 +603,51 @@ func (f *File) Write(ctx context.Context, data []byte, off int64) (uint32, sysca
 		tlog.Warn.Printf("ino%d fh%d: Write on released file", f.qIno.Ino, f.intFd())
 		return 0, syscall.EBADF
 	}
+	if errno := f.fstatStale(); errno != 0 {
+		return 0, errno
+	}
+	// Block while a snapshot is being taken
+	f.rootNode.snapshotLock.RLock()
+	defer f.rootNode.snapshotLock.RUnlock()
 	f.fileTableEntry.ContentLock.Lock()
 	defer f.fileTableEntry.ContentLock.Unlock()
 	tlog.Debug.Printf("ino%d: FUSE Write: offset=%d length=%d", f.qIno.Ino, off, len(data))
+	if f.rootNode.args.AlignedWrites {
+		if errno := f.checkAligned(off, len(data)); errno != 0 {
+			return 0, errno
+		}
+	}
+	var n uint32
+	if f.rootNode.args.WriteBuffer {
+		n, errno = f.bufferedWrite(data, off)
+	} else {
+		n, errno = f.writeThrough(data, off)
+	}
+	if errno == 0 {
+		f.skewWritten = true
+	}
+	f.rootNode.OpTrace.Record(optrace.Op{Op: optrace.OpWrite, Fh: f.traceFh, Off: off, Size: int64(len(data))}, data, errno)
+	return n, errno
+}
+
+// writeThrough writes "data" to disk, zero-padding the last block first if
+// the write creates a file hole. The caller must hold ContentLock.Lock().
+func (f *File) writeThrough(data []byte, off int64) (uint32, syscall.Errno) {
 	// If the write creates a file hole, we have to zero-pad the last block.
 	// But if the write directly follows an earlier write, it cannot create a
 	// hole, and we can save one Stat() call.
-	if !f.isConsecutiveWrite(off) {
-		errno := f.writePadHole(off)
-		if errno != 0 {
-			return 0, errno
+	var n uint32
+	errno := f.chargeQuota(uint64(off)+uint64(len(data)), func() syscall.Errno {
+		if !f.isConsecutiveWrite(off) {
+			errno := f.writePadHole(off)
+			if errno != 0 {
+				return errno
+			}
 		}
-	}
-	n, errno := f.doWrite(data, off)
+		var errno syscall.Errno
+		n, errno = f.doWrite(data, off)
+		return errno
+	})
 	if errno != 0 {
 		f.lastOpCount = openfiletable.WriteOpCount()
 		f.lastWrittenOffset = off + int64(len(data)) - 1
@@ -397,16 +656,54 @@ func (f *File) Write(ctx context.Context, data []byte, off int64) (uint32, sysca
 }
 
 // Release - FUSE call, close file
-func (f *File) Release(ctx context.Context) syscall.Errno {
+func (f *File) Release(ctx context.Context) (errno syscall.Errno) {
+	defer f.rootNode.Metrics.Observe(optrace.OpRelease, time.Now(), &errno)
 	f.fdLock.Lock()
 	if f.released {
 		log.Panicf("ino%d fh%d: double release", f.qIno.Ino, f.intFd())
 	}
 	f.released = true
+	// Flush() has normally done this already
+	if errno := f.flushOwnWriteBuf(); errno != 0 {
+		tlog.Warn.Printf("ino%d fh%d: Release: writing buffered data failed: %v", f.qIno.Ino, f.intFd(), errno)
+	}
+	f.storeFileHash()
+	// Before restoreTimes, which puts back the old mtime
+	f.checkClockSkew()
+	f.restoreTimes()
+	f.rootNode.handles.remove(f)
+	f.rootNode.releaseHandle()
 	openfiletable.Unregister(f.qIno)
+	f.journal.Close()
 	err := f.fd.Close()
 	f.fdLock.Unlock()
-	return fs.ToErrno(err)
+	errno = fs.ToErrno(err)
+	f.rootNode.OpTrace.Record(optrace.Op{Op: optrace.OpRelease, Fh: f.traceFh}, nil, errno)
+	return errno
+}
+
+// invalidateFileHash marks the "-filehash" checksum as invalid after a
+// modification that does not go through doWrite. The caller must hold
+// ContentLock.
+func (f *File) invalidateFileHash() {
+	if f.rootNode.args.FileHash {
+		f.fileTableEntry.FileHash.Invalidate()
+		f.hashPending = true
+	}
+}
+
+// storeFileHash stores the "-filehash" checksum if the file has been modified
+// through this handle. Called on Release. Failures are logged but do not fail
+// the Release, the checksum is then missing or stale.
+func (f *File) storeFileHash() {
+	if !f.hashPending {
+		return
+	}
+	f.fileTableEntry.ContentLock.Lock()
+	defer f.fileTableEntry.ContentLock.Unlock()
+	if err := f.fileTableEntry.FileHash.Store(f.intFd()); err != nil {
+		tlog.Warn.Printf("ino%d fh%d: could not store file hash: %v", f.qIno.Ino, f.intFd(), err)
+	}
 }
 
 // Flush - FUSE call
@@ -414,6 +711,9 @@ func (f *File) Flush(ctx context.Context) syscall.Errno {
 	f.fdLock.RLock()
 	defer f.fdLock.RUnlock()
 
+	if errno := f.flushOwnWriteBuf(); errno != 0 {
+		return errno
+	}
 	err := syscallcompat.Flush(f.intFd())
 	return fs.ToErrno(err)
 }
@@ -423,23 +723,50 @@ func (f *File) Fsync(ctx context.Context, flags uint32) (errno syscall.Errno) {
 	f.fdLock.RLock()
 	defer f.fdLock.RUnlock()
 
-	return fs.ToErrno(syscall.Fsync(f.intFd()))
+	if errno := f.flushOwnWriteBuf(); errno != 0 {
+		return errno
+	}
+	if f.rootNode.args.FsyncBatch > 0 {
+		// An fsync on any fd flushes all writes to the inode, so the
+		// fd of whichever handle runs the round does it for everyone
+		return fs.ToErrno(f.fileTableEntry.FsyncBatched(f.rootNode.args.FsyncBatch, func() error {
+			return backingFsync(f.intFd())
+		}))
+	}
+	return fs.ToErrno(backingFsync(f.intFd()))
 }
 
+// backingFsync runs fsync(2) on the backing file. A variable so tests can
+// count the calls.
+var backingFsync = syscall.Fsync
+
 // Getattr FUSE call (like stat)
 func (f *File) Getattr(ctx context.Context, a *fuse.AttrOut) syscall.Errno {
 	f.fdLock.RLock()
 	defer f.fdLock.RUnlock()
 
 	tlog.Debug.Printf("file.GetAttr()")
+	// The size must include buffered writes
+	if errno := f.flushPending(); errno != 0 {
+		return errno
+	}
 	st := syscall.Stat_t{}
 	err := syscall.Fstat(f.intFd(), &st)
 	if err != nil {
 		return fs.ToErrno(err)
 	}
+	if errno := f.checkStale(&st); errno != 0 {
+		return errno
+	}
 	f.rootNode.inoMap.TranslateStat(&st)
 	a.FromStat(&st)
-	a.Size = f.contentEnc.CipherSizeToPlainSize(a.Size)
+	syscallcompat.FillBtime(&a.Attr, &st)
+	f.rootNode.freezeTimes(&a.Attr)
+	// Device files and fifos can be opened as well. Their size is whatever
+	// the backing filesystem says.
+	if a.IsRegular() {
+		a.Size = f.contentEnc.CipherSizeToPlainSize(a.Size)
+	}
 	if f.rootNode.args.ForceOwner != nil {
 		a.Owner = *f.rootNode.args.ForceOwner
 	}
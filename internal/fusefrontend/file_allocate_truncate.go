@@ -8,9 +8,11 @@ import (
 	"log"
 	"sync"
 	"syscall"
+	"time"
 
 	"github.com/hanwen/go-fuse/v2/fs"
 
+	"github.com/rfjakob/gocryptfs/internal/optrace"
 	"github.com/rfjakob/gocryptfs/internal/syscallcompat"
 	"github.com/rfjakob/gocryptfs/internal/tlog"
 )
@@ -45,14 +47,23 @@ func (f *File) Allocate(ctx context.Context, off uint64, sz uint64, mode uint32)
 		allocateWarnOnce.Do(f)
 		return syscall.EOPNOTSUPP
 	}
+	if errno := f.checkRange(off, sz); errno != 0 {
+		return errno
+	}
 
 	f.fdLock.RLock()
 	defer f.fdLock.RUnlock()
 	if f.released {
 		return syscall.EBADF
 	}
+	// Block while a snapshot is being taken
+	f.rootNode.snapshotLock.RLock()
+	defer f.rootNode.snapshotLock.RUnlock()
 	f.fileTableEntry.ContentLock.Lock()
 	defer f.fileTableEntry.ContentLock.Unlock()
+	if errno := f.fileTableEntry.FlushPendingWrite(); errno != 0 {
+		return errno
+	}
 
 	blocks := f.contentEnc.ExplodePlainRange(off, sz)
 	firstBlock := blocks[0]
@@ -89,14 +100,33 @@ func (f *File) Allocate(ctx context.Context, off uint64, sz uint64, mode uint32)
 	// The file grows. The space has already been allocated in (1), so what is
 	// left to do is to pad the first and last block and call truncate.
 	// truncateGrowFile does just that.
-	return f.truncateGrowFile(oldPlainSz, newPlainSz)
+	return f.chargeQuota(newPlainSz, func() syscall.Errno {
+		return f.truncateGrowFile(oldPlainSz, newPlainSz)
+	})
 }
 
 // truncate - called from Setattr.
 func (f *File) truncate(newSize uint64) (errno syscall.Errno) {
+	defer f.rootNode.Metrics.Observe(optrace.OpTruncate, time.Now(), &errno)
+	defer func() {
+		f.rootNode.OpTrace.Record(optrace.Op{Op: optrace.OpTruncate, Fh: f.traceFh, Size: int64(newSize)}, nil, errno)
+	}()
+	if errno := f.checkRange(newSize, 0); errno != 0 {
+		return errno
+	}
+	return f.chargeQuota(newSize, func() syscall.Errno {
+		return f.doTruncate(newSize)
+	})
+}
+
+// doTruncate changes the size of the file to "newSize". The caller must hold
+// ContentLock.Lock().
+func (f *File) doTruncate(newSize uint64) (errno syscall.Errno) {
+	f.invalidateFileHash()
 	var err error
 	// Common case first: Truncate to zero
 	if newSize == 0 {
+		tags := f.keepTags()
 		err = syscall.Ftruncate(int(f.fd.Fd()), 0)
 		if err != nil {
 			tlog.Warn.Printf("ino%d fh%d: Ftruncate(fd, 0) returned error: %v", f.qIno.Ino, f.intFd(), err)
@@ -104,6 +134,13 @@ func (f *File) truncate(newSize uint64) (errno syscall.Errno) {
 		}
 		// Truncate to zero kills the file header
 		f.fileTableEntry.ID = nil
+		if len(tags) > 0 {
+			// ...but not the file tags. They go into a fresh header.
+			f.fileTableEntry.ID, err = f.writeHeader(tags)
+			if err != nil {
+				return fs.ToErrno(err)
+			}
+		}
 		return 0
 	}
 	// We need the old file size to determine if we are growing or shrinking
@@ -172,6 +209,7 @@ func (f *File) truncateGrowFile(oldPlainSz uint64, newPlainSz uint64) syscall.Er
 	if newPlainSz <= oldPlainSz {
 		log.Panicf("BUG: newSize=%d <= oldSize=%d", newPlainSz, oldPlainSz)
 	}
+	f.invalidateFileHash()
 	newEOFOffset := newPlainSz - 1
 	if oldPlainSz > 0 {
 		n1 := f.contentEnc.PlainOffToBlockNo(oldPlainSz - 1)
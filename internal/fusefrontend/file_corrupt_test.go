@@ -0,0 +1,81 @@
+package fusefrontend
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"strings"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/rfjakob/gocryptfs/internal/contentenc"
+	"github.com/rfjakob/gocryptfs/internal/tlog"
+	"github.com/rfjakob/gocryptfs/tests/test_helpers"
+)
+
+// TestCorruptBlockLogLimit corrupts every block of a file, reads all of them
+// many times and checks that the warnings are rate-limited.
+func TestCorruptBlockLogLimit(t *testing.T) {
+	cipherdir := test_helpers.InitFS(t)
+	rn := newTestFS(Args{Cipherdir: cipherdir})
+	const blocks = 20
+	bs := int(rn.contentEnc.PlainBS())
+	writeTestFile(t, &rn.Node, "f", blocks*bs)
+
+	dirfd, cName, err := rn.openBackingDir("f")
+	if err != nil {
+		t.Fatal(err)
+	}
+	syscall.Close(dirfd)
+	cf, err := os.OpenFile(filepath.Join(cipherdir, cName), os.O_RDWR, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cipherBS := int64(rn.contentEnc.CipherBS())
+	for i := int64(0); i < blocks; i++ {
+		// Flip the bits of a byte in the middle of the block
+		off := contentenc.HeaderLen + i*cipherBS + 100
+		b := make([]byte, 1)
+		if _, err = cf.ReadAt(b, off); err != nil {
+			t.Fatal(err)
+		}
+		b[0] ^= 0xff
+		if _, err = cf.WriteAt(b, off); err != nil {
+			t.Fatal(err)
+		}
+	}
+	cf.Close()
+
+	var logBuf bytes.Buffer
+	tlog.Warn.Logger.SetOutput(&logBuf)
+	defer tlog.Warn.Logger.SetOutput(os.Stderr)
+
+	fh, _, errno := lookupChild(t, &rn.Node, "f").Open(nil, syscall.O_RDONLY)
+	if errno != 0 {
+		t.Fatal(errno)
+	}
+	f := fh.(*File)
+	defer f.Release(nil)
+	t0 := time.Now()
+	buf := make([]byte, bs)
+	reads := 0
+	for round := 0; round < 10; round++ {
+		for i := 0; i < blocks; i++ {
+			if _, errno = f.Read(nil, buf, int64(i*bs)); errno != syscall.EIO {
+				t.Fatalf("block %d: want EIO, have %v", i, errno)
+			}
+			reads++
+		}
+	}
+	lines := strings.Split(strings.TrimSpace(logBuf.String()), "\n")
+	// Every started second allows another burst
+	max := tlog.RateLimitBurst * (int(time.Since(t0)/time.Second) + 1)
+	if len(lines) > max {
+		t.Errorf("%d reads of corrupt blocks logged %d lines, want at most %d:\n%s",
+			reads, len(lines), max, logBuf.String())
+	}
+	if len(lines) < tlog.RateLimitBurst || !strings.Contains(lines[0], "corrupt block") {
+		t.Errorf("corrupt blocks were not logged:\n%s", logBuf.String())
+	}
+}
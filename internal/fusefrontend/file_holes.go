@@ -8,6 +8,7 @@ import (
 
 	"github.com/hanwen/go-fuse/v2/fs"
 
+	"github.com/rfjakob/gocryptfs/internal/syscallcompat"
 	"github.com/rfjakob/gocryptfs/internal/tlog"
 )
 
@@ -56,13 +57,175 @@ func (f *File) zeroPad(plainSize uint64) syscall.Errno {
 	return errno
 }
 
-// Lseek - FUSE call.
+// FALLOC_FL_PUNCH_HOLE deallocates a range. It must be combined with
+// FALLOC_FL_KEEP_SIZE.
+const FALLOC_FL_PUNCH_HOLE = 0x02
+
+// isAllZero returns true if "b" only contains zero bytes
+func isAllZero(b []byte) bool {
+	for _, c := range b {
+		if c != 0 {
+			return false
+		}
+	}
+	return true
+}
+
+// writeSparse implements "-sparse". It writes "ciphertext" to ciphertext
+// offset "cOff" like writeAt, except for the blocks marked in "zero", which
+// become file holes. An all-zero ciphertext block reads back as an all-zero
+// plaintext block, see contentenc.DecryptBlock.
+//
+// The part of "ciphertext" that belongs to the holes is zeroed, so that
+// "-filehash" and the journal see what is on disk. The caller must hold
+// ContentLock.Lock().
+func (f *File) writeSparse(ciphertext []byte, cOff int64, zero []bool) error {
+	cBS := int(f.contentEnc.CipherBS())
+	for i := 0; i < len(zero); {
+		// Find the run of blocks [i, j) that are all holes or all data
+		j := i + 1
+		for j < len(zero) && zero[j] == zero[i] {
+			j++
+		}
+		start, end := i*cBS, j*cBS
+		if end > len(ciphertext) {
+			end = len(ciphertext)
+		}
+		run := ciphertext[start:end]
+		off := cOff + int64(start)
+		if zero[i] {
+			for k := range run {
+				run[k] = 0
+			}
+			err := syscallcompat.Fallocate(f.intFd(), FALLOC_FL_PUNCH_HOLE|FALLOC_FL_KEEP_SIZE, off, int64(len(run)))
+			if err != nil {
+				// Darwin and some filesystems cannot punch holes. Zeros
+				// read back the same, they just take up space.
+				tlog.Debug.Printf("ino%d: writeSparse: punching hole failed: %v", f.qIno.Ino, err)
+				if _, err = f.writeAt(run, off); err != nil {
+					return err
+				}
+			}
+		} else {
+			if !f.rootNode.args.NoPrealloc {
+				if err := syscallcompat.EnospcPrealloc(f.intFd(), off, int64(len(run))); err != nil {
+					return err
+				}
+			}
+			if _, err := f.writeAt(run, off); err != nil {
+				return err
+			}
+		}
+		i = j
+	}
+	if !zero[len(zero)-1] {
+		return nil
+	}
+	// A hole at the end does not grow the file
+	fi, err := f.fd.Stat()
+	if err != nil {
+		return err
+	}
+	if end := cOff + int64(len(ciphertext)); fi.Size() < end {
+		return syscall.Ftruncate(f.intFd(), end)
+	}
+	return nil
+}
+
+// Lseek - FUSE call. Only SEEK_DATA and SEEK_HOLE get here, the kernel
+// handles the other "whence" values itself.
+//
+// The query is passed to the backing file and the ciphertext offset it
+// returns is translated back to a plaintext block boundary. Ciphertext blocks
+// are always written as a whole, so a ciphertext block that is not fully
+// allocated has never been written and reads as zeros.
 func (f *File) Lseek(ctx context.Context, off uint64, whence uint32) (uint64, syscall.Errno) {
-	cipherOff := f.rootNode.contentEnc.PlainSizeToCipherSize(off)
-	newCipherOff, err := syscall.Seek(f.intFd(), int64(cipherOff), int(whence))
+	if whence != syscallcompat.SEEK_DATA && whence != syscallcompat.SEEK_HOLE {
+		return 0, syscall.EINVAL
+	}
+	f.fdLock.RLock()
+	defer f.fdLock.RUnlock()
+
+	if errno := f.flushPending(); errno != 0 {
+		return 0, errno
+	}
+	f.fileTableEntry.ContentLock.RLock()
+	defer f.fileTableEntry.ContentLock.RUnlock()
+
+	fi, err := f.fd.Stat()
 	if err != nil {
 		return 0, fs.ToErrno(err)
 	}
-	newOff := f.contentEnc.CipherSizeToPlainSize(uint64(newCipherOff))
+	cipherSize := uint64(fi.Size())
+	plainSize := f.contentEnc.CipherSizeToPlainSize(cipherSize)
+	if off >= plainSize {
+		return 0, syscall.ENXIO
+	}
+	blockNo := f.contentEnc.PlainOffToBlockNo(off)
+	var n uint64
+	if whence == syscallcompat.SEEK_HOLE {
+		c, err := f.seekCipher(blockNo, syscallcompat.SEEK_HOLE)
+		if err != nil {
+			return 0, fs.ToErrno(err)
+		}
+		if c >= cipherSize {
+			// The implicit hole at the end of the file
+			return plainSize, 0
+		}
+		// [blockNo, c) is allocated, the block containing c is not
+		n = f.cipherOffToBlockNo(c)
+	} else {
+		// The start of an unwritten block may share a filesystem block with
+		// the end of the previous block and be allocated. Skip blocks until
+		// we find one that is allocated all the way.
+		for n = blockNo; ; n++ {
+			c, err := f.seekCipher(n, syscallcompat.SEEK_DATA)
+			if err != nil {
+				return 0, fs.ToErrno(err)
+			}
+			n = f.cipherOffToBlockNo(c)
+			end := f.contentEnc.BlockNoToCipherOff(n + 1)
+			if end > cipherSize {
+				end = cipherSize
+			}
+			h, err := f.seekCipher(n, syscallcompat.SEEK_HOLE)
+			if err != nil {
+				return 0, fs.ToErrno(err)
+			}
+			if h >= end {
+				break
+			}
+		}
+	}
+	newOff := f.contentEnc.BlockNoToPlainOff(n)
+	if newOff < off {
+		newOff = off
+	}
+	if newOff >= plainSize {
+		if whence == syscallcompat.SEEK_DATA {
+			return 0, syscall.ENXIO
+		}
+		newOff = plainSize
+	}
 	return newOff, 0
 }
+
+// seekCipher calls lseek(2) with "whence" on the backing file, starting at
+// ciphertext block "blockNo". Block 0 includes the file header.
+func (f *File) seekCipher(blockNo uint64, whence int) (uint64, error) {
+	var cipherOff uint64
+	if blockNo > 0 {
+		cipherOff = f.contentEnc.BlockNoToCipherOff(blockNo)
+	}
+	c, err := syscall.Seek(f.intFd(), int64(cipherOff), whence)
+	return uint64(c), err
+}
+
+// cipherOffToBlockNo is like contentEnc.CipherOffToBlockNo, but maps the file
+// header to block 0.
+func (f *File) cipherOffToBlockNo(c uint64) uint64 {
+	if c < f.contentEnc.HeaderLen() {
+		return 0
+	}
+	return f.contentEnc.CipherOffToBlockNo(c)
+}
@@ -0,0 +1,67 @@
+package fusefrontend
+
+// Watchdog for backing file I/O, "-io_timeout"
+
+import (
+	"io"
+	"syscall"
+	"time"
+
+	"github.com/rfjakob/gocryptfs/internal/tlog"
+)
+
+// backingIO is what file content is read from and written to. It is the
+// *os.File of the backing file, except in tests.
+type backingIO interface {
+	io.ReaderAt
+	io.WriterAt
+}
+
+// readAt reads from the backing file. See withIOTimeout.
+func (f *File) readAt(p []byte, off int64) (int, error) {
+	return f.withIOTimeout("read", off, len(p), func() (int, error) {
+		return f.bio.ReadAt(p, off)
+	})
+}
+
+// writeAt writes to the backing file. See withIOTimeout.
+func (f *File) writeAt(p []byte, off int64) (int, error) {
+	return f.withIOTimeout("write", off, len(p), func() (int, error) {
+		return f.bio.WriteAt(p, off)
+	})
+}
+
+// withIOTimeout runs "fn", which reads or writes the backing file. With
+// "-io_timeout", it gives up waiting after the timeout and returns ETIMEDOUT,
+// so that a hung backing filesystem (like an unreachable network mount) does
+// not hang the gocryptfs mount as well.
+//
+// A syscall cannot be interrupted, so "fn" keeps running in the background and
+// may still complete later. The caller must not reuse the buffer "fn" works on
+// after ETIMEDOUT.
+func (f *File) withIOTimeout(op string, off int64, length int, fn func() (int, error)) (int, error) {
+	timeout := f.rootNode.args.IOTimeout
+	if timeout <= 0 {
+		return fn()
+	}
+	type result struct {
+		n   int
+		err error
+	}
+	// Buffered so the goroutine can exit even if nobody is waiting anymore
+	done := make(chan result, 1)
+	go func() {
+		n, err := fn()
+		done <- result{n, err}
+	}()
+	t := time.NewTimer(timeout)
+	defer t.Stop()
+	select {
+	case r := <-done:
+		return r.n, r.err
+	case <-t.C:
+		tlog.Warn.Printf("ino%d fh%d: backing %s off=%d len=%d did not complete within %v, returning ETIMEDOUT",
+			f.qIno.Ino, f.intFd(), op, off, length, timeout)
+		return 0, syscall.ETIMEDOUT
+	}
+}
@@ -0,0 +1,62 @@
+package fusefrontend
+
+import (
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/hanwen/go-fuse/v2/fuse"
+
+	"github.com/rfjakob/gocryptfs/tests/test_helpers"
+)
+
+// hungIO blocks all reads and writes until "release" is closed, like a hung
+// network filesystem.
+type hungIO struct {
+	backingIO
+	release chan struct{}
+}
+
+func (h *hungIO) ReadAt(p []byte, off int64) (int, error) {
+	<-h.release
+	return h.backingIO.ReadAt(p, off)
+}
+
+func (h *hungIO) WriteAt(p []byte, off int64) (int, error) {
+	<-h.release
+	return h.backingIO.WriteAt(p, off)
+}
+
+// TestIOTimeout checks that with -io_timeout, Read and Write fail with
+// ETIMEDOUT instead of blocking forever when the backing file hangs.
+func TestIOTimeout(t *testing.T) {
+	const timeout = 100 * time.Millisecond
+	rn := newTestFS(Args{Cipherdir: test_helpers.InitFS(t), IOTimeout: timeout})
+	ch, fh, _, errno := rn.Create(nil, "foo", syscall.O_RDWR, 0600, &fuse.EntryOut{})
+	if errno != 0 {
+		t.Fatal(errno)
+	}
+	rn.AddChild("foo", ch, true)
+	f := fh.(*File)
+	defer f.Release(nil)
+	// Works normally while the backing file responds
+	data := make([]byte, 100)
+	if _, errno = f.Write(nil, data, 0); errno != 0 {
+		t.Fatal(errno)
+	}
+	hung := &hungIO{backingIO: f.bio, release: make(chan struct{})}
+	defer close(hung.release)
+	f.bio = hung
+
+	t0 := time.Now()
+	if _, errno = f.Read(nil, make([]byte, 100), 0); errno != syscall.ETIMEDOUT {
+		t.Errorf("Read: want ETIMEDOUT, got %v", errno)
+	}
+	if _, errno = f.Write(nil, data, 100); errno != syscall.ETIMEDOUT {
+		t.Errorf("Write: want ETIMEDOUT, got %v", errno)
+	}
+	// One timeout for the Read, one for the read-modify-write in Write
+	if d := time.Since(t0); d > 10*timeout {
+		t.Errorf("took %v, timeout is %v", d, timeout)
+	}
+}
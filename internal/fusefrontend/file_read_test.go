@@ -0,0 +1,79 @@
+package fusefrontend
+
+import (
+	"bytes"
+	"path/filepath"
+	"syscall"
+	"testing"
+
+	"github.com/rfjakob/gocryptfs/tests/test_helpers"
+)
+
+// TestReadDirectory opens a directory like a file and checks that Read
+// returns EISDIR instead of trying to decrypt it.
+func TestReadDirectory(t *testing.T) {
+	rn := newTestFS(Args{Cipherdir: test_helpers.InitFS(t)})
+	d := mkdirTestDir(t, &rn.Node, "dir")
+	fh, _, errno := d.Open(nil, syscall.O_RDONLY)
+	if errno != 0 {
+		t.Fatal(errno)
+	}
+	f := fh.(*File)
+	defer f.Release(nil)
+	buf := make([]byte, 100)
+	for _, off := range []int64{0, 5000} {
+		if _, errno = f.Read(nil, buf, off); errno != syscall.EISDIR {
+			t.Errorf("off=%d: want EISDIR, have %v", off, errno)
+		}
+	}
+}
+
+// TestReadTruncatedBackingFile cuts the backing file of a three-block file
+// after the first block, as if it had been truncated behind our back, and
+// checks that reads return what is left instead of panicking
+func TestReadTruncatedBackingFile(t *testing.T) {
+	cipherdir := test_helpers.InitFS(t)
+	rn := newTestFS(Args{Cipherdir: cipherdir})
+	bs := int(rn.contentEnc.PlainBS())
+	writeTestFile(t, &rn.Node, "f", 3*bs)
+	_, f := openTestFile(t, rn, "f", syscall.O_RDONLY)
+	defer f.Release(nil)
+	want := make([]byte, 3*bs)
+	res, errno := f.Read(nil, want, 0)
+	if errno != 0 {
+		t.Fatal(errno)
+	}
+	want, _ = res.Bytes(want)
+
+	dirfd, cName, err := rn.openBackingDir("f")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer syscall.Close(dirfd)
+	if err = syscall.Truncate(filepath.Join(cipherdir, cName), int64(rn.contentEnc.BlockNoToCipherOff(1))); err != nil {
+		t.Fatal(err)
+	}
+	testCases := []struct {
+		off, length int
+		want        []byte
+	}{
+		{0, 3 * bs, want[:bs]},
+		{100, 2 * bs, want[100:bs]},
+		{bs - 1, 10, want[bs-1 : bs]},
+		{bs, 10, nil},
+		{bs + 100, bs, nil},
+		{2*bs + 100, 10, nil},
+	}
+	for _, tc := range testCases {
+		buf := make([]byte, tc.length)
+		res, errno := f.Read(nil, buf, int64(tc.off))
+		if errno != 0 {
+			t.Errorf("off=%d len=%d: %v", tc.off, tc.length, errno)
+			continue
+		}
+		have, _ := res.Bytes(buf)
+		if !bytes.Equal(have, tc.want) {
+			t.Errorf("off=%d len=%d: want %d bytes, have %d", tc.off, tc.length, len(tc.want), len(have))
+		}
+	}
+}
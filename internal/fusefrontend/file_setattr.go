@@ -26,18 +26,20 @@ func (f *File) setAttr(ctx context.Context, in *fuse.SetAttrIn) (errno syscall.E
 		tlog.Warn.Printf("ino%d fh%d: Truncate on released file", f.qIno.Ino, f.intFd())
 		return syscall.EBADF
 	}
+	// Block while a snapshot is being taken
+	f.rootNode.snapshotLock.RLock()
+	defer f.rootNode.snapshotLock.RUnlock()
 	f.fileTableEntry.ContentLock.Lock()
 	defer f.fileTableEntry.ContentLock.Unlock()
-
-	// fchmod(2)
-	if mode, ok := in.GetMode(); ok {
-		errno = fs.ToErrno(syscall.Fchmod(f.intFd(), mode))
-		if errno != 0 {
-			return errno
-		}
+	if errno := f.fileTableEntry.FlushPendingWrite(); errno != 0 {
+		return errno
 	}
 
 	// fchown(2)
+	//
+	// Comes before fchmod: changing the owner clears the setuid and setgid
+	// bits of a regular file, also when root does it, so a mode that is set
+	// in the same request would be lost.
 	uid32, uOk := in.GetUID()
 	gid32, gOk := in.GetGID()
 	if uOk || gOk {
@@ -56,6 +58,14 @@ func (f *File) setAttr(ctx context.Context, in *fuse.SetAttrIn) (errno syscall.E
 		}
 	}
 
+	// fchmod(2)
+	if mode, ok := in.GetMode(); ok {
+		errno = fs.ToErrno(syscall.Fchmod(f.intFd(), mode))
+		if errno != 0 {
+			return errno
+		}
+	}
+
 	// utimens(2)
 	mtime, mok := in.GetMTime()
 	atime, aok := in.GetATime()
@@ -74,6 +84,14 @@ func (f *File) setAttr(ctx context.Context, in *fuse.SetAttrIn) (errno syscall.E
 		}
 	}
 
+	// Birth time (MacOS only)
+	if btime, ok := syscallcompat.GetBtime(in); ok {
+		errno = fs.ToErrno(syscallcompat.FutimesBtime(f.intFd(), btime))
+		if errno != 0 {
+			return errno
+		}
+	}
+
 	// truncate(2)
 	if sz, ok := in.GetSize(); ok {
 		errno = syscall.Errno(f.truncate(sz))
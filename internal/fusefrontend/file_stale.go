@@ -0,0 +1,71 @@
+package fusefrontend
+
+import (
+	"sync/atomic"
+	"syscall"
+	"time"
+
+	"golang.org/x/sys/unix"
+
+	"github.com/hanwen/go-fuse/v2/fs"
+
+	"github.com/rfjakob/gocryptfs/internal/inomap"
+	"github.com/rfjakob/gocryptfs/internal/openfiletable"
+	"github.com/rfjakob/gocryptfs/internal/syscallcompat"
+	"github.com/rfjakob/gocryptfs/internal/tlog"
+)
+
+// checkStale returns ESTALE if the backing file has been deleted behind our
+// back, for example by a sync tool. The file descriptor keeps working, but
+// the file is gone from CIPHERDIR, and anything written to it is lost.
+// Files deleted through the mount keep working, as POSIX requires.
+//
+// The result is kept for fstatStale.
+func (f *File) checkStale(st *syscall.Stat_t) (errno syscall.Errno) {
+	if st.Nlink == 0 && !f.fileTableEntry.Deleted() {
+		tlog.Debug.Printf("ino%d: backing file was deleted, returning ESTALE", f.qIno.Ino)
+		errno = syscall.ESTALE
+	}
+	atomic.StoreUint32(&f.staleErrno, uint32(errno))
+	return errno
+}
+
+// fstatStale is checkStale for Read and Write, which do not stat the file
+// anyway. To keep the Fstat off the hot path, the result of the last check
+// is reused for the rest of the second.
+func (f *File) fstatStale() syscall.Errno {
+	now := uint32(time.Now().Unix())
+	if atomic.SwapUint32(&f.staleChecked, now) == now {
+		return syscall.Errno(atomic.LoadUint32(&f.staleErrno))
+	}
+	var st syscall.Stat_t
+	if err := syscall.Fstat(f.intFd(), &st); err != nil {
+		return fs.ToErrno(err)
+	}
+	return f.checkStale(&st)
+}
+
+// lastLink finds out if deleting the name "cName" in "dirfd" deletes the
+// last name of a regular file, which may be open.
+func lastLink(dirfd int, cName string) (qi inomap.QIno, ok bool) {
+	st, err := syscallcompat.Fstatat2(dirfd, cName, unix.AT_SYMLINK_NOFOLLOW)
+	if err != nil || st.Mode&syscall.S_IFMT != syscall.S_IFREG || st.Nlink != 1 {
+		return qi, false
+	}
+	return inomap.QInoFromStat(st), true
+}
+
+// deleteName runs "del", which deletes the name "cName" in "dirfd" by unlink
+// or by renaming over it. If that is the last name of a file, open handles
+// of the file see it as deleted by us while "del" runs and, if it
+// succeeds, afterwards, so that checkStale does not report them as stale.
+func deleteName(dirfd int, cName string, del func() error) error {
+	qi, last := lastLink(dirfd, cName)
+	if !last {
+		return del()
+	}
+	openfiletable.BeginDelete(qi)
+	err := del()
+	openfiletable.EndDelete(qi, err == nil)
+	return err
+}
@@ -0,0 +1,160 @@
+package fusefrontend
+
+import (
+	"path/filepath"
+	"sync/atomic"
+	"syscall"
+	"testing"
+
+	"github.com/hanwen/go-fuse/v2/fuse"
+
+	"github.com/rfjakob/gocryptfs/internal/openfiletable"
+	"github.com/rfjakob/gocryptfs/internal/syscallcompat"
+	"github.com/rfjakob/gocryptfs/tests/test_helpers"
+)
+
+// TestStale deletes the backing files of open files behind our back and
+// checks that Getattr, Read and Write return ESTALE. Files deleted through
+// the mount must keep working.
+func TestStale(t *testing.T) {
+	cipherdir := test_helpers.InitFS(t)
+	rn := newTestFS(Args{Cipherdir: cipherdir})
+	for _, name := range []string{"external", "external2", "unlinked", "target", "renamed"} {
+		writeTestFile(t, &rn.Node, name, 5000)
+	}
+	open := func(name string) *File {
+		fh, _, errno := lookupChild(t, &rn.Node, name).Open(nil, syscall.O_RDWR)
+		if errno != 0 {
+			t.Fatal(errno)
+		}
+		return fh.(*File)
+	}
+	// check calls Getattr, Read and Write and compares the errors with "want"
+	check := func(name string, f *File, want syscall.Errno) {
+		if errno := f.Getattr(nil, &fuse.AttrOut{}); errno != want {
+			t.Errorf("%s: Getattr: want %v, have %v", name, want, errno)
+		}
+		if _, errno := f.Read(nil, make([]byte, 100), 0); errno != want {
+			t.Errorf("%s: Read: want %v, have %v", name, want, errno)
+		}
+		if _, errno := f.Write(nil, []byte("x"), 10); errno != want {
+			t.Errorf("%s: Write: want %v, have %v", name, want, errno)
+		}
+	}
+	files := make(map[string]*File)
+	for _, name := range []string{"external", "unlinked", "target"} {
+		files[name] = open(name)
+		defer files[name].Release(nil)
+		check(name, files[name], 0)
+	}
+
+	dirfd, cName, err := rn.openBackingDir("external")
+	if err != nil {
+		t.Fatal(err)
+	}
+	syscall.Close(dirfd)
+	if err = syscall.Unlink(filepath.Join(cipherdir, cName)); err != nil {
+		t.Fatal(err)
+	}
+	check("external", files["external"], syscall.ESTALE)
+	// Read and Write find out on their own, without a Getattr before
+	ext2 := open("external2")
+	defer ext2.Release(nil)
+	check("external2", ext2, 0)
+	dirfd, cName, err = rn.openBackingDir("external2")
+	if err != nil {
+		t.Fatal(err)
+	}
+	syscall.Close(dirfd)
+	if err = syscall.Unlink(filepath.Join(cipherdir, cName)); err != nil {
+		t.Fatal(err)
+	}
+	// Forget when the last check was
+	atomic.StoreUint32(&ext2.staleChecked, 0)
+	if _, errno := ext2.Read(nil, make([]byte, 100), 0); errno != syscall.ESTALE {
+		t.Errorf("external2: Read: want ESTALE, have %v", errno)
+	}
+	if _, errno := ext2.Write(nil, []byte("x"), 10); errno != syscall.ESTALE {
+		t.Errorf("external2: Write: want ESTALE, have %v", errno)
+	}
+
+	if errno := rn.Unlink(nil, "unlinked"); errno != 0 {
+		t.Fatal(errno)
+	}
+	check("unlinked", files["unlinked"], 0)
+	if errno := rn.Rename(nil, "renamed", rn, "target", 0); errno != 0 {
+		t.Fatal(errno)
+	}
+	check("target", files["target"], 0)
+}
+
+// TestStaleDeleteWindow checks that open files whose last name is being
+// deleted through the mount are not reported as stale while the delete
+// runs, also when they are opened in the middle of it, and that ESTALE is
+// not sticky.
+func TestStaleDeleteWindow(t *testing.T) {
+	cipherdir := test_helpers.InitFS(t)
+	rn := newTestFS(Args{Cipherdir: cipherdir})
+	writeTestFile(t, &rn.Node, "f", 5000)
+	dirfd, cName, err := rn.openBackingDir("f")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer syscall.Close(dirfd)
+	qi, ok := lastLink(dirfd, cName)
+	if !ok {
+		t.Fatal("lastLink: not the last link")
+	}
+	read := func(f *File) syscall.Errno {
+		// Forget when the last check was
+		atomic.StoreUint32(&f.staleChecked, 0)
+		_, errno := f.Read(nil, make([]byte, 100), 0)
+		return errno
+	}
+
+	// Not open when the delete starts, opened before it is done
+	openfiletable.BeginDelete(qi)
+	fh, _, errno := lookupChild(t, &rn.Node, "f").Open(nil, syscall.O_RDWR)
+	if errno != 0 {
+		t.Fatal(errno)
+	}
+	f := fh.(*File)
+	defer f.Release(nil)
+	if err = syscallcompat.Unlinkat(dirfd, cName, 0); err != nil {
+		t.Fatal(err)
+	}
+	if errno = read(f); errno != 0 {
+		t.Errorf("during the delete: %v", errno)
+	}
+	openfiletable.EndDelete(qi, true)
+	if errno = read(f); errno != 0 {
+		t.Errorf("after the delete: %v", errno)
+	}
+
+	// A failed delete does not mark the file, and ESTALE goes away once the
+	// file is known to be deleted by us
+	writeTestFile(t, &rn.Node, "g", 5000)
+	fh, _, errno = lookupChild(t, &rn.Node, "g").Open(nil, syscall.O_RDWR)
+	if errno != 0 {
+		t.Fatal(errno)
+	}
+	g := fh.(*File)
+	defer g.Release(nil)
+	openfiletable.BeginDelete(g.qIno)
+	openfiletable.EndDelete(g.qIno, false)
+	dirfd2, cName, err := rn.openBackingDir("g")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer syscall.Close(dirfd2)
+	if err = syscallcompat.Unlinkat(dirfd2, cName, 0); err != nil {
+		t.Fatal(err)
+	}
+	if errno = read(g); errno != syscall.ESTALE {
+		t.Errorf("deleted behind our back: want ESTALE, have %v", errno)
+	}
+	openfiletable.MarkDeleted(g.qIno)
+	if errno = read(g); errno != 0 {
+		t.Errorf("ESTALE is sticky: %v", errno)
+	}
+}
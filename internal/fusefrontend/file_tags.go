@@ -0,0 +1,195 @@
+package fusefrontend
+
+import (
+	"context"
+	"io"
+	"os"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/hanwen/go-fuse/v2/fs"
+	"golang.org/x/sys/unix"
+
+	"github.com/rfjakob/gocryptfs/internal/contentenc"
+	"github.com/rfjakob/gocryptfs/internal/inomap"
+	"github.com/rfjakob/gocryptfs/internal/openfiletable"
+	"github.com/rfjakob/gocryptfs/internal/syscallcompat"
+	"github.com/rfjakob/gocryptfs/internal/tlog"
+)
+
+// tagsXattr is the virtual xattr that reads and writes the file tags, which
+// are stored in the tags region after the file header. See "-filetags".
+const tagsXattr = "user.gocryptfs.tags"
+
+// Only warn once
+var tagsWarnOnce sync.Once
+
+// tagsNotSupported explains once why tags do not work and returns ENOTSUP
+func tagsNotSupported() syscall.Errno {
+	tagsWarnOnce.Do(func() {
+		tlog.Warn.Printf("%s: the filesystem has been created without -filetags, file tags are not available", tagsXattr)
+	})
+	return syscall.ENOTSUP
+}
+
+// readTags reads the file header and the tags region through "readAt".
+// Returns nil tags and a nil header if the file is too short to have a
+// tags region, like an empty file.
+func (rn *RootNode) readTags(readAt func([]byte, int64) (int, error)) (tags []byte, h *contentenc.FileHeader, err error) {
+	buf := make([]byte, rn.contentEnc.HeaderLen())
+	if _, err = readAt(buf, 0); err == io.EOF {
+		return nil, nil, nil
+	} else if err != nil {
+		return nil, nil, err
+	}
+	h, err = contentenc.ParseHeader(buf[:contentenc.HeaderLen])
+	if err != nil {
+		return nil, nil, err
+	}
+	tags, err = rn.contentEnc.DecryptTags(buf[contentenc.HeaderLen:], h.ID)
+	if err != nil {
+		return nil, nil, err
+	}
+	return tags, h, nil
+}
+
+// openTags opens the backing file of "n" for reading or writing the tags and
+// registers it in the open file table, so that it shares the ContentLock
+// with open file handles. The caller must call the returned "done" function.
+func (n *Node) openTags(ctx context.Context, flags int) (f *os.File, entry *openfiletable.Entry, done func(), errno syscall.Errno) {
+	dirfd, cName, errno := n.prepareAtSyscall(ctx, "")
+	if errno != 0 {
+		return nil, nil, nil, errno
+	}
+	fd, err := syscallcompat.Openat(dirfd, cName, flags|syscall.O_NOFOLLOW|syscall.O_NONBLOCK, 0)
+	syscall.Close(dirfd)
+	if err == syscall.ELOOP {
+		// Symlinks have no header
+		return nil, nil, nil, syscall.ENOTSUP
+	} else if err != nil {
+		return nil, nil, nil, fs.ToErrno(err)
+	}
+	f = os.NewFile(uintptr(fd), cName)
+	var st syscall.Stat_t
+	if err = syscall.Fstat(fd, &st); err != nil {
+		f.Close()
+		return nil, nil, nil, fs.ToErrno(err)
+	}
+	if st.Mode&syscall.S_IFMT != syscall.S_IFREG {
+		// Only regular files have a header
+		f.Close()
+		return nil, nil, nil, syscall.ENOTSUP
+	}
+	qi := inomap.QInoFromStat(&st)
+	entry = openfiletable.Register(qi)
+	done = func() {
+		openfiletable.Unregister(qi)
+		f.Close()
+	}
+	return f, entry, done, 0
+}
+
+// getTags returns the file tags of "n". ENODATA means there are none.
+func (n *Node) getTags(ctx context.Context) ([]byte, syscall.Errno) {
+	rn := n.rootNode()
+	if !rn.args.FileTags {
+		return nil, tagsNotSupported()
+	}
+	f, entry, done, errno := n.openTags(ctx, syscall.O_RDONLY)
+	if errno != 0 {
+		return nil, errno
+	}
+	defer done()
+	entry.ContentLock.RLock()
+	tags, _, err := rn.readTags(f.ReadAt)
+	entry.ContentLock.RUnlock()
+	if err != nil {
+		tlog.Warn.Printf("getTags %q: %v", f.Name(), err)
+		return nil, syscall.EIO
+	}
+	if len(tags) == 0 {
+		return nil, syscall.ENODATA
+	}
+	return tags, 0
+}
+
+// setTags replaces the file tags of "n" by "tags". Empty "tags" remove them.
+// "flags" are the XATTR_CREATE and XATTR_REPLACE flags of Setxattr.
+//
+// The tags region is rewritten in place, the file ID and the data blocks
+// stay as they are. An empty file gets a new header. The atime and mtime of
+// the backing file are kept, tags are metadata.
+func (n *Node) setTags(ctx context.Context, tags []byte, flags int) syscall.Errno {
+	rn := n.rootNode()
+	if !rn.args.FileTags {
+		return tagsNotSupported()
+	}
+	if len(tags) > contentenc.TagsMaxLen {
+		return syscall.E2BIG
+	}
+	if errno := n.unionCopyUp(); errno != 0 {
+		return errno
+	}
+	f, entry, done, errno := n.openTags(ctx, syscall.O_RDWR)
+	if errno != 0 {
+		return errno
+	}
+	defer done()
+	entry.ContentLock.Lock()
+	defer entry.ContentLock.Unlock()
+	fd := int(f.Fd())
+	times := backingTimes(fd)
+	oldTags, h, err := rn.readTags(f.ReadAt)
+	if err != nil {
+		tlog.Warn.Printf("setTags %q: %v", f.Name(), err)
+		return syscall.EIO
+	}
+	if flags&unix.XATTR_CREATE != 0 && len(oldTags) > 0 {
+		return syscall.EEXIST
+	}
+	if flags&unix.XATTR_REPLACE != 0 && len(oldTags) == 0 {
+		return syscall.ENODATA
+	}
+	if h == nil && len(tags) == 0 {
+		// Nothing to remove
+		return 0
+	}
+	var buf []byte
+	var off int64
+	if h == nil {
+		// The file is empty. The data blocks that may follow use the
+		// new file ID.
+		h = contentenc.RandomHeader()
+		buf = rn.contentEnc.PackHeader(h, tags)
+		if !rn.args.NoPrealloc {
+			if err = syscallcompat.EnospcPrealloc(fd, 0, int64(len(buf))); err != nil {
+				return fs.ToErrno(err)
+			}
+		}
+	} else {
+		buf = rn.contentEnc.PackHeader(h, tags)[contentenc.HeaderLen:]
+		off = contentenc.HeaderLen
+	}
+	if _, err = f.WriteAt(buf, off); err != nil {
+		return fs.ToErrno(err)
+	}
+	entry.IDLock.Lock()
+	entry.ID = h.ID
+	entry.IDLock.Unlock()
+	if times != nil {
+		atime := time.Unix(times[0].Unix())
+		mtime := time.Unix(times[1].Unix())
+		if err = syscallcompat.FutimesNano(fd, &atime, &mtime); err != nil {
+			tlog.Warn.Printf("setTags %q: restoring timestamps: %v", f.Name(), err)
+		}
+	}
+	if rn.args.FileHash {
+		// The checksum covers the whole backing file, including the tags
+		entry.FileHash.Invalidate()
+		if err = entry.FileHash.Store(fd); err != nil {
+			tlog.Warn.Printf("setTags %q: storing the file hash: %v", f.Name(), err)
+		}
+	}
+	return 0
+}
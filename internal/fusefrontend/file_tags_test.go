@@ -0,0 +1,146 @@
+package fusefrontend
+
+import (
+	"bytes"
+	"io/ioutil"
+	"path/filepath"
+	"strings"
+	"syscall"
+	"testing"
+
+	"github.com/hanwen/go-fuse/v2/fuse"
+	"golang.org/x/sys/unix"
+
+	"github.com/rfjakob/gocryptfs/internal/contentenc"
+	"github.com/rfjakob/gocryptfs/tests/test_helpers"
+)
+
+// getTagsXattr reads tagsXattr of "n"
+func getTagsXattr(t *testing.T, n *Node) ([]byte, syscall.Errno) {
+	buf := make([]byte, contentenc.TagsMaxLen)
+	sz, errno := n.Getxattr(nil, tagsXattr, buf)
+	if errno != 0 {
+		return nil, errno
+	}
+	return buf[:sz], 0
+}
+
+// TestFileTags sets tags, reads them back after a remount, and checks that
+// they are stored encrypted and survive writes, truncation and rotation.
+func TestFileTags(t *testing.T) {
+	cipherdir := test_helpers.InitFS(t, "-filetags")
+	args := Args{Cipherdir: cipherdir, FileTags: true}
+	rn := newTestFS(args)
+	tags := []byte("holiday,beach")
+
+	// An empty file gets a header for the tags, but stays empty
+	writeRotateFile(t, rn, "empty", nil, 0)
+	n := lookupChild(t, &rn.Node, "empty")
+	if errno := n.Setxattr(nil, tagsXattr, tags, 0); errno != 0 {
+		t.Fatal(errno)
+	}
+	var out fuse.AttrOut
+	if errno := n.Getattr(nil, nil, &out); errno != 0 {
+		t.Fatal(errno)
+	}
+	if out.Size != 0 {
+		t.Errorf("empty file with tags: size %d", out.Size)
+	}
+	_, f := openTestFile(t, rn, "empty", syscall.O_RDWR)
+	if _, errno := f.Write(nil, []byte("after"), 0); errno != 0 {
+		t.Fatal(errno)
+	}
+	f.Release(nil)
+
+	writeRotateFile(t, rn, "f", []byte("content"), 0)
+	n = lookupChild(t, &rn.Node, "f")
+	if errno := n.Setxattr(nil, tagsXattr, make([]byte, contentenc.TagsMaxLen+1), 0); errno != syscall.E2BIG {
+		t.Errorf("oversized value: want E2BIG, got %v", errno)
+	}
+	if errno := n.Setxattr(nil, tagsXattr, make([]byte, contentenc.TagsMaxLen), 0); errno != 0 {
+		t.Errorf("value of the maximum size: %v", errno)
+	}
+	if errno := n.Setxattr(nil, tagsXattr, tags, 0); errno != 0 {
+		t.Fatal(errno)
+	}
+	if errno := n.Setxattr(nil, tagsXattr, tags, unix.XATTR_CREATE); errno != syscall.EEXIST {
+		t.Errorf("XATTR_CREATE: want EEXIST, got %v", errno)
+	}
+	buf := make([]byte, 1000)
+	sz, errno := n.Listxattr(nil, buf)
+	if errno != 0 {
+		t.Fatal(errno)
+	}
+	if !strings.Contains(string(buf[:sz]), tagsXattr) {
+		t.Errorf("%s is not listed: %q", tagsXattr, buf[:sz])
+	}
+	cName, err := rn.EncryptPath("f")
+	if err != nil {
+		t.Fatal(err)
+	}
+	cData, err := ioutil.ReadFile(filepath.Join(cipherdir, cName))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if bytes.Contains(cData, tags) {
+		t.Error("plaintext tags in CIPHERDIR")
+	}
+	if want := rn.contentEnc.PlainSizeToCipherSize(7); uint64(len(cData)) != want {
+		t.Errorf("backing file size: want %d, have %d", want, len(cData))
+	}
+	if have := readChildFile(t, &rn.Node, "f"); have != "content" {
+		t.Errorf("content: have %q", have)
+	}
+
+	// Truncate to zero drops the header, but not the tags
+	_, f = openTestFile(t, rn, "f", syscall.O_RDWR)
+	in := fuse.SetAttrIn{SetAttrInCommon: fuse.SetAttrInCommon{Valid: fuse.FATTR_SIZE}}
+	if errno := f.Setattr(nil, &in, &out); errno != 0 {
+		t.Fatal(errno)
+	}
+	f.Release(nil)
+
+	// Remount, the new file IDs must carry the tags along
+	if _, err = rn.RotateFileIDs(filepath.Join(cipherdir, "gocryptfs.conf.rotate"), nil); err != nil {
+		t.Fatal(err)
+	}
+	rn = newTestFS(args)
+	for _, name := range []string{"empty", "f"} {
+		n, errno := lookup(t, &rn.Node, name)
+		if errno != 0 {
+			t.Fatal(errno)
+		}
+		have, errno := getTagsXattr(t, n)
+		if errno != 0 {
+			t.Fatalf("%s: %v", name, errno)
+		}
+		if !bytes.Equal(have, tags) {
+			t.Errorf("%s: have %q, want %q", name, have, tags)
+		}
+	}
+	if have := readChildFile(t, &rn.Node, "empty"); have != "after" {
+		t.Errorf("content: have %q", have)
+	}
+	if have := readChildFile(t, &rn.Node, "f"); have != "" {
+		t.Errorf("truncated content: have %q", have)
+	}
+
+	n = lookupChild(t, &rn.Node, "f")
+	if errno := n.Removexattr(nil, tagsXattr); errno != 0 {
+		t.Fatal(errno)
+	}
+	if errno := n.Removexattr(nil, tagsXattr); errno != syscall.ENODATA {
+		t.Errorf("second remove: want ENODATA, got %v", errno)
+	}
+	if _, errno := getTagsXattr(t, n); errno != syscall.ENODATA {
+		t.Errorf("removed tags: want ENODATA, got %v", errno)
+	}
+
+	// Filesystems without -filetags have no place for them
+	rn = newTestFS(Args{Cipherdir: test_helpers.InitFS(t)})
+	createFile(t, &rn.Node, "f", []byte("x"))
+	n = lookupChild(t, &rn.Node, "f")
+	if errno := n.Setxattr(nil, tagsXattr, tags, 0); errno != syscall.ENOTSUP {
+		t.Errorf("without -filetags: want ENOTSUP, got %v", errno)
+	}
+}
@@ -0,0 +1,383 @@
+package fusefrontend
+
+import (
+	"bytes"
+	"fmt"
+	"math/rand"
+	"syscall"
+	"testing"
+
+	"golang.org/x/sys/unix"
+
+	"github.com/hanwen/go-fuse/v2/fuse"
+
+	"github.com/rfjakob/gocryptfs/internal/contentenc"
+	"github.com/rfjakob/gocryptfs/internal/syscallcompat"
+	"github.com/rfjakob/gocryptfs/tests/test_helpers"
+)
+
+// TestWriteBlocksPlusTail overwrites an existing file with writes that are a
+// whole number of blocks plus a partial tail, at aligned and unaligned
+// offsets. The last block of such a write is shorter than a full block and
+// must go through read-modify-write without losing the old data behind it.
+func TestWriteBlocksPlusTail(t *testing.T) {
+	rn := newTestFS(Args{Cipherdir: test_helpers.InitFS(t)})
+	bs := int(rn.contentEnc.PlainBS())
+	ch, fh, _, errno := rn.Create(nil, "foo", syscall.O_RDWR, 0600, &fuse.EntryOut{})
+	if errno != 0 {
+		t.Fatal(errno)
+	}
+	rn.AddChild("foo", ch, true)
+	f := fh.(*File)
+	defer f.Release(nil)
+	rnd := rand.New(rand.NewSource(1))
+	want := make([]byte, 10*bs)
+	rnd.Read(want)
+	if _, errno = f.Write(nil, want, 0); errno != 0 {
+		t.Fatal(errno)
+	}
+	for _, off := range []int{0, 100, bs - 1, bs} {
+		for _, blocks := range []int{1, 2, 3} {
+			for _, tail := range []int{1, 100, bs - 1} {
+				data := make([]byte, blocks*bs+tail)
+				rnd.Read(data)
+				n, errno := f.Write(nil, data, int64(off))
+				if errno != 0 || int(n) != len(data) {
+					t.Fatalf("off=%d len=%d: n=%d errno=%v", off, len(data), n, errno)
+				}
+				copy(want[off:], data)
+				buf := make([]byte, len(want)+1)
+				res, errno := f.Read(nil, buf, 0)
+				if errno != 0 {
+					t.Fatal(errno)
+				}
+				if have, _ := res.Bytes(buf); !bytes.Equal(have, want) {
+					t.Fatalf("off=%d len=%d: content mismatch", off, len(data))
+				}
+			}
+		}
+	}
+}
+
+// TestPwriteMiddle does small writes into the middle of blocks of an existing
+// file, like editors and databases do, and checks that only the targeted
+// bytes change. The ciphertext of blocks the write does not touch must stay
+// the same.
+func TestPwriteMiddle(t *testing.T) {
+	cipherdir := test_helpers.InitFS(t)
+	rn := newTestFS(Args{Cipherdir: cipherdir})
+	bs := int(rn.contentEnc.PlainBS())
+	cbs := int(rn.contentEnc.CipherBS())
+	ch, fh, _, errno := rn.Create(nil, "foo", syscall.O_RDWR, 0600, &fuse.EntryOut{})
+	if errno != 0 {
+		t.Fatal(errno)
+	}
+	rn.AddChild("foo", ch, true)
+	f := fh.(*File)
+	defer f.Release(nil)
+	rnd := rand.New(rand.NewSource(1))
+	// The last block is partial
+	want := make([]byte, 10*bs+500)
+	rnd.Read(want)
+	if _, errno = f.Write(nil, want, 0); errno != 0 {
+		t.Fatal(errno)
+	}
+	ciphertext := func() []byte {
+		buf := make([]byte, 20*cbs)
+		n, _ := syscall.Pread(f.intFd(), buf, 0)
+		return buf[:n]
+	}
+	testCases := []struct {
+		off, length int
+	}{
+		{1, 1},
+		{3*bs + 1, 3},
+		{4*bs + 100, 17},
+		{5*bs + 1, bs - 2},
+		// Straddles a block boundary
+		{6*bs - 1, 2},
+		{7*bs - 10, 20},
+		// Last byte of a full block, first byte of the next one
+		{8*bs - 1, 1},
+		{8 * bs, 1},
+		// In the partial last block
+		{10*bs + 10, 10},
+		{10*bs + 499, 1},
+	}
+	for _, tc := range testCases {
+		before := ciphertext()
+		data := make([]byte, tc.length)
+		rnd.Read(data)
+		n, errno := f.Write(nil, data, int64(tc.off))
+		if errno != 0 || int(n) != len(data) {
+			t.Fatalf("off=%d len=%d: n=%d errno=%v", tc.off, tc.length, n, errno)
+		}
+		copy(want[tc.off:], data)
+		buf := make([]byte, len(want)+100)
+		res, errno := f.Read(nil, buf, 0)
+		if errno != 0 {
+			t.Fatal(errno)
+		}
+		have, _ := res.Bytes(buf)
+		if len(have) != len(want) {
+			t.Fatalf("off=%d len=%d: size changed from %d to %d", tc.off, tc.length, len(want), len(have))
+		}
+		for i := range want {
+			if have[i] != want[i] {
+				t.Fatalf("off=%d len=%d: first wrong byte at offset %d", tc.off, tc.length, i)
+			}
+		}
+		after := ciphertext()
+		first, last := tc.off/bs, (tc.off+tc.length-1)/bs
+		for blockNo := 0; blockNo*cbs < len(before); blockNo++ {
+			if blockNo >= first && blockNo <= last {
+				continue
+			}
+			c0 := contentenc.HeaderLen + blockNo*cbs
+			c1 := c0 + cbs
+			if c1 > len(before) {
+				c1 = len(before)
+			}
+			if c0 < c1 && !bytes.Equal(before[c0:c1], after[c0:c1]) {
+				t.Errorf("off=%d len=%d: untouched block %d was rewritten", tc.off, tc.length, blockNo)
+			}
+		}
+	}
+}
+
+// TestWriteExtendPartial writes a few bytes at and just past the end of files
+// whose last block is partial or complete. The block the write goes to
+// exists only in part or not at all, and must be read as the old data over
+// zeros. Every write goes through a new file handle, so writePadHole always
+// checks the file size.
+func TestWriteExtendPartial(t *testing.T) {
+	cipherdir := test_helpers.InitFS(t)
+	testWriteExtendPartial(t, newTestFS(Args{Cipherdir: cipherdir}), "default")
+	testWriteExtendPartial(t, newTestFS(Args{Cipherdir: cipherdir, WriteBuffer: true}), "writebuffer")
+	testWriteExtendPartial(t, newTestFS(Args{Cipherdir: cipherdir, Sparse: true}), "sparse")
+}
+
+func testWriteExtendPartial(t *testing.T, rn *RootNode, prefix string) {
+	bs := int(rn.contentEnc.PlainBS())
+	testCases := []struct {
+		size, off int
+	}{
+		// Appends to a partial last block
+		{bs + 904, bs + 904},
+		{1, 1},
+		// A gap in the partial last block
+		{bs + 904, bs + 910},
+		{bs + 904, 2*bs - 3},
+		// The file ends on a block boundary, the write starts a new block
+		{bs, bs},
+		{bs, bs + 100},
+		// The write goes into the block after the partial last block, which
+		// has to be padded first
+		{bs + 904, 2*bs + 10},
+		// Empty file
+		{0, 0},
+		{0, 100},
+		{0, bs + 100},
+	}
+	rnd := rand.New(rand.NewSource(1))
+	for i, tc := range testCases {
+		name := fmt.Sprintf("%s%d", prefix, i)
+		ch, fh, _, errno := rn.Create(nil, name, syscall.O_RDWR, 0600, &fuse.EntryOut{})
+		if errno != 0 {
+			t.Fatal(errno)
+		}
+		rn.AddChild(name, ch, true)
+		n := toNode(ch.Operations())
+		want := make([]byte, tc.size)
+		rnd.Read(want)
+		if tc.size > 0 {
+			if _, errno = fh.(*File).Write(nil, want, 0); errno != 0 {
+				t.Fatal(errno)
+			}
+		}
+		fh.(*File).Release(nil)
+
+		data := make([]byte, 5)
+		rnd.Read(data)
+		fh, _, errno = n.Open(nil, syscall.O_RDWR)
+		if errno != 0 {
+			t.Fatal(errno)
+		}
+		f := fh.(*File)
+		if written, errno := f.Write(nil, data, int64(tc.off)); errno != 0 || int(written) != len(data) {
+			t.Fatalf("%s: size=%d off=%d: n=%d errno=%v", prefix, tc.size, tc.off, written, errno)
+		}
+		f.Release(nil)
+		want = append(want, make([]byte, tc.off+len(data)-tc.size)...)
+		copy(want[tc.off:], data)
+
+		var a fuse.AttrOut
+		if errno := n.Getattr(nil, nil, &a); errno != 0 {
+			t.Fatal(errno)
+		}
+		if int(a.Size) != len(want) {
+			t.Errorf("%s: size=%d off=%d: reported size %d, want %d", prefix, tc.size, tc.off, a.Size, len(want))
+		}
+		fh, _, errno = n.Open(nil, syscall.O_RDONLY)
+		if errno != 0 {
+			t.Fatal(errno)
+		}
+		buf := make([]byte, len(want)+100)
+		res, errno := fh.(*File).Read(nil, buf, 0)
+		fh.(*File).Release(nil)
+		if errno != 0 {
+			t.Fatalf("%s: size=%d off=%d: read: %v", prefix, tc.size, tc.off, errno)
+		}
+		if have, _ := res.Bytes(buf); !bytes.Equal(have, want) {
+			t.Errorf("%s: size=%d off=%d: content mismatch, have %d bytes, want %d", prefix, tc.size, tc.off, len(have), len(want))
+		}
+	}
+}
+
+// TestFirstWriteSize writes less than a block to a new, empty file. The
+// read-modify-write read finds no data, and the block on disk must contain
+// only the written bytes: the file size is the length of the write, not a
+// full block.
+func TestFirstWriteSize(t *testing.T) {
+	cipherdir := test_helpers.InitFS(t)
+	for _, args := range []Args{
+		{Cipherdir: cipherdir},
+		{Cipherdir: cipherdir, WriteBuffer: true},
+		{Cipherdir: cipherdir, AlignedWrites: true},
+	} {
+		rn := newTestFS(args)
+		bs := int(rn.contentEnc.PlainBS())
+		for _, size := range []int{1, 100, bs - 1} {
+			name := fmt.Sprintf("%d.%v.%v", size, args.WriteBuffer, args.AlignedWrites)
+			ch, fh, _, errno := rn.Create(nil, name, syscall.O_RDWR, 0600, &fuse.EntryOut{})
+			if errno != 0 {
+				t.Fatal(errno)
+			}
+			rn.AddChild(name, ch, true)
+			f := fh.(*File)
+			data := bytes.Repeat([]byte{'a'}, size)
+			if n, errno := f.Write(nil, data, 0); errno != 0 || int(n) != size {
+				t.Fatalf("%s: n=%d errno=%v", name, n, errno)
+			}
+			var out fuse.AttrOut
+			if errno = f.Getattr(nil, &out); errno != 0 {
+				t.Fatal(errno)
+			}
+			if out.Size != uint64(size) {
+				t.Errorf("%s: open file reports size %d", name, out.Size)
+			}
+			f.Release(nil)
+			if errno = toNode(ch.Operations()).Getattr(nil, nil, &out); errno != 0 {
+				t.Fatal(errno)
+			}
+			if out.Size != uint64(size) {
+				t.Errorf("%s: st_size is %d", name, out.Size)
+			}
+			dirfd, cName, err := rn.openBackingDir(name)
+			if err != nil {
+				t.Fatal(err)
+			}
+			st, err := syscallcompat.Fstatat2(dirfd, cName, unix.AT_SYMLINK_NOFOLLOW)
+			syscall.Close(dirfd)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if want := rn.contentEnc.PlainSizeToCipherSize(uint64(size)); uint64(st.Size) != want {
+				t.Errorf("%s: ciphertext size is %d, want %d", name, st.Size, want)
+			}
+			if have := readChildFile(t, &rn.Node, name); have != string(data) {
+				t.Errorf("%s: read back %d bytes", name, len(have))
+			}
+		}
+	}
+}
+
+// TestWriteSpanningHole grows a file by truncate, which leaves a hole behind
+// the existing data, and then does single writes that cover existing data,
+// hole blocks and the space behind the end of the file in one go. The
+// read-modify-write reads of the partial blocks must see the old data in an
+// existing block and zeros in a hole block, and the whole file must read back
+// as the written data over the old content and zeros.
+func TestWriteSpanningHole(t *testing.T) {
+	cipherdir := test_helpers.InitFS(t)
+	testWriteSpanningHole(t, newTestFS(Args{Cipherdir: cipherdir}), "default")
+	testWriteSpanningHole(t, newTestFS(Args{Cipherdir: cipherdir, WriteBuffer: true}), "writebuffer")
+	testWriteSpanningHole(t, newTestFS(Args{Cipherdir: cipherdir, Sparse: true}), "sparse")
+}
+
+func testWriteSpanningHole(t *testing.T, rn *RootNode, prefix string) {
+	bs := int(rn.contentEnc.PlainBS())
+	// Existing data ends in the middle of block 1, the hole reaches into
+	// block 6
+	dataSize, holeEnd := bs+bs/2, 6*bs+200
+	testCases := []struct {
+		desc     string
+		off, end int
+	}{
+		{"existing data through the hole to behind the end", bs + 100, 8*bs + 300},
+		{"existing data into a hole block", bs + 100, 3*bs + 50},
+		{"within the existing block into the hole", 100, bs + bs/2 + 10},
+		{"partial hole block to behind the end", 2*bs + 10, 7 * bs},
+		{"partial hole block to the partial last block", 3*bs + 1, 6*bs + 100},
+		{"whole file", 0, 9 * bs},
+	}
+	rnd := rand.New(rand.NewSource(1))
+	for i, tc := range testCases {
+		name := fmt.Sprintf("%s%d", prefix, i)
+		ch, fh, _, errno := rn.Create(nil, name, syscall.O_RDWR, 0600, &fuse.EntryOut{})
+		if errno != 0 {
+			t.Fatal(errno)
+		}
+		rn.AddChild(name, ch, true)
+		n := toNode(ch.Operations())
+		f := fh.(*File)
+		want := make([]byte, holeEnd)
+		rnd.Read(want[:dataSize])
+		if _, errno = f.Write(nil, want[:dataSize], 0); errno != 0 {
+			t.Fatal(errno)
+		}
+		in := &fuse.SetAttrIn{SetAttrInCommon: fuse.SetAttrInCommon{Valid: fuse.FATTR_SIZE, Size: uint64(holeEnd)}}
+		if errno = f.Setattr(nil, in, &fuse.AttrOut{}); errno != 0 {
+			t.Fatal(errno)
+		}
+		data := make([]byte, tc.end-tc.off)
+		rnd.Read(data)
+		if written, errno := f.Write(nil, data, int64(tc.off)); errno != 0 || int(written) != len(data) {
+			t.Fatalf("%s: %s: n=%d errno=%v", prefix, tc.desc, written, errno)
+		}
+		f.Release(nil)
+		if tc.end > len(want) {
+			want = append(want, make([]byte, tc.end-len(want))...)
+		}
+		copy(want[tc.off:], data)
+
+		var a fuse.AttrOut
+		if errno := n.Getattr(nil, nil, &a); errno != 0 {
+			t.Fatal(errno)
+		}
+		if int(a.Size) != len(want) {
+			t.Errorf("%s: %s: reported size %d, want %d", prefix, tc.desc, a.Size, len(want))
+		}
+		fh, _, errno = n.Open(nil, syscall.O_RDONLY)
+		if errno != 0 {
+			t.Fatal(errno)
+		}
+		buf := make([]byte, len(want)+100)
+		res, errno := fh.(*File).Read(nil, buf, 0)
+		fh.(*File).Release(nil)
+		if errno != 0 {
+			t.Fatalf("%s: %s: read: %v", prefix, tc.desc, errno)
+		}
+		have, _ := res.Bytes(buf)
+		if len(have) != len(want) {
+			t.Errorf("%s: %s: read %d bytes, want %d", prefix, tc.desc, len(have), len(want))
+			continue
+		}
+		for j := range want {
+			if have[j] != want[j] {
+				t.Errorf("%s: %s: first difference at byte %d (block %d)", prefix, tc.desc, j, j/bs)
+				break
+			}
+		}
+	}
+}
@@ -0,0 +1,169 @@
+package fusefrontend
+
+// Write buffering for "-writebuffer"
+
+import (
+	"syscall"
+
+	"github.com/hanwen/go-fuse/v2/fuse"
+
+	"github.com/rfjakob/gocryptfs/internal/inomap"
+	"github.com/rfjakob/gocryptfs/internal/openfiletable"
+	"github.com/rfjakob/gocryptfs/internal/tlog"
+)
+
+// writeBuf holds data written to a file handle that does not fill a
+// complete block yet. The data is contiguous and starts at plaintext offset
+// "off".
+//
+// Everything that looks at the file content or size has to write out the
+// buffer first. To find it, the File registers flushWriteBuf as
+// fileTableEntry.PendingWrite while the buffer is not empty. There is at most
+// one non-empty buffer per file: a write through another handle flushes it.
+type writeBuf struct {
+	off  int64
+	data []byte
+	// err is set when writing out the buffer failed. The next Flush or
+	// Fsync of the handle returns it, so that close(2) or fsync(2) report
+	// the lost data also when the failed write was triggered by another
+	// operation.
+	err syscall.Errno
+}
+
+// bufferedWrite is Write with "-writebuffer": complete blocks are written
+// right away, the remainder is kept in f.wbuf until the next write completes
+// the block. The caller must hold ContentLock.Lock().
+func (f *File) bufferedWrite(data []byte, off int64) (uint32, syscall.Errno) {
+	n := uint32(len(data))
+	if len(f.wbuf.data) > 0 && off != f.wbuf.off+int64(len(f.wbuf.data)) {
+		// Not sequential
+		if errno := f.flushWriteBuf(); errno != 0 {
+			return 0, errno
+		}
+	}
+	if len(f.wbuf.data) == 0 {
+		// Another handle may have buffered data for this file
+		if errno := f.fileTableEntry.FlushPendingWrite(); errno != 0 {
+			return 0, errno
+		}
+		f.wbuf.off = off
+	}
+	f.wbuf.data = append(f.wbuf.data, data...)
+	bs := int64(f.contentEnc.PlainBS())
+	boundary := (f.wbuf.off + int64(len(f.wbuf.data))) / bs * bs
+	if boundary > f.wbuf.off {
+		split := boundary - f.wbuf.off
+		if errno := f.writeThroughChunked(f.wbuf.data[:split], f.wbuf.off); errno != 0 {
+			f.dropWriteBuf()
+			return 0, errno
+		}
+		f.wbuf.data = f.wbuf.data[:copy(f.wbuf.data, f.wbuf.data[split:])]
+		f.wbuf.off = boundary
+	}
+	if len(f.wbuf.data) > 0 {
+		f.fileTableEntry.PendingWrite = f.flushWriteBuf
+	} else {
+		f.fileTableEntry.PendingWrite = nil
+	}
+	return n, 0
+}
+
+// flushWriteBuf writes out the buffered data of this handle. The caller must
+// hold ContentLock.Lock(). Is also called through
+// fileTableEntry.PendingWrite by operations on other handles.
+func (f *File) flushWriteBuf() syscall.Errno {
+	if len(f.wbuf.data) == 0 {
+		return 0
+	}
+	tlog.Debug.Printf("ino%d fh%d: flushWriteBuf: off=%d len=%d", f.qIno.Ino, f.intFd(), f.wbuf.off, len(f.wbuf.data))
+	errno := f.writeThroughChunked(f.wbuf.data, f.wbuf.off)
+	if errno != 0 {
+		tlog.Warn.Printf("ino%d fh%d: writing %d buffered bytes at offset %d failed: %v",
+			f.qIno.Ino, f.intFd(), len(f.wbuf.data), f.wbuf.off, errno)
+		f.wbuf.err = errno
+	}
+	// Like after a failed write(2), the data is gone. The error is reported
+	// to whoever triggered the flush, and to the next Flush or Fsync of this
+	// handle.
+	f.dropWriteBuf()
+	return errno
+}
+
+// dropWriteBuf empties the buffer without writing it out.
+func (f *File) dropWriteBuf() {
+	f.wbuf.data = f.wbuf.data[:0]
+	f.fileTableEntry.PendingWrite = nil
+}
+
+// writeThroughChunked calls writeThrough in pieces that fit into the
+// request buffers.
+func (f *File) writeThroughChunked(data []byte, off int64) syscall.Errno {
+	for len(data) > 0 {
+		n := len(data)
+		if n > fuse.MAX_KERNEL_WRITE {
+			n = fuse.MAX_KERNEL_WRITE
+		}
+		if _, errno := f.writeThrough(data[:n], off); errno != 0 {
+			return errno
+		}
+		data = data[n:]
+		off += int64(n)
+	}
+	return 0
+}
+
+// flushPending writes out data buffered by any handle of this file. For
+// operations that only take ContentLock.RLock() themselves. No-op without
+// "-writebuffer".
+func (f *File) flushPending() syscall.Errno {
+	if !f.rootNode.args.WriteBuffer {
+		return 0
+	}
+	e := f.fileTableEntry
+	e.ContentLock.RLock()
+	pending := e.PendingWrite != nil
+	e.ContentLock.RUnlock()
+	if !pending {
+		return 0
+	}
+	f.rootNode.snapshotLock.RLock()
+	defer f.rootNode.snapshotLock.RUnlock()
+	e.ContentLock.Lock()
+	defer e.ContentLock.Unlock()
+	return e.FlushPendingWrite()
+}
+
+// flushOwnWriteBuf writes out the buffered data of this handle, for Flush,
+// Fsync and Release. Also returns, and clears, an error from an earlier
+// flush of the buffer that nobody has reported to this handle yet. No-op
+// without "-writebuffer".
+func (f *File) flushOwnWriteBuf() syscall.Errno {
+	if !f.rootNode.args.WriteBuffer {
+		return 0
+	}
+	f.rootNode.snapshotLock.RLock()
+	defer f.rootNode.snapshotLock.RUnlock()
+	f.fileTableEntry.ContentLock.Lock()
+	defer f.fileTableEntry.ContentLock.Unlock()
+	f.flushWriteBuf()
+	errno := f.wbuf.err
+	f.wbuf.err = 0
+	return errno
+}
+
+// flushPendingIno is flushPending for path-based operations. Returns true if
+// there was buffered data.
+func (rn *RootNode) flushPendingIno(qi inomap.QIno) (bool, syscall.Errno) {
+	e := openfiletable.Lookup(qi)
+	if e == nil {
+		return false, 0
+	}
+	rn.snapshotLock.RLock()
+	defer rn.snapshotLock.RUnlock()
+	e.ContentLock.Lock()
+	defer e.ContentLock.Unlock()
+	if e.PendingWrite == nil {
+		return false, 0
+	}
+	return true, e.FlushPendingWrite()
+}
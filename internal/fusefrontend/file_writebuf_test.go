@@ -0,0 +1,228 @@
+package fusefrontend
+
+import (
+	"bytes"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"syscall"
+	"testing"
+
+	"github.com/hanwen/go-fuse/v2/fuse"
+
+	"github.com/rfjakob/gocryptfs/tests/test_helpers"
+)
+
+// TestWriteBuffer interleaves small writes through two handles with reads and
+// stats through other handles and the path, and checks that everything sees
+// the buffered data.
+func TestWriteBuffer(t *testing.T) {
+	cipherdir := test_helpers.InitFS(t)
+	rn := newTestFS(Args{Cipherdir: cipherdir, WriteBuffer: true})
+	ch, fh, _, errno := rn.Create(nil, "foo", syscall.O_RDWR, 0600, &fuse.EntryOut{})
+	if errno != 0 {
+		t.Fatal(errno)
+	}
+	rn.AddChild("foo", ch, true)
+	w1 := fh.(*File)
+	defer w1.Release(nil)
+	n := ch.Operations().(*Node)
+	open := func(flags uint32) *File {
+		fh, _, errno := n.Open(nil, flags)
+		if errno != 0 {
+			t.Fatal(errno)
+		}
+		return fh.(*File)
+	}
+	w2 := open(syscall.O_RDWR)
+	defer w2.Release(nil)
+	r := open(syscall.O_RDONLY)
+	defer r.Release(nil)
+
+	// Sequential writes stay in the buffer until they complete a block
+	for i := 0; i < 100; i++ {
+		if _, errno = w1.Write(nil, []byte{byte(i)}, int64(i)); errno != 0 {
+			t.Fatal(errno)
+		}
+	}
+	dirfd, cName, err := rn.openBackingDir("foo")
+	if err != nil {
+		t.Fatal(err)
+	}
+	syscall.Close(dirfd)
+	if fi, err := os.Stat(filepath.Join(cipherdir, cName)); err != nil || fi.Size() != 0 {
+		t.Fatalf("data should still be buffered: %v, %v", fi.Size(), err)
+	}
+
+	rnd := rand.New(rand.NewSource(1))
+	var want []byte
+	for i := 0; i < 100; i++ {
+		want = append(want, byte(i))
+	}
+	seq := int64(len(want))
+	for i := 0; i < 2000; i++ {
+		switch rnd.Intn(10) {
+		case 0:
+			// Random write through the other handle
+			data := make([]byte, rnd.Intn(300)+1)
+			rnd.Read(data)
+			off := rnd.Intn(len(want) + 100)
+			if _, errno = w2.Write(nil, data, int64(off)); errno != 0 {
+				t.Fatal(errno)
+			}
+			if end := off + len(data); end > len(want) {
+				want = append(want, make([]byte, end-len(want))...)
+			}
+			copy(want[off:], data)
+		case 1:
+			buf := make([]byte, 10000)
+			off := rnd.Intn(len(want))
+			res, errno := r.Read(nil, buf, int64(off))
+			if errno != 0 {
+				t.Fatal(errno)
+			}
+			have, _ := res.Bytes(buf)
+			end := off + len(buf)
+			if end > len(want) {
+				end = len(want)
+			}
+			if !bytes.Equal(have, want[off:end]) {
+				t.Fatalf("op %d: read at %d: content mismatch", i, off)
+			}
+		case 2:
+			var out fuse.AttrOut
+			if errno := n.Getattr(nil, nil, &out); errno != 0 {
+				t.Fatal(errno)
+			}
+			if out.Size != uint64(len(want)) {
+				t.Fatalf("op %d: wrong size %d, want %d", i, out.Size, len(want))
+			}
+		default:
+			// Small sequential write
+			data := make([]byte, rnd.Intn(20)+1)
+			rnd.Read(data)
+			if _, errno = w1.Write(nil, data, seq); errno != 0 {
+				t.Fatal(errno)
+			}
+			if end := int(seq) + len(data); end > len(want) {
+				want = append(want, make([]byte, end-len(want))...)
+			}
+			copy(want[seq:], data)
+			seq += int64(len(data))
+		}
+	}
+	// After closing, the data is on disk
+	w1.Flush(nil)
+	rn2 := newTestFS(Args{Cipherdir: cipherdir})
+	f := lookupNode(t, rn2, "foo")
+	fh2, _, errno := f.Open(nil, syscall.O_RDONLY)
+	if errno != 0 {
+		t.Fatal(errno)
+	}
+	defer fh2.(*File).Release(nil)
+	buf := make([]byte, len(want)+1)
+	res, errno := fh2.(*File).Read(nil, buf, 0)
+	if errno != 0 {
+		t.Fatal(errno)
+	}
+	if have, _ := res.Bytes(buf); !bytes.Equal(have, want) {
+		t.Errorf("content on disk: have %d bytes, want %d", len(have), len(want))
+	}
+}
+
+// BenchmarkWriteByteByByte writes a file one byte at a time, with and
+// without -writebuffer.
+func BenchmarkWriteByteByByte(b *testing.B) {
+	for _, tc := range []struct {
+		name        string
+		writeBuffer bool
+	}{
+		{"direct", false},
+		{"writebuffer", true},
+	} {
+		b.Run(tc.name, func(b *testing.B) {
+			rn := newTestFS(Args{Cipherdir: test_helpers.InitFS(nil), WriteBuffer: tc.writeBuffer})
+			_, fh, _, errno := rn.Create(nil, "foo", syscall.O_RDWR, 0600, &fuse.EntryOut{})
+			if errno != 0 {
+				b.Fatal(errno)
+			}
+			f := fh.(*File)
+			defer f.Release(nil)
+			buf := []byte{'x'}
+			b.SetBytes(1)
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				if _, errno = f.Write(nil, buf, int64(i)); errno != 0 {
+					b.Fatal(errno)
+				}
+			}
+			if errno = f.Flush(nil); errno != 0 {
+				b.Fatal(errno)
+			}
+		})
+	}
+}
+
+// failingIO is a backingIO whose writes fail with EIO
+type failingIO struct {
+	backingIO
+}
+
+func (failingIO) WriteAt(p []byte, off int64) (int, error) {
+	return 0, syscall.EIO
+}
+
+// TestFlushReportsWriteError checks that a failed write of buffered data is
+// reported by the Flush of the handle, also when another handle triggered the
+// write and got the error first.
+func TestFlushReportsWriteError(t *testing.T) {
+	rn := newTestFS(Args{Cipherdir: test_helpers.InitFS(t), WriteBuffer: true})
+	ch, fh, _, errno := rn.Create(nil, "foo", syscall.O_RDWR, 0600, &fuse.EntryOut{})
+	if errno != 0 {
+		t.Fatal(errno)
+	}
+	rn.AddChild("foo", ch, true)
+	f := fh.(*File)
+	defer f.Release(nil)
+	bio := f.bio
+
+	// Flush of the handle itself fails
+	if _, errno = f.Write(nil, make([]byte, 100), 0); errno != 0 {
+		t.Fatal(errno)
+	}
+	f.bio = failingIO{bio}
+	if errno = f.Flush(nil); errno != syscall.EIO {
+		t.Errorf("Flush: want EIO, have %v", errno)
+	}
+	// The error is reported once
+	if errno = f.Flush(nil); errno != 0 {
+		t.Errorf("second Flush: want success, have %v", errno)
+	}
+
+	// Getattr through another handle flushes the buffer and fails
+	f.bio = bio
+	if _, errno = f.Write(nil, make([]byte, 100), 0); errno != 0 {
+		t.Fatal(errno)
+	}
+	f.bio = failingIO{bio}
+	fh2, _, errno := toNode(ch.Operations()).Open(nil, syscall.O_RDONLY)
+	if errno != 0 {
+		t.Fatal(errno)
+	}
+	f2 := fh2.(*File)
+	defer f2.Release(nil)
+	if errno = f2.Getattr(nil, &fuse.AttrOut{}); errno != syscall.EIO {
+		t.Errorf("Getattr: want EIO, have %v", errno)
+	}
+	if n := f.bufferedBytes(); n != 0 {
+		t.Errorf("%d bytes still buffered", n)
+	}
+	// fsync(2) on the handle that wrote the data still sees the error
+	if errno = f.Fsync(nil, 0); errno != syscall.EIO {
+		t.Errorf("Fsync: want EIO, have %v", errno)
+	}
+	if errno = f.Flush(nil); errno != 0 {
+		t.Errorf("Flush after Fsync: want success, have %v", errno)
+	}
+	f.bio = bio
+}
@@ -0,0 +1,99 @@
+package fusefrontend
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"syscall"
+	"testing"
+
+	"github.com/hanwen/go-fuse/v2/fuse"
+
+	"github.com/rfjakob/gocryptfs/internal/contentenc"
+	"github.com/rfjakob/gocryptfs/internal/filehash"
+	"github.com/rfjakob/gocryptfs/tests/test_helpers"
+)
+
+// TestFileHash writes a file with -filehash, verifies the stored checksum,
+// and checks that corrupting a block is detected.
+func TestFileHash(t *testing.T) {
+	cipherdir := test_helpers.InitFS(t)
+	rn := newTestFS(Args{Cipherdir: cipherdir, FileHash: true})
+	ch, fh, _, errno := rn.Create(nil, "foo", syscall.O_RDWR, 0600, &fuse.EntryOut{})
+	if errno != 0 {
+		t.Fatal(errno)
+	}
+	rn.AddChild("foo", ch, true)
+	// Sequential writes keep the running checksum valid
+	f := fh.(*File)
+	bs := int(rn.contentEnc.PlainBS())
+	for i := 0; i < 5; i++ {
+		if _, errno = f.Write(nil, bytes.Repeat([]byte{byte(i)}, bs), int64(i*bs)); errno != 0 {
+			t.Fatal(errno)
+		}
+	}
+	f.Release(nil)
+
+	dirfd, cName, err := rn.openBackingDir("foo")
+	if err != nil {
+		t.Fatal(err)
+	}
+	syscall.Close(dirfd)
+	cPath := filepath.Join(cipherdir, cName)
+	verify := func(want filehash.Status) {
+		t.Helper()
+		status, err := filehash.Verify(cPath)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if status != want {
+			t.Errorf("want %v, got %v", want, status)
+		}
+	}
+	verify(filehash.OK)
+
+	// A write in the middle invalidates the running checksum, it is
+	// recomputed on Release
+	fh, _, errno = ch.Operations().(*Node).Open(nil, syscall.O_RDWR)
+	if errno != 0 {
+		t.Fatal(errno)
+	}
+	if _, errno = fh.(*File).Write(nil, []byte("hello"), 100); errno != 0 {
+		t.Fatal(errno)
+	}
+	fh.(*File).Release(nil)
+	verify(filehash.OK)
+
+	// The xattr is not visible through the mount
+	if sz, errno := ch.Operations().(*Node).Listxattr(nil, nil); errno != 0 || sz != 0 {
+		t.Errorf("Listxattr: sz=%d errno=%v", sz, errno)
+	}
+
+	// Flip a byte in block 2, keeping size and mtime, like bit rot would
+	fi, err := os.Stat(cPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cf, err := os.OpenFile(cPath, os.O_RDWR, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	off := int64(contentenc.HeaderLen + 2*rn.contentEnc.CipherBS() + 50)
+	b := make([]byte, 1)
+	cf.ReadAt(b, off)
+	b[0] ^= 1
+	if _, err = cf.WriteAt(b, off); err != nil {
+		t.Fatal(err)
+	}
+	cf.Close()
+	if err = os.Chtimes(cPath, fi.ModTime(), fi.ModTime()); err != nil {
+		t.Fatal(err)
+	}
+	verify(filehash.Mismatch)
+
+	// A changed mtime means the file was modified without -filehash
+	if err = os.Chtimes(cPath, fi.ModTime(), fi.ModTime().Add(1)); err != nil {
+		t.Fatal(err)
+	}
+	verify(filehash.Stale)
+}
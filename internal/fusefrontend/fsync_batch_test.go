@@ -0,0 +1,89 @@
+package fusefrontend
+
+import (
+	"sync"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/rfjakob/gocryptfs/tests/test_helpers"
+)
+
+// interval is the time span of a call
+type interval struct {
+	start, end time.Time
+}
+
+// fsyncBurst writes and fsyncs "f" from "n" goroutines at once. Returns the
+// span of each fsync, and the span of each backing fsync.
+func fsyncBurst(t *testing.T, f *File, n int) (calls, backing []interval) {
+	var mu sync.Mutex
+	backingFsync = func(fd int) error {
+		iv := interval{start: time.Now()}
+		err := syscall.Fsync(fd)
+		iv.end = time.Now()
+		mu.Lock()
+		backing = append(backing, iv)
+		mu.Unlock()
+		return err
+	}
+	defer func() { backingFsync = syscall.Fsync }()
+
+	calls = make([]interval, n)
+	var wg sync.WaitGroup
+	for i := 0; i < n; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			if _, errno := f.Write(nil, []byte{byte(i)}, int64(i)); errno != 0 {
+				t.Error(errno)
+				return
+			}
+			calls[i].start = time.Now()
+			if errno := f.Fsync(nil, 0); errno != 0 {
+				t.Error(errno)
+			}
+			calls[i].end = time.Now()
+		}(i)
+	}
+	wg.Wait()
+	return calls, backing
+}
+
+// TestFsyncBatch fsyncs a file from many goroutines at once and checks that
+// "-fsync_batch" needs fewer backing fsyncs, and that each fsync still
+// returns only after a backing fsync that started after it was called.
+func TestFsyncBatch(t *testing.T) {
+	const n = 20
+	cipherdir := test_helpers.InitFS(t)
+	for _, window := range []time.Duration{0, 50 * time.Millisecond} {
+		rn := newTestFS(Args{Cipherdir: cipherdir, FsyncBatch: window})
+		name := "f" + window.String()
+		writeTestFile(t, &rn.Node, name, 0)
+		_, f := openTestFile(t, rn, name, syscall.O_RDWR)
+		calls, backing := fsyncBurst(t, f, n)
+		f.Release(nil)
+
+		if window == 0 {
+			if len(backing) != n {
+				t.Errorf("without batching: want %d backing fsyncs, have %d", n, len(backing))
+			}
+			continue
+		}
+		if len(backing) == 0 || len(backing) > n/4 {
+			t.Errorf("with batching: want between 1 and %d backing fsyncs, have %d", n/4, len(backing))
+		}
+		for i, c := range calls {
+			covered := false
+			for _, b := range backing {
+				if !b.start.Before(c.start) && !c.end.Before(b.end) {
+					covered = true
+					break
+				}
+			}
+			if !covered {
+				t.Errorf("fsync %d returned without a backing fsync that covers it", i)
+			}
+		}
+	}
+}
@@ -0,0 +1,51 @@
+package fusefrontend
+
+import (
+	"syscall"
+	"testing"
+
+	"github.com/hanwen/go-fuse/v2/fuse"
+)
+
+// createFile creates "name" in "n" with the content "data"
+func createFile(t *testing.T, n *Node, name string, data []byte) {
+	ch, fh, _, errno := n.Create(nil, name, syscall.O_RDWR, 0600, &fuse.EntryOut{})
+	if errno != 0 {
+		t.Fatalf("Create %q: %v", name, errno)
+	}
+	n.AddChild(name, ch, true)
+	if _, errno = fh.(*File).Write(nil, data, 0); errno != 0 {
+		t.Fatal(errno)
+	}
+	fh.(*File).Release(nil)
+}
+
+// lookup looks up "name" in "n" and attaches it to the inode tree
+func lookup(t *testing.T, n *Node, name string) (*Node, syscall.Errno) {
+	ch, errno := n.Lookup(nil, name, &fuse.EntryOut{})
+	if errno != 0 {
+		return nil, errno
+	}
+	n.AddChild(name, ch, true)
+	return toNode(ch.Operations()), 0
+}
+
+// readChildFile returns the content of "name" in "n"
+func readChildFile(t *testing.T, n *Node, name string) string {
+	ch, errno := lookup(t, n, name)
+	if errno != 0 {
+		t.Fatalf("Lookup %q: %v", name, errno)
+	}
+	fh, _, errno := ch.Open(nil, syscall.O_RDONLY)
+	if errno != 0 {
+		t.Fatal(errno)
+	}
+	defer fh.(*File).Release(nil)
+	buf := make([]byte, 100000)
+	res, errno := fh.(*File).Read(nil, buf, 0)
+	if errno != 0 {
+		t.Fatal(errno)
+	}
+	data, _ := res.Bytes(buf)
+	return string(data)
+}
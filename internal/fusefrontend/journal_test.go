@@ -0,0 +1,100 @@
+package fusefrontend
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"syscall"
+	"testing"
+
+	"github.com/hanwen/go-fuse/v2/fuse"
+
+	"github.com/rfjakob/gocryptfs/internal/contentenc"
+	"github.com/rfjakob/gocryptfs/internal/journal"
+	"github.com/rfjakob/gocryptfs/tests/test_helpers"
+)
+
+// TestJournal writes a file in -journal mode, simulates a crash in the middle
+// of a later write, and checks that journal.Check finds the valid prefix.
+func TestJournal(t *testing.T) {
+	cipherdir := test_helpers.InitFS(t)
+	rn := newTestFS(Args{Cipherdir: cipherdir, Journal: true})
+	_, fh, _, errno := rn.Create(nil, "foo", syscall.O_RDWR, 0600, &fuse.EntryOut{})
+	if errno != 0 {
+		t.Fatal(errno)
+	}
+	f := fh.(*File)
+	// 10 full blocks and a partial one
+	bs := int(rn.contentEnc.PlainBS())
+	if _, errno = f.Write(nil, bytes.Repeat([]byte("x"), 10*bs), 0); errno != 0 {
+		t.Fatal(errno)
+	}
+	if _, errno = f.Write(nil, make([]byte, 100), int64(10*bs)); errno != 0 {
+		t.Fatal(errno)
+	}
+	f.Release(nil)
+
+	dirfd, cName, err := rn.openBackingDir("foo")
+	if err != nil {
+		t.Fatal(err)
+	}
+	syscall.Close(dirfd)
+	cPath := filepath.Join(cipherdir, cName)
+	res, err := journal.CheckFile(cPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if res.Blocks != 11 || res.PlainSize != uint64(10*bs+100) {
+		t.Errorf("after clean write: %+v", res)
+	}
+
+	// Crash while rewriting block 4: the ciphertext block is torn, and the
+	// journal record only made it halfway.
+	cf, err := os.OpenFile(cPath, os.O_WRONLY, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cOff := int64(contentenc.HeaderLen + 4*rn.contentEnc.CipherBS() + 100)
+	if _, err = cf.WriteAt(make([]byte, 1000), cOff); err != nil {
+		t.Fatal(err)
+	}
+	cf.Close()
+	jf, err := os.OpenFile(cPath+journal.Suffix, os.O_WRONLY|os.O_APPEND, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	jf.Write([]byte{0, 0, 0, 0, 0, 0, 0, 4, 0, 0})
+	jf.Close()
+	res, err = journal.CheckFile(cPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if res.Blocks != 4 || res.PlainSize != uint64(4*bs) {
+		t.Errorf("after crash: %+v", res)
+	}
+
+	// The journal moves with the file and is hidden from listings
+	if errno = rn.Rename(nil, "foo", rn, "bar", 0); errno != 0 {
+		t.Fatal(errno)
+	}
+	if names := readdirNames(t, rn); len(names) != 1 || names[0] != "bar" {
+		t.Errorf("wrong listing %v", names)
+	}
+	dirfd, cName2, err := rn.openBackingDir("bar")
+	if err != nil {
+		t.Fatal(err)
+	}
+	syscall.Close(dirfd)
+	cPath2 := filepath.Join(cipherdir, cName2)
+	if _, err = os.Stat(cPath2 + journal.Suffix); err != nil {
+		t.Errorf("journal was not renamed: %v", err)
+	}
+	if errno = rn.Unlink(nil, "bar"); errno != 0 {
+		t.Fatal(errno)
+	}
+	for _, p := range []string{cPath, cPath2} {
+		if _, err = os.Stat(p + journal.Suffix); !os.IsNotExist(err) {
+			t.Errorf("stale journal %q: %v", p, err)
+		}
+	}
+}
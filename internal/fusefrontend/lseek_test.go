@@ -0,0 +1,69 @@
+package fusefrontend
+
+import (
+	"syscall"
+	"testing"
+
+	"github.com/hanwen/go-fuse/v2/fuse"
+
+	"github.com/rfjakob/gocryptfs/internal/syscallcompat"
+	"github.com/rfjakob/gocryptfs/tests/test_helpers"
+)
+
+// TestLseek checks SEEK_DATA and SEEK_HOLE on a file with a hole between the
+// first block and a block at 1 MiB.
+func TestLseek(t *testing.T) {
+	rn := newTestFS(Args{Cipherdir: test_helpers.InitFS(t)})
+	bs := rn.contentEnc.PlainBS()
+	ch, fh, _, errno := rn.Create(nil, "sparse", syscall.O_RDWR, 0600, &fuse.EntryOut{})
+	if errno != 0 {
+		t.Fatal(errno)
+	}
+	rn.AddChild("sparse", ch, true)
+	f := fh.(*File)
+	defer f.Release(nil)
+	const dataOff = 1024 * 1024
+	for _, off := range []int64{0, dataOff} {
+		if _, errno = f.Write(nil, make([]byte, 100), off); errno != 0 {
+			t.Fatal(errno)
+		}
+	}
+	plainSize := uint64(dataOff + 100)
+	// Not all filesystems report holes
+	if off, err := syscall.Seek(f.intFd(), 0, syscallcompat.SEEK_HOLE); err != nil {
+		t.Skipf("backing filesystem does not support SEEK_HOLE: %v", err)
+	} else if fi, _ := f.fd.Stat(); off >= fi.Size() {
+		t.Skip("backing filesystem does not report holes")
+	}
+
+	for _, tc := range []struct {
+		name   string
+		off    uint64
+		whence uint32
+		want   uint64
+	}{
+		// Inside written blocks, the offset itself is returned
+		{"data in block 0", 10, syscallcompat.SEEK_DATA, 10},
+		{"data in last block", dataOff + 10, syscallcompat.SEEK_DATA, dataOff + 10},
+		// SEEK_DATA skips the hole to the next written block
+		{"data after block 0", bs, syscallcompat.SEEK_DATA, dataOff},
+		{"data in hole", 100 * bs, syscallcompat.SEEK_DATA, dataOff},
+		// The hole starts at the first unwritten block
+		{"hole from 0", 0, syscallcompat.SEEK_HOLE, bs},
+		{"hole in hole", 100*bs + 5, syscallcompat.SEEK_HOLE, 100*bs + 5},
+		// Implicit hole at EOF
+		{"hole at EOF", dataOff, syscallcompat.SEEK_HOLE, plainSize},
+	} {
+		have, errno := f.Lseek(nil, tc.off, tc.whence)
+		if errno != 0 {
+			t.Errorf("%s: %v", tc.name, errno)
+		} else if have != tc.want {
+			t.Errorf("%s: have %d, want %d", tc.name, have, tc.want)
+		}
+	}
+	for _, whence := range []uint32{syscallcompat.SEEK_DATA, syscallcompat.SEEK_HOLE} {
+		if _, errno := f.Lseek(nil, plainSize, whence); errno != syscall.ENXIO {
+			t.Errorf("whence=%d at EOF: want ENXIO, got %v", whence, errno)
+		}
+	}
+}
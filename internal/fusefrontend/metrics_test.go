@@ -0,0 +1,37 @@
+package fusefrontend
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/rfjakob/gocryptfs/internal/metrics"
+	"github.com/rfjakob/gocryptfs/tests/test_helpers"
+)
+
+// TestMetrics checks that the FUSE operations are counted with "-metrics"
+func TestMetrics(t *testing.T) {
+	rn := newTestFS(Args{Cipherdir: test_helpers.InitFS(t)})
+	rn.Metrics = metrics.New()
+	writeTestFile(t, &rn.Node, "foo", 100)
+	if errno := rn.Unlink(nil, "foo"); errno != 0 {
+		t.Fatal(errno)
+	}
+	if errno := rn.Unlink(nil, "foo"); errno == 0 {
+		t.Fatal("second Unlink succeeded")
+	}
+	var sb strings.Builder
+	if err := rn.Metrics.WritePrometheus(&sb); err != nil {
+		t.Fatal(err)
+	}
+	for _, want := range []string{
+		`gocryptfs_ops_total{op="create"} 1`,
+		`gocryptfs_ops_total{op="write"} 1`,
+		`gocryptfs_ops_total{op="release"} 1`,
+		`gocryptfs_ops_total{op="unlink"} 2`,
+		`gocryptfs_op_errors_total{op="unlink"} 1`,
+	} {
+		if !strings.Contains(sb.String(), want+"\n") {
+			t.Errorf("%q is missing from the output:\n%s", want, sb.String())
+		}
+	}
+}
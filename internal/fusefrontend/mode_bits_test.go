@@ -0,0 +1,105 @@
+package fusefrontend
+
+import (
+	"os"
+	"syscall"
+	"testing"
+
+	"golang.org/x/sys/unix"
+
+	"github.com/hanwen/go-fuse/v2/fs"
+	"github.com/hanwen/go-fuse/v2/fuse"
+
+	"github.com/rfjakob/gocryptfs/internal/syscallcompat"
+	"github.com/rfjakob/gocryptfs/tests/test_helpers"
+)
+
+// setattrMode runs Setattr on "n", through "f" if it is not nil, and returns
+// the mode bits Setattr and Getattr report. With "chown", the request also
+// sets the owner, to the uid and gid we already have.
+func setattrMode(t *testing.T, n *Node, f fs.FileHandle, mode uint32, chown bool) (set, get uint32) {
+	in := &fuse.SetAttrIn{SetAttrInCommon: fuse.SetAttrInCommon{Valid: fuse.FATTR_MODE, Mode: mode}}
+	if chown {
+		in.Valid |= fuse.FATTR_UID | fuse.FATTR_GID
+		in.Uid = uint32(os.Getuid())
+		in.Gid = uint32(os.Getgid())
+	}
+	var out fuse.AttrOut
+	if errno := n.Setattr(nil, f, in, &out); errno != 0 {
+		t.Fatalf("Setattr %o: %v", mode, errno)
+	}
+	set = out.Mode & 07777
+	if errno := n.Getattr(nil, f, &out); errno != 0 {
+		t.Fatal(errno)
+	}
+	return set, out.Mode & 07777
+}
+
+// backingMode returns the mode bits of the backing file of "path"
+func backingMode(t *testing.T, rn *RootNode, path string) uint32 {
+	dirfd, cName, err := rn.openBackingDir(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer syscall.Close(dirfd)
+	st, err := syscallcompat.Fstatat2(dirfd, cName, unix.AT_SYMLINK_NOFOLLOW)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return uint32(st.Mode) & 07777
+}
+
+// TestModeBits sets the setgid and sticky bits on a directory and the setuid
+// and setgid bits on a file, and checks that Setattr and Getattr report them
+// exactly as the backing files have them. When a chown clears the bits, they
+// must stay cleared.
+func TestModeBits(t *testing.T) {
+	rn := newTestFS(Args{Cipherdir: test_helpers.InitFS(t)})
+	d := mkdirTestDir(t, &rn.Node, "d")
+	writeTestFile(t, &rn.Node, "f", 10)
+	f := lookupChild(t, &rn.Node, "f")
+	fh, _, errno := f.Open(nil, syscall.O_RDWR)
+	if errno != 0 {
+		t.Fatal(errno)
+	}
+	defer fh.(*File).Release(nil)
+
+	testCases := []struct {
+		desc  string
+		n     *Node
+		path  string
+		f     fs.FileHandle
+		mode  uint32
+		chown bool
+	}{
+		{"dir setgid|sticky", d, "d", nil, syscall.S_ISGID | syscall.S_ISVTX | 0755, false},
+		{"dir setgid|sticky with chown", d, "d", nil, syscall.S_ISGID | syscall.S_ISVTX | 0750, true},
+		{"file setuid", f, "f", nil, syscall.S_ISUID | 0755, false},
+		{"file setuid|setgid with chown", f, "f", nil, syscall.S_ISUID | syscall.S_ISGID | 0755, true},
+		{"file handle setuid|setgid", f, "f", fh, syscall.S_ISUID | syscall.S_ISGID | 0711, false},
+		{"file handle setuid|setgid with chown", f, "f", fh, syscall.S_ISUID | syscall.S_ISGID | 0750, true},
+		{"file mode cleared", f, "f", nil, 0644, false},
+	}
+	for _, tc := range testCases {
+		set, get := setattrMode(t, tc.n, tc.f, tc.mode, tc.chown)
+		if set != tc.mode || get != tc.mode {
+			t.Errorf("%s: want %o, Setattr reports %o, Getattr %o", tc.desc, tc.mode, set, get)
+		}
+		if b := backingMode(t, rn, tc.path); b != tc.mode {
+			t.Errorf("%s: want %o, backing file has %o", tc.desc, tc.mode, b)
+		}
+	}
+
+	// A chown without a mode clears setuid and setgid on the backing file,
+	// and we must not report them anymore
+	setattrMode(t, f, nil, syscall.S_ISUID|syscall.S_ISGID|0755, false)
+	in := &fuse.SetAttrIn{SetAttrInCommon: fuse.SetAttrInCommon{Valid: fuse.FATTR_UID}}
+	in.Uid = uint32(os.Getuid())
+	var out fuse.AttrOut
+	if errno := f.Setattr(nil, nil, in, &out); errno != 0 {
+		t.Fatal(errno)
+	}
+	if b := backingMode(t, rn, "f"); out.Mode&07777 != b || b&(syscall.S_ISUID|syscall.S_ISGID) != 0 {
+		t.Errorf("after chown: Setattr reports %o, backing file has %o", out.Mode&07777, b)
+	}
+}
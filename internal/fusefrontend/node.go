@@ -2,14 +2,19 @@ package fusefrontend
 
 import (
 	"context"
+	"path/filepath"
 	"syscall"
+	"time"
 
 	"golang.org/x/sys/unix"
 
 	"github.com/hanwen/go-fuse/v2/fs"
 	"github.com/hanwen/go-fuse/v2/fuse"
 
+	"github.com/rfjakob/gocryptfs/internal/inomap"
+	"github.com/rfjakob/gocryptfs/internal/journal"
 	"github.com/rfjakob/gocryptfs/internal/nametransform"
+	"github.com/rfjakob/gocryptfs/internal/optrace"
 	"github.com/rfjakob/gocryptfs/internal/syscallcompat"
 	"github.com/rfjakob/gocryptfs/internal/tlog"
 )
@@ -18,11 +23,26 @@ import (
 // in a gocryptfs mount.
 type Node struct {
 	fs.Inode
+	// plus holds the attributes collected by Readdir, if this is a directory
+	plus plusCache
 }
 
 // Lookup - FUSE call for discovering a file.
 func (n *Node) Lookup(ctx context.Context, name string, out *fuse.EntryOut) (ch *fs.Inode, errno syscall.Errno) {
-	dirfd, cName, errno := n.prepareAtSyscall(name)
+	// The kernel resolves "." and ".." itself. go-fuse panics if we return a
+	// node for them, so a LOOKUP that gets here anyway fails.
+	if name == "." || name == ".." {
+		return nil, syscall.ENOENT
+	}
+	rn := n.rootNode()
+	// Right after Readdir, which is what READDIRPLUS does, the attributes are
+	// already known
+	if e, ok := n.takePlus(name); ok && !rn.isFiltered(filepath.Join(n.Path(), name)) {
+		ch = n.newChild(ctx, e.st, out)
+		out.Attr.Size = e.size
+		return ch, 0
+	}
+	dirfd, cName, errno := n.prepareAtSyscall(ctx, name)
 	if errno != 0 {
 		return
 	}
@@ -33,6 +53,9 @@ func (n *Node) Lookup(ctx context.Context, name string, out *fuse.EntryOut) (ch
 	if err != nil {
 		return nil, fs.ToErrno(err)
 	}
+	if rn.args.HideBadHeaders && hasBadHeader(dirfd, cName, st) {
+		return nil, syscall.ENOENT
+	}
 
 	// Create new inode and fill `out`
 	ch = n.newChild(ctx, st, out)
@@ -47,12 +70,17 @@ func (n *Node) Lookup(ctx context.Context, name string, out *fuse.EntryOut) (ch
 //
 // GetAttr is symlink-safe through use of openBackingDir() and Fstatat().
 func (n *Node) Getattr(ctx context.Context, f fs.FileHandle, out *fuse.AttrOut) (errno syscall.Errno) {
+	defer func() {
+		if errno == 0 {
+			n.setAttrTimeout(out)
+		}
+	}()
 	// If the kernel gives us a file handle, use it.
 	if f != nil {
 		return f.(fs.FileGetattrer).Getattr(ctx, out)
 	}
 
-	dirfd, cName, errno := n.prepareAtSyscall("")
+	dirfd, cName, errno := n.prepareAtSyscall(ctx, "")
 	if errno != 0 {
 		return
 	}
@@ -62,11 +90,23 @@ func (n *Node) Getattr(ctx context.Context, f fs.FileHandle, out *fuse.AttrOut)
 	if err != nil {
 		return fs.ToErrno(err)
 	}
+	// The size must include buffered writes
+	rn := n.rootNode()
+	if rn.args.WriteBuffer && st.Mode&syscall.S_IFMT == syscall.S_IFREG {
+		if flushed, errno := rn.flushPendingIno(inomap.QInoFromStat(st)); errno != 0 {
+			return errno
+		} else if flushed {
+			if st, err = syscallcompat.Fstatat2(dirfd, cName, unix.AT_SYMLINK_NOFOLLOW); err != nil {
+				return fs.ToErrno(err)
+			}
+		}
+	}
 
 	// Fix inode number
-	rn := n.rootNode()
 	rn.inoMap.TranslateStat(st)
 	out.Attr.FromStat(st)
+	syscallcompat.FillBtime(&out.Attr, st)
+	rn.freezeTimes(&out.Attr)
 
 	// Translate ciphertext size in `out.Attr.Size` to plaintext size
 	n.translateSize(dirfd, cName, &out.Attr)
@@ -77,36 +117,109 @@ func (n *Node) Getattr(ctx context.Context, f fs.FileHandle, out *fuse.AttrOut)
 	return 0
 }
 
+// Access - FUSE call. Check if the caller may access the file with the
+// permissions in "mask" (R_OK, W_OK, X_OK, or F_OK for plain existence).
+//
+// Write checks fail with EROFS on a read-only mount. Everything else is
+// answered by the backing file, as the ciphertext files have the same
+// permission bits as the plaintext files. When we run as root
+// (PreserveOwner), the check is done with the ids of the caller.
+//
+// Symlink-safe through use of Faccessat.
+func (n *Node) Access(ctx context.Context, mask uint32) syscall.Errno {
+	rn := n.rootNode()
+	if mask&unix.W_OK != 0 && rn.args.ReadOnly {
+		return syscall.EROFS
+	}
+	dirfd, cName, errno := n.prepareAtSyscall(ctx, "")
+	if errno != 0 {
+		return errno
+	}
+	defer syscall.Close(dirfd)
+
+	if !rn.args.PreserveOwner {
+		ctx = nil
+	}
+	err := syscallcompat.FaccessatUser(dirfd, cName, mask, toFuseCtx(ctx))
+	return fs.ToErrno(err)
+}
+
 // Unlink - FUSE call. Delete a file.
 //
+// The per-file header is part of the content file and goes away with it.
+// Long names have an additional ".name" side file, which is deleted *after*
+// the content file. If we crash in between, we leave an orphaned ".name" file
+// behind, which Readdir ignores. The opposite order could leave a content file
+// whose name can no longer be decrypted.
+//
+// With "-trash", the content file is moved into the trash instead, see
+// trash.go.
+//
 // Symlink-safe through use of Unlinkat().
 func (n *Node) Unlink(ctx context.Context, name string) (errno syscall.Errno) {
-	dirfd, cName, errno := n.prepareAtSyscall(name)
+	n.rootNode().snapshotLock.RLock()
+	defer n.rootNode().snapshotLock.RUnlock()
+	defer n.rootNode().invalidatePlus()
+	defer n.rootNode().Metrics.Observe(optrace.OpUnlink, time.Now(), &errno)
+	if rn := n.rootNode(); rn.OpTrace != nil {
+		defer func() {
+			rn.OpTrace.Record(optrace.Op{Op: optrace.OpUnlink, Path: filepath.Join(n.Path(), name)}, nil, errno)
+		}()
+	}
+	handled, unionDone, errno := n.unionRemove(name, false)
+	if handled || errno != 0 {
+		return
+	}
+	defer unionDone(&errno)
+	dirfd, cName, errno := n.prepareAtSyscall(ctx, name)
 	if errno != 0 {
 		return
 	}
 	defer syscall.Close(dirfd)
 
-	// Delete content
-	err := syscallcompat.Unlinkat(dirfd, cName, 0)
-	if err != nil {
-		return fs.ToErrno(err)
+	rn := n.rootNode()
+	if rn.args.Trash {
+		// Move content into the trash. It keeps counting against the quota.
+		prefix, _ := rn.callerPrefix(ctx)
+		path, _ := filepath.Rel(rn.args.Prefix, filepath.Join(prefix, n.Path(), name))
+		if err := rn.moveToTrash(dirfd, cName, path); err != nil {
+			return fs.ToErrno(err)
+		}
+	} else {
+		freed := rn.quotaFreed(dirfd, cName)
+		// Delete content
+		err := deleteName(dirfd, cName, func() error {
+			return rn.unlinkBacking(dirfd, cName)
+		})
+		if err != nil {
+			return fs.ToErrno(err)
+		}
+		rn.releaseQuota(freed)
 	}
 	// Delete ".name" file
 	if !n.rootNode().args.PlaintextNames && nametransform.IsLongContent(cName) {
-		err = nametransform.DeleteLongNameAt(dirfd, cName)
+		err := nametransform.DeleteLongNameAt(dirfd, cName)
 		if err != nil {
+			// The file itself is gone, so the unlink was successful from the
+			// user's point of view. The orphaned .name file is harmless.
 			tlog.Warn.Printf("Unlink: could not delete .name file: %v", err)
 		}
 	}
-	return fs.ToErrno(err)
+	// Delete "-journal" side file. Also done when mounted without "-journal",
+	// so no stale journals are left over.
+	if !n.rootNode().args.PlaintextNames {
+		if err := journal.Delete(dirfd, cName); err != nil {
+			tlog.Warn.Printf("Unlink: could not delete journal: %v", err)
+		}
+	}
+	return 0
 }
 
 // Readlink - FUSE call.
 //
 // Symlink-safe through openBackingDir() + Readlinkat().
 func (n *Node) Readlink(ctx context.Context) (out []byte, errno syscall.Errno) {
-	dirfd, cName, errno := n.prepareAtSyscall("")
+	dirfd, cName, errno := n.prepareAtSyscall(ctx, "")
 	if errno != 0 {
 		return
 	}
@@ -117,31 +230,76 @@ func (n *Node) Readlink(ctx context.Context) (out []byte, errno syscall.Errno) {
 
 // Setattr - FUSE call. Called for chmod, truncate, utimens, ...
 func (n *Node) Setattr(ctx context.Context, f fs.FileHandle, in *fuse.SetAttrIn, out *fuse.AttrOut) (errno syscall.Errno) {
+	defer n.rootNode().invalidatePlus()
+	defer func() {
+		if errno == 0 {
+			n.setAttrTimeout(out)
+		}
+	}()
+	n.rootNode().dropTimes(in)
+	if rn := n.rootNode(); rn.args.LowerCipherdir != "" {
+		rn.snapshotLock.RLock()
+		errno = n.unionCopyUp()
+		rn.snapshotLock.RUnlock()
+		if errno != 0 {
+			return
+		}
+		// The fd may still point to the lower layer
+		f = nil
+	}
 	// Use the fd if the kernel gave us one
 	if f != nil {
 		f2 := f.(*File)
 		return f2.Setattr(ctx, in, out)
 	}
 
-	dirfd, cName, errno := n.prepareAtSyscall("")
+	dirfd, cName, errno := n.prepareAtSyscall(ctx, "")
 	if errno != 0 {
 		return
 	}
 	defer syscall.Close(dirfd)
 
-	// chmod(2)
-	//
-	// gocryptfs.diriv & gocryptfs.longname.[sha256].name files do NOT get chmod'ed
-	// or chown'ed with their parent file/dir for simplicity.
-	// See nametransform/perms.go for details.
-	if mode, ok := in.GetMode(); ok {
-		errno = fs.ToErrno(syscallcompat.FchmodatNofollow(dirfd, cName, mode))
+	if errno = n.setAttrMeta(dirfd, cName, in); errno != 0 {
+		return errno
+	}
+
+	// For truncate, the user has to have write permissions. That means we can
+	// depend on opening a RDWR fd and letting the File handle truncate.
+	if sz, ok := in.GetSize(); ok {
+		f, _, errno := n.Open(ctx, syscall.O_RDWR)
+		if errno != 0 {
+			return errno
+		}
+		f2 := f.(*File)
+		defer f2.Release(ctx)
+		rn := n.rootNode()
+		rn.snapshotLock.RLock()
+		f2.fileTableEntry.ContentLock.Lock()
+		errno = f2.fileTableEntry.FlushPendingWrite()
+		if errno == 0 {
+			errno = syscall.Errno(f2.truncate(sz))
+		}
+		f2.fileTableEntry.ContentLock.Unlock()
+		rn.snapshotLock.RUnlock()
 		if errno != 0 {
 			return errno
 		}
+		return f2.Getattr(ctx, out)
 	}
 
+	return n.Getattr(ctx, nil, out)
+}
+
+// setAttrMeta is the chown, chmod, utimens and birth time part of the
+// path-based Setattr. Truncate is done by Setattr through a File.
+func (n *Node) setAttrMeta(dirfd int, cName string, in *fuse.SetAttrIn) (errno syscall.Errno) {
+	// Block while a snapshot is being taken, like File.setAttr does
+	n.rootNode().snapshotLock.RLock()
+	defer n.rootNode().snapshotLock.RUnlock()
+
 	// chown(2)
+	//
+	// Comes before chmod, see File.setAttr.
 	uid32, uOk := in.GetUID()
 	gid32, gOk := in.GetGID()
 	if uOk || gOk {
@@ -160,6 +318,18 @@ func (n *Node) Setattr(ctx context.Context, f fs.FileHandle, in *fuse.SetAttrIn,
 		}
 	}
 
+	// chmod(2)
+	//
+	// gocryptfs.diriv & gocryptfs.longname.[sha256].name files do NOT get chmod'ed
+	// or chown'ed with their parent file/dir for simplicity.
+	// See nametransform/perms.go for details.
+	if mode, ok := in.GetMode(); ok {
+		errno = fs.ToErrno(syscallcompat.FchmodatNofollow(dirfd, cName, mode))
+		if errno != 0 {
+			return errno
+		}
+	}
+
 	// utimens(2)
 	mtime, mok := in.GetMTime()
 	atime, aok := in.GetATime()
@@ -178,23 +348,14 @@ func (n *Node) Setattr(ctx context.Context, f fs.FileHandle, in *fuse.SetAttrIn,
 		}
 	}
 
-	// For truncate, the user has to have write permissions. That means we can
-	// depend on opening a RDWR fd and letting the File handle truncate.
-	if sz, ok := in.GetSize(); ok {
-		f, _, errno := n.Open(ctx, syscall.O_RDWR)
+	// Birth time (MacOS only)
+	if btime, ok := syscallcompat.GetBtime(in); ok {
+		errno = fs.ToErrno(syscallcompat.UtimesBtimeAtNofollow(dirfd, cName, btime))
 		if errno != 0 {
 			return errno
 		}
-		f2 := f.(*File)
-		defer f2.Release(ctx)
-		errno = syscall.Errno(f2.truncate(sz))
-		if errno != 0 {
-			return errno
-		}
-		return f2.Getattr(ctx, out)
 	}
-
-	return n.Getattr(ctx, nil, out)
+	return 0
 }
 
 // StatFs - FUSE call. Returns information about the filesystem.
@@ -208,6 +369,20 @@ func (n *Node) Statfs(ctx context.Context, out *fuse.StatfsOut) syscall.Errno {
 		return fs.ToErrno(err)
 	}
 	out.FromStatfsT(&st)
+	// Report the quota as the size of the filesystem, unless the backing
+	// filesystem is smaller
+	if q := n.rootNode().quota; q != nil && out.Bsize > 0 {
+		if blocks := uint64(q.limit) / uint64(out.Bsize); blocks < out.Blocks {
+			out.Blocks = blocks
+		}
+		free := uint64(q.free()) / uint64(out.Bsize)
+		if free < out.Bfree {
+			out.Bfree = free
+		}
+		if free < out.Bavail {
+			out.Bavail = free
+		}
+	}
 	return 0
 }
 
@@ -215,7 +390,15 @@ func (n *Node) Statfs(ctx context.Context, out *fuse.StatfsOut) syscall.Errno {
 //
 // Symlink-safe through use of Mknodat().
 func (n *Node) Mknod(ctx context.Context, name string, mode, rdev uint32, out *fuse.EntryOut) (inode *fs.Inode, errno syscall.Errno) {
-	dirfd, cName, errno := n.prepareAtSyscall(name)
+	n.rootNode().snapshotLock.RLock()
+	defer n.rootNode().snapshotLock.RUnlock()
+	defer n.rootNode().invalidatePlus()
+	unionDone, errno := n.unionCreate(name)
+	if errno != 0 {
+		return
+	}
+	defer unionDone(&errno)
+	dirfd, cName, errno := n.prepareAtSyscallCreate(ctx, name)
 	if errno != 0 {
 		return
 	}
@@ -231,7 +414,7 @@ func (n *Node) Mknod(ctx context.Context, name string, mode, rdev uint32, out *f
 	var err error
 	ctx2 := toFuseCtx(ctx)
 	if !rn.args.PlaintextNames && nametransform.IsLongContent(cName) {
-		err := rn.nameTransform.WriteLongNameAt(dirfd, cName, name)
+		err := rn.writeLongNameAt(dirfd, cName, name)
 		if err != nil {
 			errno = fs.ToErrno(err)
 			return
@@ -264,14 +447,25 @@ func (n *Node) Mknod(ctx context.Context, name string, mode, rdev uint32, out *f
 //
 // Symlink-safe through use of Linkat().
 func (n *Node) Link(ctx context.Context, target fs.InodeEmbedder, name string, out *fuse.EntryOut) (inode *fs.Inode, errno syscall.Errno) {
-	dirfd, cName, errno := n.prepareAtSyscall(name)
+	n.rootNode().snapshotLock.RLock()
+	defer n.rootNode().snapshotLock.RUnlock()
+	defer n.rootNode().invalidatePlus()
+	n2 := toNode(target)
+	if errno = n2.unionCopyUp(); errno != 0 {
+		return
+	}
+	unionDone, errno := n.unionCreate(name)
+	if errno != 0 {
+		return
+	}
+	defer unionDone(&errno)
+	dirfd, cName, errno := n.prepareAtSyscallCreate(ctx, name)
 	if errno != 0 {
 		return
 	}
 	defer syscall.Close(dirfd)
 
-	n2 := toNode(target)
-	dirfd2, cName2, errno := n2.prepareAtSyscall("")
+	dirfd2, cName2, errno := n2.prepareAtSyscall(ctx, "")
 	if errno != 0 {
 		return
 	}
@@ -281,7 +475,7 @@ func (n *Node) Link(ctx context.Context, target fs.InodeEmbedder, name string, o
 	rn := n.rootNode()
 	var err error
 	if !rn.args.PlaintextNames && nametransform.IsLongContent(cName) {
-		err = rn.nameTransform.WriteLongNameAt(dirfd, cName, name)
+		err = rn.writeLongNameAt(dirfd, cName, name)
 		if err != nil {
 			errno = fs.ToErrno(err)
 			return
@@ -313,7 +507,15 @@ func (n *Node) Link(ctx context.Context, target fs.InodeEmbedder, name string, o
 //
 // Symlink-safe through use of Symlinkat.
 func (n *Node) Symlink(ctx context.Context, target, name string, out *fuse.EntryOut) (inode *fs.Inode, errno syscall.Errno) {
-	dirfd, cName, errno := n.prepareAtSyscall(name)
+	n.rootNode().snapshotLock.RLock()
+	defer n.rootNode().snapshotLock.RUnlock()
+	defer n.rootNode().invalidatePlus()
+	unionDone, errno := n.unionCreate(name)
+	if errno != 0 {
+		return
+	}
+	defer unionDone(&errno)
+	dirfd, cName, errno := n.prepareAtSyscallCreate(ctx, name)
 	if errno != 0 {
 		return
 	}
@@ -334,7 +536,7 @@ func (n *Node) Symlink(ctx context.Context, target, name string, out *fuse.Entry
 	var err error
 	ctx2 := toFuseCtx(ctx)
 	if !rn.args.PlaintextNames && nametransform.IsLongContent(cName) {
-		err = rn.nameTransform.WriteLongNameAt(dirfd, cName, name)
+		err = rn.writeLongNameAt(dirfd, cName, name)
 		if err != nil {
 			errno = fs.ToErrno(err)
 			return
@@ -363,29 +565,64 @@ func (n *Node) Symlink(ctx context.Context, target, name string, out *fuse.Entry
 //
 // Symlink-safe through Renameat().
 func (n *Node) Rename(ctx context.Context, name string, newParent fs.InodeEmbedder, newName string, flags uint32) (errno syscall.Errno) {
-	dirfd, cName, errno := n.prepareAtSyscall(name)
+	n.rootNode().snapshotLock.RLock()
+	defer n.rootNode().snapshotLock.RUnlock()
+	defer n.rootNode().invalidatePlus()
+	defer n.rootNode().Metrics.Observe(optrace.OpRename, time.Now(), &errno)
+	if rn := n.rootNode(); rn.OpTrace != nil {
+		// Record the paths now, go-fuse moves the inode after we return
+		p1 := filepath.Join(n.Path(), name)
+		p2 := filepath.Join(toNode(newParent).Path(), newName)
+		defer func() {
+			rn.OpTrace.Record(optrace.Op{Op: optrace.OpRename, Path: p1, Path2: p2, Flags: flags}, nil, errno)
+		}()
+	}
+	unionDone, errno := n.unionRename(name, toNode(newParent), newName, flags)
+	if errno != 0 {
+		return
+	}
+	defer unionDone(&errno)
+	dirfd, cName, errno := n.prepareAtSyscall(ctx, name)
 	if errno != 0 {
 		return
 	}
 	defer syscall.Close(dirfd)
 
 	n2 := toNode(newParent)
-	dirfd2, cName2, errno := n2.prepareAtSyscall(newName)
+	dirfd2, cName2, errno := n2.prepareAtSyscallCreate(ctx, newName)
 	if errno != 0 {
 		return
 	}
 	defer syscall.Close(dirfd2)
 
-	// Easy case.
 	rn := n.rootNode()
+	// A file replaced by the rename frees its quota
+	var freed int64
+	// An open file replaced by the rename is deleted by us, see deleteName
+	replace := func(rename func() error) error {
+		if flags&syscallcompat.RENAME_EXCHANGE != 0 {
+			return rename()
+		}
+		return deleteName(dirfd2, cName2, rename)
+	}
+	if flags&syscallcompat.RENAME_EXCHANGE == 0 {
+		freed = rn.quotaReplaced(dirfd, cName, dirfd2, cName2)
+	}
+	// Easy case.
 	if rn.args.PlaintextNames {
-		return fs.ToErrno(syscallcompat.Renameat2(dirfd, cName, dirfd2, cName2, uint(flags)))
+		err := replace(func() error {
+			return syscallcompat.Renameat2(dirfd, cName, dirfd2, cName2, uint(flags))
+		})
+		if err == nil {
+			rn.releaseQuota(freed)
+		}
+		return fs.ToErrno(err)
 	}
 	// Long destination file name: create .name file
 	nameFileAlreadyThere := false
 	var err error
 	if nametransform.IsLongContent(cName2) {
-		err = rn.nameTransform.WriteLongNameAt(dirfd2, cName2, newName)
+		err = rn.writeLongNameAt(dirfd2, cName2, newName)
 		// Failure to write the .name file is expected when the target path already
 		// exists. Since hashes are pretty unique, there is no need to modify the
 		// .name file in this case, and we ignore the error.
@@ -397,18 +634,21 @@ func (n *Node) Rename(ctx context.Context, name string, newParent fs.InodeEmbedd
 	}
 	// Actual rename
 	tlog.Debug.Printf("Renameat %d/%s -> %d/%s\n", dirfd, cName, dirfd2, cName2)
-	err = syscallcompat.Renameat2(dirfd, cName, dirfd2, cName2, uint(flags))
-	if (flags&syscallcompat.RENAME_NOREPLACE == 0) && (err == syscall.ENOTEMPTY || err == syscall.EEXIST) {
-		// If an empty directory is overwritten we will always get an error as
-		// the "empty" directory will still contain gocryptfs.diriv.
-		// Interestingly, ext4 returns ENOTEMPTY while xfs returns EEXIST.
-		// We handle that by trying to fs.Rmdir() the target directory and trying
-		// again.
-		tlog.Debug.Printf("Rename: Handling ENOTEMPTY")
-		if n2.Rmdir(ctx, newName) == 0 {
-			err = syscallcompat.Renameat2(dirfd, cName, dirfd2, cName2, uint(flags))
+	err = replace(func() error {
+		err := syscallcompat.Renameat2(dirfd, cName, dirfd2, cName2, uint(flags))
+		if (flags&syscallcompat.RENAME_NOREPLACE == 0) && (err == syscall.ENOTEMPTY || err == syscall.EEXIST) {
+			// If an empty directory is overwritten we will always get an error as
+			// the "empty" directory will still contain gocryptfs.diriv.
+			// Interestingly, ext4 returns ENOTEMPTY while xfs returns EEXIST.
+			// We handle that by trying to rmdir() the target directory and trying
+			// again.
+			tlog.Debug.Printf("Rename: Handling ENOTEMPTY")
+			if n2.rmdir(ctx, newName) == 0 {
+				err = syscallcompat.Renameat2(dirfd, cName, dirfd2, cName2, uint(flags))
+			}
 		}
-	}
+		return err
+	})
 	if err != nil {
 		if nametransform.IsLongContent(cName2) && nameFileAlreadyThere == false {
 			// Roll back .name creation unless the .name file was already there
@@ -416,8 +656,16 @@ func (n *Node) Rename(ctx context.Context, name string, newParent fs.InodeEmbedd
 		}
 		return fs.ToErrno(err)
 	}
+	if flags&syscallcompat.RENAME_EXCHANGE != 0 {
+		// Both names still exist after an exchange, and each keeps its
+		// plaintext name, so the source .name file must stay as well.
+		rn.exchangeJournals(dirfd, cName, dirfd2, cName2)
+		return 0
+	}
 	if nametransform.IsLongContent(cName) {
 		nametransform.DeleteLongNameAt(dirfd, cName)
 	}
+	rn.renameJournal(dirfd, cName, dirfd2, cName2)
+	rn.releaseQuota(freed)
 	return 0
 }
@@ -6,6 +6,7 @@ import (
 
 // Check that we have implemented the fs.Node* interfaces
 var _ = (fs.NodeGetattrer)((*Node)(nil))
+var _ = (fs.NodeAccesser)((*Node)(nil))
 var _ = (fs.NodeLookuper)((*Node)(nil))
 var _ = (fs.NodeReaddirer)((*Node)(nil))
 var _ = (fs.NodeCreater)((*Node)(nil))
@@ -6,7 +6,9 @@ import (
 	"io"
 	"path/filepath"
 	"runtime"
+	"strings"
 	"syscall"
+	"time"
 
 	"golang.org/x/sys/unix"
 
@@ -15,7 +17,9 @@ import (
 
 	"github.com/rfjakob/gocryptfs/internal/configfile"
 	"github.com/rfjakob/gocryptfs/internal/cryptocore"
+	"github.com/rfjakob/gocryptfs/internal/journal"
 	"github.com/rfjakob/gocryptfs/internal/nametransform"
+	"github.com/rfjakob/gocryptfs/internal/optrace"
 	"github.com/rfjakob/gocryptfs/internal/syscallcompat"
 	"github.com/rfjakob/gocryptfs/internal/tlog"
 )
@@ -65,13 +69,30 @@ func (n *Node) mkdirWithIv(dirfd int, cName string, mode uint32, caller *fuse.Ca
 // Mkdir - FUSE call. Create a directory at "newPath" with permissions "mode".
 //
 // Symlink-safe through use of Mkdirat().
-func (n *Node) Mkdir(ctx context.Context, name string, mode uint32, out *fuse.EntryOut) (*fs.Inode, syscall.Errno) {
+func (n *Node) Mkdir(ctx context.Context, name string, mode uint32, out *fuse.EntryOut) (inode *fs.Inode, errno syscall.Errno) {
+	n.rootNode().snapshotLock.RLock()
+	defer n.rootNode().snapshotLock.RUnlock()
+	defer n.rootNode().invalidatePlus()
 	rn := n.rootNode()
+	defer rn.Metrics.Observe(optrace.OpMkdir, time.Now(), &errno)
 	newPath := filepath.Join(n.Path(), name)
+	if rn.OpTrace != nil {
+		defer func() {
+			rn.OpTrace.Record(optrace.Op{Op: optrace.OpMkdir, Path: newPath, Mode: mode}, nil, errno)
+		}()
+	}
 	if rn.isFiltered(newPath) {
 		return nil, syscall.EPERM
 	}
-	dirfd, cName, err := rn.openBackingDir(newPath)
+	unionDone, errno := n.unionCreate(name)
+	if errno != 0 {
+		return
+	}
+	defer unionDone(&errno)
+	if errno = n.fanoutMkdirBucket(ctx, name); errno != 0 {
+		return
+	}
+	dirfd, cName, err := rn.openBackingDirAs(ctx, newPath)
 	if err != nil {
 		return nil, fs.ToErrno(err)
 	}
@@ -104,7 +125,7 @@ func (n *Node) Mkdir(ctx context.Context, name string, mode uint32, out *fuse.En
 		// Handle long file name
 		if nametransform.IsLongContent(cName) {
 			// Create ".name"
-			err = rn.nameTransform.WriteLongNameAt(dirfd, cName, newPath)
+			err = rn.writeLongNameAt(dirfd, cName, newPath)
 			if err != nil {
 				return nil, fs.ToErrno(err)
 			}
@@ -153,6 +174,10 @@ func (n *Node) Mkdir(ctx context.Context, name string, mode uint32, out *fuse.En
 	return ch, 0
 }
 
+// quarantinePrefix is prepended to the ciphertext name of entries that cannot
+// be decrypted when "-quarantine" is active.
+const quarantinePrefix = ".corrupt."
+
 // Readdir - FUSE call.
 //
 // This function is symlink-safe through use of openBackingDir() and
@@ -161,7 +186,7 @@ func (n *Node) Readdir(ctx context.Context) (fs.DirStream, syscall.Errno) {
 	rn := n.rootNode()
 	p := n.Path()
 	dirName := filepath.Base(p)
-	parentDirFd, cDirName, err := rn.openBackingDir(p)
+	parentDirFd, cDirName, err := rn.openBackingDirAs(ctx, p)
 	if err != nil {
 		return nil, fs.ToErrno(err)
 	}
@@ -169,7 +194,7 @@ func (n *Node) Readdir(ctx context.Context) (fs.DirStream, syscall.Errno) {
 
 	// Read ciphertext directory
 	var cipherEntries []fuse.DirEntry
-	fd, err := syscallcompat.Openat(parentDirFd, cDirName, syscall.O_RDONLY|syscall.O_DIRECTORY|syscall.O_NOFOLLOW, 0)
+	fd, err := rn.openat(parentDirFd, cDirName, syscall.O_RDONLY|syscall.O_DIRECTORY|syscall.O_NOFOLLOW, 0)
 	if err != nil {
 		return nil, fs.ToErrno(err)
 	}
@@ -178,74 +203,235 @@ func (n *Node) Readdir(ctx context.Context) (fs.DirStream, syscall.Errno) {
 	if err != nil {
 		return nil, fs.ToErrno(err)
 	}
+	// In "-lowerdir" mode, the entries of the lower directory that show
+	// through follow the first nUpper entries and are read through lowerFd.
+	nUpper := len(cipherEntries)
+	lowerFd := -1
+	if rn.args.LowerCipherdir != "" {
+		var lower []fuse.DirEntry
+		lowerFd, lower, err = rn.unionLowerEntries(p, cipherEntries)
+		if err != nil {
+			return nil, fs.ToErrno(err)
+		}
+		if lowerFd >= 0 {
+			defer syscall.Close(lowerFd)
+			cipherEntries = append(cipherEntries, lower...)
+		}
+	}
 	// Get DirIV (stays nil if PlaintextNames is used)
 	var cachedIV []byte
+	// badDirIV is set in "-quarantine" mode if the DirIV is unreadable. All
+	// entries are then listed in quarantined form.
+	badDirIV := false
 	if !rn.args.PlaintextNames {
 		// Read the DirIV from disk
 		cachedIV, err = nametransform.ReadDirIVAt(fd)
 		if err != nil {
 			tlog.Warn.Printf("OpenDir %q: could not read %s: %v", cDirName, nametransform.DirIVFilename, err)
-			return nil, syscall.EIO
+			if !rn.args.Quarantine {
+				return nil, syscall.EIO
+			}
+			rn.reportMitigatedCorruption(cDirName)
+			badDirIV = true
 		}
 	}
-	// Decrypted directory entries
-	var plain []fuse.DirEntry
-	// Filter and decrypt filenames
-	for i := range cipherEntries {
-		cName := cipherEntries[i].Name
-		if dirName == "." && cName == configfile.ConfDefaultName {
-			// silently ignore "gocryptfs.conf" in the top level dir
-			continue
-		}
-		if rn.args.PlaintextNames {
-			plain = append(plain, cipherEntries[i])
-			continue
-		}
-		if cName == nametransform.DirIVFilename {
-			// silently ignore "gocryptfs.diriv" everywhere if dirIV is enabled
-			continue
-		}
-		// Handle long file name
-		isLong := nametransform.LongNameNone
-		if rn.args.LongNames {
-			isLong = nametransform.NameType(cName)
-		}
-		if isLong == nametransform.LongNameContent {
-			cNameLong, err := nametransform.ReadLongNameAt(fd, cName)
+	// Decrypted directory entries, starting with "." and "..", which are not
+	// on disk (Getdents drops them) and never go through name decryption.
+	plain := n.dotEntries(ctx)
+	// Attributes for the Lookups that follow with READDIRPLUS. Changes
+	// during the scan make them unusable.
+	var plus map[string]plusEntry
+	plusGen := rn.plusGeneration()
+	if !rn.args.SharedStorage {
+		plus = make(map[string]plusEntry, len(cipherEntries))
+	}
+	// Filter and decrypt filenames. The entries were read from "entryFd".
+	addEntries := func(entryFd int, cipherEntries []fuse.DirEntry) {
+		for i := range cipherEntries {
+			cName := cipherEntries[i].Name
+			if rn.args.Fanout && isFanoutBucket(cName) {
+				continue
+			}
+			if dirName == "." && rn.args.Prefix == "" && cName == configfile.ConfDefaultName {
+				// silently ignore "gocryptfs.conf" in the top level dir
+				continue
+			}
+			if rn.args.PlaintextNames {
+				if cipherEntries[i].Mode&syscall.S_IFMT == syscall.S_IFREG && rn.hideBadHeader(entryFd, cName) {
+					continue
+				}
+				if plus != nil {
+					n.collectPlus(plus, entryFd, cName, cName)
+				}
+				plain = append(plain, cipherEntries[i])
+				continue
+			}
+			if cName == nametransform.DirIVFilename {
+				// silently ignore "gocryptfs.diriv" everywhere if dirIV is enabled
+				continue
+			}
+			if cName == trashDir {
+				// "-trash" directory. Also hidden when mounted without -trash.
+				continue
+			}
+			if rn.args.LowerCipherdir != "" && isUnionMarker(cName) {
+				continue
+			}
+			if strings.HasSuffix(cName, journal.Suffix) {
+				// "-journal" side files. Also hidden when mounted without
+				// "-journal".
+				continue
+			}
+			// Handle long file name
+			isLong := nametransform.LongNameNone
+			if rn.args.LongNames {
+				isLong = nametransform.NameType(cName)
+			}
+			if isLong == nametransform.LongNameFilename {
+				// ignore "gocryptfs.longname.*.name"
+				continue
+			}
+			if badDirIV {
+				cipherEntries[i].Name = quarantinePrefix + cName
+				plain = append(plain, cipherEntries[i])
+				continue
+			}
+			// The name as stored on disk, which is what quarantined entries
+			// are listed as.
+			diskName := cName
+			if isLong == nametransform.LongNameContent {
+				cNameLong, err := nametransform.ReadLongNameAt(entryFd, cName)
+				if err != nil {
+					tlog.Warn.Printf("OpenDir %q: invalid entry %q: Could not read .name: %v",
+						cDirName, cName, err)
+					rn.reportMitigatedCorruption(cName)
+					if rn.args.Quarantine {
+						cipherEntries[i].Name = quarantinePrefix + diskName
+						plain = append(plain, cipherEntries[i])
+					}
+					continue
+				}
+				cName = cNameLong
+			}
+			name, err := rn.nameTransform.DecryptName(cName, cachedIV)
 			if err != nil {
-				tlog.Warn.Printf("OpenDir %q: invalid entry %q: Could not read .name: %v",
+				tlog.Warn.Printf("OpenDir %q: invalid entry %q: %v",
 					cDirName, cName, err)
 				rn.reportMitigatedCorruption(cName)
+				if rn.args.Quarantine {
+					cipherEntries[i].Name = quarantinePrefix + diskName
+					plain = append(plain, cipherEntries[i])
+				}
 				continue
 			}
-			cName = cNameLong
-		} else if isLong == nametransform.LongNameFilename {
-			// ignore "gocryptfs.longname.*.name"
-			continue
+			if cipherEntries[i].Mode&syscall.S_IFMT == syscall.S_IFREG && rn.hideBadHeader(entryFd, diskName) {
+				continue
+			}
+			if plus != nil {
+				n.collectPlus(plus, entryFd, diskName, name)
+			}
+			// Override the ciphertext name with the plaintext name but reuse the rest
+			// of the structure
+			cipherEntries[i].Name = name
+			plain = append(plain, cipherEntries[i])
 		}
-		name, err := rn.nameTransform.DecryptName(cName, cachedIV)
-		if err != nil {
-			tlog.Warn.Printf("OpenDir %q: invalid entry %q: %v",
-				cDirName, cName, err)
-			rn.reportMitigatedCorruption(cName)
-			continue
+	}
+	addEntries(fd, cipherEntries[:nUpper])
+	if lowerFd >= 0 {
+		addEntries(lowerFd, cipherEntries[nUpper:])
+	}
+	if rn.args.Fanout {
+		if err = fanoutWalk(fd, cipherEntries, fanoutLevels, addEntries); err != nil {
+			return nil, fs.ToErrno(err)
 		}
-		// Override the ciphertext name with the plaintext name but reuse the rest
-		// of the structure
-		cipherEntries[i].Name = name
-		plain = append(plain, cipherEntries[i])
+	}
+	if plus != nil {
+		n.storePlus(plus, plusGen)
 	}
 
 	return fs.NewListDirStream(plain), 0
 }
 
+// ReaddirNames returns the names in the directory "n", without "." and "..",
+// for callers that drive the frontend without a mount, like "-export_tar"
+// and "-webdav".
+func (n *Node) ReaddirNames() ([]string, syscall.Errno) {
+	ds, errno := n.Readdir(nil)
+	if errno != 0 {
+		return nil, errno
+	}
+	defer ds.Close()
+	var names []string
+	for ds.HasNext() {
+		e, errno := ds.Next()
+		if errno != 0 {
+			return nil, errno
+		}
+		if e.Name != "." && e.Name != ".." {
+			names = append(names, e.Name)
+		}
+	}
+	return names, 0
+}
+
+// dotEntries returns the "." and ".." directory entries for this directory.
+// At the root, ".." refers to the root itself.
+func (n *Node) dotEntries(ctx context.Context) []fuse.DirEntry {
+	parent := n.dotDotNode()
+	return []fuse.DirEntry{
+		{Name: ".", Mode: syscall.S_IFDIR, Ino: n.dirIno(ctx)},
+		{Name: "..", Mode: syscall.S_IFDIR, Ino: parent.dirIno(ctx)},
+	}
+}
+
+// dotDotNode returns the parent node, or the node itself if it is the root.
+func (n *Node) dotDotNode() *Node {
+	if _, p := n.Parent(); p != nil {
+		return toNode(p.Operations())
+	}
+	return n
+}
+
+// dirIno returns the inode number that stat(2) reports for this node.
+// Like go-fuse, we use the stable inode number except for the root node,
+// where go-fuse passes through what Getattr returns.
+func (n *Node) dirIno(ctx context.Context) uint64 {
+	if ino := n.StableAttr().Ino; ino > 1 {
+		return ino
+	}
+	var out fuse.AttrOut
+	if errno := n.Getattr(ctx, nil, &out); errno != 0 {
+		return 0
+	}
+	return out.Ino
+}
+
 // Rmdir - FUSE call.
 //
 // Symlink-safe through Unlinkat() + AT_REMOVEDIR.
-func (n *Node) Rmdir(ctx context.Context, name string) (code syscall.Errno) {
+func (n *Node) Rmdir(ctx context.Context, name string) syscall.Errno {
+	n.rootNode().snapshotLock.RLock()
+	defer n.rootNode().snapshotLock.RUnlock()
+	return n.rmdir(ctx, name)
+}
+
+// rmdir implements Rmdir for callers that already hold the snapshotLock.
+func (n *Node) rmdir(ctx context.Context, name string) (code syscall.Errno) {
+	defer n.rootNode().invalidatePlus()
 	rn := n.rootNode()
+	defer rn.Metrics.Observe(optrace.OpRmdir, time.Now(), &code)
 	p := filepath.Join(n.Path(), name)
-	parentDirFd, cName, err := rn.openBackingDir(p)
+	if rn.OpTrace != nil {
+		defer func() {
+			rn.OpTrace.Record(optrace.Op{Op: optrace.OpRmdir, Path: p}, nil, code)
+		}()
+	}
+	handled, unionDone, code := n.unionRemove(name, true)
+	if handled || code != 0 {
+		return
+	}
+	defer unionDone(&code)
+	parentDirFd, cName, err := rn.openBackingDirAs(ctx, p)
 	if err != nil {
 		return fs.ToErrno(err)
 	}
@@ -296,6 +482,12 @@ func (n *Node) Rmdir(ctx context.Context, name string) (code syscall.Errno) {
 			}
 		}()
 	}
+	// Empty buckets do not count
+	if rn.args.Fanout {
+		if err = fanoutPrune(dirfd); err != nil {
+			return fs.ToErrno(err)
+		}
+	}
 retry:
 	// Check directory contents
 	children, err := syscallcompat.Getdents(dirfd)
@@ -365,7 +557,7 @@ retry:
 
 // Opendir is a FUSE call to check if the directory can be opened.
 func (n *Node) Opendir(ctx context.Context) (errno syscall.Errno) {
-	dirfd, cName, errno := n.prepareAtSyscall("")
+	dirfd, cName, errno := n.prepareAtSyscall(ctx, "")
 	if errno != 0 {
 		return
 	}
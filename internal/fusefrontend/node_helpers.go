@@ -3,7 +3,9 @@ package fusefrontend
 import (
 	"context"
 	"path/filepath"
+	"strings"
 	"syscall"
+	"time"
 
 	"github.com/hanwen/go-fuse/v2/fs"
 
@@ -55,6 +57,11 @@ func (n *Node) readlink(dirfd int, cName string) (out []byte, errno syscall.Errn
 }
 
 // translateSize translates the ciphertext size in `out` into plaintext size.
+// For regular files, this is the plaintext content length, for symlinks the
+// length of the decrypted target. Other types, like directories, keep the
+// size reported by the backing filesystem. out.Blocks is left alone: it is the physical allocation of the ciphertext
+// file, which is what "du" should show, including the crypto overhead and
+// without holes.
 func (n *Node) translateSize(dirfd int, cName string, out *fuse.Attr) {
 	if out.IsRegular() {
 		rn := n.rootNode()
@@ -82,7 +89,10 @@ func (n *Node) rootNode() *RootNode {
 // If you pass a `child` file name, the (dirfd, cName) pair will refer to
 // a child of this node.
 // If `child` is empty, the (dirfd, cName) pair refers to this node itself.
-func (n *Node) prepareAtSyscall(child string) (dirfd int, cName string, errno syscall.Errno) {
+//
+// With "-user_prefix", the path is resolved in the subtree of the caller in
+// `ctx`.
+func (n *Node) prepareAtSyscall(ctx context.Context, child string) (dirfd int, cName string, errno syscall.Errno) {
 	p := n.Path()
 	if child != "" {
 		p = filepath.Join(p, child)
@@ -92,13 +102,22 @@ func (n *Node) prepareAtSyscall(child string) (dirfd int, cName string, errno sy
 		errno = syscall.EPERM
 		return
 	}
-	dirfd, cName, err := rn.openBackingDir(p)
+	dirfd, cName, err := rn.openBackingDirAs(ctx, p)
 	if err != nil {
 		errno = fs.ToErrno(err)
 	}
 	return
 }
 
+// prepareAtSyscallCreate is prepareAtSyscall for creating the child "name".
+// With "-fanout", it creates the bucket directory for it first.
+func (n *Node) prepareAtSyscallCreate(ctx context.Context, child string) (dirfd int, cName string, errno syscall.Errno) {
+	if errno = n.fanoutMkdirBucket(ctx, child); errno != 0 {
+		return -1, "", errno
+	}
+	return n.prepareAtSyscall(ctx, child)
+}
+
 // newChild attaches a new child inode to n.
 // The passed-in `st` will be modified to get a unique inode number
 // (or, in `-sharedstorage` mode, the inode number will be set to zero).
@@ -108,6 +127,9 @@ func (n *Node) newChild(ctx context.Context, st *syscall.Stat_t, out *fuse.Entry
 	// (or set to zero in case of `-sharestorage`)
 	rn.inoMap.TranslateStat(st)
 	out.Attr.FromStat(st)
+	syscallcompat.FillBtime(&out.Attr, st)
+	rn.freezeTimes(&out.Attr)
+	n.setEntryTimeout(out)
 	// Create child node
 	id := fs.StableAttr{
 		Mode: uint32(st.Mode),
@@ -117,3 +139,52 @@ func (n *Node) newChild(ctx context.Context, st *syscall.Stat_t, out *fuse.Entry
 	node := &Node{}
 	return n.NewInode(ctx, node, id)
 }
+
+// depth returns the number of components in the path of this node. The root
+// node has depth zero.
+func (n *Node) depth() int {
+	p := n.Path()
+	if p == "" {
+		return 0
+	}
+	return strings.Count(p, "/") + 1
+}
+
+// scaleTimeout divides "t" by "depth" if "-timeout_depth" is active.
+func (rn *RootNode) scaleTimeout(t time.Duration, depth int) time.Duration {
+	if !rn.args.TimeoutDepth || depth <= 1 {
+		return t
+	}
+	return t / time.Duration(depth)
+}
+
+// setEntryTimeout sets the entry and attr timeouts in "out", which describes
+// a child of this node.
+func (n *Node) setEntryTimeout(out *fuse.EntryOut) {
+	rn := n.rootNode()
+	d := 1
+	if rn.args.TimeoutDepth {
+		d = n.depth() + 1
+	}
+	out.SetEntryTimeout(rn.scaleTimeout(rn.args.EntryTimeout, d))
+	out.SetAttrTimeout(rn.scaleTimeout(rn.args.AttrTimeout, d))
+}
+
+// setAttrTimeout sets the attr timeout in "out", which describes this node.
+func (n *Node) setAttrTimeout(out *fuse.AttrOut) {
+	rn := n.rootNode()
+	d := 1
+	if rn.args.TimeoutDepth {
+		d = n.depth()
+	}
+	out.SetTimeout(rn.scaleTimeout(rn.args.AttrTimeout, d))
+}
+
+// traceFh returns the "-optrace" file handle number of "fh", or zero if fh is
+// nil.
+func traceFh(fh fs.FileHandle) uint64 {
+	if f, ok := fh.(*File); ok {
+		return f.traceFh
+	}
+	return 0
+}
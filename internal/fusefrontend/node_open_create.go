@@ -2,12 +2,15 @@ package fusefrontend
 
 import (
 	"context"
+	"path/filepath"
 	"syscall"
+	"time"
 
 	"github.com/hanwen/go-fuse/v2/fs"
 	"github.com/hanwen/go-fuse/v2/fuse"
 
 	"github.com/rfjakob/gocryptfs/internal/nametransform"
+	"github.com/rfjakob/gocryptfs/internal/optrace"
 	"github.com/rfjakob/gocryptfs/internal/syscallcompat"
 	"github.com/rfjakob/gocryptfs/internal/tlog"
 )
@@ -16,14 +19,35 @@ import (
 //
 // Symlink-safe through Openat().
 func (n *Node) Open(ctx context.Context, flags uint32) (fh fs.FileHandle, fuseFlags uint32, errno syscall.Errno) {
-	dirfd, cName, errno := n.prepareAtSyscall("")
+	rn := n.rootNode()
+	defer rn.Metrics.Observe(optrace.OpOpen, time.Now(), &errno)
+	if flags&syscall.O_TRUNC != 0 {
+		defer rn.invalidatePlus()
+	}
+	if rn.OpTrace != nil {
+		defer func() {
+			rn.OpTrace.Record(optrace.Op{Op: optrace.OpOpen, Path: n.Path(), Fh: traceFh(fh), Flags: flags}, nil, errno)
+		}()
+	}
+	// Writing to a lower file in "-lowerdir" mode writes to a copy
+	if int(flags)&syscall.O_ACCMODE != syscall.O_RDONLY || flags&syscall.O_TRUNC != 0 {
+		if errno = n.unionCopyUp(); errno != 0 {
+			return
+		}
+	}
+	dirfd, cName, errno := n.prepareAtSyscall(ctx, "")
 	if errno != 0 {
 		return
 	}
 	defer syscall.Close(dirfd)
 
-	rn := n.rootNode()
 	newFlags := rn.mangleOpenFlags(flags)
+	// O_TRUNC is done below, under the ContentLock, so that other open file
+	// handles do not keep using the file ID of the old header. ftruncate(2)
+	// needs a writable fd, so O_RDONLY|O_TRUNC is left to the kernel.
+	if int(flags)&syscall.O_ACCMODE != syscall.O_RDONLY {
+		newFlags &^= syscall.O_TRUNC
+	}
 	// Taking this lock makes sure we don't race openWriteOnlyFile()
 	rn.openWriteOnlyLock.RLock()
 	defer rn.openWriteOnlyLock.RUnlock()
@@ -31,9 +55,23 @@ func (n *Node) Open(ctx context.Context, flags uint32) (fh fs.FileHandle, fuseFl
 	if rn.args.KernelCache {
 		fuseFlags = fuse.FOPEN_KEEP_CACHE
 	}
+	if rn.args.DirectIO {
+		fuseFlags |= fuse.FOPEN_DIRECT_IO
+	}
 
+	if errno = rn.reserveHandle(); errno != 0 {
+		return
+	}
+	// From here on, the slot belongs to "f" and is given back by Release
+	var f *File
+	defer func() {
+		if f == nil {
+			rn.releaseHandle()
+		}
+	}()
 	// Open backing file
-	fd, err := syscallcompat.Openat(dirfd, cName, newFlags, 0)
+	fd, err := rn.openat(dirfd, cName, newFlags, 0)
+	writeOnlyChmod := false
 	// Handle a few specific errors
 	if err != nil {
 		if err == syscall.EMFILE {
@@ -43,6 +81,7 @@ func (n *Node) Open(ctx context.Context, flags uint32) (fh fs.FileHandle, fuseFl
 		}
 		if err == syscall.EACCES && (int(flags)&syscall.O_ACCMODE) == syscall.O_WRONLY {
 			fd, err = rn.openWriteOnlyFile(dirfd, cName, newFlags)
+			writeOnlyChmod = true
 		}
 	}
 	// Could not handle the error? Bail out
@@ -50,34 +89,108 @@ func (n *Node) Open(ctx context.Context, flags uint32) (fh fs.FileHandle, fuseFl
 		errno = fs.ToErrno(err)
 		return
 	}
-	fh, _, errno = NewFile(fd, cName, rn)
-	return fh, fuseFlags, errno
+	j, err := rn.openJournal(dirfd, cName, flags)
+	if err != nil {
+		tlog.Warn.Printf("Open %q: could not open journal: %v", cName, err)
+		syscall.Close(fd)
+		errno = fs.ToErrno(err)
+		return
+	}
+	f, _, errno = NewFile(fd, cName, rn)
+	if errno != 0 {
+		j.Close()
+		return
+	}
+	f.journal = j
+	f.writeOnly = int(flags)&syscall.O_ACCMODE == syscall.O_WRONLY
+	f.openClockSkew(n.Path())
+	rn.handles.add(f, openHandle{path: n.Path(), flags: flags, backingFlags: newFlags, writeOnlyChmod: writeOnlyChmod})
+	if flags&syscall.O_TRUNC != 0 {
+		if errno = f.truncateOnOpen(newFlags&syscall.O_TRUNC != 0); errno != 0 {
+			f.Release(ctx)
+			return nil, 0, errno
+		}
+	}
+	return f, fuseFlags, errno
+}
+
+// truncateOnOpen truncates the file to zero for an Open with O_TRUNC. The
+// next write creates a fresh header with a new file ID. "done" means the
+// kernel already truncated the backing file when we opened it and only
+// the cached file ID has to be dropped.
+func (f *File) truncateOnOpen(done bool) syscall.Errno {
+	f.rootNode.snapshotLock.RLock()
+	defer f.rootNode.snapshotLock.RUnlock()
+	f.fileTableEntry.ContentLock.Lock()
+	defer f.fileTableEntry.ContentLock.Unlock()
+	if done {
+		f.fileTableEntry.ID = nil
+		f.invalidateFileHash()
+		return 0
+	}
+	if errno := f.fileTableEntry.FlushPendingWrite(); errno != 0 {
+		return errno
+	}
+	return f.truncate(0)
 }
 
 // Create - FUSE call. Creates a new file.
 //
 // Symlink-safe through the use of Openat().
 func (n *Node) Create(ctx context.Context, name string, flags uint32, mode uint32, out *fuse.EntryOut) (inode *fs.Inode, fh fs.FileHandle, fuseFlags uint32, errno syscall.Errno) {
-	dirfd, cName, errno := n.prepareAtSyscall(name)
+	n.rootNode().snapshotLock.RLock()
+	defer n.rootNode().snapshotLock.RUnlock()
+	defer n.rootNode().invalidatePlus()
+	rn := n.rootNode()
+	defer rn.Metrics.Observe(optrace.OpCreate, time.Now(), &errno)
+	if rn.OpTrace != nil {
+		defer func() {
+			rn.OpTrace.Record(optrace.Op{Op: optrace.OpCreate, Path: filepath.Join(n.Path(), name),
+				Fh: traceFh(fh), Flags: flags, Mode: mode}, nil, errno)
+		}()
+	}
+	unionDone, errno := n.unionCreate(name)
+	if errno != 0 {
+		return
+	}
+	defer unionDone(&errno)
+	dirfd, cName, errno := n.prepareAtSyscallCreate(ctx, name)
 	if errno != 0 {
 		return
 	}
 	defer syscall.Close(dirfd)
 
+	if errno = rn.reserveHandle(); errno != 0 {
+		return
+	}
+	// From here on, the slot belongs to "f" and is given back by Release
+	var f *File
+	defer func() {
+		if f == nil {
+			rn.releaseHandle()
+		}
+	}()
 	var err error
 	fd := -1
 	// Make sure context is nil if we don't want to preserve the owner
-	rn := n.rootNode()
 	if !rn.args.PreserveOwner {
 		ctx = nil
 	}
 	newFlags := rn.mangleOpenFlags(flags)
+	// Create the journal first, so that there never is a journaled file
+	// without one
+	j, err := rn.openJournal(dirfd, cName, flags)
+	if err != nil {
+		tlog.Warn.Printf("Create %q: could not create journal: %v", cName, err)
+		return nil, nil, 0, fs.ToErrno(err)
+	}
 	// Handle long file name
 	ctx2 := toFuseCtx(ctx)
 	if !rn.args.PlaintextNames && nametransform.IsLongContent(cName) {
 		// Create ".name"
-		err = rn.nameTransform.WriteLongNameAt(dirfd, cName, name)
+		err = rn.writeLongNameAt(dirfd, cName, name)
 		if err != nil {
+			rn.closeJournal(j, dirfd, cName)
 			return nil, nil, 0, fs.ToErrno(err)
 		}
 		// Create content
@@ -96,13 +209,22 @@ func (n *Node) Create(ctx context.Context, name string, flags uint32, mode uint3
 			syscall.Getrlimit(syscall.RLIMIT_NOFILE, &lim)
 			tlog.Warn.Printf("Create %q: too many open files. Current \"ulimit -n\": %d", cName, lim.Cur)
 		}
+		rn.closeJournal(j, dirfd, cName)
 		return nil, nil, 0, fs.ToErrno(err)
 	}
 
-	fh, st, errno := NewFile(fd, cName, rn)
+	f, st, errno := NewFile(fd, cName, rn)
 	if errno != 0 {
+		j.Close()
 		return
 	}
+	f.journal = j
+	f.writeOnly = int(flags)&syscall.O_ACCMODE == syscall.O_WRONLY
+	f.openClockSkew(filepath.Join(n.Path(), name))
+	rn.handles.add(f, openHandle{path: filepath.Join(n.Path(), name), flags: flags, backingFlags: newFlags | syscall.O_CREAT | syscall.O_EXCL})
 	inode = n.newChild(ctx, st, out)
-	return inode, fh, fuseFlags, errno
+	if rn.args.DirectIO {
+		fuseFlags = fuse.FOPEN_DIRECT_IO
+	}
+	return inode, f, fuseFlags, errno
 }
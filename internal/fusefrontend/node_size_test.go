@@ -0,0 +1,106 @@
+package fusefrontend
+
+import (
+	"os"
+	"path/filepath"
+	"syscall"
+	"testing"
+
+	"github.com/hanwen/go-fuse/v2/fuse"
+
+	"github.com/rfjakob/gocryptfs/tests/test_helpers"
+)
+
+// TestAttrSize stats a file, a symlink and a directory through Lookup,
+// Getattr, the Readdir cache and an open file, and checks the size each
+// reports.
+func TestAttrSize(t *testing.T) {
+	cipherdir := test_helpers.InitFS(t)
+	rn := newTestFS(Args{Cipherdir: cipherdir})
+	writeTestFile(t, &rn.Node, "file", 5000)
+	const target = "some/target"
+	link, errno := rn.Symlink(nil, target, "link", &fuse.EntryOut{})
+	if errno != 0 {
+		t.Fatal(errno)
+	}
+	rn.AddChild("link", link, true)
+	dir, errno := rn.Mkdir(nil, "dir", 0700, &fuse.EntryOut{})
+	if errno != 0 {
+		t.Fatal(errno)
+	}
+	rn.AddChild("dir", dir, true)
+	// Directory sizes are defined by the backing filesystem
+	dirfd, cName, err := rn.openBackingDir("dir")
+	if err != nil {
+		t.Fatal(err)
+	}
+	syscall.Close(dirfd)
+	fi, err := os.Lstat(filepath.Join(cipherdir, cName))
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := map[string]uint64{
+		"file": 5000,
+		"link": uint64(len(target)),
+		"dir":  uint64(fi.Size()),
+	}
+	check := func(how string) {
+		for name, size := range want {
+			var out fuse.EntryOut
+			if _, errno := rn.Lookup(nil, name, &out); errno != 0 {
+				t.Fatalf("%s: Lookup %q: %v", how, name, errno)
+			}
+			if out.Size != size {
+				t.Errorf("%s: Lookup %q: have size %d, want %d", how, name, out.Size, size)
+			}
+			var a fuse.AttrOut
+			if errno := lookupChild(t, &rn.Node, name).Getattr(nil, nil, &a); errno != 0 {
+				t.Fatal(errno)
+			}
+			if a.Size != size {
+				t.Errorf("%s: Getattr %q: have size %d, want %d", how, name, a.Size, size)
+			}
+		}
+	}
+	check("stat")
+	if _, errno := rn.Readdir(nil); errno != 0 {
+		t.Fatal(errno)
+	}
+	check("readdir cache")
+
+	fh, _, errno := lookupChild(t, &rn.Node, "file").Open(nil, syscall.O_RDONLY)
+	if errno != 0 {
+		t.Fatal(errno)
+	}
+	f := fh.(*File)
+	defer f.Release(nil)
+	var a fuse.AttrOut
+	if errno = f.Getattr(nil, &a); errno != 0 {
+		t.Fatal(errno)
+	}
+	if a.Size != want["file"] {
+		t.Errorf("open file: have size %d, want %d", a.Size, want["file"])
+	}
+
+	// A fifo can be opened, and its size is not translated
+	if _, errno = rn.Mknod(nil, "fifo", syscall.S_IFIFO|0600, 0, &fuse.EntryOut{}); errno != 0 {
+		t.Fatal(errno)
+	}
+	var out fuse.EntryOut
+	ch, errno := rn.Lookup(nil, "fifo", &out)
+	if errno != 0 {
+		t.Fatal(errno)
+	}
+	rn.AddChild("fifo", ch, true)
+	fh, _, errno = lookupChild(t, &rn.Node, "fifo").Open(nil, syscall.O_RDWR|syscall.O_NONBLOCK)
+	if errno != 0 {
+		t.Fatal(errno)
+	}
+	defer fh.(*File).Release(nil)
+	if errno = fh.(*File).Getattr(nil, &a); errno != 0 {
+		t.Fatal(errno)
+	}
+	if a.Size != 0 || a.Mode&syscall.S_IFMT != syscall.S_IFIFO {
+		t.Errorf("fifo: have mode %o size %d", a.Mode, a.Size)
+	}
+}
@@ -7,6 +7,9 @@ import (
 	"strings"
 	"syscall"
 
+	"golang.org/x/sys/unix"
+
+	"github.com/rfjakob/gocryptfs/internal/filehash"
 	"github.com/rfjakob/gocryptfs/internal/tlog"
 )
 
@@ -26,12 +29,19 @@ var xattrStorePrefix = "user.gocryptfs."
 var xattrCapability = "security.capability"
 
 // isAcl returns true if the attribute name is for storing ACLs
-//
-// ACLs are passed through without encryption
 func isAcl(attr string) bool {
 	return attr == "system.posix_acl_access" || attr == "system.posix_acl_default"
 }
 
+// passthroughAcl returns true if "attr" is an ACL that should be stored
+// without encryption, so that the backing filesystem enforces it.
+// This is the default. With "-encryptacl", ACLs are encrypted like any other
+// xattr, and, as the backing filesystem cannot see them, not enforced by
+// anybody. That is what keeps them from being applied twice.
+func (rn *RootNode) passthroughAcl(attr string) bool {
+	return isAcl(attr) && !rn.args.EncryptACL
+}
+
 // GetXAttr - FUSE call. Reads the value of extended attribute "attr".
 //
 // This function is symlink-safe through Fgetxattr.
@@ -44,22 +54,35 @@ func (n *Node) Getxattr(ctx context.Context, attr string, dest []byte) (uint32,
 		// Returning EOPNOTSUPP is what we did till
 		// ca9e912a28b901387e1dbb85f6c531119f2d5ef2 "fusefrontend: drop xattr user namespace restriction"
 		// and it did not cause trouble. Seems cleaner than saying ENODATA.
-		return 0, syscall.EOPNOTSUPP
+		return minus1, syscall.EOPNOTSUPP
 	}
 	var data []byte
-	// ACLs are passed through without encryption
-	if isAcl(attr) {
+	if attr == tagsXattr {
+		// Stored in the file header, not in an xattr
+		var errno syscall.Errno
+		data, errno = n.getTags(ctx)
+		if errno != 0 {
+			return minus1, errno
+		}
+	} else if rn.contentHashCache != nil && attr == contentHashXattr {
+		sum, errno := n.contentHash(ctx)
+		if errno != 0 {
+			return minus1, errno
+		}
+		data = []byte(sum)
+	} else if rn.passthroughAcl(attr) {
+		// ACLs are passed through without encryption
 		var errno syscall.Errno
-		data, errno = n.getXAttr(attr)
+		data, errno = n.getXAttr(ctx, attr)
 		if errno != 0 {
 			return minus1, errno
 		}
 	} else {
 		// encrypted user xattr
 		cAttr := rn.encryptXattrName(attr)
-		cData, errno := n.getXAttr(cAttr)
+		cData, errno := n.getXAttr(ctx, cAttr)
 		if errno != 0 {
-			return 0, errno
+			return minus1, errno
 		}
 		var err error
 		data, err = rn.decryptXattrValue(cData)
@@ -83,51 +106,79 @@ func (n *Node) Getxattr(ctx context.Context, attr string, dest []byte) (uint32,
 //
 // This function is symlink-safe through Fsetxattr.
 func (n *Node) Setxattr(ctx context.Context, attr string, data []byte, flags uint32) syscall.Errno {
+	n.rootNode().snapshotLock.RLock()
+	defer n.rootNode().snapshotLock.RUnlock()
 	rn := n.rootNode()
+	if rn.contentHashCache != nil && attr == contentHashXattr {
+		// Read-only, computed in Getxattr
+		return syscall.EPERM
+	}
 	flags = uint32(filterXattrSetFlags(int(flags)))
+	if attr == tagsXattr {
+		return n.setTags(ctx, data, int(flags))
+	}
+	if errno := n.unionCopyUp(); errno != 0 {
+		return errno
+	}
 
 	// ACLs are passed through without encryption
-	if isAcl(attr) {
-		return n.setXAttr(attr, data, flags)
+	if rn.passthroughAcl(attr) {
+		return n.setXAttr(ctx, attr, data, flags)
 	}
 
 	cAttr := rn.encryptXattrName(attr)
 	cData := rn.encryptXattrValue(data)
-	return n.setXAttr(cAttr, cData, flags)
+	return n.setXAttr(ctx, cAttr, cData, flags)
 }
 
 // RemoveXAttr - FUSE call.
 //
 // This function is symlink-safe through Fremovexattr.
 func (n *Node) Removexattr(ctx context.Context, attr string) syscall.Errno {
+	n.rootNode().snapshotLock.RLock()
+	defer n.rootNode().snapshotLock.RUnlock()
 	rn := n.rootNode()
+	if rn.contentHashCache != nil && attr == contentHashXattr {
+		return syscall.EPERM
+	}
+	if attr == tagsXattr {
+		return n.setTags(ctx, nil, unix.XATTR_REPLACE)
+	}
+	if errno := n.unionCopyUp(); errno != 0 {
+		return errno
+	}
 
 	// ACLs are passed through without encryption
-	if isAcl(attr) {
-		return n.removeXAttr(attr)
+	if rn.passthroughAcl(attr) {
+		return n.removeXAttr(ctx, attr)
 	}
 
 	cAttr := rn.encryptXattrName(attr)
-	return n.removeXAttr(cAttr)
+	return n.removeXAttr(ctx, cAttr)
 }
 
 // ListXAttr - FUSE call. Lists extended attributes on the file at "relPath".
 //
 // This function is symlink-safe through Flistxattr.
 func (n *Node) Listxattr(ctx context.Context, dest []byte) (uint32, syscall.Errno) {
-	cNames, errno := n.listXAttr()
+	cNames, errno := n.listXAttr(ctx)
 	if errno != 0 {
-		return 0, errno
+		return minus1, errno
 	}
 	rn := n.rootNode()
 	var buf bytes.Buffer
+	if rn.args.FileTags {
+		if _, errno := n.getTags(ctx); errno == 0 {
+			buf.WriteString(tagsXattr + "\000")
+		}
+	}
 	for _, curName := range cNames {
 		// ACLs are passed through without encryption
-		if isAcl(curName) {
+		if rn.passthroughAcl(curName) {
 			buf.WriteString(curName + "\000")
 			continue
 		}
-		if !strings.HasPrefix(curName, xattrStorePrefix) {
+		if !strings.HasPrefix(curName, xattrStorePrefix) || curName == filehash.XattrName {
 			continue
 		}
 		name, err := rn.decryptXattrName(curName)
@@ -137,7 +188,8 @@ func (n *Node) Listxattr(ctx context.Context, dest []byte) (uint32, syscall.Errn
 			continue
 		}
 		// We *used to* encrypt ACLs, which caused a lot of problems.
-		if isAcl(name) {
+		// Now we only do it when asked to.
+		if rn.passthroughAcl(name) {
 			tlog.Warn.Printf("ListXAttr: ignoring deprecated encrypted ACL %q = %q", curName, name)
 			rn.reportMitigatedCorruption(curName)
 			continue
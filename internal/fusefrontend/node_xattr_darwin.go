@@ -1,6 +1,7 @@
 package fusefrontend
 
 import (
+	"context"
 	"syscall"
 
 	"golang.org/x/sys/unix"
@@ -18,15 +19,15 @@ func filterXattrSetFlags(flags int) int {
 	return flags &^ XATTR_NOSECURITY
 }
 
-func (n *Node) getXAttr(cAttr string) (out []byte, errno syscall.Errno) {
-	dirfd, cName, errno := n.prepareAtSyscall("")
+func (n *Node) getXAttr(ctx context.Context, cAttr string) (out []byte, errno syscall.Errno) {
+	dirfd, cName, errno := n.prepareAtSyscall(ctx, "")
 	if errno != 0 {
 		return
 	}
 	defer syscall.Close(dirfd)
 
 	// O_NONBLOCK to not block on FIFOs.
-	fd, err := syscallcompat.Openat(dirfd, cName, syscall.O_RDONLY|syscall.O_NONBLOCK, 0)
+	fd, err := syscallcompat.Openat(dirfd, cName, syscall.O_RDONLY|syscall.O_NONBLOCK|syscall.O_NOFOLLOW, 0)
 	if err != nil {
 		return nil, fs.ToErrno(err)
 	}
@@ -40,18 +41,18 @@ func (n *Node) getXAttr(cAttr string) (out []byte, errno syscall.Errno) {
 	return cData, 0
 }
 
-func (n *Node) setXAttr(cAttr string, cData []byte, flags uint32) (errno syscall.Errno) {
-	dirfd, cName, errno := n.prepareAtSyscall("")
+func (n *Node) setXAttr(ctx context.Context, cAttr string, cData []byte, flags uint32) (errno syscall.Errno) {
+	dirfd, cName, errno := n.prepareAtSyscall(ctx, "")
 	if errno != 0 {
 		return
 	}
 	defer syscall.Close(dirfd)
 
 	// O_NONBLOCK to not block on FIFOs.
-	fd, err := syscallcompat.Openat(dirfd, cName, syscall.O_WRONLY|syscall.O_NONBLOCK, 0)
+	fd, err := syscallcompat.Openat(dirfd, cName, syscall.O_WRONLY|syscall.O_NONBLOCK|syscall.O_NOFOLLOW, 0)
 	// Directories cannot be opened read-write. Retry.
 	if err == syscall.EISDIR {
-		fd, err = syscallcompat.Openat(dirfd, cName, syscall.O_RDONLY|syscall.O_DIRECTORY|syscall.O_NONBLOCK, 0)
+		fd, err = syscallcompat.Openat(dirfd, cName, syscall.O_RDONLY|syscall.O_DIRECTORY|syscall.O_NONBLOCK|syscall.O_NOFOLLOW, 0)
 	}
 	if err != nil {
 		fs.ToErrno(err)
@@ -62,18 +63,18 @@ func (n *Node) setXAttr(cAttr string, cData []byte, flags uint32) (errno syscall
 	return fs.ToErrno(err)
 }
 
-func (n *Node) removeXAttr(cAttr string) (errno syscall.Errno) {
-	dirfd, cName, errno := n.prepareAtSyscall("")
+func (n *Node) removeXAttr(ctx context.Context, cAttr string) (errno syscall.Errno) {
+	dirfd, cName, errno := n.prepareAtSyscall(ctx, "")
 	if errno != 0 {
 		return
 	}
 	defer syscall.Close(dirfd)
 
 	// O_NONBLOCK to not block on FIFOs.
-	fd, err := syscallcompat.Openat(dirfd, cName, syscall.O_WRONLY|syscall.O_NONBLOCK, 0)
+	fd, err := syscallcompat.Openat(dirfd, cName, syscall.O_WRONLY|syscall.O_NONBLOCK|syscall.O_NOFOLLOW, 0)
 	// Directories cannot be opened read-write. Retry.
 	if err == syscall.EISDIR {
-		fd, err = syscallcompat.Openat(dirfd, cName, syscall.O_RDONLY|syscall.O_DIRECTORY|syscall.O_NONBLOCK, 0)
+		fd, err = syscallcompat.Openat(dirfd, cName, syscall.O_RDONLY|syscall.O_DIRECTORY|syscall.O_NONBLOCK|syscall.O_NOFOLLOW, 0)
 	}
 	if err != nil {
 		return fs.ToErrno(err)
@@ -84,15 +85,15 @@ func (n *Node) removeXAttr(cAttr string) (errno syscall.Errno) {
 	return fs.ToErrno(err)
 }
 
-func (n *Node) listXAttr() (out []string, errno syscall.Errno) {
-	dirfd, cName, errno := n.prepareAtSyscall("")
+func (n *Node) listXAttr(ctx context.Context) (out []string, errno syscall.Errno) {
+	dirfd, cName, errno := n.prepareAtSyscall(ctx, "")
 	if errno != 0 {
 		return
 	}
 	defer syscall.Close(dirfd)
 
 	// O_NONBLOCK to not block on FIFOs.
-	fd, err := syscallcompat.Openat(dirfd, cName, syscall.O_RDONLY|syscall.O_NONBLOCK, 0)
+	fd, err := syscallcompat.Openat(dirfd, cName, syscall.O_RDONLY|syscall.O_NONBLOCK|syscall.O_NOFOLLOW, 0)
 	if err != nil {
 		return nil, fs.ToErrno(err)
 	}
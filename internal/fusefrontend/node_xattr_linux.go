@@ -1,6 +1,7 @@
 package fusefrontend
 
 import (
+	"context"
 	"fmt"
 	"syscall"
 
@@ -15,8 +16,8 @@ func filterXattrSetFlags(flags int) int {
 	return flags
 }
 
-func (n *Node) getXAttr(cAttr string) (out []byte, errno syscall.Errno) {
-	dirfd, cName, errno := n.prepareAtSyscall("")
+func (n *Node) getXAttr(ctx context.Context, cAttr string) (out []byte, errno syscall.Errno) {
+	dirfd, cName, errno := n.prepareAtSyscall(ctx, "")
 	if errno != 0 {
 		return
 	}
@@ -30,8 +31,8 @@ func (n *Node) getXAttr(cAttr string) (out []byte, errno syscall.Errno) {
 	return cData, 0
 }
 
-func (n *Node) setXAttr(cAttr string, cData []byte, flags uint32) (errno syscall.Errno) {
-	dirfd, cName, errno := n.prepareAtSyscall("")
+func (n *Node) setXAttr(ctx context.Context, cAttr string, cData []byte, flags uint32) (errno syscall.Errno) {
+	dirfd, cName, errno := n.prepareAtSyscall(ctx, "")
 	if errno != 0 {
 		return
 	}
@@ -41,8 +42,8 @@ func (n *Node) setXAttr(cAttr string, cData []byte, flags uint32) (errno syscall
 	return fs.ToErrno(unix.Lsetxattr(procPath, cAttr, cData, int(flags)))
 }
 
-func (n *Node) removeXAttr(cAttr string) (errno syscall.Errno) {
-	dirfd, cName, errno := n.prepareAtSyscall("")
+func (n *Node) removeXAttr(ctx context.Context, cAttr string) (errno syscall.Errno) {
+	dirfd, cName, errno := n.prepareAtSyscall(ctx, "")
 	if errno != 0 {
 		return
 	}
@@ -52,8 +53,8 @@ func (n *Node) removeXAttr(cAttr string) (errno syscall.Errno) {
 	return fs.ToErrno(unix.Lremovexattr(procPath, cAttr))
 }
 
-func (n *Node) listXAttr() (out []string, errno syscall.Errno) {
-	dirfd, cName, errno := n.prepareAtSyscall("")
+func (n *Node) listXAttr(ctx context.Context) (out []string, errno syscall.Errno) {
+	dirfd, cName, errno := n.prepareAtSyscall(ctx, "")
 	if errno != 0 {
 		return
 	}
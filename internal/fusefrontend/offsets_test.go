@@ -0,0 +1,97 @@
+package fusefrontend
+
+import (
+	"bytes"
+	"math"
+	"syscall"
+	"testing"
+
+	"github.com/hanwen/go-fuse/v2/fuse"
+
+	"github.com/rfjakob/gocryptfs/tests/test_helpers"
+)
+
+// TestLargeOffsets writes and reads around the 32-bit boundaries, and checks
+// that offsets near the 63-bit limit, where the ciphertext offsets would
+// overflow int64, are rejected instead of wrapping around.
+func TestLargeOffsets(t *testing.T) {
+	rn := newTestFS(Args{Cipherdir: test_helpers.InitFS(t)})
+	ch, fh, _, errno := rn.Create(nil, "foo", syscall.O_RDWR, 0600, &fuse.EntryOut{})
+	if errno != 0 {
+		t.Fatal(errno)
+	}
+	rn.AddChild("foo", ch, true)
+	f := fh.(*File)
+	defer f.Release(nil)
+	max := int64(f.contentEnc.MaxPlainSize())
+
+	// Writes that cross the 32-bit boundaries work. The file is sparse.
+	data := []byte("0123456789")
+	for _, off := range []int64{1<<31 - 5, 1<<32 - 5, 1<<32 + 5} {
+		if n, errno := f.Write(nil, data, off); errno != 0 || int(n) != len(data) {
+			t.Fatalf("write at %d: n=%d errno=%v", off, n, errno)
+		}
+		buf := make([]byte, len(data))
+		res, errno := f.Read(nil, buf, off)
+		if errno != 0 {
+			t.Fatalf("read at %d: %v", off, errno)
+		}
+		if have, _ := res.Bytes(buf); !bytes.Equal(have, data) {
+			t.Errorf("read at %d: have %q, want %q", off, have, data)
+		}
+	}
+
+	writeTestCases := []struct {
+		off   int64
+		errno syscall.Errno
+	}{
+		{-1, syscall.EINVAL},
+		{math.MinInt64, syscall.EINVAL},
+		{max, syscall.EFBIG},
+		{max - 5, syscall.EFBIG},
+		{1<<63 - 1 - 1<<50, syscall.EFBIG},
+		{math.MaxInt64 - int64(len(data)) + 1, syscall.EFBIG},
+	}
+	for _, tc := range writeTestCases {
+		if _, errno := f.Write(nil, data, tc.off); errno != tc.errno {
+			t.Errorf("write at %d: want %v, have %v", tc.off, tc.errno, errno)
+		}
+	}
+
+	// Reads beyond the maximum file size return EOF
+	for _, off := range []int64{1 << 62, max - 5, max, math.MaxInt64 - 5, math.MaxInt64} {
+		buf := make([]byte, 100)
+		res, errno := f.Read(nil, buf, off)
+		if errno != 0 {
+			t.Errorf("read at %d: %v", off, errno)
+			continue
+		}
+		if have, _ := res.Bytes(buf); len(have) != 0 {
+			t.Errorf("read at %d: have %d bytes, want EOF", off, len(have))
+		}
+	}
+	if _, errno = f.Read(nil, make([]byte, 100), -1); errno != syscall.EINVAL {
+		t.Errorf("read at -1: want EINVAL, have %v", errno)
+	}
+
+	// truncate(2) and fallocate(2) beyond the maximum file size
+	in := &fuse.SetAttrIn{SetAttrInCommon: fuse.SetAttrInCommon{Valid: fuse.FATTR_SIZE, Size: uint64(max) + 1}}
+	if errno = f.Setattr(nil, in, &fuse.AttrOut{}); errno != syscall.EFBIG {
+		t.Errorf("truncate to max+1: want EFBIG, have %v", errno)
+	}
+	if errno = f.Allocate(nil, uint64(max)-5, 10, 0); errno != syscall.EFBIG {
+		t.Errorf("fallocate across max: want EFBIG, have %v", errno)
+	}
+	if errno = f.Allocate(nil, math.MaxUint64-5, 10, 0); errno != syscall.EFBIG {
+		t.Errorf("fallocate with wrapping end: want EFBIG, have %v", errno)
+	}
+
+	// The rejected requests did not change the file
+	var a fuse.AttrOut
+	if errno = f.Getattr(nil, &a); errno != 0 {
+		t.Fatal(errno)
+	}
+	if want := uint64(1<<32+5) + uint64(len(data)); a.Size != want {
+		t.Errorf("size: have %d, want %d", a.Size, want)
+	}
+}
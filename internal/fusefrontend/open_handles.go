@@ -0,0 +1,135 @@
+package fusefrontend
+
+import (
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/rfjakob/gocryptfs/ctlsock"
+	"github.com/rfjakob/gocryptfs/internal/ctlsocksrv"
+	"github.com/rfjakob/gocryptfs/internal/syscallcompat"
+)
+
+var _ ctlsocksrv.OpenFileLister = &RootNode{} // Verify that interface is implemented.
+
+// openHandles is the registry of open file handles, for ListOpenFiles.
+// Open and Create add a handle, Release removes it.
+type openHandles struct {
+	sync.Mutex
+	m map[*File]openHandle
+}
+
+// openHandle is what the registry knows about an open File
+type openHandle struct {
+	path           string
+	flags          uint32
+	backingFlags   int
+	writeOnlyChmod bool
+	opened         time.Time
+}
+
+func (h *openHandles) add(f *File, oh openHandle) {
+	h.Lock()
+	defer h.Unlock()
+	if h.m == nil {
+		h.m = make(map[*File]openHandle)
+	}
+	oh.opened = time.Now()
+	h.m[f] = oh
+}
+
+func (h *openHandles) remove(f *File) {
+	h.Lock()
+	delete(h.m, f)
+	h.Unlock()
+}
+
+// ListOpenFiles implements ctlsocksrv.OpenFileLister. The list is sorted by
+// path and opening time.
+func (rn *RootNode) ListOpenFiles() []ctlsock.OpenFile {
+	rn.handles.Lock()
+	files := make(map[*File]openHandle, len(rn.handles.m))
+	for f, oh := range rn.handles.m {
+		files[f] = oh
+	}
+	rn.handles.Unlock()
+
+	out := []ctlsock.OpenFile{}
+	for f, oh := range files {
+		out = append(out, ctlsock.OpenFile{
+			Path:           oh.path,
+			Flags:          openFlagsString(int(oh.flags)),
+			BackingFlags:   openFlagsString(oh.backingFlags),
+			WriteOnlyChmod: oh.writeOnlyChmod,
+			BufferedBytes:  f.bufferedBytes(),
+			Opened:         oh.opened,
+		})
+	}
+	sort.Slice(out, func(i, j int) bool {
+		if out[i].Path != out[j].Path {
+			return out[i].Path < out[j].Path
+		}
+		return out[i].Opened.Before(out[j].Opened)
+	})
+	return out
+}
+
+// bufferedBytes returns the number of bytes in the "-writebuffer" buffer of
+// the handle. Zero if the handle has been released in the meantime.
+func (f *File) bufferedBytes() int {
+	f.fdLock.RLock()
+	defer f.fdLock.RUnlock()
+	if f.released {
+		return 0
+	}
+	f.fileTableEntry.ContentLock.RLock()
+	defer f.fileTableEntry.ContentLock.RUnlock()
+	return len(f.wbuf.data)
+}
+
+// openFlagNames are the flags openFlagsString knows about. Unknown flags are
+// shown as a hex number.
+var openFlagNames = []struct {
+	flag int
+	name string
+}{
+	{syscall.O_APPEND, "O_APPEND"},
+	{syscall.O_CREAT, "O_CREAT"},
+	{syscall.O_EXCL, "O_EXCL"},
+	{syscall.O_TRUNC, "O_TRUNC"},
+	{syscall.O_NONBLOCK, "O_NONBLOCK"},
+	{syscall.O_SYNC, "O_SYNC"},
+	{syscall.O_NOFOLLOW, "O_NOFOLLOW"},
+	{syscall.O_CLOEXEC, "O_CLOEXEC"},
+	{syscallcompat.O_DIRECT, "O_DIRECT"},
+	{syscallcompat.O_NOATIME, "O_NOATIME"},
+}
+
+// openFlagsString formats open flags like "O_WRONLY|O_APPEND"
+func openFlagsString(flags int) string {
+	var parts []string
+	switch flags & syscall.O_ACCMODE {
+	case syscall.O_RDONLY:
+		parts = append(parts, "O_RDONLY")
+	case syscall.O_WRONLY:
+		parts = append(parts, "O_WRONLY")
+	case syscall.O_RDWR:
+		parts = append(parts, "O_RDWR")
+	}
+	rest := flags &^ syscall.O_ACCMODE
+	for _, n := range openFlagNames {
+		// O_DIRECT and O_NOATIME are zero on MacOS. O_SYNC includes
+		// O_DSYNC on Linux and must match completely.
+		if n.flag != 0 && rest&n.flag == n.flag {
+			parts = append(parts, n.name)
+			rest &^= n.flag
+		}
+	}
+	if rest != 0 {
+		parts = append(parts, "0x"+strconv.FormatInt(int64(rest), 16))
+	}
+	return strings.Join(parts, "|")
+}
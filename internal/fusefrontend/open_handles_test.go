@@ -0,0 +1,173 @@
+package fusefrontend
+
+import (
+	"bytes"
+	"sync"
+	"syscall"
+	"testing"
+
+	"github.com/hanwen/go-fuse/v2/fuse"
+
+	"github.com/rfjakob/gocryptfs/tests/test_helpers"
+)
+
+// TestListOpenFiles opens two files with different flags and checks that
+// ListOpenFiles reports both, and that no handle stays in the registry after
+// Release.
+func TestListOpenFiles(t *testing.T) {
+	rn := newTestFS(Args{Cipherdir: test_helpers.InitFS(t), WriteBuffer: true})
+	writeTestFile(t, &rn.Node, "a", 0)
+	writeTestFile(t, &rn.Node, "b", 100)
+	d := mkdirTestDir(t, &rn.Node, "dir")
+	writeTestFile(t, d, "c", 0)
+	if l := rn.ListOpenFiles(); len(l) != 0 {
+		t.Fatalf("Create and Release left %d handles behind: %v", len(l), l)
+	}
+
+	fa, _, errno := lookupChild(t, &rn.Node, "a").Open(nil, syscall.O_WRONLY|syscall.O_APPEND)
+	if errno != 0 {
+		t.Fatal(errno)
+	}
+	fc, _, errno := lookupChild(t, d, "c").Open(nil, syscall.O_RDONLY)
+	if errno != 0 {
+		t.Fatal(errno)
+	}
+	// Stays in the "-writebuffer" buffer
+	if _, errno = fa.(*File).Write(nil, make([]byte, 10), 0); errno != 0 {
+		t.Fatal(errno)
+	}
+	l := rn.ListOpenFiles()
+	if len(l) != 2 {
+		t.Fatalf("want 2 open files, have %v", l)
+	}
+	if l[0].Path != "a" || l[0].Flags != "O_WRONLY|O_APPEND" || l[0].BackingFlags != "O_RDWR|O_NOFOLLOW" ||
+		l[0].WriteOnlyChmod || l[0].BufferedBytes != 10 || l[0].Opened.IsZero() {
+		t.Errorf("wrong entry for a: %+v", l[0])
+	}
+	if l[1].Path != "dir/c" || l[1].Flags != "O_RDONLY" || l[1].BackingFlags != "O_RDONLY|O_NOFOLLOW" ||
+		l[1].BufferedBytes != 0 {
+		t.Errorf("wrong entry for dir/c: %+v", l[1])
+	}
+
+	// Truncate through Setattr opens and releases a handle internally
+	in := &fuse.SetAttrIn{SetAttrInCommon: fuse.SetAttrInCommon{Valid: fuse.FATTR_SIZE, Size: 0}}
+	if errno = lookupChild(t, &rn.Node, "b").Setattr(nil, nil, in, &fuse.AttrOut{}); errno != 0 {
+		t.Fatal(errno)
+	}
+	// Opening a file that does not exist anymore fails without leaving a
+	// handle behind
+	if errno = rn.Unlink(nil, "b"); errno != 0 {
+		t.Fatal(errno)
+	}
+	if _, _, errno = lookupChild(t, &rn.Node, "b").Open(nil, syscall.O_RDONLY); errno == 0 {
+		t.Fatal("Open of a deleted file should have failed")
+	}
+	if l := rn.ListOpenFiles(); len(l) != 2 {
+		t.Errorf("want 2 open files, have %v", l)
+	}
+
+	fa.(*File).Release(nil)
+	fc.(*File).Release(nil)
+	if l := rn.ListOpenFiles(); len(l) != 0 {
+		t.Errorf("Release left %d handles behind: %v", len(l), l)
+	}
+}
+
+// TestConcurrentOpenFlags opens the same file O_RDONLY and O_WRONLY. The
+// O_WRONLY backing fd is O_RDWR, but each handle has to keep the access mode
+// it was opened with. Writes through one handle must never show up as torn
+// or undecryptable blocks in reads through the other.
+func TestConcurrentOpenFlags(t *testing.T) {
+	rn := newTestFS(Args{Cipherdir: test_helpers.InitFS(t)})
+	const blocks = 8
+	bs := int(rn.contentEnc.PlainBS())
+	writeTestFile(t, &rn.Node, "f", blocks*bs)
+	_, r := openTestFile(t, rn, "f", syscall.O_RDONLY)
+	_, w := openTestFile(t, rn, "f", syscall.O_WRONLY)
+	if r.fileTableEntry != w.fileTableEntry || r.fd == w.fd {
+		t.Fatal("handles should share the open file table entry, but not the fd")
+	}
+	if _, errno := w.Read(nil, make([]byte, bs), 0); errno != syscall.EBADF {
+		t.Errorf("Read on the O_WRONLY handle: want EBADF, have %v", errno)
+	}
+	if _, errno := r.Write(nil, []byte("x"), 0); errno == 0 {
+		t.Errorf("Write on the O_RDONLY handle should have failed")
+	}
+	l := rn.ListOpenFiles()
+	if len(l) != 2 || l[0].Flags != "O_RDONLY" || l[0].BackingFlags != "O_RDONLY|O_NOFOLLOW" ||
+		l[1].Flags != "O_WRONLY" || l[1].BackingFlags != "O_RDWR|O_NOFOLLOW" {
+		t.Fatalf("wrong open file list: %+v", l)
+	}
+
+	// Each write fills a whole block with one byte value, so every block the
+	// reader sees must consist of a single value
+	const rounds = 50
+	var wg sync.WaitGroup
+	wg.Add(2)
+	go func() {
+		defer wg.Done()
+		for i := 1; i <= rounds; i++ {
+			for b := 0; b < blocks; b++ {
+				if _, errno := w.Write(nil, bytes.Repeat([]byte{byte(i)}, bs), int64(b*bs)); errno != 0 {
+					t.Errorf("Write: %v", errno)
+					return
+				}
+			}
+		}
+	}()
+	go func() {
+		defer wg.Done()
+		buf := make([]byte, blocks*bs)
+		for i := 0; i < rounds; i++ {
+			res, errno := r.Read(nil, buf, 0)
+			if errno != 0 {
+				t.Errorf("Read: %v", errno)
+				return
+			}
+			data, _ := res.Bytes(buf)
+			if len(data) != len(buf) {
+				t.Errorf("short read: %d bytes", len(data))
+				return
+			}
+			for b := 0; b < blocks; b++ {
+				block := data[b*bs : (b+1)*bs]
+				if !bytes.Equal(block, bytes.Repeat(block[:1], bs)) {
+					t.Errorf("block %d is torn", b)
+					return
+				}
+			}
+		}
+	}()
+	wg.Wait()
+
+	// Releasing one handle leaves the other one working
+	w.Release(nil)
+	res, errno := r.Read(nil, make([]byte, bs), int64((blocks-1)*bs))
+	if errno != 0 {
+		t.Fatal(errno)
+	}
+	if data, _ := res.Bytes(nil); !bytes.Equal(data, bytes.Repeat([]byte{rounds}, bs)) {
+		t.Errorf("last block does not have the final content")
+	}
+	r.Release(nil)
+	if l := rn.ListOpenFiles(); len(l) != 0 {
+		t.Errorf("Release left %d handles behind: %v", len(l), l)
+	}
+}
+
+func TestOpenFlagsString(t *testing.T) {
+	testCases := []struct {
+		flags int
+		want  string
+	}{
+		{syscall.O_RDONLY, "O_RDONLY"},
+		{syscall.O_RDWR | syscall.O_CREAT | syscall.O_EXCL, "O_RDWR|O_CREAT|O_EXCL"},
+		{syscall.O_WRONLY | syscall.O_TRUNC | syscall.O_SYNC, "O_WRONLY|O_TRUNC|O_SYNC"},
+		{syscall.O_RDONLY | 1<<30, "O_RDONLY|0x40000000"},
+	}
+	for _, tc := range testCases {
+		if have := openFlagsString(tc.flags); have != tc.want {
+			t.Errorf("%#x: want %q, have %q", tc.flags, tc.want, have)
+		}
+	}
+}
@@ -0,0 +1,32 @@
+package fusefrontend
+
+import (
+	"sync/atomic"
+	"syscall"
+
+	"github.com/rfjakob/gocryptfs/internal/tlog"
+)
+
+// reserveHandle takes one of the "-max_open" slots for a File that is about
+// to be opened. Fails with ENFILE if all slots are taken: the limit is
+// shared by every process that uses the mount, like the system-wide file
+// table. Every successful call must be paired with releaseHandle.
+func (rn *RootNode) reserveHandle() syscall.Errno {
+	if rn.args.MaxOpen <= 0 {
+		return 0
+	}
+	if atomic.AddInt32(&rn.openCount, 1) > int32(rn.args.MaxOpen) {
+		atomic.AddInt32(&rn.openCount, -1)
+		tlog.Warn.PrintfLimited(&rn.maxOpenLog, "Reached the limit of %d open files (-max_open)", rn.args.MaxOpen)
+		return syscall.ENFILE
+	}
+	return 0
+}
+
+// releaseHandle gives back the slot taken by reserveHandle
+func (rn *RootNode) releaseHandle() {
+	if rn.args.MaxOpen <= 0 {
+		return
+	}
+	atomic.AddInt32(&rn.openCount, -1)
+}
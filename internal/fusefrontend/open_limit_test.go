@@ -0,0 +1,69 @@
+package fusefrontend
+
+import (
+	"syscall"
+	"testing"
+
+	"github.com/hanwen/go-fuse/v2/fuse"
+
+	"github.com/rfjakob/gocryptfs/tests/test_helpers"
+)
+
+// TestMaxOpen fills all "-max_open" slots with a mix of opens and creates,
+// checks that the next ones fail with ENFILE, and that closing a handle, or
+// a failed open, frees a slot.
+func TestMaxOpen(t *testing.T) {
+	rn := newTestFS(Args{Cipherdir: test_helpers.InitFS(t), MaxOpen: 3})
+	createFile(t, &rn.Node, "f", []byte("x"))
+	n := lookupChild(t, &rn.Node, "f")
+
+	var open []*File
+	defer func() {
+		for _, f := range open {
+			f.Release(nil)
+		}
+	}()
+	for i := 0; i < 2; i++ {
+		fh, _, errno := n.Open(nil, syscall.O_RDONLY)
+		if errno != 0 {
+			t.Fatal(errno)
+		}
+		open = append(open, fh.(*File))
+	}
+	_, fh, _, errno := rn.Create(nil, "new", syscall.O_RDWR, 0600, &fuse.EntryOut{})
+	if errno != 0 {
+		t.Fatal(errno)
+	}
+	open = append(open, fh.(*File))
+
+	if _, _, errno = n.Open(nil, syscall.O_RDONLY); errno != syscall.ENFILE {
+		t.Errorf("Open past the limit: want ENFILE, got %v", errno)
+	}
+	if _, _, _, errno = rn.Create(nil, "new2", syscall.O_RDWR, 0600, &fuse.EntryOut{}); errno != syscall.ENFILE {
+		t.Errorf("Create past the limit: want ENFILE, got %v", errno)
+	}
+
+	open[0].Release(nil)
+	open = open[1:]
+	// A failed open must give its slot back
+	if _, _, _, errno = rn.Create(nil, "new", syscall.O_RDWR|syscall.O_EXCL, 0600, &fuse.EntryOut{}); errno != syscall.EEXIST {
+		t.Fatalf("want EEXIST, got %v", errno)
+	}
+	fh2, _, errno := n.Open(nil, syscall.O_RDONLY)
+	if errno != 0 {
+		t.Fatalf("Open after Release: %v", errno)
+	}
+	open = append(open, fh2.(*File))
+
+	// Without a limit
+	rn = newTestFS(Args{Cipherdir: test_helpers.InitFS(t)})
+	createFile(t, &rn.Node, "f", []byte("x"))
+	n = lookupChild(t, &rn.Node, "f")
+	for i := 0; i < 10; i++ {
+		fh, _, errno := n.Open(nil, syscall.O_RDONLY)
+		if errno != 0 {
+			t.Fatal(errno)
+		}
+		open = append(open, fh.(*File))
+	}
+}
@@ -0,0 +1,88 @@
+package fusefrontend
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"syscall"
+	"testing"
+
+	"github.com/hanwen/go-fuse/v2/fuse"
+
+	"github.com/rfjakob/gocryptfs/internal/contentenc"
+	"github.com/rfjakob/gocryptfs/tests/test_helpers"
+)
+
+// TestOpenTrunc opens a file with O_TRUNC while another handle is open and
+// checks that the file reads back empty and gets a new header on the next
+// write, also through the old handle.
+func TestOpenTrunc(t *testing.T) {
+	cipherdir := test_helpers.InitFS(t)
+	rn := newTestFS(Args{Cipherdir: cipherdir})
+	ch, fh, _, errno := rn.Create(nil, "foo", syscall.O_RDWR, 0600, &fuse.EntryOut{})
+	if errno != 0 {
+		t.Fatal(errno)
+	}
+	rn.AddChild("foo", ch, true)
+	f1 := fh.(*File)
+	defer f1.Release(nil)
+	if _, errno = f1.Write(nil, bytes.Repeat([]byte("a"), 10000), 0); errno != 0 {
+		t.Fatal(errno)
+	}
+	header := func() []byte {
+		dirfd, cName, err := rn.openBackingDir("foo")
+		if err != nil {
+			t.Fatal(err)
+		}
+		syscall.Close(dirfd)
+		buf := make([]byte, contentenc.HeaderLen)
+		cf, err := os.Open(filepath.Join(cipherdir, cName))
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer cf.Close()
+		if _, err = cf.ReadAt(buf, 0); err != nil {
+			t.Fatal(err)
+		}
+		return buf
+	}
+	oldHeader := header()
+
+	fh2, _, errno := toNode(ch.Operations()).Open(nil, syscall.O_WRONLY|syscall.O_TRUNC)
+	if errno != 0 {
+		t.Fatal(errno)
+	}
+	f2 := fh2.(*File)
+	defer f2.Release(nil)
+	var out fuse.AttrOut
+	if errno = f2.Getattr(nil, &out); errno != 0 {
+		t.Fatal(errno)
+	}
+	if out.Size != 0 {
+		t.Fatalf("size after O_TRUNC: %d", out.Size)
+	}
+	buf := make([]byte, 100)
+	if res, errno := f1.Read(nil, buf, 0); errno != 0 {
+		t.Fatal(errno)
+	} else if have, _ := res.Bytes(buf); len(have) != 0 {
+		t.Fatalf("read %d bytes after O_TRUNC", len(have))
+	}
+	// The old handle must not reuse the old file ID
+	if _, errno = f1.Write(nil, []byte("new"), 0); errno != 0 {
+		t.Fatal(errno)
+	}
+	newHeader := header()
+	if _, err := contentenc.ParseHeader(newHeader); err != nil {
+		t.Fatalf("invalid header on disk: %v", err)
+	}
+	if bytes.Equal(newHeader, oldHeader) {
+		t.Error("the header was not renewed")
+	}
+	res, errno := f1.Read(nil, buf, 0)
+	if errno != 0 {
+		t.Fatal(errno)
+	}
+	if have, _ := res.Bytes(buf); string(have) != "new" {
+		t.Errorf("wrong content %q", have)
+	}
+}
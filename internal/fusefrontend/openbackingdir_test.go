@@ -166,3 +166,66 @@ func TestOpenBackingDirPlaintextNames(t *testing.T) {
 	}
 	syscall.Close(dirfd)
 }
+
+// lookupPath looks up the slash-separated "path" below "n" one component at
+// a time, like the kernel does, and returns the error of the first lookup
+// that failed.
+func lookupPath(t *testing.T, n *Node, path string) syscall.Errno {
+	for _, name := range strings.Split(path, "/") {
+		var errno syscall.Errno
+		if n, errno = lookup(t, n, name); errno != 0 {
+			return errno
+		}
+	}
+	return 0
+}
+
+// TestLookupNotDir checks that resolving a path through a file fails with
+// ENOTDIR, and through a missing entry with ENOENT, at every depth and in
+// every mode that changes how backing paths are resolved.
+func TestLookupNotDir(t *testing.T) {
+	long := strings.Repeat("l", 200)
+	lower := test_helpers.InitFS(t)
+	lrn := newTestFS(Args{Cipherdir: lower})
+	createFile(t, &lrn.Node, "lowerfile", nil)
+	createFile(t, mkdirTestDir(t, &lrn.Node, "lowerdir"), "lowerfile", nil)
+
+	for _, args := range []Args{
+		{Cipherdir: test_helpers.InitFS(t)},
+		{Cipherdir: test_helpers.InitFS(t, "-plaintextnames"), PlaintextNames: true},
+		{Cipherdir: test_helpers.InitFS(t), Fanout: true},
+		{Cipherdir: newUnionUpper(t, lower), LowerCipherdir: lower},
+	} {
+		rn := newTestFS(args)
+		if args.LowerCipherdir != "" {
+			if err := rn.CheckLowerdir(); err != nil {
+				t.Fatal(err)
+			}
+		}
+		d := mkdirTestDir(t, &rn.Node, "dir")
+		for _, dir := range []*Node{&rn.Node, d} {
+			createFile(t, dir, "realfile", nil)
+			createFile(t, dir, long, nil)
+		}
+		cases := map[string]syscall.Errno{
+			"realfile/sub":         syscall.ENOTDIR,
+			"realfile/sub/x":       syscall.ENOTDIR,
+			long + "/sub":          syscall.ENOTDIR,
+			"dir/realfile/sub":     syscall.ENOTDIR,
+			"dir/" + long + "/sub": syscall.ENOTDIR,
+			"missing/sub":          syscall.ENOENT,
+			"dir/missing/sub":      syscall.ENOENT,
+			"dir/realfile":         0,
+		}
+		if args.LowerCipherdir != "" {
+			cases["lowerfile/sub"] = syscall.ENOTDIR
+			cases["lowerdir/lowerfile/sub"] = syscall.ENOTDIR
+			cases["lowerdir/missing/sub"] = syscall.ENOENT
+		}
+		for p, want := range cases {
+			if have := lookupPath(t, &rn.Node, p); have != want {
+				t.Errorf("%+v: %s: want %v, have %v", args, p, want, have)
+			}
+		}
+	}
+}
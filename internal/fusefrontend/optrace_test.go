@@ -0,0 +1,134 @@
+package fusefrontend
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"syscall"
+	"testing"
+
+	"github.com/hanwen/go-fuse/v2/fuse"
+
+	"github.com/rfjakob/gocryptfs/internal/optrace"
+	"github.com/rfjakob/gocryptfs/internal/syscallcompat"
+	"github.com/rfjakob/gocryptfs/tests/test_helpers"
+)
+
+// TestOpTraceReplay records a short session, replays it into an empty
+// directory, and checks that the result has the same structure.
+func TestOpTraceReplay(t *testing.T) {
+	cipherdir := test_helpers.InitFS(t)
+	rn := newTestFS(Args{Cipherdir: cipherdir})
+	var trace bytes.Buffer
+	rn.OpTrace = optrace.New(&trace)
+	secret := bytes.Repeat([]byte("secretcontent"), 1000)
+
+	dirInode, errno := rn.Mkdir(nil, "secretdir", 0700, &fuse.EntryOut{})
+	if errno != 0 {
+		t.Fatal(errno)
+	}
+	rn.AddChild("secretdir", dirInode, true)
+	dir := dirInode.Operations().(*Node)
+
+	create := func(n *Node, name string) *File {
+		ch, fh, _, errno := n.Create(nil, name, syscall.O_RDWR, 0600, &fuse.EntryOut{})
+		if errno != 0 {
+			t.Fatal(errno)
+		}
+		n.AddChild(name, ch, true)
+		return fh.(*File)
+	}
+	write := func(f *File, data []byte, off int64) {
+		if _, errno := f.Write(nil, data, off); errno != 0 {
+			t.Fatal(errno)
+		}
+	}
+	// secretdir/file1: 10000 bytes, a hole, and 100 more bytes
+	f := create(dir, "file1")
+	write(f, secret[:10000], 0)
+	write(f, secret[:100], 20000)
+	f.Release(nil)
+	// secretdir/b: written, truncated, and renamed from "a"
+	f = create(&rn.Node, "a")
+	write(f, secret[:5000], 0)
+	in := &fuse.SetAttrIn{}
+	in.Valid = fuse.FATTR_SIZE
+	in.Size = 3000
+	if errno := f.Setattr(nil, in, &fuse.AttrOut{}); errno != 0 {
+		t.Fatal(errno)
+	}
+	f.Release(nil)
+	if errno := rn.Rename(nil, "a", dir, "b", 0); errno != 0 {
+		t.Fatal(errno)
+	}
+	// RENAME_NOREPLACE onto secretdir/b fails and must fail on replay, too.
+	// No rename flags on MacOS.
+	if syscallcompat.RENAME_NOREPLACE != 0 {
+		create(&rn.Node, "d").Release(nil)
+		if errno := rn.Rename(nil, "d", dir, "b", syscallcompat.RENAME_NOREPLACE); errno != syscall.EEXIST {
+			t.Fatalf("RENAME_NOREPLACE: want EEXIST, got %v", errno)
+		}
+		if errno := rn.Unlink(nil, "d"); errno != 0 {
+			t.Fatal(errno)
+		}
+	}
+	// "c" is created and deleted again
+	create(&rn.Node, "c").Release(nil)
+	if errno := rn.Unlink(nil, "c"); errno != 0 {
+		t.Fatal(errno)
+	}
+	// Read back file1
+	fh, _, errno := dir.GetChild("file1").Operations().(*Node).Open(nil, syscall.O_RDONLY)
+	if errno != 0 {
+		t.Fatal(errno)
+	}
+	if _, errno := fh.(*File).Read(nil, make([]byte, 4096), 0); errno != 0 {
+		t.Fatal(errno)
+	}
+	fh.(*File).Release(nil)
+
+	for _, s := range []string{"secretdir", "file1", "secretcontent"} {
+		if bytes.Contains(trace.Bytes(), []byte(s)) {
+			t.Errorf("trace contains plaintext %q", s)
+		}
+	}
+
+	replayDir, err := ioutil.TempDir(test_helpers.TmpDir, "replay.")
+	if err != nil {
+		t.Fatal(err)
+	}
+	mismatches, err := optrace.Replay(&trace, replayDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if mismatches != 0 {
+		t.Errorf("%d mismatches", mismatches)
+	}
+
+	// Root should contain a single directory containing two files
+	entries, err := ioutil.ReadDir(replayDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) != 1 || !entries[0].IsDir() {
+		t.Fatalf("wrong root dir contents: %v", entries)
+	}
+	entries, err = ioutil.ReadDir(filepath.Join(replayDir, entries[0].Name()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var sizes []int64
+	for _, e := range entries {
+		if !e.Mode().IsRegular() {
+			t.Errorf("%q is not a regular file", e.Name())
+		}
+		sizes = append(sizes, e.Size())
+	}
+	sort.Slice(sizes, func(i, j int) bool { return sizes[i] < sizes[j] })
+	if len(sizes) != 2 || sizes[0] != 3000 || sizes[1] != 20100 {
+		t.Errorf("wrong file sizes: %v", sizes)
+	}
+	os.RemoveAll(replayDir)
+}
@@ -0,0 +1,98 @@
+package fusefrontend
+
+import (
+	"path/filepath"
+	"sort"
+	"strings"
+	"syscall"
+	"testing"
+
+	"github.com/hanwen/go-fuse/v2/fuse"
+
+	"github.com/rfjakob/gocryptfs/tests/test_helpers"
+)
+
+// listDir returns the names in directory "n", without "." and "..".
+func listDir(t *testing.T, n *Node) []string {
+	ds, errno := n.Readdir(nil)
+	if errno != 0 {
+		t.Fatal(errno)
+	}
+	var names []string
+	for ds.HasNext() {
+		e, _ := ds.Next()
+		if e.Name != "." && e.Name != ".." {
+			names = append(names, e.Name)
+		}
+	}
+	sort.Strings(names)
+	return names
+}
+
+// TestPrefix mounts "data/2024" of a filesystem as the root and checks that
+// the listing shows the shortened paths, and that files created there end up
+// in the right place.
+func TestPrefix(t *testing.T) {
+	cipherdir := test_helpers.InitFS(t)
+	rn := newTestFS(Args{Cipherdir: cipherdir, LongNames: true})
+	n := &rn.Node
+	for _, name := range []string{"data", "2024", "sub"} {
+		ch, errno := n.Mkdir(nil, name, 0700, &fuse.EntryOut{})
+		if errno != 0 {
+			t.Fatal(errno)
+		}
+		n.AddChild(name, ch, true)
+		n = toNode(ch.Operations())
+		if name == "2024" {
+			writeTestFile(t, n, "report", 10)
+		}
+	}
+	writeTestFile(t, &rn.Node, "outside", 1)
+
+	rp := newTestFS(Args{Cipherdir: cipherdir, LongNames: true, Prefix: "data/2024"})
+	if err := rp.CheckPrefix(); err != nil {
+		t.Fatal(err)
+	}
+	if have := strings.Join(listDir(t, &rp.Node), " "); have != "report sub" {
+		t.Errorf("wrong root listing %q", have)
+	}
+	if _, errno := rp.Lookup(nil, "outside", &fuse.EntryOut{}); errno != syscall.ENOENT {
+		t.Errorf("file outside of the prefix: want ENOENT, got %v", errno)
+	}
+	sub := lookupNode(t, rp, "sub")
+	long := strings.Repeat("x", 200)
+	writeTestFile(t, sub, long, 5)
+	// Visible without the prefix, so the names were encrypted with the right
+	// DirIVs
+	if have := strings.Join(listDir(t, n), " "); have != long {
+		t.Errorf("file created below the prefix not found: %q", have)
+	}
+	var a fuse.AttrOut
+	if errno := lookupChild(t, sub, long).Getattr(nil, nil, &a); errno != 0 || a.Size != 5 {
+		t.Errorf("Getattr: size=%d errno=%v", a.Size, errno)
+	}
+
+	// ctlsock paths
+	cPath, err := rp.EncryptPath("sub/" + long)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cPath2, err := rn.EncryptPath(filepath.Join("data/2024/sub", long))
+	if err != nil || cPath != cPath2 {
+		t.Errorf("EncryptPath: %q != %q (%v)", cPath, cPath2, err)
+	}
+	if p, err := rp.DecryptPath(cPath); err != nil || p != "sub/"+long {
+		t.Errorf("DecryptPath: %q %v", p, err)
+	}
+	cOutside, _ := rn.EncryptPath("outside")
+	if _, err = rp.DecryptPath(cOutside); err == nil {
+		t.Error("DecryptPath outside of the prefix should fail")
+	}
+
+	if err = newTestFS(Args{Cipherdir: cipherdir, Prefix: "data/nonexistent"}).CheckPrefix(); err == nil {
+		t.Error("nonexistent prefix was accepted")
+	}
+	if err = newTestFS(Args{Cipherdir: cipherdir, Prefix: "outside"}).CheckPrefix(); err == nil {
+		t.Error("prefix that is a file was accepted")
+	}
+}
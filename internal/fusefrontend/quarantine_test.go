@@ -0,0 +1,89 @@
+package fusefrontend
+
+import (
+	"os"
+	"path/filepath"
+	"sort"
+	"syscall"
+	"testing"
+
+	"github.com/hanwen/go-fuse/v2/fuse"
+
+	"github.com/rfjakob/gocryptfs/tests/test_helpers"
+)
+
+// readdirNames returns the sorted names from rn.Readdir, without "." and
+// "..".
+func readdirNames(t *testing.T, rn *RootNode) []string {
+	ds, errno := rn.Readdir(nil)
+	if errno != 0 {
+		t.Fatal(errno)
+	}
+	var names []string
+	for ds.HasNext() {
+		e, errno := ds.Next()
+		if errno != 0 {
+			t.Fatal(errno)
+		}
+		if e.Name == "." || e.Name == ".." {
+			continue
+		}
+		names = append(names, e.Name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// TestQuarantine corrupts the name of one file among several and checks that
+// the others are listed fine, with and without -quarantine.
+func TestQuarantine(t *testing.T) {
+	cipherdir := test_helpers.InitFS(t)
+	rn := newTestFS(Args{Cipherdir: cipherdir})
+	for _, n := range []string{"a", "b", "c"} {
+		_, fh, _, errno := rn.Create(nil, n, syscall.O_RDWR, 0600, &fuse.EntryOut{})
+		if errno != 0 {
+			t.Fatal(errno)
+		}
+		fh.(*File).Release(nil)
+	}
+	// Corrupt the name of "b" by renaming the backing file
+	dirfd, cName, err := rn.openBackingDir("b")
+	if err != nil {
+		t.Fatal(err)
+	}
+	syscall.Close(dirfd)
+	const badName = "AAAAAAAAAAAAAAAAAAAAAA"
+	err = os.Rename(filepath.Join(cipherdir, cName), filepath.Join(cipherdir, badName))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Default: the corrupt entry is hidden and cannot be reached
+	names := readdirNames(t, rn)
+	if len(names) != 2 || names[0] != "a" || names[1] != "c" {
+		t.Errorf("default: wrong listing %v", names)
+	}
+	if _, errno := rn.Lookup(nil, quarantinePrefix+badName, &fuse.EntryOut{}); errno != syscall.ENOENT {
+		t.Errorf("default: quarantined name should not be reachable, got errno=%v", errno)
+	}
+
+	// -quarantine: the corrupt entry is listed with a prefix and can be deleted
+	rq := newTestFS(Args{Cipherdir: cipherdir, Quarantine: true})
+	names = readdirNames(t, rq)
+	if len(names) != 3 || names[0] != quarantinePrefix+badName || names[1] != "a" || names[2] != "c" {
+		t.Errorf("quarantine: wrong listing %v", names)
+	}
+	if _, errno := rq.Lookup(nil, quarantinePrefix+badName, &fuse.EntryOut{}); errno != 0 {
+		t.Errorf("quarantine: Lookup failed: %v", errno)
+	}
+	// Internal files stay hidden
+	if _, errno := rq.Lookup(nil, quarantinePrefix+"gocryptfs.diriv", &fuse.EntryOut{}); errno == 0 {
+		t.Error("quarantine: gocryptfs.diriv should not be reachable")
+	}
+	if errno := rq.Unlink(nil, quarantinePrefix+badName); errno != 0 {
+		t.Errorf("quarantine: Unlink failed: %v", errno)
+	}
+	if _, err := os.Stat(filepath.Join(cipherdir, badName)); !os.IsNotExist(err) {
+		t.Errorf("quarantine: backing file still exists: %v", err)
+	}
+}
@@ -0,0 +1,212 @@
+package fusefrontend
+
+import (
+	"strings"
+	"sync/atomic"
+	"syscall"
+
+	"golang.org/x/sys/unix"
+
+	"github.com/hanwen/go-fuse/v2/fs"
+
+	"github.com/rfjakob/gocryptfs/internal/configfile"
+	"github.com/rfjakob/gocryptfs/internal/journal"
+	"github.com/rfjakob/gocryptfs/internal/nametransform"
+	"github.com/rfjakob/gocryptfs/internal/syscallcompat"
+	"github.com/rfjakob/gocryptfs/internal/tlog"
+)
+
+// quota tracks the total plaintext size of all regular files for "-quota".
+type quota struct {
+	// limit in bytes
+	limit int64
+	// used bytes. Accessed atomically.
+	used int64
+}
+
+// reserve adds "n" bytes to the used space if that stays within the limit.
+// Returns false otherwise.
+func (q *quota) reserve(n int64) bool {
+	for {
+		used := atomic.LoadInt64(&q.used)
+		if used+n > q.limit {
+			return false
+		}
+		if atomic.CompareAndSwapInt64(&q.used, used, used+n) {
+			return true
+		}
+	}
+}
+
+// add adds "n" bytes, which may be negative, to the used space without
+// checking the limit.
+func (q *quota) add(n int64) {
+	atomic.AddInt64(&q.used, n)
+}
+
+// free returns the number of bytes left.
+func (q *quota) free() int64 {
+	free := q.limit - atomic.LoadInt64(&q.used)
+	if free < 0 {
+		return 0
+	}
+	return free
+}
+
+// initQuota sums up the plaintext sizes of all files in the cipherdir, or
+// below "-prefix". Files with several hard links are counted once.
+// Unreadable directories are skipped with a warning.
+//
+// The tree is walked with dirfds, so it also works when the ciphertext paths
+// are longer than PATH_MAX.
+func (rn *RootNode) initQuota() {
+	var used int64
+	dirfd, cName, err := rn.openBackingDir("")
+	if err == nil {
+		var fd int
+		fd, err = syscallcompat.Openat(dirfd, cName, syscall.O_RDONLY|syscall.O_DIRECTORY|syscall.O_NOFOLLOW, 0)
+		syscall.Close(dirfd)
+		if err == nil {
+			used = rn.quotaScan(fd, rn.args.Prefix == "", make(map[[2]uint64]bool))
+			syscall.Close(fd)
+		}
+	}
+	if err != nil {
+		tlog.Warn.Printf("-quota: %v", err)
+	}
+	rn.quota = &quota{limit: rn.args.Quota, used: used}
+	tlog.Debug.Printf("-quota: %d of %d bytes used", used, rn.args.Quota)
+	if used > rn.args.Quota {
+		tlog.Warn.Printf("-quota: %d bytes used, already over the limit of %d bytes", used, rn.args.Quota)
+	}
+}
+
+// quotaScan returns the plaintext size of the files in the directory "fd"
+// and below. "topLevel" is true for the root of the cipherdir. Hard links
+// already in "seen" are not counted again.
+func (rn *RootNode) quotaScan(fd int, topLevel bool, seen map[[2]uint64]bool) (used int64) {
+	entries, err := syscallcompat.Getdents(fd)
+	if err != nil {
+		tlog.Warn.Printf("-quota: %v", err)
+		return 0
+	}
+	for _, e := range entries {
+		switch e.Mode & syscall.S_IFMT {
+		case syscall.S_IFDIR:
+			child, err := syscallcompat.Openat(fd, e.Name, syscall.O_RDONLY|syscall.O_DIRECTORY|syscall.O_NOFOLLOW, 0)
+			if err != nil {
+				tlog.Warn.Printf("-quota: %s: %v", e.Name, err)
+				continue
+			}
+			used += rn.quotaScan(child, false, seen)
+			syscall.Close(child)
+		case syscall.S_IFREG:
+			if !rn.isQuotaFile(topLevel, e.Name) {
+				continue
+			}
+			st, err := syscallcompat.Fstatat2(fd, e.Name, unix.AT_SYMLINK_NOFOLLOW)
+			if err != nil {
+				tlog.Warn.Printf("-quota: %s: %v", e.Name, err)
+				continue
+			}
+			if st.Nlink > 1 {
+				key := [2]uint64{uint64(st.Dev), uint64(st.Ino)}
+				if seen[key] {
+					continue
+				}
+				seen[key] = true
+			}
+			used += int64(rn.contentEnc.CipherSizeToPlainSize(uint64(st.Size)))
+		}
+	}
+	return used
+}
+
+// isQuotaFile returns true if the backing file "cName" stores the content of
+// a plaintext file, as opposed to gocryptfs metadata.
+func (rn *RootNode) isQuotaFile(topLevel bool, cName string) bool {
+	if topLevel && cName == configfile.ConfDefaultName {
+		return false
+	}
+	if rn.args.PlaintextNames {
+		return true
+	}
+	// Includes the "gocryptfs.diriv.rmdir.XYZ" files left over by Rmdir.
+	// Files in the "-trash" directory count, their ".trashinfo" files do not.
+	if strings.HasPrefix(cName, nametransform.DirIVFilename) || strings.HasSuffix(cName, journal.Suffix) ||
+		strings.HasSuffix(cName, trashInfoSuffix) {
+		return false
+	}
+	return nametransform.NameType(cName) != nametransform.LongNameFilename
+}
+
+// quotaFreed returns how many bytes of quota deleting "cName" in "dirfd"
+// frees: its plaintext size if it is a regular file without other hard
+// links, zero otherwise. Also zero if "-quota" is off.
+func (rn *RootNode) quotaFreed(dirfd int, cName string) int64 {
+	if rn.quota == nil {
+		return 0
+	}
+	st, err := syscallcompat.Fstatat2(dirfd, cName, unix.AT_SYMLINK_NOFOLLOW)
+	if err != nil || st.Mode&syscall.S_IFMT != syscall.S_IFREG || st.Nlink != 1 {
+		return 0
+	}
+	return int64(rn.contentEnc.CipherSizeToPlainSize(uint64(st.Size)))
+}
+
+// quotaReplaced is quotaFreed for the target of a rename from "cName" in
+// "dirfd" to "cName2" in "dirfd2". Renaming a file onto itself, or onto
+// another hard link of itself, does not delete anything.
+func (rn *RootNode) quotaReplaced(dirfd int, cName string, dirfd2 int, cName2 string) int64 {
+	if rn.quota == nil {
+		return 0
+	}
+	st, err := syscallcompat.Fstatat2(dirfd, cName, unix.AT_SYMLINK_NOFOLLOW)
+	if err != nil {
+		return 0
+	}
+	st2, err := syscallcompat.Fstatat2(dirfd2, cName2, unix.AT_SYMLINK_NOFOLLOW)
+	if err != nil || (st.Dev == st2.Dev && st.Ino == st2.Ino) {
+		return 0
+	}
+	return rn.quotaFreed(dirfd2, cName2)
+}
+
+// releaseQuota returns "n" bytes freed by deleting a file to the quota.
+func (rn *RootNode) releaseQuota(n int64) {
+	if rn.quota != nil && n != 0 {
+		rn.quota.add(-n)
+	}
+}
+
+// chargeQuota runs "fn", which changes the plaintext size of the file to
+// "newSize" or, if "newSize" is smaller than the current size and fn does
+// not truncate, leaves it alone. The size change is accounted against
+// "-quota". If the file would grow past the quota, fn is not run and EDQUOT is
+// returned. The caller must hold ContentLock.Lock().
+func (f *File) chargeQuota(newSize uint64, fn func() syscall.Errno) syscall.Errno {
+	q := f.rootNode.quota
+	if q == nil {
+		return fn()
+	}
+	oldSize, err := f.statPlainSize()
+	if err != nil {
+		return fs.ToErrno(err)
+	}
+	var reserved int64
+	if newSize > oldSize {
+		reserved = int64(newSize - oldSize)
+		if !q.reserve(reserved) {
+			return syscall.EDQUOT
+		}
+	}
+	errno := fn()
+	// Account for what actually happened. fn may have failed halfway, or
+	// shrunk the file.
+	actual := int64(oldSize) + reserved
+	if sz, err := f.statPlainSize(); err == nil {
+		actual = int64(sz)
+	}
+	q.add(actual - int64(oldSize) - reserved)
+	return errno
+}
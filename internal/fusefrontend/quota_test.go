@@ -0,0 +1,125 @@
+package fusefrontend
+
+import (
+	"fmt"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"testing"
+
+	"github.com/hanwen/go-fuse/v2/fuse"
+
+	"github.com/rfjakob/gocryptfs/tests/test_helpers"
+)
+
+// TestQuota checks that writes and truncates past the quota fail with
+// EDQUOT, and that deleting, shrinking and replacing files frees quota.
+func TestQuota(t *testing.T) {
+	cipherdir := test_helpers.InitFS(t)
+	create := func(rn *RootNode, name string, size int) *File {
+		t.Helper()
+		ch, fh, _, errno := rn.Create(nil, name, syscall.O_RDWR, 0600, &fuse.EntryOut{})
+		if errno != 0 {
+			t.Fatal(errno)
+		}
+		rn.AddChild(name, ch, true)
+		if size > 0 {
+			if _, errno = fh.(*File).Write(nil, make([]byte, size), 0); errno != 0 {
+				t.Fatal(errno)
+			}
+		}
+		return fh.(*File)
+	}
+	// Already there before the mount, found by the scan
+	create(newTestFS(Args{Cipherdir: cipherdir}), "old", 10000).Release(nil)
+
+	rn := newTestFS(Args{Cipherdir: cipherdir, Quota: 50000})
+	used := func() int64 {
+		return atomic.LoadInt64(&rn.quota.used)
+	}
+	if used() != 10000 {
+		t.Fatalf("scan found %d bytes, want 10000", used())
+	}
+	f := create(rn, "a", 40000)
+	defer f.Release(nil)
+	if _, errno := f.Write(nil, []byte{1}, 40000); errno != syscall.EDQUOT {
+		t.Errorf("write past the quota: want EDQUOT, got %v", errno)
+	}
+	// Overwriting does not need more space
+	if _, errno := f.Write(nil, make([]byte, 1000), 100); errno != 0 {
+		t.Errorf("overwrite: %v", errno)
+	}
+	setSize := func(size uint64) syscall.Errno {
+		in := fuse.SetAttrIn{}
+		in.Valid = fuse.FATTR_SIZE
+		in.Size = size
+		return f.Setattr(nil, &in, &fuse.AttrOut{})
+	}
+	if errno := setSize(50001); errno != syscall.EDQUOT {
+		t.Errorf("truncate past the quota: want EDQUOT, got %v", errno)
+	}
+	var st fuse.StatfsOut
+	if errno := rn.Statfs(nil, &st); errno != 0 || st.Bavail != 0 {
+		t.Errorf("Statfs: errno=%v, Bavail=%d", errno, st.Bavail)
+	}
+	if errno := setSize(20000); errno != 0 {
+		t.Fatal(errno)
+	}
+	if used() != 30000 {
+		t.Errorf("after shrinking: used=%d, want 30000", used())
+	}
+	if errno := rn.Unlink(nil, "old"); errno != 0 {
+		t.Fatal(errno)
+	}
+	if _, errno := f.Write(nil, make([]byte, 30000), 20000); errno != 0 {
+		t.Errorf("write into freed quota: %v", errno)
+	}
+	// Replacing "a" by a rename frees its space
+	create(rn, "b", 0).Release(nil)
+	if errno := rn.Rename(nil, "b", rn, "a", 0); errno != 0 {
+		t.Fatal(errno)
+	}
+	if used() != 0 {
+		t.Errorf("after rename: used=%d, want 0", used())
+	}
+}
+
+// TestQuotaConcurrent writes to several files in parallel and checks that the
+// quota is never exceeded and that the accounting matches a fresh scan.
+func TestQuotaConcurrent(t *testing.T) {
+	cipherdir := test_helpers.InitFS(t)
+	const limit = 200000
+	rn := newTestFS(Args{Cipherdir: cipherdir, Quota: limit})
+	var wg sync.WaitGroup
+	var written int64
+	for i := 0; i < 8; i++ {
+		_, fh, _, errno := rn.Create(nil, fmt.Sprintf("f%d", i), syscall.O_RDWR, 0600, &fuse.EntryOut{})
+		if errno != 0 {
+			t.Fatal(errno)
+		}
+		f := fh.(*File)
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			defer f.Release(nil)
+			buf := make([]byte, 1000)
+			for off := int64(0); ; off += int64(len(buf)) {
+				if _, errno := f.Write(nil, buf, off); errno == syscall.EDQUOT {
+					return
+				} else if errno != 0 {
+					t.Error(errno)
+					return
+				}
+				atomic.AddInt64(&written, int64(len(buf)))
+			}
+		}()
+	}
+	wg.Wait()
+	if written != limit {
+		t.Errorf("wrote %d bytes, want exactly the quota of %d", written, limit)
+	}
+	rn2 := newTestFS(Args{Cipherdir: cipherdir, Quota: limit})
+	if rn.quota.used != rn2.quota.used {
+		t.Errorf("accounting says %d bytes, scan says %d", rn.quota.used, rn2.quota.used)
+	}
+}
@@ -0,0 +1,115 @@
+package fusefrontend
+
+import (
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"time"
+
+	"golang.org/x/sys/unix"
+
+	"github.com/rfjakob/gocryptfs/internal/inomap"
+	"github.com/rfjakob/gocryptfs/internal/openfiletable"
+	"github.com/rfjakob/gocryptfs/internal/syscallcompat"
+)
+
+// plusMaxAge is how long the attributes collected by Readdir stay usable.
+// Matches the attribute timeout the kernel uses by default.
+const plusMaxAge = time.Second
+
+// plusEntry are the attributes of one directory entry, collected by Readdir.
+type plusEntry struct {
+	// st is the stat of the backing file, with the ciphertext size
+	st *syscall.Stat_t
+	// size is the plaintext size
+	size uint64
+}
+
+// plusCache holds the attributes of the entries of a directory as collected
+// by the last Readdir, indexed by plaintext name.
+//
+// When the kernel sends READDIRPLUS, go-fuse calls Readdir and then Lookup for
+// every entry. Without the cache, each Lookup walks the backing directory tree
+// again, reads the DirIVs and encrypts the name, only to stat a file that
+// Readdir has seen moments ago.
+type plusCache struct {
+	sync.Mutex
+	entries map[string]plusEntry
+	// created is when Readdir filled the cache
+	created time.Time
+	// gen is RootNode.plusGen plus openfiletable.WriteOpCount() at that time
+	gen uint64
+}
+
+// plusGeneration changes whenever something in the filesystem may have been
+// modified through this mount.
+func (rn *RootNode) plusGeneration() uint64 {
+	return uint64(atomic.LoadUint32(&rn.plusGen)) + openfiletable.WriteOpCount()
+}
+
+// invalidatePlus makes all attributes collected by Readdir unusable. Called by
+// all operations that change directory entries or attributes. File content
+// changes are already covered by openfiletable.WriteOpCount().
+func (rn *RootNode) invalidatePlus() {
+	atomic.AddUint32(&rn.plusGen, 1)
+}
+
+// collectPlus stats the backing file "cName" in the directory "dirfd" and
+// stores the result as the attributes of "name". Used by Readdir.
+func (n *Node) collectPlus(entries map[string]plusEntry, dirfd int, cName string, name string) {
+	st, err := syscallcompat.Fstatat2(dirfd, cName, unix.AT_SYMLINK_NOFOLLOW)
+	if err != nil {
+		// The Lookup will report the error
+		return
+	}
+	var e plusEntry
+	e.st = st
+	switch st.Mode & syscall.S_IFMT {
+	case syscall.S_IFREG:
+		e.size = n.rootNode().contentEnc.CipherSizeToPlainSize(uint64(st.Size))
+	case syscall.S_IFLNK:
+		target, errno := n.readlink(dirfd, cName)
+		if errno != 0 {
+			return
+		}
+		e.size = uint64(len(target))
+	default:
+		e.size = uint64(st.Size)
+	}
+	entries[name] = e
+}
+
+// storePlus replaces the collected attributes of this directory.
+func (n *Node) storePlus(entries map[string]plusEntry, gen uint64) {
+	n.plus.Lock()
+	n.plus.entries = entries
+	n.plus.created = time.Now()
+	n.plus.gen = gen
+	n.plus.Unlock()
+}
+
+// takePlus returns the attributes of "name" collected by the last Readdir of
+// this directory, and removes them from the cache. Returns false if there are
+// none, or if they may be outdated.
+func (n *Node) takePlus(name string) (e plusEntry, ok bool) {
+	rn := n.rootNode()
+	n.plus.Lock()
+	defer n.plus.Unlock()
+	if n.plus.entries == nil {
+		return e, false
+	}
+	if time.Since(n.plus.created) > plusMaxAge || n.plus.gen != rn.plusGeneration() {
+		n.plus.entries = nil
+		return e, false
+	}
+	e, ok = n.plus.entries[name]
+	if !ok {
+		return e, false
+	}
+	delete(n.plus.entries, name)
+	// Open files may have buffered writes or a write in flight
+	if e.st.Mode&syscall.S_IFMT == syscall.S_IFREG && openfiletable.Lookup(inomap.QInoFromStat(e.st)) != nil {
+		return e, false
+	}
+	return e, true
+}
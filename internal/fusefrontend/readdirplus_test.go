@@ -0,0 +1,174 @@
+package fusefrontend
+
+import (
+	"fmt"
+	"strings"
+	"syscall"
+	"testing"
+
+	"github.com/hanwen/go-fuse/v2/fuse"
+
+	"github.com/rfjakob/gocryptfs/tests/test_helpers"
+)
+
+// readdirPlus does what go-fuse does for READDIRPLUS: Readdir, then Lookup for
+// every entry. Returns the attributes by name.
+func readdirPlus(tb testing.TB, n *Node) map[string]fuse.Attr {
+	ds, errno := n.Readdir(nil)
+	if errno != 0 {
+		tb.Fatal(errno)
+	}
+	attrs := make(map[string]fuse.Attr)
+	for ds.HasNext() {
+		e, errno := ds.Next()
+		if errno != 0 {
+			tb.Fatal(errno)
+		}
+		if e.Name == "." || e.Name == ".." {
+			continue
+		}
+		var out fuse.EntryOut
+		if _, errno = n.Lookup(nil, e.Name, &out); errno != 0 {
+			tb.Fatalf("Lookup %q: %v", e.Name, errno)
+		}
+		attrs[e.Name] = out.Attr
+	}
+	return attrs
+}
+
+// writeTestFile creates "name" in "n" with "size" bytes of content.
+func writeTestFile(tb testing.TB, n *Node, name string, size int) {
+	ch, fh, _, errno := n.Create(nil, name, syscall.O_RDWR, 0600, &fuse.EntryOut{})
+	if errno != 0 {
+		tb.Fatal(errno)
+	}
+	n.AddChild(name, ch, true)
+	if size > 0 {
+		if _, errno = fh.(*File).Write(nil, make([]byte, size), 0); errno != 0 {
+			tb.Fatal(errno)
+		}
+	}
+	fh.(*File).Release(nil)
+}
+
+// TestReaddirPlus checks that the attributes Lookup returns from the Readdir
+// cache are the same as those from Lookups that go to disk, and that the cache
+// is not used after a change.
+func TestReaddirPlus(t *testing.T) {
+	rn := newTestFS(Args{Cipherdir: test_helpers.InitFS(t), LongNames: true})
+	ch, errno := rn.Mkdir(nil, "dir", 0700, &fuse.EntryOut{})
+	if errno != 0 {
+		t.Fatal(errno)
+	}
+	rn.AddChild("dir", ch, true)
+	dir := toNode(ch.Operations())
+	for i, size := range []int{0, 1, 4096, 5000, 100000} {
+		writeTestFile(t, dir, fmt.Sprintf("file%d", i), size)
+	}
+	long := strings.Repeat("l", 200)
+	writeTestFile(t, dir, long, 123)
+	if _, errno = dir.Symlink(nil, "some/target", "link", &fuse.EntryOut{}); errno != 0 {
+		t.Fatal(errno)
+	}
+	if _, errno = dir.Mkdir(nil, "subdir", 0700, &fuse.EntryOut{}); errno != 0 {
+		t.Fatal(errno)
+	}
+
+	if _, errno = dir.Readdir(nil); errno != 0 {
+		t.Fatal(errno)
+	}
+	if len(dir.plus.entries) != 8 {
+		t.Fatalf("want 8 cached entries, have %d", len(dir.plus.entries))
+	}
+	attrs := readdirPlus(t, dir)
+	if len(attrs) != 8 {
+		t.Fatalf("want 8 entries, have %d", len(attrs))
+	}
+	for name, have := range attrs {
+		var out fuse.EntryOut
+		// The cache entry is used up, this goes to disk
+		if _, errno := dir.Lookup(nil, name, &out); errno != 0 {
+			t.Fatal(errno)
+		}
+		if have != out.Attr {
+			t.Errorf("%q: readdirplus attributes differ:\nhave %v\nwant %v", name, have, out.Attr)
+		}
+	}
+	if have := attrs["link"].Size; have != uint64(len("some/target")) {
+		t.Errorf("link: want size %d, have %d", len("some/target"), have)
+	}
+	if have := attrs[long].Size; have != 123 {
+		t.Errorf("long name: want size 123, have %d", have)
+	}
+
+	// Changes after the Readdir must be visible
+	ds, errno := dir.Readdir(nil)
+	if errno != 0 {
+		t.Fatal(errno)
+	}
+	ds.Close()
+	in := fuse.SetAttrIn{}
+	in.Valid = fuse.FATTR_SIZE
+	in.Size = 7
+	if errno = lookupChild(t, dir, "file4").Setattr(nil, nil, &in, &fuse.AttrOut{}); errno != 0 {
+		t.Fatal(errno)
+	}
+	var out fuse.EntryOut
+	if _, errno = dir.Lookup(nil, "file4", &out); errno != 0 {
+		t.Fatal(errno)
+	}
+	if out.Attr.Size != 7 {
+		t.Errorf("stale size %d after truncate", out.Attr.Size)
+	}
+}
+
+// lookupChild returns the node for "name", which is already in the inode tree.
+func lookupChild(t *testing.T, n *Node, name string) *Node {
+	ch := n.GetChild(name)
+	if ch == nil {
+		t.Fatalf("%q is not in the inode tree", name)
+	}
+	return toNode(ch.Operations())
+}
+
+// BenchmarkReaddirPlus simulates "ls -l" on a directory with 1000 files, as
+// served with READDIRPLUS, with and without the attributes collected by
+// Readdir.
+func BenchmarkReaddirPlus(b *testing.B) {
+	rn := newTestFS(Args{Cipherdir: test_helpers.InitFS(nil)})
+	n := &rn.Node
+	// A bit deeper in the tree, where the path walk of a Lookup costs more
+	for _, name := range []string{"a", "b", "c"} {
+		ch, errno := n.Mkdir(nil, name, 0700, &fuse.EntryOut{})
+		if errno != 0 {
+			b.Fatal(errno)
+		}
+		n.AddChild(name, ch, true)
+		n = toNode(ch.Operations())
+	}
+	for i := 0; i < 1000; i++ {
+		writeTestFile(b, n, fmt.Sprintf("file%04d", i), i)
+	}
+	for _, tc := range []struct {
+		name string
+		plus bool
+	}{{"readdirplus", true}, {"lookup", false}} {
+		b.Run(tc.name, func(b *testing.B) {
+			for i := 0; i < b.N; i++ {
+				if !tc.plus {
+					// Readdir feeds the cache, drop it before the Lookups
+					ds, _ := n.Readdir(nil)
+					rn.invalidatePlus()
+					for ds.HasNext() {
+						e, _ := ds.Next()
+						if e.Name != "." && e.Name != ".." {
+							n.Lookup(nil, e.Name, &fuse.EntryOut{})
+						}
+					}
+					continue
+				}
+				readdirPlus(b, n)
+			}
+		})
+	}
+}
@@ -0,0 +1,106 @@
+package fusefrontend
+
+import (
+	"syscall"
+	"testing"
+
+	"github.com/hanwen/go-fuse/v2/fuse"
+
+	"github.com/rfjakob/gocryptfs/internal/syscallcompat"
+	"github.com/rfjakob/gocryptfs/tests/test_helpers"
+)
+
+// TestRenameFlags checks RENAME_NOREPLACE and RENAME_EXCHANGE on files and
+// directories.
+func TestRenameFlags(t *testing.T) {
+	rn := newTestFS(Args{Cipherdir: test_helpers.InitFS(t)})
+	create := func(name string) {
+		ch, fh, _, errno := rn.Create(nil, name, syscall.O_RDWR, 0600, &fuse.EntryOut{})
+		if errno != 0 {
+			t.Fatal(errno)
+		}
+		rn.AddChild(name, ch, true)
+		defer fh.(*File).Release(nil)
+		if _, errno = fh.(*File).Write(nil, []byte(name), 0); errno != 0 {
+			t.Fatal(errno)
+		}
+	}
+	// content returns the content of the file "name", or "" if it is not a
+	// regular file
+	content := func(name string) string {
+		t.Helper()
+		n := lookupNode(t, rn, name)
+		fh, _, errno := n.Open(nil, syscall.O_RDONLY)
+		if errno == syscall.EISDIR {
+			return ""
+		} else if errno != 0 {
+			t.Fatal(errno)
+		}
+		defer fh.(*File).Release(nil)
+		buf := make([]byte, 100)
+		res, errno := fh.(*File).Read(nil, buf, 0)
+		if errno != 0 {
+			t.Fatal(errno)
+		}
+		data, _ := res.Bytes(buf)
+		return string(data)
+	}
+	create("a")
+	create("b")
+	if _, errno := rn.Mkdir(nil, "dir", 0700, &fuse.EntryOut{}); errno != 0 {
+		t.Fatal(errno)
+	}
+
+	// RENAME_NOREPLACE fails on an existing file and on an existing (empty)
+	// directory, and leaves both untouched
+	for _, to := range []string{"b", "dir"} {
+		if errno := rn.Rename(nil, "a", rn, to, syscallcompat.RENAME_NOREPLACE); errno != syscall.EEXIST {
+			t.Errorf("NOREPLACE a -> %s: want EEXIST, got %v", to, errno)
+		}
+	}
+	if c := content("a"); c != "a" {
+		t.Errorf("source changed: %q", c)
+	}
+	if c := content("b"); c != "b" {
+		t.Errorf("target changed: %q", c)
+	}
+	if _, errno := rn.Lookup(nil, "dir", &fuse.EntryOut{}); errno != 0 {
+		t.Errorf("directory is gone: %v", errno)
+	}
+	// ... and works like a normal rename if the target does not exist
+	if errno := rn.Rename(nil, "a", rn, "c", syscallcompat.RENAME_NOREPLACE); errno != 0 {
+		t.Fatal(errno)
+	}
+	rn.MvChild("a", rn.EmbeddedInode(), "c", true)
+	if c := content("c"); c != "a" {
+		t.Errorf("wrong content after rename: %q", c)
+	}
+
+	// RENAME_EXCHANGE swaps two files, and a file and a directory
+	if errno := rn.Rename(nil, "b", rn, "c", syscallcompat.RENAME_EXCHANGE); errno != 0 {
+		t.Fatal(errno)
+	}
+	rn.RmChild("b")
+	rn.RmChild("c")
+	if c := content("b"); c != "a" {
+		t.Errorf("b: want content a, got %q", c)
+	}
+	if c := content("c"); c != "b" {
+		t.Errorf("c: want content b, got %q", c)
+	}
+	if errno := rn.Rename(nil, "b", rn, "dir", syscallcompat.RENAME_EXCHANGE); errno != 0 {
+		t.Fatal(errno)
+	}
+	rn.RmChild("b")
+	rn.RmChild("dir")
+	if c := content("dir"); c != "a" {
+		t.Errorf("dir: want content a, got %q", c)
+	}
+	if n := lookupNode(t, rn, "b"); !n.IsDir() {
+		t.Errorf("b should be a directory now")
+	}
+	// Exchanging with a name that does not exist fails
+	if errno := rn.Rename(nil, "c", rn, "nonexisting", syscallcompat.RENAME_EXCHANGE); errno != syscall.ENOENT {
+		t.Errorf("want ENOENT, got %v", errno)
+	}
+}
@@ -0,0 +1,94 @@
+package fusefrontend
+
+import (
+	"io/ioutil"
+	"sort"
+	"strings"
+	"syscall"
+	"testing"
+
+	"github.com/hanwen/go-fuse/v2/fuse"
+
+	"github.com/rfjakob/gocryptfs/internal/nametransform"
+	"github.com/rfjakob/gocryptfs/internal/syscallcompat"
+	"github.com/rfjakob/gocryptfs/tests/test_helpers"
+)
+
+// checkLongNames checks that the cipherdir contains one .name file for
+// each long-name content file, and nothing else of that type.
+func checkLongNames(t *testing.T, cipherdir string, wantLong int) {
+	t.Helper()
+	fis, err := ioutil.ReadDir(cipherdir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var content, names []string
+	for _, fi := range fis {
+		switch nametransform.NameType(fi.Name()) {
+		case nametransform.LongNameContent:
+			content = append(content, fi.Name())
+		case nametransform.LongNameFilename:
+			names = append(names, nametransform.RemoveLongNameSuffix(fi.Name()))
+		}
+	}
+	sort.Strings(content)
+	sort.Strings(names)
+	if len(content) != wantLong || strings.Join(content, " ") != strings.Join(names, " ") {
+		t.Errorf("want %d long names, have content files %v and .name files %v", wantLong, content, names)
+	}
+}
+
+// TestRenameLongName renames a file across the long name boundary in both
+// directions and checks that no .name file is left behind.
+func TestRenameLongName(t *testing.T) {
+	cipherdir := test_helpers.InitFS(t)
+	rn := newTestFS(Args{Cipherdir: cipherdir})
+	long1 := strings.Repeat("x", 200)
+	long2 := strings.Repeat("y", 200)
+	for _, name := range []string{"short", long2} {
+		_, fh, _, errno := rn.Create(nil, name, syscall.O_RDWR, 0600, &fuse.EntryOut{})
+		if errno != 0 {
+			t.Fatal(errno)
+		}
+		fh.(*File).Release(nil)
+	}
+	checkLongNames(t, cipherdir, 1)
+
+	lookup := func(name string) {
+		t.Helper()
+		if _, errno := rn.Lookup(nil, name, &fuse.EntryOut{}); errno != 0 {
+			t.Errorf("Lookup %q: %v", name[:5], errno)
+		}
+	}
+	for _, tc := range []struct {
+		from, to string
+		flags    uint32
+		wantLong int
+	}{
+		// short -> long
+		{"short", long1, 0, 2},
+		// long -> long, replacing an existing file
+		{long1, long2, 0, 1},
+		// long -> short
+		{long2, "short", 0, 0},
+	} {
+		if errno := rn.Rename(nil, tc.from, rn, tc.to, tc.flags); errno != 0 {
+			t.Fatalf("Rename %q -> %q: %v", tc.from[:5], tc.to[:5], errno)
+		}
+		lookup(tc.to)
+		checkLongNames(t, cipherdir, tc.wantLong)
+	}
+
+	// Exchanging a short and a long name: both names must keep working
+	_, fh, _, errno := rn.Create(nil, long1, syscall.O_RDWR, 0600, &fuse.EntryOut{})
+	if errno != 0 {
+		t.Fatal(errno)
+	}
+	fh.(*File).Release(nil)
+	if errno := rn.Rename(nil, long1, rn, "short", syscallcompat.RENAME_EXCHANGE); errno != 0 {
+		t.Fatal(errno)
+	}
+	lookup("short")
+	lookup(long1)
+	checkLongNames(t, cipherdir, 1)
+}
@@ -9,10 +9,18 @@ import (
 	"syscall"
 	"time"
 
+	"golang.org/x/sys/unix"
+
+	"github.com/hanwen/go-fuse/v2/fuse"
+
 	"github.com/rfjakob/gocryptfs/internal/configfile"
 	"github.com/rfjakob/gocryptfs/internal/contentenc"
 	"github.com/rfjakob/gocryptfs/internal/inomap"
+	"github.com/rfjakob/gocryptfs/internal/journal"
+	"github.com/rfjakob/gocryptfs/internal/metrics"
 	"github.com/rfjakob/gocryptfs/internal/nametransform"
+	"github.com/rfjakob/gocryptfs/internal/optrace"
+	"github.com/rfjakob/gocryptfs/internal/ratelimit"
 	"github.com/rfjakob/gocryptfs/internal/serialize_reads"
 	"github.com/rfjakob/gocryptfs/internal/syscallcompat"
 	"github.com/rfjakob/gocryptfs/internal/tlog"
@@ -51,6 +59,37 @@ type RootNode struct {
 	// inoMap translates inode numbers from different devices to unique inode
 	// numbers.
 	inoMap inomap.TranslateStater
+	// snapshotLock is Lock()ed by Snapshot() to block all writes to file
+	// contents, metadata changes and all changes to the directory tree.
+	// Writers and Setattr RLock() it before taking the ContentLock,
+	// namespace operations on entry.
+	snapshotLock sync.RWMutex
+	// OpTrace records FUSE operations for "-optrace". nil if disabled.
+	OpTrace *optrace.Recorder
+	// Metrics counts FUSE operations for "-metrics". nil if disabled.
+	Metrics *metrics.Registry
+	// bwLimiter throttles File.Read and File.Write. nil if "-bwlimit" was
+	// not passed.
+	bwLimiter *ratelimit.Limiter
+	// quota tracks the total plaintext size for "-quota". nil if disabled.
+	quota *quota
+	// plusGen is incremented by invalidatePlus(). Accessed atomically.
+	plusGen uint32
+	// openCount is the number of Files holding a "-max_open" slot. Accessed
+	// atomically.
+	openCount int32
+	// maxOpenLog limits the "-max_open" warnings
+	maxOpenLog tlog.RateLimiter
+	// backingWatch is the state of "-watch_backing". nil if disabled.
+	backingWatch *backingWatch
+	// clockSkew is the state of "-warn_clock_skew". nil if disabled.
+	clockSkew *clockSkew
+	// contentHashCache is the state of "-contenthash". nil if disabled.
+	contentHashCache *contentHashCache
+	// handles is the registry of open files for ListOpenFiles
+	handles openHandles
+	// unionLock serializes copy-ups in "-lowerdir" mode
+	unionLock sync.Mutex
 }
 
 func NewRootNode(args Args, c *contentenc.ContentEnc, n nametransform.NameTransformer) *RootNode {
@@ -71,6 +110,26 @@ func NewRootNode(args Args, c *contentenc.ContentEnc, n nametransform.NameTransf
 	if args.SharedStorage {
 		rn.inoMap = &inomap.TranslateStatZero{}
 	}
+	if args.BandwidthLimit > 0 {
+		// Allow one maximum-sized FUSE request to pass without delay
+		burst := fuse.MAX_KERNEL_WRITE
+		if args.BandwidthLimit > int64(burst) {
+			burst = int(args.BandwidthLimit)
+		}
+		rn.bwLimiter = ratelimit.New(args.BandwidthLimit, burst)
+	}
+	if args.Quota > 0 {
+		rn.initQuota()
+	}
+	if args.WatchBacking > 0 {
+		rn.backingWatch = &backingWatch{notifier: inodeNotifier{}}
+	}
+	if args.WarnClockSkew {
+		rn.clockSkew = &clockSkew{newest: make(map[string]time.Time)}
+	}
+	if args.ContentHash {
+		rn.contentHashCache = &contentHashCache{entries: make(map[inomap.QIno]contentHashEntry)}
+	}
 	return rn
 }
 
@@ -125,7 +184,7 @@ func (rn *RootNode) isFiltered(path string) bool {
 		return false
 	}
 	// gocryptfs.conf in the root directory is forbidden
-	if path == configfile.ConfDefaultName {
+	if filepath.Join(rn.args.Prefix, path) == configfile.ConfDefaultName {
 		tlog.Info.Printf("The name /%s is reserved when -plaintextnames is used\n",
 			configfile.ConfDefaultName)
 		return true
@@ -205,17 +264,43 @@ func (rn *RootNode) openWriteOnlyFile(dirfd int, cName string, newFlags int) (rw
 // basename.
 //
 // The caller should then use Openat(dirfd, cName, ...) and friends.
-// For convenience, if relPath is "", cName is going to be ".".
+// For convenience, if relPath is "", cName is going to be "." (unless
+// "-prefix" is used, then it is the last component of the prefix).
+//
+// "relPath" is relative to the root of the mount, which is the "-prefix"
+// directory if set.
 //
 // openBackingDir is secure against symlink races by using Openat and
-// ReadDirIVAt.
+// ReadDirIVAt. As it walks down one directory at a time, it also works for
+// ciphertext paths longer than PATH_MAX, which the name encryption can produce
+// from plaintext paths well below the limit.
 //
 // Retries on EINTR.
 func (rn *RootNode) openBackingDir(relPath string) (dirfd int, cName string, err error) {
+	return rn.openBackingDirUnprefixed(filepath.Join(rn.args.Prefix, relPath))
+}
+
+// openBackingDirUnprefixed is openBackingDir for a path relative to the root
+// of the filesystem, ignoring "-prefix". The DirIVs are always read starting
+// at the root.
+func (rn *RootNode) openBackingDirUnprefixed(relPath string) (dirfd int, cName string, err error) {
+	if rn.args.LowerCipherdir != "" {
+		layer, err := rn.unionLayer(relPath)
+		if err != nil {
+			return -1, "", err
+		}
+		return rn.openBackingDirIn(layer, relPath)
+	}
+	return rn.openBackingDirIn(rn.args.Cipherdir, relPath)
+}
+
+// openBackingDirIn is openBackingDirUnprefixed in the backing directory
+// "cipherdir", which is Cipherdir or, with "-lowerdir", LowerCipherdir.
+func (rn *RootNode) openBackingDirIn(cipherdir string, relPath string) (dirfd int, cName string, err error) {
 	dirRelPath := nametransform.Dir(relPath)
 	// With PlaintextNames, we don't need to read DirIVs. Easy.
 	if rn.args.PlaintextNames {
-		dirfd, err = syscallcompat.OpenDirNofollow(rn.args.Cipherdir, dirRelPath)
+		dirfd, err = syscallcompat.OpenDirNofollow(cipherdir, dirRelPath)
 		if err != nil {
 			return -1, "", err
 		}
@@ -224,7 +309,7 @@ func (rn *RootNode) openBackingDir(relPath string) (dirfd int, cName string, err
 		return dirfd, cName, nil
 	}
 	// Open cipherdir (following symlinks)
-	dirfd, err = syscallcompat.Open(rn.args.Cipherdir, syscall.O_DIRECTORY|syscallcompat.O_PATH, 0)
+	dirfd, err = syscallcompat.Open(cipherdir, syscall.O_DIRECTORY|syscallcompat.O_PATH, 0)
 	if err != nil {
 		return -1, "", err
 	}
@@ -235,15 +320,26 @@ func (rn *RootNode) openBackingDir(relPath string) (dirfd int, cName string, err
 	// Walk the directory tree
 	parts := strings.Split(relPath, "/")
 	for i, name := range parts {
-		iv, err := nametransform.ReadDirIVAt(dirfd)
-		if err != nil {
-			syscall.Close(dirfd)
-			return -1, "", err
+		if qName, ok := rn.quarantinedCName(dirfd, name); ok {
+			cName = qName
+		} else {
+			iv, err := nametransform.ReadDirIVAt(dirfd)
+			if err != nil {
+				syscall.Close(dirfd)
+				return -1, "", err
+			}
+			cName, err = rn.nameTransform.EncryptAndHashName(name, iv)
+			if err != nil {
+				syscall.Close(dirfd)
+				return -1, "", err
+			}
 		}
-		cName, err = rn.nameTransform.EncryptAndHashName(name, iv)
-		if err != nil {
-			syscall.Close(dirfd)
-			return -1, "", err
+		// With "-fanout", the entry is in a bucket below the directory
+		if rn.args.Fanout {
+			dirfd, err = fanoutOpenBucket(dirfd, cName)
+			if err != nil {
+				return -1, "", err
+			}
 		}
 		// Last part? We are done.
 		if i == len(parts)-1 {
@@ -260,6 +356,84 @@ func (rn *RootNode) openBackingDir(relPath string) (dirfd int, cName string, err
 	return dirfd, cName, nil
 }
 
+// quarantinedCName checks if "name" is a quarantined entry as listed by
+// Readdir in "-quarantine" mode, that is, quarantinePrefix followed by the
+// ciphertext name. If it is, and the ciphertext entry exists in the
+// directory "dirfd", the ciphertext name is returned.
+//
+// Internal files (gocryptfs.diriv, gocryptfs.conf, gocryptfs.trash, *.name)
+// can never be reached this way.
+func (rn *RootNode) quarantinedCName(dirfd int, name string) (cName string, ok bool) {
+	if !rn.args.Quarantine || !strings.HasPrefix(name, quarantinePrefix) {
+		return "", false
+	}
+	cName = name[len(quarantinePrefix):]
+	if cName == "" || cName == "." || cName == ".." ||
+		cName == nametransform.DirIVFilename || cName == trashDir ||
+		cName == configfile.ConfDefaultName || cName == configfile.ConfReverseName ||
+		nametransform.NameType(cName) == nametransform.LongNameFilename ||
+		strings.HasSuffix(cName, journal.Suffix) {
+		return "", false
+	}
+	var st unix.Stat_t
+	if err := syscallcompat.Fstatat(dirfd, cName, &st, unix.AT_SYMLINK_NOFOLLOW); err != nil {
+		return "", false
+	}
+	return cName, true
+}
+
+// openJournal opens the "-journal" journal for the file "cName" in "dirfd"
+// if the file is opened for writing with "flags". Returns nil otherwise.
+func (rn *RootNode) openJournal(dirfd int, cName string, flags uint32) (*journal.Writer, error) {
+	if !rn.args.Journal || int(flags)&syscall.O_ACCMODE == syscall.O_RDONLY {
+		return nil, nil
+	}
+	return journal.Open(dirfd, cName, rn.contentEnc.PlainBS(), rn.contentEnc.CipherBS())
+}
+
+// renameJournal moves the "-journal" side file along with a renamed file.
+// If the source has no journal, a journal of an overwritten target is
+// deleted. Journals that end up with the wrong file anyway (RENAME_EXCHANGE)
+// are detected by their file ID and reset on the next write.
+func (rn *RootNode) renameJournal(dirfd int, cName string, dirfd2 int, cName2 string) {
+	err := syscallcompat.Renameat(dirfd, cName+journal.Suffix, dirfd2, cName2+journal.Suffix)
+	if err == syscall.ENOENT {
+		err = journal.Delete(dirfd2, cName2)
+	}
+	if err != nil {
+		tlog.Warn.Printf("Rename: could not move journal: %v", err)
+	}
+}
+
+// exchangeJournals swaps the journals of two files that have been exchanged
+// with RENAME_EXCHANGE. Either of them may not have a journal.
+func (rn *RootNode) exchangeJournals(dirfd int, cName string, dirfd2 int, cName2 string) {
+	j1, j2 := cName+journal.Suffix, cName2+journal.Suffix
+	err := syscallcompat.Renameat2(dirfd, j1, dirfd2, j2, syscallcompat.RENAME_EXCHANGE)
+	if err == syscall.ENOENT {
+		// At most one of them exists, move it over to the other name
+		err = syscallcompat.Renameat(dirfd, j1, dirfd2, j2)
+		if err == syscall.ENOENT {
+			err = syscallcompat.Renameat(dirfd2, j2, dirfd, j1)
+		}
+		if err == syscall.ENOENT {
+			err = nil
+		}
+	}
+	if err != nil {
+		tlog.Warn.Printf("Rename: could not exchange journals: %v", err)
+	}
+}
+
+// closeJournal closes the journal "j" after the file it was opened for could
+// not be created, and deletes it if it has just been created.
+func (rn *RootNode) closeJournal(j *journal.Writer, dirfd int, cName string) {
+	if j.Created() {
+		journal.Delete(dirfd, cName)
+	}
+	j.Close()
+}
+
 // encryptSymlinkTarget: "data" is encrypted like file contents (GCM)
 // and base64-encoded.
 // The empty string encrypts to the empty string.
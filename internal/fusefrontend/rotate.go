@@ -0,0 +1,310 @@
+package fusefrontend
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"syscall"
+	"time"
+
+	"golang.org/x/sys/unix"
+
+	"github.com/rfjakob/gocryptfs/internal/contentenc"
+	"github.com/rfjakob/gocryptfs/internal/filehash"
+	"github.com/rfjakob/gocryptfs/internal/journal"
+	"github.com/rfjakob/gocryptfs/internal/syscallcompat"
+	"github.com/rfjakob/gocryptfs/internal/tlog"
+)
+
+// rotateTmpSuffix is appended to the ciphertext file name to get the name of
+// the re-encrypted copy. Encrypted names never contain a dot.
+const rotateTmpSuffix = ".rotate.tmp"
+
+// RotateStats are the counts returned by RotateFileIDs
+type RotateStats struct {
+	// Rotated files got a new file ID
+	Rotated int
+	// Skipped files were left alone: empty files (which have no header),
+	// files with several hard links, and files done by an earlier run
+	Skipped int
+	// Failed files could not be read or re-encrypted and were left alone
+	Failed int
+}
+
+// RotateFileIDs gives every file in CIPHERDIR a new random file ID and
+// re-encrypts all of its blocks with it. The master key stays the same. The
+// filesystem must not be mounted.
+//
+// Each file is re-encrypted into a copy that is renamed over the original, so
+// after an interruption, every file is either completely old or completely
+// new. The relative path of the last file before the first failure is recorded
+// in "stateFile", which must be an absolute path and may be inside CIPHERDIR.
+// If "stateFile" exists, the files up to and including that path are skipped,
+// which resumes an interrupted run. It is deleted when all files are done.
+//
+// Files with several hard links are skipped, as the rename would split them.
+// "progress" is called after each file, it may be nil.
+func (rn *RootNode) RotateFileIDs(stateFile string, progress func(done, total int)) (stats RotateStats, err error) {
+	var resumeAfter []string
+	if buf, err := ioutil.ReadFile(stateFile); err == nil && len(buf) > 0 {
+		last := strings.TrimSpace(string(buf))
+		resumeAfter = strings.Split(last, "/")
+		tlog.Info.Printf("rotate: resuming after %q", last)
+	} else if err != nil && !os.IsNotExist(err) {
+		return stats, err
+	}
+	var paths []string
+	paths, stats.Failed, err = rn.contentFiles("rotate", stateFile)
+	if err != nil {
+		return stats, err
+	}
+	for i, rel := range paths {
+		if resumeAfter != nil && !pathAfter(strings.Split(rel, "/"), resumeAfter) {
+			stats.Skipped++
+		} else if done, err := rn.rotateFile(rel); err != nil {
+			tlog.Warn.Printf("rotate: %s: %v", rel, err)
+			stats.Failed++
+		} else if !done {
+			stats.Skipped++
+		} else {
+			stats.Rotated++
+		}
+		// The state says "everything up to here is done", so it must stop
+		// before the first failed file
+		if stats.Failed == 0 {
+			if err := ioutil.WriteFile(stateFile, []byte(rel+"\n"), 0600); err != nil {
+				return stats, err
+			}
+		}
+		if progress != nil {
+			progress(i+1, len(paths))
+		}
+	}
+	if stats.Failed == 0 {
+		// Everything is done, a new run starts from the beginning
+		os.Remove(stateFile)
+	}
+	return stats, nil
+}
+
+// contentFiles returns the paths, relative to CIPHERDIR, of all backing files
+// that store file content, in filepath.Walk order, for RotateFileIDs and
+// CompactFiles. "skip" is an absolute path that is left out. Temporary copies
+// left over by an interrupted run of either are deleted. "failed" counts the
+// directories that could not be read, "op" prefixes the warnings about them.
+func (rn *RootNode) contentFiles(op string, skip string) (paths []string, failed int, err error) {
+	root := rn.args.Cipherdir
+	rootfd, err := syscall.Open(root, syscall.O_RDONLY|syscall.O_DIRECTORY, 0)
+	if err != nil {
+		return nil, 0, err
+	}
+	defer syscall.Close(rootfd)
+	err = syscallcompat.Walkat(rootfd, func(dirfd int, name string, rel string, mode uint32, err error) error {
+		if err != nil {
+			tlog.Warn.Printf("%s: %s: %v", op, rel, err)
+			failed++
+			return nil
+		}
+		if mode != syscall.S_IFREG || !rn.isQuotaFile(dirfd == rootfd, name) || filepath.Join(root, rel) == skip {
+			return nil
+		}
+		if !rn.args.PlaintextNames &&
+			(strings.HasSuffix(name, rotateTmpSuffix) || strings.HasSuffix(name, compactTmpSuffix)) {
+			// Left over by an interrupted run. With plaintext names, this
+			// could be a user file.
+			syscallcompat.Unlinkat(dirfd, name, 0)
+			return nil
+		}
+		paths = append(paths, rel)
+		return nil
+	})
+	return paths, failed, err
+}
+
+// pathAfter returns true if path "a" comes after "b" in the order
+// filepath.Walk visits them. Both are split into components.
+func pathAfter(a, b []string) bool {
+	for i := range a {
+		if i == len(b) {
+			return true
+		}
+		if a[i] != b[i] {
+			return a[i] > b[i]
+		}
+	}
+	return false
+}
+
+// rotateFile re-encrypts the ciphertext file at "rel" with a new file ID.
+// Returns false if the file was left alone because it is empty or has
+// several hard links.
+func (rn *RootNode) rotateFile(rel string) (done bool, err error) {
+	return rn.rewriteFile(rel, rotateTmpSuffix, true)
+}
+
+// rewriteFile copies the ciphertext file at "rel", relative to CIPHERDIR,
+// block by block into a new file that is then renamed over it. With
+// "rotate", the copy gets a new file ID and every block is re-encrypted with
+// it. Without, the header and the blocks are copied as they are, after
+// checking that they decrypt. All-zero blocks are holes, they stay holes. Returns false if the file was left alone
+// because it is empty or has several hard links.
+func (rn *RootNode) rewriteFile(rel string, tmpSuffix string, rotate bool) (done bool, err error) {
+	// The directories are opened one by one, the absolute path may be
+	// longer than PATH_MAX
+	dir := filepath.Dir(rel)
+	if dir == "." {
+		dir = ""
+	}
+	dirfd, err := syscallcompat.OpenDirNofollow(rn.args.Cipherdir, dir)
+	if err != nil {
+		return false, err
+	}
+	defer syscall.Close(dirfd)
+	name := filepath.Base(rel)
+	// O_NOFOLLOW: "rel" comes from a directory walk, somebody may have
+	// replaced it with a symlink since
+	srcFd, err := syscallcompat.Openat(dirfd, name, syscall.O_RDONLY|syscall.O_NOFOLLOW, 0)
+	if err != nil {
+		return false, err
+	}
+	src := os.NewFile(uintptr(srcFd), rel)
+	defer src.Close()
+	var st unix.Stat_t
+	if err = unix.Fstat(int(src.Fd()), &st); err != nil {
+		return false, err
+	}
+	if st.Size == 0 {
+		return false, nil
+	}
+	if st.Nlink > 1 {
+		tlog.Info.Printf("%s: skipping file with %d hard links", rel, st.Nlink)
+		return false, nil
+	}
+	buf := make([]byte, rn.contentEnc.HeaderLen())
+	if _, err = io.ReadFull(src, buf); err != nil {
+		return false, fmt.Errorf("reading header: %v", err)
+	}
+	oldHeader, err := contentenc.ParseHeader(buf[:contentenc.HeaderLen])
+	if err != nil {
+		return false, err
+	}
+	var tags []byte
+	if rn.args.FileTags {
+		// The tags region is bound to the file ID
+		if tags, err = rn.contentEnc.DecryptTags(buf[contentenc.HeaderLen:], oldHeader.ID); err != nil {
+			return false, fmt.Errorf("tags region: %v", err)
+		}
+	}
+	tmp := name + tmpSuffix
+	dstFd, err := syscallcompat.Openat(dirfd, tmp, syscall.O_RDWR|syscall.O_CREAT|syscall.O_EXCL, 0600)
+	if err != nil {
+		return false, err
+	}
+	dst := os.NewFile(uintptr(dstFd), rel+tmpSuffix)
+	defer func() {
+		// Also closes dst before the rename on success
+		dst.Close()
+		if err != nil {
+			syscallcompat.Unlinkat(dirfd, tmp, 0)
+		}
+	}()
+	newHeader := oldHeader
+	if rotate {
+		newHeader = contentenc.RandomHeader()
+		buf = rn.contentEnc.PackHeader(newHeader, tags)
+	}
+	if _, err = dst.Write(buf); err != nil {
+		return false, err
+	}
+	cipherBS := int(rn.contentEnc.CipherBS())
+	block := make([]byte, cipherBS)
+	zero := make([]byte, cipherBS)
+	for blockNo := uint64(0); ; blockNo++ {
+		off := int64(rn.contentEnc.BlockNoToCipherOff(blockNo))
+		n, err := src.ReadAt(block, off)
+		if n == 0 && err == io.EOF {
+			break
+		} else if err != nil && err != io.EOF {
+			return false, err
+		}
+		if bytes.Equal(block[:n], zero[:n]) {
+			continue
+		}
+		plain, err := rn.contentEnc.DecryptBlock(block[:n], blockNo, oldHeader.ID)
+		if err != nil {
+			return false, fmt.Errorf("block %d: %v", blockNo, err)
+		}
+		out := block[:n]
+		if rotate {
+			out = rn.contentEnc.EncryptBlock(plain, blockNo, newHeader.ID)
+		}
+		if _, err = dst.WriteAt(out, off); err != nil {
+			return false, err
+		}
+	}
+	fd := int(dst.Fd())
+	// Trailing holes
+	if err = syscall.Ftruncate(fd, st.Size); err != nil {
+		return false, err
+	}
+	if err = rn.rotateCopyMetadata(int(src.Fd()), fd, &st); err != nil {
+		return false, err
+	}
+	if err = dst.Sync(); err != nil {
+		return false, err
+	}
+	if err = syscallcompat.Renameat(dirfd, tmp, dirfd, name); err != nil {
+		return false, err
+	}
+	if rotate {
+		// The journal describes the old ciphertext
+		syscallcompat.Unlinkat(dirfd, name+journal.Suffix, 0)
+	}
+	return true, nil
+}
+
+// rotateCopyMetadata copies owner (if running as root), mode, xattrs and
+// timestamps from the file "src" to its re-encrypted copy "dst". The
+// "-filehash" checksum is recomputed, as the ciphertext has changed.
+func (rn *RootNode) rotateCopyMetadata(src int, dst int, st *unix.Stat_t) error {
+	if os.Getuid() == 0 {
+		if err := syscall.Fchown(dst, int(st.Uid), int(st.Gid)); err != nil {
+			return err
+		}
+	}
+	if err := syscall.Fchmod(dst, uint32(st.Mode)&07777); err != nil {
+		return err
+	}
+	attrs, err := syscallcompat.Flistxattr(src)
+	if err != nil && err != syscall.ENOTSUP {
+		return err
+	}
+	var hasHash bool
+	for _, attr := range attrs {
+		if attr == filehash.XattrName {
+			hasHash = true
+			continue
+		}
+		val, err := syscallcompat.Fgetxattr(src, attr)
+		if err != nil {
+			return err
+		}
+		if err = unix.Fsetxattr(dst, attr, val, 0); err != nil {
+			return err
+		}
+	}
+	atime := time.Unix(st.Atim.Unix())
+	mtime := time.Unix(st.Mtim.Unix())
+	if err = syscallcompat.FutimesNano(dst, &atime, &mtime); err != nil {
+		return err
+	}
+	if hasHash {
+		var r filehash.Running
+		return r.Store(dst)
+	}
+	return nil
+}
@@ -0,0 +1,155 @@
+package fusefrontend
+
+import (
+	"bytes"
+	"io/ioutil"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"sort"
+	"syscall"
+	"testing"
+
+	"github.com/hanwen/go-fuse/v2/fuse"
+
+	"github.com/rfjakob/gocryptfs/internal/contentenc"
+	"github.com/rfjakob/gocryptfs/tests/test_helpers"
+)
+
+// TestRotateFileIDs rotates a small filesystem and checks that every file got
+// a new header and still reads back the same. Then it checks resuming from the
+// state file and that a corrupt file is left alone.
+func TestRotateFileIDs(t *testing.T) {
+	cipherdir := test_helpers.InitFS(t)
+	rn := newTestFS(Args{Cipherdir: cipherdir})
+	content := map[string][]byte{
+		"small": []byte("hello world"),
+		"multi": make([]byte, 3*contentenc.DefaultBS+123),
+		"empty": nil,
+	}
+	rand.Read(content["multi"])
+	for name, data := range content {
+		writeRotateFile(t, rn, name, data, 0)
+	}
+	// A hole, then one block of data
+	sparse := make([]byte, 100000)
+	copy(sparse[len(sparse)-5:], "tail!")
+	content["sparse"] = sparse
+	writeRotateFile(t, rn, "sparse", []byte("tail!"), int64(len(sparse)-5))
+
+	cPath := func(name string) string {
+		dirfd, cName, err := rn.openBackingDir(name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		syscall.Close(dirfd)
+		return filepath.Join(cipherdir, cName)
+	}
+	header := func(name string) []byte {
+		buf := make([]byte, contentenc.HeaderLen)
+		f, err := os.Open(cPath(name))
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer f.Close()
+		f.Read(buf)
+		return buf
+	}
+	oldHeaders := make(map[string][]byte)
+	for name := range content {
+		oldHeaders[name] = header(name)
+	}
+	checkContent := func() {
+		// A fresh RootNode, nothing is cached
+		rn2 := newTestFS(Args{Cipherdir: cipherdir})
+		for name, want := range content {
+			fh, _, errno := lookupNode(t, rn2, name).Open(nil, syscall.O_RDONLY)
+			if errno != 0 {
+				t.Fatal(errno)
+			}
+			buf := make([]byte, len(want)+100)
+			res, errno := fh.(*File).Read(nil, buf, 0)
+			if errno != 0 {
+				t.Fatalf("%s: %v", name, errno)
+			}
+			if have, _ := res.Bytes(buf); !bytes.Equal(have, want) {
+				t.Errorf("%s: content differs after rotation", name)
+			}
+			fh.(*File).Release(nil)
+		}
+	}
+
+	stateFile := filepath.Join(cipherdir, "gocryptfs.conf.rotate")
+	var calls int
+	stats, err := rn.RotateFileIDs(stateFile, func(done, total int) { calls++ })
+	if err != nil {
+		t.Fatal(err)
+	}
+	if stats != (RotateStats{Rotated: 3, Skipped: 1}) || calls != 4 {
+		t.Fatalf("wrong stats %+v, %d progress calls", stats, calls)
+	}
+	newHeaders := make(map[string][]byte)
+	for name := range content {
+		newHeaders[name] = header(name)
+		if name != "empty" && bytes.Equal(newHeaders[name], oldHeaders[name]) {
+			t.Errorf("%s: header was not changed", name)
+		}
+	}
+	checkContent()
+	if _, err := os.Stat(stateFile); !os.IsNotExist(err) {
+		t.Errorf("state file was not removed: %v", err)
+	}
+	if st, _ := os.Stat(cPath("sparse")); st.Sys().(*syscall.Stat_t).Blocks > 100 {
+		t.Errorf("the hole was filled: %d blocks", st.Sys().(*syscall.Stat_t).Blocks)
+	}
+
+	// Resume after the first file in walk order, and corrupt the last one,
+	// which must then be left alone
+	names := []string{"small", "multi", "sparse"}
+	sort.Slice(names, func(i, j int) bool { return cPath(names[i]) < cPath(names[j]) })
+	first, _ := filepath.Rel(cipherdir, cPath(names[0]))
+	if err = ioutil.WriteFile(stateFile, []byte(first+"\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	bad := cPath(names[2])
+	badContent, _ := ioutil.ReadFile(bad)
+	badContent[len(badContent)-1] ^= 1
+	ioutil.WriteFile(bad, badContent, 0600)
+	stats, err = rn.RotateFileIDs(stateFile, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if stats.Failed != 1 {
+		t.Errorf("want 1 failed file, have %+v", stats)
+	}
+	if !bytes.Equal(header(names[0]), newHeaders[names[0]]) {
+		t.Errorf("%s: rotated again after resume", names[0])
+	}
+	if bytes.Equal(header(names[1]), newHeaders[names[1]]) {
+		t.Errorf("%s: not rotated after resume", names[1])
+	}
+	if have, _ := ioutil.ReadFile(bad); !bytes.Equal(have, badContent) {
+		t.Error("corrupt file was modified")
+	}
+	if _, err := os.Stat(bad + rotateTmpSuffix); !os.IsNotExist(err) {
+		t.Errorf("temporary file was not removed: %v", err)
+	}
+	if _, err := os.Stat(stateFile); err != nil {
+		t.Errorf("state file must be kept after a failure: %v", err)
+	}
+}
+
+// writeRotateFile creates "name" and writes "data" at "off" into it.
+func writeRotateFile(t *testing.T, rn *RootNode, name string, data []byte, off int64) {
+	ch, fh, _, errno := rn.Create(nil, name, syscall.O_RDWR, 0600, &fuse.EntryOut{})
+	if errno != 0 {
+		t.Fatal(errno)
+	}
+	rn.AddChild(name, ch, true)
+	if len(data) > 0 {
+		if _, errno = fh.(*File).Write(nil, data, off); errno != 0 {
+			t.Fatal(errno)
+		}
+	}
+	fh.(*File).Release(nil)
+}
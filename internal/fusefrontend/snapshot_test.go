@@ -0,0 +1,167 @@
+package fusefrontend
+
+import (
+	"bytes"
+	"fmt"
+	"os"
+	"path/filepath"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/hanwen/go-fuse/v2/fuse"
+
+	"github.com/rfjakob/gocryptfs/internal/nametransform"
+	"github.com/rfjakob/gocryptfs/internal/snapshot"
+	"github.com/rfjakob/gocryptfs/tests/test_helpers"
+)
+
+// TestSnapshot takes a snapshot while a file is open and checks that the
+// snapshot can be used on its own.
+func TestSnapshot(t *testing.T) {
+	cipherdir := test_helpers.InitFS(t)
+	rn := newTestFS(Args{Cipherdir: cipherdir})
+	_, fh, _, errno := rn.Create(nil, "foo", syscall.O_RDWR, 0600, &fuse.EntryOut{})
+	if errno != 0 {
+		t.Fatal(errno)
+	}
+	f := fh.(*File)
+	content := bytes.Repeat([]byte("x"), 10000)
+	if _, errno := f.Write(nil, content, 0); errno != 0 {
+		t.Fatal(errno)
+	}
+
+	dst := filepath.Join(filepath.Dir(cipherdir), filepath.Base(cipherdir)+".snapshot")
+	reflinked, err := rn.Snapshot(dst)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Logf("reflinked=%v", reflinked)
+	// Writes after the snapshot must not show up in it
+	if _, errno := f.Write(nil, []byte("yyy"), 0); errno != 0 {
+		t.Fatal(errno)
+	}
+	f.Release(nil)
+
+	snap := newTestFS(Args{Cipherdir: dst})
+	ch, errno := snap.Lookup(nil, "foo", &fuse.EntryOut{})
+	if errno != 0 {
+		t.Fatal(errno)
+	}
+	snap.AddChild("foo", ch, true)
+	fh, _, errno = ch.Operations().(*Node).Open(nil, syscall.O_RDONLY)
+	if errno != 0 {
+		t.Fatal(errno)
+	}
+	defer fh.(*File).Release(nil)
+	res, errno := fh.(*File).Read(nil, make([]byte, 20000), 0)
+	if errno != 0 {
+		t.Fatal(errno)
+	}
+	data, _ := res.Bytes(nil)
+	if !bytes.Equal(data, content) {
+		t.Errorf("snapshot content mismatch: got %d bytes, %q...", len(data), data[:3])
+	}
+
+	// The destination must not exist yet
+	if _, err := rn.Snapshot(dst); err == nil {
+		t.Error("snapshot over an existing directory should fail")
+	}
+}
+
+// TestSnapshotRename moves a file back and forth between two directories
+// while snapshots are taken. Every snapshot must contain the file exactly
+// once.
+func TestSnapshotRename(t *testing.T) {
+	cipherdir := test_helpers.InitFS(t)
+	rn := newTestFS(Args{Cipherdir: cipherdir})
+	dirs := []*Node{mkdirTestDir(t, &rn.Node, "a"), mkdirTestDir(t, &rn.Node, "b")}
+	createFile(t, dirs[0], "f", []byte("content"))
+	for i := 0; i < 20; i++ {
+		createFile(t, dirs[0], fmt.Sprintf("filler%d", i), bytes.Repeat([]byte("x"), 10000))
+	}
+
+	stop := make(chan struct{})
+	done := make(chan syscall.Errno)
+	go func() {
+		for i := 0; ; i++ {
+			select {
+			case <-stop:
+				done <- 0
+				return
+			default:
+			}
+			if errno := dirs[i%2].Rename(nil, "f", dirs[(i+1)%2], "f", 0); errno != 0 {
+				done <- errno
+				return
+			}
+		}
+	}()
+	for i := 0; i < 20; i++ {
+		dst := fmt.Sprintf("%s.snapshot%d", cipherdir, i)
+		if _, err := rn.Snapshot(dst); err != nil {
+			t.Fatal(err)
+		}
+		// "f" and the fillers are the only files in the subdirectories
+		files := 0
+		filepath.Walk(dst, func(path string, fi os.FileInfo, err error) error {
+			if err == nil && fi.Mode().IsRegular() && filepath.Dir(path) != dst && fi.Name() != nametransform.DirIVFilename {
+				files++
+			}
+			return nil
+		})
+		if files != 21 {
+			t.Errorf("snapshot %d: want 21 files, have %d", i, files)
+		}
+		os.RemoveAll(dst)
+	}
+	close(stop)
+	if errno := <-done; errno != 0 {
+		t.Fatal(errno)
+	}
+}
+
+// TestSnapshotSetattr checks that a path-based chmod waits for a running
+// snapshot.
+func TestSnapshotSetattr(t *testing.T) {
+	cipherdir := test_helpers.InitFS(t)
+	rn := newTestFS(Args{Cipherdir: cipherdir})
+	createFile(t, &rn.Node, "f", []byte("content"))
+	n, errno := lookup(t, &rn.Node, "f")
+	if errno != 0 {
+		t.Fatal(errno)
+	}
+	rn.snapshotLock.Lock()
+	done := make(chan syscall.Errno)
+	go func() {
+		in := &fuse.SetAttrIn{SetAttrInCommon: fuse.SetAttrInCommon{Valid: fuse.FATTR_MODE, Mode: 0644}}
+		done <- n.Setattr(nil, nil, in, &fuse.AttrOut{})
+	}()
+	select {
+	case errno = <-done:
+		rn.snapshotLock.Unlock()
+		t.Fatalf("chmod did not wait for the snapshot: %v", errno)
+	case <-time.After(100 * time.Millisecond):
+	}
+	rn.snapshotLock.Unlock()
+	if errno = <-done; errno != 0 {
+		t.Fatal(errno)
+	}
+}
+
+// TestSnapshotDeadline checks that a snapshot that takes longer than
+// snapshotMaxBlock is aborted and leaves nothing behind.
+func TestSnapshotDeadline(t *testing.T) {
+	cipherdir := test_helpers.InitFS(t)
+	rn := newTestFS(Args{Cipherdir: cipherdir})
+	createFile(t, &rn.Node, "f", []byte("content"))
+	defer func(old time.Duration) { snapshotMaxBlock = old }(snapshotMaxBlock)
+	snapshotMaxBlock = -time.Second
+	dst := cipherdir + ".snapshot"
+	if _, err := rn.Snapshot(dst); err != snapshot.ErrDeadline {
+		t.Errorf("want ErrDeadline, have %v", err)
+	}
+	if _, err := os.Lstat(dst); !os.IsNotExist(err) {
+		t.Errorf("partial snapshot left behind: %v", err)
+	}
+}
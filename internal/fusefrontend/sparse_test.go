@@ -0,0 +1,97 @@
+package fusefrontend
+
+import (
+	"bytes"
+	"syscall"
+	"testing"
+
+	"github.com/hanwen/go-fuse/v2/fuse"
+
+	"github.com/rfjakob/gocryptfs/internal/syscallcompat"
+	"github.com/rfjakob/gocryptfs/tests/test_helpers"
+)
+
+// TestSparse copies a mostly empty image into the filesystem in 128 KiB
+// writes, like cp or dd do, and checks that "-sparse" keeps the zero blocks
+// as holes in the backing file, and that the content reads back unchanged.
+func TestSparse(t *testing.T) {
+	const imageSize = 4 * 1024 * 1024
+	image := make([]byte, imageSize)
+	copy(image, "boot sector")
+	copy(image[imageSize/2:], "some data in the middle")
+	// Ends in zeros, which must still count for the file size
+	copy(image[imageSize-200*1024:], "end")
+
+	// copyImage writes "image" and returns the open file
+	copyImage := func(args Args) *File {
+		rn := newTestFS(args)
+		ch, fh, _, errno := rn.Create(nil, "image", syscall.O_RDWR, 0600, &fuse.EntryOut{})
+		if errno != 0 {
+			t.Fatal(errno)
+		}
+		rn.AddChild("image", ch, true)
+		f := fh.(*File)
+		for off := 0; off < imageSize; off += 128 * 1024 {
+			if _, errno = f.Write(nil, image[off:off+128*1024], int64(off)); errno != 0 {
+				t.Fatal(errno)
+			}
+		}
+		return f
+	}
+	allocated := func(f *File) int64 {
+		var st syscall.Stat_t
+		if err := syscall.Fstat(f.intFd(), &st); err != nil {
+			t.Fatal(err)
+		}
+		return st.Blocks * 512
+	}
+	check := func(f *File, want []byte) {
+		buf := make([]byte, fuse.MAX_KERNEL_WRITE)
+		for off := 0; off < len(want); off += len(buf) {
+			res, errno := f.Read(nil, buf, int64(off))
+			if errno != 0 {
+				t.Fatal(errno)
+			}
+			if have, _ := res.Bytes(buf); !bytes.Equal(have, want[off:off+len(buf)]) {
+				t.Fatalf("wrong content at offset %d", off)
+			}
+		}
+		var a fuse.AttrOut
+		if errno := f.Getattr(nil, &a); errno != 0 {
+			t.Fatal(errno)
+		}
+		if a.Size != uint64(len(want)) {
+			t.Errorf("wrong size: have %d, want %d", a.Size, len(want))
+		}
+	}
+
+	dense := copyImage(Args{Cipherdir: test_helpers.InitFS(t)})
+	defer dense.Release(nil)
+	sparse := copyImage(Args{Cipherdir: test_helpers.InitFS(t), Sparse: true})
+	defer sparse.Release(nil)
+	check(sparse, image)
+	if allocated(dense) < imageSize {
+		t.Skip("backing filesystem does not allocate written zeros")
+	}
+	// Three blocks with data, plus filesystem blocks shared across
+	// ciphertext block boundaries
+	if a := allocated(sparse); a > 64*1024 {
+		t.Errorf("backing file is not sparse: %d bytes allocated", a)
+	}
+	bs := sparse.contentEnc.PlainBS()
+	if off, errno := sparse.Lseek(nil, 0, syscallcompat.SEEK_HOLE); errno != 0 || off != bs {
+		t.Errorf("SEEK_HOLE: have %d %v, want %d", off, errno, bs)
+	}
+
+	// Overwriting data with zeros makes a hole as well
+	before := allocated(sparse)
+	zeros := make([]byte, 4*bs)
+	if _, errno := sparse.Write(nil, zeros, imageSize/2); errno != 0 {
+		t.Fatal(errno)
+	}
+	copy(image[imageSize/2:], zeros)
+	check(sparse, image)
+	if after := allocated(sparse); after >= before {
+		t.Errorf("zeroed block still allocated: before=%d after=%d", before, after)
+	}
+}
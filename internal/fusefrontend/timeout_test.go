@@ -0,0 +1,53 @@
+package fusefrontend
+
+import (
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/hanwen/go-fuse/v2/fuse"
+
+	"github.com/rfjakob/gocryptfs/tests/test_helpers"
+)
+
+// TestTimeouts checks that -entry_timeout and -attr_timeout show up in Lookup
+// and Getattr responses, with and without -timeout_depth.
+func TestTimeouts(t *testing.T) {
+	cipherdir := test_helpers.InitFS(t)
+	const entry = 12 * time.Second
+	const attr = 6 * time.Second
+	for _, scale := range []bool{false, true} {
+		rn := newTestFS(Args{Cipherdir: cipherdir, EntryTimeout: entry, AttrTimeout: attr, TimeoutDepth: scale})
+		// Build "a/b/c" and look up each level
+		n := &rn.Node
+		for depth, name := range []string{"a", "b", "c"} {
+			depth++
+			// Already exists in the second round
+			if _, errno := n.Mkdir(nil, name, 0700, &fuse.EntryOut{}); errno != 0 && errno != syscall.EEXIST {
+				t.Fatal(errno)
+			}
+			var out fuse.EntryOut
+			ch, errno := n.Lookup(nil, name, &out)
+			if errno != 0 {
+				t.Fatal(errno)
+			}
+			n.AddChild(name, ch, true)
+			n = ch.Operations().(*Node)
+
+			div := time.Duration(1)
+			if scale {
+				div = time.Duration(depth)
+			}
+			if out.EntryTimeout() != entry/div || out.AttrTimeout() != attr/div {
+				t.Errorf("scale=%v depth=%d: Lookup: entry=%v attr=%v", scale, depth, out.EntryTimeout(), out.AttrTimeout())
+			}
+			var aOut fuse.AttrOut
+			if errno := n.Getattr(nil, nil, &aOut); errno != 0 {
+				t.Fatal(errno)
+			}
+			if aOut.Timeout() != attr/div {
+				t.Errorf("scale=%v depth=%d: Getattr: attr=%v", scale, depth, aOut.Timeout())
+			}
+		}
+	}
+}
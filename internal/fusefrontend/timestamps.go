@@ -0,0 +1,81 @@
+package fusefrontend
+
+import (
+	"syscall"
+	"time"
+
+	"golang.org/x/sys/unix"
+
+	"github.com/hanwen/go-fuse/v2/fuse"
+
+	"github.com/rfjakob/gocryptfs/internal/syscallcompat"
+	"github.com/rfjakob/gocryptfs/internal/tlog"
+)
+
+// freezeTimes sets all timestamps in "a" to the Unix epoch in
+// "-timestamps=freeze" mode. Must be called after syscallcompat.FillBtime.
+func (rn *RootNode) freezeTimes(a *fuse.Attr) {
+	if !rn.args.FreezeTimestamps {
+		return
+	}
+	a.Atime, a.Atimensec = 0, 0
+	a.Mtime, a.Mtimensec = 0, 0
+	a.Ctime, a.Ctimensec = 0, 0
+	// Clears the birth time on MacOS
+	syscallcompat.FillBtime(a, &syscall.Stat_t{})
+}
+
+// openat is syscallcompat.Openat for file and directory opens that may read
+// content. In "-noatime" and "-timestamps=nopropagate" mode, O_NOATIME is
+// added so that reading does not update the atime of the backing file.
+//
+// Only the owner of a file (or CAP_FOWNER) may use O_NOATIME. For other
+// files, the open is retried without it, and reading them updates the atime
+// as usual.
+func (rn *RootNode) openat(dirfd int, cName string, flags int, mode uint32) (int, error) {
+	if !(rn.args.NoAtime || rn.args.NoPropagateTimes) || syscallcompat.O_NOATIME == 0 {
+		return syscallcompat.Openat(dirfd, cName, flags, mode)
+	}
+	fd, err := syscallcompat.Openat(dirfd, cName, flags|syscallcompat.O_NOATIME, mode)
+	if err == syscall.EPERM {
+		fd, err = syscallcompat.Openat(dirfd, cName, flags, mode)
+	}
+	return fd, err
+}
+
+// dropTimes removes atime and mtime changes from a SETATTR request in
+// "-timestamps=nopropagate" mode. Other changes in the request go through.
+func (rn *RootNode) dropTimes(in *fuse.SetAttrIn) {
+	if !rn.args.NoPropagateTimes {
+		return
+	}
+	in.Valid &^= fuse.FATTR_ATIME | fuse.FATTR_MTIME | fuse.FATTR_ATIME_NOW | fuse.FATTR_MTIME_NOW
+}
+
+// backingTimes returns the atime and mtime of the backing file "fd", or nil
+// if it cannot be stat()ed.
+func backingTimes(fd int) *[2]unix.Timespec {
+	var st unix.Stat_t
+	if err := unix.Fstat(fd, &st); err != nil {
+		return nil
+	}
+	return &[2]unix.Timespec{st.Atim, st.Mtim}
+}
+
+// restoreTimes puts back the atime and mtime the backing file had when "f"
+// was opened, if writes through "f" have changed the mtime. Called on
+// Release in "-timestamps=nopropagate" mode. The ctime cannot be restored.
+func (f *File) restoreTimes() {
+	if f.openTimes == nil {
+		return
+	}
+	now := backingTimes(f.intFd())
+	if now == nil || now[1] == f.openTimes[1] {
+		return
+	}
+	atime := time.Unix(f.openTimes[0].Unix())
+	mtime := time.Unix(f.openTimes[1].Unix())
+	if err := syscallcompat.FutimesNano(f.intFd(), &atime, &mtime); err != nil {
+		tlog.Warn.Printf("ino%d fh%d: could not restore timestamps: %v", f.qIno.Ino, f.intFd(), err)
+	}
+}
@@ -0,0 +1,173 @@
+package fusefrontend
+
+import (
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/hanwen/go-fuse/v2/fuse"
+
+	"github.com/rfjakob/gocryptfs/tests/test_helpers"
+)
+
+// openTestFile looks up "name" in the root of "rn" and opens it
+func openTestFile(t *testing.T, rn *RootNode, name string, flags uint32) (*Node, *File) {
+	ch, errno := rn.Lookup(nil, name, &fuse.EntryOut{})
+	if errno != 0 {
+		t.Fatal(errno)
+	}
+	rn.AddChild(name, ch, true)
+	n := toNode(ch.Operations())
+	fh, _, errno := n.Open(nil, flags)
+	if errno != 0 {
+		t.Fatal(errno)
+	}
+	return n, fh.(*File)
+}
+
+// readTestFile reads "name" in the root of "rn" and returns the atime and
+// mtime it reports before and after
+func readTestFile(t *testing.T, rn *RootNode, name string) (before, after fuse.Attr) {
+	n, f := openTestFile(t, rn, name, syscall.O_RDONLY)
+	var a fuse.AttrOut
+	if errno := n.Getattr(nil, nil, &a); errno != 0 {
+		t.Fatal(errno)
+	}
+	before = a.Attr
+	if _, errno := f.Read(nil, make([]byte, 100), 0); errno != 0 {
+		t.Fatal(errno)
+	}
+	f.Release(nil)
+	if errno := n.Getattr(nil, nil, &a); errno != 0 {
+		t.Fatal(errno)
+	}
+	return before, a.Attr
+}
+
+// setOldTimes sets atime and mtime of "name" two days into the past. Reading
+// the file then updates the atime also with "relatime".
+func setOldTimes(t *testing.T, rn *RootNode, name string) {
+	old := uint64(time.Now().Add(-48 * time.Hour).Unix())
+	in := &fuse.SetAttrIn{SetAttrInCommon: fuse.SetAttrInCommon{
+		Valid: fuse.FATTR_ATIME | fuse.FATTR_MTIME,
+		Atime: old,
+		Mtime: old,
+	}}
+	if errno := lookupChild(t, &rn.Node, name).Setattr(nil, nil, in, &fuse.AttrOut{}); errno != 0 {
+		t.Fatal(errno)
+	}
+}
+
+func TestTimestampsNoPropagate(t *testing.T) {
+	cipherdir := test_helpers.InitFS(t)
+	normal := newTestFS(Args{Cipherdir: cipherdir})
+	writeTestFile(t, &normal.Node, "file", 100)
+	setOldTimes(t, normal, "file")
+
+	rn := newTestFS(Args{Cipherdir: cipherdir, NoPropagateTimes: true})
+	before, after := readTestFile(t, rn, "file")
+	if after.Atime != before.Atime || after.Atimensec != before.Atimensec {
+		t.Errorf("reading changed the atime from %d to %d", before.Atime, after.Atime)
+	}
+	// Setting timestamps is ignored
+	in := &fuse.SetAttrIn{SetAttrInCommon: fuse.SetAttrInCommon{
+		Valid: fuse.FATTR_ATIME_NOW | fuse.FATTR_MTIME_NOW | fuse.FATTR_ATIME | fuse.FATTR_MTIME,
+	}}
+	var a fuse.AttrOut
+	if errno := lookupChild(t, &rn.Node, "file").Setattr(nil, nil, in, &a); errno != 0 {
+		t.Fatal(errno)
+	}
+	if a.Atime != before.Atime || a.Mtime != before.Mtime {
+		t.Errorf("utimens went through: atime %d->%d, mtime %d->%d", before.Atime, a.Atime, before.Mtime, a.Mtime)
+	}
+	// Writing changes the mtime, but it is put back on close
+	n, f := openTestFile(t, rn, "file", syscall.O_RDWR)
+	if _, errno := f.Write(nil, []byte("hello"), 0); errno != 0 {
+		t.Fatal(errno)
+	}
+	f.Release(nil)
+	if errno := n.Getattr(nil, nil, &a); errno != 0 {
+		t.Fatal(errno)
+	}
+	if a.Mtime != before.Mtime || a.Mtimensec != before.Mtimensec {
+		t.Errorf("writing changed the mtime from %d to %d", before.Mtime, a.Mtime)
+	}
+
+	// Without the option, the same read changes the atime. If it does not,
+	// the backing filesystem does not update atimes at all, and the checks
+	// above did not test much.
+	before, after = readTestFile(t, normal, "file")
+	if after.Atime == before.Atime && after.Atimensec == before.Atimensec {
+		t.Logf("the backing filesystem does not update the atime on read (noatime mount?)")
+	}
+}
+
+// TestNoAtime checks that reading with NoAtime leaves the atime of the
+// backing file alone, while setting timestamps still works
+func TestNoAtime(t *testing.T) {
+	cipherdir := test_helpers.InitFS(t)
+	normal := newTestFS(Args{Cipherdir: cipherdir})
+	writeTestFile(t, &normal.Node, "file", 100)
+	setOldTimes(t, normal, "file")
+
+	rn := newTestFS(Args{Cipherdir: cipherdir, NoAtime: true})
+	before, after := readTestFile(t, rn, "file")
+	if after.Atime != before.Atime || after.Atimensec != before.Atimensec {
+		t.Errorf("reading changed the atime from %d to %d", before.Atime, after.Atime)
+	}
+	in := &fuse.SetAttrIn{SetAttrInCommon: fuse.SetAttrInCommon{Valid: fuse.FATTR_ATIME_NOW | fuse.FATTR_ATIME}}
+	var a fuse.AttrOut
+	if errno := lookupChild(t, &rn.Node, "file").Setattr(nil, nil, in, &a); errno != 0 {
+		t.Fatal(errno)
+	}
+	if a.Atime == before.Atime {
+		t.Errorf("utimens was ignored")
+	}
+
+	// Like in TestTimestampsNoPropagate
+	setOldTimes(t, normal, "file")
+	before, after = readTestFile(t, normal, "file")
+	if after.Atime == before.Atime && after.Atimensec == before.Atimensec {
+		t.Logf("the backing filesystem does not update the atime on read (noatime mount?)")
+	}
+}
+
+func TestTimestampsFreeze(t *testing.T) {
+	cipherdir := test_helpers.InitFS(t)
+	normal := newTestFS(Args{Cipherdir: cipherdir})
+	writeTestFile(t, &normal.Node, "file", 100)
+	setOldTimes(t, normal, "file")
+
+	rn := newTestFS(Args{Cipherdir: cipherdir, FreezeTimestamps: true})
+	var e fuse.EntryOut
+	if _, errno := rn.Lookup(nil, "file", &e); errno != 0 {
+		t.Fatal(errno)
+	}
+	if e.Atime != 0 || e.Mtime != 0 || e.Ctime != 0 {
+		t.Errorf("Lookup reports atime %d, mtime %d, ctime %d", e.Atime, e.Mtime, e.Ctime)
+	}
+	before, after := readTestFile(t, rn, "file")
+	for _, a := range []fuse.Attr{before, after} {
+		if a.Atime != 0 || a.Atimensec != 0 || a.Mtime != 0 || a.Ctime != 0 {
+			t.Errorf("Getattr reports atime %d, mtime %d, ctime %d", a.Atime, a.Mtime, a.Ctime)
+		}
+	}
+	// Also through an open file
+	_, f := openTestFile(t, rn, "file", syscall.O_RDONLY)
+	defer f.Release(nil)
+	var a fuse.AttrOut
+	if errno := f.Getattr(nil, &a); errno != 0 {
+		t.Fatal(errno)
+	}
+	if a.Atime != 0 || a.Mtime != 0 || a.Ctime != 0 {
+		t.Errorf("File.Getattr reports atime %d, mtime %d, ctime %d", a.Atime, a.Mtime, a.Ctime)
+	}
+	// The backing file is not affected
+	var orig fuse.AttrOut
+	if errno := lookupChild(t, &normal.Node, "file").Getattr(nil, nil, &orig); errno != 0 {
+		t.Fatal(errno)
+	}
+	if orig.Mtime == 0 {
+		t.Errorf("the mtime of the backing file is zero")
+	}
+}
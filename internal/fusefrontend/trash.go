@@ -0,0 +1,329 @@
+package fusefrontend
+
+import (
+	"crypto/sha256"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"syscall"
+	"time"
+
+	"golang.org/x/sys/unix"
+
+	"github.com/rfjakob/gocryptfs/ctlsock"
+	"github.com/rfjakob/gocryptfs/internal/ctlsocksrv"
+	"github.com/rfjakob/gocryptfs/internal/nametransform"
+	"github.com/rfjakob/gocryptfs/internal/syscallcompat"
+	"github.com/rfjakob/gocryptfs/internal/tlog"
+)
+
+var _ ctlsocksrv.Trasher = &RootNode{} // Verify that interface is implemented.
+
+// In "-trash" mode, Unlink moves the ciphertext file into the directory
+// trashDir in the root of the mount instead of deleting it:
+//
+//	gocryptfs.trash/ID            the ciphertext file, unchanged
+//	gocryptfs.trash/ID.trashinfo  original path and deletion time, encrypted
+//
+// ID is the deletion time, encrypted like a file name. Readdir hides
+// trashDir, and the plaintext name "gocryptfs.trash" encrypts to something
+// else, so it cannot be reached through the mount. File contents do not
+// depend on the path, so the file decrypts fine after it has been moved back.
+const trashDir = "gocryptfs.trash"
+
+// trashInfoSuffix is appended to the trash ID for the file that stores the
+// original path
+const trashInfoSuffix = ".trashinfo"
+
+// trashNameIV is the IV used to encrypt the deletion time into the trash ID
+var trashNameIV = []byte("trash_name_iv_xx")
+
+// trashStampFormat is the plaintext of the trash ID, before the counter that
+// makes it unique
+const trashStampFormat = "20060102T150405.000000000Z"
+
+// trashInfo is what a ".trashinfo" file contains, as encrypted JSON
+type trashInfo struct {
+	// Path is the plaintext path relative to the root of the mount
+	Path    string
+	Deleted time.Time
+}
+
+// openTrashDir opens trashDir for reading. With "create", it is created if
+// it does not exist yet.
+func (rn *RootNode) openTrashDir(create bool) (int, error) {
+	// With "-prefix", openBackingDir("") returns the parent of the prefix
+	// directory. Keep the trash inside the prefix so that each prefix has
+	// its own.
+	dirfd, cName, err := rn.openBackingDir("")
+	if err != nil {
+		return -1, err
+	}
+	rootFd, err := syscallcompat.Openat(dirfd, cName, syscall.O_RDONLY|syscall.O_DIRECTORY|syscall.O_NOFOLLOW, 0)
+	syscall.Close(dirfd)
+	if err != nil {
+		return -1, err
+	}
+	defer syscall.Close(rootFd)
+	if create {
+		err = syscallcompat.Mkdirat(rootFd, trashDir, 0700)
+		if err != nil && err != syscall.EEXIST {
+			return -1, err
+		}
+	}
+	return syscallcompat.Openat(rootFd, trashDir, syscall.O_RDONLY|syscall.O_DIRECTORY|syscall.O_NOFOLLOW, 0)
+}
+
+// moveToTrash moves "cName" in "dirfd", whose plaintext path relative to the
+// root of the mount is "path", into the trash. The side files (.name file,
+// journal) are deleted by the caller like for a normal Unlink. The content
+// keeps counting against "-quota" until it is purged.
+func (rn *RootNode) moveToTrash(dirfd int, cName string, path string) error {
+	tfd, err := rn.openTrashDir(true)
+	if err != nil {
+		return err
+	}
+	defer syscall.Close(tfd)
+	now := time.Now()
+	data, err := json.Marshal(trashInfo{Path: path, Deleted: now})
+	if err != nil {
+		return err
+	}
+	if uint64(len(data)) > rn.contentEnc.PlainBS() {
+		return syscall.ENAMETOOLONG
+	}
+	// Files deleted in the same nanosecond get a counter
+	var id string
+	for i := 0; ; i++ {
+		stamp := now.UTC().Format(trashStampFormat)
+		if i > 0 {
+			stamp += fmt.Sprintf(".%d", i)
+		}
+		id = rn.nameTransform.EncryptName(stamp, trashNameIV)
+		err = rn.writeTrashInfo(tfd, id, data)
+		if err != syscall.EEXIST || i >= 1000 {
+			break
+		}
+	}
+	if err != nil {
+		return err
+	}
+	err = syscallcompat.Renameat2(dirfd, cName, tfd, id, syscallcompat.RENAME_NOREPLACE)
+	if err != nil {
+		syscallcompat.Unlinkat(tfd, id+trashInfoSuffix, 0)
+		return err
+	}
+	return nil
+}
+
+// writeTrashInfo writes the encrypted "data" into the ".trashinfo" file of
+// "id". Fails with EEXIST if it already exists.
+func (rn *RootNode) writeTrashInfo(tfd int, id string, data []byte) error {
+	name := id + trashInfoSuffix
+	fd, err := syscallcompat.Openat(tfd, name, syscall.O_WRONLY|syscall.O_CREAT|syscall.O_EXCL|syscall.O_NOFOLLOW, 0400)
+	if err != nil {
+		return err
+	}
+	f := os.NewFile(uintptr(fd), name)
+	_, err = f.Write(rn.contentEnc.EncryptBlock(data, 0, trashInfoFileID(id)))
+	if err2 := f.Close(); err == nil {
+		err = err2
+	}
+	if err != nil {
+		syscallcompat.Unlinkat(tfd, name, 0)
+	}
+	return err
+}
+
+// trashInfoFileID returns the file ID the ".trashinfo" file of "id" is
+// encrypted with, 128 bits like the file ID in a file header. Binding the
+// info to the ID prevents swapping the info of two entries.
+func trashInfoFileID(id string) []byte {
+	h := sha256.Sum256([]byte(id))
+	return h[:16]
+}
+
+// readTrashInfo reads and decrypts the ".trashinfo" file of "id"
+func (rn *RootNode) readTrashInfo(tfd int, id string) (info trashInfo, err error) {
+	fd, err := syscallcompat.Openat(tfd, id+trashInfoSuffix, syscall.O_RDONLY|syscall.O_NOFOLLOW, 0)
+	if err != nil {
+		return info, err
+	}
+	f := os.NewFile(uintptr(fd), id+trashInfoSuffix)
+	defer f.Close()
+	// Allocate one more byte so we see whether the file is too big
+	buf := make([]byte, rn.contentEnc.CipherBS()+1)
+	n, err := f.ReadAt(buf, 0)
+	if err != nil && err != io.EOF {
+		return info, err
+	}
+	if uint64(n) > rn.contentEnc.CipherBS() {
+		return info, syscall.EBADMSG
+	}
+	data, err := rn.contentEnc.DecryptBlock(buf[:n], 0, trashInfoFileID(id))
+	if err != nil {
+		return info, err
+	}
+	if err = json.Unmarshal(data, &info); err != nil {
+		return info, syscall.EBADMSG
+	}
+	return info, nil
+}
+
+// validTrashID checks that "id" is a plain name in trashDir and not one of
+// the ".trashinfo" files
+func validTrashID(id string) bool {
+	return id != "" && id != "." && id != ".." && !strings.ContainsAny(id, "/\x00") &&
+		!strings.HasSuffix(id, trashInfoSuffix)
+}
+
+// ListTrash implements ctlsocksrv.Trasher. The list is sorted by deletion
+// time. Entries whose info file cannot be decrypted are skipped with a
+// warning.
+func (rn *RootNode) ListTrash() ([]ctlsock.TrashEntry, error) {
+	out := []ctlsock.TrashEntry{}
+	tfd, err := rn.openTrashDir(false)
+	if err == syscall.ENOENT {
+		return out, nil
+	} else if err != nil {
+		return nil, err
+	}
+	defer syscall.Close(tfd)
+	entries, err := syscallcompat.Getdents(tfd)
+	if err != nil {
+		return nil, err
+	}
+	for _, e := range entries {
+		if !strings.HasSuffix(e.Name, trashInfoSuffix) {
+			continue
+		}
+		id := strings.TrimSuffix(e.Name, trashInfoSuffix)
+		var st unix.Stat_t
+		if err := syscallcompat.Fstatat(tfd, id, &st, unix.AT_SYMLINK_NOFOLLOW); err != nil {
+			// Left over by a crash in RestoreTrash
+			continue
+		}
+		info, err := rn.readTrashInfo(tfd, id)
+		if err != nil {
+			tlog.Warn.Printf("ListTrash: %s: %v", id, err)
+			continue
+		}
+		out = append(out, ctlsock.TrashEntry{ID: id, Path: info.Path, Deleted: info.Deleted})
+	}
+	sort.Slice(out, func(i, j int) bool {
+		if !out[i].Deleted.Equal(out[j].Deleted) {
+			return out[i].Deleted.Before(out[j].Deleted)
+		}
+		return out[i].ID < out[j].ID
+	})
+	return out, nil
+}
+
+// RestoreTrash implements ctlsocksrv.Trasher. It moves the trash entry "id"
+// back to its original path and returns that path. The parent directory must
+// still exist (ENOENT otherwise), and nothing may have been created at the
+// path in the meantime (EEXIST otherwise). The entry stays in the trash if
+// the restore fails.
+func (rn *RootNode) RestoreTrash(id string) (string, error) {
+	rn.snapshotLock.RLock()
+	defer rn.snapshotLock.RUnlock()
+	if !validTrashID(id) {
+		return "", syscall.EINVAL
+	}
+	tfd, err := rn.openTrashDir(false)
+	if err != nil {
+		return "", err
+	}
+	defer syscall.Close(tfd)
+	info, err := rn.readTrashInfo(tfd, id)
+	if err != nil {
+		return "", err
+	}
+	if rn.isFiltered(info.Path) {
+		return "", syscall.EPERM
+	}
+	dirfd, cName, err := rn.openBackingDir(info.Path)
+	if err != nil {
+		return "", err
+	}
+	defer syscall.Close(dirfd)
+	var st unix.Stat_t
+	if err = syscallcompat.Fstatat(dirfd, cName, &st, unix.AT_SYMLINK_NOFOLLOW); err == nil {
+		return "", syscall.EEXIST
+	}
+	long := nametransform.IsLongContent(cName)
+	if long {
+		if err = rn.writeLongNameAt(dirfd, cName, info.Path); err != nil {
+			return "", err
+		}
+	}
+	err = syscallcompat.Renameat2(tfd, id, dirfd, cName, syscallcompat.RENAME_NOREPLACE)
+	if err != nil {
+		if long {
+			nametransform.DeleteLongNameAt(dirfd, cName)
+		}
+		return "", err
+	}
+	if err = syscallcompat.Unlinkat(tfd, id+trashInfoSuffix, 0); err != nil {
+		tlog.Warn.Printf("RestoreTrash: could not delete %s: %v", id+trashInfoSuffix, err)
+	}
+	rn.invalidatePlus()
+	return info.Path, nil
+}
+
+// PurgeTrash implements ctlsocksrv.Trasher. It deletes the trash entry "id"
+// for good, or all entries if "id" is "*", and returns their space to
+// "-quota".
+func (rn *RootNode) PurgeTrash(id string) error {
+	rn.snapshotLock.RLock()
+	defer rn.snapshotLock.RUnlock()
+	if id != "*" && !validTrashID(id) {
+		return syscall.EINVAL
+	}
+	tfd, err := rn.openTrashDir(false)
+	if err == syscall.ENOENT && id == "*" {
+		return nil
+	} else if err != nil {
+		return err
+	}
+	defer syscall.Close(tfd)
+	if id != "*" {
+		return rn.purgeTrashEntry(tfd, id)
+	}
+	entries, err := syscallcompat.Getdents(tfd)
+	if err != nil {
+		return err
+	}
+	for _, e := range entries {
+		if validTrashID(e.Name) {
+			if err = rn.purgeTrashEntry(tfd, e.Name); err != nil {
+				return fmt.Errorf("%s: %v", e.Name, err)
+			}
+		} else if strings.HasSuffix(e.Name, trashInfoSuffix) {
+			// Left over by a crash in RestoreTrash
+			syscallcompat.Unlinkat(tfd, e.Name, 0)
+		}
+	}
+	return nil
+}
+
+// purgeTrashEntry deletes the trash entry "id" and its info file
+func (rn *RootNode) purgeTrashEntry(tfd int, id string) error {
+	freed := rn.quotaFreed(tfd, id)
+	err := deleteName(tfd, id, func() error {
+		return rn.unlinkBacking(tfd, id)
+	})
+	if err != nil {
+		return err
+	}
+	rn.releaseQuota(freed)
+	err = syscallcompat.Unlinkat(tfd, id+trashInfoSuffix, 0)
+	if err != nil && err != syscall.ENOENT {
+		tlog.Warn.Printf("PurgeTrash: could not delete %s: %v", filepath.Join(trashDir, id+trashInfoSuffix), err)
+	}
+	return nil
+}
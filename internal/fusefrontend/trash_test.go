@@ -0,0 +1,190 @@
+package fusefrontend
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"syscall"
+	"testing"
+
+	"github.com/rfjakob/gocryptfs/internal/nametransform"
+	"github.com/rfjakob/gocryptfs/tests/test_helpers"
+)
+
+// trashPaths returns the original paths of the trash entries, and the IDs by
+// path
+func trashPaths(t *testing.T, rn *RootNode) ([]string, map[string]string) {
+	l, err := rn.ListTrash()
+	if err != nil {
+		t.Fatal(err)
+	}
+	paths := []string{}
+	ids := make(map[string]string)
+	for _, e := range l {
+		if e.Deleted.IsZero() {
+			t.Errorf("%s: no deletion time", e.Path)
+		}
+		paths = append(paths, e.Path)
+		ids[e.Path] = e.ID
+	}
+	return paths, ids
+}
+
+// TestTrash deletes files in "-trash" mode and checks that they are moved to
+// the hidden trash directory, that restoring brings them back with intact
+// content, and that purging frees the quota.
+func TestTrash(t *testing.T) {
+	cipherdir := test_helpers.InitFS(t)
+	rn := newTestFS(Args{Cipherdir: cipherdir, LongNames: true, Trash: true, Quota: 1000})
+	d := mkdirTestDir(t, &rn.Node, "d")
+	long := strings.Repeat("l", 200)
+	createFile(t, d, "f", []byte("hello"))
+	createFile(t, d, long, []byte("world"))
+	for _, name := range []string{"f", long} {
+		if errno := d.Unlink(nil, name); errno != 0 {
+			t.Fatalf("Unlink %q: %v", name, errno)
+		}
+	}
+	if have := listDir(t, d); len(have) != 0 {
+		t.Errorf("deleted files are still listed: %v", have)
+	}
+	if have := listDir(t, &rn.Node); !reflect.DeepEqual(have, []string{"d"}) {
+		t.Errorf("trash directory must be hidden, have %v", have)
+	}
+	if rn.quota.used != 10 {
+		t.Errorf("trashed files must count against the quota, used=%d", rn.quota.used)
+	}
+	// The .name file is gone, the trash holds two files and their info
+	entries, err := ioutil.ReadDir(filepath.Join(cipherdir, trashDir))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) != 4 {
+		t.Errorf("want 4 entries in the trash directory, have %d", len(entries))
+	}
+	cDir, err := rn.EncryptPath("d")
+	if err != nil {
+		t.Fatal(err)
+	}
+	dirEntries, _ := ioutil.ReadDir(filepath.Join(cipherdir, cDir))
+	for _, e := range dirEntries {
+		if e.Name() != nametransform.DirIVFilename {
+			t.Errorf("side file left behind: %s", e.Name())
+		}
+	}
+	paths, ids := trashPaths(t, rn)
+	if !reflect.DeepEqual(paths, []string{"d/f", "d/" + long}) {
+		t.Fatalf("wrong trash list %v", paths)
+	}
+
+	// Restore goes back to the original path
+	if p, err := rn.RestoreTrash(ids["d/f"]); err != nil || p != "d/f" {
+		t.Fatalf("RestoreTrash: %q, %v", p, err)
+	}
+	if have := readChildFile(t, d, "f"); have != "hello" {
+		t.Errorf("restored content: want %q, have %q", "hello", have)
+	}
+	if _, err := rn.RestoreTrash(ids["d/f"]); err != syscall.ENOENT {
+		t.Errorf("second restore: want ENOENT, have %v", err)
+	}
+	// Something new at the original path blocks the restore
+	createFile(t, d, long, []byte("x"))
+	if _, err := rn.RestoreTrash(ids["d/"+long]); err != syscall.EEXIST {
+		t.Errorf("restore over a new file: want EEXIST, have %v", err)
+	}
+	if errno := d.Unlink(nil, long); errno != 0 {
+		t.Fatal(errno)
+	}
+	if _, err := rn.RestoreTrash(ids["d/"+long]); err != nil {
+		t.Fatal(err)
+	}
+	if have := readChildFile(t, d, long); have != "world" {
+		t.Errorf("restored long name content: want %q, have %q", "world", have)
+	}
+	if paths, _ = trashPaths(t, rn); len(paths) != 1 {
+		t.Errorf("want the second file only, have %v", paths)
+	}
+	for _, id := range []string{"", "..", "a/b", ids["d/f"] + trashInfoSuffix} {
+		if _, err := rn.RestoreTrash(id); err != syscall.EINVAL {
+			t.Errorf("RestoreTrash(%q): want EINVAL, have %v", id, err)
+		}
+	}
+
+	// Purging frees the quota
+	if err := rn.PurgeTrash("*"); err != nil {
+		t.Fatal(err)
+	}
+	if paths, _ = trashPaths(t, rn); len(paths) != 0 {
+		t.Errorf("trash is not empty after purge: %v", paths)
+	}
+	if rn.quota.used != 10 {
+		t.Errorf("want 10 bytes used after purge, have %d", rn.quota.used)
+	}
+	if entries, _ = ioutil.ReadDir(filepath.Join(cipherdir, trashDir)); len(entries) != 0 {
+		t.Errorf("purge left %d files behind", len(entries))
+	}
+	// Mounted without -trash, deleting deletes
+	rn2 := newTestFS(Args{Cipherdir: cipherdir, LongNames: true})
+	d2, errno := lookup(t, &rn2.Node, "d")
+	if errno != 0 {
+		t.Fatal(errno)
+	}
+	if errno = d2.Unlink(nil, "f"); errno != 0 {
+		t.Fatal(errno)
+	}
+	if paths, _ = trashPaths(t, rn2); len(paths) != 0 {
+		t.Errorf("Unlink without -trash moved the file to the trash: %v", paths)
+	}
+}
+
+// TestTrashPrefix mounts two prefixes of the same filesystem in "-trash" mode
+// and checks that each keeps its own trash inside the prefix directory.
+func TestTrashPrefix(t *testing.T) {
+	cipherdir := test_helpers.InitFS(t)
+	rn := newTestFS(Args{Cipherdir: cipherdir})
+	for _, name := range []string{"alice", "bob"} {
+		mkdirTestDir(t, &rn.Node, name)
+	}
+	alice := newTestFS(Args{Cipherdir: cipherdir, Trash: true, Prefix: "alice"})
+	bob := newTestFS(Args{Cipherdir: cipherdir, Trash: true, Prefix: "bob"})
+	for _, p := range []*RootNode{alice, bob} {
+		if err := p.CheckPrefix(); err != nil {
+			t.Fatal(err)
+		}
+	}
+	createFile(t, &alice.Node, "f", []byte("hello"))
+	if errno := alice.Unlink(nil, "f"); errno != 0 {
+		t.Fatal(errno)
+	}
+	if _, err := os.Stat(filepath.Join(cipherdir, trashDir)); !os.IsNotExist(err) {
+		t.Errorf("trash directory outside of the prefix: %v", err)
+	}
+	cAlice, err := rn.EncryptPath("alice")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err = os.Stat(filepath.Join(cipherdir, cAlice, trashDir)); err != nil {
+		t.Errorf("no trash directory inside the prefix: %v", err)
+	}
+	paths, ids := trashPaths(t, alice)
+	if !reflect.DeepEqual(paths, []string{"f"}) {
+		t.Fatalf("wrong trash list %v", paths)
+	}
+	if paths, _ = trashPaths(t, bob); len(paths) != 0 {
+		t.Errorf("other prefix sees the trash: %v", paths)
+	}
+	if _, err = bob.RestoreTrash(ids["f"]); err != syscall.ENOENT {
+		t.Errorf("restore from the other prefix: want ENOENT, have %v", err)
+	}
+	if err = bob.PurgeTrash(ids["f"]); err != syscall.ENOENT {
+		t.Errorf("purge from the other prefix: want ENOENT, have %v", err)
+	}
+	if p, err := alice.RestoreTrash(ids["f"]); err != nil || p != "f" {
+		t.Fatalf("RestoreTrash: %q, %v", p, err)
+	}
+	if have := readChildFile(t, &alice.Node, "f"); have != "hello" {
+		t.Errorf("restored content: want %q, have %q", "hello", have)
+	}
+}
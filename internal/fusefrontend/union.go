@@ -0,0 +1,757 @@
+package fusefrontend
+
+// Union mount of two cipherdirs ("-lowerdir").
+//
+// The upper layer is Cipherdir, the lower layer is LowerCipherdir. Both use
+// the same master key. The lower layer is never modified; it shows through
+// wherever the upper layer has no entry of the same name:
+//
+//   - An upper entry hides the lower entry of the same name. Directories that
+//     exist in both layers are merged.
+//   - Opening a lower file for writing, and everything else that changes an
+//     entry, first copies it up, together with all parent directories.
+//     Copied-up directories keep the DirIV of the lower directory, so
+//     ciphertext names are the same in both layers, and the ciphertext is
+//     copied as it is.
+//   - Deleting an entry that exists in the lower layer leaves a whiteout file
+//     in the upper directory that hides it.
+//   - A directory created where the lower layer has an entry is opaque: the
+//     lower directory content does not show through.
+//
+// The markers are files in the upper layer whose names no encrypted name can
+// have.
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/base64"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"syscall"
+	"time"
+
+	"golang.org/x/sys/unix"
+
+	"github.com/hanwen/go-fuse/v2/fs"
+	"github.com/hanwen/go-fuse/v2/fuse"
+
+	"github.com/rfjakob/gocryptfs/internal/configfile"
+	"github.com/rfjakob/gocryptfs/internal/cryptocore"
+	"github.com/rfjakob/gocryptfs/internal/journal"
+	"github.com/rfjakob/gocryptfs/internal/nametransform"
+	"github.com/rfjakob/gocryptfs/internal/syscallcompat"
+	"github.com/rfjakob/gocryptfs/internal/tlog"
+)
+
+const (
+	// unionWhiteoutPrefix followed by the hash of a ciphertext name hides
+	// the lower entry of that name
+	unionWhiteoutPrefix = "gocryptfs.whiteout."
+	// unionOpaqueName in an upper directory hides the whole lower directory
+	unionOpaqueName = "gocryptfs.opaque"
+	// unionTmpPrefix is used for entries that are being copied up
+	unionTmpPrefix = "gocryptfs.copyup."
+	// copyUpChunk is the read size when copying up file content
+	copyUpChunk = 128 * 1024
+)
+
+// whiteoutName returns the name of the whiteout file for "cName". The name
+// is hashed so that it fits the 255 byte limit for every cName.
+func whiteoutName(cName string) string {
+	h := sha256.Sum256([]byte(cName))
+	return unionWhiteoutPrefix + base64.RawURLEncoding.EncodeToString(h[:])
+}
+
+// isUnionMarker returns true for the files that "-lowerdir" mode keeps in
+// the upper layer. Readdir hides them.
+func isUnionMarker(cName string) bool {
+	return cName == unionOpaqueName ||
+		strings.HasPrefix(cName, unionWhiteoutPrefix) ||
+		strings.HasPrefix(cName, unionTmpPrefix)
+}
+
+// unionContentName returns true if "cName" is a directory entry that a user
+// can see, as opposed to DirIVs, ".name" files, journals and union markers.
+func unionContentName(cName string) bool {
+	return cName != nametransform.DirIVFilename &&
+		nametransform.NameType(cName) != nametransform.LongNameFilename &&
+		!strings.HasSuffix(cName, journal.Suffix) &&
+		!isUnionMarker(cName)
+}
+
+// unionHidden returns true if the upper directory "dirfd" hides the lower
+// entry "cName", through a whiteout or because it is opaque.
+func unionHidden(dirfd int, cName string) bool {
+	var st unix.Stat_t
+	for _, m := range []string{unionOpaqueName, whiteoutName(cName)} {
+		if syscallcompat.Fstatat(dirfd, m, &st, unix.AT_SYMLINK_NOFOLLOW) == nil {
+			return true
+		}
+	}
+	return false
+}
+
+// unionLookup finds out which layers "relPath" is visible in. "inLower" is
+// false if the lower entry is hidden by the upper layer. The root directory
+// is in both layers.
+func (rn *RootNode) unionLookup(relPath string) (inUpper bool, inLower bool, err error) {
+	if relPath == "" {
+		return true, true, nil
+	}
+	dirfd, err := syscallcompat.Open(rn.args.Cipherdir, syscall.O_DIRECTORY|syscallcompat.O_PATH, 0)
+	if err != nil {
+		return false, false, err
+	}
+	defer func() {
+		syscall.Close(dirfd)
+	}()
+	parts := strings.Split(relPath, "/")
+	for i, name := range parts {
+		iv, err := nametransform.ReadDirIVAt(dirfd)
+		if err != nil {
+			return false, false, err
+		}
+		cName, err := rn.nameTransform.EncryptAndHashName(name, iv)
+		if err != nil {
+			return false, false, err
+		}
+		var st unix.Stat_t
+		err = syscallcompat.Fstatat(dirfd, cName, &st, unix.AT_SYMLINK_NOFOLLOW)
+		if err == syscall.ENOENT || (err == nil && i == len(parts)-1) {
+			inUpper = err == nil
+			if unionHidden(dirfd, cName) {
+				return inUpper, false, nil
+			}
+			// The rest of the path only exists in the lower layer. Going
+			// through a lower file fails with ENOTDIR, as it would without
+			// layers, and not with ENOENT from the upper layer.
+			if !inUpper && i < len(parts)-1 && rn.lowerNotDir(strings.Join(parts[:i], "/"), relPath) {
+				return false, false, syscall.ENOTDIR
+			}
+			inLower, err = rn.lowerExists(relPath)
+			return inUpper, inLower, err
+		} else if err != nil {
+			return false, false, err
+		}
+		if st.Mode&syscall.S_IFMT != syscall.S_IFDIR {
+			// Resolving the path fails with ENOTDIR in the upper layer
+			return true, false, nil
+		}
+		dirfd2, err := syscallcompat.Openat(dirfd, cName, syscall.O_NOFOLLOW|syscall.O_DIRECTORY|syscallcompat.O_PATH, 0)
+		if err != nil {
+			return false, false, err
+		}
+		syscall.Close(dirfd)
+		dirfd = dirfd2
+	}
+	return true, false, nil
+}
+
+// unionLayer returns the cipherdir that file operations on "relPath" go to:
+// the lower layer if the entry is only visible there, the upper layer
+// otherwise. Also new entries are created in the upper layer.
+func (rn *RootNode) unionLayer(relPath string) (string, error) {
+	inUpper, inLower, err := rn.unionLookup(relPath)
+	if err != nil {
+		return "", err
+	}
+	if !inUpper && inLower {
+		return rn.args.LowerCipherdir, nil
+	}
+	return rn.args.Cipherdir, nil
+}
+
+// lowerStat stats "relPath" in the lower layer, ignoring the upper layer
+func (rn *RootNode) lowerStat(relPath string) (*syscall.Stat_t, error) {
+	dirfd, cName, err := rn.openBackingDirIn(rn.args.LowerCipherdir, relPath)
+	if err != nil {
+		return nil, err
+	}
+	defer syscall.Close(dirfd)
+	return syscallcompat.Fstatat2(dirfd, cName, unix.AT_SYMLINK_NOFOLLOW)
+}
+
+// lowerNotDir returns true if resolving "relPath" in the lower layer fails
+// with ENOTDIR below "dir", which must be a directory in the lower layer as
+// well. Otherwise, the non-directory in the way is hidden by the upper layer.
+func (rn *RootNode) lowerNotDir(dir string, relPath string) bool {
+	if dir != "" {
+		st, err := rn.lowerStat(dir)
+		if err != nil || st.Mode&syscall.S_IFMT != syscall.S_IFDIR {
+			return false
+		}
+	}
+	_, err := rn.lowerStat(relPath)
+	return err == syscall.ENOTDIR
+}
+
+// lowerExists returns true if the lower layer has an entry at "relPath"
+func (rn *RootNode) lowerExists(relPath string) (bool, error) {
+	_, err := rn.lowerStat(relPath)
+	if err == syscall.ENOENT || err == syscall.ENOTDIR {
+		return false, nil
+	}
+	return err == nil, err
+}
+
+// unionLowerEntries returns the entries of the lower directory "relPath"
+// that show through the upper directory with the entries "upper": all except
+// those that the upper directory has as well or hides. The entries are read
+// through "lfd", which the caller must close. "lfd" is -1 if there are no
+// lower entries.
+func (rn *RootNode) unionLowerEntries(relPath string, upper []fuse.DirEntry) (lfd int, entries []fuse.DirEntry, err error) {
+	have := make(map[string]bool, len(upper))
+	for _, e := range upper {
+		have[e.Name] = true
+	}
+	if have[unionOpaqueName] {
+		return -1, nil, nil
+	}
+	dirfd, cName, err := rn.openBackingDirIn(rn.args.LowerCipherdir, relPath)
+	if err == syscall.ENOENT || err == syscall.ENOTDIR {
+		return -1, nil, nil
+	} else if err != nil {
+		return -1, nil, err
+	}
+	lfd, err = rn.openat(dirfd, cName, syscall.O_RDONLY|syscall.O_DIRECTORY|syscall.O_NOFOLLOW, 0)
+	syscall.Close(dirfd)
+	if err == syscall.ENOENT || err == syscall.ENOTDIR {
+		return -1, nil, nil
+	} else if err != nil {
+		return -1, nil, err
+	}
+	all, err := syscallcompat.Getdents(lfd)
+	if err != nil {
+		syscall.Close(lfd)
+		return -1, nil, err
+	}
+	for _, e := range all {
+		// ".name" files go with their content file
+		base := e.Name
+		if nametransform.NameType(base) == nametransform.LongNameFilename {
+			base = nametransform.RemoveLongNameSuffix(base)
+		}
+		if have[e.Name] || have[base] || have[whiteoutName(base)] {
+			continue
+		}
+		entries = append(entries, e)
+	}
+	return lfd, entries, nil
+}
+
+// unionCopyUp copies "relPath" from the lower to the upper layer, unless
+// the upper layer has it already. Parent directories are copied up first.
+func (rn *RootNode) unionCopyUp(relPath string) error {
+	if rn.args.LowerCipherdir == "" {
+		return nil
+	}
+	rn.unionLock.Lock()
+	defer rn.unionLock.Unlock()
+	return rn.copyUpLocked(relPath)
+}
+
+func (rn *RootNode) copyUpLocked(relPath string) error {
+	inUpper, inLower, err := rn.unionLookup(relPath)
+	if err != nil || inUpper || !inLower {
+		return err
+	}
+	if err = rn.copyUpLocked(nametransform.Dir(relPath)); err != nil {
+		return err
+	}
+	ldirfd, cName, err := rn.openBackingDirIn(rn.args.LowerCipherdir, relPath)
+	if err != nil {
+		return err
+	}
+	defer syscall.Close(ldirfd)
+	udirfd, ucName, err := rn.openBackingDirIn(rn.args.Cipherdir, relPath)
+	if err != nil {
+		return err
+	}
+	defer syscall.Close(udirfd)
+	if ucName != cName {
+		// The upper parent directory has a different DirIV
+		tlog.Warn.Printf("copy-up %q: ciphertext names differ: %q vs %q", relPath, cName, ucName)
+		return syscall.EXDEV
+	}
+	st, err := syscallcompat.Fstatat2(ldirfd, cName, unix.AT_SYMLINK_NOFOLLOW)
+	if err != nil {
+		return err
+	}
+	tmp := fmt.Sprintf("%s%d", unionTmpPrefix, cryptocore.RandUint64())
+	err = copyUpEntry(ldirfd, udirfd, cName, tmp, st)
+	if err == nil && nametransform.IsLongContent(cName) {
+		err = copyUpSmallFile(ldirfd, udirfd, cName+nametransform.LongNameSuffix)
+		if err == syscall.EEXIST {
+			err = nil
+		}
+	}
+	if err == nil {
+		err = syscallcompat.Renameat(udirfd, tmp, udirfd, cName)
+	}
+	if err != nil {
+		tlog.Warn.Printf("copy-up %q: %v", relPath, err)
+		if st.Mode&syscall.S_IFMT == syscall.S_IFDIR {
+			if fd, err2 := syscallcompat.Openat(udirfd, tmp, syscall.O_DIRECTORY|syscall.O_NOFOLLOW|syscallcompat.O_PATH, 0); err2 == nil {
+				syscallcompat.Unlinkat(fd, nametransform.DirIVFilename, 0)
+				syscall.Close(fd)
+			}
+			syscallcompat.Unlinkat(udirfd, tmp, unix.AT_REMOVEDIR)
+		} else {
+			syscallcompat.Unlinkat(udirfd, tmp, 0)
+		}
+		return err
+	}
+	return nil
+}
+
+// copyUpEntry creates "tmp" in the upper directory "udirfd" as a copy of the
+// lower entry "cName" in "ldirfd", including owner (as root), extended
+// attributes, mode and timestamps.
+func copyUpEntry(ldirfd int, udirfd int, cName string, tmp string, st *syscall.Stat_t) (err error) {
+	mode := st.Mode & syscall.S_IFMT
+	switch mode {
+	case syscall.S_IFDIR:
+		if err = syscallcompat.Mkdirat(udirfd, tmp, 0700); err != nil {
+			return err
+		}
+		src, err := syscallcompat.Openat(ldirfd, cName, syscall.O_RDONLY|syscall.O_DIRECTORY|syscall.O_NOFOLLOW, 0)
+		if err != nil {
+			return err
+		}
+		defer syscall.Close(src)
+		dst, err := syscallcompat.Openat(udirfd, tmp, syscall.O_RDONLY|syscall.O_DIRECTORY|syscall.O_NOFOLLOW, 0)
+		if err != nil {
+			return err
+		}
+		defer syscall.Close(dst)
+		// Same DirIV, same ciphertext names
+		if err = copyUpSmallFile(src, dst, nametransform.DirIVFilename); err != nil {
+			return err
+		}
+		copyUpXattrs(src, dst)
+	case syscall.S_IFREG:
+		src, err := syscallcompat.Openat(ldirfd, cName, syscall.O_RDONLY|syscall.O_NOFOLLOW, 0)
+		if err != nil {
+			return err
+		}
+		defer syscall.Close(src)
+		dst, err := syscallcompat.Openat(udirfd, tmp, syscall.O_WRONLY|syscall.O_CREAT|syscall.O_EXCL|syscall.O_NOFOLLOW, 0600)
+		if err != nil {
+			return err
+		}
+		defer syscall.Close(dst)
+		if err = copyUpData(src, dst, st.Size); err != nil {
+			return err
+		}
+		copyUpXattrs(src, dst)
+		if err = syscall.Fsync(dst); err != nil {
+			return err
+		}
+	case syscall.S_IFLNK:
+		target, err := syscallcompat.Readlinkat(ldirfd, cName)
+		if err != nil {
+			return err
+		}
+		if err = syscallcompat.Symlinkat(target, udirfd, tmp); err != nil {
+			return err
+		}
+	default:
+		// Fifos, sockets and device nodes
+		if err = syscallcompat.Mknodat(udirfd, tmp, uint32(st.Mode), int(st.Rdev)); err != nil {
+			return err
+		}
+	}
+	if os.Getuid() == 0 {
+		err = syscallcompat.Fchownat(udirfd, tmp, int(st.Uid), int(st.Gid), unix.AT_SYMLINK_NOFOLLOW)
+		if err != nil {
+			return err
+		}
+	}
+	if mode != syscall.S_IFLNK {
+		// This cast is needed on Darwin, where st.Mode is uint16.
+		err = syscallcompat.FchmodatNofollow(udirfd, tmp, uint32(st.Mode)&^syscall.S_IFMT)
+		if err != nil {
+			return err
+		}
+	}
+	var a fuse.Attr
+	a.FromStat(st)
+	atime := time.Unix(int64(a.Atime), int64(a.Atimensec))
+	mtime := time.Unix(int64(a.Mtime), int64(a.Mtimensec))
+	return syscallcompat.UtimesNanoAtNofollow(udirfd, tmp, &atime, &mtime)
+}
+
+// copyUpData copies "size" bytes from "src" to "dst". All-zero chunks are
+// not written, so holes in the lower file stay holes.
+func copyUpData(src int, dst int, size int64) error {
+	buf := make([]byte, copyUpChunk)
+	zero := make([]byte, copyUpChunk)
+	for off := int64(0); off < size; {
+		n, err := syscall.Pread(src, buf, off)
+		if err != nil {
+			return err
+		}
+		if n == 0 {
+			break
+		}
+		if !bytes.Equal(buf[:n], zero[:n]) {
+			if _, err = syscall.Pwrite(dst, buf[:n], off); err != nil {
+				return err
+			}
+		}
+		off += int64(n)
+	}
+	return syscall.Ftruncate(dst, size)
+}
+
+// copyUpSmallFile copies the internal file "name" (DirIV or ".name" file)
+// from the directory "srcDirfd" to "dstDirfd"
+func copyUpSmallFile(srcDirfd int, dstDirfd int, name string) error {
+	src, err := syscallcompat.Openat(srcDirfd, name, syscall.O_RDONLY|syscall.O_NOFOLLOW, 0)
+	if err != nil {
+		return err
+	}
+	defer syscall.Close(src)
+	var st syscall.Stat_t
+	if err = syscall.Fstat(src, &st); err != nil {
+		return err
+	}
+	// This cast is needed on Darwin, where st.Mode is uint16.
+	dst, err := syscallcompat.Openat(dstDirfd, name, syscall.O_WRONLY|syscall.O_CREAT|syscall.O_EXCL|syscall.O_NOFOLLOW, uint32(st.Mode)&0777)
+	if err != nil {
+		return err
+	}
+	err = copyUpData(src, dst, st.Size)
+	syscall.Close(dst)
+	if err != nil {
+		syscallcompat.Unlinkat(dstDirfd, name, 0)
+	}
+	return err
+}
+
+// copyUpXattrs copies the extended attributes. Failures are logged but do
+// not stop the copy-up, as the upper filesystem may not support all of them.
+func copyUpXattrs(src int, dst int) {
+	attrs, err := syscallcompat.Flistxattr(src)
+	if err != nil {
+		return
+	}
+	for _, attr := range attrs {
+		val, err := syscallcompat.Fgetxattr(src, attr)
+		if err == nil {
+			err = unix.Fsetxattr(dst, attr, val, 0)
+		}
+		if err != nil {
+			tlog.Warn.Printf("copy-up: could not copy xattr %q: %v", attr, err)
+		}
+	}
+}
+
+// unionWhiteout hides the lower entry "relPath" after the upper entry has
+// been removed
+func (rn *RootNode) unionWhiteout(relPath string) error {
+	if err := rn.unionCopyUp(nametransform.Dir(relPath)); err != nil {
+		return err
+	}
+	dirfd, cName, err := rn.openBackingDirIn(rn.args.Cipherdir, relPath)
+	if err != nil {
+		return err
+	}
+	defer syscall.Close(dirfd)
+	fd, err := syscallcompat.Openat(dirfd, whiteoutName(cName), syscall.O_WRONLY|syscall.O_CREAT|syscall.O_EXCL|syscall.O_NOFOLLOW, 0400)
+	if err == syscall.EEXIST {
+		return nil
+	} else if err != nil {
+		return err
+	}
+	return syscall.Close(fd)
+}
+
+// unionCreated is called after "relPath" has been created in the upper
+// layer. It removes the whiteout for it, and makes a new directory opaque if
+// the lower layer has an entry of the same name.
+func (rn *RootNode) unionCreated(relPath string) error {
+	dirfd, cName, err := rn.openBackingDirIn(rn.args.Cipherdir, relPath)
+	if err != nil {
+		return err
+	}
+	defer syscall.Close(dirfd)
+	err = syscallcompat.Unlinkat(dirfd, whiteoutName(cName), 0)
+	if err != nil && err != syscall.ENOENT {
+		return err
+	}
+	st, err := syscallcompat.Fstatat2(dirfd, cName, unix.AT_SYMLINK_NOFOLLOW)
+	if err != nil || st.Mode&syscall.S_IFMT != syscall.S_IFDIR {
+		return err
+	}
+	if ok, err := rn.lowerExists(relPath); err != nil || !ok {
+		return err
+	}
+	dirfd2, err := syscallcompat.Openat(dirfd, cName, syscall.O_DIRECTORY|syscall.O_NOFOLLOW|syscallcompat.O_PATH, 0)
+	if err != nil {
+		return err
+	}
+	defer syscall.Close(dirfd2)
+	fd, err := syscallcompat.Openat(dirfd2, unionOpaqueName, syscall.O_WRONLY|syscall.O_CREAT|syscall.O_EXCL|syscall.O_NOFOLLOW, 0400)
+	if err == syscall.EEXIST {
+		return nil
+	} else if err != nil {
+		return err
+	}
+	return syscall.Close(fd)
+}
+
+// unionRmdirCheck returns ENOTEMPTY if the merged directory "relPath" is
+// not empty. Otherwise, the union markers in the upper directory are
+// deleted, so that the normal Rmdir can remove it.
+func (rn *RootNode) unionRmdirCheck(relPath string, inUpper bool) error {
+	var upper []fuse.DirEntry
+	fd := -1
+	if inUpper {
+		dirfd, cName, err := rn.openBackingDirIn(rn.args.Cipherdir, relPath)
+		if err != nil {
+			return err
+		}
+		fd, err = syscallcompat.Openat(dirfd, cName, syscall.O_RDONLY|syscall.O_DIRECTORY|syscall.O_NOFOLLOW, 0)
+		syscall.Close(dirfd)
+		if err != nil {
+			return err
+		}
+		defer syscall.Close(fd)
+		if upper, err = syscallcompat.Getdents(fd); err != nil {
+			return err
+		}
+		for _, e := range upper {
+			if unionContentName(e.Name) {
+				return syscall.ENOTEMPTY
+			}
+		}
+	}
+	lfd, lower, err := rn.unionLowerEntries(relPath, upper)
+	if err != nil {
+		return err
+	}
+	if lfd >= 0 {
+		syscall.Close(lfd)
+	}
+	for _, e := range lower {
+		if unionContentName(e.Name) {
+			return syscall.ENOTEMPTY
+		}
+	}
+	for _, e := range upper {
+		if isUnionMarker(e.Name) {
+			if err = syscallcompat.Unlinkat(fd, e.Name, 0); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// CheckLowerdir checks that LowerCipherdir can be merged below Cipherdir:
+// both root directories must have the same DirIV, and the names in the lower
+// root must decrypt with our key. If the upper root has no DirIV, the lower
+// one is copied, so that an empty directory with a copy of gocryptfs.conf can
+// be the upper layer.
+func (rn *RootNode) CheckLowerdir() error {
+	if rn.args.LowerCipherdir == "" {
+		return nil
+	}
+	lower, err := syscallcompat.Open(rn.args.LowerCipherdir, syscall.O_RDONLY|syscall.O_DIRECTORY, 0)
+	if err != nil {
+		return err
+	}
+	defer syscall.Close(lower)
+	upper, err := syscallcompat.Open(rn.args.Cipherdir, syscall.O_DIRECTORY|syscallcompat.O_PATH, 0)
+	if err != nil {
+		return err
+	}
+	defer syscall.Close(upper)
+	liv, err := nametransform.ReadDirIVAt(lower)
+	if err != nil {
+		return err
+	}
+	uiv, err := nametransform.ReadDirIVAt(upper)
+	if err == syscall.ENOENT {
+		if err = copyUpSmallFile(lower, upper, nametransform.DirIVFilename); err != nil {
+			return err
+		}
+		uiv = liv
+	} else if err != nil {
+		return err
+	}
+	if !bytes.Equal(liv, uiv) {
+		return fmt.Errorf("%s and %s have different root %s", rn.args.LowerCipherdir,
+			rn.args.Cipherdir, nametransform.DirIVFilename)
+	}
+	entries, err := syscallcompat.Getdents(lower)
+	if err != nil {
+		return err
+	}
+	for _, e := range entries {
+		if !unionContentName(e.Name) || e.Name == configfile.ConfDefaultName ||
+			nametransform.NameType(e.Name) != nametransform.LongNameNone {
+			continue
+		}
+		if _, err = rn.nameTransform.DecryptName(e.Name, liv); err != nil {
+			return fmt.Errorf("cannot decrypt %q in %s, is it encrypted with a different key? %v",
+				e.Name, rn.args.LowerCipherdir, err)
+		}
+		break
+	}
+	return nil
+}
+
+// unionNop is the "done" function when there is nothing to do afterwards
+func unionNop(*syscall.Errno) {}
+
+// unionCopyUp copies n up to the upper layer in "-lowerdir" mode, before it
+// is changed
+func (n *Node) unionCopyUp() syscall.Errno {
+	return fs.ToErrno(n.rootNode().unionCopyUp(n.Path()))
+}
+
+// unionCreate prepares creating the child "name" of n in "-lowerdir" mode.
+// The parent is copied up, and a name that is visible in the lower layer
+// gets EEXIST. After creating the entry, the caller calls "done" with the
+// result.
+func (n *Node) unionCreate(name string) (done func(*syscall.Errno), errno syscall.Errno) {
+	rn := n.rootNode()
+	if rn.args.LowerCipherdir == "" {
+		return unionNop, 0
+	}
+	p := filepath.Join(n.Path(), name)
+	if err := rn.unionCopyUp(n.Path()); err != nil {
+		return nil, fs.ToErrno(err)
+	}
+	inUpper, inLower, err := rn.unionLookup(p)
+	if err != nil {
+		return nil, fs.ToErrno(err)
+	}
+	if !inUpper && inLower {
+		return nil, syscall.EEXIST
+	}
+	return func(errno *syscall.Errno) {
+		if *errno == 0 {
+			*errno = fs.ToErrno(rn.unionCreated(p))
+		}
+	}, 0
+}
+
+// unionRemove prepares removing the child "name" of n in "-lowerdir" mode.
+// An entry that is only in the lower layer is hidden by a whiteout right
+// away, and "handled" is true. Otherwise, the caller removes the upper entry
+// and then calls "done" with the result.
+func (n *Node) unionRemove(name string, rmdir bool) (handled bool, done func(*syscall.Errno), errno syscall.Errno) {
+	rn := n.rootNode()
+	if rn.args.LowerCipherdir == "" {
+		return false, unionNop, 0
+	}
+	p := filepath.Join(n.Path(), name)
+	inUpper, inLower, err := rn.unionLookup(p)
+	if err != nil {
+		return false, nil, fs.ToErrno(err)
+	}
+	if !inLower {
+		return false, unionNop, 0
+	}
+	if rmdir {
+		if err = rn.unionRmdirCheck(p, inUpper); err != nil {
+			return false, nil, fs.ToErrno(err)
+		}
+	}
+	if !inUpper {
+		st, err := rn.lowerStat(p)
+		if err != nil {
+			return false, nil, fs.ToErrno(err)
+		}
+		isDir := st.Mode&syscall.S_IFMT == syscall.S_IFDIR
+		if rmdir && !isDir {
+			return false, nil, syscall.ENOTDIR
+		} else if !rmdir && isDir {
+			return false, nil, syscall.EISDIR
+		}
+		return true, nil, fs.ToErrno(rn.unionWhiteout(p))
+	}
+	return false, func(errno *syscall.Errno) {
+		if *errno == 0 {
+			*errno = fs.ToErrno(rn.unionWhiteout(p))
+		}
+	}, 0
+}
+
+// unionRename prepares renaming the child "name" of n to "newName" in
+// "newParent" in "-lowerdir" mode. Files are copied up. Directories that
+// exist in the lower layer get EXDEV, because their lower content would stay
+// behind; mv(1) then copies them. After the rename, the caller calls "done"
+// with the result.
+func (n *Node) unionRename(name string, newParent *Node, newName string, flags uint32) (done func(*syscall.Errno), errno syscall.Errno) {
+	rn := n.rootNode()
+	if rn.args.LowerCipherdir == "" {
+		return unionNop, 0
+	}
+	p1 := filepath.Join(n.Path(), name)
+	p2 := filepath.Join(newParent.Path(), newName)
+	isDir := func(st *syscall.Stat_t, err error) bool {
+		return err == nil && st.Mode&syscall.S_IFMT == syscall.S_IFDIR
+	}
+	lowerDir := func(relPath string) bool {
+		return isDir(rn.lowerStat(relPath))
+	}
+	_, inLower1, err := rn.unionLookup(p1)
+	if err != nil {
+		return nil, fs.ToErrno(err)
+	}
+	if inLower1 && lowerDir(p1) {
+		return nil, syscall.EXDEV
+	}
+	if err = rn.unionCopyUp(p1); err != nil {
+		return nil, fs.ToErrno(err)
+	}
+	if err = rn.unionCopyUp(newParent.Path()); err != nil {
+		return nil, fs.ToErrno(err)
+	}
+	inUpper2, inLower2, err := rn.unionLookup(p2)
+	if err != nil {
+		return nil, fs.ToErrno(err)
+	}
+	exchange := flags&syscallcompat.RENAME_EXCHANGE != 0
+	if inLower2 && (exchange || !inUpper2) {
+		dirfd, cName, err := rn.openBackingDirIn(rn.args.Cipherdir, p1)
+		if err != nil {
+			return nil, fs.ToErrno(err)
+		}
+		srcDir := isDir(syscallcompat.Fstatat2(dirfd, cName, unix.AT_SYMLINK_NOFOLLOW))
+		syscall.Close(dirfd)
+		if lowerDir(p2) {
+			if !srcDir && !exchange {
+				return nil, syscall.EISDIR
+			}
+			return nil, syscall.EXDEV
+		} else if srcDir && !exchange {
+			return nil, syscall.ENOTDIR
+		}
+		if exchange {
+			if err = rn.unionCopyUp(p2); err != nil {
+				return nil, fs.ToErrno(err)
+			}
+		} else if flags&syscallcompat.RENAME_NOREPLACE != 0 {
+			return nil, syscall.EEXIST
+		}
+	}
+	return func(errno *syscall.Errno) {
+		if *errno != 0 {
+			return
+		}
+		err := rn.unionCreated(p2)
+		if err == nil && exchange {
+			err = rn.unionCreated(p1)
+		} else if err == nil && inLower1 {
+			err = rn.unionWhiteout(p1)
+		}
+		*errno = fs.ToErrno(err)
+	}, 0
+}
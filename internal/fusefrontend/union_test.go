@@ -0,0 +1,150 @@
+package fusefrontend
+
+import (
+	"bytes"
+	"io/ioutil"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"syscall"
+	"testing"
+
+	"github.com/hanwen/go-fuse/v2/fuse"
+
+	"github.com/rfjakob/gocryptfs/internal/configfile"
+	"github.com/rfjakob/gocryptfs/tests/test_helpers"
+)
+
+// newUnionUpper creates an upper layer for "lower". It starts out as a copy
+// of the config file.
+func newUnionUpper(t *testing.T, lower string) string {
+	upper, err := ioutil.TempDir(test_helpers.TmpDir, t.Name()+".upper.")
+	if err != nil {
+		t.Fatal(err)
+	}
+	conf, err := ioutil.ReadFile(filepath.Join(lower, configfile.ConfDefaultName))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = ioutil.WriteFile(filepath.Join(upper, configfile.ConfDefaultName), conf, 0400); err != nil {
+		t.Fatal(err)
+	}
+	return upper
+}
+
+// TestUnion merges two cipherdirs and checks that the listing and the file
+// contents combine both layers, that writing copies a lower file up, and
+// that deleted lower entries stay hidden.
+func TestUnion(t *testing.T) {
+	lower := test_helpers.InitFS(t)
+	lrn := newTestFS(Args{Cipherdir: lower})
+	createFile(t, &lrn.Node, "lower-only", []byte("lower-only content"))
+	createFile(t, &lrn.Node, "both", []byte("lower version"))
+	d := mkdirTestDir(t, &lrn.Node, "dir")
+	createFile(t, d, "x", bytes.Repeat([]byte("x"), 10000))
+	createFile(t, d, "y", []byte("y"))
+
+	upper := newUnionUpper(t, lower)
+	rn := newTestFS(Args{Cipherdir: upper, LowerCipherdir: lower})
+	if err := rn.CheckLowerdir(); err != nil {
+		t.Fatal(err)
+	}
+	urn := newTestFS(Args{Cipherdir: upper})
+	createFile(t, &urn.Node, "both", []byte("upper version"))
+	createFile(t, &urn.Node, "upper-only", []byte("upper-only content"))
+
+	if have, want := listDir(t, &rn.Node), []string{"both", "dir", "lower-only", "upper-only"}; !reflect.DeepEqual(have, want) {
+		t.Errorf("want %v, have %v", want, have)
+	}
+	for name, want := range map[string]string{
+		"both":       "upper version",
+		"lower-only": "lower-only content",
+		"upper-only": "upper-only content",
+	} {
+		if have := readChildFile(t, &rn.Node, name); have != want {
+			t.Errorf("%s: want %q, have %q", name, want, have)
+		}
+	}
+
+	// Writing into a block of a lower file copies it up first
+	ud, _ := lookup(t, &rn.Node, "dir")
+	x, _ := lookup(t, ud, "x")
+	fh, _, errno := x.Open(nil, syscall.O_WRONLY)
+	if errno != 0 {
+		t.Fatal(errno)
+	}
+	if _, errno = fh.(*File).Write(nil, []byte("AB"), 5000); errno != 0 {
+		t.Fatal(errno)
+	}
+	fh.(*File).Release(nil)
+	want := bytes.Repeat([]byte("x"), 10000)
+	copy(want[5000:], "AB")
+	if have := readChildFile(t, ud, "x"); have != string(want) {
+		t.Errorf("dir/x has wrong content after the write")
+	}
+	if have := readChildFile(t, lookupChild(t, &lrn.Node, "dir"), "x"); have != strings.Repeat("x", 10000) {
+		t.Errorf("the write changed the lower layer")
+	}
+	upperDir, _ := lookup(t, &urn.Node, "dir")
+	if have, want := listDir(t, upperDir), []string{"x"}; !reflect.DeepEqual(have, want) {
+		t.Errorf("upper dir: want %v, have %v", want, have)
+	}
+	if have, want := listDir(t, ud), []string{"x", "y"}; !reflect.DeepEqual(have, want) {
+		t.Errorf("merged dir: want %v, have %v", want, have)
+	}
+
+	// Deleting lower entries leaves whiteouts in the upper layer
+	for _, name := range []string{"both", "lower-only"} {
+		if errno = rn.Unlink(nil, name); errno != 0 {
+			t.Fatalf("Unlink %q: %v", name, errno)
+		}
+		if _, errno = lookup(t, &rn.Node, name); errno != syscall.ENOENT {
+			t.Errorf("%s: Lookup after Unlink: want ENOENT, have %v", name, errno)
+		}
+	}
+	if have, want := listDir(t, &rn.Node), []string{"dir", "upper-only"}; !reflect.DeepEqual(have, want) {
+		t.Errorf("after Unlink: want %v, have %v", want, have)
+	}
+	if have, want := listDir(t, &lrn.Node), []string{"both", "dir", "lower-only"}; !reflect.DeepEqual(have, want) {
+		t.Errorf("Unlink changed the lower layer: want %v, have %v", want, have)
+	}
+	entries, err := ioutil.ReadDir(upper)
+	if err != nil {
+		t.Fatal(err)
+	}
+	whiteouts := 0
+	for _, e := range entries {
+		if strings.HasPrefix(e.Name(), unionWhiteoutPrefix) {
+			whiteouts++
+		}
+	}
+	if whiteouts != 2 {
+		t.Errorf("want 2 whiteouts, have %d", whiteouts)
+	}
+	// A new file of the same name replaces the whiteout
+	createFile(t, &rn.Node, "lower-only", []byte("new"))
+	if have := readChildFile(t, &rn.Node, "lower-only"); have != "new" {
+		t.Errorf("recreated file: want %q, have %q", "new", have)
+	}
+
+	// The merged directory is only empty when both layers are
+	if errno = rn.Rmdir(nil, "dir"); errno != syscall.ENOTEMPTY {
+		t.Errorf("Rmdir of a non-empty merged dir: want ENOTEMPTY, have %v", errno)
+	}
+	for _, name := range []string{"x", "y"} {
+		if errno = ud.Unlink(nil, name); errno != 0 {
+			t.Fatalf("Unlink dir/%s: %v", name, errno)
+		}
+	}
+	if errno = rn.Rmdir(nil, "dir"); errno != 0 {
+		t.Fatal(errno)
+	}
+	// A new directory of the same name does not show the lower content
+	if _, errno = rn.Mkdir(nil, "dir", 0700, &fuse.EntryOut{}); errno != 0 {
+		t.Fatal(errno)
+	}
+	ud, _ = lookup(t, &rn.Node, "dir")
+	if have := listDir(t, ud); len(have) != 0 {
+		t.Errorf("new dir shows lower entries: %v", have)
+	}
+}
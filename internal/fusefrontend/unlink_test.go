@@ -0,0 +1,59 @@
+package fusefrontend
+
+import (
+	"io/ioutil"
+	"strings"
+	"syscall"
+	"testing"
+
+	"github.com/hanwen/go-fuse/v2/fuse"
+
+	"github.com/rfjakob/gocryptfs/internal/nametransform"
+	"github.com/rfjakob/gocryptfs/tests/test_helpers"
+)
+
+// TestUnlinkLongName creates a file with a long name, deletes it, and verifies
+// that neither the content file nor the .name side file is left behind.
+func TestUnlinkLongName(t *testing.T) {
+	cipherdir := test_helpers.InitFS(t)
+	args := Args{
+		Cipherdir: cipherdir,
+		LongNames: true,
+	}
+	fs := newTestFS(args)
+
+	name := strings.Repeat("x", 200)
+	_, fh, _, errno := fs.Create(nil, name, syscall.O_RDWR, 0600, &fuse.EntryOut{})
+	if errno != 0 {
+		t.Fatal(errno)
+	}
+	fh.(*File).Release(nil)
+
+	entries, err := ioutil.ReadDir(cipherdir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var longEntries int
+	for _, e := range entries {
+		if nametransform.NameType(e.Name()) != nametransform.LongNameNone {
+			longEntries++
+		}
+	}
+	if longEntries != 2 {
+		t.Fatalf("expected content and .name file, have %d long name entries", longEntries)
+	}
+
+	errno = fs.Unlink(nil, name)
+	if errno != 0 {
+		t.Fatal(errno)
+	}
+	entries, err = ioutil.ReadDir(cipherdir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, e := range entries {
+		if nametransform.NameType(e.Name()) != nametransform.LongNameNone {
+			t.Errorf("leftover file %q", e.Name())
+		}
+	}
+}
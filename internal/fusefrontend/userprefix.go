@@ -0,0 +1,114 @@
+package fusefrontend
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"syscall"
+
+	"github.com/hanwen/go-fuse/v2/fuse"
+)
+
+// ReadUserPrefixes reads the "-user_prefix" file. Each line has a numeric uid
+// and a plaintext directory, relative to the root of the mount, separated by
+// whitespace. Empty lines and lines starting with "#" are ignored.
+//
+//	# uid  directory
+//	1000   home/alice
+//	1001   home/bob
+func ReadUserPrefixes(path string) (map[uint32]string, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	m := make(map[uint32]string)
+	scanner := bufio.NewScanner(f)
+	for lineNo := 1; scanner.Scan(); lineNo++ {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		fields := strings.Fields(line)
+		if len(fields) != 2 {
+			return nil, fmt.Errorf("%s:%d: want \"UID DIRECTORY\", got %q", path, lineNo, line)
+		}
+		uid, err := strconv.ParseUint(fields[0], 10, 32)
+		if err != nil {
+			return nil, fmt.Errorf("%s:%d: invalid uid %q", path, lineNo, fields[0])
+		}
+		// Like "-prefix": "/home/alice/" and "home/alice" mean the same
+		dir := strings.Trim(filepath.Clean("/"+fields[1]), "/")
+		if dir == "" {
+			return nil, fmt.Errorf("%s:%d: uid %d: the directory cannot be the root of the mount", path, lineNo, uid)
+		}
+		if _, dup := m[uint32(uid)]; dup {
+			return nil, fmt.Errorf("%s:%d: duplicate uid %d", path, lineNo, uid)
+		}
+		m[uint32(uid)] = dir
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	if len(m) == 0 {
+		return nil, fmt.Errorf("%s: no entries", path)
+	}
+	return m, nil
+}
+
+// callerPrefix returns the directory, relative to the root of the
+// filesystem, that is the root of the mount for the caller in "ctx".
+// Callers that have no "-user_prefix" entry get EACCES.
+//
+// So do calls without a caller, like those from "-webdav". They do not come
+// from the kernel, and there is no user whose subtree they could see.
+func (rn *RootNode) callerPrefix(ctx context.Context) (string, syscall.Errno) {
+	if rn.args.UserPrefixes == nil {
+		return rn.args.Prefix, 0
+	}
+	if ctx == nil {
+		return "", syscall.EACCES
+	}
+	caller, ok := fuse.FromContext(ctx)
+	if !ok {
+		return "", syscall.EACCES
+	}
+	dir, ok := rn.args.UserPrefixes[caller.Uid]
+	if !ok {
+		return "", syscall.EACCES
+	}
+	return filepath.Join(rn.args.Prefix, dir), 0
+}
+
+// openBackingDirAs is openBackingDir for the caller in "ctx". "relPath" is
+// relative to the root of the mount as the caller sees it.
+//
+// "relPath" comes from the inode tree and should never contain "..", and
+// the kernel resolves ".." at the root of the mount to outside of the mount.
+// Still, a path that filepath.Join would clean to outside of the prefix is
+// rejected with EACCES.
+func (rn *RootNode) openBackingDirAs(ctx context.Context, relPath string) (dirfd int, cName string, err error) {
+	prefix, errno := rn.callerPrefix(ctx)
+	if errno != 0 {
+		return -1, "", errno
+	}
+	p := filepath.Join(prefix, relPath)
+	if prefix != "" && p != prefix && !strings.HasPrefix(p, prefix+"/") {
+		return -1, "", syscall.EACCES
+	}
+	return rn.openBackingDirUnprefixed(p)
+}
+
+// CheckUserPrefixes checks that all "-user_prefix" directories exist.
+func (rn *RootNode) CheckUserPrefixes() error {
+	for uid, dir := range rn.args.UserPrefixes {
+		if err := rn.checkDir(filepath.Join(rn.args.Prefix, dir)); err != nil {
+			return fmt.Errorf("uid %d: %v", uid, err)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,203 @@
+package fusefrontend
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"syscall"
+	"testing"
+
+	"github.com/hanwen/go-fuse/v2/fuse"
+
+	"github.com/rfjakob/gocryptfs/tests/test_helpers"
+)
+
+func TestReadUserPrefixes(t *testing.T) {
+	dir, err := ioutil.TempDir("", "userprefix")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	testCases := []struct {
+		content string
+		want    map[uint32]string
+	}{
+		{"# uid directory\n1000 home/alice\n\n  1001\t/home/bob/  \n", map[uint32]string{1000: "home/alice", 1001: "home/bob"}},
+		{"1000 home/../alice\n", map[uint32]string{1000: "alice"}},
+		// Errors
+		{"", nil},
+		{"1000\n", nil},
+		{"alice home/alice\n", nil},
+		{"-1 home/alice\n", nil},
+		{"1000 /\n", nil},
+		{"1000 ../..\n", nil},
+		{"1000 a\n1000 b\n", nil},
+	}
+	for i, tc := range testCases {
+		path := filepath.Join(dir, "map")
+		if err := ioutil.WriteFile(path, []byte(tc.content), 0600); err != nil {
+			t.Fatal(err)
+		}
+		have, err := ReadUserPrefixes(path)
+		if tc.want == nil {
+			if err == nil {
+				t.Errorf("case %d: want an error, got %v", i, have)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("case %d: %v", i, err)
+			continue
+		}
+		if len(have) != len(tc.want) {
+			t.Errorf("case %d: want %v, have %v", i, tc.want, have)
+		}
+		for uid, d := range tc.want {
+			if have[uid] != d {
+				t.Errorf("case %d: uid %d: want %q, have %q", i, uid, d, have[uid])
+			}
+		}
+	}
+}
+
+// TestUserPrefix mounts a filesystem with subtrees for two users and checks
+// that each user only sees their own subtree, cannot get out of it, and
+// that users without an entry get EACCES.
+func TestUserPrefix(t *testing.T) {
+	cipherdir := test_helpers.InitFS(t)
+	// Set up the home directories through a mount without -user_prefix
+	admin := newTestFS(Args{Cipherdir: cipherdir})
+	home := mkdirTestDir(t, &admin.Node, "home")
+	writeTestFile(t, &admin.Node, "toplevel", 10)
+	for _, user := range []string{"alice", "bob"} {
+		d := mkdirTestDir(t, home, user)
+		writeTestFile(t, d, user+"-file", 10)
+		mkdirTestDir(t, d, user+"-dir")
+	}
+
+	rn := newTestFS(Args{
+		Cipherdir:     cipherdir,
+		SharedStorage: true,
+		UserPrefixes:  map[uint32]string{1000: "home/alice", 1001: "home/bob"},
+	})
+	if err := rn.CheckUserPrefixes(); err != nil {
+		t.Fatal(err)
+	}
+	ctxAs := func(uid uint32) context.Context {
+		return fuse.NewContext(context.Background(), &fuse.Caller{Owner: fuse.Owner{Uid: uid, Gid: uid}})
+	}
+	alice, bob, eve := ctxAs(1000), ctxAs(1001), ctxAs(1002)
+
+	list := func(ctx context.Context, n *Node) (names []string, errno syscall.Errno) {
+		ds, errno := n.Readdir(ctx)
+		if errno != 0 {
+			return nil, errno
+		}
+		for ds.HasNext() {
+			e, errno := ds.Next()
+			if errno != 0 {
+				return nil, errno
+			}
+			if e.Name != "." && e.Name != ".." {
+				names = append(names, e.Name)
+			}
+		}
+		sort.Strings(names)
+		return names, 0
+	}
+	for _, tc := range []struct {
+		ctx  context.Context
+		user string
+	}{{alice, "alice"}, {bob, "bob"}} {
+		names, errno := list(tc.ctx, &rn.Node)
+		if errno != 0 {
+			t.Fatalf("%s: Readdir: %v", tc.user, errno)
+		}
+		if len(names) != 2 || names[0] != tc.user+"-dir" || names[1] != tc.user+"-file" {
+			t.Errorf("%s sees %v", tc.user, names)
+		}
+		var a fuse.AttrOut
+		if errno := rn.Getattr(tc.ctx, nil, &a); errno != 0 || a.Mode&syscall.S_IFMT != syscall.S_IFDIR {
+			t.Errorf("%s: Getattr of the root: %v", tc.user, errno)
+		}
+	}
+
+	// The other user's files, the top level of the filesystem, and
+	// everything that would lead there
+	for _, name := range []string{"bob-file", "bob-dir", "toplevel", "home"} {
+		if _, errno := rn.Lookup(alice, name, &fuse.EntryOut{}); errno != syscall.ENOENT {
+			t.Errorf("alice: Lookup %q: want ENOENT, have %v", name, errno)
+		}
+	}
+	// ".." is resolved by the kernel and never looked up
+	if _, errno := rn.Lookup(alice, "..", &fuse.EntryOut{}); errno != syscall.ENOENT {
+		t.Errorf("alice: Lookup \"..\" at the root: want ENOENT, have %v", errno)
+	}
+	for _, name := range []string{"../bob", "../../toplevel", "alice-dir/../../bob"} {
+		if _, errno := rn.Lookup(alice, name, &fuse.EntryOut{}); errno != syscall.EACCES {
+			t.Errorf("alice: Lookup %q: want EACCES, have %v", name, errno)
+		}
+	}
+	// Going up from a subdirectory only reaches the root of the subtree
+	ch, errno := rn.Lookup(alice, "alice-dir", &fuse.EntryOut{})
+	if errno != 0 {
+		t.Fatal(errno)
+	}
+	rn.AddChild("alice-dir", ch, true)
+	sub := toNode(ch.Operations())
+	if _, errno := sub.Lookup(alice, "../alice-file", &fuse.EntryOut{}); errno != 0 {
+		t.Errorf("alice: Lookup alice-dir/../alice-file: %v", errno)
+	}
+	if _, errno := sub.Lookup(alice, "../../bob/bob-file", &fuse.EntryOut{}); errno != syscall.EACCES {
+		t.Errorf("alice: Lookup alice-dir/../../bob/bob-file: want EACCES, have %v", errno)
+	}
+
+	// New files end up in the subtree of their creator
+	_, fh, _, errno := rn.Create(bob, "new", syscall.O_RDWR, 0600, &fuse.EntryOut{})
+	if errno != 0 {
+		t.Fatal(errno)
+	}
+	fh.(*File).Release(nil)
+	if _, errno := rn.Lookup(alice, "new", &fuse.EntryOut{}); errno != syscall.ENOENT {
+		t.Errorf("alice sees bob's new file: %v", errno)
+	}
+	if _, errno := lookupChild(t, home, "bob").Lookup(nil, "new", &fuse.EntryOut{}); errno != 0 {
+		t.Errorf("bob's new file is not in home/bob: %v", errno)
+	}
+
+	// Unknown users
+	if _, errno := list(eve, &rn.Node); errno != syscall.EACCES {
+		t.Errorf("eve: Readdir: want EACCES, have %v", errno)
+	}
+	if _, errno := rn.Lookup(eve, "alice-file", &fuse.EntryOut{}); errno != syscall.EACCES {
+		t.Errorf("eve: Lookup: want EACCES, have %v", errno)
+	}
+	if _, _, _, errno := rn.Create(eve, "x", syscall.O_RDWR, 0600, &fuse.EntryOut{}); errno != syscall.EACCES {
+		t.Errorf("eve: Create: want EACCES, have %v", errno)
+	}
+
+	// No caller at all, like from -webdav: there is no subtree to show
+	for _, ctx := range []context.Context{nil, context.Background()} {
+		if _, errno := list(ctx, &rn.Node); errno != syscall.EACCES {
+			t.Errorf("ctx %v: Readdir: want EACCES, have %v", ctx, errno)
+		}
+		if _, errno := rn.Lookup(ctx, "home", &fuse.EntryOut{}); errno != syscall.EACCES {
+			t.Errorf("ctx %v: Lookup: want EACCES, have %v", ctx, errno)
+		}
+		if _, _, _, errno := rn.Create(ctx, "x", syscall.O_RDWR, 0600, &fuse.EntryOut{}); errno != syscall.EACCES {
+			t.Errorf("ctx %v: Create: want EACCES, have %v", ctx, errno)
+		}
+	}
+}
+
+// mkdirTestDir creates the directory "name" in "n" and returns it
+func mkdirTestDir(t *testing.T, n *Node, name string) *Node {
+	ch, errno := n.Mkdir(nil, name, 0700, &fuse.EntryOut{})
+	if errno != 0 {
+		t.Fatal(errno)
+	}
+	n.AddChild(name, ch, true)
+	return toNode(ch.Operations())
+}
@@ -0,0 +1,89 @@
+package fusefrontend
+
+import (
+	"crypto/rand"
+	"syscall"
+
+	"golang.org/x/sys/unix"
+
+	"github.com/rfjakob/gocryptfs/internal/inomap"
+	"github.com/rfjakob/gocryptfs/internal/openfiletable"
+	"github.com/rfjakob/gocryptfs/internal/syscallcompat"
+	"github.com/rfjakob/gocryptfs/internal/tlog"
+)
+
+// wipeChunkSize is how much random data wipeFd writes at once
+const wipeChunkSize = 128 * 1024
+
+// unlinkBacking deletes the backing file "cName" in "dirfd". With "-wipe",
+// the content is overwritten with random data and synced to disk once the
+// unlink has succeeded, through an fd opened before. Without the master key,
+// the ciphertext is worthless anyway; this protects against somebody who gets
+// both the key and the disk.
+//
+// The wipe is best effort: failures are logged and do not fail the delete.
+// Files that are still open, or have other hard links, are left alone,
+// because their content is still in use. On SSDs and copy-on-write
+// filesystems, the old blocks may survive the overwrite, see warnWipeMedia in
+// the main package.
+func (rn *RootNode) unlinkBacking(dirfd int, cName string) error {
+	if !rn.args.Wipe {
+		return syscallcompat.Unlinkat(dirfd, cName, 0)
+	}
+	var st unix.Stat_t
+	err := syscallcompat.Fstatat(dirfd, cName, &st, unix.AT_SYMLINK_NOFOLLOW)
+	if err != nil || st.Mode&syscall.S_IFMT != syscall.S_IFREG {
+		return syscallcompat.Unlinkat(dirfd, cName, 0)
+	}
+	fd, err := syscallcompat.Openat(dirfd, cName, syscall.O_WRONLY|syscall.O_NOFOLLOW|syscall.O_NONBLOCK, 0)
+	if err != nil {
+		tlog.Warn.Printf("wipe %q: %v", cName, err)
+		fd = -1
+	}
+	if err = syscallcompat.Unlinkat(dirfd, cName, 0); err != nil {
+		if fd >= 0 {
+			syscall.Close(fd)
+		}
+		return err
+	}
+	if fd >= 0 {
+		wipeFd(fd, cName)
+		syscall.Close(fd)
+	}
+	return nil
+}
+
+// wipeFd overwrites the content of the unlinked file "fd" with random data
+// and syncs it to disk. "cName" is only used for log messages.
+func wipeFd(fd int, cName string) {
+	var st syscall.Stat_t
+	if err := syscall.Fstat(fd, &st); err != nil {
+		tlog.Warn.Printf("wipe %q: %v", cName, err)
+		return
+	}
+	if st.Mode&syscall.S_IFMT != syscall.S_IFREG || st.Nlink != 0 {
+		return
+	}
+	if openfiletable.Lookup(inomap.QInoFromStat(&st)) != nil {
+		tlog.Warn.Printf("wipe %q: file is still open, not wiping it", cName)
+		return
+	}
+	buf := make([]byte, wipeChunkSize)
+	for off := int64(0); off < st.Size; off += int64(len(buf)) {
+		chunk := buf
+		if st.Size-off < int64(len(chunk)) {
+			chunk = chunk[:st.Size-off]
+		}
+		_, err := rand.Read(chunk)
+		if err == nil {
+			_, err = syscall.Pwrite(fd, chunk, off)
+		}
+		if err != nil {
+			tlog.Warn.Printf("wipe %q: overwrite at offset %d: %v", cName, off, err)
+			return
+		}
+	}
+	if err := syscall.Fsync(fd); err != nil {
+		tlog.Warn.Printf("wipe %q: fsync: %v", cName, err)
+	}
+}
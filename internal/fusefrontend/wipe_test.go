@@ -0,0 +1,154 @@
+package fusefrontend
+
+import (
+	"bytes"
+	"io"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"syscall"
+	"testing"
+
+	"github.com/rfjakob/gocryptfs/tests/test_helpers"
+)
+
+// readAll reads the whole content of "f", independent of the file offset
+func readAll(t *testing.T, f *os.File) []byte {
+	content, err := ioutil.ReadAll(io.NewSectionReader(f, 0, 1<<40))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return content
+}
+
+// openBacking opens the backing file of "name" in the root of "rn" and
+// returns it with its current content. The fd keeps the content reachable
+// after the unlink.
+func openBacking(t *testing.T, rn *RootNode, name string) (*os.File, []byte) {
+	cName, err := rn.EncryptPath(name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	f, err := os.Open(filepath.Join(rn.args.Cipherdir, cName))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return f, readAll(t, f)
+}
+
+// TestWipe deletes files in "-wipe" mode while holding the backing file open
+// outside of the mount, and checks that every block of the ciphertext has been
+// overwritten by the unlink. Files that are open through the mount, or
+// have another hard link, must be left alone.
+func TestWipe(t *testing.T) {
+	cipherdir := test_helpers.InitFS(t)
+	for _, wipe := range []bool{false, true} {
+		rn := newTestFS(Args{Cipherdir: cipherdir, Wipe: wipe})
+		bs := int(rn.contentEnc.CipherBS())
+		name := "f"
+		if wipe {
+			name = "wiped"
+		}
+		// Bigger than wipeChunkSize, in two writes as one is limited to
+		// 128 KiB
+		writeTestFile(t, &rn.Node, name, 100*1024)
+		_, f := openTestFile(t, rn, name, syscall.O_WRONLY)
+		if _, errno := f.Write(nil, bytes.Repeat([]byte{1}, 100*1024), 100*1024); errno != 0 {
+			t.Fatal(errno)
+		}
+		f.Release(nil)
+		backing, old := openBacking(t, rn, name)
+		if errno := rn.Unlink(nil, name); errno != 0 {
+			t.Fatal(errno)
+		}
+		now := readAll(t, backing)
+		backing.Close()
+		if len(now) != len(old) {
+			t.Fatalf("wipe=%v: size changed from %d to %d", wipe, len(old), len(now))
+		}
+		if !wipe {
+			if !bytes.Equal(now, old) {
+				t.Errorf("content changed without -wipe")
+			}
+			continue
+		}
+		zero := make([]byte, bs)
+		for off := 0; off < len(old); off += bs {
+			end := off + bs
+			if end > len(old) {
+				end = len(old)
+			}
+			if bytes.Equal(now[off:end], old[off:end]) || bytes.Equal(now[off:end], zero[:end-off]) {
+				t.Fatalf("block at offset %d has not been overwritten with random data", off)
+			}
+		}
+	}
+
+	// Still open through the mount, or still linked: no wipe
+	rn := newTestFS(Args{Cipherdir: cipherdir, Wipe: true})
+	writeTestFile(t, &rn.Node, "open", 10000)
+	_, f := openTestFile(t, rn, "open", syscall.O_RDONLY)
+	defer f.Release(nil)
+	writeTestFile(t, &rn.Node, "linked", 10000)
+	linked, err := rn.EncryptPath("linked")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = os.Link(filepath.Join(cipherdir, linked), filepath.Join(cipherdir, "link")); err != nil {
+		t.Fatal(err)
+	}
+	for _, name := range []string{"open", "linked"} {
+		backing, old := openBacking(t, rn, name)
+		if errno := rn.Unlink(nil, name); errno != 0 {
+			t.Fatal(errno)
+		}
+		now := readAll(t, backing)
+		backing.Close()
+		if !bytes.Equal(now, old) {
+			t.Errorf("%s: content in use has been wiped", name)
+		}
+	}
+}
+
+// TestWipeUnlinkFails makes the unlink fail by setting the immutable flag on
+// the backing directory, and checks that "-wipe" leaves the content intact,
+// for Unlink and for purging the trash.
+func TestWipeUnlinkFails(t *testing.T) {
+	cipherdir := test_helpers.InitFS(t)
+	rn := newTestFS(Args{Cipherdir: cipherdir, Wipe: true, Trash: true})
+	createFile(t, &rn.Node, "trashed", []byte("hello"))
+	if errno := rn.Unlink(nil, "trashed"); errno != 0 {
+		t.Fatal(errno)
+	}
+	_, ids := trashPaths(t, rn)
+	rn.args.Trash = false
+	createFile(t, &rn.Node, "f", []byte("world"))
+	backing, old := openBacking(t, rn, "f")
+	defer backing.Close()
+	trash, err := os.Open(filepath.Join(cipherdir, trashDir, ids["trashed"]))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer trash.Close()
+	oldTrash := readAll(t, trash)
+
+	for _, dir := range []string{cipherdir, filepath.Join(cipherdir, trashDir)} {
+		if out, err := exec.Command("chattr", "+i", dir).CombinedOutput(); err != nil {
+			t.Skipf("cannot set the immutable flag: %v, %s", err, out)
+		}
+		defer exec.Command("chattr", "-i", dir).Run()
+	}
+	if errno := rn.Unlink(nil, "f"); errno != syscall.EPERM {
+		t.Errorf("Unlink: want EPERM, have %v", errno)
+	}
+	if err = rn.PurgeTrash(ids["trashed"]); err != syscall.EPERM {
+		t.Errorf("PurgeTrash: want EPERM, have %v", err)
+	}
+	if !bytes.Equal(readAll(t, backing), old) {
+		t.Error("Unlink failed, but the file has been wiped")
+	}
+	if !bytes.Equal(readAll(t, trash), oldTrash) {
+		t.Error("PurgeTrash failed, but the file has been wiped")
+	}
+}
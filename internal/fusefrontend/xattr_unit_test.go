@@ -18,7 +18,7 @@ func newTestFS(args Args) *RootNode {
 	// Init crypto backend
 	key := make([]byte, cryptocore.KeyLen)
 	cCore := cryptocore.New(key, cryptocore.BackendGoGCM, contentenc.DefaultIVBits, true, false)
-	cEnc := contentenc.New(cCore, contentenc.DefaultBS, false)
+	cEnc := contentenc.New(cCore, contentenc.DefaultBS, false, args.FileTags)
 	n := nametransform.New(cCore.EMECipher, true, true)
 	rn := NewRootNode(args, cEnc, n)
 	oneSec := time.Second
@@ -0,0 +1,62 @@
+package fusefrontend
+
+import (
+	"syscall"
+	"testing"
+
+	"github.com/hanwen/go-fuse/v2/fuse"
+
+	"github.com/rfjakob/gocryptfs/tests/test_helpers"
+)
+
+// TestZeroLengthReadWrite checks that zero-length reads and writes return
+// zero and do not touch the backing file.
+func TestZeroLengthReadWrite(t *testing.T) {
+	cipherdir := test_helpers.InitFS(t)
+	rn := newTestFS(Args{Cipherdir: cipherdir})
+	_, fh, _, errno := rn.Create(nil, "foo", syscall.O_RDWR, 0600, &fuse.EntryOut{})
+	if errno != 0 {
+		t.Fatal(errno)
+	}
+	f := fh.(*File)
+	defer f.Release(nil)
+
+	backingSize := func() int64 {
+		var st syscall.Stat_t
+		if err := syscall.Fstat(f.intFd(), &st); err != nil {
+			t.Fatal(err)
+		}
+		return st.Size
+	}
+
+	// On an empty file, a zero-length write must not create the header
+	n, errno := f.Write(nil, []byte{}, 0)
+	if n != 0 || errno != 0 {
+		t.Errorf("empty file: n=%d errno=%v", n, errno)
+	}
+	if sz := backingSize(); sz != 0 {
+		t.Errorf("empty file: backing size changed to %d", sz)
+	}
+
+	if _, errno := f.Write(nil, make([]byte, 100), 0); errno != 0 {
+		t.Fatal(errno)
+	}
+	before := backingSize()
+	// Past the end of the file, a zero-length write must not pad a hole
+	for _, off := range []int64{0, 50, 100, 1000000} {
+		n, errno := f.Write(nil, []byte{}, off)
+		if n != 0 || errno != 0 {
+			t.Errorf("off=%d: n=%d errno=%v", off, n, errno)
+		}
+		if sz := backingSize(); sz != before {
+			t.Errorf("off=%d: backing size changed from %d to %d", off, before, sz)
+		}
+		res, errno := f.Read(nil, []byte{}, off)
+		if errno != 0 {
+			t.Errorf("off=%d: Read errno=%v", off, errno)
+		}
+		if res.Size() != 0 {
+			t.Errorf("off=%d: Read returned %d bytes", off, res.Size())
+		}
+	}
+}
@@ -16,6 +16,10 @@ var _ ctlsocksrv.Interface = &RootNode{}
 // EncryptPath implements ctlsock.Backend.
 // This is used for the control socket and for the "-exclude" logic.
 func (rn *RootNode) EncryptPath(plainPath string) (string, error) {
+	plainPath, err := ctlsocksrv.CleanPath(plainPath)
+	if err != nil {
+		return "", err
+	}
 	if rn.args.PlaintextNames || plainPath == "" {
 		return plainPath, nil
 	}
@@ -34,6 +38,10 @@ func (rn *RootNode) EncryptPath(plainPath string) (string, error) {
 
 // DecryptPath implements ctlsock.Backend
 func (rn *RootNode) DecryptPath(cipherPath string) (string, error) {
+	cipherPath, err := ctlsocksrv.CleanPath(cipherPath)
+	if err != nil {
+		return "", err
+	}
 	p, err := rn.decryptPath(cipherPath)
 	return p, err
 }
@@ -25,6 +25,9 @@ type File struct {
 
 // Read - FUSE call
 func (f *File) Read(ctx context.Context, buf []byte, ioff int64) (resultData fuse.ReadResult, errno syscall.Errno) {
+	if ioff < 0 {
+		return nil, syscall.EINVAL
+	}
 	length := uint64(len(buf))
 	off := uint64(ioff)
 	out := bytes.NewBuffer(buf[:0])
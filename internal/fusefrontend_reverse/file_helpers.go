@@ -6,7 +6,7 @@ import (
 	"sync"
 
 	"github.com/rfjakob/gocryptfs/internal/contentenc"
-	"github.com/rfjakob/gocryptfs/internal/pathiv"
+	"github.com/rfjakob/gocryptfs/internal/cryptocore"
 	"github.com/rfjakob/gocryptfs/internal/tlog"
 )
 
@@ -18,10 +18,10 @@ func (rf *File) encryptBlocks(plaintext []byte, firstBlockNo uint64, fileID []by
 	inBuf := bytes.NewBuffer(plaintext)
 	var outBuf bytes.Buffer
 	bs := int(rf.contentEnc.PlainBS())
+	ivGen := cryptocore.NewDeterministicIVGenerator(block0IV, firstBlockNo)
 	for blockNo := firstBlockNo; inBuf.Len() > 0; blockNo++ {
 		inBlock := inBuf.Next(bs)
-		iv := pathiv.BlockIV(block0IV, blockNo)
-		outBlock := rf.contentEnc.EncryptBlockNonce(inBlock, blockNo, fileID, iv)
+		outBlock := rf.contentEnc.EncryptBlockNonce(inBlock, blockNo, fileID, ivGen.Get())
 		outBuf.Write(outBlock)
 	}
 	return outBuf.Bytes()
@@ -79,6 +79,7 @@ func (n *Node) Getattr(ctx context.Context, f fs.FileHandle, out *fuse.AttrOut)
 	rn := n.rootNode()
 	rn.inoMap.TranslateStat(st)
 	out.Attr.FromStat(st)
+	syscallcompat.FillBtime(&out.Attr, st)
 
 	// Translate ciphertext size in `out.Attr.Size` to plaintext size
 	cName := filepath.Base(n.Path())
@@ -130,6 +131,7 @@ func (n *Node) Open(ctx context.Context, flags uint32) (fh fs.FileHandle, fuseFl
 	}
 	var a fuse.Attr
 	a.FromStat(&st)
+	syscallcompat.FillBtime(&a, &st)
 	if !a.IsRegular() {
 		tlog.Warn.Printf("ino%d: newFile: not a regular file", st.Ino)
 		syscall.Close(fd)
@@ -170,6 +172,9 @@ func (n *Node) Open(ctx context.Context, flags uint32) (fh fs.FileHandle, fuseFl
 		block0IV:   derivedIVs.Block0IV,
 		contentEnc: n.rootNode().contentEnc,
 	}
+	if n.rootNode().args.DirectIO {
+		fuseFlags = fuse.FOPEN_DIRECT_IO
+	}
 	return
 }
 
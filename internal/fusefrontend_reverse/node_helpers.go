@@ -15,17 +15,6 @@ import (
 	"github.com/rfjakob/gocryptfs/internal/syscallcompat"
 )
 
-const (
-	// File names are padded to 16-byte multiples, encrypted and
-	// base64-encoded. We can encode at most 176 bytes to stay below the 255
-	// bytes limit:
-	// * base64(176 bytes) = 235 bytes
-	// * base64(192 bytes) = 256 bytes (over 255!)
-	// But the PKCS#7 padding is at least one byte. This means we can only use
-	// 175 bytes for the file name.
-	shortNameMax = 175
-)
-
 // translateSize translates the ciphertext size in `out` into plaintext size.
 func (n *Node) translateSize(dirfd int, cName string, pName string, out *fuse.Attr) {
 	if out.IsRegular() {
@@ -95,6 +84,7 @@ func (n *Node) newChild(ctx context.Context, st *syscall.Stat_t, out *fuse.Entry
 	rn := n.rootNode()
 	rn.inoMap.TranslateStat(st)
 	out.Attr.FromStat(st)
+	syscallcompat.FillBtime(&out.Attr, st)
 	// Create child node
 	id := fs.StableAttr{
 		Mode: uint32(st.Mode),
@@ -193,6 +183,7 @@ func (n *Node) lookupConf(ctx context.Context, out *fuse.EntryOut) (ch *fs.Inode
 	// Get unique inode number
 	rn.inoMap.TranslateStat(&st)
 	out.Attr.FromStat(&st)
+	syscallcompat.FillBtime(&out.Attr, &st)
 	// Create child node
 	id := fs.StableAttr{
 		Mode: uint32(st.Mode),
@@ -67,6 +67,10 @@ func (rn *RootNode) findLongnameParent(fd int, diriv []byte, longname string) (p
 		errno = fs.ToErrno(err)
 		return
 	}
+	// File names are padded to 16-byte multiples, encrypted and encoded.
+	// Names up to ShortNameMax bytes (175 for base64) stay below the 255
+	// bytes limit and cannot be long names.
+	shortNameMax := rn.nameTransform.ShortNameMax()
 	for _, entry := range entries {
 		if len(entry.Name) <= shortNameMax {
 			continue
@@ -74,7 +78,7 @@ func (rn *RootNode) findLongnameParent(fd int, diriv []byte, longname string) (p
 		cFullName = rn.nameTransform.EncryptName(entry.Name, diriv)
 		if len(cFullName) <= unix.NAME_MAX {
 			// Entry should have been skipped by the "continue" above
-			log.Panic("logic error or wrong shortNameMax constant?")
+			log.Panic("logic error or wrong ShortNameMax?")
 		}
 		hName := rn.nameTransform.HashLongName(cFullName)
 		if longname == hName {
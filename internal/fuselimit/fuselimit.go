@@ -0,0 +1,295 @@
+// Package fuselimit caps the number of FUSE requests that are processed at
+// the same time ("-concurrency").
+package fuselimit
+
+import (
+	"sync"
+	"syscall"
+
+	"github.com/hanwen/go-fuse/v2/fuse"
+)
+
+// limitedFS wraps a fuse.RawFileSystem and lets at most cap(sem) requests
+// through at a time. The others wait in the goroutine go-fuse started for
+// them.
+//
+// Not limited are FORGET, which go-fuse may handle in the loop that reads
+// from /dev/fuse and which has no reply, and SETLKW, which can block until
+// another request releases the lock and would then deadlock. The same goes
+// for everything on an open FIFO or device, where opening, reading and
+// writing can block until another process shows up.
+type limitedFS struct {
+	fuse.RawFileSystem
+	sem chan struct{}
+	// special holds the file handles of open files that are not regular
+	// files. Requests on them do not take a slot. Protected by "mu".
+	mu      sync.Mutex
+	special map[uint64]struct{}
+}
+
+// New returns "fs" limited to "n" concurrent requests. n <= 0 means no
+// limit, "fs" is returned unchanged.
+func New(fs fuse.RawFileSystem, n int) fuse.RawFileSystem {
+	if n <= 0 {
+		return fs
+	}
+	return &limitedFS{
+		RawFileSystem: fs,
+		sem:           make(chan struct{}, n),
+		special:       make(map[uint64]struct{}),
+	}
+}
+
+func (l *limitedFS) acquire() {
+	l.sem <- struct{}{}
+}
+
+func (l *limitedFS) release() {
+	<-l.sem
+}
+
+// acquireFh is acquire for requests on the open file "fh". It returns false
+// and takes no slot if "fh" is not a regular file.
+func (l *limitedFS) acquireFh(fh uint64) bool {
+	l.mu.Lock()
+	_, special := l.special[fh]
+	l.mu.Unlock()
+	if special {
+		return false
+	}
+	l.acquire()
+	return true
+}
+
+func (l *limitedFS) Lookup(cancel <-chan struct{}, header *fuse.InHeader, name string, out *fuse.EntryOut) fuse.Status {
+	l.acquire()
+	defer l.release()
+	return l.RawFileSystem.Lookup(cancel, header, name, out)
+}
+
+func (l *limitedFS) GetAttr(cancel <-chan struct{}, input *fuse.GetAttrIn, out *fuse.AttrOut) fuse.Status {
+	l.acquire()
+	defer l.release()
+	return l.RawFileSystem.GetAttr(cancel, input, out)
+}
+
+func (l *limitedFS) SetAttr(cancel <-chan struct{}, input *fuse.SetAttrIn, out *fuse.AttrOut) fuse.Status {
+	l.acquire()
+	defer l.release()
+	return l.RawFileSystem.SetAttr(cancel, input, out)
+}
+
+func (l *limitedFS) Mknod(cancel <-chan struct{}, input *fuse.MknodIn, name string, out *fuse.EntryOut) fuse.Status {
+	l.acquire()
+	defer l.release()
+	return l.RawFileSystem.Mknod(cancel, input, name, out)
+}
+
+func (l *limitedFS) Mkdir(cancel <-chan struct{}, input *fuse.MkdirIn, name string, out *fuse.EntryOut) fuse.Status {
+	l.acquire()
+	defer l.release()
+	return l.RawFileSystem.Mkdir(cancel, input, name, out)
+}
+
+func (l *limitedFS) Unlink(cancel <-chan struct{}, header *fuse.InHeader, name string) fuse.Status {
+	l.acquire()
+	defer l.release()
+	return l.RawFileSystem.Unlink(cancel, header, name)
+}
+
+func (l *limitedFS) Rmdir(cancel <-chan struct{}, header *fuse.InHeader, name string) fuse.Status {
+	l.acquire()
+	defer l.release()
+	return l.RawFileSystem.Rmdir(cancel, header, name)
+}
+
+func (l *limitedFS) Rename(cancel <-chan struct{}, input *fuse.RenameIn, oldName string, newName string) fuse.Status {
+	l.acquire()
+	defer l.release()
+	return l.RawFileSystem.Rename(cancel, input, oldName, newName)
+}
+
+func (l *limitedFS) Link(cancel <-chan struct{}, input *fuse.LinkIn, filename string, out *fuse.EntryOut) fuse.Status {
+	l.acquire()
+	defer l.release()
+	return l.RawFileSystem.Link(cancel, input, filename, out)
+}
+
+func (l *limitedFS) Symlink(cancel <-chan struct{}, header *fuse.InHeader, pointedTo string, linkName string, out *fuse.EntryOut) fuse.Status {
+	l.acquire()
+	defer l.release()
+	return l.RawFileSystem.Symlink(cancel, header, pointedTo, linkName, out)
+}
+
+func (l *limitedFS) Readlink(cancel <-chan struct{}, header *fuse.InHeader) ([]byte, fuse.Status) {
+	l.acquire()
+	defer l.release()
+	return l.RawFileSystem.Readlink(cancel, header)
+}
+
+func (l *limitedFS) Access(cancel <-chan struct{}, input *fuse.AccessIn) fuse.Status {
+	l.acquire()
+	defer l.release()
+	return l.RawFileSystem.Access(cancel, input)
+}
+
+func (l *limitedFS) GetXAttr(cancel <-chan struct{}, header *fuse.InHeader, attr string, dest []byte) (uint32, fuse.Status) {
+	l.acquire()
+	defer l.release()
+	return l.RawFileSystem.GetXAttr(cancel, header, attr, dest)
+}
+
+func (l *limitedFS) ListXAttr(cancel <-chan struct{}, header *fuse.InHeader, dest []byte) (uint32, fuse.Status) {
+	l.acquire()
+	defer l.release()
+	return l.RawFileSystem.ListXAttr(cancel, header, dest)
+}
+
+func (l *limitedFS) SetXAttr(cancel <-chan struct{}, input *fuse.SetXAttrIn, attr string, data []byte) fuse.Status {
+	l.acquire()
+	defer l.release()
+	return l.RawFileSystem.SetXAttr(cancel, input, attr, data)
+}
+
+func (l *limitedFS) RemoveXAttr(cancel <-chan struct{}, header *fuse.InHeader, attr string) fuse.Status {
+	l.acquire()
+	defer l.release()
+	return l.RawFileSystem.RemoveXAttr(cancel, header, attr)
+}
+
+func (l *limitedFS) Create(cancel <-chan struct{}, input *fuse.CreateIn, name string, out *fuse.CreateOut) fuse.Status {
+	l.acquire()
+	defer l.release()
+	return l.RawFileSystem.Create(cancel, input, name, out)
+}
+
+// Open finds out the file type first, which is fast, so that opening a FIFO
+// does not hold a slot while it waits for the other end.
+func (l *limitedFS) Open(cancel <-chan struct{}, input *fuse.OpenIn, out *fuse.OpenOut) fuse.Status {
+	var attr fuse.AttrOut
+	st := l.RawFileSystem.GetAttr(cancel, &fuse.GetAttrIn{InHeader: input.InHeader}, &attr)
+	if !st.Ok() || attr.Mode&syscall.S_IFMT == syscall.S_IFREG {
+		l.acquire()
+		defer l.release()
+		return l.RawFileSystem.Open(cancel, input, out)
+	}
+	st = l.RawFileSystem.Open(cancel, input, out)
+	if st.Ok() {
+		l.mu.Lock()
+		l.special[out.Fh] = struct{}{}
+		l.mu.Unlock()
+	}
+	return st
+}
+
+func (l *limitedFS) Read(cancel <-chan struct{}, input *fuse.ReadIn, buf []byte) (fuse.ReadResult, fuse.Status) {
+	if l.acquireFh(input.Fh) {
+		defer l.release()
+	}
+	return l.RawFileSystem.Read(cancel, input, buf)
+}
+
+func (l *limitedFS) Lseek(cancel <-chan struct{}, in *fuse.LseekIn, out *fuse.LseekOut) fuse.Status {
+	if l.acquireFh(in.Fh) {
+		defer l.release()
+	}
+	return l.RawFileSystem.Lseek(cancel, in, out)
+}
+
+func (l *limitedFS) GetLk(cancel <-chan struct{}, input *fuse.LkIn, out *fuse.LkOut) fuse.Status {
+	if l.acquireFh(input.Fh) {
+		defer l.release()
+	}
+	return l.RawFileSystem.GetLk(cancel, input, out)
+}
+
+func (l *limitedFS) SetLk(cancel <-chan struct{}, input *fuse.LkIn) fuse.Status {
+	if l.acquireFh(input.Fh) {
+		defer l.release()
+	}
+	return l.RawFileSystem.SetLk(cancel, input)
+}
+
+func (l *limitedFS) Release(cancel <-chan struct{}, input *fuse.ReleaseIn) {
+	// Forget "fh" first, a concurrent Open may get the same number
+	l.mu.Lock()
+	_, special := l.special[input.Fh]
+	delete(l.special, input.Fh)
+	l.mu.Unlock()
+	if !special {
+		l.acquire()
+		defer l.release()
+	}
+	l.RawFileSystem.Release(cancel, input)
+}
+
+func (l *limitedFS) Write(cancel <-chan struct{}, input *fuse.WriteIn, data []byte) (uint32, fuse.Status) {
+	if l.acquireFh(input.Fh) {
+		defer l.release()
+	}
+	return l.RawFileSystem.Write(cancel, input, data)
+}
+
+func (l *limitedFS) CopyFileRange(cancel <-chan struct{}, input *fuse.CopyFileRangeIn) (uint32, fuse.Status) {
+	if l.acquireFh(input.FhIn) {
+		defer l.release()
+	}
+	return l.RawFileSystem.CopyFileRange(cancel, input)
+}
+
+func (l *limitedFS) Flush(cancel <-chan struct{}, input *fuse.FlushIn) fuse.Status {
+	if l.acquireFh(input.Fh) {
+		defer l.release()
+	}
+	return l.RawFileSystem.Flush(cancel, input)
+}
+
+func (l *limitedFS) Fsync(cancel <-chan struct{}, input *fuse.FsyncIn) fuse.Status {
+	if l.acquireFh(input.Fh) {
+		defer l.release()
+	}
+	return l.RawFileSystem.Fsync(cancel, input)
+}
+
+func (l *limitedFS) Fallocate(cancel <-chan struct{}, input *fuse.FallocateIn) fuse.Status {
+	if l.acquireFh(input.Fh) {
+		defer l.release()
+	}
+	return l.RawFileSystem.Fallocate(cancel, input)
+}
+
+func (l *limitedFS) OpenDir(cancel <-chan struct{}, input *fuse.OpenIn, out *fuse.OpenOut) fuse.Status {
+	l.acquire()
+	defer l.release()
+	return l.RawFileSystem.OpenDir(cancel, input, out)
+}
+
+func (l *limitedFS) ReadDir(cancel <-chan struct{}, input *fuse.ReadIn, out *fuse.DirEntryList) fuse.Status {
+	l.acquire()
+	defer l.release()
+	return l.RawFileSystem.ReadDir(cancel, input, out)
+}
+
+func (l *limitedFS) ReadDirPlus(cancel <-chan struct{}, input *fuse.ReadIn, out *fuse.DirEntryList) fuse.Status {
+	l.acquire()
+	defer l.release()
+	return l.RawFileSystem.ReadDirPlus(cancel, input, out)
+}
+
+func (l *limitedFS) ReleaseDir(input *fuse.ReleaseIn) {
+	l.acquire()
+	defer l.release()
+	l.RawFileSystem.ReleaseDir(input)
+}
+
+func (l *limitedFS) FsyncDir(cancel <-chan struct{}, input *fuse.FsyncIn) fuse.Status {
+	l.acquire()
+	defer l.release()
+	return l.RawFileSystem.FsyncDir(cancel, input)
+}
+
+func (l *limitedFS) StatFs(cancel <-chan struct{}, input *fuse.InHeader, out *fuse.StatfsOut) fuse.Status {
+	l.acquire()
+	defer l.release()
+	return l.RawFileSystem.StatFs(cancel, input, out)
+}
@@ -0,0 +1,164 @@
+package fuselimit
+
+import (
+	"sync"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/hanwen/go-fuse/v2/fuse"
+)
+
+// overlapFS records how many requests run at the same time
+type overlapFS struct {
+	fuse.RawFileSystem
+	mu      sync.Mutex
+	running int
+	max     int
+}
+
+func (o *overlapFS) op() {
+	o.mu.Lock()
+	o.running++
+	if o.running > o.max {
+		o.max = o.running
+	}
+	o.mu.Unlock()
+	time.Sleep(10 * time.Millisecond)
+	o.mu.Lock()
+	o.running--
+	o.mu.Unlock()
+}
+
+func (o *overlapFS) GetAttr(cancel <-chan struct{}, input *fuse.GetAttrIn, out *fuse.AttrOut) fuse.Status {
+	o.op()
+	return fuse.OK
+}
+
+func (o *overlapFS) Read(cancel <-chan struct{}, input *fuse.ReadIn, buf []byte) (fuse.ReadResult, fuse.Status) {
+	o.op()
+	return fuse.ReadResultData(nil), fuse.OK
+}
+
+func (o *overlapFS) Write(cancel <-chan struct{}, input *fuse.WriteIn, data []byte) (uint32, fuse.Status) {
+	o.op()
+	return uint32(len(data)), fuse.OK
+}
+
+// maxOverlap sends 24 requests of different types from parallel goroutines
+// through New(..., n) and returns the most that ran at the same time.
+func maxOverlap(n int) int {
+	o := &overlapFS{RawFileSystem: fuse.NewDefaultRawFileSystem()}
+	fs := New(o, n)
+	var wg sync.WaitGroup
+	for i := 0; i < 8; i++ {
+		wg.Add(3)
+		go func() {
+			defer wg.Done()
+			fs.GetAttr(nil, &fuse.GetAttrIn{}, &fuse.AttrOut{})
+		}()
+		go func() {
+			defer wg.Done()
+			fs.Read(nil, &fuse.ReadIn{}, nil)
+		}()
+		go func() {
+			defer wg.Done()
+			fs.Write(nil, &fuse.WriteIn{}, []byte("x"))
+		}()
+	}
+	wg.Wait()
+	return o.max
+}
+
+func TestSerialized(t *testing.T) {
+	if m := maxOverlap(1); m != 1 {
+		t.Errorf("concurrency 1: %d requests overlapped", m)
+	}
+}
+
+func TestLimit(t *testing.T) {
+	if m := maxOverlap(4); m > 4 || m < 2 {
+		t.Errorf("concurrency 4: %d requests overlapped", m)
+	}
+}
+
+// TestUnlimited checks that n=0 keeps the current behavior
+func TestUnlimited(t *testing.T) {
+	o := &overlapFS{}
+	if New(o, 0) != fuse.RawFileSystem(o) {
+		t.Error("n=0 should return the file system unchanged")
+	}
+	if m := maxOverlap(0); m < 2 {
+		t.Errorf("no limit: only %d requests overlapped", m)
+	}
+}
+
+// fifoFS has a FIFO with node ID 2 and a regular file with node ID 1. Reads
+// from the FIFO block until "unblock" is closed.
+type fifoFS struct {
+	fuse.RawFileSystem
+	unblock chan struct{}
+}
+
+func (f *fifoFS) GetAttr(cancel <-chan struct{}, input *fuse.GetAttrIn, out *fuse.AttrOut) fuse.Status {
+	out.Mode = syscall.S_IFREG | 0600
+	if input.NodeId == 2 {
+		out.Mode = syscall.S_IFIFO | 0600
+	}
+	return fuse.OK
+}
+
+func (f *fifoFS) Open(cancel <-chan struct{}, input *fuse.OpenIn, out *fuse.OpenOut) fuse.Status {
+	out.Fh = input.NodeId * 10
+	return fuse.OK
+}
+
+func (f *fifoFS) Read(cancel <-chan struct{}, input *fuse.ReadIn, buf []byte) (fuse.ReadResult, fuse.Status) {
+	if input.Fh == 20 {
+		<-f.unblock
+	}
+	return fuse.ReadResultData(nil), fuse.OK
+}
+
+// TestFIFO checks that blocked reads from a FIFO do not take the slots that
+// regular files need.
+func TestFIFO(t *testing.T) {
+	f := &fifoFS{RawFileSystem: fuse.NewDefaultRawFileSystem(), unblock: make(chan struct{})}
+	fs := New(f, 1)
+	open := func(nodeID uint64) uint64 {
+		in := &fuse.OpenIn{}
+		in.NodeId = nodeID
+		var out fuse.OpenOut
+		if st := fs.Open(nil, in, &out); !st.Ok() {
+			t.Fatal(st)
+		}
+		return out.Fh
+	}
+	fifo := open(2)
+	reg := open(1)
+	var wg sync.WaitGroup
+	for i := 0; i < 3; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			fs.Read(nil, &fuse.ReadIn{Fh: fifo}, nil)
+		}()
+	}
+	done := make(chan struct{})
+	go func() {
+		fs.Read(nil, &fuse.ReadIn{Fh: reg}, nil)
+		fs.Release(nil, &fuse.ReleaseIn{Fh: reg})
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("regular file blocked by FIFO readers")
+	}
+	close(f.unblock)
+	wg.Wait()
+	fs.Release(nil, &fuse.ReleaseIn{Fh: fifo})
+	if len(fs.(*limitedFS).special) != 0 {
+		t.Error("FIFO handle was not forgotten on Release")
+	}
+}
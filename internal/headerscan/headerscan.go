@@ -0,0 +1,183 @@
+// Package headerscan checks the per-file headers of all files in a
+// ciphertext directory tree.
+//
+// Only the first contentenc.HeaderLen bytes of each file are read, nothing is
+// decrypted, and no password is needed. This makes it much faster than
+// "-fsck", but it cannot find corruption beyond the header.
+package headerscan
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"syscall"
+
+	"github.com/rfjakob/gocryptfs/internal/configfile"
+	"github.com/rfjakob/gocryptfs/internal/contentenc"
+	"github.com/rfjakob/gocryptfs/internal/journal"
+	"github.com/rfjakob/gocryptfs/internal/nametransform"
+	"github.com/rfjakob/gocryptfs/internal/syscallcompat"
+)
+
+// Status is the result of checking one file
+type Status int
+
+const (
+	// OK means the file has a valid header
+	OK Status = iota
+	// Empty means the file has zero length. Empty files have no header by
+	// design.
+	Empty
+	// Missing means the file does not start with a gocryptfs header: it is
+	// shorter than a header, or the version field does not match. This is
+	// what a plaintext file that was copied into CIPHERDIR looks like.
+	Missing
+	// Bad means the file starts like a gocryptfs header, but the header is
+	// invalid: it is all-zero or has an all-zero file ID.
+	Bad
+	// Unreadable means the file or directory could not be read
+	Unreadable
+)
+
+func (s Status) String() string {
+	switch s {
+	case OK:
+		return "ok"
+	case Empty:
+		return "empty"
+	case Missing:
+		return "no header"
+	case Bad:
+		return "BAD HEADER"
+	case Unreadable:
+		return "unreadable"
+	}
+	return fmt.Sprintf("Status(%d)", int(s))
+}
+
+// Entry is the result for one file
+type Entry struct {
+	// Path relative to the scanned directory
+	Path   string
+	Status Status
+	// Version and ID are the header fields. Only set if Status is OK.
+	Version uint16
+	ID      []byte
+	// Err says what is wrong if Status is not OK or Empty
+	Err error
+}
+
+// Result is the result of Scan
+type Result struct {
+	// Entries has one entry per file, in lexical order
+	Entries []Entry
+}
+
+// Count returns the number of entries with status "s"
+func (r *Result) Count(s Status) int {
+	var n int
+	for _, e := range r.Entries {
+		if e.Status == s {
+			n++
+		}
+	}
+	return n
+}
+
+// Scan checks the headers of all regular files below "cipherdir". The files
+// gocryptfs uses for metadata (gocryptfs.conf, gocryptfs.diriv, long name
+// ".name" and ".journal" files) are skipped, also with plaintext names.
+//
+// An error is only returned if "cipherdir" itself cannot be read.
+func Scan(cipherdir string) (*Result, error) {
+	dirfd, err := syscall.Open(cipherdir, syscall.O_RDONLY|syscall.O_DIRECTORY, 0)
+	if err != nil {
+		return nil, &os.PathError{Op: "open", Path: cipherdir, Err: err}
+	}
+	defer syscall.Close(dirfd)
+	var res Result
+	err = syscallcompat.Walkat(dirfd, func(dirfd int, name string, rel string, mode uint32, err error) error {
+		if err != nil {
+			res.Entries = append(res.Entries, Entry{Path: rel, Status: Unreadable, Err: err})
+			return nil
+		}
+		if mode != syscall.S_IFREG || isMetadata(rel) {
+			return nil
+		}
+		res.Entries = append(res.Entries, checkFile(dirfd, name, rel))
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return &res, nil
+}
+
+// isMetadata returns true if the file at "rel" is not file content
+func isMetadata(rel string) bool {
+	name := filepath.Base(rel)
+	if rel == configfile.ConfDefaultName || rel == configfile.ConfReverseName {
+		return true
+	}
+	// Includes the "gocryptfs.diriv.rmdir.XYZ" files left over by Rmdir
+	if strings.HasPrefix(name, nametransform.DirIVFilename) || strings.HasSuffix(name, journal.Suffix) {
+		return true
+	}
+	return nametransform.NameType(name) == nametransform.LongNameFilename
+}
+
+// checkFile reads and checks the header of the file "name" in "dirfd"
+func checkFile(dirfd int, name string, rel string) Entry {
+	e := Entry{Path: rel}
+	fd, err := syscallcompat.Openat(dirfd, name, syscall.O_RDONLY|syscall.O_NOFOLLOW, 0)
+	if err != nil {
+		e.Status = Unreadable
+		e.Err = err
+		return e
+	}
+	f := os.NewFile(uintptr(fd), rel)
+	defer f.Close()
+	fi, err := f.Stat()
+	if err != nil {
+		e.Status = Unreadable
+		e.Err = err
+		return e
+	}
+	if fi.Size() == 0 {
+		e.Status = Empty
+		return e
+	}
+	buf := make([]byte, contentenc.HeaderLen)
+	n, err := io.ReadFull(f, buf)
+	if err == io.ErrUnexpectedEOF {
+		e.Status = Missing
+		e.Err = fmt.Errorf("file is shorter than a header: %d bytes", n)
+		return e
+	} else if err != nil {
+		e.Status = Unreadable
+		e.Err = err
+		return e
+	}
+	h, err := contentenc.ParseHeader(buf)
+	if err == nil {
+		e.Status = OK
+		e.Version = h.Version
+		e.ID = h.ID
+		return e
+	}
+	e.Err = err
+	if binary.BigEndian.Uint16(buf) == contentenc.CurrentVersion {
+		e.Status = Bad
+	} else if bytes.Equal(buf, make([]byte, contentenc.HeaderLen)) {
+		// Seen after crashes, when the file size was updated but the data
+		// was not written
+		e.Status = Bad
+	} else {
+		e.Status = Missing
+	}
+	return e
+}
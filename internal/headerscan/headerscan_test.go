@@ -0,0 +1,73 @@
+package headerscan
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/rfjakob/gocryptfs/internal/contentenc"
+)
+
+// TestScan checks a directory with valid, headerless and corrupt files, and
+// metadata files that must be skipped.
+func TestScan(t *testing.T) {
+	dir, err := ioutil.TempDir("", "headerscan")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	valid := contentenc.RandomHeader()
+	badID := append([]byte{0, contentenc.CurrentVersion}, make([]byte, 16)...)
+	files := map[string][]byte{
+		"valid":                           append(valid.Pack(), []byte("ciphertext")...),
+		"headerless":                      []byte("some plaintext that was copied in by mistake"),
+		"short":                           []byte("x"),
+		"empty":                           nil,
+		"zeros":                           make([]byte, 100),
+		"badid":                           badID,
+		"gocryptfs.conf":                  []byte("{}"),
+		"sub/gocryptfs.diriv":             make([]byte, 16),
+		"sub/x.journal":                   []byte("journal"),
+		"sub/gocryptfs.longname.abc.name": []byte("name"),
+	}
+	os.Mkdir(filepath.Join(dir, "sub"), 0700)
+	for name, content := range files {
+		if err = ioutil.WriteFile(filepath.Join(dir, name), content, 0600); err != nil {
+			t.Fatal(err)
+		}
+	}
+	res, err := Scan(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := map[string]Status{
+		"valid":      OK,
+		"headerless": Missing,
+		"short":      Missing,
+		"empty":      Empty,
+		"zeros":      Bad,
+		"badid":      Bad,
+	}
+	if len(res.Entries) != len(want) {
+		t.Errorf("want %d entries, have %d: %v", len(want), len(res.Entries), res.Entries)
+	}
+	for _, e := range res.Entries {
+		if e.Status != want[e.Path] {
+			t.Errorf("%s: want %v, have %v (%v)", e.Path, want[e.Path], e.Status, e.Err)
+		}
+		if e.Path == "valid" && (e.Version != contentenc.CurrentVersion || !bytes.Equal(e.ID, valid.ID)) {
+			t.Errorf("valid: wrong header fields: version=%d id=%x", e.Version, e.ID)
+		}
+		if (e.Status == OK || e.Status == Empty) != (e.Err == nil) {
+			t.Errorf("%s: status %v with error %v", e.Path, e.Status, e.Err)
+		}
+	}
+	if res.Count(Missing) != 2 || res.Count(Bad) != 2 {
+		t.Errorf("wrong counts: missing=%d bad=%d", res.Count(Missing), res.Count(Bad))
+	}
+	if _, err = Scan(filepath.Join(dir, "nonexistent")); err == nil {
+		t.Error("scanning a nonexistent directory should fail")
+	}
+}
@@ -0,0 +1,284 @@
+// Package journal implements the block journal used by "-journal".
+//
+// For each file that is written to, a journal of the ciphertext blocks
+// written is kept in a side file next to the ciphertext file (cName + Suffix).
+// After a crash, Check uses the journal to find out how many blocks at the
+// start of the file are known to be good, so that a large write can be resumed
+// from there.
+//
+// The journal is append-only. It starts with a header that identifies the
+// file (by its file ID) and is followed by one record per block write:
+//
+//	header: magic[4] plainBS[4] cipherBS[4] fileID[16]
+//	record: blockNo[8] length[4] crc32c[4]
+//
+// The checksum covers blockNo, length and the ciphertext block. The data is
+// not fsync'ed before the journal record is written. This is not necessary, as
+// Check verifies each record against the ciphertext on disk, so a record for
+// a block that has not made it to disk simply ends the valid prefix.
+package journal
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"io/ioutil"
+	"os"
+	"syscall"
+
+	"github.com/rfjakob/gocryptfs/internal/contentenc"
+	"github.com/rfjakob/gocryptfs/internal/syscallcompat"
+)
+
+// Suffix is appended to the ciphertext file name to get the journal name.
+// Encrypted names never contain a dot, so this cannot collide with a file.
+const Suffix = ".journal"
+
+const (
+	headerLen = 4 + 4 + 4 + 16
+	recordLen = 8 + 4 + 4
+)
+
+var magic = []byte("GCJ\x01")
+
+var crcTable = crc32.MakeTable(crc32.Castagnoli)
+
+// ErrStale is returned by Check if the journal does not belong to the current
+// contents of the file. This happens when the file has been truncated to zero
+// and rewritten without "-journal".
+var ErrStale = errors.New("journal does not match the file")
+
+// Writer appends records to a journal file. All methods can be called on a nil
+// Writer and do nothing in that case.
+type Writer struct {
+	fd       *os.File
+	plainBS  uint64
+	cipherBS uint64
+	// fileID is the file ID that the journal header is known to match
+	fileID []byte
+	// created is true if Open created the journal file
+	created bool
+}
+
+// Open opens or creates the journal for "cName" in the directory "dirfd".
+func Open(dirfd int, cName string, plainBS uint64, cipherBS uint64) (*Writer, error) {
+	jName := cName + Suffix
+	created := false
+	fd, err := syscallcompat.Openat(dirfd, jName, syscall.O_RDWR|syscall.O_APPEND|syscall.O_NOFOLLOW, 0)
+	if err == syscall.ENOENT {
+		fd, err = syscallcompat.Openat(dirfd, jName, syscall.O_RDWR|syscall.O_APPEND|syscall.O_CREAT|syscall.O_EXCL, 0600)
+		created = true
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &Writer{
+		fd:       os.NewFile(uintptr(fd), jName),
+		plainBS:  plainBS,
+		cipherBS: cipherBS,
+		created:  created,
+	}, nil
+}
+
+// Created returns true if the journal file did not exist before Open.
+func (w *Writer) Created() bool {
+	return w != nil && w.created
+}
+
+// Delete deletes the journal for "cName" in the directory "dirfd", if there
+// is one.
+func Delete(dirfd int, cName string) error {
+	err := syscallcompat.Unlinkat(dirfd, cName+Suffix, 0)
+	if err == syscall.ENOENT {
+		return nil
+	}
+	return err
+}
+
+// Start makes sure that the journal belongs to the file with the ID "fileID",
+// and resets it if not. Call it before the first Append.
+func (w *Writer) Start(fileID []byte) error {
+	if w == nil || bytes.Equal(w.fileID, fileID) {
+		return nil
+	}
+	buf := make([]byte, headerLen)
+	_, err := w.fd.ReadAt(buf, 0)
+	if err == nil && bytes.Equal(buf, w.header(fileID)) {
+		w.fileID = fileID
+		return nil
+	}
+	return w.Reset(fileID)
+}
+
+// Reset discards all records and writes a new header for "fileID". Call it
+// when the file has been given a new header.
+func (w *Writer) Reset(fileID []byte) error {
+	if w == nil {
+		return nil
+	}
+	w.fileID = nil
+	if err := w.fd.Truncate(0); err != nil {
+		return err
+	}
+	// O_APPEND: writes to the (now empty) end
+	if _, err := w.fd.Write(w.header(fileID)); err != nil {
+		return err
+	}
+	w.fileID = fileID
+	return nil
+}
+
+// Append records that "ciphertext", which consists of one or more ciphertext
+// blocks starting at block number "firstBlockNo", has been written.
+func (w *Writer) Append(firstBlockNo uint64, ciphertext []byte) error {
+	if w == nil {
+		return nil
+	}
+	if w.fileID == nil {
+		return fmt.Errorf("journal: Append before Start")
+	}
+	nBlocks := (uint64(len(ciphertext)) + w.cipherBS - 1) / w.cipherBS
+	buf := make([]byte, 0, nBlocks*recordLen)
+	for i := uint64(0); i < nBlocks; i++ {
+		end := (i + 1) * w.cipherBS
+		if end > uint64(len(ciphertext)) {
+			end = uint64(len(ciphertext))
+		}
+		buf = appendRecord(buf, firstBlockNo+i, ciphertext[i*w.cipherBS:end])
+	}
+	_, err := w.fd.Write(buf)
+	return err
+}
+
+// Close closes the journal file.
+func (w *Writer) Close() error {
+	if w == nil {
+		return nil
+	}
+	return w.fd.Close()
+}
+
+func (w *Writer) header(fileID []byte) []byte {
+	buf := make([]byte, 0, headerLen)
+	buf = append(buf, magic...)
+	buf = appendUint32(buf, uint32(w.plainBS))
+	buf = appendUint32(buf, uint32(w.cipherBS))
+	return append(buf, fileID...)
+}
+
+func appendRecord(buf []byte, blockNo uint64, block []byte) []byte {
+	var b [8]byte
+	binary.BigEndian.PutUint64(b[:], blockNo)
+	buf = append(buf, b[:]...)
+	buf = appendUint32(buf, uint32(len(block)))
+	return appendUint32(buf, blockCRC(blockNo, block))
+}
+
+// blockCRC computes the record checksum over blockNo, the block length and
+// the block itself.
+func blockCRC(blockNo uint64, block []byte) uint32 {
+	var b [12]byte
+	binary.BigEndian.PutUint64(b[:], blockNo)
+	binary.BigEndian.PutUint32(b[8:], uint32(len(block)))
+	return crc32.Update(crc32.Checksum(b[:], crcTable), crcTable, block)
+}
+
+func appendUint32(buf []byte, v uint32) []byte {
+	var b [4]byte
+	binary.BigEndian.PutUint32(b[:], v)
+	return append(buf, b[:]...)
+}
+
+type record struct {
+	length uint32
+	crc    uint32
+}
+
+// Result is what Check found out about a file.
+type Result struct {
+	// Blocks is the number of blocks at the start of the file that have been
+	// journaled and are intact on disk.
+	Blocks uint64
+	// PlainSize is the plaintext size of these blocks. A resumed write
+	// should continue at this offset.
+	PlainSize uint64
+}
+
+// Check reads the journal from "j" and verifies the records against the
+// ciphertext file "ciphertext". It returns the longest prefix of the file
+// that is covered by valid records. A truncated last record, as left by a
+// crash, is ignored.
+//
+// Check needs no key, it only looks at the ciphertext.
+func Check(j io.Reader, ciphertext io.ReaderAt) (res Result, err error) {
+	data, err := ioutil.ReadAll(j)
+	if err != nil {
+		return res, err
+	}
+	if len(data) < headerLen || !bytes.Equal(data[:len(magic)], magic) {
+		return res, fmt.Errorf("journal: invalid header")
+	}
+	plainBS := uint64(binary.BigEndian.Uint32(data[4:]))
+	cipherBS := uint64(binary.BigEndian.Uint32(data[8:]))
+	fileID := data[12:headerLen]
+	if plainBS == 0 || cipherBS <= plainBS {
+		return res, fmt.Errorf("journal: invalid block sizes %d/%d", plainBS, cipherBS)
+	}
+	hdrBuf := make([]byte, contentenc.HeaderLen)
+	if _, err = ciphertext.ReadAt(hdrBuf, 0); err != nil {
+		return res, ErrStale
+	}
+	h, err := contentenc.ParseHeader(hdrBuf)
+	if err != nil || !bytes.Equal(h.ID, fileID) {
+		return res, ErrStale
+	}
+	// Later records for the same block replace earlier ones
+	records := make(map[uint64]record)
+	for r := data[headerLen:]; len(r) >= recordLen; r = r[recordLen:] {
+		blockNo := binary.BigEndian.Uint64(r)
+		records[blockNo] = record{
+			length: binary.BigEndian.Uint32(r[8:]),
+			crc:    binary.BigEndian.Uint32(r[12:]),
+		}
+	}
+	block := make([]byte, cipherBS)
+	for {
+		rec, ok := records[res.Blocks]
+		if !ok || uint64(rec.length) > cipherBS || uint64(rec.length) <= cipherBS-plainBS {
+			break
+		}
+		off := int64(contentenc.HeaderLen + res.Blocks*cipherBS)
+		n, _ := ciphertext.ReadAt(block[:rec.length], off)
+		if n != int(rec.length) {
+			break
+		}
+		if blockCRC(res.Blocks, block[:n]) != rec.crc {
+			break
+		}
+		res.Blocks++
+		res.PlainSize += uint64(rec.length) - (cipherBS - plainBS)
+		// A partial block can only be the last one
+		if uint64(rec.length) < cipherBS {
+			break
+		}
+	}
+	return res, nil
+}
+
+// CheckFile runs Check on the ciphertext file at "path" and its journal.
+func CheckFile(path string) (Result, error) {
+	c, err := os.Open(path)
+	if err != nil {
+		return Result{}, err
+	}
+	defer c.Close()
+	j, err := os.Open(path + Suffix)
+	if err != nil {
+		return Result{}, err
+	}
+	defer j.Close()
+	return Check(j, c)
+}
@@ -0,0 +1,192 @@
+// Package keyagent implements an agent that holds unlocked master keys and
+// hands them out over a Unix socket, similar to ssh-agent. It is started by
+// passing "-keyagent_serve" on the command line, and mounts get their key from
+// it when "-keyagent" is passed.
+//
+// The protocol is one JSON request and one JSON response per connection:
+//
+//	-> {"GetKey":"<fingerprint>"}
+//	<- {"Key":"<base64 master key>","ErrText":""}
+//
+// The fingerprint identifies the filesystem, see Fingerprint. There is no
+// authentication beyond the permissions of the socket file, which is only
+// accessible by the user that started the agent.
+package keyagent
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/rfjakob/gocryptfs/internal/configfile"
+	"github.com/rfjakob/gocryptfs/internal/exitcodes"
+	"github.com/rfjakob/gocryptfs/internal/tlog"
+)
+
+// Request is sent by a client (encoded as JSON)
+type Request struct {
+	// GetKey is the fingerprint of the filesystem whose master key is
+	// requested
+	GetKey string
+}
+
+// Response is sent by the agent in response to a Request (encoded as JSON)
+type Response struct {
+	// Key is the master key. Empty on error.
+	Key []byte `json:",omitempty"`
+	// ErrText is the error message. Empty on success.
+	ErrText string `json:",omitempty"`
+}
+
+// maxRequestSize is the largest request the agent reads. A fingerprint is 64
+// bytes, so this is plenty.
+const maxRequestSize = 1000
+
+// timeout limits how long a connection may take, so that a stuck client
+// cannot tie up the agent and a stuck agent cannot hang the mount.
+const timeout = 10 * time.Second
+
+// Fingerprint returns the string that identifies the filesystem of "cf" in
+// requests. It is the SHA256 of the encrypted master key, which is random
+// per filesystem, and changes when the password is changed.
+func Fingerprint(cf *configfile.ConfFile) string {
+	h := sha256.Sum256(cf.EncryptedKey)
+	return hex.EncodeToString(h[:])
+}
+
+// Agent holds master keys and serves them to clients
+type Agent struct {
+	mu sync.Mutex
+	// keys maps fingerprints to master keys
+	keys map[string][]byte
+}
+
+// New returns an Agent without any keys
+func New() *Agent {
+	return &Agent{keys: make(map[string][]byte)}
+}
+
+// Add stores a copy of "key" under "fingerprint"
+func (a *Agent) Add(fingerprint string, key []byte) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	a.keys[fingerprint] = append([]byte(nil), key...)
+}
+
+// Wipe zeroes and forgets all keys
+func (a *Agent) Wipe() {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	for fp, key := range a.keys {
+		for i := range key {
+			key[i] = 0
+		}
+		delete(a.keys, fp)
+	}
+}
+
+// Listen creates the socket "path", accessible only by the current user
+func Listen(path string) (net.Listener, error) {
+	// Set the umask so that the socket file is never accessible by others,
+	// not even between creating and chmod'ing it.
+	oldMask := syscall.Umask(0077)
+	defer syscall.Umask(oldMask)
+	return net.Listen("unix", path)
+}
+
+// Serve answers requests on "sock" until it is closed
+func (a *Agent) Serve(sock net.Listener) {
+	for {
+		conn, err := sock.Accept()
+		if err != nil {
+			// Happens when the socket is closed on exit, see ctlsocksrv
+			tlog.Info.Printf("keyagent: Accept error: %v", err)
+			return
+		}
+		go a.handleConnection(conn)
+	}
+}
+
+func (a *Agent) handleConnection(conn net.Conn) {
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(timeout))
+	var req Request
+	var resp Response
+	err := json.NewDecoder(io.LimitReader(conn, maxRequestSize)).Decode(&req)
+	if err != nil {
+		resp.ErrText = fmt.Sprintf("bad request: %v", err)
+	} else {
+		a.mu.Lock()
+		key := a.keys[req.GetKey]
+		if key == nil {
+			resp.ErrText = fmt.Sprintf("no key for filesystem %q", req.GetKey)
+		} else {
+			resp.Key = append([]byte(nil), key...)
+		}
+		a.mu.Unlock()
+	}
+	if err = json.NewEncoder(conn).Encode(&resp); err != nil {
+		tlog.Warn.Printf("keyagent: sending response: %v", err)
+	}
+	for i := range resp.Key {
+		resp.Key[i] = 0
+	}
+}
+
+// Provider is a configfile.KeyProvider that gets the master key from an
+// agent instead of asking for the password
+type Provider struct {
+	// Socket is the path of the agent socket
+	Socket string
+	Conf   *configfile.ConfFile
+}
+
+var _ configfile.KeyProvider = &Provider{} // Verify that interface is implemented.
+
+// Unwrap requests the master key from the agent
+func (p *Provider) Unwrap(ctx context.Context) ([]byte, error) {
+	key, err := GetKey(ctx, p.Socket, Fingerprint(p.Conf))
+	if err != nil {
+		return nil, exitcodes.NewErr(fmt.Sprintf("keyagent: %v", err), exitcodes.KeyAgent)
+	}
+	return key, nil
+}
+
+// Wrap fails. The agent only hands out keys of existing filesystems.
+func (p *Provider) Wrap(key []byte) error {
+	return exitcodes.NewErr("keyagent: cannot store a new master key in the agent", exitcodes.KeyAgent)
+}
+
+// GetKey requests the master key of the filesystem "fingerprint" from the
+// agent listening on "socket"
+func GetKey(ctx context.Context, socket string, fingerprint string) ([]byte, error) {
+	var d net.Dialer
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+	conn, err := d.DialContext(ctx, "unix", socket)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+	if deadline, ok := ctx.Deadline(); ok {
+		conn.SetDeadline(deadline)
+	}
+	if err = json.NewEncoder(conn).Encode(&Request{GetKey: fingerprint}); err != nil {
+		return nil, err
+	}
+	var resp Response
+	if err = json.NewDecoder(conn).Decode(&resp); err != nil {
+		return nil, err
+	}
+	if resp.ErrText != "" {
+		return nil, fmt.Errorf("agent: %s", resp.ErrText)
+	}
+	return resp.Key, nil
+}
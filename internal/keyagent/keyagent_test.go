@@ -0,0 +1,52 @@
+package keyagent
+
+import (
+	"bytes"
+	"context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// TestGetKey serves a key and checks that only the right fingerprint gets
+// it, and that the socket is only accessible by the owner.
+func TestGetKey(t *testing.T) {
+	dir, err := ioutil.TempDir("", "TestGetKey.")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	socket := filepath.Join(dir, "sock")
+	sock, err := Listen(socket)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer sock.Close()
+	fi, err := os.Stat(socket)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if perm := fi.Mode().Perm(); perm&0077 != 0 {
+		t.Errorf("socket is accessible by others: %o", perm)
+	}
+
+	a := New()
+	key := bytes.Repeat([]byte{0xaa}, 32)
+	a.Add("fp1", key)
+	go a.Serve(sock)
+	have, err := GetKey(context.Background(), socket, "fp1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(have, key) {
+		t.Errorf("wrong key: %x", have)
+	}
+	if _, err = GetKey(context.Background(), socket, "fp2"); err == nil {
+		t.Error("unknown fingerprint got a key")
+	}
+	a.Wipe()
+	if _, err = GetKey(context.Background(), socket, "fp1"); err == nil {
+		t.Error("got a key after Wipe")
+	}
+}
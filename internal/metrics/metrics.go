@@ -0,0 +1,143 @@
+// Package metrics counts FUSE operations and their latencies ("-metrics"),
+// and serves them over HTTP in the Prometheus text exposition format, so
+// that a Prometheus server can scrape the mount directly.
+//
+// The metrics contain operation names and counts only, never paths or
+// contents.
+package metrics
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"sort"
+	"strconv"
+	"sync"
+	"syscall"
+	"time"
+)
+
+// LatencyBuckets are the upper bounds, in seconds, of the latency histogram
+// buckets. The "+Inf" bucket is implicit.
+var LatencyBuckets = []float64{0.0001, 0.0005, 0.001, 0.005, 0.01, 0.05, 0.1, 0.5, 1, 5}
+
+// ContentType is the Content-Type of the Prometheus text format
+const ContentType = "text/plain; version=0.0.4; charset=utf-8"
+
+// opStats are the counters of one operation
+type opStats struct {
+	count  uint64
+	errors uint64
+	// buckets[i] counts the operations that took at most LatencyBuckets[i],
+	// not cumulative. Slower ones are only in count.
+	buckets []uint64
+	// sum is the total latency in seconds
+	sum float64
+}
+
+// Registry holds the counters. All methods can be called on a nil Registry
+// and do nothing in that case.
+type Registry struct {
+	mu  sync.Mutex
+	ops map[string]*opStats
+}
+
+// New returns a Registry without any counts
+func New() *Registry {
+	return &Registry{ops: make(map[string]*opStats)}
+}
+
+// Observe counts an operation "op" that started at "start" and has just
+// finished with "*errno". Meant to be deferred at the start of the operation,
+// so that it sees the final errno:
+//
+//	defer rn.Metrics.Observe(optrace.OpMkdir, time.Now(), &errno)
+func (r *Registry) Observe(op string, start time.Time, errno *syscall.Errno) {
+	if r == nil {
+		return
+	}
+	d := time.Since(start).Seconds()
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	s := r.ops[op]
+	if s == nil {
+		s = &opStats{buckets: make([]uint64, len(LatencyBuckets))}
+		r.ops[op] = s
+	}
+	s.count++
+	if errno != nil && *errno != 0 {
+		s.errors++
+	}
+	s.sum += d
+	for i, le := range LatencyBuckets {
+		if d <= le {
+			s.buckets[i]++
+			break
+		}
+	}
+}
+
+// WritePrometheus writes all counters to "w" in the Prometheus text format.
+// Operations are sorted by name, so the output is stable.
+func (r *Registry) WritePrometheus(w io.Writer) error {
+	if r == nil {
+		return nil
+	}
+	r.mu.Lock()
+	names := make([]string, 0, len(r.ops))
+	ops := make(map[string]opStats, len(r.ops))
+	for name, s := range r.ops {
+		names = append(names, name)
+		c := *s
+		c.buckets = append([]uint64(nil), s.buckets...)
+		ops[name] = c
+	}
+	r.mu.Unlock()
+	sort.Strings(names)
+
+	bw := bufio.NewWriter(w)
+	fmt.Fprintf(bw, "# HELP gocryptfs_ops_total Number of FUSE operations.\n")
+	fmt.Fprintf(bw, "# TYPE gocryptfs_ops_total counter\n")
+	for _, name := range names {
+		fmt.Fprintf(bw, "gocryptfs_ops_total{op=%q} %d\n", name, ops[name].count)
+	}
+	fmt.Fprintf(bw, "# HELP gocryptfs_op_errors_total Number of FUSE operations that returned an error.\n")
+	fmt.Fprintf(bw, "# TYPE gocryptfs_op_errors_total counter\n")
+	for _, name := range names {
+		fmt.Fprintf(bw, "gocryptfs_op_errors_total{op=%q} %d\n", name, ops[name].errors)
+	}
+	fmt.Fprintf(bw, "# HELP gocryptfs_op_duration_seconds Latency of FUSE operations.\n")
+	fmt.Fprintf(bw, "# TYPE gocryptfs_op_duration_seconds histogram\n")
+	for _, name := range names {
+		s := ops[name]
+		var cumulative uint64
+		for i, le := range LatencyBuckets {
+			cumulative += s.buckets[i]
+			fmt.Fprintf(bw, "gocryptfs_op_duration_seconds_bucket{op=%q,le=%q} %d\n",
+				name, strconv.FormatFloat(le, 'g', -1, 64), cumulative)
+		}
+		fmt.Fprintf(bw, "gocryptfs_op_duration_seconds_bucket{op=%q,le=\"+Inf\"} %d\n", name, s.count)
+		fmt.Fprintf(bw, "gocryptfs_op_duration_seconds_sum{op=%q} %s\n", name, strconv.FormatFloat(s.sum, 'g', -1, 64))
+		fmt.Fprintf(bw, "gocryptfs_op_duration_seconds_count{op=%q} %d\n", name, s.count)
+	}
+	return bw.Flush()
+}
+
+// ServeHTTP serves the counters in the Prometheus text format
+func (r *Registry) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	if req.Method != http.MethodGet && req.Method != http.MethodHead {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	w.Header().Set("Content-Type", ContentType)
+	r.WritePrometheus(w)
+}
+
+// Serve serves the counters at "/metrics" on "ln" until it is closed
+func (r *Registry) Serve(ln net.Listener) error {
+	mux := http.NewServeMux()
+	mux.Handle("/metrics", r)
+	return http.Serve(ln, mux)
+}
@@ -0,0 +1,169 @@
+package metrics
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"regexp"
+	"strconv"
+	"strings"
+	"syscall"
+	"testing"
+	"time"
+)
+
+// sample is one parsed sample line
+type sample struct {
+	name   string
+	labels map[string]string
+	value  float64
+}
+
+var (
+	commentRe = regexp.MustCompile(`^# (HELP|TYPE) ([a-zA-Z_:][a-zA-Z0-9_:]*) (.+)$`)
+	sampleRe  = regexp.MustCompile(`^([a-zA-Z_:][a-zA-Z0-9_:]*)(\{(.*)\})? (\S+)$`)
+	labelRe   = regexp.MustCompile(`^([a-zA-Z_][a-zA-Z0-9_]*)="((?:[^"\\]|\\.)*)"$`)
+)
+
+// parseExposition parses the Prometheus text format and fails on anything
+// that does not follow it. Returns the samples and the TYPE of each metric.
+func parseExposition(t *testing.T, r io.Reader) ([]sample, map[string]string) {
+	var samples []sample
+	types := make(map[string]string)
+	sc := bufio.NewScanner(r)
+	for sc.Scan() {
+		line := sc.Text()
+		if m := commentRe.FindStringSubmatch(line); m != nil {
+			if m[1] == "TYPE" {
+				switch m[3] {
+				case "counter", "gauge", "histogram", "summary", "untyped":
+				default:
+					t.Errorf("invalid type in %q", line)
+				}
+				if types[m[2]] != "" {
+					t.Errorf("second TYPE line for %s", m[2])
+				}
+				types[m[2]] = m[3]
+			}
+			continue
+		}
+		m := sampleRe.FindStringSubmatch(line)
+		if m == nil {
+			t.Errorf("invalid line %q", line)
+			continue
+		}
+		s := sample{name: m[1], labels: make(map[string]string)}
+		if m[3] != "" {
+			for _, l := range strings.Split(m[3], ",") {
+				lm := labelRe.FindStringSubmatch(l)
+				if lm == nil {
+					t.Errorf("invalid label %q in %q", l, line)
+					continue
+				}
+				s.labels[lm[1]] = lm[2]
+			}
+		}
+		var err error
+		if s.value, err = strconv.ParseFloat(m[4], 64); err != nil {
+			t.Errorf("invalid value in %q: %v", line, err)
+		}
+		base := strings.TrimSuffix(strings.TrimSuffix(strings.TrimSuffix(s.name, "_bucket"), "_sum"), "_count")
+		if types[s.name] == "" && types[base] == "" {
+			t.Errorf("sample %q comes before its TYPE line", line)
+		}
+		samples = append(samples, s)
+	}
+	return samples, types
+}
+
+// TestPrometheus scrapes the metrics endpoint and checks that the output
+// parses as the Prometheus text format, has the expected metric names, and
+// that the histograms are consistent.
+func TestPrometheus(t *testing.T) {
+	r := New()
+	var ok, fail syscall.Errno = 0, syscall.ENOENT
+	for i := 0; i < 3; i++ {
+		r.Observe("read", time.Now(), &ok)
+	}
+	r.Observe("read", time.Now().Add(-2*time.Second), &fail)
+	r.Observe("write", time.Now().Add(-time.Hour), &ok)
+
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	go r.Serve(ln)
+	resp, err := http.Get("http://" + ln.Addr().String() + "/metrics")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	if ct := resp.Header.Get("Content-Type"); ct != ContentType {
+		t.Errorf("Content-Type: want %q, have %q", ContentType, ct)
+	}
+	samples, types := parseExposition(t, resp.Body)
+
+	for name, want := range map[string]string{
+		"gocryptfs_ops_total":           "counter",
+		"gocryptfs_op_errors_total":     "counter",
+		"gocryptfs_op_duration_seconds": "histogram",
+	} {
+		if types[name] != want {
+			t.Errorf("%s: want type %q, have %q", name, want, types[name])
+		}
+	}
+	values := make(map[string]float64)
+	var lastBucket float64
+	for _, s := range samples {
+		if s.labels["op"] == "" {
+			t.Errorf("%s has no op label", s.name)
+		}
+		if s.name == "gocryptfs_op_duration_seconds_bucket" {
+			if s.labels["le"] == "" {
+				t.Errorf("bucket without le label")
+			}
+			if s.labels["le"] == fmt.Sprint(LatencyBuckets[0]) {
+				lastBucket = 0
+			}
+			if s.value < lastBucket {
+				t.Errorf("op=%s: bucket le=%s is not cumulative", s.labels["op"], s.labels["le"])
+			}
+			lastBucket = s.value
+		}
+		values[s.name+"/"+s.labels["op"]+"/"+s.labels["le"]] = s.value
+	}
+	for key, want := range map[string]float64{
+		"gocryptfs_ops_total/read/":                       4,
+		"gocryptfs_ops_total/write/":                      1,
+		"gocryptfs_op_errors_total/read/":                 1,
+		"gocryptfs_op_errors_total/write/":                0,
+		"gocryptfs_op_duration_seconds_count/read/":       4,
+		"gocryptfs_op_duration_seconds_bucket/read/+Inf":  4,
+		"gocryptfs_op_duration_seconds_bucket/read/1":     3,
+		"gocryptfs_op_duration_seconds_bucket/read/5":     4,
+		"gocryptfs_op_duration_seconds_bucket/write/5":    0,
+		"gocryptfs_op_duration_seconds_bucket/write/+Inf": 1,
+	} {
+		if have, ok := values[key]; !ok || have != want {
+			t.Errorf("%s: want %v, have %v (present: %v)", key, want, have, ok)
+		}
+	}
+	if values["gocryptfs_op_duration_seconds_sum/write/"] < 3600 {
+		t.Errorf("write latency sum is too small: %v", values["gocryptfs_op_duration_seconds_sum/write/"])
+	}
+}
+
+// TestNilRegistry checks that a nil Registry, as used without "-metrics",
+// does nothing
+func TestNilRegistry(t *testing.T) {
+	var r *Registry
+	var errno syscall.Errno
+	r.Observe("read", time.Now(), &errno)
+	var sb strings.Builder
+	if err := r.WritePrometheus(&sb); err != nil || sb.Len() != 0 {
+		t.Errorf("want no output, have %q, %v", sb.String(), err)
+	}
+}
@@ -0,0 +1,75 @@
+package nametransform
+
+import (
+	"encoding/base32"
+	"encoding/base64"
+	"fmt"
+	"strings"
+)
+
+const (
+	// EncodingBase64URL is the default name encoding: base64 with the URL-safe
+	// alphabet, padded or not depending on the Raw64 feature flag.
+	EncodingBase64URL = "base64url"
+	// EncodingBase32 is unpadded base32 with the lower-case RFC 4648
+	// alphabet. Names are 20% longer than with base64, but work on
+	// case-insensitive filesystems.
+	EncodingBase32 = "base32"
+
+	base32Alphabet = "abcdefghijklmnopqrstuvwxyz234567"
+	// customChars are the characters a custom alphabet may use. "." is not
+	// allowed so an encrypted name can never look like "gocryptfs.diriv" or
+	// "gocryptfs.longname.*", and "=" is the padding character.
+	customChars = "abcdefghijklmnopqrstuvwxyzABCDEFGHIJKLMNOPQRSTUVWXYZ0123456789-_+~,@"
+)
+
+// NameEncoding turns encrypted file names into strings and back.
+// *base64.Encoding and *base32.Encoding implement it.
+type NameEncoding interface {
+	EncodeToString(src []byte) string
+	DecodeString(s string) ([]byte, error)
+	EncodedLen(n int) int
+}
+
+// NewNameEncoding returns the name encoding selected by "name", which is
+// EncodingBase64URL, EncodingBase32, or a custom alphabet of 32 (base32) or
+// 64 (base64) distinct characters. Custom alphabets are never padded.
+// "raw64" selects unpadded base64 for EncodingBase64URL.
+func NewNameEncoding(name string, raw64 bool) (NameEncoding, error) {
+	switch name {
+	case EncodingBase64URL, "":
+		if raw64 {
+			return base64.RawURLEncoding, nil
+		}
+		return base64.URLEncoding, nil
+	case EncodingBase32:
+		return base32.NewEncoding(base32Alphabet).WithPadding(base32.NoPadding), nil
+	}
+	for i, c := range name {
+		if !strings.ContainsRune(customChars, c) {
+			return nil, fmt.Errorf("name encoding %q: character %q is not allowed, use only %q", name, c, customChars)
+		}
+		if strings.ContainsRune(name[i+1:], c) {
+			return nil, fmt.Errorf("name encoding %q: character %q appears more than once", name, c)
+		}
+	}
+	switch len(name) {
+	case 32:
+		return base32.NewEncoding(name).WithPadding(base32.NoPadding), nil
+	case 64:
+		return base64.NewEncoding(name).WithPadding(base64.NoPadding), nil
+	}
+	return nil, fmt.Errorf("name encoding %q: want %q, %q, or a custom alphabet of 32 or 64 characters, got %d characters",
+		name, EncodingBase64URL, EncodingBase32, len(name))
+}
+
+// shortNameMax returns the longest plaintext name whose encrypted name still
+// fits into NameMax bytes when encoded with "enc". Encrypted names are padded
+// to 16-byte multiples, and the padding is at least one byte.
+func shortNameMax(enc NameEncoding) int {
+	padded := 16
+	for enc.EncodedLen(padded+16) <= NameMax {
+		padded += 16
+	}
+	return padded - 1
+}
@@ -0,0 +1,81 @@
+package nametransform
+
+import (
+	"crypto/aes"
+	"strings"
+	"testing"
+
+	"github.com/rfjakob/eme"
+)
+
+func newTestNameTransform(t *testing.T, encoding string) *NameTransform {
+	bc, err := aes.NewCipher(make([]byte, 32))
+	if err != nil {
+		t.Fatal(err)
+	}
+	n := New(eme.New(bc), true, true)
+	n.NameEnc, err = NewNameEncoding(encoding, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return n
+}
+
+// TestNameEncodingRoundTrip encrypts and decrypts names of all lengths with
+// each encoding and checks that the long name threshold matches the encoding.
+func TestNameEncodingRoundTrip(t *testing.T) {
+	for _, tc := range []struct {
+		encoding     string
+		alphabet     string
+		shortNameMax int
+	}{
+		{EncodingBase64URL, "abcdefghijklmnopqrstuvwxyzABCDEFGHIJKLMNOPQRSTUVWXYZ0123456789-_", 175},
+		{EncodingBase32, base32Alphabet, 143},
+		{"0123456789abcdefghijklmnopqrstuv", "0123456789abcdefghijklmnopqrstuv", 143},
+		{"~,@+ABCDEFGHIJKLMNOPQRSTUVWXYZ0123456789abcdefghijklmnopqrstuvwx", "~,@+ABCDEFGHIJKLMNOPQRSTUVWXYZ0123456789abcdefghijklmnopqrstuvwx", 175},
+	} {
+		n := newTestNameTransform(t, tc.encoding)
+		if have := n.ShortNameMax(); have != tc.shortNameMax {
+			t.Errorf("%s: ShortNameMax=%d, want %d", tc.encoding, have, tc.shortNameMax)
+		}
+		iv := make([]byte, DirIVLen)
+		for l := 1; l <= NameMax; l++ {
+			plain := strings.Repeat("x", l)
+			cName := n.EncryptName(plain, iv)
+			if strings.Trim(cName, tc.alphabet) != "" {
+				t.Fatalf("%s: %q contains characters outside of the alphabet", tc.encoding, cName)
+			}
+			if dec, err := n.DecryptName(cName, iv); err != nil || dec != plain {
+				t.Fatalf("%s: len=%d: round trip failed: %v", tc.encoding, l, err)
+			}
+			hName, err := n.EncryptAndHashName(plain, iv)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(hName) > NameMax {
+				t.Fatalf("%s: len=%d: encrypted name is %d bytes long", tc.encoding, l, len(hName))
+			}
+			if isLong := IsLongContent(hName); isLong != (l > tc.shortNameMax) {
+				t.Fatalf("%s: len=%d: long name=%v, ShortNameMax=%d", tc.encoding, l, isLong, tc.shortNameMax)
+			}
+		}
+	}
+}
+
+func TestNewNameEncodingInvalid(t *testing.T) {
+	for _, name := range []string{
+		"base16",
+		// Too short and too long
+		"abcdefghijklmnopqrstuvwxyz23456",
+		base32Alphabet + "8",
+		// Duplicate character
+		"abcdefghijklmnopqrstuvwxyz23456a",
+		// "." and "/" are not allowed
+		"abcdefghijklmnopqrstuvwxyz23456.",
+		"abcdefghijklmnopqrstuvwxyz23456/",
+	} {
+		if _, err := NewNameEncoding(name, true); err == nil {
+			t.Errorf("%q should be rejected", name)
+		}
+	}
+}
@@ -28,7 +28,7 @@ const (
 // This function does not do any I/O.
 func (n *NameTransform) HashLongName(name string) string {
 	hashBin := sha256.Sum256([]byte(name))
-	hashBase64 := n.B64.EncodeToString(hashBin[:])
+	hashBase64 := n.NameEnc.EncodeToString(hashBin[:])
 	return longNamePrefix + hashBase64
 }
 
@@ -91,8 +91,9 @@ func ReadLongNameAt(dirfd int, cName string) (string, error) {
 		// fd runs out of scope here
 	}
 	defer f.Close()
-	// 256 (=255 padded to 16) bytes base64-encoded take 344 bytes: "AAAAAAA...AAA=="
-	lim := 344
+	// 256 (=255 padded to 16) bytes base64-encoded take 344 bytes: "AAAAAAA...AAA==",
+	// and 410 bytes base32-encoded (see NewNameEncoding).
+	lim := 410
 	// Allocate a bigger buffer so we see whether the file is too big
 	buf := make([]byte, lim+1)
 	n, err := f.ReadAt(buf, 0)
@@ -125,13 +126,19 @@ func DeleteLongNameAt(dirfd int, hashName string) error {
 //
 // This function is symlink-safe through the use of Openat().
 func (n *NameTransform) WriteLongNameAt(dirfd int, hashName string, plainName string) (err error) {
-	plainName = filepath.Base(plainName)
-
-	// Encrypt the basename
 	dirIV, err := ReadDirIVAt(dirfd)
 	if err != nil {
 		return err
 	}
+	return n.WriteLongNameAtIV(dirfd, hashName, plainName, dirIV)
+}
+
+// WriteLongNameAtIV is WriteLongNameAt with the DirIV passed by the caller,
+// for when "dirfd" is not the directory that holds gocryptfs.diriv.
+func (n *NameTransform) WriteLongNameAtIV(dirfd int, hashName string, plainName string, dirIV []byte) (err error) {
+	plainName = filepath.Base(plainName)
+
+	// Encrypt the basename
 	cName := n.EncryptName(plainName, dirIV)
 
 	// Write the encrypted name into hashName.name
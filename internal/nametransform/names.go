@@ -29,8 +29,12 @@ type NameTransformer interface {
 	// This function does not do any I/O.
 	HashLongName(name string) string
 	WriteLongNameAt(dirfd int, hashName string, plainName string) error
+	WriteLongNameAtIV(dirfd int, hashName string, plainName string, dirIV []byte) error
 	B64EncodeToString(src []byte) string
 	B64DecodeString(s string) ([]byte, error)
+	// ShortNameMax returns the longest plaintext name that does not need to
+	// be stored as a long name.
+	ShortNameMax() int
 }
 
 // NameTransform is used to transform filenames.
@@ -40,6 +44,10 @@ type NameTransform struct {
 	// B64 = either base64.URLEncoding or base64.RawURLEncoding, depending
 	// on the Raw64 feature flag
 	B64 *base64.Encoding
+	// NameEnc encodes the encrypted file names and long name hashes. New
+	// sets it to B64, set it after New to use a different encoding.
+	// Symlink targets always use B64.
+	NameEnc NameEncoding
 	// Patterns to bypass decryption
 	BadnamePatterns []string
 }
@@ -54,6 +62,7 @@ func New(e *eme.EMECipher, longNames bool, raw64 bool) *NameTransform {
 		emeCipher: e,
 		longNames: longNames,
 		B64:       b64,
+		NameEnc:   b64,
 	}
 }
 
@@ -67,7 +76,7 @@ func (n *NameTransform) DecryptName(cipherName string, iv []byte) (string, error
 			if err == nil && match { // Pattern should have been validated already
 				// Find longest decryptable substring
 				// At least 16 bytes due to AES --> at least 22 characters in base64
-				nameMin := n.B64.EncodedLen(aes.BlockSize)
+				nameMin := n.NameEnc.EncodedLen(aes.BlockSize)
 				for charpos := len(cipherName) - 1; charpos >= nameMin; charpos-- {
 					res, err = n.decryptName(cipherName[:charpos], iv)
 					if err == nil {
@@ -84,7 +93,7 @@ func (n *NameTransform) DecryptName(cipherName string, iv []byte) (string, error
 // decryptName decrypts a base64-encoded encrypted filename "cipherName" using the
 // initialization vector "iv".
 func (n *NameTransform) decryptName(cipherName string, iv []byte) (string, error) {
-	bin, err := n.B64.DecodeString(cipherName)
+	bin, err := n.NameEnc.DecodeString(cipherName)
 	if err != nil {
 		return "", err
 	}
@@ -127,10 +136,17 @@ func (n *NameTransform) EncryptName(plainName string, iv []byte) (cipherName64 s
 	bin := []byte(plainName)
 	bin = pad16(bin)
 	bin = n.emeCipher.Encrypt(iv, bin)
-	cipherName64 = n.B64.EncodeToString(bin)
+	cipherName64 = n.NameEnc.EncodeToString(bin)
 	return cipherName64
 }
 
+// ShortNameMax returns the longest plaintext name whose encrypted name fits
+// into NameMax bytes. Longer names are stored as long names. This is 175 for
+// base64, and less for encodings that expand more.
+func (n *NameTransform) ShortNameMax() int {
+	return shortNameMax(n.NameEnc)
+}
+
 // B64EncodeToString returns a Base64-encoded string
 func (n *NameTransform) B64EncodeToString(src []byte) string {
 	return n.B64.EncodeToString(src)
@@ -0,0 +1,69 @@
+//go:build go1.18
+// +build go1.18
+
+package nametransform
+
+import (
+	"bytes"
+	"crypto/aes"
+	"strings"
+	"testing"
+
+	"github.com/rfjakob/eme"
+
+	"github.com/rfjakob/gocryptfs/internal/tlog"
+)
+
+// FuzzDecryptName feeds arbitrary encrypted names to DecryptName. It must
+// never panic, and a name it accepts must be a valid file name whose
+// encryption decodes to the same bytes.
+//
+//	go test ./internal/nametransform -run NONE -fuzz FuzzDecryptName
+func FuzzDecryptName(f *testing.F) {
+	// Empty names are logged as warnings, which slows down fuzzing a lot
+	defer func(e bool) { tlog.Warn.Enabled = e }(tlog.Warn.Enabled)
+	tlog.Warn.Enabled = false
+	ec, err := aes.NewCipher(make([]byte, 32))
+	if err != nil {
+		f.Fatal(err)
+	}
+	iv := make([]byte, DirIVLen)
+	valid := New(eme.New(ec), true, false).EncryptName("hello", iv)
+
+	f.Add("", false)
+	f.Add("a", false)
+	f.Add("====", false)
+	f.Add("!!!!", true)
+	// Truncated
+	f.Add(valid[:len(valid)-4], false)
+	f.Add(valid[:len(valid)-1], false)
+	f.Add(valid, true)
+	f.Add(valid, false)
+	// Not a multiple of the AES block size
+	f.Add(strings.Repeat("A", 20), true)
+	// Encrypted "." and a name with a "/"
+	f.Add(New(eme.New(ec), true, false).EncryptName(".", iv), false)
+	f.Add(New(eme.New(ec), true, false).EncryptName("a/b", iv), false)
+
+	f.Fuzz(func(t *testing.T, cipherName string, raw64 bool) {
+		n := New(eme.New(ec), true, raw64)
+		plain, err := n.DecryptName(cipherName, iv)
+		if cipherName == valid && !raw64 && (err != nil || plain != "hello") {
+			t.Fatalf("valid name: have %q, %v", plain, err)
+		}
+		if err != nil {
+			if plain != "" {
+				t.Fatalf("error %v, but returned %q", err, plain)
+			}
+			return
+		}
+		if plain == "" || plain == "." || plain == ".." || strings.ContainsAny(plain, "/\x00") {
+			t.Fatalf("accepted invalid file name %q", plain)
+		}
+		have, _ := n.NameEnc.DecodeString(n.EncryptName(plain, iv))
+		want, _ := n.NameEnc.DecodeString(cipherName)
+		if !bytes.Equal(have, want) {
+			t.Fatalf("%q decrypted to %q, which encrypts to something else", cipherName, plain)
+		}
+	})
+}
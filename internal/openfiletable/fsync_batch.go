@@ -0,0 +1,49 @@
+package openfiletable
+
+import (
+	"sync"
+	"time"
+)
+
+// fsyncBatch coalesces the fsyncs of one file, see Entry.FsyncBatched.
+type fsyncBatch struct {
+	sync.Mutex
+	// next is the round that has not started its fsync yet. Nil if there is
+	// none.
+	next *fsyncRound
+}
+
+// fsyncRound is one backing fsync that several callers wait for
+type fsyncRound struct {
+	done chan struct{}
+	err  error
+}
+
+// FsyncBatched calls "fsync" on behalf of all callers that arrive within
+// "window" of each other, and returns its result to all of them.
+//
+// The first caller of a round waits "window", then runs "fsync". Callers
+// that arrive before the fsync has started join the round; callers that
+// arrive later start the next round, because an fsync that is already
+// running may not cover their writes. So every caller returns only after an
+// fsync has completed that started after it was called.
+func (e *Entry) FsyncBatched(window time.Duration, fsync func() error) error {
+	b := &e.fsync
+	b.Lock()
+	if r := b.next; r != nil {
+		b.Unlock()
+		<-r.done
+		return r.err
+	}
+	r := &fsyncRound{done: make(chan struct{})}
+	b.next = r
+	b.Unlock()
+
+	time.Sleep(window)
+	b.Lock()
+	b.next = nil
+	b.Unlock()
+	r.err = fsync()
+	close(r.done)
+	return r.err
+}
@@ -7,8 +7,11 @@ package openfiletable
 import (
 	"sync"
 	"sync/atomic"
+	"syscall"
 
+	"github.com/rfjakob/gocryptfs/internal/filehash"
 	"github.com/rfjakob/gocryptfs/internal/inomap"
+	"github.com/rfjakob/gocryptfs/internal/tlog"
 )
 
 // wlock - serializes write accesses to each file (identified by inode number)
@@ -20,6 +23,7 @@ var t table
 
 func init() {
 	t.entries = make(map[inomap.QIno]*Entry)
+	t.pendingDeletes = make(map[inomap.QIno]int)
 }
 
 type table struct {
@@ -30,16 +34,27 @@ type table struct {
 	// must be used. It must be the first element of the struct to guarantee
 	// 64-bit alignment.
 	writeOpCount uint64
+	// deleteCount counts EndDelete calls, see DeleteCount. Accessed
+	// atomically.
+	deleteCount uint64
 	// Protects map access
 	sync.Mutex
 	// Table entries
 	entries map[inomap.QIno]*Entry
+	// pendingDeletes counts the running deletes of each file, see
+	// BeginDelete
+	pendingDeletes map[inomap.QIno]int
 }
 
 // Entry is an entry in the open file table
 type Entry struct {
 	// Reference count. Protected by the table lock.
 	refCount int
+	// qi is the key of the entry in the table
+	qi inomap.QIno
+	// deleted is set when the file has been deleted through the mount, see
+	// MarkDeleted. Protected by the table lock.
+	deleted bool
 	// ContentLock protects on-disk content from concurrent writes. Every writer
 	// must take this lock before modifying the file content.
 	ContentLock countingMutex
@@ -48,6 +63,26 @@ type Entry struct {
 	// IDLock must be taken before reading or writing the ID field in this struct,
 	// unless you have an exclusive lock on ContentLock.
 	IDLock sync.Mutex
+	// FileHash is the running "-filehash" checksum. Protected by ContentLock.
+	FileHash filehash.Running
+	// PendingWrite writes data that a file handle has buffered for this file
+	// to disk, see "-writebuffer" in fusefrontend. Nil if nothing is
+	// buffered. Protected by ContentLock.
+	PendingWrite func() syscall.Errno
+	// DecryptErrLog limits the warnings about corrupt content of this file,
+	// so that reading a bad block in a loop cannot flood the log.
+	DecryptErrLog tlog.RateLimiter
+	// fsync coalesces fsyncs for "-fsync_batch", see FsyncBatched
+	fsync fsyncBatch
+}
+
+// FlushPendingWrite writes out buffered data, if there is any. The caller
+// must hold ContentLock.Lock().
+func (e *Entry) FlushPendingWrite() syscall.Errno {
+	if e.PendingWrite == nil {
+		return 0
+	}
+	return e.PendingWrite()
 }
 
 // Register creates an open file table entry for "qi" (or incrementes the
@@ -58,13 +93,91 @@ func Register(qi inomap.QIno) *Entry {
 
 	e := t.entries[qi]
 	if e == nil {
-		e = &Entry{}
+		e = &Entry{qi: qi}
 		t.entries[qi] = e
 	}
 	e.refCount++
 	return e
 }
 
+// Lookup returns the entry for "qi", or nil if the file is not open. Does not
+// change the reference count, so the entry may be unregistered at any time.
+func Lookup(qi inomap.QIno) *Entry {
+	t.Lock()
+	defer t.Unlock()
+	return t.entries[qi]
+}
+
+// MarkDeleted records that the last name of the file "qi" has been deleted
+// through the mount. Open files then have a link count of zero, which is
+// expected in this case. Does nothing if the file is not open.
+func MarkDeleted(qi inomap.QIno) {
+	t.Lock()
+	defer t.Unlock()
+	if e := t.entries[qi]; e != nil {
+		e.deleted = true
+	}
+}
+
+// BeginDelete records that the last name of the file "qi" is about to be
+// deleted through the mount, by unlink or by a rename over it. Until the
+// matching EndDelete, Deleted returns true for the file, so that open files
+// that see their link count drop to zero in the meantime are not mistaken
+// for files deleted behind our back. Works whether the file is open or not.
+func BeginDelete(qi inomap.QIno) {
+	t.Lock()
+	defer t.Unlock()
+	t.pendingDeletes[qi]++
+}
+
+// EndDelete ends a BeginDelete. "ok" is true if the delete succeeded, in
+// which case the file is marked deleted like MarkDeleted does.
+func EndDelete(qi inomap.QIno, ok bool) {
+	t.Lock()
+	defer t.Unlock()
+	if t.pendingDeletes[qi]--; t.pendingDeletes[qi] <= 0 {
+		delete(t.pendingDeletes, qi)
+	}
+	if e := t.entries[qi]; e != nil && ok {
+		e.deleted = true
+	}
+	atomic.AddUint64(&t.deleteCount, 1)
+}
+
+// DeleteCount returns the number of EndDelete calls so far. An Open that
+// sees it change while registering the file may have missed a delete.
+func DeleteCount() uint64 {
+	return atomic.LoadUint64(&t.deleteCount)
+}
+
+// Deleted returns true if MarkDeleted has been called for this entry, or
+// if a delete of the file is running.
+func (e *Entry) Deleted() bool {
+	t.Lock()
+	defer t.Unlock()
+	return e.deleted || t.pendingDeletes[e.qi] > 0
+}
+
+// FlushAllPendingWrites calls FlushPendingWrite on all entries and returns
+// the first error.
+func FlushAllPendingWrites() syscall.Errno {
+	t.Lock()
+	entries := make([]*Entry, 0, len(t.entries))
+	for _, e := range t.entries {
+		entries = append(entries, e)
+	}
+	t.Unlock()
+	var errno syscall.Errno
+	for _, e := range entries {
+		e.ContentLock.Lock()
+		if errno2 := e.FlushPendingWrite(); errno == 0 {
+			errno = errno2
+		}
+		e.ContentLock.Unlock()
+	}
+	return errno
+}
+
 // Unregister decrements the reference count for "qi" and deletes the entry from
 // the open file table if the reference count reaches 0.
 func Unregister(qi inomap.QIno) {
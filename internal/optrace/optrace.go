@@ -0,0 +1,164 @@
+// Package optrace records a log of FUSE operations ("-optrace") that can be
+// replayed against a fresh filesystem to reproduce bugs.
+//
+// The log does not contain any plaintext. File names are replaced by keyed
+// hashes and file contents by a keyed hash plus the length. The key is
+// random and is never written out, so the hashes cannot be checked against
+// guessed names or contents.
+package optrace
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"io"
+	"os"
+	"strings"
+	"sync"
+	"syscall"
+
+	"github.com/rfjakob/gocryptfs/internal/cryptocore"
+)
+
+// Operation names as stored in Op.Op
+const (
+	OpCreate   = "create"
+	OpOpen     = "open"
+	OpRelease  = "release"
+	OpRead     = "read"
+	OpWrite    = "write"
+	OpTruncate = "truncate"
+	OpMkdir    = "mkdir"
+	OpRmdir    = "rmdir"
+	OpUnlink   = "unlink"
+	OpRename   = "rename"
+)
+
+// minNameLen is the minimum length of a hashed name. Longer names keep their
+// length so that long name handling is exercised on replay.
+const minNameLen = 16
+
+// Op is one recorded operation. It is stored as one line of JSON.
+type Op struct {
+	Op string `json:"op"`
+	// Path is the hashed path relative to the mountpoint
+	Path string `json:"path,omitempty"`
+	// Path2 is the hashed destination path for renames
+	Path2 string `json:"path2,omitempty"`
+	// Fh identifies the open file for file handle operations
+	Fh    uint64 `json:"fh,omitempty"`
+	Off   int64  `json:"off,omitempty"`
+	Size  int64  `json:"size,omitempty"`
+	Flags uint32 `json:"flags,omitempty"`
+	Mode  uint32 `json:"mode,omitempty"`
+	// Hash of the written data
+	Hash string `json:"hash,omitempty"`
+	// Errno is the result of the operation
+	Errno int `json:"errno,omitempty"`
+}
+
+// Recorder writes Ops to a trace file. All methods can be called on a nil
+// Recorder and do nothing in that case.
+type Recorder struct {
+	mu  sync.Mutex
+	enc *json.Encoder
+	f   io.Closer
+	key []byte
+	// lastFh is the last file handle number handed out
+	lastFh uint64
+}
+
+// New returns a Recorder that writes to "w".
+func New(w io.Writer) *Recorder {
+	return &Recorder{
+		enc: json.NewEncoder(w),
+		key: cryptocore.RandBytes(32),
+	}
+}
+
+// Create creates the trace file "path" and returns a Recorder writing to it.
+func Create(path string) (*Recorder, error) {
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0600)
+	if err != nil {
+		return nil, err
+	}
+	r := New(f)
+	r.f = f
+	return r, nil
+}
+
+// Close closes the trace file.
+func (r *Recorder) Close() error {
+	if r == nil || r.f == nil {
+		return nil
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.f.Close()
+}
+
+// NextFh returns a new file handle number.
+func (r *Recorder) NextFh() uint64 {
+	if r == nil {
+		return 0
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.lastFh++
+	return r.lastFh
+}
+
+// Record writes "op" to the trace. Op.Path and Op.Path2 must contain
+// plaintext paths and are hashed before writing. "data", if not nil, is
+// hashed into Op.Hash.
+func (r *Recorder) Record(op Op, data []byte, errno syscall.Errno) {
+	if r == nil {
+		return
+	}
+	op.Path = r.hashPath(op.Path)
+	op.Path2 = r.hashPath(op.Path2)
+	if data != nil {
+		op.Hash = hex.EncodeToString(r.mac(data))[:32]
+	}
+	op.Errno = int(errno)
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	// Errors are ignored. A broken trace should not break the filesystem.
+	r.enc.Encode(op)
+}
+
+func (r *Recorder) mac(data []byte) []byte {
+	m := hmac.New(sha256.New, r.key)
+	m.Write(data)
+	return m.Sum(nil)
+}
+
+// hashPath hashes each component of the slash-separated "path" separately, so
+// the directory structure is preserved.
+func (r *Recorder) hashPath(path string) string {
+	if path == "" {
+		return ""
+	}
+	parts := strings.Split(path, "/")
+	for i, p := range parts {
+		parts[i] = r.hashName(p)
+	}
+	return strings.Join(parts, "/")
+}
+
+// hashName returns a hex string of length max(len(name), minNameLen) that is
+// derived from a keyed hash of "name".
+func (r *Recorder) hashName(name string) string {
+	l := len(name)
+	if l < minNameLen {
+		l = minNameLen
+	}
+	var out []byte
+	h := r.mac([]byte(name))
+	for len(out) < l {
+		out = append(out, hex.EncodeToString(h)...)
+		h = r.mac(h)
+	}
+	return string(out[:l])
+}
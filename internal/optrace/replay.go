@@ -0,0 +1,135 @@
+package optrace
+
+import (
+	"bufio"
+	"crypto/sha256"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"syscall"
+
+	"golang.org/x/sys/unix"
+
+	"github.com/rfjakob/gocryptfs/internal/syscallcompat"
+	"github.com/rfjakob/gocryptfs/internal/tlog"
+)
+
+// Replay executes the trace read from "r" against the directory "dir",
+// usually the mountpoint of a freshly created gocryptfs filesystem.
+//
+// Written data is replaced by a pseudo-random stream derived from the
+// recorded hash, so writes of identical data stay identical.
+//
+// Operations whose result differs from the recorded result are logged and
+// counted in "mismatches". "err" is only set if the trace cannot be parsed.
+func Replay(r io.Reader, dir string) (mismatches int, err error) {
+	files := make(map[uint64]*os.File)
+	defer func() {
+		for _, f := range files {
+			f.Close()
+		}
+	}()
+	scanner := bufio.NewScanner(r)
+	for lineNo := 1; scanner.Scan(); lineNo++ {
+		var op Op
+		if err := json.Unmarshal(scanner.Bytes(), &op); err != nil {
+			return mismatches, fmt.Errorf("line %d: %v", lineNo, err)
+		}
+		errno := replayOp(&op, dir, files)
+		if int(errno) != op.Errno {
+			tlog.Warn.Printf("Replay line %d: %s %q: got errno %d, recorded %d",
+				lineNo, op.Op, op.Path, errno, op.Errno)
+			mismatches++
+		}
+	}
+	return mismatches, scanner.Err()
+}
+
+// replayOp executes a single operation and returns the resulting errno.
+func replayOp(op *Op, dir string, files map[uint64]*os.File) syscall.Errno {
+	path := filepath.Join(dir, op.Path)
+	var err error
+	switch op.Op {
+	case OpCreate, OpOpen:
+		flags := int(op.Flags)
+		if op.Op == OpCreate {
+			flags |= os.O_CREATE | os.O_EXCL
+		}
+		var f *os.File
+		f, err = os.OpenFile(path, flags, os.FileMode(op.Mode))
+		if err == nil {
+			files[op.Fh] = f
+		}
+	case OpRelease:
+		f, ok := files[op.Fh]
+		if !ok {
+			return syscall.EBADF
+		}
+		delete(files, op.Fh)
+		err = f.Close()
+	case OpRead:
+		f, ok := files[op.Fh]
+		if !ok {
+			return syscall.EBADF
+		}
+		_, err = f.ReadAt(make([]byte, op.Size), op.Off)
+		if err == io.EOF {
+			err = nil
+		}
+	case OpWrite:
+		f, ok := files[op.Fh]
+		if !ok {
+			return syscall.EBADF
+		}
+		_, err = f.WriteAt(replayData(op.Hash, op.Size), op.Off)
+	case OpTruncate:
+		f, ok := files[op.Fh]
+		if !ok {
+			return syscall.EBADF
+		}
+		err = f.Truncate(op.Size)
+	case OpMkdir:
+		err = syscall.Mkdir(path, op.Mode)
+	case OpRmdir:
+		err = syscall.Rmdir(path)
+	case OpUnlink:
+		err = syscall.Unlink(path)
+	case OpRename:
+		// Op.Flags holds RENAME_EXCHANGE and RENAME_NOREPLACE
+		err = syscallcompat.Renameat2(unix.AT_FDCWD, path, unix.AT_FDCWD, filepath.Join(dir, op.Path2), uint(op.Flags))
+	default:
+		tlog.Warn.Printf("Replay: unknown op %q", op.Op)
+		return syscall.ENOSYS
+	}
+	return toErrno(err)
+}
+
+// replayData returns "size" bytes of pseudo-random data derived from "hash".
+func replayData(hash string, size int64) []byte {
+	out := make([]byte, 0, size+sha256.Size)
+	h := sha256.Sum256([]byte(hash))
+	for int64(len(out)) < size {
+		out = append(out, h[:]...)
+		h = sha256.Sum256(h[:])
+	}
+	return out[:size]
+}
+
+// toErrno extracts the errno from the error types returned by the os package.
+func toErrno(err error) syscall.Errno {
+	switch e := err.(type) {
+	case nil:
+		return 0
+	case syscall.Errno:
+		return e
+	case *os.PathError:
+		return toErrno(e.Err)
+	case *os.LinkError:
+		return toErrno(e.Err)
+	case *os.SyscallError:
+		return toErrno(e.Err)
+	}
+	return syscall.EIO
+}
@@ -0,0 +1,74 @@
+// Package ratelimit implements a token bucket that is used to cap the
+// bandwidth going through the mount ("-bwlimit").
+package ratelimit
+
+import (
+	"sync"
+	"time"
+)
+
+// Limiter is a token bucket shared by all open files. The bucket holds up to
+// "burst" bytes and is refilled at "rate" bytes per second.
+//
+// Wait() never sleeps while holding the lock, so a slow caller cannot
+// block unrelated callers from reserving their share.
+type Limiter struct {
+	mu sync.Mutex
+	// rate is the refill rate in bytes per second
+	rate float64
+	// burst is the bucket capacity in bytes
+	burst float64
+	// tokens is the current fill level. It goes negative when callers have
+	// reserved bandwidth that has not been refilled yet.
+	tokens float64
+	// last is the time "tokens" was last updated
+	last time.Time
+}
+
+// New returns a Limiter that allows "bytesPerSec" bytes per second on average.
+// "burst" is the largest amount of bytes that can pass through without
+// waiting after an idle period. It should be at least as large as the largest
+// single request, otherwise every request has to wait.
+func New(bytesPerSec int64, burst int) *Limiter {
+	if bytesPerSec <= 0 {
+		panic("ratelimit: bytesPerSec must be positive")
+	}
+	if burst <= 0 {
+		panic("ratelimit: burst must be positive")
+	}
+	return &Limiter{
+		rate:   float64(bytesPerSec),
+		burst:  float64(burst),
+		tokens: float64(burst),
+		last:   time.Now(),
+	}
+}
+
+// Wait blocks until "n" bytes may pass. Calling Wait on a nil Limiter returns
+// immediately, so callers do not have to check if limiting is enabled.
+func (l *Limiter) Wait(n int) {
+	if l == nil || n <= 0 {
+		return
+	}
+	time.Sleep(l.reserve(n, time.Now()))
+}
+
+// reserve takes "n" tokens out of the bucket and returns how long the caller
+// has to wait until the bucket is no longer in debt.
+func (l *Limiter) reserve(n int, now time.Time) time.Duration {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	elapsed := now.Sub(l.last)
+	if elapsed > 0 {
+		l.tokens += elapsed.Seconds() * l.rate
+		if l.tokens > l.burst {
+			l.tokens = l.burst
+		}
+		l.last = now
+	}
+	l.tokens -= float64(n)
+	if l.tokens >= 0 {
+		return 0
+	}
+	return time.Duration(-l.tokens / l.rate * float64(time.Second))
+}
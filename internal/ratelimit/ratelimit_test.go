@@ -0,0 +1,64 @@
+package ratelimit
+
+import (
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestNilLimiter(t *testing.T) {
+	var l *Limiter
+	t0 := time.Now()
+	l.Wait(1 << 30)
+	if time.Since(t0) > 100*time.Millisecond {
+		t.Error("nil limiter should not block")
+	}
+}
+
+func TestReserve(t *testing.T) {
+	now := time.Now()
+	l := New(1000, 100)
+	l.last = now
+	// The initial burst passes without waiting
+	if d := l.reserve(100, now); d != 0 {
+		t.Errorf("burst: want 0, got %v", d)
+	}
+	// The bucket is empty now, 500 bytes at 1000 B/s take 500ms
+	if d := l.reserve(500, now); d != 500*time.Millisecond {
+		t.Errorf("want 500ms, got %v", d)
+	}
+	// After 2 seconds the debt has been paid off and the bucket is full
+	// again, but not more than "burst".
+	now = now.Add(2 * time.Second)
+	if d := l.reserve(100, now); d != 0 {
+		t.Errorf("refill: want 0, got %v", d)
+	}
+	if d := l.reserve(100, now); d != 100*time.Millisecond {
+		t.Errorf("burst cap: want 100ms, got %v", d)
+	}
+}
+
+// TestElapsed pushes 3x the rate through the limiter from several goroutines
+// and checks that it takes about 2 seconds (the first second's worth is the
+// initial burst).
+func TestElapsed(t *testing.T) {
+	const rate = 1024 * 1024
+	const chunk = 128 * 1024
+	l := New(rate, rate)
+	var wg sync.WaitGroup
+	t0 := time.Now()
+	for i := 0; i < 4; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for j := 0; j < 3*rate/chunk/4; j++ {
+				l.Wait(chunk)
+			}
+		}()
+	}
+	wg.Wait()
+	d := time.Since(t0)
+	if d < 1800*time.Millisecond || d > 3*time.Second {
+		t.Errorf("expected about 2s, took %v", d)
+	}
+}
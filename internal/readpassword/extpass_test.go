@@ -83,3 +83,27 @@ func TestExtpassEmpty(t *testing.T) {
 	}
 	t.Fatal("empty password should have failed")
 }
+
+// Only the first line of the extpass output is used
+func TestExtpassFirstLine(t *testing.T) {
+	p1 := "first"
+	p2 := string(readPasswordExtpass([]string{"printf", "first\nsecond\n"}))
+	if p1 != p2 {
+		t.Errorf("p1=%q != p2=%q", p1, p2)
+	}
+}
+
+// When extpass exits nonzero, we should crash, even if it printed a password.
+func TestExtpassNonzeroExit(t *testing.T) {
+	if os.Getenv("TEST_SLAVE") == "1" {
+		readPasswordExtpass([]string{"sh", "-c", "echo test; exit 1"})
+		return
+	}
+	cmd := exec.Command(os.Args[0], "-test.run=TestExtpassNonzeroExit$")
+	cmd.Env = append(os.Environ(), "TEST_SLAVE=1")
+	err := cmd.Run()
+	if err != nil {
+		return
+	}
+	t.Fatal("nonzero exit status should have failed")
+}
@@ -0,0 +1,217 @@
+// Package snapshot copies a CIPHERDIR to a new location, using reflinks
+// where the filesystem supports them ("-snapshot").
+//
+// As the copy is a plain ciphertext copy, including gocryptfs.conf, it can be
+// mounted independently of the original.
+package snapshot
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"syscall"
+	"time"
+
+	"golang.org/x/sys/unix"
+
+	"github.com/rfjakob/gocryptfs/internal/syscallcompat"
+	"github.com/rfjakob/gocryptfs/internal/tlog"
+)
+
+// Copy copies the directory tree "src" to "dst", which must not exist yet.
+//
+// Regular files are reflinked if possible. If the filesystem does not support
+// reflinks, Copy logs a warning and falls back to copying the data, and
+// "reflinked" is false.
+//
+// Files that disappear while Copy is running are skipped. Copy does not
+// block writes, the caller has to take care of that.
+func Copy(src string, dst string) (reflinked bool, err error) {
+	return CopyDeadline(src, dst, time.Time{})
+}
+
+// ErrDeadline is returned by CopyDeadline when the copy did not finish in
+// time
+var ErrDeadline = errors.New("snapshot: deadline exceeded")
+
+// copyChunk is how much file data CopyDeadline copies between two deadline
+// checks
+const copyChunk = 1024 * 1024
+
+// CopyDeadline is Copy, but gives up with ErrDeadline once "deadline" has
+// passed, and removes the partial copy. The zero time means no deadline.
+func CopyDeadline(src string, dst string, deadline time.Time) (reflinked bool, err error) {
+	src, err = filepath.Abs(src)
+	if err != nil {
+		return false, err
+	}
+	dst, err = filepath.Abs(dst)
+	if err != nil {
+		return false, err
+	}
+	if dst == src || strings.HasPrefix(dst, src+"/") {
+		return false, fmt.Errorf("snapshot destination %q is inside %q", dst, src)
+	}
+	srcfd, err := syscall.Open(src, syscall.O_RDONLY|syscall.O_DIRECTORY, 0)
+	if err != nil {
+		return false, &os.PathError{Op: "open", Path: src, Err: err}
+	}
+	defer syscall.Close(srcfd)
+	var st unix.Stat_t
+	if err = unix.Fstat(srcfd, &st); err != nil {
+		return false, err
+	}
+	// Owner needs rwx so we can fill the directory. The final permissions
+	// are set when it is done.
+	if err = os.Mkdir(dst, 0700); err != nil {
+		return false, err
+	}
+	dstfd, err := syscall.Open(dst, syscall.O_RDONLY|syscall.O_DIRECTORY, 0)
+	if err != nil {
+		return false, err
+	}
+	defer syscall.Close(dstfd)
+	c := copier{
+		reflinked: true,
+		deadline:  deadline,
+	}
+	err = c.copyDir(srcfd, dstfd, "", &st)
+	if err == ErrDeadline {
+		os.RemoveAll(dst)
+	}
+	if err != nil {
+		return false, err
+	}
+	return c.reflinked, nil
+}
+
+type copier struct {
+	// reflinked is reset to false once a reflink fails
+	reflinked bool
+	// deadline is the zero time if there is none
+	deadline time.Time
+}
+
+// expired returns true once the deadline has passed
+func (c *copier) expired() bool {
+	return !c.deadline.IsZero() && time.Now().After(c.deadline)
+}
+
+// copyDir copies the contents of the directory "srcfd" to the empty
+// directory "dstfd". "rel" is the path relative to the source root, for
+// the warnings. The directories are opened relative to their parent, so this
+// also works when the absolute paths are longer than PATH_MAX.
+//
+// The permissions and times of "dstfd" are set to the ones in "st" last, as
+// filling it changes its mtime.
+func (c *copier) copyDir(srcfd int, dstfd int, rel string, st *unix.Stat_t) error {
+	entries, err := syscallcompat.Getdents(srcfd)
+	if err != nil {
+		return err
+	}
+	sort.Slice(entries, func(i, j int) bool { return entries[i].Name < entries[j].Name })
+	for _, e := range entries {
+		if c.expired() {
+			return ErrDeadline
+		}
+		err = c.copyEntry(srcfd, dstfd, e.Name, filepath.Join(rel, e.Name))
+		if err == syscall.ENOENT {
+			// Deleted while we were looking at it
+			continue
+		} else if err != nil {
+			return err
+		}
+	}
+	if err = syscall.Fchmod(dstfd, uint32(st.Mode)&0777); err != nil {
+		return err
+	}
+	mtime := time.Unix(st.Mtim.Unix())
+	return syscallcompat.FutimesNano(dstfd, &mtime, &mtime)
+}
+
+// copyEntry copies "name" in the directory "srcfd" to the directory "dstfd"
+func (c *copier) copyEntry(srcfd int, dstfd int, name string, rel string) error {
+	var st unix.Stat_t
+	if err := syscallcompat.Fstatat(srcfd, name, &st, unix.AT_SYMLINK_NOFOLLOW); err != nil {
+		return err
+	}
+	switch st.Mode & syscall.S_IFMT {
+	case syscall.S_IFDIR:
+		child, err := syscallcompat.Openat(srcfd, name, syscall.O_RDONLY|syscall.O_DIRECTORY|syscall.O_NOFOLLOW, 0)
+		if err != nil {
+			return err
+		}
+		defer syscall.Close(child)
+		if err = syscallcompat.Mkdirat(dstfd, name, 0700); err != nil {
+			return err
+		}
+		dstChild, err := syscallcompat.Openat(dstfd, name, syscall.O_RDONLY|syscall.O_DIRECTORY|syscall.O_NOFOLLOW, 0)
+		if err != nil {
+			return err
+		}
+		defer syscall.Close(dstChild)
+		return c.copyDir(child, dstChild, rel, &st)
+	case syscall.S_IFREG:
+		return c.copyFile(srcfd, dstfd, name, &st)
+	case syscall.S_IFLNK:
+		target, err := syscallcompat.Readlinkat(srcfd, name)
+		if err != nil {
+			return err
+		}
+		return syscallcompat.Symlinkat(target, dstfd, name)
+	case syscall.S_IFSOCK:
+		tlog.Warn.Printf("snapshot: skipping socket %q", rel)
+		return nil
+	default:
+		// Device nodes and fifos
+		return syscallcompat.Mknodat(dstfd, name, uint32(st.Mode), int(st.Rdev))
+	}
+}
+
+// copyFile reflinks or copies the regular file "name" in "srcfd" to "dstfd".
+func (c *copier) copyFile(srcfd int, dstfd int, name string, st *unix.Stat_t) error {
+	inFd, err := syscallcompat.Openat(srcfd, name, syscall.O_RDONLY|syscall.O_NOFOLLOW, 0)
+	if err != nil {
+		return err
+	}
+	in := os.NewFile(uintptr(inFd), name)
+	defer in.Close()
+	outFd, err := syscallcompat.Openat(dstfd, name, syscall.O_WRONLY|syscall.O_CREAT|syscall.O_EXCL, 0600)
+	if err != nil {
+		return err
+	}
+	out := os.NewFile(uintptr(outFd), name)
+	defer out.Close()
+	if c.reflinked {
+		err = syscallcompat.Reflink(outFd, inFd)
+		if err != nil {
+			tlog.Debug.Printf("snapshot: reflink not possible (%v), falling back to a full copy", err)
+			c.reflinked = false
+		}
+	}
+	if !c.reflinked {
+		for {
+			if c.expired() {
+				return ErrDeadline
+			}
+			_, err = io.CopyN(out, in, copyChunk)
+			if err == io.EOF {
+				break
+			} else if err != nil {
+				return err
+			}
+		}
+	}
+	if err = syscall.Fchmod(outFd, uint32(st.Mode)&0777); err != nil {
+		return err
+	}
+	mtime := time.Unix(st.Mtim.Unix())
+	if err = syscallcompat.FutimesNano(outFd, &mtime, &mtime); err != nil {
+		return err
+	}
+	return out.Close()
+}
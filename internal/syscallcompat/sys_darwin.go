@@ -21,9 +21,20 @@ const (
 	// O_PATH is only defined on Linux
 	O_PATH = 0
 
+	// O_NOATIME is only defined on Linux
+	O_NOATIME = 0
+
 	// RENAME_NOREPLACE is only defined on Linux
 	RENAME_NOREPLACE = 0
 
+	// RENAME_EXCHANGE is only defined on Linux
+	RENAME_EXCHANGE = 0
+
+	// SEEK_DATA and SEEK_HOLE are the lseek(2) "whence" values for sparse
+	// files. MacOS has them the other way round than Linux.
+	SEEK_HOLE = 3
+	SEEK_DATA = 4
+
 	// KAUTH_UID_NONE and KAUTH_GID_NONE are special values to
 	// revert permissions to the process credentials.
 	KAUTH_UID_NONE = ^uint32(0) - 100
@@ -69,6 +80,12 @@ func Fallocate(fd int, mode uint32, off int64, len int64) error {
 	return syscall.EOPNOTSUPP
 }
 
+// Reflink is not implemented on Darwin. APFS has clonefile(2), but it works
+// on paths, not file descriptors.
+func Reflink(dstFd int, srcFd int) error {
+	return syscall.EOPNOTSUPP
+}
+
 // Dup3 is not available on Darwin, so we use Dup2 instead.
 func Dup3(oldfd int, newfd int, flags int) (err error) {
 	if flags != 0 {
@@ -100,6 +117,21 @@ func Mknodat(dirfd int, path string, mode uint32, dev int) (err error) {
 	return emulateMknodat(dirfd, path, mode, dev)
 }
 
+func FaccessatUser(dirfd int, path string, mode uint32, context *fuse.Context) (err error) {
+	if context != nil {
+		runtime.LockOSThread()
+		defer runtime.UnlockOSThread()
+
+		err = pthread_setugid_np(context.Owner.Uid, context.Owner.Gid)
+		if err != nil {
+			return err
+		}
+		defer pthread_setugid_np(KAUTH_UID_NONE, KAUTH_GID_NONE)
+	}
+
+	return Faccessat(dirfd, path, mode)
+}
+
 func MknodatUser(dirfd int, path string, mode uint32, dev int, context *fuse.Context) (err error) {
 	if context != nil {
 		runtime.LockOSThread()
@@ -189,6 +221,13 @@ func FutimesNano(fd int, a *time.Time, m *time.Time) (err error) {
 // ignores the provided 'dirfd'. In addition, it also lacks handling of 'nil'
 // pointers (used to preserve one of both timestamps).
 func UtimesNanoAtNofollow(dirfd int, path string, a *time.Time, m *time.Time) (err error) {
+	attrList, attributes := timesToAttrList(a, m)
+	return setattrlistAtNofollow(dirfd, path, &attrList, unsafe.Pointer(&attributes), unsafe.Sizeof(attributes))
+}
+
+// setattrlistAtNofollow is setattrlist(2) relative to "dirfd". Never follows
+// symlinks.
+func setattrlistAtNofollow(dirfd int, path string, attrList *attrList, buf unsafe.Pointer, size uintptr) (err error) {
 	if !filepath.IsAbs(path) {
 		chdirMutex.Lock()
 		defer chdirMutex.Unlock()
@@ -210,16 +249,58 @@ func UtimesNanoAtNofollow(dirfd int, path string, a *time.Time, m *time.Time) (e
 		return err
 	}
 
-	attrList, attributes := timesToAttrList(a, m)
-	return setattrlist(_p0, unsafe.Pointer(&attrList), unsafe.Pointer(&attributes),
-		unsafe.Sizeof(attributes), unix.FSOPT_NOFOLLOW)
+	return setattrlist(_p0, unsafe.Pointer(attrList), buf, size, unix.FSOPT_NOFOLLOW)
+}
+
+// FillBtime copies the birth time from "st" to "a".
+func FillBtime(a *fuse.Attr, st *syscall.Stat_t) {
+	a.Crtime_ = uint64(st.Birthtimespec.Sec)
+	a.Crtimensec_ = uint32(st.Birthtimespec.Nsec)
+}
+
+// GetBtime returns the birth time that a SETATTR request wants to set.
+func GetBtime(in *fuse.SetAttrIn) (btime time.Time, ok bool) {
+	if in.Valid&fuse.FATTR_CRTIME == 0 {
+		return time.Time{}, false
+	}
+	return time.Unix(int64(in.Crtime), int64(in.CrtimeNsec)), true
+}
+
+// SetBtime adds the birth time from "st" to the SETATTR request "in".
+func SetBtime(in *fuse.SetAttrIn, st *unix.Stat_t) {
+	in.Valid |= fuse.FATTR_CRTIME
+	in.Crtime, in.CrtimeNsec = uint64(st.Btim.Sec), uint32(st.Btim.Nsec)
+}
+
+func btimeToAttrList(btime time.Time) (attrList, unix.Timespec) {
+	attrList := attrList{bitmapCount: unix.ATTR_BIT_MAP_COUNT, CommonAttr: unix.ATTR_CMN_CRTIME}
+	return attrList, unix.NsecToTimespec(btime.UnixNano())
+}
+
+// FutimesBtime sets the birth time of "fd".
+func FutimesBtime(fd int, btime time.Time) error {
+	attrList, ts := btimeToAttrList(btime)
+	return fsetattrlist(fd, unsafe.Pointer(&attrList), unsafe.Pointer(&ts), unsafe.Sizeof(ts), 0)
+}
+
+// UtimesBtimeAtNofollow sets the birth time of "path" relative to "dirfd".
+// Never follows symlinks.
+func UtimesBtimeAtNofollow(dirfd int, path string, btime time.Time) error {
+	attrList, ts := btimeToAttrList(btime)
+	return setattrlistAtNofollow(dirfd, path, &attrList, unsafe.Pointer(&ts), unsafe.Sizeof(ts))
 }
 
 func Getdents(fd int) ([]fuse.DirEntry, error) {
 	return emulateGetdents(fd)
 }
 
-// Renameat2 does not exist on Darwin, so we call Renameat and ignore the flags.
+// Renameat2 does not exist on Darwin, so we call Renameat. The kernel never
+// passes flags on MacOS, and RENAME_NOREPLACE and RENAME_EXCHANGE are zero
+// here, so a caller that asks for anything else gets EINVAL instead of a
+// rename that silently ignores the flags.
 func Renameat2(olddirfd int, oldpath string, newdirfd int, newpath string, flags uint) (err error) {
+	if flags != 0 {
+		return syscall.EINVAL
+	}
 	return unix.Renameat(olddirfd, oldpath, newdirfd, newpath)
 }
@@ -28,8 +28,19 @@ const (
 	// O_PATH is only defined on Linux
 	O_PATH = unix.O_PATH
 
+	// O_NOATIME is only defined on Linux
+	O_NOATIME = unix.O_NOATIME
+
 	// RENAME_NOREPLACE is only defined on Linux
 	RENAME_NOREPLACE = unix.RENAME_NOREPLACE
+
+	// RENAME_EXCHANGE is only defined on Linux
+	RENAME_EXCHANGE = unix.RENAME_EXCHANGE
+
+	// SEEK_DATA and SEEK_HOLE are the lseek(2) "whence" values for sparse
+	// files. Not in our version of x/sys/unix.
+	SEEK_DATA = 3
+	SEEK_HOLE = 4
 )
 
 var preallocWarn sync.Once
@@ -65,6 +76,21 @@ func Fallocate(fd int, mode uint32, off int64, len int64) (err error) {
 	return syscall.Fallocate(fd, mode, off, len)
 }
 
+// _FICLONE is defined in linux/fs.h
+const _FICLONE = 0x40049409
+
+// Reflink makes "dstFd" share the data blocks of "srcFd" (ioctl FICLONE).
+// Only filesystems like btrfs and XFS support this. Others return
+// EOPNOTSUPP or EINVAL, and EXDEV is returned if the files are on different
+// filesystems.
+func Reflink(dstFd int, srcFd int) error {
+	_, _, errno := unix.Syscall(unix.SYS_IOCTL, uintptr(dstFd), _FICLONE, uintptr(srcFd))
+	if errno != 0 {
+		return errno
+	}
+	return nil
+}
+
 func getSupplementaryGroups(pid uint32) (gids []int) {
 	procPath := fmt.Sprintf("/proc/%d/task/%d/status", pid, pid)
 	blob, err := ioutil.ReadFile(procPath)
@@ -164,6 +190,38 @@ func MknodatUser(dirfd int, path string, mode uint32, dev int, context *fuse.Con
 	return Mknodat(dirfd, path, mode, dev)
 }
 
+// FaccessatUser runs Faccessat in the context of a different user.
+//
+// Like OpenatUser(), but faccessat(2) checks the real uid and gid instead of
+// the effective ones, so those are switched. The saved and the effective uid
+// stay 0, which allows us to switch back.
+func FaccessatUser(dirfd int, path string, mode uint32, context *fuse.Context) (err error) {
+	if context != nil {
+		runtime.LockOSThread()
+		defer runtime.UnlockOSThread()
+
+		err = unix.Setgroups(getSupplementaryGroups(context.Pid))
+		if err != nil {
+			return err
+		}
+		defer unix.Setgroups(nil)
+
+		err = unix.Setresgid(int(context.Owner.Gid), -1, -1)
+		if err != nil {
+			return err
+		}
+		defer unix.Setresgid(0, -1, -1)
+
+		err = unix.Setresuid(int(context.Owner.Uid), -1, -1)
+		if err != nil {
+			return err
+		}
+		defer unix.Setresuid(0, -1, -1)
+	}
+
+	return Faccessat(dirfd, path, mode)
+}
+
 // Dup3 wraps the Dup3 syscall. We want to use Dup3 rather than Dup2 because Dup2
 // is not implemented on arm64.
 func Dup3(oldfd int, newfd int, flags int) (err error) {
@@ -290,16 +348,90 @@ func UtimesNanoAtNofollow(dirfd int, path string, a *time.Time, m *time.Time) (e
 	return err
 }
 
+// FillBtime would copy the birth time from "st" to "a", but the FUSE
+// protocol on Linux has no birth time in the attributes. Stat_t does not
+// have it either, only statx(2). No-op.
+func FillBtime(a *fuse.Attr, st *syscall.Stat_t) {}
+
+// GetBtime returns the birth time that a SETATTR request wants to set.
+// Linux never sends one.
+func GetBtime(in *fuse.SetAttrIn) (btime time.Time, ok bool) {
+	return time.Time{}, false
+}
+
+// SetBtime would add the birth time from "st" to the SETATTR request "in".
+// No-op, see FillBtime.
+func SetBtime(in *fuse.SetAttrIn, st *unix.Stat_t) {}
+
+// FutimesBtime is not supported on Linux, the birth time cannot be changed.
+func FutimesBtime(fd int, btime time.Time) error {
+	return syscall.EOPNOTSUPP
+}
+
+// UtimesBtimeAtNofollow is not supported on Linux, see FutimesBtime.
+func UtimesBtimeAtNofollow(dirfd int, path string, btime time.Time) error {
+	return syscall.EOPNOTSUPP
+}
+
 // Getdents syscall.
 func Getdents(fd int) ([]fuse.DirEntry, error) {
 	return getdents(fd)
 }
 
+// renameat2 is the raw syscall, overridden in tests
+var renameat2 = unix.Renameat2
+
 // Renameat2 does not exist on Darwin, so we have to wrap it here.
 // Retries on EINTR.
+//
+// Kernels older than 3.15 and some filesystems do not support the flags.
+// RENAME_NOREPLACE is then emulated for non-directories, see
+// renameNoReplaceFallback. RENAME_EXCHANGE cannot be emulated atomically and
+// fails with EINVAL.
 func Renameat2(olddirfd int, oldpath string, newdirfd int, newpath string, flags uint) (err error) {
 	err = retryEINTR(func() error {
-		return unix.Renameat2(olddirfd, oldpath, newdirfd, newpath, flags)
+		return renameat2(olddirfd, oldpath, newdirfd, newpath, flags)
 	})
-	return err
+	if flags == 0 || (err != syscall.EINVAL && err != syscall.ENOSYS) {
+		return err
+	}
+	if flags == RENAME_NOREPLACE {
+		return renameNoReplaceFallback(olddirfd, oldpath, newdirfd, newpath, err)
+	}
+	if flags&RENAME_EXCHANGE != 0 {
+		tlog.Warn.Printf("Renameat2: the backing filesystem does not support RENAME_EXCHANGE (%v), cannot swap %q and %q atomically",
+			err, oldpath, newpath)
+	}
+	return syscall.EINVAL
+}
+
+// renameNoReplaceFallback emulates RENAME_NOREPLACE with linkat+unlinkat.
+// linkat fails with EEXIST if "newpath" exists, so there is no window where
+// an existing target could be replaced. Directories cannot be hard-linked,
+// and renaming them without the flag could replace an empty directory, so
+// they fail with "origErr" (the error from renameat2).
+func renameNoReplaceFallback(olddirfd int, oldpath string, newdirfd int, newpath string, origErr error) error {
+	var st unix.Stat_t
+	err := retryEINTR(func() error {
+		return unix.Fstatat(olddirfd, oldpath, &st, unix.AT_SYMLINK_NOFOLLOW)
+	})
+	if err != nil {
+		return err
+	}
+	if st.Mode&syscall.S_IFMT == syscall.S_IFDIR {
+		tlog.Warn.Printf("Renameat2: the backing filesystem does not support RENAME_NOREPLACE (%v), cannot rename directory %q safely",
+			origErr, oldpath)
+		return origErr
+	}
+	err = retryEINTR(func() error {
+		return unix.Linkat(olddirfd, oldpath, newdirfd, newpath, 0)
+	})
+	if err == syscall.EEXIST {
+		return err
+	} else if err != nil {
+		tlog.Warn.Printf("Renameat2: the backing filesystem does not support RENAME_NOREPLACE (%v) and linkat failed: %v",
+			origErr, err)
+		return origErr
+	}
+	return Unlinkat(olddirfd, oldpath, 0)
 }
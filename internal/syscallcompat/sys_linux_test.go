@@ -0,0 +1,66 @@
+package syscallcompat
+
+import (
+	"io/ioutil"
+	"os"
+	"syscall"
+	"testing"
+)
+
+// TestRenameat2Fallback checks the emulation of the renameat2 flags on
+// filesystems that do not support them.
+func TestRenameat2Fallback(t *testing.T) {
+	orig := renameat2
+	renameat2 = func(int, string, int, string, uint) error {
+		return syscall.EINVAL
+	}
+	defer func() {
+		renameat2 = orig
+	}()
+	dir, err := ioutil.TempDir(tmpDir, "renameat2")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, n := range []string{"a", "b"} {
+		if err = ioutil.WriteFile(dir+"/"+n, []byte(n), 0600); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err = os.Mkdir(dir+"/dir", 0700); err != nil {
+		t.Fatal(err)
+	}
+	dirf, err := os.Open(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer dirf.Close()
+	dirfd := int(dirf.Fd())
+
+	// Existing target is not replaced
+	if err = Renameat2(dirfd, "a", dirfd, "b", RENAME_NOREPLACE); err != syscall.EEXIST {
+		t.Errorf("want EEXIST, got %v", err)
+	}
+	if content, _ := ioutil.ReadFile(dir + "/b"); string(content) != "b" {
+		t.Errorf("target was modified: %q", content)
+	}
+	// New target works like rename
+	if err = Renameat2(dirfd, "a", dirfd, "c", RENAME_NOREPLACE); err != nil {
+		t.Fatal(err)
+	}
+	if _, err = os.Stat(dir + "/a"); !os.IsNotExist(err) {
+		t.Errorf("source still exists: %v", err)
+	}
+	if content, _ := ioutil.ReadFile(dir + "/c"); string(content) != "a" {
+		t.Errorf("wrong content after rename: %q", content)
+	}
+	// Directories and RENAME_EXCHANGE cannot be emulated
+	if err = Renameat2(dirfd, "dir", dirfd, "dir2", RENAME_NOREPLACE); err != syscall.EINVAL {
+		t.Errorf("directory: want EINVAL, got %v", err)
+	}
+	if err = Renameat2(dirfd, "b", dirfd, "c", RENAME_EXCHANGE); err != syscall.EINVAL {
+		t.Errorf("exchange: want EINVAL, got %v", err)
+	}
+	if content, _ := ioutil.ReadFile(dir + "/c"); string(content) != "a" {
+		t.Errorf("failed exchange modified the target: %q", content)
+	}
+}
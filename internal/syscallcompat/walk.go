@@ -0,0 +1,73 @@
+package syscallcompat
+
+import (
+	"path/filepath"
+	"sort"
+	"syscall"
+
+	"github.com/hanwen/go-fuse/v2/fuse"
+)
+
+// WalkFunc is called by Walkat for every entry below the start directory.
+// The entry is "name" in the directory "dirfd", "rel" is its path relative to
+// the start directory. "mode" holds the S_IFMT bits.
+//
+// It is called again for a directory if it could not be opened or read, with
+// "err" set. Returning an error stops the walk, returning nil skips the
+// directory.
+type WalkFunc func(dirfd int, name string, rel string, mode uint32, err error) error
+
+// Walkat walks the directory tree below "dirfd" like filepath.Walk, in
+// lexical order, but opens each directory relative to its parent. Unlike
+// filepath.Walk, it also works when the absolute paths are longer than
+// PATH_MAX. Symlinks are not followed. An error is only returned if "dirfd"
+// itself cannot be read, or if "fn" returns one.
+func Walkat(dirfd int, fn WalkFunc) error {
+	entries, err := Getdents(dirfd)
+	if err != nil {
+		return err
+	}
+	return walkEntries(dirfd, "", entries, fn)
+}
+
+func walkEntries(dirfd int, rel string, entries []fuse.DirEntry, fn WalkFunc) error {
+	sort.Slice(entries, func(i, j int) bool { return entries[i].Name < entries[j].Name })
+	for _, e := range entries {
+		childRel := filepath.Join(rel, e.Name)
+		mode := e.Mode & syscall.S_IFMT
+		if err := fn(dirfd, e.Name, childRel, mode, nil); err != nil {
+			return err
+		}
+		if mode != syscall.S_IFDIR {
+			continue
+		}
+		child, childEntries, err := readDirAt(dirfd, e.Name)
+		if err != nil {
+			if err = fn(dirfd, e.Name, childRel, mode, err); err != nil {
+				return err
+			}
+			continue
+		}
+		err = walkEntries(child, childRel, childEntries, fn)
+		syscall.Close(child)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// readDirAt opens the directory "name" in "dirfd" and reads its entries.
+// The caller must close "fd".
+func readDirAt(dirfd int, name string) (fd int, entries []fuse.DirEntry, err error) {
+	fd, err = Openat(dirfd, name, syscall.O_RDONLY|syscall.O_DIRECTORY|syscall.O_NOFOLLOW, 0)
+	if err != nil {
+		return -1, nil, err
+	}
+	entries, err = Getdents(fd)
+	if err != nil {
+		syscall.Close(fd)
+		return -1, nil, err
+	}
+	return fd, entries, nil
+}
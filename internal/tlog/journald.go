@@ -0,0 +1,113 @@
+package tlog
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"log"
+	"net"
+	"sort"
+	"strings"
+)
+
+// SyslogTag is the tag of our syslog messages, and the SYSLOG_IDENTIFIER of
+// our journald messages. Set via "-syslog_tag".
+var SyslogTag = ProgramName
+
+// journalSocket is where journald receives messages in its native protocol,
+// see https://systemd.io/JOURNAL_NATIVE_PROTOCOL/
+var journalSocket = "/run/systemd/journal/socket"
+
+// Message priorities as defined in syslog(3)
+const (
+	JournalCrit    = 2
+	JournalWarning = 4
+	JournalInfo    = 6
+	JournalDebug   = 7
+)
+
+// journalWriter sends each Write to journald as one entry. A log.Logger
+// calls Write once per message.
+type journalWriter struct {
+	conn *net.UnixConn
+	// header are the fields that are the same for all entries, already
+	// serialized
+	header []byte
+}
+
+// newJournalWriter connects to journald. All entries get "priority", the
+// SyslogTag and "fields".
+func newJournalWriter(priority int, fields map[string]string) (*journalWriter, error) {
+	conn, err := net.DialUnix("unixgram", nil, &net.UnixAddr{Name: journalSocket, Net: "unixgram"})
+	if err != nil {
+		return nil, err
+	}
+	var b bytes.Buffer
+	appendJournalField(&b, "PRIORITY", fmt.Sprint(priority))
+	appendJournalField(&b, "SYSLOG_IDENTIFIER", SyslogTag)
+	// Sorted so that the entries are reproducible
+	keys := make([]string, 0, len(fields))
+	for k := range fields {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	for _, k := range keys {
+		appendJournalField(&b, k, fields[k])
+	}
+	return &journalWriter{conn: conn, header: b.Bytes()}, nil
+}
+
+func (w *journalWriter) Write(p []byte) (int, error) {
+	b := bytes.NewBuffer(append([]byte(nil), w.header...))
+	appendJournalField(b, "MESSAGE", trimNewline(string(p)))
+	if _, err := w.conn.Write(b.Bytes()); err != nil {
+		return 0, err
+	}
+	return len(p), nil
+}
+
+// appendJournalField serializes one field. Values that contain a newline
+// are length-prefixed.
+func appendJournalField(b *bytes.Buffer, key string, value string) {
+	b.WriteString(key)
+	if !strings.Contains(value, "\n") {
+		b.WriteByte('=')
+		b.WriteString(value)
+		b.WriteByte('\n')
+		return
+	}
+	b.WriteByte('\n')
+	binary.Write(b, binary.LittleEndian, uint64(len(value)))
+	b.WriteString(value)
+	b.WriteByte('\n')
+}
+
+// SwitchToJournald redirects the output of this logger to journald with
+// "priority" and the additional "fields", which must be valid journal field
+// names (uppercase letters, digits and underscores).
+func (l *toggledLogger) SwitchToJournald(priority int, fields map[string]string) error {
+	w, err := newJournalWriter(priority, fields)
+	if err != nil {
+		return err
+	}
+	l.Logger.SetOutput(w)
+	// journald adds the time itself
+	l.Logger.SetFlags(0)
+	// Disable colors
+	l.prefix = ""
+	l.postfix = ""
+	return nil
+}
+
+// SwitchLoggerToJournald redirects the default log.Logger to journald, like
+// SwitchLoggerToSyslog.
+func SwitchLoggerToJournald(priority int, fields map[string]string) error {
+	w, err := newJournalWriter(priority, fields)
+	if err != nil {
+		return err
+	}
+	log.SetPrefix("go-fuse: ")
+	log.SetFlags(0)
+	log.SetOutput(w)
+	return nil
+}
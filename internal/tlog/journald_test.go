@@ -0,0 +1,97 @@
+package tlog
+
+import (
+	"bytes"
+	"encoding/binary"
+	"io/ioutil"
+	"log"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// parseJournalEntry parses the native journald protocol
+func parseJournalEntry(t *testing.T, b []byte) map[string]string {
+	fields := make(map[string]string)
+	for len(b) > 0 {
+		nl := bytes.IndexByte(b, '\n')
+		if nl < 0 {
+			t.Fatalf("unterminated field %q", b)
+		}
+		line := b[:nl]
+		b = b[nl+1:]
+		if eq := bytes.IndexByte(line, '='); eq >= 0 {
+			fields[string(line[:eq])] = string(line[eq+1:])
+			continue
+		}
+		// Binary field: 64-bit length, value, newline
+		n := binary.LittleEndian.Uint64(b[:8])
+		fields[string(line)] = string(b[8 : 8+n])
+		b = b[8+n+1:]
+	}
+	return fields
+}
+
+// TestJournald connects a logger to a fake journald socket and checks the
+// fields of the entries it sends.
+func TestJournald(t *testing.T) {
+	dir, err := ioutil.TempDir("", "tlog_journald")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	oldSocket, oldTag := journalSocket, SyslogTag
+	defer func() { journalSocket, SyslogTag = oldSocket, oldTag }()
+	journalSocket = filepath.Join(dir, "socket")
+	SyslogTag = "gocryptfs-home"
+	server, err := net.ListenUnixgram("unixgram", &net.UnixAddr{Name: journalSocket, Net: "unixgram"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer server.Close()
+	receive := func() map[string]string {
+		buf := make([]byte, 4096)
+		n, err := server.Read(buf)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return parseJournalEntry(t, buf[:n])
+	}
+
+	l := &toggledLogger{
+		Enabled: true,
+		Logger:  log.New(os.Stderr, "", log.LstdFlags),
+		prefix:  ColorYellow,
+		postfix: ColorReset,
+	}
+	if err = l.SwitchToJournald(JournalWarning, map[string]string{"GOCRYPTFS_MOUNTPOINT": "/mnt/home"}); err != nil {
+		t.Fatal(err)
+	}
+	l.Printf("disk %s\n", "full")
+	want := map[string]string{
+		"PRIORITY":             "4",
+		"SYSLOG_IDENTIFIER":    "gocryptfs-home",
+		"GOCRYPTFS_MOUNTPOINT": "/mnt/home",
+		"MESSAGE":              "disk full",
+	}
+	have := receive()
+	for k, v := range want {
+		if have[k] != v {
+			t.Errorf("%s: have %q, want %q", k, have[k], v)
+		}
+	}
+	if len(have) != len(want) {
+		t.Errorf("unexpected fields: %v", have)
+	}
+
+	l.Println("line 1\nline 2")
+	if have := receive()["MESSAGE"]; have != "line 1\nline 2" {
+		t.Errorf("multi-line message: have %q", have)
+	}
+
+	journalSocket = filepath.Join(dir, "missing")
+	if err = l.SwitchToJournald(JournalInfo, nil); err == nil {
+		t.Error("switching to a journald that is not running should fail")
+	}
+}
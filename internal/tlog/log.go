@@ -137,7 +137,7 @@ func init() {
 
 // SwitchToSyslog redirects the output of this logger to syslog.
 func (l *toggledLogger) SwitchToSyslog(p syslog.Priority) {
-	w, err := syslog.New(p, ProgramName)
+	w, err := syslog.New(p, SyslogTag)
 	if err != nil {
 		Warn.Printf("SwitchToSyslog: %v", err)
 	} else {
@@ -151,7 +151,7 @@ func (l *toggledLogger) SwitchToSyslog(p syslog.Priority) {
 // SwitchLoggerToSyslog redirects the default log.Logger that the go-fuse lib uses
 // to syslog.
 func SwitchLoggerToSyslog(p syslog.Priority) {
-	w, err := syslog.New(p, ProgramName)
+	w, err := syslog.New(p, SyslogTag)
 	if err != nil {
 		Warn.Printf("SwitchLoggerToSyslog: %v", err)
 	} else {
@@ -0,0 +1,69 @@
+package tlog
+
+import (
+	"fmt"
+	"sync"
+	"time"
+)
+
+// RateLimitBurst is how many messages a RateLimiter lets through per second
+const RateLimitBurst = 5
+
+// RateLimiter caps how often a class of messages is logged through
+// PrintfLimited, for errors that can repeat very fast, like a
+// corrupt block that an application reads in a loop. The zero value is ready
+// to use.
+//
+// Suppressed messages are counted, and the count is appended to the next
+// message that gets through.
+type RateLimiter struct {
+	mu sync.Mutex
+	// windowStart is when the current one-second window started
+	windowStart time.Time
+	// printed is the number of messages let through in the current window
+	printed int
+	// suppressed is the number of messages dropped since the last one that
+	// was let through
+	suppressed int
+}
+
+// allow decides if a message at time "now" may be logged. If yes, it also
+// returns how many messages were dropped before it.
+func (r *RateLimiter) allow(now time.Time) (ok bool, suppressed int) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if now.Sub(r.windowStart) >= time.Second || now.Before(r.windowStart) {
+		r.windowStart = now
+		r.printed = 0
+	}
+	if r.printed >= RateLimitBurst {
+		r.suppressed++
+		return false, 0
+	}
+	r.printed++
+	suppressed = r.suppressed
+	r.suppressed = 0
+	return true, suppressed
+}
+
+// PrintfLimited is like Printf, but drops the message if "r" has already let
+// through RateLimitBurst messages in the last second. A nil "r" does not
+// limit anything.
+func (l *toggledLogger) PrintfLimited(r *RateLimiter, format string, v ...interface{}) {
+	if !l.Enabled {
+		return
+	}
+	if r == nil {
+		l.Printf(format, v...)
+		return
+	}
+	ok, suppressed := r.allow(time.Now())
+	if !ok {
+		return
+	}
+	msg := trimNewline(fmt.Sprintf(format, v...))
+	if suppressed > 0 {
+		msg += fmt.Sprintf(" (%d similar messages suppressed)", suppressed)
+	}
+	l.Printf("%s", msg)
+}
@@ -2,6 +2,7 @@ package tlog
 
 import (
 	"testing"
+	"time"
 )
 
 // Test that trimNewline() works as expected
@@ -24,3 +25,27 @@ func TestTrimNewline(t *testing.T) {
 		}
 	}
 }
+
+// TestRateLimiter checks that RateLimiter lets RateLimitBurst messages
+// through per second and reports how many it dropped.
+func TestRateLimiter(t *testing.T) {
+	var r RateLimiter
+	t0 := time.Now()
+	for i := 0; i < RateLimitBurst; i++ {
+		if ok, s := r.allow(t0); !ok || s != 0 {
+			t.Fatalf("message %d: want ok=true suppressed=0, have %v %d", i, ok, s)
+		}
+	}
+	for i := 0; i < 10; i++ {
+		if ok, _ := r.allow(t0.Add(999 * time.Millisecond)); ok {
+			t.Fatalf("message %d over the limit was let through", i)
+		}
+	}
+	// The next window reports the dropped messages once
+	if ok, s := r.allow(t0.Add(time.Second)); !ok || s != 10 {
+		t.Errorf("new window: want ok=true suppressed=10, have %v %d", ok, s)
+	}
+	if ok, s := r.allow(t0.Add(time.Second)); !ok || s != 0 {
+		t.Errorf("want ok=true suppressed=0, have %v %d", ok, s)
+	}
+}
@@ -0,0 +1,639 @@
+// Package webdavsrv serves the plaintext view of a gocryptfs filesystem over
+// WebDAV, for clients that cannot mount FUSE filesystems. It is activated by
+// passing "-webdav" on the command line.
+//
+// The fusefrontend node methods are called directly, like the kernel would
+// call them through a mount. Only regular files and directories are visible,
+// WebDAV has no way to represent symlinks or device nodes.
+package webdavsrv
+
+import (
+	"bufio"
+	"crypto/subtle"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"mime"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/hanwen/go-fuse/v2/fs"
+	"github.com/hanwen/go-fuse/v2/fuse"
+
+	"github.com/rfjakob/gocryptfs/internal/fusefrontend"
+	"github.com/rfjakob/gocryptfs/internal/tlog"
+)
+
+// Options configure the Server
+type Options struct {
+	// User and Password the clients must send via HTTP basic authentication
+	User, Password string
+	// ReadOnly rejects all requests that would change something
+	ReadOnly bool
+}
+
+// Server is an http.Handler that implements WebDAV class 1 (no locking) on
+// top of a fusefrontend.RootNode. The RootNode must be set up with
+// fs.NewNodeFS, but not be mounted.
+type Server struct {
+	rn   *fusefrontend.RootNode
+	opts Options
+}
+
+// New returns a Server for "rn"
+func New(rn *fusefrontend.RootNode, opts Options) *Server {
+	return &Server{rn: rn, opts: opts}
+}
+
+// ReadAuthFile reads the user name and password from the first line of
+// "filename", which must look like "USER:PASSWORD".
+func ReadAuthFile(filename string) (user string, password string, err error) {
+	f, err := os.Open(filename)
+	if err != nil {
+		return "", "", err
+	}
+	defer f.Close()
+	s := bufio.NewScanner(f)
+	s.Scan()
+	if err = s.Err(); err != nil {
+		return "", "", err
+	}
+	i := strings.IndexByte(s.Text(), ':')
+	if i < 1 || i == len(s.Text())-1 {
+		return "", "", fmt.Errorf("%s: first line must look like USER:PASSWORD", filename)
+	}
+	return s.Text()[:i], s.Text()[i+1:], nil
+}
+
+// ServeHTTP implements http.Handler
+func (s *Server) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	user, password, ok := r.BasicAuth()
+	// Compare both even if the first one does not match, to not leak which one
+	// was wrong through the timing
+	userOk := subtle.ConstantTimeCompare([]byte(user), []byte(s.opts.User))
+	passwordOk := subtle.ConstantTimeCompare([]byte(password), []byte(s.opts.Password))
+	if !ok || userOk&passwordOk != 1 {
+		w.Header().Set("WWW-Authenticate", `Basic realm="gocryptfs"`)
+		http.Error(w, "authentication required", http.StatusUnauthorized)
+		return
+	}
+	p := path.Clean("/" + r.URL.Path)
+	switch r.Method {
+	case "OPTIONS":
+		w.Header().Set("DAV", "1")
+		w.Header().Set("Allow", "OPTIONS, GET, HEAD, PUT, DELETE, MKCOL, MOVE, PROPFIND")
+		return
+	case "GET", "HEAD":
+		s.get(w, r, p)
+		return
+	case "PROPFIND":
+		s.propfind(w, r, p)
+		return
+	case "PUT", "DELETE", "MKCOL", "MOVE":
+		if s.opts.ReadOnly {
+			http.Error(w, "read-only", http.StatusForbidden)
+			return
+		}
+	default:
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	if p == "/" {
+		http.Error(w, "cannot change the root collection", http.StatusForbidden)
+		return
+	}
+	switch r.Method {
+	case "PUT":
+		s.put(w, r, p)
+	case "DELETE":
+		s.delete(w, p)
+	case "MKCOL":
+		s.mkcol(w, r, p)
+	case "MOVE":
+		s.move(w, r, p)
+	}
+}
+
+// lookup returns the node for the plaintext path "p", which must be clean and
+// absolute. New nodes are added to the inode tree, as the node methods find
+// the backing files through it.
+func (s *Server) lookup(p string) (*fusefrontend.Node, syscall.Errno) {
+	n := &s.rn.Node
+	if p == "/" {
+		return n, 0
+	}
+	for _, name := range strings.Split(p[1:], "/") {
+		var errno syscall.Errno
+		if n, errno = lookupChild(n, name); errno != 0 {
+			return nil, errno
+		}
+	}
+	return n, 0
+}
+
+// lookupChild returns the node for "name" in the directory "n"
+func lookupChild(n *fusefrontend.Node, name string) (*fusefrontend.Node, syscall.Errno) {
+	if ch := n.GetChild(name); ch != nil {
+		return ch.Operations().(*fusefrontend.Node), 0
+	}
+	ch, errno := n.Lookup(nil, name, &fuse.EntryOut{})
+	if errno != 0 {
+		return nil, errno
+	}
+	n.AddChild(name, ch, true)
+	return ch.Operations().(*fusefrontend.Node), 0
+}
+
+// lookupParent returns the node of the parent directory of "p" and the last
+// path component.
+func (s *Server) lookupParent(p string) (*fusefrontend.Node, string, syscall.Errno) {
+	dir, name := path.Split(p)
+	n, errno := s.lookup(path.Clean(dir))
+	if errno != 0 {
+		return nil, "", errno
+	}
+	return n, name, 0
+}
+
+func getattr(n *fusefrontend.Node) (fuse.Attr, syscall.Errno) {
+	var out fuse.AttrOut
+	errno := n.Getattr(nil, nil, &out)
+	return out.Attr, errno
+}
+
+func isDir(a *fuse.Attr) bool {
+	return a.Mode&syscall.S_IFMT == syscall.S_IFDIR
+}
+
+func isRegular(a *fuse.Attr) bool {
+	return a.Mode&syscall.S_IFMT == syscall.S_IFREG
+}
+
+// errnoStatus sends the HTTP status that matches "errno"
+func errnoStatus(w http.ResponseWriter, errno syscall.Errno) {
+	status := http.StatusInternalServerError
+	switch errno {
+	case syscall.ENOENT:
+		status = http.StatusNotFound
+	case syscall.EACCES, syscall.EPERM, syscall.EROFS:
+		status = http.StatusForbidden
+	case syscall.ENOTDIR:
+		status = http.StatusConflict
+	case syscall.ENOSPC, syscall.EDQUOT:
+		status = http.StatusInsufficientStorage
+	case syscall.ENAMETOOLONG:
+		status = http.StatusBadRequest
+	}
+	http.Error(w, errno.Error(), status)
+}
+
+// parseRange parses a "Range" header with a single range. Returns ok=false
+// if the whole file should be sent, because there is no header or it is one
+// we do not support (several ranges). Returns satisfiable=false if the range
+// lies outside the file.
+func parseRange(header string, size uint64) (off uint64, length uint64, ok bool, satisfiable bool) {
+	if !strings.HasPrefix(header, "bytes=") || strings.Contains(header, ",") {
+		return 0, 0, false, true
+	}
+	spec := strings.TrimSpace(header[len("bytes="):])
+	i := strings.IndexByte(spec, '-')
+	if i < 0 {
+		return 0, 0, false, true
+	}
+	first, last := spec[:i], spec[i+1:]
+	if first == "" {
+		// Suffix range: the last N bytes
+		n, err := strconv.ParseUint(last, 10, 64)
+		if err != nil {
+			return 0, 0, false, true
+		}
+		if n == 0 || size == 0 {
+			return 0, 0, true, false
+		}
+		if n > size {
+			n = size
+		}
+		return size - n, n, true, true
+	}
+	start, err := strconv.ParseUint(first, 10, 64)
+	if err != nil {
+		return 0, 0, false, true
+	}
+	end := size - 1
+	if last != "" {
+		end, err = strconv.ParseUint(last, 10, 64)
+		if err != nil || end < start {
+			return 0, 0, false, true
+		}
+		if end >= size {
+			end = size - 1
+		}
+	}
+	if start >= size {
+		return 0, 0, true, false
+	}
+	return start, end - start + 1, true, true
+}
+
+// get handles GET and HEAD. A "Range" header is served with partial Reads of
+// just the requested bytes, which only decrypt the blocks they touch.
+func (s *Server) get(w http.ResponseWriter, r *http.Request, p string) {
+	n, errno := s.lookup(p)
+	if errno != 0 {
+		errnoStatus(w, errno)
+		return
+	}
+	attr, errno := getattr(n)
+	if errno != 0 {
+		errnoStatus(w, errno)
+		return
+	}
+	if !isRegular(&attr) {
+		http.Error(w, "not a regular file", http.StatusMethodNotAllowed)
+		return
+	}
+	fh, _, errno := n.Open(nil, syscall.O_RDONLY)
+	if errno != 0 {
+		errnoStatus(w, errno)
+		return
+	}
+	f := fh.(*fusefrontend.File)
+	defer f.Release(nil)
+	// Stat through the open file, the size may have changed since Getattr
+	var out fuse.AttrOut
+	if errno = f.Getattr(nil, &out); errno != 0 {
+		errnoStatus(w, errno)
+		return
+	}
+	size := out.Attr.Size
+	h := w.Header()
+	h.Set("Accept-Ranges", "bytes")
+	h.Set("Last-Modified", time.Unix(int64(out.Attr.Mtime), 0).UTC().Format(http.TimeFormat))
+	if ct := mime.TypeByExtension(path.Ext(p)); ct != "" {
+		h.Set("Content-Type", ct)
+	} else {
+		h.Set("Content-Type", "application/octet-stream")
+	}
+	off, length, partial, satisfiable := parseRange(r.Header.Get("Range"), size)
+	if !satisfiable {
+		h.Set("Content-Range", fmt.Sprintf("bytes */%d", size))
+		http.Error(w, "range not satisfiable", http.StatusRequestedRangeNotSatisfiable)
+		return
+	}
+	status := http.StatusOK
+	if partial {
+		h.Set("Content-Range", fmt.Sprintf("bytes %d-%d/%d", off, off+length-1, size))
+		status = http.StatusPartialContent
+	} else {
+		length = size
+	}
+	h.Set("Content-Length", strconv.FormatUint(length, 10))
+	w.WriteHeader(status)
+	if r.Method == "HEAD" {
+		return
+	}
+	buf := make([]byte, fuse.MAX_KERNEL_WRITE)
+	for length > 0 {
+		n := uint64(len(buf))
+		if length < n {
+			n = length
+		}
+		res, errno := f.Read(nil, buf[:n], int64(off))
+		if errno != 0 {
+			tlog.Warn.Printf("webdav: GET %q: %v", p, errno)
+			return
+		}
+		data, status := res.Bytes(buf[:n])
+		if !status.Ok() {
+			tlog.Warn.Printf("webdav: GET %q: %v", p, status)
+			return
+		}
+		if len(data) == 0 {
+			// The file was truncated while we were reading it
+			tlog.Warn.Printf("webdav: GET %q: short read at offset %d", p, off)
+			return
+		}
+		if _, err := w.Write(data); err != nil {
+			return
+		}
+		off += uint64(len(data))
+		length -= uint64(len(data))
+	}
+}
+
+// put handles PUT. Replaces the content of an existing file, or creates a
+// new one.
+func (s *Server) put(w http.ResponseWriter, r *http.Request, p string) {
+	parent, name, errno := s.lookupParent(p)
+	if errno == syscall.ENOENT {
+		http.Error(w, "parent collection does not exist", http.StatusConflict)
+		return
+	} else if errno != 0 {
+		errnoStatus(w, errno)
+		return
+	}
+	var fh fs.FileHandle
+	created := false
+	n, errno := s.lookup(p)
+	if errno == 0 {
+		attr, errno := getattr(n)
+		if errno != 0 {
+			errnoStatus(w, errno)
+			return
+		}
+		if !isRegular(&attr) {
+			http.Error(w, "not a regular file", http.StatusMethodNotAllowed)
+			return
+		}
+		fh, _, errno = n.Open(nil, syscall.O_WRONLY|syscall.O_TRUNC)
+		if errno != 0 {
+			errnoStatus(w, errno)
+			return
+		}
+	} else if errno == syscall.ENOENT {
+		var ch *fs.Inode
+		ch, fh, _, errno = parent.Create(nil, name, syscall.O_WRONLY, 0600, &fuse.EntryOut{})
+		if errno != 0 {
+			errnoStatus(w, errno)
+			return
+		}
+		parent.AddChild(name, ch, true)
+		created = true
+	} else {
+		errnoStatus(w, errno)
+		return
+	}
+	f := fh.(*fusefrontend.File)
+	errno = copyToFile(r.Body, f)
+	f.Release(nil)
+	if errno != 0 {
+		if created && parent.Unlink(nil, name) == 0 {
+			parent.RmChild(name)
+		}
+		errnoStatus(w, errno)
+		return
+	}
+	if created {
+		w.WriteHeader(http.StatusCreated)
+	} else {
+		w.WriteHeader(http.StatusNoContent)
+	}
+}
+
+// copyToFile copies all of "in" to the beginning of "f".
+func copyToFile(in io.Reader, f *fusefrontend.File) syscall.Errno {
+	buf := make([]byte, fuse.MAX_KERNEL_WRITE)
+	var off int64
+	for {
+		m, err := io.ReadFull(in, buf)
+		if m > 0 {
+			if _, errno := f.Write(nil, buf[:m], off); errno != 0 {
+				return errno
+			}
+			off += int64(m)
+		}
+		if err == io.EOF || err == io.ErrUnexpectedEOF {
+			return 0
+		}
+		if err != nil {
+			return syscall.EIO
+		}
+	}
+}
+
+// delete handles DELETE. Collections are deleted with everything inside.
+func (s *Server) delete(w http.ResponseWriter, p string) {
+	parent, name, errno := s.lookupParent(p)
+	if errno != 0 {
+		errnoStatus(w, errno)
+		return
+	}
+	if errno = s.remove(parent, name); errno != 0 {
+		errnoStatus(w, errno)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// remove deletes "name" in "parent", recursively if it is a directory.
+func (s *Server) remove(parent *fusefrontend.Node, name string) syscall.Errno {
+	n, errno := lookupChild(parent, name)
+	if errno != 0 {
+		return errno
+	}
+	attr, errno := getattr(n)
+	if errno != 0 {
+		return errno
+	}
+	if !isDir(&attr) {
+		if errno = parent.Unlink(nil, name); errno == 0 {
+			parent.RmChild(name)
+		}
+		return errno
+	}
+	names, errno := n.ReaddirNames()
+	if errno != 0 {
+		return errno
+	}
+	for _, child := range names {
+		if errno = s.remove(n, child); errno != 0 {
+			return errno
+		}
+	}
+	if errno = parent.Rmdir(nil, name); errno == 0 {
+		parent.RmChild(name)
+	}
+	return errno
+}
+
+// mkcol handles MKCOL
+func (s *Server) mkcol(w http.ResponseWriter, r *http.Request, p string) {
+	if r.ContentLength > 0 {
+		http.Error(w, "MKCOL with a body is not supported", http.StatusUnsupportedMediaType)
+		return
+	}
+	parent, name, errno := s.lookupParent(p)
+	if errno == syscall.ENOENT {
+		http.Error(w, "parent collection does not exist", http.StatusConflict)
+		return
+	} else if errno != 0 {
+		errnoStatus(w, errno)
+		return
+	}
+	ch, errno := parent.Mkdir(nil, name, 0700, &fuse.EntryOut{})
+	if errno == syscall.EEXIST {
+		http.Error(w, "already exists", http.StatusMethodNotAllowed)
+		return
+	} else if errno != 0 {
+		errnoStatus(w, errno)
+		return
+	}
+	parent.AddChild(name, ch, true)
+	w.WriteHeader(http.StatusCreated)
+}
+
+// move handles MOVE
+func (s *Server) move(w http.ResponseWriter, r *http.Request, p string) {
+	dest, err := url.Parse(r.Header.Get("Destination"))
+	if err != nil || dest.Path == "" || (dest.Host != "" && dest.Host != r.Host) {
+		http.Error(w, "bad Destination header", http.StatusBadRequest)
+		return
+	}
+	destPath := path.Clean("/" + dest.Path)
+	if destPath == "/" || destPath == p || strings.HasPrefix(destPath, p+"/") {
+		http.Error(w, "cannot move a resource into itself", http.StatusForbidden)
+		return
+	}
+	parent, name, errno := s.lookupParent(p)
+	if errno != 0 {
+		errnoStatus(w, errno)
+		return
+	}
+	newParent, newName, errno := s.lookupParent(destPath)
+	if errno == syscall.ENOENT {
+		http.Error(w, "parent collection does not exist", http.StatusConflict)
+		return
+	} else if errno != 0 {
+		errnoStatus(w, errno)
+		return
+	}
+	if _, errno = s.lookup(p); errno != 0 {
+		errnoStatus(w, errno)
+		return
+	}
+	_, errno = s.lookup(destPath)
+	exists := errno == 0
+	if exists {
+		if r.Header.Get("Overwrite") == "F" {
+			http.Error(w, "destination exists", http.StatusPreconditionFailed)
+			return
+		}
+		// rename(2) cannot replace a non-empty directory
+		if errno = s.remove(newParent, newName); errno != 0 {
+			errnoStatus(w, errno)
+			return
+		}
+	}
+	if errno = parent.Rename(nil, name, newParent, newName, 0); errno != 0 {
+		errnoStatus(w, errno)
+		return
+	}
+	// A mount moves the inode after a successful rename, so do we
+	parent.MvChild(name, newParent.EmbeddedInode(), newName, true)
+	if exists {
+		w.WriteHeader(http.StatusNoContent)
+	} else {
+		w.WriteHeader(http.StatusCreated)
+	}
+}
+
+type multistatus struct {
+	XMLName   xml.Name   `xml:"D:multistatus"`
+	XMLNS     string     `xml:"xmlns:D,attr"`
+	Responses []response `xml:"D:response"`
+}
+
+type response struct {
+	Href     string   `xml:"D:href"`
+	Propstat propstat `xml:"D:propstat"`
+}
+
+type propstat struct {
+	Prop   prop   `xml:"D:prop"`
+	Status string `xml:"D:status"`
+}
+
+type prop struct {
+	DisplayName   string       `xml:"D:displayname"`
+	ResourceType  resourceType `xml:"D:resourcetype"`
+	ContentLength *uint64      `xml:"D:getcontentlength,omitempty"`
+	ContentType   string       `xml:"D:getcontenttype,omitempty"`
+	LastModified  string       `xml:"D:getlastmodified"`
+}
+
+type resourceType struct {
+	Collection *struct{} `xml:"D:collection"`
+}
+
+// propfind handles PROPFIND with "Depth: 0" or "Depth: 1". All properties we
+// have are returned, whatever the request body asks for. "Depth: infinity"
+// could walk the whole filesystem and is refused, as RFC 4918 allows.
+func (s *Server) propfind(w http.ResponseWriter, r *http.Request, p string) {
+	depth := r.Header.Get("Depth")
+	if depth != "0" && depth != "1" {
+		http.Error(w, "only Depth 0 and 1 are supported", http.StatusForbidden)
+		return
+	}
+	io.Copy(ioutil.Discard, r.Body)
+	n, errno := s.lookup(p)
+	if errno != 0 {
+		errnoStatus(w, errno)
+		return
+	}
+	attr, errno := getattr(n)
+	if errno != 0 {
+		errnoStatus(w, errno)
+		return
+	}
+	if !isDir(&attr) && !isRegular(&attr) {
+		errnoStatus(w, syscall.ENOENT)
+		return
+	}
+	ms := multistatus{XMLNS: "DAV:"}
+	ms.Responses = append(ms.Responses, propResponse(p, &attr))
+	if depth == "1" && isDir(&attr) {
+		names, errno := n.ReaddirNames()
+		if errno != 0 {
+			errnoStatus(w, errno)
+			return
+		}
+		for _, name := range names {
+			ch, errno := lookupChild(n, name)
+			if errno != 0 {
+				// Deleted in the meantime, or undecryptable
+				continue
+			}
+			a, errno := getattr(ch)
+			if errno != 0 || (!isDir(&a) && !isRegular(&a)) {
+				continue
+			}
+			ms.Responses = append(ms.Responses, propResponse(path.Join(p, name), &a))
+		}
+	}
+	w.Header().Set("Content-Type", `application/xml; charset="utf-8"`)
+	w.WriteHeader(207)
+	io.WriteString(w, xml.Header)
+	if err := xml.NewEncoder(w).Encode(ms); err != nil {
+		tlog.Warn.Printf("webdav: PROPFIND %q: %v", p, err)
+	}
+}
+
+// propResponse returns the properties of the file or directory at "p"
+func propResponse(p string, a *fuse.Attr) response {
+	pr := prop{
+		DisplayName:  path.Base(p),
+		LastModified: time.Unix(int64(a.Mtime), 0).UTC().Format(http.TimeFormat),
+	}
+	href := (&url.URL{Path: p}).EscapedPath()
+	if isDir(a) {
+		pr.ResourceType.Collection = &struct{}{}
+		if p != "/" {
+			href += "/"
+		}
+	} else {
+		size := a.Size
+		pr.ContentLength = &size
+		pr.ContentType = mime.TypeByExtension(path.Ext(p))
+	}
+	return response{
+		Href:     href,
+		Propstat: propstat{Prop: pr, Status: "HTTP/1.1 200 OK"},
+	}
+}
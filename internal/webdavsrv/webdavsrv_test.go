@@ -0,0 +1,178 @@
+package webdavsrv
+
+import (
+	"bytes"
+	"io/ioutil"
+	"math/rand"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/rfjakob/gocryptfs/internal/fusefrontend"
+	"github.com/rfjakob/gocryptfs/tests/inprocess"
+	"github.com/rfjakob/gocryptfs/tests/test_helpers"
+)
+
+// newTestServer serves a new gocryptfs filesystem over WebDAV. The user
+// name is "u", the password "p".
+func newTestServer(t *testing.T) (*inprocess.FS, *httptest.Server) {
+	pfs, err := inprocess.New(test_helpers.InitFS(t), []byte("test"), fusefrontend.Args{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	srv := httptest.NewServer(New(pfs.RootNode(), Options{User: "u", Password: "p"}))
+	return pfs, srv
+}
+
+// do sends an authenticated request and returns the response and its body.
+func do(t *testing.T, method string, url string, body []byte, header map[string]string) (*http.Response, []byte) {
+	req, err := http.NewRequest(method, url, bytes.NewReader(body))
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.SetBasicAuth("u", "p")
+	for k, v := range header {
+		req.Header.Set(k, v)
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	data, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return resp, data
+}
+
+// TestRangeGet does a GET with a Range header and compares the bytes with a
+// direct read through the frontend.
+func TestRangeGet(t *testing.T) {
+	pfs, srv := newTestServer(t)
+	defer pfs.Close()
+	defer srv.Close()
+	content := make([]byte, 300000)
+	rand.Read(content)
+	f, err := pfs.Create("file", 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err = f.WriteAt(content, 0); err != nil {
+		t.Fatal(err)
+	}
+	f.Close()
+
+	testCases := []struct {
+		rng        string
+		off, end   int
+		wantStatus int
+	}{
+		{"bytes=5000-140000", 5000, 140001, http.StatusPartialContent},
+		{"bytes=299990-", 299990, 300000, http.StatusPartialContent},
+		{"bytes=-10", 299990, 300000, http.StatusPartialContent},
+		{"bytes=0-999999", 0, 300000, http.StatusPartialContent},
+		{"", 0, 300000, http.StatusOK},
+	}
+	for _, tc := range testCases {
+		resp, have := do(t, "GET", srv.URL+"/file", nil, map[string]string{"Range": tc.rng})
+		if resp.StatusCode != tc.wantStatus {
+			t.Errorf("%q: want status %d, have %d", tc.rng, tc.wantStatus, resp.StatusCode)
+			continue
+		}
+		f, err := pfs.Open("file", 0)
+		if err != nil {
+			t.Fatal(err)
+		}
+		want := make([]byte, tc.end-tc.off)
+		if _, err = f.ReadAt(want, int64(tc.off)); err != nil {
+			t.Fatal(err)
+		}
+		f.Close()
+		if !bytes.Equal(have, want) {
+			t.Errorf("%q: content differs from a direct read, len %d vs %d", tc.rng, len(have), len(want))
+		}
+	}
+	resp, _ := do(t, "GET", srv.URL+"/file", nil, map[string]string{"Range": "bytes=300000-"})
+	if resp.StatusCode != http.StatusRequestedRangeNotSatisfiable {
+		t.Errorf("range past the end: want status 416, have %d", resp.StatusCode)
+	}
+}
+
+// TestWebDAV runs the other methods and checks authentication.
+func TestWebDAV(t *testing.T) {
+	pfs, srv := newTestServer(t)
+	defer pfs.Close()
+	defer srv.Close()
+	resp, err := http.Get(srv.URL + "/")
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusUnauthorized {
+		t.Errorf("no credentials: want status 401, have %d", resp.StatusCode)
+	}
+	if resp, _ := do(t, "MKCOL", srv.URL+"/dir", nil, nil); resp.StatusCode != http.StatusCreated {
+		t.Fatalf("MKCOL: status %d", resp.StatusCode)
+	}
+	if resp, _ := do(t, "PUT", srv.URL+"/dir/a%20b.txt", []byte("hello"), nil); resp.StatusCode != http.StatusCreated {
+		t.Fatalf("PUT: status %d", resp.StatusCode)
+	}
+	if resp, _ := do(t, "PUT", srv.URL+"/dir/a%20b.txt", []byte("hi"), nil); resp.StatusCode != http.StatusNoContent {
+		t.Fatalf("PUT over existing file: status %d", resp.StatusCode)
+	}
+	if attr, err := pfs.Stat("dir/a b.txt"); err != nil || attr.Size != 2 {
+		t.Fatalf("Stat after PUT: %v, size %d", err, attr.Size)
+	}
+	resp, body := do(t, "PROPFIND", srv.URL+"/dir", nil, map[string]string{"Depth": "1"})
+	if resp.StatusCode != 207 {
+		t.Fatalf("PROPFIND: status %d", resp.StatusCode)
+	}
+	for _, want := range []string{"<D:href>/dir/</D:href>", "<D:href>/dir/a%20b.txt</D:href>", "<D:getcontentlength>2</D:getcontentlength>", "<D:collection>"} {
+		if !strings.Contains(string(body), want) {
+			t.Errorf("PROPFIND: %q missing in\n%s", want, body)
+		}
+	}
+	// The config file is not part of the plaintext view
+	if _, body := do(t, "PROPFIND", srv.URL+"/", nil, map[string]string{"Depth": "1"}); strings.Contains(string(body), "gocryptfs") {
+		t.Errorf("PROPFIND lists internal files:\n%s", body)
+	}
+	resp, _ = do(t, "MOVE", srv.URL+"/dir/a%20b.txt", nil, map[string]string{"Destination": srv.URL + "/moved"})
+	if resp.StatusCode != http.StatusCreated {
+		t.Fatalf("MOVE: status %d", resp.StatusCode)
+	}
+	if _, body := do(t, "GET", srv.URL+"/moved", nil, nil); string(body) != "hi" {
+		t.Errorf("GET after MOVE: %q", body)
+	}
+	do(t, "PUT", srv.URL+"/dir/x", []byte("x"), nil)
+	if resp, _ := do(t, "DELETE", srv.URL+"/dir", nil, nil); resp.StatusCode != http.StatusNoContent {
+		t.Fatalf("DELETE: status %d", resp.StatusCode)
+	}
+	if _, err := pfs.Stat("dir"); err == nil {
+		t.Error("dir still exists after DELETE")
+	}
+}
+
+func TestParseRange(t *testing.T) {
+	testCases := []struct {
+		header               string
+		off, length          uint64
+		partial, satisfiable bool
+	}{
+		{"bytes=0-9", 0, 10, true, true},
+		{"bytes=90-", 90, 10, true, true},
+		{"bytes=-5", 95, 5, true, true},
+		{"bytes=-500", 0, 100, true, true},
+		{"bytes=100-", 0, 0, true, false},
+		{"bytes=0-1,5-6", 0, 0, false, true},
+		{"bytes=5-1", 0, 0, false, true},
+		{"items=0-1", 0, 0, false, true},
+	}
+	for _, tc := range testCases {
+		off, length, partial, satisfiable := parseRange(tc.header, 100)
+		if off != tc.off || length != tc.length || partial != tc.partial || satisfiable != tc.satisfiable {
+			t.Errorf("%q: have %d %d %v %v", tc.header, off, length, partial, satisfiable)
+		}
+	}
+}
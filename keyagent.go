@@ -0,0 +1,48 @@
+package main
+
+import (
+	"os"
+	"os/signal"
+	"path/filepath"
+	"syscall"
+
+	"github.com/rfjakob/gocryptfs/internal/exitcodes"
+	"github.com/rfjakob/gocryptfs/internal/keyagent"
+	"github.com/rfjakob/gocryptfs/internal/tlog"
+)
+
+// serveKeyAgent handles "gocryptfs -keyagent_serve SOCKET CIPHERDIR". It asks
+// for the password once and then serves the master key to mounts that pass
+// "-keyagent SOCKET", until it gets SIGINT or SIGTERM.
+//
+// Returns the exit code.
+func serveKeyAgent(args *argContainer) int {
+	masterkey, cf, err := loadConfig(args)
+	if err != nil {
+		exitcodes.Exit(err)
+	}
+	agent := keyagent.New()
+	defer agent.Wipe()
+	agent.Add(keyagent.Fingerprint(cf), masterkey)
+	for i := range masterkey {
+		masterkey[i] = 0
+	}
+	// Print the absolute path, which works as "-keyagent" from any directory
+	path, _ := filepath.Abs(args.keyagent_serve)
+	sock, err := keyagent.Listen(path)
+	if err != nil {
+		tlog.Fatal.Printf("-keyagent_serve: %v", err)
+		return exitcodes.KeyAgent
+	}
+	// Handle SIGINT & SIGTERM
+	ch := make(chan os.Signal, 1)
+	signal.Notify(ch, os.Interrupt)
+	signal.Notify(ch, syscall.SIGTERM)
+	go func() {
+		<-ch
+		sock.Close()
+	}()
+	tlog.Info.Printf("Serving the master key of %s at %s", args.cipherdir, path)
+	agent.Serve(sock)
+	return 0
+}
@@ -0,0 +1,49 @@
+package main
+
+import (
+	"github.com/rfjakob/gocryptfs/internal/configfile"
+	"github.com/rfjakob/gocryptfs/internal/fido2"
+	"github.com/rfjakob/gocryptfs/internal/keyagent"
+	"github.com/rfjakob/gocryptfs/internal/readpassword"
+	"github.com/rfjakob/gocryptfs/internal/tlog"
+)
+
+// newKeyProvider returns the KeyProvider that mount and "-init" use to get
+// and store the master key of the config file "cf". Builds that wrap the
+// master key with a KMS, a TPM or an HSM replace it.
+var newKeyProvider = defaultKeyProvider
+
+// defaultKeyProvider gets the master key from the agent if "-keyagent" was
+// passed, and asks for the password otherwise.
+func defaultKeyProvider(args *argContainer, cf *configfile.ConfFile) configfile.KeyProvider {
+	if args.keyagent != "" {
+		return &keyagent.Provider{Socket: args.keyagent, Conf: cf}
+	}
+	return passwordKeyProvider(args, cf)
+}
+
+// passwordKeyProvider asks for the password. It comes
+// from the FIDO2 token if the filesystem uses one, and from "-extpass",
+// "-passfile" or the terminal otherwise.
+func passwordKeyProvider(args *argContainer, cf *configfile.ConfFile) configfile.KeyProvider {
+	return &configfile.PasswordProvider{
+		Conf:     cf,
+		Password: func() []byte { return readPassword(args, cf) },
+		LogN:     args.scryptn,
+	}
+}
+
+func readPassword(args *argContainer, cf *configfile.ConfFile) []byte {
+	if cf.IsFeatureFlagSet(configfile.FlagFIDO2) {
+		return fido2.Secret(args.fido2, cf.FIDO2.CredentialID, cf.FIDO2.HMACSalt)
+	}
+	if args.init {
+		if args.extpass.Empty() {
+			tlog.Info.Printf("Choose a password for protecting your files.")
+		}
+		return readpassword.Twice([]string(args.extpass), []string(args.passfile))
+	}
+	pw := readpassword.Once([]string(args.extpass), []string(args.passfile), "")
+	tlog.Info.Println("Decrypting master key")
+	return pw
+}
@@ -0,0 +1,176 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"syscall"
+	"testing"
+
+	"github.com/hanwen/go-fuse/v2/fs"
+	"github.com/hanwen/go-fuse/v2/fuse"
+
+	"github.com/rfjakob/gocryptfs/internal/configfile"
+	"github.com/rfjakob/gocryptfs/internal/cryptocore"
+	"github.com/rfjakob/gocryptfs/internal/fusefrontend"
+	"github.com/rfjakob/gocryptfs/internal/keyagent"
+)
+
+// mockKeyProvider keeps the master key in memory instead of the config file
+type mockKeyProvider struct {
+	key     []byte
+	unwraps int
+}
+
+func (m *mockKeyProvider) Unwrap(ctx context.Context) ([]byte, error) {
+	m.unwraps++
+	return append([]byte(nil), m.key...), nil
+}
+
+func (m *mockKeyProvider) Wrap(key []byte) error {
+	m.key = append([]byte(nil), key...)
+	return nil
+}
+
+// writeRootFile creates "name" in the root directory of "rn"
+func writeRootFile(t *testing.T, rn *fusefrontend.RootNode, name string, data []byte) {
+	_, fh, _, errno := rn.Create(nil, name, syscall.O_RDWR, 0600, &fuse.EntryOut{})
+	if errno != 0 {
+		t.Fatal(errno)
+	}
+	if _, errno = fh.(*fusefrontend.File).Write(nil, data, 0); errno != 0 {
+		t.Fatal(errno)
+	}
+	fh.(*fusefrontend.File).Release(nil)
+}
+
+// readRootFile returns the content of "name" in the root directory of "rn"
+func readRootFile(t *testing.T, rn *fusefrontend.RootNode, name string) []byte {
+	ch, errno := rn.Lookup(nil, name, &fuse.EntryOut{})
+	if errno != 0 {
+		t.Fatal(errno)
+	}
+	rn.AddChild(name, ch, true)
+	fh, _, errno := ch.Operations().(fs.NodeOpener).Open(nil, syscall.O_RDONLY)
+	if errno != 0 {
+		t.Fatal(errno)
+	}
+	defer fh.(*fusefrontend.File).Release(nil)
+	buf := make([]byte, 100)
+	res, errno := fh.(*fusefrontend.File).Read(nil, buf, 0)
+	if errno != 0 {
+		t.Fatal(errno)
+	}
+	data, _ := res.Bytes(buf)
+	return data
+}
+
+// TestMockKeyProvider creates a filesystem with a mock KeyProvider and
+// unlocks it twice through the code that mount uses. A file written after
+// the first unlock must be readable after the second.
+func TestMockKeyProvider(t *testing.T) {
+	mock := &mockKeyProvider{}
+	newKeyProvider = func(*argContainer, *configfile.ConfFile) configfile.KeyProvider {
+		return mock
+	}
+	defer func() { newKeyProvider = defaultKeyProvider }()
+
+	dir, err := ioutil.TempDir("", "TestMockKeyProvider.")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	oldArgs := os.Args
+	os.Args = []string{"gocryptfs", "-init", "-q", "-scryptn=10", dir}
+	args := parseCliOpts()
+	os.Args = oldArgs
+	args.cipherdir = dir
+	args.config = filepath.Join(dir, configfile.ConfDefaultName)
+	initDir(&args)
+	if len(mock.key) != cryptocore.KeyLen {
+		t.Fatalf("Wrap got a %d byte key", len(mock.key))
+	}
+	cf, err := configfile.Load(args.config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(cf.EncryptedKey) != 0 {
+		t.Errorf("the config file contains an encrypted key")
+	}
+
+	args.init = false
+	want := []byte("hello key provider")
+	for i := 0; i < 2; i++ {
+		rootNode, wipeKeys := initFuseFrontend(&args)
+		rn := rootNode.(*fusefrontend.RootNode)
+		fs.NewNodeFS(rn, &fs.Options{})
+		if i == 0 {
+			writeRootFile(t, rn, "foo", want)
+		} else if have := readRootFile(t, rn, "foo"); !bytes.Equal(have, want) {
+			t.Errorf("want %q, have %q", want, have)
+		}
+		wipeKeys()
+	}
+	if mock.unwraps != 2 {
+		t.Errorf("want 2 Unwrap calls, have %d", mock.unwraps)
+	}
+}
+
+// TestKeyAgent writes a file into a filesystem unlocked with the password,
+// then serves the master key from an agent and checks that a mount with
+// "-keyagent" gets the key from there and can read the file.
+func TestKeyAgent(t *testing.T) {
+	dir, err := ioutil.TempDir("", "TestKeyAgent.")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	cipherdir := filepath.Join(dir, "cipher")
+	if err = os.Mkdir(cipherdir, 0700); err != nil {
+		t.Fatal(err)
+	}
+	oldArgs := os.Args
+	os.Args = []string{"gocryptfs", "-init", "-q", "-scryptn=10", "-extpass", "echo test", cipherdir}
+	args := parseCliOpts()
+	os.Args = oldArgs
+	args.cipherdir = cipherdir
+	args.config = filepath.Join(cipherdir, configfile.ConfDefaultName)
+	initDir(&args)
+	args.init = false
+
+	want := []byte("hello key agent")
+	rootNode, wipeKeys := initFuseFrontend(&args)
+	rn := rootNode.(*fusefrontend.RootNode)
+	fs.NewNodeFS(rn, &fs.Options{})
+	writeRootFile(t, rn, "foo", want)
+	wipeKeys()
+
+	// The mock agent gets the key the way "-keyagent_serve" does
+	masterkey, cf, err := loadConfig(&args)
+	if err != nil {
+		t.Fatal(err)
+	}
+	agent := keyagent.New()
+	defer agent.Wipe()
+	agent.Add(keyagent.Fingerprint(cf), masterkey)
+	socket := filepath.Join(dir, "agent.sock")
+	sock, err := keyagent.Listen(socket)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer sock.Close()
+	go agent.Serve(sock)
+
+	// Asking for the password would fail now
+	args.extpass = []string{"false"}
+	args.keyagent = socket
+	rootNode, wipeKeys = initFuseFrontend(&args)
+	defer wipeKeys()
+	rn = rootNode.(*fusefrontend.RootNode)
+	fs.NewNodeFS(rn, &fs.Options{})
+	if have := readRootFile(t, rn, "foo"); !bytes.Equal(have, want) {
+		t.Errorf("want %q, have %q", want, have)
+	}
+}
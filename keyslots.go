@@ -0,0 +1,82 @@
+package main
+
+import (
+	"log"
+	"os"
+
+	"github.com/rfjakob/gocryptfs/internal/configfile"
+	"github.com/rfjakob/gocryptfs/internal/exitcodes"
+	"github.com/rfjakob/gocryptfs/internal/readpassword"
+	"github.com/rfjakob/gocryptfs/internal/tlog"
+)
+
+// addKey - add a key slot with a new password to the config file.
+// Asks for one of the existing passwords first, or takes the master key from
+// "-masterkey".
+// Does not return (calls os.Exit on error).
+func addKey(args *argContainer) {
+	masterkey, confFile, err := loadConfig(args)
+	if err != nil {
+		exitcodes.Exit(err)
+	}
+	if len(masterkey) == 0 {
+		log.Panic("empty masterkey")
+	}
+	if confFile.IsFeatureFlagSet(configfile.FlagFIDO2) {
+		tlog.Fatal.Printf("Key slots are not supported on FIDO2-enabled filesystems.")
+		os.Exit(exitcodes.Usage)
+	}
+	tlog.Info.Println("Please enter the password to add.")
+	newPw := readpassword.Twice([]string(args.extpass), []string(args.passfile))
+	logN := confFile.ScryptObject.LogN()
+	if args._explicitScryptn {
+		logN = args.scryptn
+	}
+	slot := confFile.AddKeySlot(masterkey, newPw, logN)
+	for i := range newPw {
+		newPw[i] = 0
+	}
+	for i := range masterkey {
+		masterkey[i] = 0
+	}
+	err = confFile.WriteFile()
+	if err != nil {
+		tlog.Fatal.Println(err)
+		os.Exit(exitcodes.WriteConf)
+	}
+	tlog.Info.Printf(tlog.ColorGreen+"Password added in key slot %d."+tlog.ColorReset, slot)
+}
+
+// removeKey - remove the key slot that the entered password unlocks from the
+// config file. Refuses to remove the last key slot.
+// Does not return (calls os.Exit on error).
+func removeKey(args *argContainer) {
+	if args.masterkey != "" || args.zerokey || args.keyagent != "" {
+		tlog.Fatal.Printf("-remove_key cannot be used together with -masterkey, -zerokey or -keyagent")
+		os.Exit(exitcodes.Usage)
+	}
+	tlog.Info.Println("Please enter the password to remove.")
+	masterkey, confFile, err := loadConfig(args)
+	if err != nil {
+		exitcodes.Exit(err)
+	}
+	for i := range masterkey {
+		masterkey[i] = 0
+	}
+	if confFile.IsFeatureFlagSet(configfile.FlagFIDO2) {
+		tlog.Fatal.Printf("Key slots are not supported on FIDO2-enabled filesystems.")
+		os.Exit(exitcodes.Usage)
+	}
+	slot := confFile.UnlockedSlot()
+	err = confFile.RemoveKeySlot(slot)
+	if err != nil {
+		tlog.Fatal.Printf("%v: add another password using -add_key first", err)
+		os.Exit(exitcodes.Usage)
+	}
+	err = confFile.WriteFile()
+	if err != nil {
+		tlog.Fatal.Println(err)
+		os.Exit(exitcodes.WriteConf)
+	}
+	tlog.Info.Printf(tlog.ColorGreen+"Password in key slot %d removed."+tlog.ColorReset, slot)
+}
@@ -4,6 +4,7 @@
 package main
 
 import (
+	"context"
 	"fmt"
 	"log"
 	"os"
@@ -17,7 +18,6 @@ import (
 	"github.com/rfjakob/gocryptfs/internal/configfile"
 	"github.com/rfjakob/gocryptfs/internal/contentenc"
 	"github.com/rfjakob/gocryptfs/internal/exitcodes"
-	"github.com/rfjakob/gocryptfs/internal/fido2"
 	"github.com/rfjakob/gocryptfs/internal/readpassword"
 	"github.com/rfjakob/gocryptfs/internal/speed"
 	"github.com/rfjakob/gocryptfs/internal/stupidgcm"
@@ -51,22 +51,11 @@ func loadConfig(args *argContainer) (masterkey []byte, cf *configfile.ConfFile,
 	if masterkey != nil {
 		return masterkey, cf, nil
 	}
-	var pw []byte
-	if cf.IsFeatureFlagSet(configfile.FlagFIDO2) {
-		if args.fido2 == "" {
-			tlog.Fatal.Printf("Masterkey encrypted using FIDO2 token; need to use the --fido2 option.")
-			os.Exit(exitcodes.Usage)
-		}
-		pw = fido2.Secret(args.fido2, cf.FIDO2.CredentialID, cf.FIDO2.HMACSalt)
-	} else {
-		pw = readpassword.Once([]string(args.extpass), []string(args.passfile), "")
-	}
-	tlog.Info.Println("Decrypting master key")
-	masterkey, err = cf.DecryptMasterKey(pw)
-	for i := range pw {
-		pw[i] = 0
+	if cf.IsFeatureFlagSet(configfile.FlagFIDO2) && args.fido2 == "" && args.keyagent == "" {
+		tlog.Fatal.Printf("Masterkey encrypted using FIDO2 token; need to use the --fido2 option.")
+		os.Exit(exitcodes.Usage)
 	}
-
+	masterkey, err = cf.UnwrapKey(context.Background(), newKeyProvider(args, cf))
 	if err != nil {
 		tlog.Fatal.Println(err)
 		return nil, nil, err
@@ -129,6 +118,24 @@ func changePassword(args *argContainer) {
 	tlog.Info.Printf(tlog.ColorGreen + "Password changed." + tlog.ColorReset)
 }
 
+// unlockCheck checks if the password unlocks the config file, without
+// mounting. Exits with exitcodes.PasswordIncorrect if it does not, and
+// returns if it does.
+func unlockCheck(args *argContainer) {
+	if args.masterkey != "" || args.zerokey {
+		tlog.Fatal.Printf("-unlockcheck cannot be used together with -masterkey or -zerokey")
+		os.Exit(exitcodes.Usage)
+	}
+	masterkey, _, err := loadConfig(args)
+	if err != nil {
+		exitcodes.Exit(err)
+	}
+	for i := range masterkey {
+		masterkey[i] = 0
+	}
+	tlog.Info.Printf(tlog.ColorGreen + "Password correct." + tlog.ColorReset)
+}
+
 // printVersion prints a version string like this:
 // gocryptfs v1.7-32-gcf99cfd; go-fuse v1.0.0-174-g22a9cb9; 2019-05-12 go1.12 linux/amd64
 func printVersion() {
@@ -194,6 +201,11 @@ func main() {
 		speed.Run()
 		os.Exit(0)
 	}
+	// "-selftest"
+	if args.selftest {
+		printVersion()
+		os.Exit(selfTest(args.selftest_seed))
+	}
 	if args.wpanic {
 		tlog.Warn.Wpanic = true
 		tlog.Debug.Printf("Panicking on warnings")
@@ -221,15 +233,31 @@ func main() {
 	if args.quiet {
 		tlog.Info.Enabled = false
 	}
+	// "-json" keeps stdout free for the summary
+	if args.json {
+		tlog.Info.Enabled = false
+	}
+	// "-export_tar" writes the tar stream to stdout
+	if args.export_tar {
+		tlog.Info.Logger.SetOutput(os.Stderr)
+	}
 	// "-reverse" implies "-aessiv"
 	if args.reverse {
 		args.aessiv = true
 	} else {
-		if args.exclude != nil {
-			tlog.Fatal.Printf("-exclude only works in reverse mode")
+		if args.exclude != nil && !args.fsck && args.importdir == "" {
+			tlog.Fatal.Printf("-exclude only works in reverse mode and with -fsck and -import")
 			os.Exit(exitcodes.ExcludeError)
 		}
 	}
+	// "-reverse_config" is "-config" for reverse mode, and ignored otherwise
+	if args.reverse && args.reverse_config != "" {
+		if args.config != "" {
+			tlog.Fatal.Printf("-config and -reverse_config cannot be used together in reverse mode")
+			os.Exit(exitcodes.Usage)
+		}
+		args.config = args.reverse_config
+	}
 	// "-config"
 	if args.config != "" {
 		args.config, err = filepath.Abs(args.config)
@@ -244,6 +272,31 @@ func main() {
 	} else {
 		args.config = filepath.Join(args.cipherdir, configfile.ConfDefaultName)
 	}
+	// "-tmpdir"
+	if args.tmpdir != "" {
+		args.tmpdir, err = filepath.Abs(args.tmpdir)
+		if err != nil {
+			tlog.Fatal.Printf("Invalid \"-tmpdir\" setting: %v", err)
+			os.Exit(exitcodes.Usage)
+		}
+		if fi, err := os.Stat(args.tmpdir); err != nil || !fi.IsDir() {
+			tlog.Fatal.Printf("-tmpdir: %q is not a directory", args.tmpdir)
+			os.Exit(exitcodes.Usage)
+		}
+		configfile.TmpDir = args.tmpdir
+	}
+	// "-lowerdir"
+	if args.lowerdir != "" {
+		args.lowerdir, err = filepath.Abs(args.lowerdir)
+		if err != nil {
+			tlog.Fatal.Printf("Invalid \"-lowerdir\" setting: %v", err)
+			os.Exit(exitcodes.Usage)
+		}
+		if fi, err := os.Stat(args.lowerdir); err != nil || !fi.IsDir() {
+			tlog.Fatal.Printf("-lowerdir: %q is not a directory", args.lowerdir)
+			os.Exit(exitcodes.Usage)
+		}
+	}
 	// "-force_owner"
 	if args.force_owner != "" {
 		var uidNum, gidNum int64
@@ -304,11 +357,11 @@ func main() {
 		return
 	}
 	if nOps > 1 {
-		tlog.Fatal.Printf("At most one of -info, -init, -passwd, -fsck is allowed")
+		tlog.Fatal.Printf("At most one of -info, -init, -passwd, -add_key, -remove_key, -fsck, -snapshot, -unlockcheck, -verifyhash, -import, -rotate_fileids, -compact, -webdav, -export_tar, -keyagent_serve, -check_file is allowed")
 		os.Exit(exitcodes.Usage)
 	}
 	if flagSet.NArg() != 1 {
-		tlog.Fatal.Printf("The options -info, -init, -passwd, -fsck take exactly one argument, %d given",
+		tlog.Fatal.Printf("The options -info, -init, -passwd, -add_key, -remove_key, -fsck, -snapshot, -unlockcheck, -verifyhash, -import, -rotate_fileids, -compact, -webdav, -export_tar, -keyagent_serve, -check_file take exactly one argument, %d given",
 			flagSet.NArg())
 		os.Exit(exitcodes.Usage)
 	}
@@ -327,9 +380,69 @@ func main() {
 		changePassword(&args)
 		os.Exit(0)
 	}
+	// "-add_key"
+	if args.add_key {
+		addKey(&args)
+		os.Exit(0)
+	}
+	// "-remove_key"
+	if args.remove_key {
+		removeKey(&args)
+		os.Exit(0)
+	}
 	// "-fsck"
 	if args.fsck {
 		code := fsck(&args)
 		os.Exit(code)
 	}
+	// "-unlockcheck"
+	if args.unlockcheck {
+		unlockCheck(&args)
+		os.Exit(0)
+	}
+	// "-snapshot"
+	if args.snapshot != "" {
+		takeSnapshot(&args)
+		os.Exit(0)
+	}
+	// "-verifyhash"
+	if args.verifyhash {
+		code := verifyHash(&args)
+		os.Exit(code)
+	}
+	// "-import"
+	if args.importdir != "" {
+		code := importTree(&args)
+		os.Exit(code)
+	}
+	// "-rotate_fileids"
+	if args.rotate_fileids {
+		code := rotateFileIDs(&args)
+		os.Exit(code)
+	}
+	// "-compact"
+	if args.compact {
+		code := compactFiles(&args)
+		os.Exit(code)
+	}
+	// "-webdav"
+	if args.webdav != "" {
+		code := serveWebDAV(&args)
+		os.Exit(code)
+	}
+	// "-export_tar"
+	if args.export_tar {
+		code := exportTar(&args)
+		os.Exit(code)
+	}
+	// "-keyagent_serve"
+	if args.keyagent_serve != "" {
+		code := serveKeyAgent(&args)
+		os.Exit(code)
+	}
+	// "-check_file"
+	if args.check_file != "" {
+		code := checkFile(&args)
+		os.Exit(code)
+	}
 }
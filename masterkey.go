@@ -13,15 +13,15 @@ import (
 
 // unhexMasterKey - Convert a hex-encoded master key to binary.
 // Calls os.Exit on failure.
-func unhexMasterKey(masterkey string, fromStdin bool) []byte {
+func unhexMasterKey(masterkey string, fromStdin bool, useHKDF bool) []byte {
 	masterkey = strings.Replace(masterkey, "-", "", -1)
 	key, err := hex.DecodeString(masterkey)
 	if err != nil {
 		tlog.Fatal.Printf("Could not parse master key: %v", err)
 		os.Exit(exitcodes.MasterKey)
 	}
-	if len(key) != cryptocore.KeyLen {
-		tlog.Fatal.Printf("Master key has length %d but we require length %d", len(key), cryptocore.KeyLen)
+	if err := cryptocore.ValidKeyLen(len(key), useHKDF); err != nil {
+		tlog.Fatal.Printf("Master key: %v", err)
 		os.Exit(exitcodes.MasterKey)
 	}
 	tlog.Info.Printf("Using explicit master key.")
@@ -40,11 +40,11 @@ func handleArgsMasterkey(args *argContainer) (masterkey []byte) {
 	// "-masterkey=stdin"
 	if args.masterkey == "stdin" {
 		in := string(readpassword.Once(nil, nil, "Masterkey"))
-		return unhexMasterKey(in, true)
+		return unhexMasterKey(in, true, args.hkdf)
 	}
 	// "-masterkey=941a6029-3adc6a1c-..."
 	if args.masterkey != "" {
-		return unhexMasterKey(args.masterkey, false)
+		return unhexMasterKey(args.masterkey, false, args.hkdf)
 	}
 	// "-zerokey"
 	if args.zerokey {
@@ -32,8 +32,11 @@ import (
 	"github.com/rfjakob/gocryptfs/internal/exitcodes"
 	"github.com/rfjakob/gocryptfs/internal/fusefrontend"
 	"github.com/rfjakob/gocryptfs/internal/fusefrontend_reverse"
+	"github.com/rfjakob/gocryptfs/internal/fuselimit"
+	"github.com/rfjakob/gocryptfs/internal/metrics"
 	"github.com/rfjakob/gocryptfs/internal/nametransform"
 	"github.com/rfjakob/gocryptfs/internal/openfiletable"
+	"github.com/rfjakob/gocryptfs/internal/optrace"
 	"github.com/rfjakob/gocryptfs/internal/tlog"
 )
 
@@ -61,6 +64,12 @@ func doMount(args *argContainer) {
 			args.mountpoint, args.cipherdir)
 		os.Exit(exitcodes.MountPoint)
 	}
+	// A crashed gocryptfs leaves a dead mount behind that makes all other
+	// checks fail with confusing errors
+	if err = checkMountpoint(args.mountpoint, args.unmount_stale, args.nonempty); err != nil {
+		tlog.Fatal.Printf("%v", err)
+		os.Exit(exitcodes.MountPoint)
+	}
 	if args.nonempty {
 		err = isDir(args.mountpoint)
 	} else {
@@ -76,6 +85,25 @@ func doMount(args *argContainer) {
 		tlog.Fatal.Printf("Invalid mountpoint: %v", err)
 		os.Exit(exitcodes.MountPoint)
 	}
+	// Mounting a cipherdir that is itself stored inside a gocryptfs mount
+	// encrypts everything twice
+	if !args.reverse {
+		checkNested(args, args.cipherdir)
+	}
+	// Some network filesystems lack rename or have unusable inode numbers.
+	// Reverse mode and "-ro" do not write to CIPHERDIR.
+	if !args.reverse && !args.ro && !args.noprobe {
+		probeCipherdir(args.cipherdir)
+	}
+	if args.require_encrypted_volume {
+		requireEncryptedVolume(args.cipherdir)
+	}
+	if args.wipe && !args.reverse {
+		warnWipeMedia(args.cipherdir)
+	}
+	if args.encryptacl && !args.reverse {
+		tlog.Warn.Printf("-encryptacl: POSIX ACLs are not enforced, only the file mode bits are checked")
+	}
 	// Open control socket early so we can error out before asking the user
 	// for the password
 	if args.ctlsock != "" {
@@ -122,6 +150,9 @@ func doMount(args *argContainer) {
 	defer wipeKeys()
 
 	tlog.Info.Println(tlog.ColorGreen + "Filesystem mounted and ready." + tlog.ColorReset)
+	if args.journald {
+		switchToJournald(args)
+	}
 	// We have been forked into the background, as evidenced by the set
 	// "notifypid".
 	if args.notifypid > 0 {
@@ -129,12 +160,15 @@ func doMount(args *argContainer) {
 		os.Chdir("/")
 		// Switch to syslog
 		if !args.nosyslog {
-			// Switch all of our logs and the generic logger to syslog
-			tlog.Info.SwitchToSyslog(syslog.LOG_USER | syslog.LOG_INFO)
-			tlog.Debug.SwitchToSyslog(syslog.LOG_USER | syslog.LOG_DEBUG)
-			tlog.Warn.SwitchToSyslog(syslog.LOG_USER | syslog.LOG_WARNING)
-			tlog.Fatal.SwitchToSyslog(syslog.LOG_USER | syslog.LOG_CRIT)
-			tlog.SwitchLoggerToSyslog(syslog.LOG_USER | syslog.LOG_WARNING)
+			// Switch all of our logs and the generic logger to syslog,
+			// unless they already go to journald
+			if !args.journald {
+				tlog.Info.SwitchToSyslog(syslog.LOG_USER | syslog.LOG_INFO)
+				tlog.Debug.SwitchToSyslog(syslog.LOG_USER | syslog.LOG_DEBUG)
+				tlog.Warn.SwitchToSyslog(syslog.LOG_USER | syslog.LOG_WARNING)
+				tlog.Fatal.SwitchToSyslog(syslog.LOG_USER | syslog.LOG_CRIT)
+				tlog.SwitchLoggerToSyslog(syslog.LOG_USER | syslog.LOG_WARNING)
+			}
 			// Daemons should redirect stdin, stdout and stderr
 			redirectStdFds()
 		}
@@ -164,8 +198,18 @@ func doMount(args *argContainer) {
 		fwdFs := fs.(*fusefrontend.RootNode)
 		go idleMonitor(args.idle, fwdFs, srv, args.mountpoint)
 	}
+	if args.watch_backing > 0 && !args.reverse {
+		go fs.(*fusefrontend.RootNode).WatchBacking(args.watch_backing)
+	}
 	// Wait for unmount.
 	srv.Wait()
+	if !args.reverse {
+		// Flush and close the "-optrace" file
+		fs.(*fusefrontend.RootNode).OpTrace.Close()
+	}
+	if cleanupAfterServe(args.mountpoint) {
+		os.Exit(exitcodes.ServeLoop)
+	}
 }
 
 // Based on the EncFS idle monitor:
@@ -251,6 +295,11 @@ func initFuseFrontend(args *argContainer) (rootNode fs.InodeEmbedder, wipeKeys f
 			}
 			exitcodes.Exit(err)
 		}
+		if confFile.ReadOnlyCompat() && !args.ro && !args.reverse {
+			tlog.Warn.Printf("Filesystem was created by a newer gocryptfs (%q, on-disk format %d), mounting read-only",
+				confFile.Creator, confFile.Version)
+			args.ro = true
+		}
 	}
 	// Reconciliate CLI and config file arguments into a fusefrontend.Args struct
 	// that is passed to the filesystem implementation
@@ -266,28 +315,69 @@ func initFuseFrontend(args *argContainer) (rootNode fs.InodeEmbedder, wipeKeys f
 	if args._forceOwner != nil {
 		args.allow_other = true
 	}
+	// So does "-user_prefix", which is pointless with a single user
+	if args.user_prefix != "" {
+		args.allow_other = true
+	}
 	frontendArgs := fusefrontend.Args{
-		Cipherdir:       args.cipherdir,
-		PlaintextNames:  args.plaintextnames,
-		LongNames:       args.longnames,
-		ConfigCustom:    args._configCustom,
-		NoPrealloc:      args.noprealloc,
-		SerializeReads:  args.serialize_reads,
-		ForceDecode:     args.forcedecode,
-		ForceOwner:      args._forceOwner,
-		Exclude:         args.exclude,
-		ExcludeWildcard: args.excludeWildcard,
-		ExcludeFrom:     args.excludeFrom,
-		Suid:            args.suid,
-		KernelCache:     args.kernel_cache,
-		SharedStorage:   args.sharedstorage,
+		Cipherdir:        args.cipherdir,
+		PlaintextNames:   args.plaintextnames,
+		LongNames:        args.longnames,
+		ConfigCustom:     args._configCustom,
+		NoPrealloc:       args.noprealloc,
+		SerializeReads:   args.serialize_reads,
+		ForceDecode:      args.forcedecode,
+		ForceOwner:       args._forceOwner,
+		Exclude:          args.exclude,
+		ExcludeWildcard:  args.excludeWildcard,
+		ExcludeFrom:      args.excludeFrom,
+		Suid:             args.suid,
+		KernelCache:      args.kernel_cache,
+		DirectIO:         args.direct_io,
+		SharedStorage:    args.sharedstorage,
+		BandwidthLimit:   int64(args.bwlimit) * 1024 * 1024,
+		Quota:            int64(args.quota) * 1024 * 1024,
+		MaxOpen:          args.max_open,
+		Prefix:           args.prefix,
+		UserPrefixes:     args._userPrefixes,
+		ReadOnly:         args.ro,
+		Quarantine:       args.quarantine,
+		HideBadHeaders:   args.unexpected == "hide",
+		EncryptACL:       args.encryptacl,
+		Journal:          args.journal,
+		TimeoutDepth:     args.timeout_depth,
+		FileHash:         args.filehash,
+		AlignedWrites:    args.aligned_writes,
+		IOTimeout:        args.io_timeout,
+		WriteBuffer:      args.writebuffer,
+		WatchBacking:     args.watch_backing,
+		FsyncBatch:       args.fsync_batch,
+		Sparse:           args.sparse,
+		FreezeTimestamps: args.timestamps == "freeze",
+		NoPropagateTimes: args.timestamps == "nopropagate",
+		NoAtime:          args.noatime,
+		LowerCipherdir:   args.lowerdir,
+		Fanout:           args.fanout,
+		FileTags:         args.filetags,
+		Trash:            args.trash,
+		WarnClockSkew:    args.warn_clock_skew,
+		Wipe:             args.wipe,
+		ContentHash:      args.contenthash,
+	}
+	// sharedstorage mode disables all caching, see initGoFuse
+	if !args.sharedstorage {
+		frontendArgs.EntryTimeout = args.entry_timeout
+		frontendArgs.AttrTimeout = args.attr_timeout
 	}
 	// confFile is nil when "-zerokey" or "-masterkey" was used
 	if confFile != nil {
 		// Settings from the config file override command line args
 		frontendArgs.PlaintextNames = confFile.IsFeatureFlagSet(configfile.FlagPlaintextNames)
 		args.raw64 = confFile.IsFeatureFlagSet(configfile.FlagRaw64)
+		args.name_encoding = confFile.NameEncoding
 		args.hkdf = confFile.IsFeatureFlagSet(configfile.FlagHKDF)
+		frontendArgs.Fanout = confFile.IsFeatureFlagSet(configfile.FlagFanout)
+		frontendArgs.FileTags = confFile.IsFeatureFlagSet(configfile.FlagFileTags)
 		if confFile.IsFeatureFlagSet(configfile.FlagAESSIV) {
 			cryptoBackend = cryptocore.BackendAESSIV
 		} else if args.reverse {
@@ -295,6 +385,39 @@ func initFuseFrontend(args *argContainer) (rootNode fs.InodeEmbedder, wipeKeys f
 			os.Exit(exitcodes.Usage)
 		}
 	}
+	if frontendArgs.Journal {
+		// The journal side files could collide with plaintext file names
+		if frontendArgs.PlaintextNames {
+			tlog.Fatal.Printf("-journal is not compatible with -plaintextnames")
+			os.Exit(exitcodes.Usage)
+		}
+		if args.reverse {
+			tlog.Warn.Printf("-journal is not supported in reverse mode and will be ignored")
+		}
+	}
+	// The tags region is only written by the forward mode, and the journal
+	// records do not know that it moves the data blocks
+	if frontendArgs.FileTags && (args.reverse || frontendArgs.Journal) {
+		tlog.Fatal.Printf("file tags are not compatible with -reverse and -journal")
+		os.Exit(exitcodes.Usage)
+	}
+	// Without DirIVs, the layers cannot share ciphertext names
+	if frontendArgs.LowerCipherdir != "" && frontendArgs.PlaintextNames {
+		tlog.Fatal.Printf("-lowerdir is not compatible with -plaintextnames")
+		os.Exit(exitcodes.Usage)
+	}
+	// The bucket directories are only understood by the forward mode Readdir
+	// and Lookup
+	if frontendArgs.Fanout && (args.reverse || frontendArgs.Quarantine || frontendArgs.LowerCipherdir != "") {
+		tlog.Fatal.Printf("-fanout is not compatible with -reverse, -quarantine and -lowerdir")
+		os.Exit(exitcodes.Usage)
+	}
+	// The trash directory is only hidden by encrypted names, and files
+	// deleted from the lower layer cannot be moved
+	if frontendArgs.Trash && (args.reverse || frontendArgs.PlaintextNames || frontendArgs.LowerCipherdir != "") {
+		tlog.Fatal.Printf("-trash is not compatible with -reverse, -plaintextnames and -lowerdir")
+		os.Exit(exitcodes.Usage)
+	}
 	// If allow_other is set and we run as root, try to give newly created files to
 	// the right user.
 	if args.allow_other && os.Getuid() == 0 {
@@ -305,8 +428,14 @@ func initFuseFrontend(args *argContainer) (rootNode fs.InodeEmbedder, wipeKeys f
 
 	// Init crypto backend
 	cCore := cryptocore.New(masterkey, cryptoBackend, contentenc.DefaultIVBits, args.hkdf, args.forcedecode)
-	cEnc := contentenc.New(cCore, contentenc.DefaultBS, args.forcedecode)
+	cEnc := contentenc.New(cCore, contentenc.DefaultBS, args.forcedecode, frontendArgs.FileTags)
 	nameTransform := nametransform.New(cCore.EMECipher, frontendArgs.LongNames, args.raw64)
+	nameEnc, err := nametransform.NewNameEncoding(args.name_encoding, args.raw64)
+	if err != nil {
+		tlog.Fatal.Printf("-name_encoding: %v", err)
+		os.Exit(exitcodes.Usage)
+	}
+	nameTransform.NameEnc = nameEnc
 	// Init badname patterns
 	nameTransform.BadnamePatterns = make([]string, 0)
 	for _, pattern := range args.badname {
@@ -330,8 +459,44 @@ func initFuseFrontend(args *argContainer) (rootNode fs.InodeEmbedder, wipeKeys f
 			log.Panic("reverse mode must use AES-SIV, everything else is insecure")
 		}
 		rootNode = fusefrontend_reverse.NewRootNode(frontendArgs, cEnc, nameTransform)
+		if args.optrace != "" {
+			tlog.Warn.Printf("-optrace is not supported in reverse mode and will be ignored")
+		}
 	} else {
-		rootNode = fusefrontend.NewRootNode(frontendArgs, cEnc, nameTransform)
+		rn := fusefrontend.NewRootNode(frontendArgs, cEnc, nameTransform)
+		if args.prefix != "" {
+			if err := rn.CheckPrefix(); err != nil {
+				tlog.Fatal.Printf("-prefix: %v", err)
+				os.Exit(exitcodes.CipherDir)
+			}
+		}
+		if err := rn.CheckUserPrefixes(); err != nil {
+			tlog.Fatal.Printf("-user_prefix: %v", err)
+			os.Exit(exitcodes.CipherDir)
+		}
+		if err := rn.CheckLowerdir(); err != nil {
+			tlog.Fatal.Printf("-lowerdir: %v", err)
+			os.Exit(exitcodes.CipherDir)
+		}
+		if args.optrace != "" {
+			rn.OpTrace, err = optrace.Create(args.optrace)
+			if err != nil {
+				tlog.Fatal.Printf("-optrace: %v", err)
+				os.Exit(exitcodes.Other)
+			}
+			tlog.Info.Printf("Writing FUSE operation trace to %s", args.optrace)
+		}
+		if args.metrics != "" {
+			rn.Metrics = metrics.New()
+			ln, err := net.Listen("tcp", args.metrics)
+			if err != nil {
+				tlog.Fatal.Printf("-metrics: %v", err)
+				os.Exit(exitcodes.Metrics)
+			}
+			go rn.Metrics.Serve(ln)
+			tlog.Info.Printf("Serving metrics at http://%s/metrics", ln.Addr())
+		}
+		rootNode = rn
 	}
 	// We have opened the socket early so that we cannot fail here after
 	// asking the user for the password
@@ -348,6 +513,9 @@ func initGoFuse(rootNode fs.InodeEmbedder, args *argContainer) *fuse.Server {
 	var fuseOpts *fs.Options
 	sec := time.Second
 	if args.sharedstorage {
+		if args.timeout_depth {
+			tlog.Warn.Printf("-timeout_depth has no effect with -sharedstorage")
+		}
 		// sharedstorage mode sets all cache timeouts to zero so changes to the
 		// backing shared storage show up immediately.
 		// Hard links are disabled by using automatically incrementing
@@ -357,11 +525,11 @@ func initGoFuse(rootNode fs.InodeEmbedder, args *argContainer) *fuse.Server {
 		}
 	} else {
 		fuseOpts = &fs.Options{
-			// These options are to be compatible with libfuse defaults,
+			// The defaults are compatible with libfuse defaults,
 			// making benchmarking easier.
 			NegativeTimeout: &sec,
-			AttrTimeout:     &sec,
-			EntryTimeout:    &sec,
+			AttrTimeout:     &args.attr_timeout,
+			EntryTimeout:    &args.entry_timeout,
 		}
 	}
 	fuseOpts.NullPermissions = true
@@ -450,7 +618,7 @@ func initGoFuse(rootNode fs.InodeEmbedder, args *argContainer) *fuse.Server {
 		tlog.Debug.Printf("Adding -ko mount options: %v", parts)
 		mOpts.Options = append(mOpts.Options, parts...)
 	}
-	srv, err := fs.Mount(args.mountpoint, rootNode, fuseOpts)
+	srv, err := mountLimited(args.mountpoint, rootNode, fuseOpts, args.concurrency)
 	if err != nil {
 		tlog.Fatal.Printf("fs.Mount failed: %s", strings.TrimSpace(err.Error()))
 		if runtime.GOOS == "darwin" {
@@ -467,6 +635,24 @@ func initGoFuse(rootNode fs.InodeEmbedder, args *argContainer) *fuse.Server {
 	return srv
 }
 
+// mountLimited is fs.Mount, with at most "concurrency" FUSE requests
+// processed at a time. Zero means no limit.
+func mountLimited(dir string, root fs.InodeEmbedder, options *fs.Options, concurrency int) (*fuse.Server, error) {
+	rawFS := fuselimit.New(fs.NewNodeFS(root, options), concurrency)
+	srv, err := fuse.NewServer(rawFS, dir, &options.MountOptions)
+	if err != nil {
+		return nil, err
+	}
+	go srv.Serve()
+	if err := srv.WaitMount(); err != nil {
+		return nil, err
+	}
+	if concurrency > 0 {
+		tlog.Debug.Printf("Processing at most %d FUSE requests at a time", concurrency)
+	}
+	return srv, nil
+}
+
 // haveFusermount2 finds out if the "fusermount" binary is from libfuse 2.x.
 func haveFusermount2() bool {
 	path, err := exec.LookPath("fusermount")
@@ -490,17 +676,78 @@ func haveFusermount2() bool {
 	return false
 }
 
+// shutdownTimeout is how long handleSigint waits for the regular unmount
+// before it detaches the mount lazily.
+const shutdownTimeout = 10 * time.Second
+
+// handleSigint unmounts and exits on SIGINT or SIGTERM. A second signal
+// exits immediately, without waiting for the unmount.
 func handleSigint(srv *fuse.Server, mountpoint string) {
-	ch := make(chan os.Signal, 1)
+	ch := make(chan os.Signal, 2)
 	signal.Notify(ch, os.Interrupt)
 	signal.Notify(ch, syscall.SIGTERM)
 	go func() {
-		<-ch
-		unmount(srv, mountpoint)
+		sig := <-ch
+		tlog.Info.Printf("Got %v, unmounting %q", sig, mountpoint)
+		go func() {
+			sig := <-ch
+			tlog.Warn.Printf("Got %v again, exiting without waiting for the unmount", sig)
+			os.Exit(exitcodes.SigInt)
+		}()
+		gracefulUnmount(srv, mountpoint, shutdownTimeout)
 		os.Exit(exitcodes.SigInt)
 	}()
 }
 
+// gracefulUnmount calls unmount() and gives it "timeout" to finish. The
+// regular unmount waits for in-flight requests. If it takes longer, for
+// example because a request hangs on an unresponsive backing filesystem,
+// the mount is detached lazily ("fusermount -u -z") on Linux.
+//
+// Data buffered by "-writebuffer" for files that are still open is written
+// out at the end, so it is not lost when we exit.
+func gracefulUnmount(srv *fuse.Server, mountpoint string, timeout time.Duration) {
+	done := make(chan struct{})
+	go func() {
+		unmount(srv, mountpoint)
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(timeout):
+		tlog.Warn.Printf("unmount: no success after %v", timeout)
+		if runtime.GOOS == "linux" {
+			tlog.Info.Printf("Forcing lazy unmount")
+			if err := fusermountLazy(mountpoint); err != nil {
+				tlog.Warn.Printf("unmount: lazy unmount failed: %v", err)
+			}
+		}
+	}
+	if errno := openfiletable.FlushAllPendingWrites(); errno != 0 {
+		tlog.Warn.Printf("unmount: flushing pending writes failed: %v", errno)
+	}
+}
+
+// switchToJournald implements "-journald": it sends our logs and the go-fuse
+// logs to journald as native entries. Each entry carries the mountpoint and
+// CIPHERDIR, so that "journalctl GOCRYPTFS_MOUNTPOINT=/mnt/foo" shows the
+// logs of one mount. If journald is not running, the logs stay where they
+// are.
+func switchToJournald(args *argContainer) {
+	fields := map[string]string{
+		"GOCRYPTFS_MOUNTPOINT": args.mountpoint,
+		"GOCRYPTFS_CIPHERDIR":  args.cipherdir,
+	}
+	if err := tlog.SwitchLoggerToJournald(tlog.JournalWarning, fields); err != nil {
+		tlog.Warn.Printf("-journald: cannot connect to journald, not switching: %v", err)
+		return
+	}
+	tlog.Info.SwitchToJournald(tlog.JournalInfo, fields)
+	tlog.Debug.SwitchToJournald(tlog.JournalDebug, fields)
+	tlog.Warn.SwitchToJournald(tlog.JournalWarning, fields)
+	tlog.Fatal.SwitchToJournald(tlog.JournalCrit, fields)
+}
+
 // unmount() calls srv.Unmount(), and if that fails, calls "fusermount -u -z"
 // (lazy unmount).
 func unmount(srv *fuse.Server, mountpoint string) {
@@ -508,12 +755,8 @@ func unmount(srv *fuse.Server, mountpoint string) {
 	if err != nil {
 		tlog.Warn.Printf("unmount: srv.Unmount returned %v", err)
 		if runtime.GOOS == "linux" {
-			// MacOSX does not support lazy unmount
 			tlog.Info.Printf("Trying lazy unmount")
-			cmd := exec.Command("fusermount", "-u", "-z", mountpoint)
-			cmd.Stdout = os.Stdout
-			cmd.Stderr = os.Stderr
-			cmd.Run()
+			fusermountLazy(mountpoint)
 		}
 	}
 }
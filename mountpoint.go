@@ -0,0 +1,106 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"runtime"
+	"syscall"
+
+	"github.com/rfjakob/gocryptfs/internal/tlog"
+)
+
+// staleMountError means that there is a FUSE mount on the mountpoint whose
+// filesystem process is gone, usually because it crashed or was killed. All
+// accesses fail with "Transport endpoint is not connected".
+type staleMountError struct {
+	mountpoint string
+}
+
+func (e *staleMountError) Error() string {
+	return fmt.Sprintf("mountpoint %q is a stale FUSE mount (transport endpoint is not connected). "+
+		"Run \"fusermount -u -z %s\" or pass -unmount_stale.", e.mountpoint, e.mountpoint)
+}
+
+// Overridden by tests
+var (
+	statMountpoint = os.Lstat
+	lazyUnmount    = fusermountLazy
+)
+
+// fusermountLazy detaches the FUSE mount at "mountpoint" even if it is
+// stale or programs still use it.
+func fusermountLazy(mountpoint string) error {
+	if runtime.GOOS != "linux" {
+		// MacOSX does not support lazy unmount
+		return fmt.Errorf("lazy unmount is only supported on Linux, try \"umount -f %s\"", mountpoint)
+	}
+	cmd := exec.Command("fusermount", "-u", "-z", mountpoint)
+	cmd.Stdout = os.Stdout
+	cmd.Stderr = os.Stderr
+	return cmd.Run()
+}
+
+// checkMountpoint returns a *staleMountError if "mountpoint" is a stale FUSE
+// mount. With "unmountStale", the stale mount is lazily unmounted instead, and
+// the mountpoint is checked again. Mounting on top of a working mount, like a
+// bind mount or a container volume, is allowed. It only gives a warning unless
+// "nonempty" says that this is expected. Other problems are left to the
+// caller.
+func checkMountpoint(mountpoint string, unmountStale bool, nonempty bool) error {
+	_, err := statMountpoint(mountpoint)
+	if errors.Is(err, syscall.ENOTCONN) {
+		stale := &staleMountError{mountpoint}
+		if !unmountStale {
+			return stale
+		}
+		tlog.Info.Printf("Mountpoint %q is a stale FUSE mount, unmounting it", mountpoint)
+		if err = lazyUnmount(mountpoint); err != nil {
+			tlog.Warn.Printf("unmounting %q failed: %v", mountpoint, err)
+			return stale
+		}
+		if _, err = statMountpoint(mountpoint); errors.Is(err, syscall.ENOTCONN) {
+			return stale
+		}
+	}
+	if err == nil && !nonempty && isMountRoot(mountpoint) {
+		tlog.Warn.Printf("Mountpoint %q is itself a mount point, mounting on top of it", mountpoint)
+	}
+	return nil
+}
+
+// isMountRoot returns true if "dir" is the root directory of a mount, that
+// is, it is on a different device than its parent directory.
+func isMountRoot(dir string) bool {
+	parent := filepath.Dir(dir)
+	if parent == dir {
+		return false
+	}
+	st, err := statMountpoint(dir)
+	if err != nil {
+		return false
+	}
+	pst, err := statMountpoint(parent)
+	if err != nil {
+		return false
+	}
+	return st.Sys().(*syscall.Stat_t).Dev != pst.Sys().(*syscall.Stat_t).Dev
+}
+
+// cleanupAfterServe is called after the FUSE serve loop has exited, which
+// should only happen because the filesystem was unmounted. If the loop exited
+// because reading from /dev/fuse failed instead, the mount is still there but
+// dead. It is lazily unmounted so it does not stay behind as a stale mount.
+// Returns true if that happened.
+func cleanupAfterServe(mountpoint string) bool {
+	if _, err := statMountpoint(mountpoint); !errors.Is(err, syscall.ENOTCONN) {
+		return false
+	}
+	tlog.Warn.Printf("The FUSE serve loop exited, but %q is still mounted. Unmounting it.", mountpoint)
+	if err := lazyUnmount(mountpoint); err != nil {
+		tlog.Warn.Printf("%v", err)
+	}
+	return true
+}
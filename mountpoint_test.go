@@ -0,0 +1,114 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"syscall"
+	"testing"
+)
+
+// TestCheckMountpointStale simulates a stale mount and checks that it is
+// reported, and that -unmount_stale cleans it up.
+func TestCheckMountpointStale(t *testing.T) {
+	dir, err := ioutil.TempDir("", "TestCheckMountpointStale")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(dir)
+	stale := true
+	unmounts := 0
+	statMountpoint = func(name string) (os.FileInfo, error) {
+		if name == dir && stale {
+			return nil, &os.PathError{Op: "lstat", Path: name, Err: syscall.ENOTCONN}
+		}
+		return os.Lstat(name)
+	}
+	lazyUnmount = func(mountpoint string) error {
+		unmounts++
+		stale = false
+		return nil
+	}
+	defer func() {
+		statMountpoint = os.Lstat
+		lazyUnmount = fusermountLazy
+	}()
+
+	err = checkMountpoint(dir, false, false)
+	if _, ok := err.(*staleMountError); !ok {
+		t.Fatalf("want a *staleMountError, got %v", err)
+	}
+	if unmounts != 0 {
+		t.Fatal("unmounted without -unmount_stale")
+	}
+	if err = checkMountpoint(dir, true, false); err != nil {
+		t.Fatal(err)
+	}
+	if unmounts != 1 {
+		t.Errorf("want one unmount, got %d", unmounts)
+	}
+	// Nothing to clean up anymore
+	if err = checkMountpoint(dir, true, false); err != nil || unmounts != 1 {
+		t.Errorf("err=%v unmounts=%d", err, unmounts)
+	}
+}
+
+// TestCheckMountpointLive checks that a live mount is accepted as a
+// mountpoint, and is not unmounted.
+func TestCheckMountpointLive(t *testing.T) {
+	// /proc is a mount on any Linux system
+	if _, err := os.Stat("/proc/self"); err != nil {
+		t.Skip("no /proc mount")
+	}
+	lazyUnmount = func(mountpoint string) error {
+		t.Fatalf("must not unmount %q", mountpoint)
+		return nil
+	}
+	defer func() { lazyUnmount = fusermountLazy }()
+	if !isMountRoot("/proc") {
+		t.Error("/proc is not detected as a mount root")
+	}
+	for _, nonempty := range []bool{false, true} {
+		if err := checkMountpoint("/proc", true, nonempty); err != nil {
+			t.Errorf("nonempty=%v: %v", nonempty, err)
+		}
+	}
+	dir, err := ioutil.TempDir("", "TestCheckMountpointLive")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(dir)
+	if isMountRoot(dir) {
+		t.Errorf("plain directory %q is detected as a mount root", dir)
+	}
+	if err = checkMountpoint(dir, true, false); err != nil {
+		t.Errorf("plain directory: %v", err)
+	}
+}
+
+// TestCleanupAfterServe checks that a mount whose serve loop has exited is
+// removed, and a cleanly unmounted one is left alone.
+func TestCleanupAfterServe(t *testing.T) {
+	stale := false
+	unmounts := 0
+	statMountpoint = func(name string) (os.FileInfo, error) {
+		if stale {
+			return nil, &os.PathError{Op: "lstat", Path: name, Err: syscall.ENOTCONN}
+		}
+		return os.Lstat(name)
+	}
+	lazyUnmount = func(mountpoint string) error {
+		unmounts++
+		return nil
+	}
+	defer func() {
+		statMountpoint = os.Lstat
+		lazyUnmount = fusermountLazy
+	}()
+	if cleanupAfterServe("/") || unmounts != 0 {
+		t.Errorf("unmounted a mountpoint that is not stale")
+	}
+	stale = true
+	if !cleanupAfterServe("/") || unmounts != 1 {
+		t.Errorf("stale mount was not unmounted")
+	}
+}
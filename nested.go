@@ -0,0 +1,101 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strings"
+
+	"golang.org/x/sys/unix"
+
+	"github.com/rfjakob/gocryptfs/internal/configfile"
+	"github.com/rfjakob/gocryptfs/internal/exitcodes"
+	"github.com/rfjakob/gocryptfs/internal/tlog"
+)
+
+// fuseSuperMagic is the statfs f_type of all FUSE filesystems on Linux
+const fuseSuperMagic = 0x65735546
+
+// gocryptfsMountOf returns the mountpoint of the forward-mode gocryptfs mount
+// that "dir" resides on, or "" if it is not on one (or we cannot tell, like
+// on MacOS).
+func gocryptfsMountOf(dir string) string {
+	if runtime.GOOS != "linux" {
+		return ""
+	}
+	var st unix.Statfs_t
+	if err := unix.Statfs(dir, &st); err != nil || uint32(st.Type) != fuseSuperMagic {
+		return ""
+	}
+	dir, err := filepath.EvalSymlinks(dir)
+	if err != nil {
+		return ""
+	}
+	content, err := ioutil.ReadFile("/proc/self/mountinfo")
+	if err != nil {
+		return ""
+	}
+	// The mount with the longest mountpoint that contains "dir" is the one
+	// "dir" is on
+	var best, bestType string
+	for _, line := range strings.Split(string(content), "\n") {
+		// Format: ID PARENT MAJ:MIN ROOT MOUNTPOINT OPTIONS [OPTIONAL...] - TYPE SOURCE SUPER_OPTIONS
+		fields := strings.Fields(line)
+		sep := -1
+		for i, f := range fields {
+			if f == "-" {
+				sep = i
+				break
+			}
+		}
+		if len(fields) < 5 || sep < 0 || sep+1 >= len(fields) {
+			continue
+		}
+		mnt := unescapeMountinfo(fields[4])
+		if mnt != "/" && dir != mnt && !strings.HasPrefix(dir, mnt+"/") {
+			continue
+		}
+		if len(mnt) >= len(best) {
+			best, bestType = mnt, fields[sep+1]
+		}
+	}
+	if bestType != "fuse.gocryptfs" {
+		return ""
+	}
+	return best
+}
+
+// unescapeMountinfo undoes the octal escaping of spaces, tabs, newlines and
+// backslashes in /proc/self/mountinfo.
+func unescapeMountinfo(s string) string {
+	return strings.NewReplacer(`\040`, " ", `\011`, "\t", `\012`, "\n", `\134`, `\`).Replace(s)
+}
+
+// checkNested exits with an error if "dir", which is about to be used as a
+// forward-mode CIPHERDIR, is inside a gocryptfs mount. The files would be
+// encrypted twice, which is almost always a mistake. "-allow_nested" turns the
+// error into a warning.
+func checkNested(args *argContainer, dir string) {
+	mnt := gocryptfsMountOf(dir)
+	if mnt == "" {
+		return
+	}
+	if args.allow_nested {
+		tlog.Warn.Printf("Warning: %q is inside the gocryptfs mount %q, files will be encrypted twice", dir, mnt)
+		return
+	}
+	tlog.Fatal.Printf("%q is inside the gocryptfs mount %q. Files would be encrypted twice.", dir, mnt)
+	tlog.Fatal.Printf("Did you mean to use the cipherdir of that mount? Pass -allow_nested if this is intended.")
+	os.Exit(exitcodes.CipherDir)
+}
+
+// hasConfig checks if "dir" contains a gocryptfs config file.
+func hasConfig(dir string) bool {
+	for _, name := range []string{configfile.ConfDefaultName, configfile.ConfReverseName} {
+		if _, err := os.Stat(filepath.Join(dir, name)); err == nil {
+			return true
+		}
+	}
+	return false
+}
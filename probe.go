@@ -0,0 +1,57 @@
+package main
+
+import (
+	"os"
+
+	"github.com/rfjakob/gocryptfs/internal/atrest"
+	"github.com/rfjakob/gocryptfs/internal/exitcodes"
+	"github.com/rfjakob/gocryptfs/internal/fsprobe"
+	"github.com/rfjakob/gocryptfs/internal/tlog"
+)
+
+// probeCipherdir checks that the filesystem CIPHERDIR is on supports what
+// gocryptfs needs. Missing capabilities are reported as warnings. If one is
+// missing that could corrupt files, we exit, unless "-noprobe" is passed.
+func probeCipherdir(cipherdir string) {
+	checks := fsprobe.Run(cipherdir)
+	for _, c := range checks {
+		switch c.Severity {
+		case fsprobe.OK:
+			tlog.Debug.Printf("probe: %v", c)
+		case fsprobe.Warn:
+			tlog.Warn.Printf("The filesystem CIPHERDIR is on lacks a capability: %v", c)
+		case fsprobe.Fatal:
+			tlog.Fatal.Printf("The filesystem CIPHERDIR is on lacks a capability: %v", c)
+		}
+	}
+	if fsprobe.Worst(checks) == fsprobe.Fatal {
+		tlog.Fatal.Printf("Refusing to mount, as this could corrupt files. Pass -noprobe to mount anyway.")
+		os.Exit(exitcodes.BackingFS)
+	}
+}
+
+// requireEncryptedVolume exits unless CIPHERDIR is on a volume that is
+// encrypted at rest. In reverse mode, this is the plaintext directory.
+func requireEncryptedVolume(cipherdir string) {
+	encrypted, why := atrest.Check(cipherdir)
+	for _, w := range why {
+		tlog.Debug.Printf("require_encrypted_volume: %s", w)
+	}
+	if encrypted {
+		return
+	}
+	tlog.Fatal.Printf("CIPHERDIR %q is not on an encrypted volume, or this could not be verified:", cipherdir)
+	for _, w := range why {
+		tlog.Fatal.Printf("  %s", w)
+	}
+	tlog.Fatal.Printf("Refusing to mount because of -require_encrypted_volume.")
+	os.Exit(exitcodes.UnencryptedVolume)
+}
+
+// warnWipeMedia warns if "-wipe" cannot be relied on for CIPHERDIR, because
+// overwriting a file there may leave its old content on the disk
+func warnWipeMedia(cipherdir string) {
+	for _, why := range atrest.WipeUnreliable(cipherdir) {
+		tlog.Warn.Printf("-wipe: %s, overwritten file content may still be recoverable", why)
+	}
+}
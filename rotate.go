@@ -0,0 +1,47 @@
+package main
+
+import (
+	"os"
+	"time"
+
+	"github.com/rfjakob/gocryptfs/internal/exitcodes"
+	"github.com/rfjakob/gocryptfs/internal/fusefrontend"
+	"github.com/rfjakob/gocryptfs/internal/tlog"
+)
+
+// rotateFileIDs handles "gocryptfs -rotate_fileids CIPHERDIR". It gives every
+// file in CIPHERDIR a new random file ID and re-encrypts its content with it.
+// Progress is saved to the config file name plus ".rotate", so running the
+// command again after an interruption continues where it stopped.
+//
+// Returns the exit code.
+func rotateFileIDs(args *argContainer) int {
+	if args.reverse {
+		tlog.Fatal.Printf("-rotate_fileids cannot be used together with -reverse")
+		os.Exit(exitcodes.Usage)
+	}
+	pfs, wipeKeys := initFuseFrontend(args)
+	defer wipeKeys()
+	rn := pfs.(*fusefrontend.RootNode)
+	stateFile := args.config + ".rotate"
+	var last time.Time
+	progress := func(done, total int) {
+		if time.Since(last) < 5*time.Second && done < total {
+			return
+		}
+		last = time.Now()
+		tlog.Info.Printf("rotate_fileids: %d of %d files", done, total)
+	}
+	stats, err := rn.RotateFileIDs(stateFile, progress)
+	if err != nil {
+		tlog.Fatal.Printf("rotate_fileids: %v", err)
+		return exitcodes.RotateFileIDs
+	}
+	tlog.Info.Printf("rotate_fileids: %d files rotated, %d skipped, %d errors",
+		stats.Rotated, stats.Skipped, stats.Failed)
+	if stats.Failed > 0 {
+		tlog.Info.Printf("rotate_fileids: run again to retry, progress is saved in %s", stateFile)
+		return exitcodes.RotateFileIDs
+	}
+	return 0
+}
@@ -0,0 +1,52 @@
+package main
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/rfjakob/gocryptfs/internal/contentenc"
+	"github.com/rfjakob/gocryptfs/internal/cryptocore"
+	"github.com/rfjakob/gocryptfs/internal/exitcodes"
+	"github.com/rfjakob/gocryptfs/internal/stupidgcm"
+	"github.com/rfjakob/gocryptfs/internal/tlog"
+)
+
+// selfTestIterations is the number of random writes per backend, on top of
+// the ones at the block boundaries
+const selfTestIterations = 2000
+
+// selfTest handles "gocryptfs -selftest". It runs contentenc.SelfTest with a
+// random key for every crypto backend. A zero "seed" is replaced by a random
+// one, which is printed so that a failed run can be repeated.
+//
+// Returns the exit code.
+func selfTest(seed int64) int {
+	if seed == 0 {
+		seed = time.Now().UnixNano()
+	}
+	type selfTestBackend struct {
+		name    string
+		backend cryptocore.AEADTypeEnum
+	}
+	backends := []selfTestBackend{
+		{"AES-GCM-256-Go", cryptocore.BackendGoGCM},
+		{"AES-SIV-512-Go", cryptocore.BackendAESSIV},
+	}
+	if !stupidgcm.BuiltWithoutOpenssl {
+		backends = append(backends, selfTestBackend{"AES-GCM-256-OpenSSL", cryptocore.BackendOpenSSL})
+	}
+	fmt.Printf("Seed: %d\n", seed)
+	key := cryptocore.RandBytes(cryptocore.KeyLen)
+	for _, b := range backends {
+		cc := cryptocore.New(key, b.backend, contentenc.DefaultIVBits, true, false)
+		ce := contentenc.New(cc, contentenc.DefaultBS, false, false)
+		err := ce.SelfTest(seed, selfTestIterations)
+		ce.Wipe()
+		if err != nil {
+			tlog.Fatal.Printf("%s: %v", b.name, err)
+			return exitcodes.SelfTest
+		}
+		fmt.Printf("%-20s\tok\n", b.name)
+	}
+	return 0
+}
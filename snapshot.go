@@ -0,0 +1,61 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/rfjakob/gocryptfs/ctlsock"
+	"github.com/rfjakob/gocryptfs/internal/exitcodes"
+	"github.com/rfjakob/gocryptfs/internal/snapshot"
+	"github.com/rfjakob/gocryptfs/internal/tlog"
+)
+
+// snapshotTimeout is how long we wait for a mounted gocryptfs to finish a
+// snapshot requested over the control socket.
+const snapshotTimeout = 1 * time.Hour
+
+// takeSnapshot handles "gocryptfs -snapshot DEST CIPHERDIR". It copies
+// CIPHERDIR to DEST, using reflinks where the filesystem supports them.
+//
+// If CIPHERDIR is mounted, pass the control socket of the mount via "-ctlsock".
+// The mount then blocks writes while the copy runs. Without "-ctlsock", the
+// copy is done directly and writes are not blocked.
+func takeSnapshot(args *argContainer) {
+	dst, err := filepath.Abs(args.snapshot)
+	if err != nil {
+		tlog.Fatal.Printf("Invalid -snapshot path: %v", err)
+		os.Exit(exitcodes.Usage)
+	}
+	if _, err := os.Lstat(dst); err == nil {
+		tlog.Fatal.Printf("Snapshot destination %q already exists", dst)
+		os.Exit(exitcodes.Snapshot)
+	}
+	if args.ctlsock != "" {
+		c, err := ctlsock.New(args.ctlsock)
+		if err != nil {
+			tlog.Fatal.Printf("Cannot connect to control socket: %v", err)
+			os.Exit(exitcodes.CtlSock)
+		}
+		defer c.Close()
+		resp, err := c.QueryTimeout(&ctlsock.RequestStruct{Snapshot: dst}, snapshotTimeout)
+		if err != nil {
+			tlog.Fatal.Printf("Snapshot failed: %v", err)
+			os.Exit(exitcodes.Snapshot)
+		}
+		if resp.WarnText != "" {
+			tlog.Warn.Printf("%s", resp.WarnText)
+		}
+		tlog.Info.Printf("Snapshot of the mounted filesystem written to %s", resp.Result)
+		return
+	}
+	reflinked, err := snapshot.Copy(args.cipherdir, dst)
+	if err != nil {
+		tlog.Fatal.Printf("Snapshot failed: %v", err)
+		os.Exit(exitcodes.Snapshot)
+	}
+	if !reflinked {
+		tlog.Warn.Printf("Reflinks are not supported, data has been copied")
+	}
+	tlog.Info.Printf("Snapshot written to %s", dst)
+}
@@ -3,10 +3,16 @@ package cli
 // Test CLI operations like "-init", "-password" etc
 
 import (
+	"archive/tar"
+	"bytes"
+	"encoding/json"
+	"errors"
 	"fmt"
+	"io"
 	"io/ioutil"
 	"os"
 	"os/exec"
+	"path/filepath"
 	"strconv"
 	"strings"
 	"sync"
@@ -15,8 +21,11 @@ import (
 	"time"
 
 	"github.com/rfjakob/gocryptfs/internal/configfile"
+	"github.com/rfjakob/gocryptfs/internal/contentenc"
 	"github.com/rfjakob/gocryptfs/internal/exitcodes"
+	"github.com/rfjakob/gocryptfs/internal/fusefrontend"
 
+	"github.com/rfjakob/gocryptfs/tests/inprocess"
 	"github.com/rfjakob/gocryptfs/tests/test_helpers"
 )
 
@@ -85,6 +94,40 @@ func TestInitAessiv(t *testing.T) {
 	}
 }
 
+// Test -init with -masterkey_len
+func TestInitMasterKeyLen(t *testing.T) {
+	for _, l := range []string{"16", "65"} {
+		dir, err := ioutil.TempDir(test_helpers.TmpDir, "TestInitMasterKeyLen")
+		if err != nil {
+			t.Fatal(err)
+		}
+		cmd := exec.Command(test_helpers.GocryptfsBinary, "-init", "-extpass", "echo test", "-masterkey_len="+l, dir)
+		err = cmd.Run()
+		if exitCode := test_helpers.ExtractCmdExitCode(err); exitCode != exitcodes.Usage {
+			t.Errorf("-masterkey_len=%s: wrong exit code: have=%d, want=%d", l, exitCode, exitcodes.Usage)
+		}
+	}
+	dir := test_helpers.InitFS(t, "-masterkey_len=48")
+	key, c, err := configfile.LoadAndDecrypt(dir+"/"+configfile.ConfDefaultName, testPw)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(key) != 48 || c.MasterKeyLen != 48 {
+		t.Errorf("wrong master key length: key=%d config=%d", len(key), c.MasterKeyLen)
+	}
+	mnt := dir + ".mnt"
+	test_helpers.MountOrFatal(t, dir, mnt, "-extpass=echo test")
+	defer test_helpers.UnmountPanic(mnt)
+	want := []byte("hello world")
+	if err := ioutil.WriteFile(mnt+"/file", want, 0600); err != nil {
+		t.Fatal(err)
+	}
+	have, err := ioutil.ReadFile(mnt + "/file")
+	if err != nil || !bytes.Equal(have, want) {
+		t.Errorf("read back %q, %v", have, err)
+	}
+}
+
 // Test -init with -reverse
 func TestInitReverse(t *testing.T) {
 	dir := test_helpers.InitFS(t, "-reverse")
@@ -305,6 +348,65 @@ func TestPasswdScryptn(t *testing.T) {
 	}
 }
 
+// keySlotCmd runs "gocryptfs -q FLAG DIR" and feeds it "passwords" on stdin,
+// one per line. Returns the exit code.
+func keySlotCmd(t *testing.T, flag string, dir string, passwords ...string) int {
+	cmd := exec.Command(test_helpers.GocryptfsBinary, "-q", flag, dir)
+	cmd.Stdin = strings.NewReader(strings.Join(passwords, "\n") + "\n")
+	cmd.Stderr = os.Stderr
+	return test_helpers.ExtractCmdExitCode(cmd.Run())
+}
+
+// Test -add_key and -remove_key: two passwords both unlock and mount the
+// filesystem, and removing one leaves the other working
+func TestKeySlots(t *testing.T) {
+	dir := test_helpers.InitFS(t) // Password "test"
+	// Old password, new password
+	if code := keySlotCmd(t, "-add_key", dir, "test", "second"); code != 0 {
+		t.Fatalf("-add_key failed with exit code %d", code)
+	}
+	if code := keySlotCmd(t, "-add_key", dir, "wrong", "third"); code != exitcodes.PasswordIncorrect {
+		t.Errorf("-add_key with a wrong password: want exit code %d, have %d", exitcodes.PasswordIncorrect, code)
+	}
+	for _, pw := range []string{"test", "second"} {
+		if code := keySlotCmd(t, "-unlockcheck", dir, pw); code != 0 {
+			t.Errorf("password %q does not unlock: exit code %d", pw, code)
+		}
+	}
+	if code := keySlotCmd(t, "-remove_key", dir, "test"); code != 0 {
+		t.Fatalf("-remove_key failed with exit code %d", code)
+	}
+	if code := keySlotCmd(t, "-unlockcheck", dir, "test"); code != exitcodes.PasswordIncorrect {
+		t.Errorf("removed password: want exit code %d, have %d", exitcodes.PasswordIncorrect, code)
+	}
+	if code := keySlotCmd(t, "-unlockcheck", dir, "second"); code != 0 {
+		t.Errorf("remaining password does not unlock: exit code %d", code)
+	}
+	// The last password cannot be removed
+	if code := keySlotCmd(t, "-remove_key", dir, "second"); code != exitcodes.Usage {
+		t.Errorf("removing the last password: want exit code %d, have %d", exitcodes.Usage, code)
+	}
+
+	// Write a file with one password and read it with the other
+	if code := keySlotCmd(t, "-add_key", dir, "second", "test"); code != 0 {
+		t.Fatalf("-add_key failed with exit code %d", code)
+	}
+	mnt := dir + ".mnt"
+	test_helpers.MountOrFatal(t, dir, mnt, "-extpass", "echo test")
+	if err := ioutil.WriteFile(mnt+"/file1", []byte("somecontent"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	test_helpers.UnmountPanic(mnt)
+	test_helpers.MountOrFatal(t, dir, mnt, "-extpass", "echo second")
+	defer test_helpers.UnmountPanic(mnt)
+	content, err := ioutil.ReadFile(mnt + "/file1")
+	if err != nil {
+		t.Fatal(err)
+	} else if string(content) != "somecontent" {
+		t.Errorf("wrong content: %q", string(content))
+	}
+}
+
 // Test -init & -config flag
 func TestInitConfig(t *testing.T) {
 	config := test_helpers.TmpDir + "/TestInitConfig.conf"
@@ -326,6 +428,79 @@ func TestInitConfig(t *testing.T) {
 	}
 }
 
+// Test -init -json
+func TestInitJSON(t *testing.T) {
+	testCases := []struct {
+		flags        []string
+		cipher       string
+		filenameMode string
+		nameEncoding string
+		masterKeyLen int
+	}{
+		{nil, "AES-GCM", "encrypted", "base64url", 32},
+		{[]string{"-aessiv", "-plaintextnames", "-masterkey_len=48"}, "AES-SIV", "plaintext", "", 48},
+		{[]string{"-name_encoding=base32"}, "AES-GCM", "encrypted", "base32", 32},
+	}
+	for _, tc := range testCases {
+		dir, err := ioutil.TempDir(test_helpers.TmpDir, "TestInitJSON")
+		if err != nil {
+			t.Fatal(err)
+		}
+		args := append([]string{"-init", "-json", "-extpass", "echo test", "-scryptn=10"}, tc.flags...)
+		cmd := exec.Command(test_helpers.GocryptfsBinary, append(args, dir)...)
+		cmd.Stderr = os.Stderr
+		out, err := cmd.Output()
+		if err != nil {
+			t.Fatal(err)
+		}
+		var s struct {
+			CipherDir, Config, Cipher, FilenameMode, NameEncoding string
+			Version                                               uint16
+			BlockSize, MasterKeyLen                               int
+			FeatureFlags                                          []string
+			KDF                                                   struct {
+				Algorithm                string
+				N, R, P, KeyLen, SaltLen int
+			}
+		}
+		// Fails if anything besides the JSON was printed
+		if err = json.Unmarshal(out, &s); err != nil {
+			t.Fatalf("%v: %v\n%s", tc.flags, err, out)
+		}
+		if s.CipherDir != dir || s.Config != dir+"/"+configfile.ConfDefaultName {
+			t.Errorf("%v: wrong paths %q %q", tc.flags, s.CipherDir, s.Config)
+		}
+		if s.Cipher != tc.cipher || s.FilenameMode != tc.filenameMode || s.NameEncoding != tc.nameEncoding {
+			t.Errorf("%v: have %q %q %q", tc.flags, s.Cipher, s.FilenameMode, s.NameEncoding)
+		}
+		if s.Version != 2 || s.BlockSize != 4096 || s.MasterKeyLen != tc.masterKeyLen {
+			t.Errorf("%v: have version %d, block size %d, key length %d", tc.flags, s.Version, s.BlockSize, s.MasterKeyLen)
+		}
+		if s.KDF.Algorithm != "scrypt" || s.KDF.N != 1<<10 || s.KDF.R != 8 || s.KDF.P != 1 || s.KDF.KeyLen != 32 || s.KDF.SaltLen != 32 {
+			t.Errorf("%v: wrong KDF parameters %+v", tc.flags, s.KDF)
+		}
+		// The summary matches what is on disk
+		_, c, err := configfile.LoadAndDecrypt(s.Config, testPw)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if strings.Join(c.FeatureFlags, " ") != strings.Join(s.FeatureFlags, " ") {
+			t.Errorf("%v: feature flags %v, config file has %v", tc.flags, s.FeatureFlags, c.FeatureFlags)
+		}
+		for _, secret := range []string{"EncryptedKey", "Salt\"", "\"test\""} {
+			if strings.Contains(string(out), secret) {
+				t.Errorf("%v: output contains %q:\n%s", tc.flags, secret, out)
+			}
+		}
+	}
+	// -json without -init
+	cmd := exec.Command(test_helpers.GocryptfsBinary, "-json", "-info", test_helpers.InitFS(t))
+	err := cmd.Run()
+	if exitCode := test_helpers.ExtractCmdExitCode(err); exitCode != exitcodes.Usage {
+		t.Errorf("-json -info: wrong exit code: have=%d, want=%d", exitCode, exitcodes.Usage)
+	}
+}
+
 // Test -ro
 func TestRo(t *testing.T) {
 	dir := test_helpers.InitFS(t)
@@ -344,6 +519,64 @@ func TestRo(t *testing.T) {
 	}
 }
 
+// newerFormat rewrites the config file in "dir" like a gocryptfs with the
+// next on-disk format version would write it. "readCompat" is the oldest
+// version it declares to be readable by, zero for none.
+func newerFormat(t *testing.T, dir string, readCompat uint16) {
+	conf := filepath.Join(dir, "gocryptfs.conf")
+	js, err := ioutil.ReadFile(conf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var cf configfile.ConfFile
+	if err = json.Unmarshal(js, &cf); err != nil {
+		t.Fatal(err)
+	}
+	cf.Version = contentenc.CurrentVersion + 1
+	cf.ReadCompatVersion = readCompat
+	cf.Creator = "gocryptfs v99"
+	if js, err = json.Marshal(cf); err != nil {
+		t.Fatal(err)
+	}
+	if err = ioutil.WriteFile(conf, js, 0600); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// Test mounting a filesystem created by a newer on-disk format version: a
+// read-compatible one mounts read-only, an incompatible one is refused with
+// a message that names the version.
+func TestNewerFormat(t *testing.T) {
+	dir := test_helpers.InitFS(t)
+	mnt := dir + ".mnt"
+	test_helpers.MountOrFatal(t, dir, mnt, "-extpass=echo test")
+	if err := ioutil.WriteFile(mnt+"/file", []byte("hello"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	test_helpers.UnmountPanic(mnt)
+
+	newerFormat(t, dir, contentenc.CurrentVersion)
+	test_helpers.MountOrFatal(t, dir, mnt, "-extpass=echo test")
+	content, err := ioutil.ReadFile(mnt + "/file")
+	if err != nil || string(content) != "hello" {
+		t.Errorf("read-compatible newer format: read %q, %v", content, err)
+	}
+	if _, err = os.Create(mnt + "/file2"); err == nil {
+		t.Errorf("read-compatible newer format must be mounted read-only")
+	}
+	test_helpers.UnmountPanic(mnt)
+
+	newerFormat(t, dir, 0)
+	cmd := exec.Command(test_helpers.GocryptfsBinary, "-extpass=echo test", dir, mnt)
+	out, err := cmd.CombinedOutput()
+	if exitCode := test_helpers.ExtractCmdExitCode(err); exitCode != exitcodes.NewerFS {
+		t.Errorf("incompatible newer format: wrong exit code: have=%d, want=%d", exitCode, exitcodes.NewerFS)
+	}
+	if !strings.Contains(string(out), "gocryptfs v99") {
+		t.Errorf("error message does not name the newer version: %s", out)
+	}
+}
+
 // Test "-nonempty"
 func TestNonempty(t *testing.T) {
 	dir := test_helpers.InitFS(t)
@@ -440,7 +673,9 @@ func TestPasswdPasswordIncorrect(t *testing.T) {
 
 // Check that we correctly background on mount and close stderr and stdout.
 // Something like
-//   gocryptfs a b | cat
+//
+//	gocryptfs a b | cat
+//
 // must not hang ( https://github.com/rfjakob/gocryptfs/issues/130 ).
 func TestMountBackground(t *testing.T) {
 	dir := test_helpers.InitFS(t)
@@ -493,7 +728,7 @@ func TestMountBackground(t *testing.T) {
 // user. Only one operation flag is allowed.
 func TestMultipleOperationFlags(t *testing.T) {
 	// Test all combinations
-	opFlags := []string{"-init", "-info", "-passwd", "-fsck"}
+	opFlags := []string{"-init", "-info", "-passwd", "-add_key", "-remove_key", "-fsck", "-snapshot=/tmp/x", "-unlockcheck", "-verifyhash", "-import=/tmp/x", "-check_file=x"}
 	for _, flag1 := range opFlags {
 		var flag2 string
 		for _, flag2 = range opFlags {
@@ -886,3 +1121,629 @@ func TestMountCreat(t *testing.T) {
 		test_helpers.UnmountPanic(mnt)
 	}
 }
+
+// Test "-snapshot" with and without "-ctlsock". The snapshots must be
+// mountable independently of the original.
+func TestSnapshot(t *testing.T) {
+	dir := test_helpers.InitFS(t)
+	mnt := dir + ".mnt"
+	sock := dir + ".sock"
+	test_helpers.MountOrFatal(t, dir, mnt, "-extpass=echo test", "-ctlsock="+sock)
+	content := []byte("snapshot content")
+	err := ioutil.WriteFile(mnt+"/file", content, 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Snapshot of the mounted filesystem through the control socket
+	snap1 := dir + ".snap1"
+	cmd := exec.Command(test_helpers.GocryptfsBinary, "-q", "-snapshot", snap1, "-ctlsock", sock, dir)
+	cmd.Stderr = os.Stderr
+	if err := cmd.Run(); err != nil {
+		t.Fatal(err)
+	}
+	test_helpers.UnmountPanic(mnt)
+	// Offline snapshot
+	snap2 := dir + ".snap2"
+	cmd = exec.Command(test_helpers.GocryptfsBinary, "-q", "-snapshot", snap2, dir)
+	cmd.Stderr = os.Stderr
+	if err := cmd.Run(); err != nil {
+		t.Fatal(err)
+	}
+	for _, snap := range []string{snap1, snap2} {
+		test_helpers.MountOrFatal(t, snap, mnt, "-extpass=echo test")
+		data, err := ioutil.ReadFile(mnt + "/file")
+		test_helpers.UnmountPanic(mnt)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(data) != string(content) {
+			t.Errorf("%s: wrong content %q", snap, data)
+		}
+	}
+	// The destination must not exist
+	cmd = exec.Command(test_helpers.GocryptfsBinary, "-q", "-snapshot", snap2, dir)
+	err = cmd.Run()
+	if exitCode := test_helpers.ExtractCmdExitCode(err); exitCode != exitcodes.Snapshot {
+		t.Errorf("want exit code %d, got %d", exitcodes.Snapshot, exitCode)
+	}
+}
+
+// Test "-unlockcheck" exit codes for the correct and a wrong password
+func TestUnlockCheck(t *testing.T) {
+	dir := test_helpers.InitFS(t) // Create filesystem with password "test"
+	cmd := exec.Command(test_helpers.GocryptfsBinary, "-q", "-unlockcheck", "-extpass", "echo test", dir)
+	out, err := cmd.CombinedOutput()
+	if err != nil {
+		t.Errorf("correct password: %v, output: %q", err, out)
+	}
+	if len(out) != 0 {
+		t.Errorf("-q should silence the output, got %q", out)
+	}
+	cmd = exec.Command(test_helpers.GocryptfsBinary, "-unlockcheck", "-extpass", "echo WRONG", dir)
+	err = cmd.Run()
+	exitCode := test_helpers.ExtractCmdExitCode(err)
+	if exitCode != exitcodes.PasswordIncorrect {
+		t.Errorf("wrong password: want=%d, got=%d", exitcodes.PasswordIncorrect, exitCode)
+	}
+}
+
+// Test "-import": import a small tree, mount and check content and structure
+func TestImport(t *testing.T) {
+	dir := test_helpers.InitFS(t)
+	src := dir + ".src"
+	if err := os.MkdirAll(src+"/sub/deep", 0755); err != nil {
+		t.Fatal(err)
+	}
+	content := []byte("import content")
+	if err := ioutil.WriteFile(src+"/sub/deep/file", content, 0640); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Symlink("deep/file", src+"/sub/link"); err != nil {
+		t.Fatal(err)
+	}
+	if err := syscall.Mkfifo(src+"/fifo", 0600); err != nil {
+		t.Fatal(err)
+	}
+	mtime := time.Date(2001, 2, 3, 4, 5, 6, 0, time.UTC)
+	if err := os.Chtimes(src+"/sub", mtime, mtime); err != nil {
+		t.Fatal(err)
+	}
+	cmd := exec.Command(test_helpers.GocryptfsBinary, "-q", "-import", src, "-extpass", "echo test", dir)
+	out, err := cmd.CombinedOutput()
+	if err != nil {
+		t.Fatalf("%v, output: %q", err, out)
+	}
+	mnt := dir + ".mnt"
+	test_helpers.MountOrFatal(t, dir, mnt, "-extpass=echo test")
+	defer test_helpers.UnmountPanic(mnt)
+	data, err := ioutil.ReadFile(mnt + "/sub/link")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(data) != string(content) {
+		t.Errorf("wrong content %q", data)
+	}
+	fi, err := os.Stat(mnt + "/sub/deep/file")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if fi.Mode() != 0640 {
+		t.Errorf("wrong mode %v", fi.Mode())
+	}
+	fi, err = os.Stat(mnt + "/sub")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !fi.ModTime().Equal(mtime) {
+		t.Errorf("wrong mtime %v", fi.ModTime())
+	}
+	// The FIFO is skipped
+	if _, err = os.Lstat(mnt + "/fifo"); !os.IsNotExist(err) {
+		t.Errorf("fifo should have been skipped: %v", err)
+	}
+	// Importing again fails because the files exist already
+	cmd = exec.Command(test_helpers.GocryptfsBinary, "-q", "-import", src, "-extpass", "echo test", dir)
+	err = cmd.Run()
+	if exitCode := test_helpers.ExtractCmdExitCode(err); exitCode != exitcodes.Import {
+		t.Errorf("want exit code %d, got %d", exitcodes.Import, exitCode)
+	}
+}
+
+// TestImportExclude checks that -import does not walk excluded directories,
+// but their siblings
+func TestImportExclude(t *testing.T) {
+	dir := test_helpers.InitFS(t)
+	src := dir + ".src"
+	for _, d := range []string{".git", "node_modules/pkg", "src/node_modules_doc"} {
+		if err := os.MkdirAll(src+"/"+d, 0755); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for _, f := range []string{".git/config", "node_modules/pkg/index.js", "src/main.go", "src/node_modules_doc/README", "README"} {
+		if err := ioutil.WriteFile(src+"/"+f, []byte(f), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	cmd := exec.Command(test_helpers.GocryptfsBinary, "-import", src, "-extpass", "echo test",
+		"-exclude", ".git", "-exclude-wildcard", "node_modules", dir)
+	out, err := cmd.CombinedOutput()
+	if err != nil {
+		t.Fatalf("%v, output: %q", err, out)
+	}
+	if !strings.Contains(string(out), "5 entries imported, 2 excluded") {
+		t.Errorf("wrong summary: %q", out)
+	}
+	pfs, err := inprocess.New(dir, testPw, fusefrontend.Args{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer pfs.Close()
+	for _, f := range []string{"src/main.go", "src/node_modules_doc/README", "README"} {
+		if _, err := pfs.Stat(f); err != nil {
+			t.Errorf("%q was not imported: %v", f, err)
+		}
+	}
+	for _, f := range []string{".git", "node_modules"} {
+		if _, err := pfs.Stat(f); err != syscall.ENOENT {
+			t.Errorf("%q should have been excluded: %v", f, err)
+		}
+	}
+}
+
+// TestExportTar imports a small tree, exports it again with -export_tar and
+// compares what comes out of the tar stream with the originals.
+func TestExportTar(t *testing.T) {
+	dir := test_helpers.InitFS(t)
+	src := dir + ".src"
+	longName := strings.Repeat("long", 50)
+	if err := os.MkdirAll(src+"/sub/"+longName, 0750); err != nil {
+		t.Fatal(err)
+	}
+	files := map[string][]byte{
+		"small":                    []byte("small file"),
+		"empty":                    nil,
+		"sub/" + longName + "/big": bytes.Repeat([]byte("0123456789abcdef"), 20000),
+	}
+	for name, content := range files {
+		if err := ioutil.WriteFile(src+"/"+name, content, 0640); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := os.Symlink("../small", src+"/sub/link"); err != nil {
+		t.Fatal(err)
+	}
+	mtime := time.Date(2001, 2, 3, 4, 5, 6, 789, time.UTC)
+	for _, name := range []string{"small", "sub/" + longName} {
+		if err := os.Chtimes(src+"/"+name, mtime, mtime); err != nil {
+			t.Fatal(err)
+		}
+	}
+	cmd := exec.Command(test_helpers.GocryptfsBinary, "-q", "-import", src, "-extpass", "echo test", dir)
+	if out, err := cmd.CombinedOutput(); err != nil {
+		t.Fatalf("%v, output: %q", err, out)
+	}
+
+	cmd = exec.Command(test_helpers.GocryptfsBinary, "-export_tar", "-extpass", "echo test", dir)
+	var stdout, stderr bytes.Buffer
+	cmd.Stdout = &stdout
+	cmd.Stderr = &stderr
+	if err := cmd.Run(); err != nil {
+		t.Fatalf("%v, stderr: %q", err, stderr.String())
+	}
+	if !strings.Contains(stderr.String(), "6 entries exported, 0 skipped, 0 errors") {
+		t.Errorf("wrong summary: %q", stderr.String())
+	}
+	tr := tar.NewReader(&stdout)
+	seen := make(map[string]*tar.Header)
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		seen[hdr.Name] = hdr
+		if content, ok := files[hdr.Name]; ok {
+			data, err := ioutil.ReadAll(tr)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !bytes.Equal(data, content) {
+				t.Errorf("%s: wrong content, %d bytes", hdr.Name, len(data))
+			}
+			if hdr.Typeflag != tar.TypeReg || hdr.Mode != 0640 {
+				t.Errorf("%s: wrong type %c or mode %o", hdr.Name, hdr.Typeflag, hdr.Mode)
+			}
+		}
+	}
+	if len(seen) != 6 {
+		t.Errorf("want 6 entries, have %d", len(seen))
+	}
+	if hdr := seen["sub/link"]; hdr == nil || hdr.Typeflag != tar.TypeSymlink || hdr.Linkname != "../small" {
+		t.Errorf("wrong symlink: %+v", hdr)
+	}
+	if hdr := seen["sub/"+longName+"/"]; hdr == nil || hdr.Typeflag != tar.TypeDir || hdr.Mode != 0750 {
+		t.Errorf("wrong directory: %+v", hdr)
+	}
+	for _, name := range []string{"small", "sub/" + longName + "/"} {
+		if hdr := seen[name]; hdr == nil || !hdr.ModTime.Equal(mtime) {
+			t.Errorf("%s: wrong mtime: %+v", name, hdr)
+		}
+	}
+
+	// Reverse mode is not supported
+	cmd = exec.Command(test_helpers.GocryptfsBinary, "-export_tar", "-reverse", "-extpass", "echo test", dir)
+	if exitCode := test_helpers.ExtractCmdExitCode(cmd.Run()); exitCode != exitcodes.Usage {
+		t.Errorf("-reverse: want exit code %d, got %d", exitcodes.Usage, exitCode)
+	}
+}
+
+// TestHardlinksImportExport imports a tree with a hard link pair with
+// -import_hardlinks, checks that both names share one ciphertext file, and
+// that -export_tar writes the second name as a link to the first.
+func TestHardlinksImportExport(t *testing.T) {
+	dir := test_helpers.InitFS(t)
+	src := dir + ".src"
+	if err := os.MkdirAll(src+"/sub", 0755); err != nil {
+		t.Fatal(err)
+	}
+	content := []byte("hardlinked content")
+	if err := ioutil.WriteFile(src+"/a", content, 0640); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Link(src+"/a", src+"/sub/b"); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(src+"/c", content, 0640); err != nil {
+		t.Fatal(err)
+	}
+	cmd := exec.Command(test_helpers.GocryptfsBinary, "-q", "-import", src, "-import_hardlinks", "-extpass", "echo test", dir)
+	if out, err := cmd.CombinedOutput(); err != nil {
+		t.Fatalf("%v, output: %q", err, out)
+	}
+	pfs, err := inprocess.New(dir, testPw, fusefrontend.Args{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	a, errA := pfs.Stat("a")
+	b, errB := pfs.Stat("sub/b")
+	c, errC := pfs.Stat("c")
+	pfs.Close()
+	if errA != nil || errB != nil || errC != nil {
+		t.Fatal(errA, errB, errC)
+	}
+	if a.Ino != b.Ino || a.Nlink != 2 {
+		t.Errorf("a and sub/b are not hard links: ino %d/%d, nlink %d", a.Ino, b.Ino, a.Nlink)
+	}
+	if c.Ino == a.Ino || c.Nlink != 1 {
+		t.Errorf("c should be a separate file: ino %d, nlink %d", c.Ino, c.Nlink)
+	}
+
+	cmd = exec.Command(test_helpers.GocryptfsBinary, "-export_tar", "-extpass", "echo test", dir)
+	var stdout, stderr bytes.Buffer
+	cmd.Stdout = &stdout
+	cmd.Stderr = &stderr
+	if err := cmd.Run(); err != nil {
+		t.Fatalf("%v, stderr: %q", err, stderr.String())
+	}
+	tr := tar.NewReader(&stdout)
+	seen := make(map[string]*tar.Header)
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		seen[hdr.Name] = hdr
+		if hdr.Name == "a" {
+			if data, _ := ioutil.ReadAll(tr); !bytes.Equal(data, content) {
+				t.Errorf("a: wrong content %q", data)
+			}
+		}
+	}
+	if hdr := seen["a"]; hdr == nil || hdr.Typeflag != tar.TypeReg {
+		t.Errorf("wrong entry for a: %+v", hdr)
+	}
+	if hdr := seen["sub/b"]; hdr == nil || hdr.Typeflag != tar.TypeLink || hdr.Linkname != "a" {
+		t.Errorf("sub/b should be a link to a: %+v", hdr)
+	}
+	if hdr := seen["c"]; hdr == nil || hdr.Typeflag != tar.TypeReg {
+		t.Errorf("wrong entry for c: %+v", hdr)
+	}
+}
+
+// TestInitExisting checks that `gocryptfs -init` refuses to initialize an
+// existing cipherdir again
+func TestInitExisting(t *testing.T) {
+	dir := test_helpers.InitFS(t)
+	cmd := exec.Command(test_helpers.GocryptfsBinary, "-init", "-extpass", "echo test", dir)
+	out, err := cmd.CombinedOutput()
+	exitCode := test_helpers.ExtractCmdExitCode(err)
+	if exitCode != exitcodes.CipherDir {
+		t.Fatalf("wrong exit code: have=%d, want=%d", exitCode, exitcodes.CipherDir)
+	}
+	if !strings.Contains(string(out), "already contains a gocryptfs filesystem") {
+		t.Errorf("unexpected output: %q", out)
+	}
+	// Reverse mode would encrypt the ciphertext a second time
+	cmd = exec.Command(test_helpers.GocryptfsBinary, "-init", "-reverse", "-extpass", "echo test", "-scryptn=10", dir)
+	err = cmd.Run()
+	if exitCode := test_helpers.ExtractCmdExitCode(err); exitCode != exitcodes.CipherDir {
+		t.Fatalf("-reverse: wrong exit code: have=%d, want=%d", exitCode, exitcodes.CipherDir)
+	}
+	cmd = exec.Command(test_helpers.GocryptfsBinary, "-q", "-init", "-reverse", "-allow_nested", "-extpass", "echo test", "-scryptn=10", dir)
+	if out, err = cmd.CombinedOutput(); err != nil {
+		t.Fatalf("-reverse -allow_nested: %v, output: %q", err, out)
+	}
+}
+
+// TestInitNested checks that a cipherdir inside a gocryptfs mount is refused
+// unless -allow_nested is passed
+func TestInitNested(t *testing.T) {
+	dir := test_helpers.InitFS(t)
+	mnt := dir + ".mnt"
+	test_helpers.MountOrFatal(t, dir, mnt, "-extpass=echo test")
+	defer test_helpers.UnmountPanic(mnt)
+	inner := mnt + "/inner"
+	if err := os.Mkdir(inner, 0700); err != nil {
+		t.Fatal(err)
+	}
+	cmd := exec.Command(test_helpers.GocryptfsBinary, "-init", "-extpass", "echo test", "-scryptn=10", inner)
+	err := cmd.Run()
+	if exitCode := test_helpers.ExtractCmdExitCode(err); exitCode != exitcodes.CipherDir {
+		t.Fatalf("wrong exit code: have=%d, want=%d", exitCode, exitcodes.CipherDir)
+	}
+	cmd = exec.Command(test_helpers.GocryptfsBinary, "-q", "-init", "-allow_nested", "-extpass", "echo test", "-scryptn=10", inner)
+	if out, err := cmd.CombinedOutput(); err != nil {
+		t.Fatalf("-allow_nested: %v, output: %q", err, out)
+	}
+	// Mounting it needs -allow_nested as well
+	innerMnt := dir + ".inner.mnt"
+	if err := test_helpers.Mount(inner, innerMnt, false, "-extpass=echo test"); err == nil {
+		test_helpers.UnmountPanic(innerMnt)
+		t.Fatal("mount without -allow_nested should have failed")
+	}
+	test_helpers.MountOrFatal(t, inner, innerMnt, "-extpass=echo test", "-allow_nested")
+	test_helpers.UnmountPanic(innerMnt)
+}
+
+// TestUnmountStale kills a gocryptfs process to leave a stale mount behind,
+// and checks that mounting again fails with a clear error, or cleans up with
+// -unmount_stale.
+func TestUnmountStale(t *testing.T) {
+	dir := test_helpers.InitFS(t)
+	mnt := dir + ".mnt"
+	test_helpers.MountOrFatal(t, dir, mnt, "-extpass=echo test")
+	syscall.Kill(test_helpers.MountInfo[mnt].Pid, syscall.SIGKILL)
+	delete(test_helpers.MountInfo, mnt)
+	var err error
+	for i := 0; i < 100; i++ {
+		if _, err = os.Stat(mnt); err != nil {
+			break
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	if !errors.Is(err, syscall.ENOTCONN) {
+		t.Fatalf("mount is not stale: %v", err)
+	}
+	cmd := exec.Command(test_helpers.GocryptfsBinary, "-extpass=echo test", dir, mnt)
+	out, err := cmd.CombinedOutput()
+	if exitCode := test_helpers.ExtractCmdExitCode(err); exitCode != exitcodes.MountPoint {
+		t.Errorf("wrong exit code: have=%d, want=%d", exitCode, exitcodes.MountPoint)
+	}
+	if !strings.Contains(string(out), "stale FUSE mount") {
+		t.Errorf("unexpected output: %q", out)
+	}
+	test_helpers.MountOrFatal(t, dir, mnt, "-extpass=echo test", "-unmount_stale")
+	defer test_helpers.UnmountPanic(mnt)
+	if err = ioutil.WriteFile(mnt+"/foo", []byte("bar"), 0600); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// TestSignalsKeepMount sends signals that are ignored by default to a
+// running mount and checks that the interrupted reads from /dev/fuse do not
+// end the serve loop.
+func TestSignalsKeepMount(t *testing.T) {
+	dir := test_helpers.InitFS(t)
+	mnt := dir + ".mnt"
+	test_helpers.MountOrFatal(t, dir, mnt, "-extpass=echo test")
+	defer test_helpers.UnmountPanic(mnt)
+	pid := test_helpers.MountInfo[mnt].Pid
+	for i, sig := range []syscall.Signal{syscall.SIGCHLD, syscall.SIGWINCH, syscall.SIGURG} {
+		if err := syscall.Kill(pid, sig); err != nil {
+			t.Fatal(err)
+		}
+		// Give the signal time to arrive
+		time.Sleep(50 * time.Millisecond)
+		want := []byte(fmt.Sprintf("file %d", i))
+		if err := ioutil.WriteFile(mnt+"/foo", want, 0600); err != nil {
+			t.Fatalf("after %v: %v", sig, err)
+		}
+		if have, err := ioutil.ReadFile(mnt + "/foo"); err != nil || !bytes.Equal(have, want) {
+			t.Fatalf("after %v: have %q, err=%v", sig, have, err)
+		}
+	}
+}
+
+// TestSigtermUnmounts sends SIGTERM to a running mount and checks that the
+// process exits and leaves no mount behind.
+func TestSigtermUnmounts(t *testing.T) {
+	dir := test_helpers.InitFS(t)
+	mnt := dir + ".mnt"
+	test_helpers.MountOrFatal(t, dir, mnt, "-extpass=echo test")
+	if err := ioutil.WriteFile(mnt+"/foo", []byte("bar"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	pid := test_helpers.MountInfo[mnt].Pid
+	delete(test_helpers.MountInfo, mnt)
+	if err := syscall.Kill(pid, syscall.SIGTERM); err != nil {
+		t.Fatal(err)
+	}
+	// Mount() reaps the process in the background
+	var err error
+	for i := 0; i < 200; i++ {
+		if err = syscall.Kill(pid, 0); err == syscall.ESRCH {
+			break
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	if err != syscall.ESRCH {
+		t.Fatalf("process %d still running after SIGTERM", pid)
+	}
+	// A mountpoint that is no longer mounted is on the same device as its
+	// parent directory
+	var st, parent syscall.Stat_t
+	if err = syscall.Stat(mnt, &st); err != nil {
+		t.Fatalf("mountpoint not accessible: %v", err)
+	}
+	if err = syscall.Stat(dir+"/..", &parent); err != nil {
+		t.Fatal(err)
+	}
+	if st.Dev != parent.Dev {
+		t.Fatalf("%q is still mounted", mnt)
+	}
+	test_helpers.MountOrFatal(t, dir, mnt, "-extpass=echo test")
+	defer test_helpers.UnmountPanic(mnt)
+	if have, err := ioutil.ReadFile(mnt + "/foo"); err != nil || string(have) != "bar" {
+		t.Errorf("have %q, err=%v", have, err)
+	}
+}
+
+// TestSparse copies a sparse image through a "-sparse" mount and checks
+// that the backing file stays sparse.
+func TestSparse(t *testing.T) {
+	dir := test_helpers.InitFS(t)
+	mnt := dir + ".mnt"
+	test_helpers.MountOrFatal(t, dir, mnt, "-extpass=echo test", "-sparse")
+	defer test_helpers.UnmountPanic(mnt)
+	image := make([]byte, 4*1024*1024)
+	copy(image, "boot sector")
+	copy(image[len(image)-100:], "end")
+	if err := ioutil.WriteFile(mnt+"/image", image, 0600); err != nil {
+		t.Fatal(err)
+	}
+	have, err := ioutil.ReadFile(mnt + "/image")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(have, image) {
+		t.Error("content changed")
+	}
+	entries, err := ioutil.ReadDir(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, e := range entries {
+		if e.Name() == "gocryptfs.conf" || e.Name() == "gocryptfs.diriv" {
+			continue
+		}
+		st := e.Sys().(*syscall.Stat_t)
+		if st.Blocks*512 > 64*1024 {
+			t.Errorf("backing file %q is not sparse: %d bytes allocated", e.Name(), st.Blocks*512)
+		}
+	}
+}
+
+// TestDirectIO mounts with -direct_io and does read/write round trips with
+// unaligned sizes and offsets. A change made through a second mount must be
+// visible right away, as there is no page cache that could be stale.
+func TestDirectIO(t *testing.T) {
+	dir := test_helpers.InitFS(t)
+	mnt := dir + ".mnt"
+	test_helpers.MountOrFatal(t, dir, mnt, "-extpass=echo test", "-direct_io")
+	defer test_helpers.UnmountPanic(mnt)
+	f, err := os.OpenFile(mnt+"/foo", os.O_RDWR|os.O_CREATE, 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	var want []byte
+	for i, size := range []int{1, 4095, 4097, 100, 131072, 7} {
+		data := bytes.Repeat([]byte{byte('a' + i)}, size)
+		off := len(want) / 3
+		if _, err := f.WriteAt(data, int64(off)); err != nil {
+			t.Fatal(err)
+		}
+		if end := off + size; end > len(want) {
+			want = append(want, make([]byte, end-len(want))...)
+		}
+		copy(want[off:], data)
+		have := make([]byte, len(want)-off+10)
+		n, err := f.ReadAt(have, int64(off))
+		if err != nil && err != io.EOF {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(have[:n], want[off:]) {
+			t.Fatalf("size=%d off=%d: content mismatch", size, off)
+		}
+	}
+	if _, err := f.Seek(0, 0); err != nil {
+		t.Fatal(err)
+	}
+	if have, err := ioutil.ReadAll(f); err != nil || !bytes.Equal(have, want) {
+		t.Fatalf("sequential read: content mismatch, err=%v", err)
+	}
+
+	// Overwrite a part through a second mount of the same CIPHERDIR
+	mnt2 := dir + ".mnt2"
+	test_helpers.MountOrFatal(t, dir, mnt2, "-extpass=echo test", "-sharedstorage")
+	defer test_helpers.UnmountPanic(mnt2)
+	f2, err := os.OpenFile(mnt2+"/foo", os.O_WRONLY, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err = f2.WriteAt([]byte("xyz"), 5000); err != nil {
+		t.Fatal(err)
+	}
+	f2.Close()
+	have := make([]byte, 3)
+	if _, err = f.ReadAt(have, 5000); err != nil || string(have) != "xyz" {
+		t.Errorf("the change from the second mount is not visible: %q, err=%v", have, err)
+	}
+	// -kernel_cache is the opposite and is rejected
+	if err = test_helpers.Mount(dir, dir+".mnt3", false, "-extpass=echo test", "-direct_io", "-kernel_cache"); err == nil {
+		test_helpers.UnmountPanic(dir + ".mnt3")
+		t.Error("-direct_io together with -kernel_cache should have failed")
+	}
+}
+
+// TestPrefix mounts a subdirectory with -prefix and checks that it appears as
+// the root of the mount.
+func TestPrefix(t *testing.T) {
+	dir := test_helpers.InitFS(t)
+	mnt := dir + ".mnt"
+	test_helpers.MountOrFatal(t, dir, mnt, "-extpass=echo test")
+	if err := os.MkdirAll(mnt+"/data/2024/sub", 0700); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(mnt+"/data/2024/report", []byte("hello"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	test_helpers.UnmountPanic(mnt)
+
+	test_helpers.MountOrFatal(t, dir, mnt, "-extpass=echo test", "-prefix=/data/2024/")
+	defer test_helpers.UnmountPanic(mnt)
+	fis, err := ioutil.ReadDir(mnt)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var names []string
+	for _, fi := range fis {
+		names = append(names, fi.Name())
+	}
+	if strings.Join(names, " ") != "report sub" {
+		t.Errorf("wrong listing %q", names)
+	}
+	if have, err := ioutil.ReadFile(mnt + "/report"); err != nil || string(have) != "hello" {
+		t.Errorf("have %q, err=%v", have, err)
+	}
+	// A nonexistent prefix is rejected
+	if err = test_helpers.Mount(dir, dir+".mnt2", false, "-extpass=echo test", "-prefix=nonexistent"); err == nil {
+		test_helpers.UnmountPanic(dir + ".mnt2")
+		t.Error("mount with a nonexistent -prefix should have failed")
+	}
+}
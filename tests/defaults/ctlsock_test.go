@@ -2,8 +2,10 @@ package defaults
 
 import (
 	"os"
+	"strings"
 	"syscall"
 	"testing"
+	"time"
 
 	"github.com/rfjakob/gocryptfs/ctlsock"
 	"github.com/rfjakob/gocryptfs/tests/test_helpers"
@@ -39,6 +41,54 @@ func TestCtlSock(t *testing.T) {
 	}
 }
 
+// TestCtlSockListOpenFiles checks that -ctlsock lists two open files with
+// their flags, and nothing once they are closed.
+func TestCtlSockListOpenFiles(t *testing.T) {
+	cDir := test_helpers.InitFS(t)
+	pDir := cDir + ".mnt"
+	sock := cDir + ".sock"
+	test_helpers.MountOrFatal(t, cDir, pDir, "-ctlsock="+sock, "-extpass", "echo test")
+	defer test_helpers.UnmountPanic(pDir)
+	f1, err := os.OpenFile(pDir+"/file1", os.O_WRONLY|os.O_CREATE, 0200)
+	if err != nil {
+		t.Fatal(err)
+	}
+	f1.Close()
+	// file1 is write-only, gocryptfs has to chmod it to open it O_RDWR.
+	// Root can open it anyway.
+	f1, err = os.OpenFile(pDir+"/file1", os.O_WRONLY|os.O_APPEND, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	f2, err := os.Create(pDir + "/file2")
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp := test_helpers.QueryCtlSock(t, sock, ctlsock.RequestStruct{ListOpenFiles: true})
+	if len(resp.OpenFiles) != 2 {
+		t.Fatalf("want 2 open files, have %+v", resp)
+	}
+	o1, o2 := resp.OpenFiles[0], resp.OpenFiles[1]
+	if o1.Path != "file1" || !strings.HasPrefix(o1.Flags, "O_WRONLY|O_APPEND") ||
+		!strings.HasPrefix(o1.BackingFlags, "O_RDWR") || o1.WriteOnlyChmod != (os.Getuid() != 0) {
+		t.Errorf("wrong entry for file1: %+v", o1)
+	}
+	if o2.Path != "file2" || !strings.HasPrefix(o2.Flags, "O_RDWR") {
+		t.Errorf("wrong entry for file2: %+v", o2)
+	}
+	f1.Close()
+	f2.Close()
+	// The kernel sends RELEASE asynchronously after close(2)
+	for i := 0; i < 100; i++ {
+		resp = test_helpers.QueryCtlSock(t, sock, ctlsock.RequestStruct{ListOpenFiles: true})
+		if len(resp.OpenFiles) == 0 {
+			return
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	t.Errorf("files are still listed after close: %+v", resp.OpenFiles)
+}
+
 func TestCtlSockDecrypt(t *testing.T) {
 	cDir := test_helpers.InitFS(t)
 	pDir := cDir + ".mnt"
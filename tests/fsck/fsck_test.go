@@ -2,6 +2,7 @@ package fsck
 
 import (
 	"encoding/base64"
+	"io/ioutil"
 	"os"
 	"os/exec"
 	"runtime"
@@ -89,6 +90,39 @@ func TestExampleFses(t *testing.T) {
 	dirfd.Close()
 }
 
+// TestFsckExclude checks that fsck does not walk excluded directories, but
+// their siblings
+func TestFsckExclude(t *testing.T) {
+	// Plaintext names so we know which backing file to corrupt
+	cDir := test_helpers.InitFS(t, "-plaintextnames")
+	for _, d := range []string{"node_modules", "src"} {
+		if err := os.Mkdir(cDir+"/"+d, 0700); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// No valid header, reading it fails
+	junk := []byte("this file was not written by gocryptfs")
+	if err := ioutil.WriteFile(cDir+"/node_modules/corrupt", junk, 0600); err != nil {
+		t.Fatal(err)
+	}
+	fsck := func() int {
+		cmd := exec.Command(test_helpers.GocryptfsBinary, "-fsck", "-extpass", "echo test",
+			"-exclude-wildcard", "node_modules", cDir)
+		out, err := cmd.CombinedOutput()
+		t.Log(string(out))
+		return test_helpers.ExtractCmdExitCode(err)
+	}
+	if code := fsck(); code != 0 {
+		t.Errorf("excluded corrupt file: exit code %d, want 0", code)
+	}
+	if err := ioutil.WriteFile(cDir+"/src/corrupt", junk, 0600); err != nil {
+		t.Fatal(err)
+	}
+	if code := fsck(); code != exitcodes.FsckErrors {
+		t.Errorf("corrupt file next to the excluded dir: exit code %d, want %d", code, exitcodes.FsckErrors)
+	}
+}
+
 // TestTerabyteFile verifies that fsck does something intelligent when it hits
 // a 1-terabyte sparse file (trying to read the whole file is not intelligent).
 func TestTerabyteFile(t *testing.T) {
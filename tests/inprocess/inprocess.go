@@ -0,0 +1,382 @@
+// Package inprocess drives the gocryptfs FUSE frontend directly from Go,
+// without a kernel mount. FS translates path-based calls into the same node
+// and file handle methods the kernel would call through go-fuse, so tests
+// exercise the complete name encryption, content encryption and block
+// framing code, but need neither /dev/fuse nor root.
+//
+// This does not test anything the kernel adds on top (caching, permission
+// checks with default_permissions, splitting of large requests). Use a real
+// mount for that.
+package inprocess
+
+import (
+	"io"
+	"path/filepath"
+	"strings"
+	"syscall"
+
+	"github.com/hanwen/go-fuse/v2/fs"
+	"github.com/hanwen/go-fuse/v2/fuse"
+
+	"github.com/rfjakob/gocryptfs/internal/configfile"
+	"github.com/rfjakob/gocryptfs/internal/contentenc"
+	"github.com/rfjakob/gocryptfs/internal/cryptocore"
+	"github.com/rfjakob/gocryptfs/internal/fusefrontend"
+	"github.com/rfjakob/gocryptfs/internal/nametransform"
+)
+
+// FS is an unmounted gocryptfs filesystem. Paths are relative to the root of
+// the plaintext view and use "/" as the separator. Errors are returned as
+// syscall.Errno, just like a mount would report them.
+type FS struct {
+	rn    *fusefrontend.RootNode
+	cCore *cryptocore.CryptoCore
+}
+
+// New unlocks the gocryptfs filesystem in "cipherdir" with "password". The
+// feature flags from the config file override the corresponding fields in
+// "args", like they do on mount. args.Cipherdir is set by New.
+func New(cipherdir string, password []byte, args fusefrontend.Args) (*FS, error) {
+	masterkey, cf, err := configfile.LoadAndDecrypt(filepath.Join(cipherdir, configfile.ConfDefaultName), password)
+	if err != nil {
+		return nil, err
+	}
+	args.Cipherdir = cipherdir
+	args.PlaintextNames = cf.IsFeatureFlagSet(configfile.FlagPlaintextNames)
+	args.Fanout = cf.IsFeatureFlagSet(configfile.FlagFanout)
+	args.FileTags = cf.IsFeatureFlagSet(configfile.FlagFileTags)
+	args.LongNames = true
+	backend := cryptocore.BackendGoGCM
+	if cf.IsFeatureFlagSet(configfile.FlagAESSIV) {
+		backend = cryptocore.BackendAESSIV
+	}
+	cCore := cryptocore.New(masterkey, backend, contentenc.DefaultIVBits, cf.IsFeatureFlagSet(configfile.FlagHKDF), false)
+	for i := range masterkey {
+		masterkey[i] = 0
+	}
+	cEnc := contentenc.New(cCore, contentenc.DefaultBS, false, args.FileTags)
+	nameTransform := nametransform.New(cCore.EMECipher, args.LongNames, cf.IsFeatureFlagSet(configfile.FlagRaw64))
+	nameTransform.NameEnc, err = nametransform.NewNameEncoding(cf.NameEncoding, cf.IsFeatureFlagSet(configfile.FlagRaw64))
+	if err != nil {
+		cCore.Wipe()
+		return nil, err
+	}
+	rn := fusefrontend.NewRootNode(args, cEnc, nameTransform)
+	// Sets up the inode tree. This is what a mount would do as well.
+	fs.NewNodeFS(rn, &fs.Options{})
+	return &FS{rn: rn, cCore: cCore}, nil
+}
+
+// Close wipes the keys from memory. The FS must not be used afterwards.
+func (f *FS) Close() {
+	f.cCore.Wipe()
+}
+
+// RootNode returns the frontend root node, for tests that need to call into
+// the frontend directly.
+func (f *FS) RootNode() *fusefrontend.RootNode {
+	return f.rn
+}
+
+func toErr(errno syscall.Errno) error {
+	if errno == 0 {
+		return nil
+	}
+	return errno
+}
+
+func toNode(ch *fs.Inode) *fusefrontend.Node {
+	if rn, ok := ch.Operations().(*fusefrontend.RootNode); ok {
+		return &rn.Node
+	}
+	return ch.Operations().(*fusefrontend.Node)
+}
+
+// lookup walks "path" one component at a time, like the kernel does.
+func (f *FS) lookup(path string) (*fusefrontend.Node, error) {
+	n := &f.rn.Node
+	for _, name := range strings.Split(path, "/") {
+		if name == "" || name == "." {
+			continue
+		}
+		if ch := n.GetChild(name); ch != nil {
+			n = toNode(ch)
+			continue
+		}
+		ch, errno := n.Lookup(nil, name, &fuse.EntryOut{})
+		if errno != 0 {
+			return nil, errno
+		}
+		n.AddChild(name, ch, true)
+		n = toNode(ch)
+	}
+	return n, nil
+}
+
+// lookupParent returns the node of the directory that contains "path", and
+// the last path component.
+func (f *FS) lookupParent(path string) (*fusefrontend.Node, string, error) {
+	dir, name := filepath.Split(filepath.Clean("/" + path))
+	if name == "" {
+		// "path" is the root directory
+		return nil, "", syscall.EINVAL
+	}
+	n, err := f.lookup(dir)
+	return n, name, err
+}
+
+// Stat returns the attributes of "path". Symlinks are not followed.
+func (f *FS) Stat(path string) (fuse.Attr, error) {
+	n, err := f.lookup(path)
+	if err != nil {
+		return fuse.Attr{}, err
+	}
+	var out fuse.AttrOut
+	errno := n.Getattr(nil, nil, &out)
+	return out.Attr, toErr(errno)
+}
+
+// Mkdir creates the directory "path".
+func (f *FS) Mkdir(path string, mode uint32) error {
+	n, name, err := f.lookupParent(path)
+	if err != nil {
+		return err
+	}
+	ch, errno := n.Mkdir(nil, name, mode, &fuse.EntryOut{})
+	if errno != 0 {
+		return errno
+	}
+	n.AddChild(name, ch, true)
+	return nil
+}
+
+// Rmdir deletes the empty directory "path".
+func (f *FS) Rmdir(path string) error {
+	n, name, err := f.lookupParent(path)
+	if err != nil {
+		return err
+	}
+	if errno := n.Rmdir(nil, name); errno != 0 {
+		return errno
+	}
+	n.RmChild(name)
+	return nil
+}
+
+// Unlink deletes the file "path".
+func (f *FS) Unlink(path string) error {
+	n, name, err := f.lookupParent(path)
+	if err != nil {
+		return err
+	}
+	if errno := n.Unlink(nil, name); errno != 0 {
+		return errno
+	}
+	n.RmChild(name)
+	return nil
+}
+
+// Rename renames "oldPath" to "newPath", replacing "newPath" if it exists.
+func (f *FS) Rename(oldPath string, newPath string) error {
+	n1, name1, err := f.lookupParent(oldPath)
+	if err != nil {
+		return err
+	}
+	n2, name2, err := f.lookupParent(newPath)
+	if err != nil {
+		return err
+	}
+	if errno := n1.Rename(nil, name1, n2, name2, 0); errno != 0 {
+		return errno
+	}
+	// The bridge moves the inode after a successful rename, so do we
+	n1.MvChild(name1, n2.EmbeddedInode(), name2, true)
+	return nil
+}
+
+// Symlink creates the symlink "path" pointing to "target".
+func (f *FS) Symlink(target string, path string) error {
+	n, name, err := f.lookupParent(path)
+	if err != nil {
+		return err
+	}
+	ch, errno := n.Symlink(nil, target, name, &fuse.EntryOut{})
+	if errno != 0 {
+		return errno
+	}
+	n.AddChild(name, ch, true)
+	return nil
+}
+
+// Readlink returns the target of the symlink "path".
+func (f *FS) Readlink(path string) (string, error) {
+	n, err := f.lookup(path)
+	if err != nil {
+		return "", err
+	}
+	target, errno := n.Readlink(nil)
+	return string(target), toErr(errno)
+}
+
+// Readdir returns the names in the directory "path", without "." and "..".
+func (f *FS) Readdir(path string) ([]string, error) {
+	n, err := f.lookup(path)
+	if err != nil {
+		return nil, err
+	}
+	ds, errno := n.Readdir(nil)
+	if errno != 0 {
+		return nil, errno
+	}
+	var names []string
+	for ds.HasNext() {
+		e, errno := ds.Next()
+		if errno != 0 {
+			return nil, errno
+		}
+		if e.Name == "." || e.Name == ".." {
+			continue
+		}
+		names = append(names, e.Name)
+	}
+	return names, nil
+}
+
+// Truncate sets the size of the file "path", without opening it.
+func (f *FS) Truncate(path string, size uint64) error {
+	n, err := f.lookup(path)
+	if err != nil {
+		return err
+	}
+	in := fuse.SetAttrIn{}
+	in.Valid = fuse.FATTR_SIZE
+	in.Size = size
+	return toErr(n.Setattr(nil, nil, &in, &fuse.AttrOut{}))
+}
+
+// Create creates the file "path", which must not exist yet, and opens it
+// read-write.
+func (f *FS) Create(path string, mode uint32) (*File, error) {
+	n, name, err := f.lookupParent(path)
+	if err != nil {
+		return nil, err
+	}
+	ch, fh, _, errno := n.Create(nil, name, syscall.O_RDWR|syscall.O_EXCL, mode, &fuse.EntryOut{})
+	if errno != 0 {
+		return nil, errno
+	}
+	n.AddChild(name, ch, true)
+	return &File{fh: fh.(*fusefrontend.File)}, nil
+}
+
+// maxSymlinks is how many symlinks Open follows before it gives up with
+// ELOOP, like MAXSYMLINKS in Linux.
+const maxSymlinks = 40
+
+// Open opens the existing file "path". "flags" are the open(2) flags.
+//
+// If "path" is a symlink, Open follows it like the kernel does before it
+// sends the FUSE open. With O_NOFOLLOW, it fails with ELOOP instead. Absolute
+// symlink targets point outside of the mount and fail with EXDEV.
+func (f *FS) Open(path string, flags int) (*File, error) {
+	n, err := f.lookup(path)
+	if err != nil {
+		return nil, err
+	}
+	for i := 0; n.Mode()&syscall.S_IFMT == syscall.S_IFLNK; i++ {
+		if flags&syscall.O_NOFOLLOW != 0 || i == maxSymlinks {
+			return nil, syscall.ELOOP
+		}
+		target, errno := n.Readlink(nil)
+		if errno != 0 {
+			return nil, errno
+		}
+		if filepath.IsAbs(string(target)) {
+			return nil, syscall.EXDEV
+		}
+		path = filepath.Join("/", filepath.Dir(path), string(target))
+		if n, err = f.lookup(path); err != nil {
+			return nil, err
+		}
+	}
+	fh, _, errno := n.Open(nil, uint32(flags))
+	if errno != 0 {
+		return nil, errno
+	}
+	return &File{fh: fh.(*fusefrontend.File)}, nil
+}
+
+// File is an open file in an FS. Reads and writes are split into requests of
+// at most fuse.MAX_KERNEL_WRITE bytes, like the kernel does.
+type File struct {
+	fh *fusefrontend.File
+}
+
+// ReadAt reads len(p) bytes at offset "off". Like os.File.ReadAt, it returns
+// io.EOF if fewer bytes are available.
+func (f *File) ReadAt(p []byte, off int64) (int, error) {
+	var done int
+	for done < len(p) {
+		buf := p[done:]
+		if len(buf) > fuse.MAX_KERNEL_WRITE {
+			buf = buf[:fuse.MAX_KERNEL_WRITE]
+		}
+		res, errno := f.fh.Read(nil, buf, off+int64(done))
+		if errno != 0 {
+			return done, errno
+		}
+		data, status := res.Bytes(buf)
+		if !status.Ok() {
+			return done, syscall.Errno(status)
+		}
+		// Read may return its own buffer
+		n := copy(p[done:], data)
+		done += n
+		if n < len(buf) {
+			return done, io.EOF
+		}
+	}
+	return done, nil
+}
+
+// WriteAt writes "p" at offset "off".
+func (f *File) WriteAt(p []byte, off int64) (int, error) {
+	var done int
+	for done < len(p) {
+		buf := p[done:]
+		if len(buf) > fuse.MAX_KERNEL_WRITE {
+			buf = buf[:fuse.MAX_KERNEL_WRITE]
+		}
+		n, errno := f.fh.Write(nil, buf, off+int64(done))
+		done += int(n)
+		if errno != 0 {
+			return done, errno
+		}
+	}
+	return done, nil
+}
+
+// Truncate sets the size of the file through the open file handle.
+func (f *File) Truncate(size uint64) error {
+	in := fuse.SetAttrIn{}
+	in.Valid = fuse.FATTR_SIZE
+	in.Size = size
+	return toErr(f.fh.Setattr(nil, &in, &fuse.AttrOut{}))
+}
+
+// Stat returns the attributes of the open file.
+func (f *File) Stat() (fuse.Attr, error) {
+	var out fuse.AttrOut
+	errno := f.fh.Getattr(nil, &out)
+	return out.Attr, toErr(errno)
+}
+
+// Close flushes and releases the file, like close(2) on the last file
+// descriptor does.
+func (f *File) Close() error {
+	errno := f.fh.Flush(nil)
+	if errno2 := f.fh.Release(nil); errno == 0 {
+		errno = errno2
+	}
+	return toErr(errno)
+}
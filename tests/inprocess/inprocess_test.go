@@ -0,0 +1,389 @@
+package inprocess
+
+import (
+	"bytes"
+	"io"
+	"io/ioutil"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"syscall"
+	"testing"
+
+	"github.com/rfjakob/gocryptfs/internal/contentenc"
+	"github.com/rfjakob/gocryptfs/internal/fusefrontend"
+	"github.com/rfjakob/gocryptfs/internal/nametransform"
+	"github.com/rfjakob/gocryptfs/tests/test_helpers"
+)
+
+func newFS(t *testing.T) *FS {
+	cipherdir := test_helpers.InitFS(t)
+	f, err := New(cipherdir, []byte("test"), fusefrontend.Args{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return f
+}
+
+// verifyContent checks that "path" has exactly the content "want", both
+// through the open file "f" and after reopening.
+func verifyContent(t *testing.T, fs *FS, f *File, path string, want []byte) {
+	t.Helper()
+	check := func(f *File) {
+		t.Helper()
+		attr, err := f.Stat()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if attr.Size != uint64(len(want)) {
+			t.Fatalf("wrong size: have %d, want %d", attr.Size, len(want))
+		}
+		// Read one byte more than there is to see the EOF
+		have := make([]byte, len(want)+1)
+		n, err := f.ReadAt(have, 0)
+		if err != io.EOF {
+			t.Fatalf("want io.EOF, got %v", err)
+		}
+		if !bytes.Equal(have[:n], want) {
+			t.Fatalf("content mismatch: have %d bytes, want %d", n, len(want))
+		}
+	}
+	check(f)
+	f2, err := fs.Open(path, syscall.O_RDONLY)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f2.Close()
+	check(f2)
+}
+
+// TestReadWrite writes random data at random offsets, including unaligned
+// writes across block boundaries and writes that leave holes, and compares
+// the result to the same writes done on a byte slice.
+func TestReadWrite(t *testing.T) {
+	fs := newFS(t)
+	defer fs.Close()
+	f, err := fs.Create("file", 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	rnd := rand.New(rand.NewSource(1))
+	var want []byte
+	for i := 0; i < 50; i++ {
+		off := rnd.Intn(300 * 1024)
+		data := make([]byte, rnd.Intn(200*1024))
+		rnd.Read(data)
+		if _, err = f.WriteAt(data, int64(off)); err != nil {
+			t.Fatal(err)
+		}
+		if end := off + len(data); end > len(want) {
+			want = append(want, make([]byte, end-len(want))...)
+		}
+		copy(want[off:], data)
+	}
+	verifyContent(t, fs, f, "file", want)
+}
+
+// TestTruncate shrinks and grows a file, through the path and through the open
+// file handle, with sizes inside and at the edges of blocks.
+func TestTruncate(t *testing.T) {
+	fs := newFS(t)
+	defer fs.Close()
+	f, err := fs.Create("file", 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	want := make([]byte, 100*1024)
+	rand.New(rand.NewSource(2)).Read(want)
+	if _, err = f.WriteAt(want, 0); err != nil {
+		t.Fatal(err)
+	}
+	for i, size := range []int{50000, 4096, 4095, 0, 1, 12345, 200 * 1024, 8192, 70000} {
+		if i%2 == 0 {
+			err = fs.Truncate("file", uint64(size))
+		} else {
+			err = f.Truncate(uint64(size))
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		if size < len(want) {
+			want = want[:size]
+		} else {
+			// Growing a file fills it with zeros
+			want = append(want, make([]byte, size-len(want))...)
+		}
+		verifyContent(t, fs, f, "file", want)
+	}
+}
+
+// TestMasterKeyLen checks that a filesystem with a non-default master key
+// length works.
+func TestMasterKeyLen(t *testing.T) {
+	cipherdir := test_helpers.InitFS(t, "-masterkey_len=64")
+	fs, err := New(cipherdir, []byte("test"), fusefrontend.Args{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer fs.Close()
+	f, err := fs.Create("file", 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	want := make([]byte, 10000)
+	rand.New(rand.NewSource(3)).Read(want)
+	if _, err = f.WriteAt(want, 0); err != nil {
+		t.Fatal(err)
+	}
+	verifyContent(t, fs, f, "file", want)
+}
+
+// TestNameEncoding creates files with names around the long name threshold
+// on a filesystem that uses base32, and checks that all encrypted names are
+// lower-case.
+func TestNameEncoding(t *testing.T) {
+	cipherdir := test_helpers.InitFS(t, "-name_encoding=base32")
+	fs, err := New(cipherdir, []byte("test"), fusefrontend.Args{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer fs.Close()
+	var want []string
+	for _, l := range []int{1, 143, 144, 255} {
+		name := strings.Repeat("x", l)
+		f, err := fs.Create(name, 0600)
+		if err != nil {
+			t.Fatalf("len=%d: %v", l, err)
+		}
+		if _, err = f.WriteAt([]byte(name), 0); err != nil {
+			t.Fatal(err)
+		}
+		f.Close()
+		want = append(want, name)
+	}
+	names, err := fs.Readdir("")
+	if err != nil {
+		t.Fatal(err)
+	}
+	sort.Strings(names)
+	if strings.Join(names, " ") != strings.Join(want, " ") {
+		t.Errorf("wrong dir content: %d entries", len(names))
+	}
+	f, err := fs.Open(want[2], syscall.O_RDONLY)
+	if err != nil {
+		t.Fatal(err)
+	}
+	verifyContent(t, fs, f, want[2], []byte(want[2]))
+	f.Close()
+	cNames, err := ioutil.ReadDir(cipherdir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var long int
+	for _, fi := range cNames {
+		if strings.ToLower(fi.Name()) != fi.Name() {
+			t.Errorf("encrypted name %q is not lower-case", fi.Name())
+		}
+		if nametransform.IsLongContent(fi.Name()) {
+			long++
+		}
+	}
+	// 144 and 255 bytes are too long for base32
+	if long != 2 {
+		t.Errorf("want 2 long names, have %d", long)
+	}
+}
+
+// TestDirOps checks directory operations, including long names and
+// renames between directories.
+func TestDirOps(t *testing.T) {
+	fs := newFS(t)
+	defer fs.Close()
+	long := strings.Repeat("l", 200)
+	if err := fs.Mkdir("dir", 0700); err != nil {
+		t.Fatal(err)
+	}
+	if err := fs.Mkdir("dir/"+long, 0700); err != nil {
+		t.Fatal(err)
+	}
+	f, err := fs.Create("dir/"+long+"/file", 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err = f.WriteAt([]byte("hello"), 0); err != nil {
+		t.Fatal(err)
+	}
+	f.Close()
+	if err = fs.Symlink("dir/"+long+"/file", "link"); err != nil {
+		t.Fatal(err)
+	}
+	if err = fs.Rename("dir/"+long+"/file", "moved"); err != nil {
+		t.Fatal(err)
+	}
+	names, err := fs.Readdir("")
+	if err != nil {
+		t.Fatal(err)
+	}
+	sort.Strings(names)
+	if strings.Join(names, " ") != "dir link moved" {
+		t.Errorf("wrong root dir content %q", names)
+	}
+	if target, err := fs.Readlink("link"); err != nil || target != "dir/"+long+"/file" {
+		t.Errorf("Readlink: %q %v", target, err)
+	}
+	if _, err = fs.Stat("dir/" + long + "/file"); err != syscall.ENOENT {
+		t.Errorf("want ENOENT for the old name, got %v", err)
+	}
+	f, err = fs.Open("moved", syscall.O_RDONLY)
+	if err != nil {
+		t.Fatal(err)
+	}
+	verifyContent(t, fs, f, "moved", []byte("hello"))
+	f.Close()
+	// Non-empty directories cannot be removed
+	if err = fs.Rmdir("dir"); err != syscall.ENOTEMPTY {
+		t.Errorf("want ENOTEMPTY, got %v", err)
+	}
+	for _, p := range []string{"dir/" + long, "dir"} {
+		if err = fs.Rmdir(p); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for _, p := range []string{"moved", "link"} {
+		if err = fs.Unlink(p); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if names, err = fs.Readdir(""); err != nil || len(names) != 0 {
+		t.Errorf("root dir should be empty: %q %v", names, err)
+	}
+}
+
+// TestOpenSymlink checks that Open follows symlinks, also chains of them,
+// unless O_NOFOLLOW is passed, and that the frontend itself refuses to open
+// the backing symlink.
+func TestOpenSymlink(t *testing.T) {
+	fs := newFS(t)
+	defer fs.Close()
+	if err := fs.Mkdir("dir", 0700); err != nil {
+		t.Fatal(err)
+	}
+	f, err := fs.Create("dir/file", 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err = f.WriteAt([]byte("hello"), 0); err != nil {
+		t.Fatal(err)
+	}
+	f.Close()
+	for _, l := range [][2]string{{"file", "dir/link"}, {"dir/link", "chain"}, {"loop", "loop"}, {"/etc/passwd", "abs"}} {
+		if err = fs.Symlink(l[0], l[1]); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for _, p := range []string{"dir/link", "chain"} {
+		f, err = fs.Open(p, syscall.O_RDONLY)
+		if err != nil {
+			t.Fatalf("%s: %v", p, err)
+		}
+		verifyContent(t, fs, f, "dir/file", []byte("hello"))
+		f.Close()
+		if _, err = fs.Open(p, syscall.O_RDONLY|syscall.O_NOFOLLOW); err != syscall.ELOOP {
+			t.Errorf("%s with O_NOFOLLOW: want ELOOP, got %v", p, err)
+		}
+	}
+	if _, err = fs.Open("loop", syscall.O_RDONLY); err != syscall.ELOOP {
+		t.Errorf("symlink loop: want ELOOP, got %v", err)
+	}
+	if _, err = fs.Open("abs", syscall.O_RDONLY); err != syscall.EXDEV {
+		t.Errorf("absolute symlink: want EXDEV, got %v", err)
+	}
+	// The kernel never asks us to open a symlink, but if somebody did, the
+	// backing open must not follow it
+	n, err := fs.lookup("dir/link")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, _, errno := n.Open(nil, syscall.O_RDONLY); errno != syscall.ELOOP {
+		t.Errorf("Node.Open on a symlink: want ELOOP, got %v", errno)
+	}
+}
+
+// TestFanout opens a filesystem created with "-fanout" and checks that the
+// entries end up in bucket directories and can be found again.
+func TestFanout(t *testing.T) {
+	cipherdir := test_helpers.InitFS(t, "-fanout")
+	fs, err := New(cipherdir, []byte("test"), fusefrontend.Args{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer fs.Close()
+	f, err := fs.Create("file", 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err = f.WriteAt([]byte("hello"), 0); err != nil {
+		t.Fatal(err)
+	}
+	f.Close()
+	// Only the config file, the diriv and the buckets are at the top level
+	entries, err := ioutil.ReadDir(cipherdir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, e := range entries {
+		switch e.Name() {
+		case "gocryptfs.conf", nametransform.DirIVFilename:
+			continue
+		}
+		if !e.IsDir() || len(e.Name()) != 2 {
+			t.Errorf("unexpected entry %q in the cipherdir", e.Name())
+		}
+	}
+	names, err := fs.Readdir("")
+	if err != nil || strings.Join(names, " ") != "file" {
+		t.Errorf("wrong root dir content %q %v", names, err)
+	}
+	f, err = fs.Open("file", syscall.O_RDONLY)
+	if err != nil {
+		t.Fatal(err)
+	}
+	verifyContent(t, fs, f, "file", []byte("hello"))
+	f.Close()
+}
+
+// TestFileTags opens a filesystem created with "-filetags" and checks that the
+// files get a tags region and can be read back.
+func TestFileTags(t *testing.T) {
+	cipherdir := test_helpers.InitFS(t, "-filetags")
+	fs, err := New(cipherdir, []byte("test"), fusefrontend.Args{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer fs.Close()
+	f, err := fs.Create("file", 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	if _, err = f.WriteAt([]byte("hello"), 0); err != nil {
+		t.Fatal(err)
+	}
+	verifyContent(t, fs, f, "file", []byte("hello"))
+	cPath, err := fs.RootNode().EncryptPath("file")
+	if err != nil {
+		t.Fatal(err)
+	}
+	fi, err := os.Stat(filepath.Join(cipherdir, cPath))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if fi.Size() < contentenc.HeaderLen+contentenc.TagsMaxLen {
+		t.Errorf("no tags region: backing file has %d bytes", fi.Size())
+	}
+}
@@ -766,6 +766,82 @@ func TestMkfifo(t *testing.T) {
 	}
 }
 
+// countFifos returns the number of fifos in the top level of the cipherdir
+func countFifos(t *testing.T) (n int) {
+	fi, err := ioutil.ReadDir(test_helpers.DefaultCipherDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, f := range fi {
+		if f.Mode()&os.ModeNamedPipe != 0 {
+			n++
+			if f.Size() != 0 {
+				t.Errorf("fifo %q has size %d in the cipherdir", f.Name(), f.Size())
+			}
+		}
+	}
+	return n
+}
+
+// TestFifoIPC passes data through a fifo inside the mount. The fifo is a
+// real fifo in the cipherdir, stored under the encrypted name. The kernel
+// implements the pipe itself, so the data does not go through gocryptfs.
+func TestFifoIPC(t *testing.T) {
+	name := "TestFifoIPC"
+	path := test_helpers.DefaultPlainDir + "/" + name
+	before := countFifos(t)
+	if err := syscall.Mkfifo(path, 0600); err != nil {
+		t.Fatal(err)
+	}
+	defer syscall.Unlink(path)
+	if n := countFifos(t); n != before+1 {
+		t.Errorf("want %d fifos in the cipherdir, have %d", before+1, n)
+	}
+	_, err := os.Lstat(test_helpers.DefaultCipherDir + "/" + name)
+	if testcase.plaintextnames && err != nil {
+		t.Errorf("fifo is not in the cipherdir under its plaintext name: %v", err)
+	} else if !testcase.plaintextnames && err == nil {
+		t.Errorf("fifo is in the cipherdir under its plaintext name")
+	}
+
+	// More than the 64 KiB a pipe buffers
+	want := make([]byte, 100000)
+	rand.Read(want)
+	errc := make(chan error, 1)
+	go func() {
+		w, err := os.OpenFile(path, os.O_WRONLY, 0)
+		if err != nil {
+			errc <- err
+			return
+		}
+		_, err = w.Write(want)
+		w.Close()
+		errc <- err
+	}()
+	r, err := os.Open(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	have, err := ioutil.ReadAll(r)
+	r.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := <-errc; err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(have, want) {
+		t.Errorf("read %d bytes from the fifo, want %d identical bytes", len(have), len(want))
+	}
+	fi, err := os.Stat(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if fi.Mode()&os.ModeNamedPipe == 0 || fi.Size() != 0 {
+		t.Errorf("wrong mode %v or size %d", fi.Mode(), fi.Size())
+	}
+}
+
 // TestMagicNames verifies that "magic" names are handled correctly
 // https://github.com/rfjakob/gocryptfs/issues/174
 func TestMagicNames(t *testing.T) {
@@ -0,0 +1,94 @@
+package reverse_test
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/rfjakob/gocryptfs/internal/configfile"
+	"github.com/rfjakob/gocryptfs/tests/test_helpers"
+)
+
+// readTree returns the content of all files below "dir", by relative path.
+// Directories are listed with a nil content.
+func readTree(t *testing.T, dir string) map[string][]byte {
+	tree := make(map[string][]byte)
+	err := filepath.Walk(dir, func(path string, fi os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		rel, err := filepath.Rel(dir, path)
+		if err != nil {
+			return err
+		}
+		if fi.IsDir() {
+			tree[rel] = nil
+			return nil
+		}
+		tree[rel], err = ioutil.ReadFile(path)
+		return err
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return tree
+}
+
+// TestReverseConfig keeps the config file outside of the plaintext directory
+// with "-reverse_config", mounts the directory twice, and checks that both
+// mounts show byte-identical ciphertext.
+func TestReverseConfig(t *testing.T) {
+	confDir, err := ioutil.TempDir(test_helpers.TmpDir, t.Name()+".conf.")
+	if err != nil {
+		t.Fatal(err)
+	}
+	conf := filepath.Join(confDir, "reverse.conf")
+	plain := test_helpers.InitFS(t, "-reverse", "-reverse_config", conf)
+	if _, err = os.Stat(filepath.Join(plain, configfile.ConfReverseName)); !os.IsNotExist(err) {
+		t.Fatalf("config file was created in the plaintext directory: %v", err)
+	}
+	if err := os.Mkdir(filepath.Join(plain, "dir"), 0700); err != nil {
+		t.Fatal(err)
+	}
+	files := map[string][]byte{
+		"small":                    []byte("hello"),
+		"dir/big":                  bytes.Repeat([]byte("0123456789"), 10000),
+		"dir/" + x240 + "longname": []byte("long"),
+	}
+	for name, content := range files {
+		if err := ioutil.WriteFile(filepath.Join(plain, name), content, 0600); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	var trees []map[string][]byte
+	for i := 0; i < 2; i++ {
+		mnt, err := ioutil.TempDir(test_helpers.TmpDir, t.Name()+".mnt.")
+		if err != nil {
+			t.Fatal(err)
+		}
+		test_helpers.MountOrFatal(t, plain, mnt, "-reverse", "-reverse_config", conf, "-extpass", "echo test")
+		trees = append(trees, readTree(t, mnt))
+		test_helpers.UnmountPanic(mnt)
+	}
+	if len(trees[0]) < len(files) {
+		t.Fatalf("only %d entries in the encrypted view", len(trees[0]))
+	}
+	for name, c0 := range trees[0] {
+		if strings.HasSuffix(name, configfile.ConfDefaultName) {
+			t.Errorf("custom config file is shown in the encrypted view as %q", name)
+		}
+		c1, ok := trees[1][name]
+		if !ok {
+			t.Errorf("%q is missing in the second mount", name)
+		} else if !bytes.Equal(c0, c1) {
+			t.Errorf("%q differs between the mounts", name)
+		}
+	}
+	if len(trees[0]) != len(trees[1]) {
+		t.Errorf("entry count differs: %d vs %d", len(trees[0]), len(trees[1]))
+	}
+}
@@ -0,0 +1,58 @@
+package main
+
+import (
+	"syscall"
+
+	"github.com/rfjakob/gocryptfs/internal/exitcodes"
+	"github.com/rfjakob/gocryptfs/internal/filehash"
+	"github.com/rfjakob/gocryptfs/internal/syscallcompat"
+	"github.com/rfjakob/gocryptfs/internal/tlog"
+)
+
+// verifyHash handles "gocryptfs -verifyhash CIPHERDIR". It checks the
+// checksums stored by "-filehash" for all files in CIPHERDIR. This only reads
+// the ciphertext, so no password is needed.
+//
+// Returns the exit code.
+func verifyHash(args *argContainer) int {
+	counts := make(map[filehash.Status]int)
+	dirfd, err := syscall.Open(args.cipherdir, syscall.O_RDONLY|syscall.O_DIRECTORY, 0)
+	if err != nil {
+		tlog.Fatal.Printf("verifyhash: %v", err)
+		return exitcodes.FileHash
+	}
+	defer syscall.Close(dirfd)
+	err = syscallcompat.Walkat(dirfd, func(dirfd int, name string, rel string, mode uint32, err error) error {
+		if err != nil {
+			tlog.Warn.Printf("verifyhash: %s: %v", rel, err)
+			return nil
+		}
+		if mode != syscall.S_IFREG {
+			return nil
+		}
+		status, err := filehash.VerifyAt(dirfd, name)
+		if err != nil {
+			tlog.Warn.Printf("verifyhash: %s: %v", rel, err)
+			counts[filehash.Mismatch]++
+			return nil
+		}
+		switch status {
+		case filehash.Mismatch:
+			tlog.Warn.Printf("verifyhash: %s: %v", rel, status)
+		case filehash.Stale:
+			tlog.Info.Printf("verifyhash: %s: %v", rel, status)
+		}
+		counts[status]++
+		return nil
+	})
+	if err != nil {
+		tlog.Fatal.Printf("verifyhash: %v", err)
+		return exitcodes.FileHash
+	}
+	tlog.Info.Printf("verifyhash: %d ok, %d mismatched, %d stale, %d without checksum",
+		counts[filehash.OK], counts[filehash.Mismatch], counts[filehash.Stale], counts[filehash.Missing])
+	if counts[filehash.Mismatch] > 0 {
+		return exitcodes.FileHash
+	}
+	return 0
+}
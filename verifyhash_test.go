@@ -0,0 +1,80 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"strings"
+	"syscall"
+	"testing"
+	"time"
+
+	"golang.org/x/sys/unix"
+
+	"github.com/rfjakob/gocryptfs/internal/exitcodes"
+	"github.com/rfjakob/gocryptfs/internal/filehash"
+	"github.com/rfjakob/gocryptfs/internal/syscallcompat"
+)
+
+// TestVerifyHashDeepPath checks that "-verifyhash" finds a checksum mismatch
+// in a file whose absolute path is longer than PATH_MAX.
+func TestVerifyHashDeepPath(t *testing.T) {
+	dir, err := ioutil.TempDir("", "TestVerifyHashDeepPath.")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	dirfd, err := syscall.Open(dir, syscall.O_RDONLY|syscall.O_DIRECTORY, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	pathLen := len(dir)
+	for i := 0; pathLen <= 4096; i++ {
+		name := fmt.Sprintf("%03d%s", i, strings.Repeat("d", 200))
+		if err = syscallcompat.Mkdirat(dirfd, name, 0700); err != nil {
+			t.Fatal(err)
+		}
+		child, err := syscallcompat.Openat(dirfd, name, syscall.O_RDONLY|syscall.O_DIRECTORY|syscall.O_NOFOLLOW, 0)
+		syscall.Close(dirfd)
+		if err != nil {
+			t.Fatal(err)
+		}
+		dirfd = child
+		pathLen += 1 + len(name)
+	}
+	defer syscall.Close(dirfd)
+	fd, err := syscallcompat.Openat(dirfd, "file", syscall.O_RDWR|syscall.O_CREAT|syscall.O_EXCL, 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer syscall.Close(fd)
+	if _, err = syscall.Pwrite(fd, []byte("content"), 0); err != nil {
+		t.Fatal(err)
+	}
+	var r filehash.Running
+	if err = r.Store(fd); err != nil {
+		if err == syscall.ENOTSUP {
+			t.Skip("no user xattrs on this filesystem")
+		}
+		t.Fatal(err)
+	}
+	args := argContainer{cipherdir: dir}
+	if code := verifyHash(&args); code != 0 {
+		t.Fatalf("intact file: want exit code 0, have %d", code)
+	}
+	// Bit rot: the content changes, size and mtime do not
+	var st unix.Stat_t
+	if err = unix.Fstat(fd, &st); err != nil {
+		t.Fatal(err)
+	}
+	if _, err = syscall.Pwrite(fd, []byte("X"), 0); err != nil {
+		t.Fatal(err)
+	}
+	mtime := time.Unix(st.Mtim.Unix())
+	if err = syscallcompat.FutimesNano(fd, &mtime, &mtime); err != nil {
+		t.Fatal(err)
+	}
+	if code := verifyHash(&args); code != exitcodes.FileHash {
+		t.Errorf("corrupted file: want exit code %d, have %d", exitcodes.FileHash, code)
+	}
+}
@@ -0,0 +1,114 @@
+package main
+
+import (
+	"net"
+	"net/http"
+	"os"
+	"os/signal"
+	"syscall"
+
+	"github.com/hanwen/go-fuse/v2/fs"
+
+	"github.com/rfjakob/gocryptfs/internal/exitcodes"
+	"github.com/rfjakob/gocryptfs/internal/fusefrontend"
+	"github.com/rfjakob/gocryptfs/internal/tlog"
+	"github.com/rfjakob/gocryptfs/internal/webdavsrv"
+)
+
+// webdavListenAddr returns the address to listen on for "-webdav ADDR". An
+// address without a host, like ":8080", listens on localhost only.
+func webdavListenAddr(addr string) (string, error) {
+	host, port, err := net.SplitHostPort(addr)
+	if err != nil {
+		return "", err
+	}
+	if host == "" {
+		host = "localhost"
+	}
+	return net.JoinHostPort(host, port), nil
+}
+
+// webdavLoopback returns true if "addr", as returned by webdavListenAddr,
+// only accepts connections from this machine
+func webdavLoopback(addr string) bool {
+	host, _, err := net.SplitHostPort(addr)
+	if err != nil {
+		return false
+	}
+	if host == "localhost" {
+		return true
+	}
+	ip := net.ParseIP(host)
+	return ip != nil && ip.IsLoopback()
+}
+
+// serveWebDAV handles "gocryptfs -webdav ADDR CIPHERDIR". It serves the
+// plaintext view of CIPHERDIR over WebDAV until SIGINT or SIGTERM.
+//
+// Returns the exit code.
+func serveWebDAV(args *argContainer) int {
+	if args.reverse {
+		tlog.Fatal.Printf("-webdav cannot be used together with -reverse")
+		os.Exit(exitcodes.Usage)
+	}
+	if args.webdav_auth == "" {
+		tlog.Fatal.Printf("-webdav needs -webdav_auth")
+		os.Exit(exitcodes.Usage)
+	}
+	user, password, err := webdavsrv.ReadAuthFile(args.webdav_auth)
+	if err != nil {
+		tlog.Fatal.Printf("-webdav_auth: %v", err)
+		os.Exit(exitcodes.Usage)
+	}
+	addr, err := webdavListenAddr(args.webdav)
+	if err != nil {
+		tlog.Fatal.Printf("-webdav: %v", err)
+		os.Exit(exitcodes.Usage)
+	}
+	if (args.webdav_cert == "") != (args.webdav_key == "") {
+		tlog.Fatal.Printf("-webdav_cert and -webdav_key must be used together")
+		os.Exit(exitcodes.Usage)
+	}
+	useTLS := args.webdav_cert != ""
+	// Basic auth credentials and file contents would go over the network
+	// in cleartext
+	if !useTLS && !webdavLoopback(addr) {
+		tlog.Fatal.Printf("-webdav: refusing to serve plain HTTP on %q, which is reachable from the network. Use -webdav_cert and -webdav_key.", addr)
+		os.Exit(exitcodes.Usage)
+	}
+	pfs, wipeKeys := initFuseFrontend(args)
+	defer wipeKeys()
+	rn := pfs.(*fusefrontend.RootNode)
+	// Set up the inode tree. No mount is created.
+	fs.NewNodeFS(rn, &fs.Options{})
+	ln, err := net.Listen("tcp", addr)
+	if err != nil {
+		tlog.Fatal.Printf("-webdav: %v", err)
+		return exitcodes.WebDAV
+	}
+	srv := &http.Server{Handler: webdavsrv.New(rn, webdavsrv.Options{
+		User:     user,
+		Password: password,
+		ReadOnly: args.ro,
+	})}
+	// Handle SIGINT & SIGTERM
+	ch := make(chan os.Signal, 1)
+	signal.Notify(ch, os.Interrupt)
+	signal.Notify(ch, syscall.SIGTERM)
+	go func() {
+		<-ch
+		srv.Close()
+	}()
+	if useTLS {
+		tlog.Info.Printf("Serving CIPHERDIR over WebDAV at https://%s/", ln.Addr())
+		err = srv.ServeTLS(ln, args.webdav_cert, args.webdav_key)
+	} else {
+		tlog.Info.Printf("Serving CIPHERDIR over WebDAV at http://%s/", ln.Addr())
+		err = srv.Serve(ln)
+	}
+	if err != http.ErrServerClosed {
+		tlog.Fatal.Printf("-webdav: %v", err)
+		return exitcodes.WebDAV
+	}
+	return 0
+}
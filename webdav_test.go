@@ -0,0 +1,33 @@
+package main
+
+import (
+	"testing"
+)
+
+// TestWebdavLoopback checks which -webdav addresses may be served over plain
+// HTTP
+func TestWebdavLoopback(t *testing.T) {
+	testCases := []struct {
+		addr     string
+		loopback bool
+	}{
+		{":8080", true},
+		{"localhost:8080", true},
+		{"127.0.0.1:8080", true},
+		{"127.1.2.3:8080", true},
+		{"[::1]:8080", true},
+		{"0.0.0.0:8080", false},
+		{"[::]:8080", false},
+		{"192.168.1.1:8080", false},
+		{"example.com:8080", false},
+	}
+	for _, tc := range testCases {
+		addr, err := webdavListenAddr(tc.addr)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if have := webdavLoopback(addr); have != tc.loopback {
+			t.Errorf("%q: want %v, have %v", tc.addr, tc.loopback, have)
+		}
+	}
+}